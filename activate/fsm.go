@@ -2,8 +2,8 @@ package activate
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"time"
@@ -24,41 +24,43 @@ const (
 	MaxRetriesRegister = 5
 )
 
+// DeviceManager defines the devicemapper operations used by the Activate
+// FSM. *devicemapper.Client implements it; tests substitute a fake.
+type DeviceManager interface {
+	DeviceExists(ctx context.Context, deviceName string) (bool, error)
+	CreateSnapshot(ctx context.Context, poolName, originID, snapshotID string) (*devicemapper.DeviceInfo, error)
+	CreateSnapshotSafe(ctx context.Context, poolName, originDeviceName, originID, snapshotID string) (*devicemapper.DeviceInfo, error)
+	ActivateDevice(ctx context.Context, poolName, deviceName, deviceID string, sizeBytes int64) error
+	MaxDeviceSize() int64
+	ThinDeviceID(ctx context.Context, deviceName string) (string, error)
+	GetDevicePath(deviceName string) string
+}
+
 // Dependencies holds external dependencies for the Activate FSM.
 type Dependencies struct {
 	DB        *database.DB
-	DeviceMgr *devicemapper.Client
+	DeviceMgr DeviceManager
 	PoolName  string
+	Retries   fsm.RetryPolicy
 }
 
-// stabilizePool forces the dm-thin pool to commit metadata and waits for kernel to settle.
-// This MUST be called after any devicemapper operation (create snapshot, activate snapshot)
-// to prevent kernel panics from operations happening too close together.
-//
-// CRITICAL: Do NOT use 'sync' command here - it can block indefinitely if dm-thin
-// devices are in a bad state, causing cascading D-state hangs.
-//
-// PERFORMANCE: With ext4 journaling disabled (-O ^has_journal), we can reduce delays.
-// The primary purpose is now just udev synchronization and metadata commit.
-func stabilizePool(poolName string) {
-	// PERFORMANCE OPTIMIZED: Minimal stabilization for dm-thin pool.
-	// With ext4 journaling disabled and 1ms sleeps proven stable, we only need
-	// a single metadata commit cycle and quick udev check.
-
-	// Force pool metadata commit using reserve/release metadata snapshot
-	// Skip the initial release - it's redundant and causes "No snapshot found" warnings
-	exec.Command("dmsetup", "message", poolName, "0", "reserve_metadata_snap").Run()
-	exec.Command("dmsetup", "message", poolName, "0", "release_metadata_snap").Run()
-
-	// Quick udev settle with zero timeout - just process pending events, don't wait
-	exec.Command("udevadm", "settle", "--timeout=0").Run()
-}
+// States of the Activate FSM. They also key Dependencies.Retries, whose
+// missing entries use the MaxRetries* constants.
+const (
+	StateCheckSnapshot  = "check-snapshot"
+	StateCreateSnapshot = "create-snapshot"
+	StateRegister       = "register"
+)
+
+// stabilizePool commits pool metadata and settles udev after a snapshot is
+// created (see devicemapper.StabilizePool). Tests replace it.
+var stabilizePool = devicemapper.StabilizePool
 
 type ImageActivateRequest = fsm.ImageActivateRequest
 type ImageActivateResponse = fsm.ImageActivateResponse
 
-// snapshotNameForImage returns a stable snapshot name for an image.
-func snapshotNameForImage(imageID string) string {
+// SnapshotNameForImage returns a stable snapshot name for an image.
+func SnapshotNameForImage(imageID string) string {
 	return fmt.Sprintf("snap-%s", imageID)
 }
 
@@ -69,8 +71,8 @@ func checkSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Imag
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for database operations
-		if retryCount > MaxRetriesCheckSnapshot {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for check-snapshot transition", MaxRetriesCheckSnapshot))
+		if limit := deps.Retries.Limit(StateCheckSnapshot, MaxRetriesCheckSnapshot); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for check-snapshot transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -82,7 +84,7 @@ func checkSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Imag
 		// Prefer request-provided snapshot name, otherwise derive.
 		snapshotName := req.Msg.SnapshotName
 		if snapshotName == "" {
-			snapshotName = snapshotNameForImage(imageID)
+			snapshotName = SnapshotNameForImage(imageID)
 		}
 
 		logger.WithFields(map[string]any{
@@ -127,6 +129,11 @@ func checkSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Imag
 			"device_path":   record.DevicePath,
 		}).Info("image already activated; skipping activation")
 
+		// Handing out the snapshot again counts as use for reap-snapshots.
+		if err := deps.DB.TouchSnapshot(ctx, record.SnapshotID); err != nil {
+			logger.WithError(err).Warn("failed to record snapshot access")
+		}
+
 		resp := &ImageActivateResponse{
 			ImageID:      record.ImageID,
 			SnapshotID:   record.SnapshotID,
@@ -135,6 +142,7 @@ func checkSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Imag
 			Active:       record.Active,
 			Activated:    false,
 			ActivatedAt:  record.CreatedAt,
+			Layout:       req.Msg.Layout,
 		}
 
 		// Use the current run's version for Handoff to properly signal FSM completion
@@ -150,8 +158,8 @@ func createSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Ima
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for devicemapper operations
-		if retryCount > MaxRetriesCreateSnapshot {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for create-snapshot transition", MaxRetriesCreateSnapshot))
+		if limit := deps.Retries.Limit(StateCreateSnapshot, MaxRetriesCreateSnapshot); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for create-snapshot transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -173,7 +181,7 @@ func createSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Ima
 
 		snapshotName := req.Msg.SnapshotName
 		if snapshotName == "" {
-			snapshotName = snapshotNameForImage(imageID)
+			snapshotName = SnapshotNameForImage(imageID)
 		}
 
 		logger.WithFields(map[string]any{
@@ -187,33 +195,22 @@ func createSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Ima
 		ctxWithTimeout, cancel := context.WithTimeout(ctx, 60*time.Second)
 		defer cancel()
 
-		// Snapshot ID must be numeric for devicemapper. Add offset to origin ID to make it unique.
-		// DeviceMapper has a 24-bit limit (max 16777215), so we must ensure the snapshot ID stays within this range.
 		originIDNum, err := strconv.ParseUint(originDeviceID, 10, 64)
 		if err != nil {
 			logger.WithError(err).Error("origin device ID is not numeric")
 			return nil, fsm.Abort(fmt.Errorf("origin device ID must be numeric: %w", err))
 		}
 
-		// Use modulo to ensure snapshot ID stays within 24-bit limit while maintaining uniqueness.
-		// We add 1 million as offset, then apply modulo to wrap within the valid range.
-		// This ensures snapshot IDs are different from origin IDs while staying under 16777215.
-		const maxDeviceID = 16777215 // 2^24 - 1 (devicemapper 24-bit limit)
-		snapshotIDNum := (originIDNum + 1000000) % maxDeviceID
-
-		// Ensure we don't get 0 (reserved) or collide with origin ID
-		if snapshotIDNum == 0 {
-			snapshotIDNum = 1000000
-		}
-		if snapshotIDNum == originIDNum {
-			snapshotIDNum = (snapshotIDNum + 500000) % maxDeviceID
+		snapshotID, err := allocateSnapshotID(ctxWithTimeout, deps.DB, snapshotName, originIDNum)
+		if err != nil {
+			logger.WithError(err).Error("failed to allocate snapshot device ID")
+			return nil, err
 		}
 
-		snapshotID := fmt.Sprintf("%d", snapshotIDNum)
 		logger.WithFields(logrus.Fields{
 			"origin_id":   originDeviceID,
 			"snapshot_id": snapshotID,
-		}).Info("calculated snapshot ID within devicemapper limits")
+		}).Info("allocated snapshot device ID")
 
 		// Check if snapshot device already exists (idempotency check)
 		// This can happen if a previous run created the snapshot but failed to register it in the database
@@ -223,59 +220,67 @@ func createSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Ima
 			return nil, fmt.Errorf("snapshot existence check failed: %w", err)
 		}
 
-		var info *devicemapper.DeviceInfo
-		if !snapshotExists {
-			// Create new snapshot in thin pool metadata
-			// CRITICAL: Use CreateSnapshotSafe which suspends/resumes the origin device
-			// Per kernel documentation: "If the origin device that you wish to snapshot is active,
-			// you must suspend it before creating the snapshot to avoid corruption."
-			if originDeviceName != "" {
-				logger.Info("using safe snapshot creation with origin device suspend/resume")
-				info, err = deps.DeviceMgr.CreateSnapshotSafe(ctxWithTimeout, deps.PoolName, originDeviceName, originDeviceID, snapshotID)
-			} else {
-				// Fallback to unsafe method if device name not available
-				logger.Warn("falling back to unsafe snapshot creation (no device name)")
-				info, err = deps.DeviceMgr.CreateSnapshot(ctxWithTimeout, deps.PoolName, originDeviceID, snapshotID)
-			}
+		// dmsetup create loads the table atomically, so an existing device is
+		// already active; creating it again would fail with "File exists".
+		if snapshotExists {
+			resp, err := existingSnapshot(ctxWithTimeout, deps.DeviceMgr, imageID, snapshotName, snapshotID)
 			if err != nil {
-				logger.WithError(err).Error("failed to create snapshot")
-				if devicemapper.IsPoolFullError(err) {
-					return nil, fsm.Abort(fmt.Errorf("devicemapper pool full: %w", err))
-				}
-				if devicemapper.IsDeviceNotFoundError(err) {
-					return nil, fsm.Abort(fmt.Errorf("origin device not found: %w", err))
-				}
-				return nil, fmt.Errorf("failed to create snapshot: %w", err)
+				logger.WithError(err).Error("failed to verify existing snapshot device")
+				return nil, err
 			}
+			resp.Layout = req.Msg.Layout
+			logger.WithField("snapshot_name", snapshotName).Info("snapshot device already active; skipping activation")
+			return fsm.NewResponse(resp), nil
+		}
 
-			// CRITICAL: Stabilize pool after snapshot creation to prevent kernel panics.
-			// CreateSnapshot does create_snap which modifies pool metadata - needs time to commit.
-			logger.Debug("stabilizing pool after snapshot creation")
-			stabilizePool(deps.PoolName)
+		// Create new snapshot in thin pool metadata
+		// CRITICAL: Use CreateSnapshotSafe which suspends/resumes the origin device
+		// Per kernel documentation: "If the origin device that you wish to snapshot is active,
+		// you must suspend it before creating the snapshot to avoid corruption."
+		var info *devicemapper.DeviceInfo
+		if originDeviceName != "" {
+			logger.Info("using safe snapshot creation with origin device suspend/resume")
+			info, err = deps.DeviceMgr.CreateSnapshotSafe(ctxWithTimeout, deps.PoolName, originDeviceName, originDeviceID, snapshotID)
 		} else {
-			logger.WithField("snapshot_name", snapshotName).Info("snapshot already exists in thin pool, will activate")
-			info = &devicemapper.DeviceInfo{
-				DeviceID: snapshotID,
-				Active:   false,
+			// Fallback to unsafe method if device name not available
+			logger.Warn("falling back to unsafe snapshot creation (no device name)")
+			info, err = deps.DeviceMgr.CreateSnapshot(ctxWithTimeout, deps.PoolName, originDeviceID, snapshotID)
+		}
+		if err != nil {
+			logger.WithError(err).Error("failed to create snapshot")
+			if devicemapper.IsPoolFullError(err) {
+				return nil, fsm.Abort(fmt.Errorf("devicemapper pool full: %w", err))
 			}
+			if devicemapper.IsPoolUnhealthyError(err) {
+				return nil, fsm.Abort(fmt.Errorf("devicemapper pool unhealthy: %w", err))
+			}
+			if devicemapper.IsDeviceNotFoundError(err) {
+				return nil, fsm.Abort(fmt.Errorf("origin device not found: %w", err))
+			}
+			return nil, fmt.Errorf("failed to create snapshot: %w", err)
 		}
 
-		// Always activate the snapshot device to ensure it has a proper table loaded
-		// This is idempotent - if already activated, dmsetup will return success
-		// Get the size from the unpacked_images table
+		// CRITICAL: Stabilize pool after snapshot creation to prevent kernel panics.
+		// CreateSnapshot does create_snap which modifies pool metadata - needs time to commit.
+		logger.Debug("stabilizing pool after snapshot creation")
+		stabilizePool(ctx, deps.PoolName, 0)
+
+		// Activate the new snapshot with the origin's device size from the
+		// unpacked_images table, so its table covers the whole filesystem
 		unpackedImage, err := deps.DB.GetUnpackedImageByID(ctxWithTimeout, imageID)
 		if err != nil {
 			logger.WithError(err).Error("failed to get unpacked image size")
 			return nil, fmt.Errorf("failed to get unpacked image: %w", err)
 		}
+		deviceSize := unpackedImage.DeviceSize(deps.DeviceMgr.MaxDeviceSize())
 
 		logger.WithFields(logrus.Fields{
 			"snapshot_name": snapshotName,
 			"snapshot_id":   snapshotID,
-			"size_bytes":    unpackedImage.SizeBytes,
+			"size_bytes":    deviceSize,
 		}).Info("activating snapshot device")
 
-		err = deps.DeviceMgr.ActivateDevice(ctxWithTimeout, deps.PoolName, snapshotName, snapshotID, unpackedImage.SizeBytes)
+		err = deps.DeviceMgr.ActivateDevice(ctxWithTimeout, deps.PoolName, snapshotName, snapshotID, deviceSize)
 		if err != nil {
 			logger.WithError(err).Error("failed to activate snapshot device")
 			return nil, fmt.Errorf("failed to activate snapshot: %w", err)
@@ -284,7 +289,7 @@ func createSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Ima
 		// CRITICAL: Stabilize pool after snapshot activation to prevent kernel panics.
 		// ActivateDevice does dmsetup create which loads a new device table - needs time to commit.
 		logger.Debug("stabilizing pool after snapshot activation")
-		stabilizePool(deps.PoolName)
+		stabilizePool(ctx, deps.PoolName, 0)
 
 		// Use snapshotName instead of info.Name because CreateSnapshot doesn't set the Name field
 		devicePath := deps.DeviceMgr.GetDevicePath(snapshotName)
@@ -303,12 +308,68 @@ func createSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, Ima
 			Active:       true,
 			Activated:    true,
 			ActivatedAt:  time.Now(),
+			Layout:       req.Msg.Layout,
 		}
 
 		return fsm.NewResponse(resp), nil
 	}
 }
 
+// snapshotIDOffset is added to the origin device ID to form a snapshot's
+// preferred device ID, keeping snapshot IDs visibly apart from origin IDs.
+const snapshotIDOffset = 1000000
+
+// deviceIDAllocator is the subset of *database.DB that allocates thin device IDs.
+type deviceIDAllocator interface {
+	AllocateDeviceID(ctx context.Context, owner string, preferred uint32) (string, error)
+}
+
+// allocateSnapshotID returns the thin device ID allocated to snapshotName,
+// allocating one on first use. The origin ID plus snapshotIDOffset is only a
+// preference: the allocator never hands out an ID held by another image or
+// snapshot, and the same snapshot always gets the same ID back.
+func allocateSnapshotID(ctx context.Context, db deviceIDAllocator, snapshotName string, originID uint64) (string, error) {
+	preferred := uint32((originID + snapshotIDOffset) % database.MaxDeviceID)
+	id, err := db.AllocateDeviceID(ctx, database.SnapshotDeviceOwner(snapshotName), preferred)
+	if errors.Is(err, database.ErrDeviceIDsExhausted) {
+		return "", fsm.Abort(err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate snapshot device ID: %w", err)
+	}
+	return id, nil
+}
+
+// activeDeviceReader is the subset of *devicemapper.Client used to inspect an
+// already-active snapshot device.
+type activeDeviceReader interface {
+	ThinDeviceID(ctx context.Context, deviceName string) (string, error)
+	GetDevicePath(deviceName string) string
+}
+
+// existingSnapshot returns the response for a snapshot device left active by
+// an earlier run, with Activated false. The run aborts if the device maps a
+// thin device other than snapshotID, since it belongs to something else.
+func existingSnapshot(ctx context.Context, dm activeDeviceReader, imageID, snapshotName, snapshotID string) (*ImageActivateResponse, error) {
+	tableID, err := dm.ThinDeviceID(ctx, snapshotName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read existing snapshot table: %w", err)
+	}
+	if tableID != snapshotID {
+		return nil, fsm.Abort(fmt.Errorf("device %s maps thin device %s, want snapshot %s", snapshotName, tableID, snapshotID))
+	}
+
+	return &ImageActivateResponse{
+		ImageID:      imageID,
+		SnapshotID:   snapshotID,
+		SnapshotName: snapshotName,
+		DevicePath:   dm.GetDevicePath(snapshotName),
+		Active:       true,
+		Activated:    false,
+		ActivatedAt:  time.Now(),
+	}, nil
+}
+
 // registerSnapshot records the snapshot in SQLite and updates image activation status.
 func registerSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, ImageActivateResponse] {
 	return func(ctx context.Context, req *fsm.Request[ImageActivateRequest, ImageActivateResponse]) (*fsm.Response[ImageActivateResponse], error) {
@@ -316,8 +377,8 @@ func registerSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, I
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for database operations
-		if retryCount > MaxRetriesRegister {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for register transition", MaxRetriesRegister))
+		if limit := deps.Retries.Limit(StateRegister, MaxRetriesRegister); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for register transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -362,9 +423,10 @@ func registerSnapshot(deps *Dependencies) fsm.Transition[ImageActivateRequest, I
 // Register registers the Activate FSM with the manager.
 func Register(ctx context.Context, manager *fsm.Manager, deps *Dependencies) (fsm.Start[ImageActivateRequest, ImageActivateResponse], fsm.Resume, error) {
 	return fsm.Register[ImageActivateRequest, ImageActivateResponse](manager, "activate-image").
-		Start("check-snapshot", checkSnapshot(deps)).
-		To("create-snapshot", createSnapshot(deps)).
-		To("register", registerSnapshot(deps)).
-		End("complete").
+		Start(StateCheckSnapshot, checkSnapshot(deps)).
+		To(StateCreateSnapshot, createSnapshot(deps)).
+		To(StateRegister, registerSnapshot(deps)).
+		End("complete", fsm.WithFinalizers(fsm.RecordImageFailure[ImageActivateRequest, ImageActivateResponse](
+			"activate", deps.DB, func(r *ImageActivateRequest) string { return r.ImageID }))).
 		Build(ctx)
 }
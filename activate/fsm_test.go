@@ -0,0 +1,342 @@
+package activate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	fsm "github.com/superfly/fsm"
+
+	"github.com/superfly/fsm/checksum"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/unpack"
+)
+
+// fakeDeviceReader serves fixed thin device tables for active devices.
+type fakeDeviceReader struct {
+	tables map[string]string // device name -> thin device ID
+}
+
+func (f *fakeDeviceReader) ThinDeviceID(ctx context.Context, deviceName string) (string, error) {
+	id, ok := f.tables[deviceName]
+	if !ok {
+		return "", errors.New("no such device")
+	}
+	return id, nil
+}
+
+func (f *fakeDeviceReader) GetDevicePath(deviceName string) string {
+	return "/dev/mapper/" + deviceName
+}
+
+func TestExistingSnapshot_AlreadyActive(t *testing.T) {
+	dm := &fakeDeviceReader{tables: map[string]string{"snap-img1": "1000042"}}
+
+	resp, err := existingSnapshot(context.Background(), dm, "img1", "snap-img1", "1000042")
+	if err != nil {
+		t.Fatalf("existingSnapshot() error = %v", err)
+	}
+	if resp.Activated || !resp.Active {
+		t.Errorf("existingSnapshot() Activated = %v, Active = %v; want false, true", resp.Activated, resp.Active)
+	}
+	if resp.SnapshotID != "1000042" || resp.DevicePath != "/dev/mapper/snap-img1" {
+		t.Errorf("existingSnapshot() = %+v", resp)
+	}
+}
+
+func TestExistingSnapshot_Errors(t *testing.T) {
+	dm := &fakeDeviceReader{tables: map[string]string{"snap-img1": "77"}}
+
+	// A device mapping some other thin device is not ours to reuse.
+	_, err := existingSnapshot(context.Background(), dm, "img1", "snap-img1", "1000042")
+	var abortErr *fsm.AbortError
+	if !errors.As(err, &abortErr) {
+		t.Errorf("existingSnapshot() with a foreign table error = %v, want an abort", err)
+	}
+
+	// A table that can't be read is retried rather than aborted.
+	_, err = existingSnapshot(context.Background(), dm, "img2", "snap-img2", "1000043")
+	if err == nil || errors.As(err, &abortErr) {
+		t.Errorf("existingSnapshot() with an unreadable table error = %v, want a retryable error", err)
+	}
+}
+
+func TestAllocateSnapshotID_NoCollisions(t *testing.T) {
+	ctx := context.Background()
+	cfg := database.DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "images.db")
+	db, err := database.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Under the old origin+1000000 scheme, the snapshot of origin 5 was given
+	// device ID 1000005, which is also this image's unpacked device ID.
+	const imageID = "img_00000000000f4245"
+	imageDeviceID := unpack.DeviceIDForImage(imageID)
+	if old := fmt.Sprint((5 + snapshotIDOffset) % database.MaxDeviceID); old != imageDeviceID {
+		t.Fatalf("old snapshot ID %s, image device ID %s; want the collision", old, imageDeviceID)
+	}
+
+	if _, err := db.AllocateDeviceID(ctx, database.ImageDeviceOwner(imageID), 1000005); err != nil {
+		t.Fatal(err)
+	}
+	snapID, err := allocateSnapshotID(ctx, db, "snap-img5", 5)
+	if err != nil {
+		t.Fatalf("allocateSnapshotID() error = %v", err)
+	}
+	if snapID == imageDeviceID {
+		t.Errorf("allocateSnapshotID() = %s, the image's device ID", snapID)
+	}
+	if again, err := allocateSnapshotID(ctx, db, "snap-img5", 5); err != nil || again != snapID {
+		t.Errorf("allocateSnapshotID(again) = %q, %v; want %q", again, err, snapID)
+	}
+
+	// Every origin gets its own snapshot ID
+	seen := map[string]bool{imageDeviceID: true, snapID: true}
+	for origin := range uint64(50) {
+		id, err := allocateSnapshotID(ctx, db, fmt.Sprintf("snap-%d", origin), origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("allocateSnapshotID(origin %d) = %s, already in use", origin, id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestCheckSnapshot_RetryLimit(t *testing.T) {
+	req := fsm.MockRequest(&fsm.Request[ImageActivateRequest, ImageActivateResponse]{
+		Msg: &ImageActivateRequest{ImageID: "img1"},
+	}, logrus.New(), fsm.Run{})
+	deps := &Dependencies{Retries: fsm.RetryPolicy{StateCheckSnapshot: 1}}
+
+	_, err := checkSnapshot(deps)(fsm.MockRetryContext(context.Background(), 2), req)
+	var abortErr *fsm.AbortError
+	if !errors.As(err, &abortErr) || !strings.Contains(err.Error(), "exceeded maximum retries (1)") {
+		t.Errorf("checkSnapshot() on retry 2 with limit 1 error = %v, want a retry-limit abort", err)
+	}
+}
+
+// fakeDeviceMgr is an in-memory DeviceManager: active maps each active
+// device name to the thin device ID in its table.
+type fakeDeviceMgr struct {
+	active  map[string]string
+	created []string         // "origin->snapshot" for each create_snap
+	sizes   map[string]int64 // Sizes passed to ActivateDevice
+}
+
+func (f *fakeDeviceMgr) DeviceExists(ctx context.Context, deviceName string) (bool, error) {
+	_, ok := f.active[deviceName]
+	return ok, nil
+}
+
+func (f *fakeDeviceMgr) CreateSnapshot(ctx context.Context, poolName, originID, snapshotID string) (*devicemapper.DeviceInfo, error) {
+	f.created = append(f.created, originID+"->"+snapshotID)
+	return &devicemapper.DeviceInfo{DeviceID: snapshotID}, nil
+}
+
+func (f *fakeDeviceMgr) CreateSnapshotSafe(ctx context.Context, poolName, originDeviceName, originID, snapshotID string) (*devicemapper.DeviceInfo, error) {
+	return f.CreateSnapshot(ctx, poolName, originID, snapshotID)
+}
+
+func (f *fakeDeviceMgr) ActivateDevice(ctx context.Context, poolName, deviceName, deviceID string, sizeBytes int64) error {
+	f.active[deviceName] = deviceID
+	if f.sizes == nil {
+		f.sizes = make(map[string]int64)
+	}
+	f.sizes[deviceName] = sizeBytes
+	return nil
+}
+
+func (f *fakeDeviceMgr) MaxDeviceSize() int64 { return devicemapper.DefaultMaxDeviceSize }
+
+func (f *fakeDeviceMgr) ThinDeviceID(ctx context.Context, deviceName string) (string, error) {
+	id, ok := f.active[deviceName]
+	if !ok {
+		return "", errors.New("no such device")
+	}
+	return id, nil
+}
+
+func (f *fakeDeviceMgr) GetDevicePath(deviceName string) string {
+	return "/dev/mapper/" + deviceName
+}
+
+// newActivateFixture returns deps backed by a fresh database holding one
+// unpacked image, img1 on origin device 5, and a fake device manager with
+// the origin active.
+func newActivateFixture(t *testing.T) (*Dependencies, *fakeDeviceMgr) {
+	t.Helper()
+	ctx := context.Background()
+
+	orig := stabilizePool
+	stabilizePool = func(context.Context, string, time.Duration) {}
+	t.Cleanup(func() { stabilizePool = orig })
+
+	cfg := database.DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "images.db")
+	db, err := database.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.StoreImageMetadata(ctx, "img1", "images/img1.tar", "/tmp/img1.tar", checksum.Checksum{Hex: "0"}, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StoreUnpackedImage(ctx, "img1", "5", "thin-5", "/dev/mapper/thin-5", 1<<20, 1<<30, 3, "direct-root"); err != nil {
+		t.Fatal(err)
+	}
+
+	dm := &fakeDeviceMgr{active: map[string]string{"thin-5": "5"}}
+	return &Dependencies{DB: db, DeviceMgr: dm, PoolName: "pool"}, dm
+}
+
+// runActivate drives check-snapshot, create-snapshot and register in order,
+// as the FSM would, stopping where check-snapshot hands off.
+func runActivate(t *testing.T, deps *Dependencies) (*ImageActivateResponse, error) {
+	t.Helper()
+	ctx := context.Background()
+	req := fsm.MockRequest(&fsm.Request[ImageActivateRequest, ImageActivateResponse]{
+		Msg: &ImageActivateRequest{ImageID: "img1", DeviceID: "5", DeviceName: "thin-5"},
+	}, logrus.New(), fsm.Run{})
+
+	resp, err := checkSnapshot(deps)(ctx, req)
+	if err != nil || resp != nil {
+		if resp == nil {
+			return nil, err
+		}
+		return resp.Msg, err
+	}
+
+	resp, err = createSnapshot(deps)(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	req.W = *resp
+
+	if _, err := registerSnapshot(deps)(ctx, req); err != nil {
+		return nil, err
+	}
+	return resp.Msg, nil
+}
+
+func TestActivate_CreatesAndRegisters(t *testing.T) {
+	ctx := context.Background()
+	deps, dm := newActivateFixture(t)
+
+	resp, err := runActivate(t, deps)
+	if err != nil {
+		t.Fatalf("activate error = %v", err)
+	}
+	if !resp.Activated || resp.SnapshotID != "1000005" || resp.DevicePath != "/dev/mapper/snap-img1" {
+		t.Errorf("response = %+v, want snapshot 1000005 newly activated at /dev/mapper/snap-img1", resp)
+	}
+	if got := strings.Join(dm.created, ","); got != "5->1000005" {
+		t.Errorf("created = %s, want 5->1000005", got)
+	}
+	// The snapshot is activated with the origin's device size, not the
+	// size of the extracted content
+	if got := dm.sizes["snap-img1"]; got != 1<<30 {
+		t.Errorf("snapshot activated with %d bytes, want %d", got, 1<<30)
+	}
+
+	snap, err := deps.DB.CheckSnapshotExists(ctx, "img1", "snap-img1")
+	if err != nil || snap == nil || snap.SnapshotID != "1000005" {
+		t.Fatalf("registered snapshot = %+v, %v; want 1000005", snap, err)
+	}
+
+	// A second run finds the active snapshot and hands it out again.
+	resp, err = runActivate(t, deps)
+	if err != nil {
+		t.Fatalf("second activate error = %v", err)
+	}
+	if resp.Activated || resp.SnapshotID != "1000005" || len(dm.created) != 1 {
+		t.Errorf("second run = %+v with %d creates, want the existing snapshot reused", resp, len(dm.created))
+	}
+	if snap, _ := deps.DB.GetSnapshotByID(ctx, "1000005"); snap.LastAccessedAt == nil {
+		t.Error("reused snapshot was not recorded as accessed")
+	}
+}
+
+func TestActivate_SnapshotIDCollision(t *testing.T) {
+	ctx := context.Background()
+	deps, dm := newActivateFixture(t)
+
+	// Another image already holds origin+snapshotIDOffset.
+	if _, err := deps.DB.AllocateDeviceID(ctx, database.ImageDeviceOwner("other"), 1000005); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := runActivate(t, deps)
+	if err != nil {
+		t.Fatalf("activate error = %v", err)
+	}
+	if resp.SnapshotID == "1000005" {
+		t.Fatalf("snapshot was given device ID 1000005, held by another image")
+	}
+	if want := "5->" + resp.SnapshotID; len(dm.created) != 1 || dm.created[0] != want {
+		t.Errorf("created = %v, want %s", dm.created, want)
+	}
+	if snap, _ := deps.DB.GetSnapshotByID(ctx, resp.SnapshotID); snap == nil {
+		t.Errorf("snapshot %s not registered", resp.SnapshotID)
+	}
+}
+
+func TestActivate_DeviceAlreadyExists(t *testing.T) {
+	t.Run("left by an earlier run", func(t *testing.T) {
+		deps, dm := newActivateFixture(t)
+		dm.active["snap-img1"] = "1000005"
+
+		resp, err := runActivate(t, deps)
+		if err != nil {
+			t.Fatalf("activate error = %v", err)
+		}
+		if resp.Activated || resp.SnapshotID != "1000005" || len(dm.created) != 0 {
+			t.Errorf("response = %+v with creates %v, want the active device adopted", resp, dm.created)
+		}
+		if snap, _ := deps.DB.GetSnapshotByID(context.Background(), "1000005"); snap == nil || !snap.Active {
+			t.Errorf("adopted snapshot not registered: %+v", snap)
+		}
+	})
+
+	t.Run("maps another thin device", func(t *testing.T) {
+		deps, dm := newActivateFixture(t)
+		dm.active["snap-img1"] = "77"
+
+		_, err := runActivate(t, deps)
+		var abortErr *fsm.AbortError
+		if !errors.As(err, &abortErr) {
+			t.Errorf("activate error = %v, want an abort", err)
+		}
+		if len(dm.created) != 0 {
+			t.Errorf("created = %v, want none", dm.created)
+		}
+	})
+
+	t.Run("recorded but device gone", func(t *testing.T) {
+		deps, dm := newActivateFixture(t)
+		if _, err := runActivate(t, deps); err != nil {
+			t.Fatal(err)
+		}
+		delete(dm.active, "snap-img1")
+
+		// The stale row is dropped and the snapshot recreated under the same ID.
+		resp, err := runActivate(t, deps)
+		if err != nil {
+			t.Fatalf("activate error = %v", err)
+		}
+		if !resp.Activated || resp.SnapshotID != "1000005" || len(dm.created) != 2 {
+			t.Errorf("response = %+v with creates %v, want snapshot 1000005 recreated", resp, dm.created)
+		}
+	})
+}
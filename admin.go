@@ -2,6 +2,7 @@ package fsm
 
 import (
 	"context"
+	"errors"
 
 	fsmv1 "github.com/superfly/fsm/gen/fsm/v1"
 	"github.com/superfly/fsm/gen/fsm/v1/fsmv1connect"
@@ -35,7 +36,10 @@ func (s *adminServer) ListRegistered(context.Context, *connect.Request[fsmv1.Lis
 	}), nil
 }
 
-func (s *adminServer) ListActive(context.Context, *connect.Request[fsmv1.ListActiveRequest]) (*connect.Response[fsmv1.ListActiveResponse], error) {
+// ListActive returns the runs this manager knows about. Finished runs are
+// skipped unless the request sets include_completed; they are only kept in
+// memory, so they cover runs finished since the manager started.
+func (s *adminServer) ListActive(ctx context.Context, req *connect.Request[fsmv1.ListActiveRequest]) (*connect.Response[fsmv1.ListActiveResponse], error) {
 	txn := s.m.db.Txn(false)
 	defer txn.Abort()
 
@@ -47,7 +51,7 @@ func (s *adminServer) ListActive(context.Context, *connect.Request[fsmv1.ListAct
 	active := []*fsmv1.ActiveFSM{}
 	for next := it.Next(); next != nil; next = it.Next() {
 		rs := next.(runState)
-		if rs.State == fsmv1.RunState_RUN_STATE_COMPLETE {
+		if rs.State == fsmv1.RunState_RUN_STATE_COMPLETE && !req.Msg.GetIncludeCompleted() {
 			continue
 		}
 		af := &fsmv1.ActiveFSM{
@@ -62,7 +66,9 @@ func (s *adminServer) ListActive(context.Context, *connect.Request[fsmv1.ListAct
 			af.TransitionVersion = rs.TransitionVersion.String()
 		}
 		// TODO - What should we do about Error.State here?
-		if rs.Error.Err != nil {
+		// A handoff ends the run successfully, so it is not reported as an error.
+		var he *HandoffError
+		if rs.Error.Err != nil && !errors.As(rs.Error.Err, &he) {
 			af.Error = rs.Error.Err.Error()
 		}
 		active = append(active, af)
@@ -0,0 +1,142 @@
+// Package checksum computes and compares image digests. The download, the
+// database and the CLI record a digest together with the algorithm that
+// produced it, so a digest is only ever compared against one taken the same way.
+package checksum
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// Algo names a digest algorithm.
+type Algo string
+
+const (
+	SHA256 Algo = "sha256"
+	SHA512 Algo = "sha512"
+	BLAKE3 Algo = "blake3" // 256-bit output
+)
+
+// Default is used when no algorithm is configured. Digests recorded before
+// the algorithm was stored are SHA256, so an empty Algo means Default.
+const Default = SHA256
+
+// Algos lists the supported algorithms, for flag help and validation.
+var Algos = []Algo{SHA256, SHA512, BLAKE3}
+
+// ParseAlgo returns the algorithm named s, case-insensitively. An empty s is
+// Default.
+func ParseAlgo(s string) (Algo, error) {
+	a := Algo(strings.ToLower(strings.TrimSpace(s))).OrDefault()
+	if _, err := a.New(); err != nil {
+		return "", err
+	}
+	return a, nil
+}
+
+// OrDefault returns a, or Default if a is empty.
+func (a Algo) OrDefault() Algo {
+	if a == "" {
+		return Default
+	}
+	return a
+}
+
+// New returns a hash for the algorithm.
+func (a Algo) New() (hash.Hash, error) {
+	switch a.OrDefault() {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	case BLAKE3:
+		return blake3.New(32, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q (want one of %s)", string(a), algoList())
+}
+
+func algoList() string {
+	names := make([]string, len(Algos))
+	for i, a := range Algos {
+		names[i] = string(a)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Checksum is a hex digest and the algorithm that produced it.
+type Checksum struct {
+	Algo Algo
+	Hex  string
+}
+
+// Reader hashes everything read from r with algo.
+func Reader(algo Algo, r io.Reader) (Checksum, error) {
+	sums, err := ReaderAll(r, algo)
+	if err != nil {
+		return Checksum{}, err
+	}
+	return sums[0], nil
+}
+
+// ReaderAll hashes everything read from r with each of algos in a single
+// pass, returning the digests in the same order.
+func ReaderAll(r io.Reader, algos ...Algo) ([]Checksum, error) {
+	hashes := make([]hash.Hash, len(algos))
+	writers := make([]io.Writer, len(algos))
+	for i, algo := range algos {
+		h, err := algo.New()
+		if err != nil {
+			return nil, err
+		}
+		hashes[i], writers[i] = h, h
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return nil, err
+	}
+	sums := make([]Checksum, len(algos))
+	for i, algo := range algos {
+		sums[i] = Checksum{Algo: algo.OrDefault(), Hex: hex.EncodeToString(hashes[i].Sum(nil))}
+	}
+	return sums, nil
+}
+
+// File hashes the file at path with algo.
+func File(algo Algo, path string) (Checksum, error) {
+	sums, err := FileAll(path, algo)
+	if err != nil {
+		return Checksum{}, err
+	}
+	return sums[0], nil
+}
+
+// FileAll hashes the file at path with each of algos, reading it once.
+func FileAll(path string, algos ...Algo) ([]Checksum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReaderAll(f, algos...)
+}
+
+// IsZero reports whether c holds no digest.
+func (c Checksum) IsZero() bool { return c.Hex == "" }
+
+// Matches reports whether c and other are the same digest taken with the same
+// algorithm. Hex case is ignored.
+func (c Checksum) Matches(other Checksum) bool {
+	return c.Algo.OrDefault() == other.Algo.OrDefault() && strings.EqualFold(c.Hex, other.Hex)
+}
+
+// String formats c as "algo:hex".
+func (c Checksum) String() string {
+	return string(c.Algo.OrDefault()) + ":" + c.Hex
+}
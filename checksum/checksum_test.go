@@ -0,0 +1,102 @@
+package checksum
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile_KnownDigests(t *testing.T) {
+	// Published test vectors for the input "abc"
+	tests := []struct {
+		algo Algo
+		want string
+	}{
+		{SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{SHA512, "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{BLAKE3, "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{"", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+
+	path := filepath.Join(t.TempDir(), "buf")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.algo), func(t *testing.T) {
+			got, err := File(tt.algo, path)
+			if err != nil {
+				t.Fatalf("File() error = %v", err)
+			}
+			if want := (Checksum{Algo: tt.algo.OrDefault(), Hex: tt.want}); got != want {
+				t.Errorf("File() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReaderAll(t *testing.T) {
+	sums, err := ReaderAll(strings.NewReader("abc"), BLAKE3, SHA256)
+	if err != nil {
+		t.Fatalf("ReaderAll() error = %v", err)
+	}
+	want := []Checksum{
+		{BLAKE3, "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	if len(sums) != len(want) || sums[0] != want[0] || sums[1] != want[1] {
+		t.Errorf("ReaderAll() = %v, want %v", sums, want)
+	}
+
+	if _, err := ReaderAll(strings.NewReader("abc"), SHA256, "md5"); err == nil {
+		t.Error("ReaderAll() with an unsupported algorithm succeeded")
+	}
+}
+
+func TestChecksum_Matches(t *testing.T) {
+	sum, err := Reader(SHA512, strings.NewReader("image contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Reader(SHA512, strings.NewReader("image contents!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		other Checksum
+		want  bool
+	}{
+		{name: "same", other: sum, want: true},
+		{name: "uppercase hex", other: Checksum{Algo: SHA512, Hex: strings.ToUpper(sum.Hex)}, want: true},
+		{name: "different content", other: other},
+		{name: "same hex, different algorithm", other: Checksum{Algo: BLAKE3, Hex: sum.Hex}},
+		{name: "empty", other: Checksum{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sum.Matches(tt.other); got != tt.want {
+				t.Errorf("Matches(%v) = %v, want %v", tt.other, got, tt.want)
+			}
+		})
+	}
+
+	// Digests recorded before the algorithm was stored are SHA256
+	legacy := Checksum{Hex: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}
+	if sha, _ := Reader(SHA256, strings.NewReader("abc")); !legacy.Matches(sha) {
+		t.Errorf("%v does not match legacy digest %v", sha, legacy)
+	}
+}
+
+func TestParseAlgo(t *testing.T) {
+	for in, want := range map[string]Algo{"": SHA256, "sha256": SHA256, "SHA512": SHA512, " blake3 ": BLAKE3} {
+		if got, err := ParseAlgo(in); err != nil || got != want {
+			t.Errorf("ParseAlgo(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseAlgo("md5"); err == nil {
+		t.Error("ParseAlgo(md5) error = nil, want unsupported")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// samplePrefixBytes is how much of each sampled object is decompressed to
+// estimate its compression ratio.
+const samplePrefixBytes = 4 << 20
+
+// rangeReader reads a byte range of an S3 object. rng is an HTTP Range value
+// such as "bytes=0-1023" or "bytes=-4".
+type rangeReader interface {
+	GetRange(ctx context.Context, key, rng string) ([]byte, error)
+}
+
+// sizeEstimate is the estimated extracted size of one sampled object.
+type sizeEstimate struct {
+	key        string
+	size       int64 // Object size in S3
+	extracted  int64 // Estimated size once decompressed
+	compressed bool
+}
+
+// isGzip reports whether data starts with the gzip magic number.
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// prefixRatio decompresses as much of a gzip prefix as possible and returns
+// decompressed bytes per compressed byte. A prefix cut mid-stream is expected;
+// only a stream that yields nothing is an error.
+func prefixRatio(prefix []byte) (float64, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(prefix))
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.Discard, zr)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no data decompressed from %d byte prefix", len(prefix))
+	}
+	return float64(n) / float64(len(prefix)), nil
+}
+
+// unwrapISIZE returns the uncompressed size closest to estimate whose low 32
+// bits are isize. The gzip footer only stores the size modulo 2^32, which
+// wraps for images over 4GB.
+func unwrapISIZE(isize uint32, estimate int64) int64 {
+	const wrap = int64(1) << 32
+	k := int64(math.Round(float64(estimate-int64(isize)) / float64(wrap)))
+	if k < 0 {
+		k = 0
+	}
+	return int64(isize) + k*wrap
+}
+
+// estimateExtractedSize estimates the decompressed size of an object from its
+// first bytes and, for gzip, its 8-byte footer (CRC32 then ISIZE). Objects
+// that are not gzip are taken at their raw size.
+//
+// The prefix ratio alone is skewed by how compressible the first few MB are,
+// so it is only used to pick the right 4GB wrap of ISIZE. ISIZE is also wrong
+// for multi-member gzip, where it covers only the last member; if it lands
+// under the object size the prefix estimate is used instead.
+func estimateExtractedSize(size int64, prefix, footer []byte) (int64, bool, error) {
+	if !isGzip(prefix) {
+		return size, false, nil
+	}
+	ratio, err := prefixRatio(prefix)
+	if err != nil {
+		return 0, true, err
+	}
+	estimate := int64(ratio * float64(size))
+	if len(footer) < 4 {
+		return estimate, true, nil
+	}
+
+	isize := binary.LittleEndian.Uint32(footer[len(footer)-4:])
+	extracted := unwrapISIZE(isize, estimate)
+	if extracted < size {
+		return estimate, true, nil
+	}
+	return extracted, true, nil
+}
+
+// sampleObject estimates the extracted size of one object with two ranged
+// reads: the first samplePrefixBytes and the last 8 bytes.
+func sampleObject(ctx context.Context, r rangeReader, img imageInfo) (sizeEstimate, error) {
+	est := sizeEstimate{key: img.key, size: img.size, extracted: img.size}
+	if img.size == 0 {
+		return est, nil
+	}
+
+	prefix, err := r.GetRange(ctx, img.key, fmt.Sprintf("bytes=0-%d", min(img.size, samplePrefixBytes)-1))
+	if err != nil {
+		return est, fmt.Errorf("read start of %s: %w", img.key, err)
+	}
+	var footer []byte
+	if isGzip(prefix) && img.size >= 18 { // 10-byte header + 8-byte footer
+		if footer, err = r.GetRange(ctx, img.key, "bytes=-8"); err != nil {
+			return est, fmt.Errorf("read gzip footer of %s: %w", img.key, err)
+		}
+	}
+
+	est.extracted, est.compressed, err = estimateExtractedSize(img.size, prefix, footer)
+	if err != nil {
+		return est, fmt.Errorf("estimate size of %s: %w", img.key, err)
+	}
+	return est, nil
+}
+
+// pickSamples returns up to n images spread evenly across images, which must
+// be sorted by size, so small and large images are both represented.
+func pickSamples(images []imageInfo, n int) []imageInfo {
+	if n <= 0 || len(images) == 0 {
+		return nil
+	}
+	if n >= len(images) {
+		return images
+	}
+	if n == 1 {
+		return []imageInfo{images[len(images)/2]}
+	}
+	samples := make([]imageInfo, 0, n)
+	for i := 0; i < n; i++ {
+		samples = append(samples, images[i*(len(images)-1)/(n-1)])
+	}
+	return samples
+}
+
+// compressionRatio returns extracted bytes per stored byte across the
+// samples. Uncompressed samples count at 1, so a mixed bucket is scaled by
+// its blend. It returns 1 when nothing was sampled.
+func compressionRatio(samples []sizeEstimate) float64 {
+	var size, extracted int64
+	for _, s := range samples {
+		size += s.size
+		extracted += s.extracted
+	}
+	if size == 0 {
+		return 1
+	}
+	return float64(extracted) / float64(size)
+}
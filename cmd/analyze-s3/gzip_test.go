@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fixture returns n bytes of text that compresses roughly 10:1 or better.
+func fixture(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < n; i++ {
+		fmt.Fprintf(&b, "usr/lib/python3/site-packages/module_%d.py\n", i%500)
+	}
+	return b.Bytes()[:n]
+}
+
+func gzipBytes(t *testing.T, members ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, m := range members {
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// fakeRangeReader serves ranges of in-memory objects.
+type fakeRangeReader map[string][]byte
+
+func (f fakeRangeReader) GetRange(ctx context.Context, key, rng string) ([]byte, error) {
+	data, ok := f[key]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", key)
+	}
+	spec := strings.TrimPrefix(rng, "bytes=")
+	if strings.HasPrefix(spec, "-") {
+		n, _ := strconv.Atoi(spec[1:])
+		return data[max(0, len(data)-n):], nil
+	}
+	from, to, _ := strings.Cut(spec, "-")
+	start, _ := strconv.Atoi(from)
+	end, _ := strconv.Atoi(to)
+	return data[start:min(end+1, len(data))], nil
+}
+
+func TestEstimateExtractedSize(t *testing.T) {
+	raw := fixture(1 << 20)
+	gz := gzipBytes(t, raw)
+
+	t.Run("uncompressed", func(t *testing.T) {
+		got, compressed, err := estimateExtractedSize(int64(len(raw)), raw[:4096], nil)
+		if err != nil || compressed || got != int64(len(raw)) {
+			t.Errorf("got %d compressed=%v err=%v, want the raw size", got, compressed, err)
+		}
+	})
+
+	t.Run("gzip uses ISIZE", func(t *testing.T) {
+		got, compressed, err := estimateExtractedSize(int64(len(gz)), gz, gz[len(gz)-8:])
+		if err != nil || !compressed || got != int64(len(raw)) {
+			t.Errorf("got %d compressed=%v err=%v, want exactly %d", got, compressed, err, len(raw))
+		}
+	})
+
+	t.Run("multi-member falls back to prefix ratio", func(t *testing.T) {
+		// ISIZE covers only the tiny last member
+		multi := gzipBytes(t, raw, []byte("tail"))
+		got, compressed, err := estimateExtractedSize(int64(len(multi)), multi, multi[len(multi)-8:])
+		if err != nil || !compressed {
+			t.Fatalf("compressed=%v err=%v", compressed, err)
+		}
+		want := int64(len(raw)) + 4
+		if math.Abs(float64(got-want))/float64(want) > 0.05 {
+			t.Errorf("got %d, want within 5%% of %d", got, want)
+		}
+	})
+
+	t.Run("corrupt gzip", func(t *testing.T) {
+		bad := append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte{0xff}, 64)...)
+		if _, _, err := estimateExtractedSize(int64(len(bad)), bad, bad[len(bad)-8:]); err == nil {
+			t.Error("expected error for a corrupt gzip stream")
+		}
+	})
+}
+
+func TestPrefixRatio_TruncatedStream(t *testing.T) {
+	raw := fixture(4 << 20)
+	gz := gzipBytes(t, raw)
+	full := float64(len(raw)) / float64(len(gz))
+
+	got, err := prefixRatio(gz[:len(gz)/2])
+	if err != nil {
+		t.Fatalf("prefixRatio() error = %v", err)
+	}
+	if math.Abs(got-full)/full > 0.1 {
+		t.Errorf("ratio from half the stream = %.2f, want within 10%% of %.2f", got, full)
+	}
+}
+
+func TestUnwrapISIZE(t *testing.T) {
+	const gb = int64(1) << 30
+	tests := []struct {
+		name     string
+		actual   int64
+		estimate int64
+	}{
+		{name: "small", actual: 300 << 20, estimate: 250 << 20},
+		{name: "wrapped once", actual: 6 * gb, estimate: 5 * gb},
+		{name: "wrapped twice", actual: 9*gb + 123, estimate: 10 * gb},
+		{name: "estimate too low", actual: 1 * gb, estimate: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unwrapISIZE(uint32(tt.actual), tt.estimate); got != tt.actual {
+				t.Errorf("unwrapISIZE() = %d, want %d", got, tt.actual)
+			}
+		})
+	}
+}
+
+func TestSampleObject(t *testing.T) {
+	raw := fixture(1 << 20)
+	objects := fakeRangeReader{
+		"images/a.tar.gz": gzipBytes(t, raw),
+		"images/b.tar":    raw,
+	}
+
+	gzEst, err := sampleObject(context.Background(), objects, imageInfo{key: "images/a.tar.gz", size: int64(len(objects["images/a.tar.gz"]))})
+	if err != nil {
+		t.Fatalf("sampleObject(gzip) error = %v", err)
+	}
+	if !gzEst.compressed || gzEst.extracted != int64(len(raw)) {
+		t.Errorf("gzip estimate = %+v, want %d extracted bytes", gzEst, len(raw))
+	}
+
+	tarEst, err := sampleObject(context.Background(), objects, imageInfo{key: "images/b.tar", size: int64(len(raw))})
+	if err != nil {
+		t.Fatalf("sampleObject(tar) error = %v", err)
+	}
+	if tarEst.compressed || tarEst.extracted != int64(len(raw)) {
+		t.Errorf("tar estimate = %+v, want the raw size", tarEst)
+	}
+
+	// Mixed bucket: ratio is total extracted over total stored
+	ratio := compressionRatio([]sizeEstimate{gzEst, tarEst})
+	want := float64(2*len(raw)) / float64(gzEst.size+tarEst.size)
+	if math.Abs(ratio-want) > 1e-9 {
+		t.Errorf("compressionRatio() = %f, want %f", ratio, want)
+	}
+	if ratio <= 1 {
+		t.Errorf("compressionRatio() = %f, want > 1 with a gzip sample", ratio)
+	}
+}
+
+func TestCompressionRatio_Uncompressed(t *testing.T) {
+	if got := compressionRatio(nil); got != 1 {
+		t.Errorf("compressionRatio(nil) = %f, want 1", got)
+	}
+	raw := []sizeEstimate{{size: 100, extracted: 100}, {size: 300, extracted: 300}}
+	if got := compressionRatio(raw); got != 1 {
+		t.Errorf("compressionRatio(raw) = %f, want 1", got)
+	}
+}
+
+func TestPickSamples(t *testing.T) {
+	var images []imageInfo
+	for i := 0; i < 10; i++ {
+		images = append(images, imageInfo{key: strconv.Itoa(i), size: int64(i)})
+	}
+
+	var keys []string
+	for _, img := range pickSamples(images, 4) {
+		keys = append(keys, img.key)
+	}
+	if got := strings.Join(keys, ","); got != "0,3,6,9" {
+		t.Errorf("pickSamples(10, 4) = %s, want smallest to largest spread 0,3,6,9", got)
+	}
+	if got := pickSamples(images, 20); len(got) != 10 {
+		t.Errorf("pickSamples(10, 20) returned %d, want all 10", len(got))
+	}
+	if got := pickSamples(images, 0); got != nil {
+		t.Errorf("pickSamples(10, 0) = %v, want none", got)
+	}
+}
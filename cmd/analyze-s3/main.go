@@ -3,13 +3,18 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/humanize"
 )
 
 type imageInfo struct {
@@ -17,7 +22,30 @@ type imageInfo struct {
 	size int64
 }
 
+// s3RangeReader reads object ranges from bucket.
+type s3RangeReader struct {
+	client *s3.Client
+	bucket string
+}
+
+func (r s3RangeReader) GetRange(ctx context.Context, key, rng string) ([]byte, error) {
+	out, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(rng),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
 func main() {
+	prefix := flag.String("prefix", "images/", "Only analyze objects whose keys start with this prefix")
+	sample := flag.Int("sample", 0, "Sample up to N objects to estimate gzip compression and size the pool by extracted size (0 to use raw object sizes)")
+	flag.Parse()
+
 	ctx := context.Background()
 
 	// Load AWS configuration (anonymous access for public bucket)
@@ -34,11 +62,10 @@ func main() {
 	client := s3.NewFromConfig(cfg)
 
 	bucket := "flyio-container-images"
-	prefix := "images/"
 
 	fmt.Println("=== S3 Bucket Image Size Analysis ===")
 	fmt.Println()
-	fmt.Printf("Bucket: s3://%s/%s\n", bucket, prefix)
+	fmt.Printf("Bucket: s3://%s/%s\n", bucket, *prefix)
 	fmt.Println()
 
 	// List all objects
@@ -48,7 +75,7 @@ func main() {
 	var images []imageInfo
 	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
+		Prefix: aws.String(*prefix),
 	})
 
 	for paginator.HasMorePages() {
@@ -91,12 +118,39 @@ func main() {
 	fmt.Println("Step 2: Image Statistics")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Printf("Total images:     %d\n", len(images))
-	fmt.Printf("Total size:       %s (%d bytes)\n", humanSize(totalSize), totalSize)
-	fmt.Printf("Minimum size:     %s (%d bytes)\n", humanSize(minSize), minSize)
-	fmt.Printf("Maximum size:     %s (%d bytes)\n", humanSize(maxSize), maxSize)
-	fmt.Printf("Average size:     %s (%d bytes)\n", humanSize(avgSize), avgSize)
+	fmt.Printf("Total size:       %s (%d bytes)\n", humanize.Bytes(totalSize), totalSize)
+	fmt.Printf("Minimum size:     %s (%d bytes)\n", humanize.Bytes(minSize), minSize)
+	fmt.Printf("Maximum size:     %s (%d bytes)\n", humanize.Bytes(maxSize), maxSize)
+	fmt.Printf("Average size:     %s (%d bytes)\n", humanize.Bytes(avgSize), avgSize)
 	fmt.Println()
 
+	// Compressed images land in the pool at their extracted size
+	poolInputSize := totalSize
+	if *sample > 0 {
+		fmt.Println("Step 2b: Compression Sampling")
+		fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+		reader := s3RangeReader{client: client, bucket: bucket}
+		var estimates []sizeEstimate
+		for _, img := range pickSamples(images, *sample) {
+			est, err := sampleObject(ctx, reader, img)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: Skipping sample: %v\n", err)
+				continue
+			}
+			kind := "raw"
+			if est.compressed {
+				kind = "gzip"
+			}
+			fmt.Printf("%-4s  %10s → %-10s  %s\n", kind, humanize.Bytes(est.size), humanize.Bytes(est.extracted), est.key)
+			estimates = append(estimates, est)
+		}
+		ratio := compressionRatio(estimates)
+		poolInputSize = int64(ratio * float64(totalSize))
+		fmt.Printf("Compression ratio: %.2fx over %d samples\n", ratio, len(estimates))
+		fmt.Printf("Extracted size:    %s (%d bytes, estimated)\n", humanize.Bytes(poolInputSize), poolInputSize)
+		fmt.Println()
+	}
+
 	fmt.Println("Step 3: Top 10 Largest Images")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	start := len(images) - 10
@@ -104,34 +158,16 @@ func main() {
 		start = 0
 	}
 	for i := start; i < len(images); i++ {
-		fmt.Printf("%-12s  %s\n", humanSize(images[i].size), images[i].key)
+		fmt.Printf("%-12s  %s\n", humanize.Bytes(images[i].size), images[i].key)
 	}
 	fmt.Println()
 
 	// Calculate recommended pool size
-	// Rule: Total size × 2 + 30% overhead for snapshots and CoW operations
-	recommendedDataSize := totalSize * 26 / 10 // 2x + 30%
-	recommendedDataSizeGB := recommendedDataSize / (1024 * 1024 * 1024)
-	if recommendedDataSize%(1024*1024*1024) != 0 {
-		recommendedDataSizeGB++
-	}
-	if recommendedDataSizeGB < 2 {
-		recommendedDataSizeGB = 2 // Minimum 2GB
-	}
-	dataSizeBytes := recommendedDataSizeGB * 1024 * 1024 * 1024
-	dataSizeSectors := dataSizeBytes / 512
-
-	// Metadata size: 0.2% of data size (minimum 4MB) - thin pool best practice
-	recommendedMetaSize := dataSizeBytes / 500
-	if recommendedMetaSize < 4*1024*1024 {
-		recommendedMetaSize = 4 * 1024 * 1024 // 4MB minimum
-	}
-	recommendedMetaSizeMB := recommendedMetaSize / (1024 * 1024)
-
-	// Low water mark: ~1% of pool size (minimum 32MB)
-	lowWaterMark := dataSizeSectors / 100
-	if lowWaterMark < 65536 {
-		lowWaterMark = 65536
+	rec := devicemapper.RecommendPoolConfig("/var/lib/flyio", poolInputSize)
+	table, err := rec.Table("$METADATA_DEV", "$DATA_DEV")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid pool configuration: %v\n", err)
+		os.Exit(1)
 	}
 
 	fmt.Println("Step 4: Devicemapper Pool Configuration")
@@ -141,11 +177,11 @@ func main() {
 	fmt.Println("  - Block size:      2048 sectors (1 MB) ← TOO LARGE, CAUSES SLOW I/O")
 	fmt.Println()
 	fmt.Println("✓ RECOMMENDED configuration (optimal performance):")
-	fmt.Printf("  - Metadata device: %d MB (0.2%% of data, min 4MB)\n", recommendedMetaSizeMB)
-	fmt.Printf("  - Data device:     %d GB (total size × 2 + 30%% overhead)\n", recommendedDataSizeGB)
-	fmt.Println("  - Block size:      256 sectors (128 KB) ← OPTIMAL FOR PERFORMANCE")
-	fmt.Printf("  - Table size:      %d sectors\n", dataSizeSectors)
-	fmt.Printf("  - Low water mark:  %d sectors (~1%% of pool)\n", lowWaterMark)
+	fmt.Printf("  - Metadata device: %s (0.2%% of data, min 4MB)\n", humanize.Bytes(rec.MetaSizeBytes))
+	fmt.Printf("  - Data device:     %s (total size × 2 + 30%% overhead)\n", humanize.Bytes(rec.DataSizeBytes))
+	fmt.Printf("  - Block size:      %d sectors (128 KB) ← OPTIMAL FOR PERFORMANCE\n", rec.DataBlockSize)
+	fmt.Printf("  - Table:           %s\n", table)
+	fmt.Println("  - Low water mark:  1% of data blocks")
 	fmt.Println()
 	fmt.Println("Pool sizing rationale:")
 	fmt.Println("  • Metadata: 0.2% of data size (thin pool best practice, min 4MB)")
@@ -157,27 +193,19 @@ func main() {
 	fmt.Println("Commands to create pool:")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Println("cd /var/lib/flyio")
-	fmt.Printf("fallocate -l %dM pool_meta\n", recommendedMetaSizeMB)
-	fmt.Printf("fallocate -l %dG pool_data\n", recommendedDataSizeGB)
+	fmt.Printf("fallocate -l %d pool_meta\n", rec.MetaSizeBytes)
+	fmt.Printf("fallocate -l %d pool_data\n", rec.DataSizeBytes)
 	fmt.Println("METADATA_DEV=$(losetup -f --show pool_meta)")
 	fmt.Println("DATA_DEV=$(losetup -f --show pool_data)")
-	fmt.Printf("dmsetup create --verifyudev pool --table \"0 %d thin-pool $METADATA_DEV $DATA_DEV 256 %d\"\n", dataSizeSectors, lowWaterMark)
+	fmt.Printf("dmsetup create --verifyudev pool --table \"%s\"\n", table)
+	fmt.Println()
+	fmt.Println("Or, equivalently:")
+	fmt.Printf("flyio-image-manager setup-pool --data-size %d --meta-size %d --block-size %d\n",
+		rec.DataSizeBytes, rec.MetaSizeBytes, rec.DataBlockSize)
+	fmt.Println("flyio-image-manager setup-pool --auto-size")
 	fmt.Println()
 }
 
 func isDirectory(key string) bool {
 	return len(key) > 0 && key[len(key)-1] == '/'
 }
-
-func humanSize(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
-	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
-	}
-	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
-}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/safeguards"
+)
+
+// alertWebhookTimeout bounds each webhook POST.
+const alertWebhookTimeout = 10 * time.Second
+
+// poolAlertPayload is the JSON body POSTed to --alert-webhook.
+type poolAlertPayload struct {
+	Pool                 string    `json:"pool"`
+	DataUsedPercent      float64   `json:"data_used_percent"`
+	MetaUsedPercent      float64   `json:"meta_used_percent"`
+	UsedDataBlocks       int64     `json:"used_data_blocks"`
+	TotalDataBlocks      int64     `json:"total_data_blocks"`
+	UsedMetaBlocks       int64     `json:"used_meta_blocks"`
+	TotalMetaBlocks      int64     `json:"total_meta_blocks"`
+	WarnPercent          float64   `json:"warn_percent"`
+	ThresholdPercent     float64   `json:"threshold_percent"`
+	MetaThresholdPercent float64   `json:"meta_threshold_percent"`
+	Time                 time.Time `json:"time"`
+}
+
+func newPoolAlertPayload(info devicemapper.PoolInfo, cfg Config, now time.Time) poolAlertPayload {
+	return poolAlertPayload{
+		Pool:                 info.Name,
+		DataUsedPercent:      info.DataUsagePercent(),
+		MetaUsedPercent:      info.MetaUsagePercent(),
+		UsedDataBlocks:       info.UsedDataBlocks,
+		TotalDataBlocks:      info.TotalDataBlocks,
+		UsedMetaBlocks:       info.UsedMetaBlocks,
+		TotalMetaBlocks:      info.TotalMetaBlocks,
+		WarnPercent:          cfg.PoolWarnThreshold,
+		ThresholdPercent:     cfg.PoolThreshold,
+		MetaThresholdPercent: cfg.PoolMetaThreshold,
+		Time:                 now.UTC(),
+	}
+}
+
+// newPoolAlerter returns the daemon's pool alerter. Each alert is logged at
+// warn and, with --alert-webhook, POSTed as JSON. The alert runs under the
+// devicemapper client's lock, so the POST is made in the background.
+func newPoolAlerter(cfg Config, logger logrus.FieldLogger, client *http.Client) *safeguards.PoolAlerter {
+	logger = logger.WithField("component", "pool-alert")
+	hard := min(cfg.PoolThreshold, cfg.PoolMetaThreshold)
+
+	return safeguards.NewPoolAlerter(safeguards.PoolAlertConfig{
+		WarnPercent: cfg.PoolWarnThreshold,
+		HardPercent: hard,
+		Alert: func(info devicemapper.PoolInfo) {
+			payload := newPoolAlertPayload(info, cfg, time.Now())
+			logger.WithFields(logrus.Fields{
+				"pool":              payload.Pool,
+				"used_percent":      payload.DataUsedPercent,
+				"meta_used_percent": payload.MetaUsedPercent,
+				"warn_percent":      payload.WarnPercent,
+				"threshold":         payload.ThresholdPercent,
+			}).Warn("pool usage above warn threshold")
+
+			if cfg.AlertWebhook == "" {
+				return
+			}
+			go func() {
+				if err := postPoolAlert(context.Background(), client, cfg.AlertWebhook, payload); err != nil {
+					logger.WithError(err).Warn("failed to send pool alert webhook")
+				}
+			}()
+		},
+	})
+}
+
+// postPoolAlert POSTs payload to url as JSON. Any non-2xx response is an error.
+func postPoolAlert(ctx context.Context, client *http.Client, url string, payload poolAlertPayload) error {
+	return postJSON(ctx, client, url, payload)
+}
+
+// postJSON POSTs payload to url as JSON, giving up after
+// alertWebhookTimeout. Any non-2xx response is an error.
+func postJSON(ctx context.Context, client *http.Client, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, alertWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+func TestPoolAlerter_PostsWebhook(t *testing.T) {
+	got := make(chan poolAlertPayload, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p poolAlertPayload
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook request = %s %s, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("decode payload: %v", err)
+		}
+		got <- p
+	}))
+	defer srv.Close()
+
+	cfg := DefaultConfig()
+	cfg.AlertWebhook = srv.URL
+	alerter := newPoolAlerter(cfg, quietLogger(), srv.Client())
+
+	info := devicemapper.PoolInfo{Name: "pool", TotalDataBlocks: 1000, UsedDataBlocks: 650, TotalMetaBlocks: 100, UsedMetaBlocks: 12}
+	alerter.Observe(info)
+	alerter.Observe(info) // same crossing: no second POST
+
+	select {
+	case p := <-got:
+		if p.Pool != "pool" || p.DataUsedPercent != 65 || p.MetaUsedPercent != 12 || p.UsedDataBlocks != 650 {
+			t.Errorf("payload = %+v, want pool at 65%% data and 12%% metadata", p)
+		}
+		if p.WarnPercent != cfg.PoolWarnThreshold || p.ThresholdPercent != cfg.PoolThreshold {
+			t.Errorf("payload thresholds = %.1f/%.1f, want %.1f/%.1f", p.WarnPercent, p.ThresholdPercent, cfg.PoolWarnThreshold, cfg.PoolThreshold)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook POST received")
+	}
+
+	select {
+	case p := <-got:
+		t.Errorf("unexpected second POST: %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPostPoolAlert_ErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	if err := postPoolAlert(context.Background(), srv.Client(), srv.URL, poolAlertPayload{}); err == nil {
+		t.Fatal("expected error for a 502 response")
+	}
+}
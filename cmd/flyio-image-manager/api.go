@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	fsm "github.com/superfly/fsm"
+	"github.com/superfly/fsm/database"
+)
+
+// apiStore is the subset of *database.DB read by the daemon API.
+type apiStore interface {
+	ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error)
+	ListActiveSnapshots(ctx context.Context) ([]*database.Snapshot, error)
+}
+
+// imageProcessor runs one image through the download → unpack → activate pipeline.
+type imageProcessor func(ctx context.Context, s3Key, imageID string) (*pipelineResult, error)
+
+// apiServer serves the daemon's HTTP API.
+//
+// POST /images/process starts a pipeline run in the background and returns
+// immediately; callers poll GET /images and GET /snapshots for the outcome.
+// The processor is responsible for serializing runs (the daemon routes them
+// through the operation guard).
+type apiServer struct {
+	ctx     context.Context // cancelled on daemon shutdown; parent of pipeline runs
+	store   apiStore
+	process imageProcessor
+	health  func(ctx context.Context) error
+	logger  logrus.FieldLogger
+
+	mu       sync.Mutex
+	inFlight map[string]bool // image IDs with a pipeline run in progress
+	draining bool            // set on shutdown; new runs are refused
+	wg       sync.WaitGroup
+}
+
+func newAPIServer(ctx context.Context, store apiStore, process imageProcessor, health func(context.Context) error, logger logrus.FieldLogger) *apiServer {
+	return &apiServer{
+		ctx:      ctx,
+		store:    store,
+		process:  process,
+		health:   health,
+		logger:   logger.WithField("component", "api"),
+		inFlight: make(map[string]bool),
+	}
+}
+
+// Handler returns the HTTP handler for the API routes.
+func (s *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /images/process", s.handleProcessImage)
+	mux.HandleFunc("GET /images", s.handleListImages)
+	mux.HandleFunc("GET /snapshots", s.handleListSnapshots)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	return mux
+}
+
+// Wait blocks until all background pipeline runs have finished.
+func (s *apiServer) Wait() {
+	s.wg.Wait()
+}
+
+// Drain stops the server accepting new pipeline runs ahead of shutdown. Runs
+// already in progress carry on; /healthz reports the daemon as draining so
+// load balancers stop sending work.
+func (s *apiServer) Drain() {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+}
+
+func (s *apiServer) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+type processImageRequest struct {
+	S3Key string `json:"s3_key"`
+}
+
+type processImageResponse struct {
+	ImageID string `json:"image_id"`
+	S3Key   string `json:"s3_key"`
+	Status  string `json:"status"`
+}
+
+func (s *apiServer) handleProcessImage(w http.ResponseWriter, r *http.Request) {
+	var req processImageRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.S3Key == "" {
+		writeAPIError(w, http.StatusBadRequest, "s3_key is required")
+		return
+	}
+
+	imageID := fsm.DeriveImageIDFromS3Key(req.S3Key)
+	logger := s.logger.WithFields(logrus.Fields{
+		"s3_key":   req.S3Key,
+		"image_id": imageID,
+	})
+
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		writeAPIError(w, http.StatusServiceUnavailable, "daemon is shutting down")
+		return
+	}
+	if s.inFlight[imageID] {
+		s.mu.Unlock()
+		writeAPIError(w, http.StatusConflict, "image is already being processed")
+		return
+	}
+	s.inFlight[imageID] = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.inFlight, imageID)
+			s.mu.Unlock()
+		}()
+
+		start := time.Now()
+		result, err := s.process(s.ctx, req.S3Key, imageID)
+		if err != nil {
+			logger.WithError(err).Error("image processing failed")
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"snapshot_id": result.SnapshotID,
+			"device_path": result.DevicePath,
+			"duration":    time.Since(start).String(),
+		}).Info("image processing completed")
+	}()
+
+	logger.Info("accepted image processing request")
+	writeJSON(w, http.StatusAccepted, processImageResponse{
+		ImageID: imageID,
+		S3Key:   req.S3Key,
+		Status:  "accepted",
+	})
+}
+
+type imageJSON struct {
+	ImageID          string     `json:"image_id"`
+	S3Key            string     `json:"s3_key"`
+	LocalPath        string     `json:"local_path"`
+	Checksum         string     `json:"checksum"`
+	ChecksumAlgo     string     `json:"checksum_algo"`
+	SizeBytes        int64      `json:"size_bytes"`
+	DownloadStatus   string     `json:"download_status"`
+	ActivationStatus string     `json:"activation_status"`
+	Processing       bool       `json:"processing"`
+	CreatedAt        time.Time  `json:"created_at"`
+	DownloadedAt     *time.Time `json:"downloaded_at,omitempty"`
+	QuarantineReason string     `json:"quarantine_reason,omitempty"`
+}
+
+func (s *apiServer) handleListImages(w http.ResponseWriter, r *http.Request) {
+	images, err := s.store.ListImages(r.Context(), r.URL.Query().Get("status"))
+	if err != nil {
+		s.logger.WithError(err).Error("failed to list images")
+		writeAPIError(w, http.StatusInternalServerError, "failed to list images")
+		return
+	}
+
+	s.mu.Lock()
+	out := make([]imageJSON, 0, len(images))
+	for _, img := range images {
+		out = append(out, imageJSON{
+			ImageID:          img.ImageID,
+			S3Key:            img.S3Key,
+			LocalPath:        img.LocalPath,
+			Checksum:         img.Checksum,
+			ChecksumAlgo:     img.ChecksumAlgo,
+			SizeBytes:        img.SizeBytes,
+			DownloadStatus:   img.DownloadStatus,
+			ActivationStatus: img.ActivationStatus,
+			Processing:       s.inFlight[img.ImageID],
+			CreatedAt:        img.CreatedAt,
+			DownloadedAt:     img.DownloadedAt,
+			QuarantineReason: img.QuarantineReason,
+		})
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+type snapshotJSON struct {
+	SnapshotID   string    `json:"snapshot_id"`
+	ImageID      string    `json:"image_id"`
+	SnapshotName string    `json:"snapshot_name"`
+	DevicePath   string    `json:"device_path"`
+	Active       bool      `json:"active"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (s *apiServer) handleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := s.store.ListActiveSnapshots(r.Context())
+	if err != nil {
+		s.logger.WithError(err).Error("failed to list snapshots")
+		writeAPIError(w, http.StatusInternalServerError, "failed to list snapshots")
+		return
+	}
+
+	out := make([]snapshotJSON, 0, len(snapshots))
+	for _, snap := range snapshots {
+		out = append(out, snapshotJSON{
+			SnapshotID:   snap.SnapshotID,
+			ImageID:      snap.ImageID,
+			SnapshotName: snap.SnapshotName,
+			DevicePath:   snap.DevicePath,
+			Active:       snap.Active,
+			CreatedAt:    snap.CreatedAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *apiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if s.isDraining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	if s.health != nil {
+		if err := s.health(r.Context()); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+				"status": "unhealthy",
+				"error":  err.Error(),
+			})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// serveAPI runs srv until ctx is cancelled, then shuts it down gracefully.
+func serveAPI(ctx context.Context, srv *http.Server) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
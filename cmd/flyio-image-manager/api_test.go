@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	fsm "github.com/superfly/fsm"
+	"github.com/superfly/fsm/database"
+)
+
+// fakeAPIStore serves canned images and snapshots.
+type fakeAPIStore struct {
+	images    []*database.Image
+	snapshots []*database.Snapshot
+	err       error
+}
+
+func (f *fakeAPIStore) ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var out []*database.Image
+	for _, img := range f.images {
+		if downloadStatus == "" || img.DownloadStatus == downloadStatus {
+			out = append(out, img)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeAPIStore) ListActiveSnapshots(ctx context.Context) ([]*database.Snapshot, error) {
+	return f.snapshots, f.err
+}
+
+// fakePipeline records processed images and blocks each run until released.
+type fakePipeline struct {
+	mu      sync.Mutex
+	calls   []string
+	release chan struct{}
+	err     error
+}
+
+func (f *fakePipeline) process(ctx context.Context, s3Key, imageID string) (*pipelineResult, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, s3Key+"="+imageID)
+	f.mu.Unlock()
+
+	if f.release != nil {
+		<-f.release
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &pipelineResult{ImageID: imageID, SnapshotID: imageID + "-snap"}, nil
+}
+
+func newTestAPI(t *testing.T, store apiStore, p *fakePipeline, health func(context.Context) error) (*apiServer, *httptest.Server) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	api := newAPIServer(context.Background(), store, p.process, health, logger)
+	srv := httptest.NewServer(api.Handler())
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func TestAPI_ProcessImage(t *testing.T) {
+	p := &fakePipeline{}
+	api, srv := newTestAPI(t, &fakeAPIStore{}, p, nil)
+
+	resp, err := http.Post(srv.URL+"/images/process", "application/json", strings.NewReader(`{"s3_key":"images/alpine.tar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+
+	var body processImageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	wantID := fsm.DeriveImageIDFromS3Key("images/alpine.tar")
+	if body.ImageID != wantID || body.S3Key != "images/alpine.tar" {
+		t.Errorf("response = %+v, want image_id %s", body, wantID)
+	}
+
+	api.Wait()
+	if len(p.calls) != 1 || p.calls[0] != "images/alpine.tar="+wantID {
+		t.Errorf("pipeline calls = %v", p.calls)
+	}
+}
+
+func TestAPI_ProcessImage_BadRequest(t *testing.T) {
+	p := &fakePipeline{}
+	_, srv := newTestAPI(t, &fakeAPIStore{}, p, nil)
+
+	for _, body := range []string{`not json`, `{}`, `{"s3_key":""}`} {
+		resp, err := http.Post(srv.URL+"/images/process", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("body %q: status = %d, want %d", body, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if len(p.calls) != 0 {
+		t.Errorf("pipeline should not run for bad requests, got %v", p.calls)
+	}
+}
+
+func TestAPI_ProcessImage_DuplicateInFlight(t *testing.T) {
+	p := &fakePipeline{release: make(chan struct{})}
+	api, srv := newTestAPI(t, &fakeAPIStore{}, p, nil)
+
+	post := func() int {
+		resp, err := http.Post(srv.URL+"/images/process", "application/json", strings.NewReader(`{"s3_key":"images/big.tar"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(); code != http.StatusAccepted {
+		t.Fatalf("first request status = %d, want %d", code, http.StatusAccepted)
+	}
+	if code := post(); code != http.StatusConflict {
+		t.Errorf("duplicate request status = %d, want %d", code, http.StatusConflict)
+	}
+
+	close(p.release)
+	api.Wait()
+
+	// Once the first run finishes the image can be submitted again
+	p.release = nil
+	if code := post(); code != http.StatusAccepted {
+		t.Errorf("resubmitted request status = %d, want %d", code, http.StatusAccepted)
+	}
+	api.Wait()
+}
+
+func TestAPI_ProcessImage_MethodNotAllowed(t *testing.T) {
+	_, srv := newTestAPI(t, &fakeAPIStore{}, &fakePipeline{}, nil)
+
+	resp, err := http.Get(srv.URL + "/images/process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAPI_ListImages(t *testing.T) {
+	downloaded := time.Date(2025, 11, 21, 20, 0, 0, 0, time.UTC)
+	store := &fakeAPIStore{images: []*database.Image{
+		{ImageID: "img-1", S3Key: "images/a.tar", DownloadStatus: database.DownloadStatusCompleted, SizeBytes: 42, DownloadedAt: &downloaded},
+		{ImageID: "img-2", S3Key: "images/b.tar", DownloadStatus: database.DownloadStatusDownloading},
+	}}
+	_, srv := newTestAPI(t, store, &fakePipeline{}, nil)
+
+	resp, err := http.Get(srv.URL + "/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var images []imageJSON
+	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("got %d images, want 2", len(images))
+	}
+	if images[0].ImageID != "img-1" || images[0].SizeBytes != 42 || images[0].DownloadedAt == nil {
+		t.Errorf("images[0] = %+v", images[0])
+	}
+
+	// Filter by download status
+	resp2, err := http.Get(srv.URL + "/images?status=" + database.DownloadStatusCompleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	images = nil
+	if err := json.NewDecoder(resp2.Body).Decode(&images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ImageID != "img-1" {
+		t.Errorf("filtered images = %+v, want only img-1", images)
+	}
+}
+
+func TestAPI_ListSnapshots(t *testing.T) {
+	store := &fakeAPIStore{snapshots: []*database.Snapshot{
+		{SnapshotID: "snap-1", ImageID: "img-1", SnapshotName: "snap-img-1", DevicePath: "/dev/mapper/snap-img-1", Active: true},
+	}}
+	_, srv := newTestAPI(t, store, &fakePipeline{}, nil)
+
+	resp, err := http.Get(srv.URL + "/snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var snaps []snapshotJSON
+	if err := json.NewDecoder(resp.Body).Decode(&snaps); err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 || snaps[0].SnapshotID != "snap-1" || snaps[0].DevicePath != "/dev/mapper/snap-img-1" {
+		t.Errorf("snapshots = %+v", snaps)
+	}
+}
+
+func TestAPI_StoreError(t *testing.T) {
+	_, srv := newTestAPI(t, &fakeAPIStore{err: errors.New("db locked")}, &fakePipeline{}, nil)
+
+	for _, path := range []string{"/images", "/snapshots"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("%s status = %d, want %d", path, resp.StatusCode, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestAPI_Healthz(t *testing.T) {
+	var healthErr error
+	health := func(ctx context.Context) error { return healthErr }
+	_, srv := newTestAPI(t, &fakeAPIStore{}, &fakePipeline{}, health)
+
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("healthy status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	healthErr = errors.New("pool needs_check")
+	resp, err = http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unhealthy status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	if !strings.Contains(body["error"], "needs_check") {
+		t.Errorf("body = %v, want health error", body)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	fsm "github.com/superfly/fsm"
+	"github.com/superfly/fsm/tui"
+)
+
+// BatchResult reports the outcome of a process-batch run.
+type BatchResult struct {
+	Succeeded []string
+	Failed    []BatchFailure
+	Skipped   []BatchSkip
+}
+
+// BatchFailure is a key whose pipeline run failed.
+type BatchFailure struct {
+	Key string
+	Err error
+}
+
+// BatchSkip is a key that was not run.
+type BatchSkip struct {
+	Key    string
+	Reason string
+}
+
+// runProcessBatch runs every key in cfg.KeysFile through the pipeline, one at
+// a time, holding the manager lock for the whole batch. With cfg.Pipeline,
+// downloads run concurrently ahead of the unpack/activate lane.
+func runProcessBatch(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	keys, err := readBatchKeysFile(cfg.KeysFile)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no S3 keys in %s", cfg.KeysFile)
+	}
+
+	// SIGINT/SIGTERM stops after the current image; the rest are skipped.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Hold the manager lock across the batch so no other process can slip
+	// devicemapper work in between images.
+	if err := acquireManagerLock(cfg.FSMDBPath, cfg.LockWait); err != nil {
+		return err
+	}
+	defer releaseManagerLock(cfg.FSMDBPath)
+
+	logger := log.WithFields(logrus.Fields{
+		"command": "process-batch",
+		"keys":    len(keys),
+	})
+
+	if cfg.Pipeline {
+		return runPipelinedBatch(ctx, cfg, logger, keys)
+	}
+
+	run := func(ctx context.Context, s3Key string) (bool, error) {
+		keyCfg := cfg
+		keyCfg.S3Key = s3Key
+		keyCfg.ImageID = fsm.DeriveImageIDFromS3Key(s3Key)
+		result, err := runFSMPipelineLocked(ctx, keyCfg, tui.NewProgressTracker(), false)
+		return result != nil && err == nil, err
+	}
+	stabilize := func(succeeded bool) {
+		stabilizeAfterOperation(ctx, cfg.PoolName, succeeded)
+	}
+
+	result := processBatch(ctx, logger, keys, run, stabilize)
+	printBatchSummary(os.Stdout, result)
+
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d of %d images failed", len(result.Failed), len(keys))
+	}
+	return nil
+}
+
+// processBatch runs keys through run sequentially, calling stabilize after
+// every run whether or not it succeeded. A failed key is recorded and the
+// batch moves on; duplicate keys, and every key left once ctx is cancelled,
+// are skipped.
+//
+// run reports whether the pipeline got far enough to leave devices in a
+// settled state, which only changes how much checking stabilize does.
+func processBatch(ctx context.Context, logger logrus.FieldLogger, keys []string, run func(ctx context.Context, s3Key string) (bool, error), stabilize func(succeeded bool)) *BatchResult {
+	result := &BatchResult{}
+	seen := make(map[string]bool, len(keys))
+
+	for i, key := range keys {
+		if seen[key] {
+			result.Skipped = append(result.Skipped, BatchSkip{Key: key, Reason: "duplicate"})
+			continue
+		}
+		seen[key] = true
+
+		if ctx.Err() != nil {
+			result.Skipped = append(result.Skipped, BatchSkip{Key: key, Reason: "interrupted"})
+			continue
+		}
+
+		keyLogger := logger.WithFields(logrus.Fields{
+			"s3_key":   key,
+			"position": fmt.Sprintf("%d/%d", i+1, len(keys)),
+		})
+		keyLogger.Info("processing batch image")
+
+		succeeded, err := run(ctx, key)
+
+		// CRITICAL: Stabilize after every image, even on failure, before the
+		// next one touches the pool.
+		stabilize(succeeded)
+
+		if err != nil {
+			keyLogger.WithError(err).Error("batch image failed")
+			result.Failed = append(result.Failed, BatchFailure{Key: key, Err: err})
+			continue
+		}
+		keyLogger.Info("batch image processed")
+		result.Succeeded = append(result.Succeeded, key)
+	}
+
+	return result
+}
+
+// runPipelinedBatch is runProcessBatch for cfg.Pipeline: one FSM manager
+// serves the whole batch, up to cfg.DownloadQueueSize downloads run at once,
+// and each completed download is unpacked and activated on its own.
+func runPipelinedBatch(ctx context.Context, cfg Config, logger logrus.FieldLogger, keys []string) error {
+	if err := prepareDeviceWork(ctx, cfg); err != nil {
+		return err
+	}
+
+	p, closePipeline, err := startPipeline(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	defer closePipeline()
+
+	keyConfig := func(s3Key string) Config {
+		keyCfg := cfg
+		keyCfg.S3Key = s3Key
+		keyCfg.ImageID = fsm.DeriveImageIDFromS3Key(s3Key)
+		return keyCfg
+	}
+	download := func(ctx context.Context, s3Key string) error {
+		return p.download(ctx, keyConfig(s3Key), tui.NewProgressTracker())
+	}
+	install := func(ctx context.Context, s3Key string) (bool, error) {
+		keyCfg := keyConfig(s3Key)
+		err := operationGuard.WithOperation(ctx, "process-image:"+keyCfg.ImageID, func() error {
+			if err := prepareDeviceWork(ctx, cfg); err != nil {
+				return err
+			}
+			_, err := p.install(ctx, keyCfg, tui.NewProgressTracker())
+			return err
+		})
+		return err == nil, err
+	}
+	stabilize := func(succeeded bool) {
+		stabilizeAfterOperation(ctx, cfg.PoolName, succeeded)
+	}
+
+	result := pipelineBatch(ctx, logger, keys, cfg.DownloadQueueSize, download, install, stabilize)
+	printBatchSummary(os.Stdout, result)
+
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d of %d images failed", len(result.Failed), len(keys))
+	}
+	return nil
+}
+
+// pipelineBatch is processBatch with downloads running ahead: up to
+// downloads keys are downloaded concurrently, and each key is installed
+// (unpacked and activated) as soon as its download completes, in completion
+// order.
+//
+// CRITICAL: install and stabilize only ever run on the calling goroutine, one
+// key at a time, so devicemapper work stays serialized however many downloads
+// are in flight.
+//
+// A key whose download fails is recorded as failed without being installed.
+// Once ctx is cancelled, no new downloads start and no further installs run;
+// those keys are skipped.
+func pipelineBatch(ctx context.Context, logger logrus.FieldLogger, keys []string, downloads int, download func(ctx context.Context, s3Key string) error, install func(ctx context.Context, s3Key string) (bool, error), stabilize func(succeeded bool)) *BatchResult {
+	result := &BatchResult{}
+	downloads = max(downloads, 1)
+
+	var unique []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			result.Skipped = append(result.Skipped, BatchSkip{Key: key, Reason: "duplicate"})
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, key)
+	}
+
+	type downloaded struct {
+		key string
+		err error
+	}
+	jobs := make(chan string)
+	done := make(chan downloaded, len(unique)) // never blocks a download worker
+
+	go func() {
+		defer close(jobs)
+		for _, key := range unique {
+			select {
+			case jobs <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range downloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				logger.WithField("s3_key", key).Info("downloading batch image")
+				done <- downloaded{key: key, err: download(ctx, key)}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	handled := make(map[string]bool, len(unique))
+	installed := 0
+	for d := range done {
+		handled[d.key] = true
+		keyLogger := logger.WithField("s3_key", d.key)
+
+		if d.err != nil {
+			keyLogger.WithError(d.err).Error("batch image download failed")
+			result.Failed = append(result.Failed, BatchFailure{Key: d.key, Err: d.err})
+			continue
+		}
+		if ctx.Err() != nil {
+			result.Skipped = append(result.Skipped, BatchSkip{Key: d.key, Reason: "interrupted"})
+			continue
+		}
+
+		installed++
+		keyLogger = keyLogger.WithField("position", fmt.Sprintf("%d/%d", installed, len(unique)))
+		keyLogger.Info("installing batch image")
+
+		succeeded, err := install(ctx, d.key)
+
+		// CRITICAL: Stabilize after every image, even on failure, before the
+		// next one touches the pool.
+		stabilize(succeeded)
+
+		if err != nil {
+			keyLogger.WithError(err).Error("batch image failed")
+			result.Failed = append(result.Failed, BatchFailure{Key: d.key, Err: err})
+			continue
+		}
+		keyLogger.Info("batch image processed")
+		result.Succeeded = append(result.Succeeded, d.key)
+	}
+
+	// Keys never handed to a download worker.
+	for _, key := range unique {
+		if !handled[key] {
+			result.Skipped = append(result.Skipped, BatchSkip{Key: key, Reason: "interrupted"})
+		}
+	}
+
+	return result
+}
+
+// readBatchKeysFile reads keys from path, or from stdin when path is "-".
+func readBatchKeysFile(path string) ([]string, error) {
+	if path == "-" {
+		return readBatchKeys(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keys file: %w", err)
+	}
+	defer f.Close()
+	return readBatchKeys(f)
+}
+
+// readBatchKeys reads newline-delimited S3 keys. Blank lines and lines
+// starting with '#' are ignored.
+func readBatchKeys(r io.Reader) ([]string, error) {
+	var keys []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read keys: %w", err)
+	}
+	return keys, nil
+}
+
+// printBatchSummary prints the counts and per-key errors of a batch run.
+func printBatchSummary(w io.Writer, r *BatchResult) {
+	fmt.Fprintf(w, "Batch complete: %d succeeded, %d failed, %d skipped\n",
+		len(r.Succeeded), len(r.Failed), len(r.Skipped))
+	for _, f := range r.Failed {
+		fmt.Fprintf(w, "  FAILED  %s: %v\n", f.Key, f.Err)
+	}
+	for _, s := range r.Skipped {
+		fmt.Fprintf(w, "  SKIPPED %s (%s)\n", s.Key, s.Reason)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBatchPipeline records run and stabilize calls into one log so tests can
+// check that every run is followed by stabilization before the next starts.
+type fakeBatchPipeline struct {
+	fail  map[string]error
+	calls []string
+
+	onRun func(s3Key string) // Optional hook, e.g. to cancel mid-batch
+}
+
+func (p *fakeBatchPipeline) run(ctx context.Context, s3Key string) (bool, error) {
+	p.calls = append(p.calls, "run "+s3Key)
+	if p.onRun != nil {
+		p.onRun(s3Key)
+	}
+	if err := p.fail[s3Key]; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *fakeBatchPipeline) stabilize(succeeded bool) {
+	if succeeded {
+		p.calls = append(p.calls, "stabilize ok")
+	} else {
+		p.calls = append(p.calls, "stabilize failed")
+	}
+}
+
+func TestProcessBatch_ContinuesPastFailures(t *testing.T) {
+	p := &fakeBatchPipeline{fail: map[string]error{
+		"images/python/1.tar": errors.New("unpack FSM failed: checksum mismatch"),
+	}}
+	keys := []string{"images/golang/1.tar", "images/python/1.tar", "images/node/3.tar", "images/golang/1.tar"}
+
+	result := processBatch(context.Background(), quietLogger(), keys, p.run, p.stabilize)
+
+	want := []string{
+		"run images/golang/1.tar", "stabilize ok",
+		"run images/python/1.tar", "stabilize failed",
+		"run images/node/3.tar", "stabilize ok",
+	}
+	if got := strings.Join(p.calls, ","); got != strings.Join(want, ",") {
+		t.Errorf("calls =\n  %s\nwant\n  %s", got, strings.Join(want, ","))
+	}
+
+	if got := strings.Join(result.Succeeded, ","); got != "images/golang/1.tar,images/node/3.tar" {
+		t.Errorf("Succeeded = %s", got)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Key != "images/python/1.tar" {
+		t.Fatalf("Failed = %+v", result.Failed)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0] != (BatchSkip{Key: "images/golang/1.tar", Reason: "duplicate"}) {
+		t.Errorf("Skipped = %+v, want the duplicate golang/1", result.Skipped)
+	}
+}
+
+func TestProcessBatch_InterruptSkipsRest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := &fakeBatchPipeline{onRun: func(s3Key string) {
+		if s3Key == "images/python/1.tar" {
+			cancel()
+		}
+	}}
+	keys := []string{"images/golang/1.tar", "images/python/1.tar", "images/node/3.tar", "images/ruby/2.tar"}
+
+	result := processBatch(ctx, quietLogger(), keys, p.run, p.stabilize)
+
+	// The image in flight when the signal arrives still finishes and stabilizes.
+	if got := strings.Join(p.calls, ","); got != "run images/golang/1.tar,stabilize ok,run images/python/1.tar,stabilize ok" {
+		t.Errorf("calls = %s", got)
+	}
+	if len(result.Succeeded) != 2 || len(result.Failed) != 0 {
+		t.Errorf("succeeded/failed = %v/%v", result.Succeeded, result.Failed)
+	}
+	want := []BatchSkip{{"images/node/3.tar", "interrupted"}, {"images/ruby/2.tar", "interrupted"}}
+	if len(result.Skipped) != 2 || result.Skipped[0] != want[0] || result.Skipped[1] != want[1] {
+		t.Errorf("Skipped = %+v, want %+v", result.Skipped, want)
+	}
+}
+
+// fakeLanes is a download/install pair that records how many of each run at
+// once. Downloads block until wantOverlap of them are in flight (or a second
+// passes), so a serialized implementation fails instead of deadlocking.
+type fakeLanes struct {
+	wantOverlap int
+	failDL      map[string]bool
+
+	mu                        sync.Mutex
+	downloads, installs       int
+	maxDownloads, maxInstalls int
+	installed, stabilized     []string
+	overlapped                chan struct{}
+	once                      sync.Once
+}
+
+func newFakeLanes(wantOverlap int) *fakeLanes {
+	return &fakeLanes{wantOverlap: wantOverlap, overlapped: make(chan struct{})}
+}
+
+func (f *fakeLanes) download(ctx context.Context, s3Key string) error {
+	f.mu.Lock()
+	f.downloads++
+	f.maxDownloads = max(f.maxDownloads, f.downloads)
+	if f.downloads >= f.wantOverlap {
+		f.once.Do(func() { close(f.overlapped) })
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-f.overlapped:
+	case <-time.After(time.Second):
+	}
+
+	f.mu.Lock()
+	f.downloads--
+	f.mu.Unlock()
+	if f.failDL[s3Key] {
+		return errors.New("access denied")
+	}
+	return nil
+}
+
+func (f *fakeLanes) install(ctx context.Context, s3Key string) (bool, error) {
+	f.mu.Lock()
+	f.installs++
+	f.maxInstalls = max(f.maxInstalls, f.installs)
+	f.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	f.mu.Lock()
+	f.installs--
+	f.installed = append(f.installed, s3Key)
+	f.mu.Unlock()
+	return true, nil
+}
+
+func (f *fakeLanes) stabilize(succeeded bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stabilized = append(f.stabilized, f.installed[len(f.installed)-1])
+}
+
+func TestPipelineBatch_DownloadsOverlapInstallsDoNot(t *testing.T) {
+	lanes := newFakeLanes(3)
+	keys := []string{"images/a/1.tar", "images/b/1.tar", "images/c/1.tar", "images/d/1.tar", "images/e/1.tar", "images/f/1.tar"}
+
+	result := pipelineBatch(context.Background(), quietLogger(), keys, 3, lanes.download, lanes.install, lanes.stabilize)
+
+	if lanes.maxDownloads != 3 {
+		t.Errorf("max concurrent downloads = %d, want 3", lanes.maxDownloads)
+	}
+	if lanes.maxInstalls != 1 {
+		t.Errorf("max concurrent installs = %d, want 1", lanes.maxInstalls)
+	}
+	if len(result.Succeeded) != len(keys) || len(result.Failed) != 0 {
+		t.Fatalf("succeeded/failed = %v/%v", result.Succeeded, result.Failed)
+	}
+	// Every install is followed by its stabilization before the next one.
+	if strings.Join(lanes.stabilized, ",") != strings.Join(lanes.installed, ",") {
+		t.Errorf("stabilized %v, installed %v", lanes.stabilized, lanes.installed)
+	}
+}
+
+func TestPipelineBatch_FailedDownloadNotInstalled(t *testing.T) {
+	lanes := newFakeLanes(2)
+	lanes.failDL = map[string]bool{"images/b/1.tar": true}
+	keys := []string{"images/a/1.tar", "images/b/1.tar", "images/a/1.tar", "images/c/1.tar"}
+
+	result := pipelineBatch(context.Background(), quietLogger(), keys, 2, lanes.download, lanes.install, lanes.stabilize)
+
+	sort.Strings(lanes.installed)
+	if got := strings.Join(lanes.installed, ","); got != "images/a/1.tar,images/c/1.tar" {
+		t.Errorf("installed = %s, want a and c", got)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Key != "images/b/1.tar" {
+		t.Errorf("Failed = %+v, want images/b/1.tar", result.Failed)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0] != (BatchSkip{Key: "images/a/1.tar", Reason: "duplicate"}) {
+		t.Errorf("Skipped = %+v, want the duplicate a/1", result.Skipped)
+	}
+}
+
+func TestPipelineBatch_InterruptSkipsRest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var installed []string
+	download := func(ctx context.Context, s3Key string) error { return nil }
+	install := func(ctx context.Context, s3Key string) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		installed = append(installed, s3Key)
+		cancel()
+		return true, nil
+	}
+	keys := []string{"images/a/1.tar", "images/b/1.tar", "images/c/1.tar", "images/d/1.tar"}
+
+	result := pipelineBatch(ctx, quietLogger(), keys, 1, download, install, func(bool) {})
+
+	if len(installed) != 1 || len(result.Succeeded) != 1 {
+		t.Fatalf("installed %v, succeeded %v; want exactly one install", installed, result.Succeeded)
+	}
+	if len(result.Succeeded)+len(result.Skipped) != len(keys) {
+		t.Errorf("succeeded %v + skipped %+v do not cover all %d keys", result.Succeeded, result.Skipped, len(keys))
+	}
+	for _, skip := range result.Skipped {
+		if skip.Reason != "interrupted" {
+			t.Errorf("skip %+v, want interrupted", skip)
+		}
+	}
+}
+
+func TestReadBatchKeys(t *testing.T) {
+	input := "images/golang/1.tar\n\n  images/python/1.tar  \n# pre-warm for the node rollout\nimages/node/3.tar"
+
+	keys, err := readBatchKeys(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("readBatchKeys() error = %v", err)
+	}
+	if got := strings.Join(keys, ","); got != "images/golang/1.tar,images/python/1.tar,images/node/3.tar" {
+		t.Errorf("keys = %s", got)
+	}
+}
+
+func TestPrintBatchSummary(t *testing.T) {
+	var buf bytes.Buffer
+	printBatchSummary(&buf, &BatchResult{
+		Succeeded: []string{"images/golang/1.tar"},
+		Failed:    []BatchFailure{{Key: "images/python/1.tar", Err: errors.New("checksum mismatch")}},
+		Skipped:   []BatchSkip{{Key: "images/node/3.tar", Reason: "interrupted"}},
+	})
+
+	out := buf.String()
+	for _, want := range []string{
+		"1 succeeded, 1 failed, 1 skipped",
+		"FAILED  images/python/1.tar: checksum mismatch",
+		"SKIPPED images/node/3.tar (interrupted)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("summary missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/superfly/fsm/checksum"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfigFile reads a YAML config file on top of DefaultConfig().
+//
+// Keys are the flag names (bucket, pool, download-queue, download-timeout,
+// ...); durations use Go syntax ("5m", "1h30m"). Unknown keys are an error so
+// a typo doesn't silently fall back to a default.
+func LoadConfigFile(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// normalizeChecksumAlgo validates cfg.ChecksumAlgo and stores it in the
+// lower-case form the download and the S3 client compare against, so a bad
+// value fails at startup rather than on the first download.
+func normalizeChecksumAlgo(cfg *Config) error {
+	algo, err := checksum.ParseAlgo(cfg.ChecksumAlgo)
+	if err != nil {
+		return fmt.Errorf("invalid --checksum-algo: %w", err)
+	}
+	cfg.ChecksumAlgo = string(algo)
+	return nil
+}
+
+// configFromArgs returns the base Config for a subcommand: the --config file
+// named in args if there is one, otherwise DefaultConfig(). Flags are parsed
+// on top of the result, so explicit flags override file values.
+func configFromArgs(args []string) (Config, error) {
+	path := configPathFromArgs(args)
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+	return LoadConfigFile(path)
+}
+
+// configPathFromArgs finds --config (or -config) in args, accepting both
+// "--config file" and "--config=file". Flag values are skipped over rather
+// than stopping the scan, since without the FlagSet we can't tell a value
+// from a positional argument.
+func configPathFromArgs(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return ""
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if value, ok := strings.CutPrefix(name, "config="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// registerConfigFlag declares --config on fs. The file itself is loaded by
+// configFromArgs before the other flags are registered; this only makes the
+// flag parse and show up in --help.
+func registerConfigFlag(fs *flag.FlagSet) {
+	fs.String("config", "", "YAML config file (explicit flags override its values)")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+bucket: file-bucket
+region: eu-west-1
+pool: file-pool
+download-queue: 3
+unpack-queue: 2
+download-timeout: 20m
+unpack-timeout: 1h
+verify-timeout: 2m
+max-download-retries: 10
+max-unpack-retries: 0
+`)
+
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+
+	def := DefaultConfig()
+	if cfg.S3Bucket != "file-bucket" || cfg.S3Region != "eu-west-1" || cfg.PoolName != "file-pool" {
+		t.Errorf("string fields = %q %q %q", cfg.S3Bucket, cfg.S3Region, cfg.PoolName)
+	}
+	if cfg.DownloadQueueSize != 3 || cfg.UnpackQueueSize != 2 {
+		t.Errorf("queue sizes = %d %d, want 3 2", cfg.DownloadQueueSize, cfg.UnpackQueueSize)
+	}
+	if cfg.DownloadTimeout != 20*time.Minute || cfg.UnpackTimeout != time.Hour || cfg.VerifyTimeout != 2*time.Minute {
+		t.Errorf("timeouts = %v %v %v, want 20m 1h 2m", cfg.DownloadTimeout, cfg.UnpackTimeout, cfg.VerifyTimeout)
+	}
+	if cfg.MaxDownloadRetries != 10 || cfg.MaxUnpackRetries != 0 || cfg.MaxActivateRetries != def.MaxActivateRetries {
+		t.Errorf("retries = %d %d %d, want 10 0 %d", cfg.MaxDownloadRetries, cfg.MaxUnpackRetries, cfg.MaxActivateRetries, def.MaxActivateRetries)
+	}
+	// Keys absent from the file keep their defaults
+	if cfg.DBPath != def.DBPath || cfg.Listen != def.Listen || !cfg.AutoDerive {
+		t.Errorf("defaults not preserved: db=%q listen=%q auto-derive=%v", cfg.DBPath, cfg.Listen, cfg.AutoDerive)
+	}
+}
+
+func TestLoadConfigFile_Empty(t *testing.T) {
+	cfg, err := LoadConfigFile(writeConfigFile(t, ""))
+	if err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+	if cfg != DefaultConfig() {
+		t.Errorf("empty file should give DefaultConfig(), got %+v", cfg)
+	}
+}
+
+func TestLoadConfigFile_UnknownKey(t *testing.T) {
+	path := writeConfigFile(t, "bucket: b\npool-name: typo\n")
+
+	_, err := LoadConfigFile(path)
+	if err == nil {
+		t.Fatal("expected error for unknown key")
+	}
+	if !strings.Contains(err.Error(), "pool-name") {
+		t.Errorf("error = %v, want it to name the unknown key", err)
+	}
+}
+
+func TestLoadConfigFile_Missing(t *testing.T) {
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "bucket: file-bucket\npool: file-pool\ndownload-queue: 3\nunpack-timeout: 1h\n")
+	args := []string{"--pool", "flag-pool", "--config", path, "--listen=:9090", "--unpack-timeout=20m"}
+
+	cfg, err := configFromArgs(args)
+	if err != nil {
+		t.Fatalf("configFromArgs() error = %v", err)
+	}
+	parseDaemonFlags(&cfg, flag.NewFlagSet("daemon", flag.ContinueOnError), args)
+
+	def := DefaultConfig()
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"default", cfg.DBPath, def.DBPath},
+		{"file", cfg.S3Bucket, "file-bucket"},
+		{"file queue size", cfg.DownloadQueueSize, 3},
+		{"flag over file", cfg.PoolName, "flag-pool"},
+		{"flag over default", cfg.Listen, ":9090"},
+		{"timeout flag over file", cfg.UnpackTimeout, 20 * time.Minute},
+		{"default timeout", cfg.VerifyTimeout, def.VerifyTimeout},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestPipelineFlags(t *testing.T) {
+	shared := []string{"--stream-extract", "--max-pressure=7", "--bucket=flag-bucket"}
+	for _, tt := range []struct {
+		name  string
+		parse func(*Config, *flag.FlagSet, []string)
+		args  []string
+	}{
+		{"process-image", parseProcessImageFlags, []string{"--s3-key=images/alpine.tar", "--image-id=alpine"}},
+		{"process-batch", parseProcessBatchFlags, []string{"--keys-file=keys.txt"}},
+		{"daemon", parseDaemonFlags, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.parse(&cfg, flag.NewFlagSet(tt.name, flag.ContinueOnError), append(tt.args, shared...))
+			if !cfg.StreamExtract || cfg.MaxPressure != 7 || cfg.S3Bucket != "flag-bucket" {
+				t.Errorf("stream-extract %v, max-pressure %v, bucket %q; want the shared flags applied", cfg.StreamExtract, cfg.MaxPressure, cfg.S3Bucket)
+			}
+		})
+	}
+}
+
+func TestConfigPathFromArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"--pool", "p"}, ""},
+		{[]string{"--config", "a.yaml"}, "a.yaml"},
+		{[]string{"-config=b.yaml", "--pool", "p"}, "b.yaml"},
+		{[]string{"--pool", "p", "--config=c.yaml"}, "c.yaml"},
+		{[]string{"--", "--config", "d.yaml"}, ""},
+	}
+	for _, tt := range tests {
+		if got := configPathFromArgs(tt.args); got != tt.want {
+			t.Errorf("configPathFromArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSetupLogger_Format(t *testing.T) {
+	defer func(f logrus.Formatter, l logrus.Level) { log.SetFormatter(f); log.SetLevel(l) }(log.Formatter, log.Level)
+
+	tests := []struct {
+		command string
+		args    []string
+		want    logrus.Formatter
+	}{
+		{"daemon", nil, &logrus.JSONFormatter{}},
+		{"daemon", []string{"--log-format", "text"}, &logrus.TextFormatter{}},
+		{"list-images", nil, &logrus.TextFormatter{}},
+		{"list-images", []string{"--log-format=json"}, &logrus.JSONFormatter{}},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		cfg.LogFormat = defaultLogFormat(tt.command)
+		fs := flag.NewFlagSet(tt.command, flag.ContinueOnError)
+		if tt.command == "daemon" {
+			parseDaemonFlags(&cfg, fs, tt.args)
+		} else {
+			parseListImagesFlags(&cfg, fs, tt.args)
+		}
+
+		if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+			t.Fatalf("%s %q: setupLogger() error = %v", tt.command, tt.args, err)
+		}
+		if got, want := reflect.TypeOf(log.Formatter), reflect.TypeOf(tt.want); got != want {
+			t.Errorf("%s %q: formatter = %v, want %v", tt.command, tt.args, got, want)
+		}
+	}
+
+	if err := setupLogger("info", "xml"); err == nil {
+		t.Error("setupLogger(xml) succeeded, want an invalid format error")
+	}
+}
+
+func TestRetryPolicyFromFlag(t *testing.T) {
+	// RetryPolicy reads zero as "use the default", so --max-*-retries 0 must
+	// become a negative entry to mean no retries.
+	for n, want := range map[int]uint64{0: 0, -3: 0, 1: 1, 10: 10} {
+		if got := retryPolicyFromFlag("download", n).Limit("download", 5); got != want {
+			t.Errorf("retryPolicyFromFlag(%d) limit = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestNormalizeChecksumAlgo(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ChecksumAlgo = " BLAKE3 "
+	if err := normalizeChecksumAlgo(&cfg); err != nil {
+		t.Fatalf("normalizeChecksumAlgo() error = %v", err)
+	}
+	if cfg.ChecksumAlgo != "blake3" {
+		t.Errorf("ChecksumAlgo = %q, want blake3", cfg.ChecksumAlgo)
+	}
+
+	cfg.ChecksumAlgo = "md5"
+	if err := normalizeChecksumAlgo(&cfg); err == nil {
+		t.Error("normalizeChecksumAlgo(md5) succeeded, want an error")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// snapshotStore is the subset of *database.DB used by deactivate-snapshot.
+type snapshotStore interface {
+	GetSnapshotByID(ctx context.Context, snapshotID string) (*database.Snapshot, error)
+	GetSnapshotsByImageID(ctx context.Context, imageID string) ([]*database.Snapshot, error)
+	DeactivateSnapshot(ctx context.Context, snapshotID string) error
+}
+
+// snapshotDeactivator is the subset of *devicemapper.Client used by deactivate-snapshot.
+type snapshotDeactivator interface {
+	DeactivateDevice(ctx context.Context, deviceName string) error
+}
+
+// runDeactivateSnapshot tears down active snapshot devices and marks them
+// inactive in the database.
+func runDeactivateSnapshot(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	logger := log.WithField("command", "deactivate-snapshot")
+
+	if cfg.DryRun {
+		logger.Info("Running in DRY RUN mode - no changes will be made")
+	}
+
+	return withDMCommand(ctx, cfg, "deactivate-snapshot", cfg.DryRun, func() error {
+		db, err := database.New(database.Config{Path: cfg.DBPath})
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+		dmClient.SetOperationRecorder(dmRecorder{db})
+
+		snapshots, err := deactivateSnapshots(ctx, logger, db, dmClient, cfg.SnapshotID, cfg.ImageID, cfg.DryRun)
+		for _, snap := range snapshots {
+			if cfg.DryRun {
+				fmt.Printf("Would deactivate %s (device %s)\n", snap.SnapshotID, snap.SnapshotName)
+			} else {
+				fmt.Printf("Deactivated %s (device %s)\n", snap.SnapshotID, snap.SnapshotName)
+			}
+		}
+		return err
+	})
+}
+
+// deactivateSnapshots resolves the active snapshots selected by snapshotID or
+// imageID, removes each snapshot's device, and marks it inactive.
+//
+// Returns the snapshots that were (or, in dry-run mode, would be) deactivated.
+// Processing stops at the first failure; a snapshot whose device could not be
+// removed keeps its active database row so the state stays truthful.
+func deactivateSnapshots(ctx context.Context, logger logrus.FieldLogger, store snapshotStore, dm snapshotDeactivator, snapshotID, imageID string, dryRun bool) ([]*database.Snapshot, error) {
+	targets, err := resolveSnapshots(ctx, store, snapshotID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	return deactivateEach(ctx, logger, store, dm.DeactivateDevice, targets, dryRun)
+}
+
+// snapshotMarker is the subset of *database.DB that marks a snapshot inactive.
+type snapshotMarker interface {
+	DeactivateSnapshot(ctx context.Context, snapshotID string) error
+}
+
+// deactivateEach removes each target's device with deactivate and then marks
+// it inactive, stopping at the first failure. A device deactivate reports as
+// busy (devicemapper.DeviceBusyError) is skipped and stays active. Shared by
+// deactivate-snapshot and reap-snapshots.
+func deactivateEach(ctx context.Context, logger logrus.FieldLogger, store snapshotMarker, deactivate func(ctx context.Context, deviceName string) error, targets []*database.Snapshot, dryRun bool) ([]*database.Snapshot, error) {
+	var done []*database.Snapshot
+	for _, snap := range targets {
+		snapLogger := logger.WithFields(logrus.Fields{
+			"snapshot_id":   snap.SnapshotID,
+			"snapshot_name": snap.SnapshotName,
+			"image_id":      snap.ImageID,
+		})
+
+		if dryRun {
+			snapLogger.Info("would deactivate snapshot")
+			done = append(done, snap)
+			continue
+		}
+
+		snapLogger.Info("deactivating snapshot device")
+		if err := deactivate(ctx, snap.SnapshotName); err != nil {
+			if devicemapper.IsDeviceBusyError(err) {
+				snapLogger.WithError(err).Warn("snapshot device in use, skipping")
+				continue
+			}
+			return done, fmt.Errorf("failed to deactivate device %s: %w", snap.SnapshotName, err)
+		}
+
+		if err := store.DeactivateSnapshot(ctx, snap.SnapshotID); err != nil {
+			return done, fmt.Errorf("device %s removed but database update failed: %w", snap.SnapshotName, err)
+		}
+
+		snapLogger.Info("snapshot deactivated")
+		done = append(done, snap)
+	}
+
+	return done, nil
+}
+
+// resolveSnapshots returns the active snapshots selected by snapshotID or imageID.
+func resolveSnapshots(ctx context.Context, store snapshotStore, snapshotID, imageID string) ([]*database.Snapshot, error) {
+	if snapshotID != "" {
+		snap, err := store.GetSnapshotByID(ctx, snapshotID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up snapshot: %w", err)
+		}
+		if snap == nil {
+			return nil, fmt.Errorf("snapshot not found: %s", snapshotID)
+		}
+		if !snap.Active {
+			return nil, fmt.Errorf("snapshot %s is already inactive", snapshotID)
+		}
+		return []*database.Snapshot{snap}, nil
+	}
+
+	snaps, err := store.GetSnapshotsByImageID(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up snapshots: %w", err)
+	}
+
+	var active []*database.Snapshot
+	for _, snap := range snaps {
+		if snap.Active {
+			active = append(active, snap)
+		}
+	}
+	if len(active) == 0 {
+		return nil, fmt.Errorf("no active snapshots for image %s", imageID)
+	}
+	return active, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+)
+
+// fakeSnapshotStore is an in-memory snapshotStore mirroring the snapshots table.
+type fakeSnapshotStore struct {
+	snapshots map[string]*database.Snapshot
+}
+
+func newFakeSnapshotStore(snaps ...*database.Snapshot) *fakeSnapshotStore {
+	s := &fakeSnapshotStore{snapshots: make(map[string]*database.Snapshot)}
+	for _, snap := range snaps {
+		s.snapshots[snap.SnapshotID] = snap
+	}
+	return s
+}
+
+func (s *fakeSnapshotStore) GetSnapshotByID(ctx context.Context, snapshotID string) (*database.Snapshot, error) {
+	return s.snapshots[snapshotID], nil
+}
+
+func (s *fakeSnapshotStore) GetSnapshotsByImageID(ctx context.Context, imageID string) ([]*database.Snapshot, error) {
+	var out []*database.Snapshot
+	for _, snap := range s.snapshots {
+		if snap.ImageID == imageID {
+			out = append(out, snap)
+		}
+	}
+	return out, nil
+}
+
+func (s *fakeSnapshotStore) DeactivateSnapshot(ctx context.Context, snapshotID string) error {
+	snap, ok := s.snapshots[snapshotID]
+	if !ok {
+		return errors.New("snapshot not found: " + snapshotID)
+	}
+	now := time.Now()
+	snap.Active = false
+	snap.DeactivatedAt = &now
+	return nil
+}
+
+// fakeSnapshotDeactivator records the devices it was asked to remove.
+type fakeSnapshotDeactivator struct {
+	removed []string
+	err     error
+}
+
+func (f *fakeSnapshotDeactivator) DeactivateDevice(ctx context.Context, deviceName string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.removed = append(f.removed, deviceName)
+	return nil
+}
+
+func quietLogger() logrus.FieldLogger {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return l
+}
+
+func TestDeactivateSnapshots_BySnapshotID(t *testing.T) {
+	store := newFakeSnapshotStore(
+		&database.Snapshot{SnapshotID: "snap-1", SnapshotName: "snap-img1", ImageID: "img1", Active: true},
+		&database.Snapshot{SnapshotID: "snap-2", SnapshotName: "snap-img2", ImageID: "img2", Active: true},
+	)
+	dm := &fakeSnapshotDeactivator{}
+
+	done, err := deactivateSnapshots(context.Background(), quietLogger(), store, dm, "snap-1", "", false)
+	if err != nil {
+		t.Fatalf("deactivateSnapshots() error = %v", err)
+	}
+	if len(done) != 1 || done[0].SnapshotID != "snap-1" {
+		t.Fatalf("deactivated = %v, want [snap-1]", done)
+	}
+	if len(dm.removed) != 1 || dm.removed[0] != "snap-img1" {
+		t.Errorf("removed devices = %v, want [snap-img1]", dm.removed)
+	}
+
+	snap := store.snapshots["snap-1"]
+	if snap.Active || snap.DeactivatedAt == nil {
+		t.Errorf("snap-1 active=%v deactivated_at=%v, want inactive with timestamp", snap.Active, snap.DeactivatedAt)
+	}
+	if !store.snapshots["snap-2"].Active {
+		t.Error("snap-2 should be untouched")
+	}
+}
+
+func TestDeactivateSnapshots_ByImageID(t *testing.T) {
+	store := newFakeSnapshotStore(
+		&database.Snapshot{SnapshotID: "snap-a", SnapshotName: "snap-a", ImageID: "img1", Active: true},
+		&database.Snapshot{SnapshotID: "snap-b", SnapshotName: "snap-b", ImageID: "img1", Active: true},
+		&database.Snapshot{SnapshotID: "snap-old", SnapshotName: "snap-old", ImageID: "img1", Active: false},
+	)
+	dm := &fakeSnapshotDeactivator{}
+
+	done, err := deactivateSnapshots(context.Background(), quietLogger(), store, dm, "", "img1", false)
+	if err != nil {
+		t.Fatalf("deactivateSnapshots() error = %v", err)
+	}
+	if len(done) != 2 {
+		t.Errorf("deactivated %d snapshots, want 2", len(done))
+	}
+	for _, id := range []string{"snap-a", "snap-b"} {
+		if store.snapshots[id].Active {
+			t.Errorf("%s still active", id)
+		}
+	}
+	for _, name := range dm.removed {
+		if name == "snap-old" {
+			t.Error("inactive snapshot's device should not be removed")
+		}
+	}
+}
+
+func TestDeactivateSnapshots_DryRun(t *testing.T) {
+	store := newFakeSnapshotStore(
+		&database.Snapshot{SnapshotID: "snap-1", SnapshotName: "snap-img1", ImageID: "img1", Active: true},
+	)
+	dm := &fakeSnapshotDeactivator{}
+
+	done, err := deactivateSnapshots(context.Background(), quietLogger(), store, dm, "snap-1", "", true)
+	if err != nil {
+		t.Fatalf("deactivateSnapshots() error = %v", err)
+	}
+	if len(done) != 1 {
+		t.Errorf("dry run reported %d snapshots, want 1", len(done))
+	}
+	if len(dm.removed) != 0 {
+		t.Errorf("dry run removed devices %v", dm.removed)
+	}
+	if !store.snapshots["snap-1"].Active {
+		t.Error("dry run must not change database state")
+	}
+}
+
+func TestDeactivateSnapshots_DeviceFailureKeepsRowActive(t *testing.T) {
+	store := newFakeSnapshotStore(
+		&database.Snapshot{SnapshotID: "snap-1", SnapshotName: "snap-img1", ImageID: "img1", Active: true},
+	)
+	dm := &fakeSnapshotDeactivator{err: errors.New("device busy")}
+
+	if _, err := deactivateSnapshots(context.Background(), quietLogger(), store, dm, "snap-1", "", false); err == nil {
+		t.Fatal("expected error when device removal fails")
+	}
+	if !store.snapshots["snap-1"].Active {
+		t.Error("snapshot must stay active in the database if its device was not removed")
+	}
+}
+
+func TestDeactivateSnapshots_NotFoundOrInactive(t *testing.T) {
+	store := newFakeSnapshotStore(
+		&database.Snapshot{SnapshotID: "snap-old", SnapshotName: "snap-old", ImageID: "img1", Active: false},
+	)
+	dm := &fakeSnapshotDeactivator{}
+
+	tests := []struct {
+		name       string
+		snapshotID string
+		imageID    string
+	}{
+		{name: "unknown snapshot", snapshotID: "missing"},
+		{name: "already inactive", snapshotID: "snap-old"},
+		{name: "image without active snapshots", imageID: "img1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := deactivateSnapshots(context.Background(), quietLogger(), store, dm, tt.snapshotID, tt.imageID, false); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+	if len(dm.removed) != 0 {
+		t.Errorf("no devices should be removed, got %v", dm.removed)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// deviceRefStore is the subset of *database.DB used by delete-device to find
+// records that still reference a device.
+type deviceRefStore interface {
+	ListUnpackedImages(ctx context.Context) ([]*database.UnpackedImage, error)
+	ListActiveSnapshots(ctx context.Context) ([]*database.Snapshot, error)
+	ReleaseDeviceID(ctx context.Context, deviceID string) error
+}
+
+// deviceDeleter is the subset of *devicemapper.Client used by delete-device.
+type deviceDeleter interface {
+	ThinDeviceID(ctx context.Context, deviceName string) (string, error)
+	SafeDeleteDevice(ctx context.Context, poolName, deviceName, deviceID string) error
+}
+
+// runDeleteDevice removes a single thin device from the pool.
+func runDeleteDevice(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	logger := log.WithField("command", "delete-device")
+
+	if cfg.DryRun {
+		logger.Info("Running in DRY RUN mode - no changes will be made")
+	}
+
+	return withDMCommand(ctx, cfg, "delete-device:"+cfg.DeviceName, cfg.DryRun, func() error {
+		db, err := database.New(database.Config{Path: cfg.DBPath})
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+		dmClient.SetOperationRecorder(dmRecorder{db})
+
+		deviceID, err := deleteDevice(ctx, logger, db, dmClient, cfg.PoolName, cfg.DeviceName, cfg.DeviceID, cfg.DryRun)
+		if err != nil {
+			return err
+		}
+		if cfg.DryRun {
+			fmt.Printf("Would delete device %s (id %s)\n", cfg.DeviceName, deviceID)
+		} else {
+			fmt.Printf("Deleted device %s (id %s)\n", cfg.DeviceName, deviceID)
+		}
+		return nil
+	})
+}
+
+// deleteDevice removes deviceName from the pool with SafeDeleteDevice and
+// returns the pool device ID it deleted.
+//
+// When deviceID is empty it is read from the active device's table. Devices
+// still recorded as an unpacked image or an active snapshot are refused: those
+// go through remove-image and deactivate-snapshot, which keep the database in
+// step with the pool.
+func deleteDevice(ctx context.Context, logger logrus.FieldLogger, store deviceRefStore, dm deviceDeleter, poolName, deviceName, deviceID string, dryRun bool) (string, error) {
+	if deviceID == "" {
+		id, err := dm.ThinDeviceID(ctx, deviceName)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve device ID for %s (pass --device-id if the device is not active): %w", deviceName, err)
+		}
+		deviceID = id
+	}
+
+	if err := checkDeviceUnreferenced(ctx, store, deviceName, deviceID); err != nil {
+		return "", err
+	}
+
+	devLogger := logger.WithFields(logrus.Fields{
+		"device_name": deviceName,
+		"device_id":   deviceID,
+	})
+
+	if dryRun {
+		devLogger.Info("would delete device")
+		return deviceID, nil
+	}
+
+	devLogger.Info("deleting device")
+	if err := dm.SafeDeleteDevice(ctx, poolName, deviceName, deviceID); err != nil {
+		return "", fmt.Errorf("failed to delete device %s: %w", deviceName, err)
+	}
+	if err := store.ReleaseDeviceID(ctx, deviceID); err != nil {
+		return "", fmt.Errorf("device %s deleted but releasing its ID failed: %w", deviceName, err)
+	}
+	devLogger.Info("device deleted")
+	return deviceID, nil
+}
+
+// checkDeviceUnreferenced returns an error naming the record that still uses
+// the device, if any.
+func checkDeviceUnreferenced(ctx context.Context, store deviceRefStore, deviceName, deviceID string) error {
+	unpacked, err := store.ListUnpackedImages(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list unpacked images: %w", err)
+	}
+	for _, img := range unpacked {
+		if img.DeviceID == deviceID || img.DeviceName == deviceName {
+			return fmt.Errorf("device %s belongs to image %s; use remove-image instead", deviceName, img.ImageID)
+		}
+	}
+
+	snaps, err := store.ListActiveSnapshots(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list active snapshots: %w", err)
+	}
+	for _, snap := range snaps {
+		if snap.SnapshotName == deviceName {
+			return fmt.Errorf("device %s is active snapshot %s; use deactivate-snapshot instead", deviceName, snap.SnapshotID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// fakeDeviceRefStore serves fixed unpacked images and active snapshots, and
+// records released device IDs.
+type fakeDeviceRefStore struct {
+	unpacked  []*database.UnpackedImage
+	snapshots []*database.Snapshot
+	released  []string
+}
+
+func (s *fakeDeviceRefStore) ListUnpackedImages(ctx context.Context) ([]*database.UnpackedImage, error) {
+	return s.unpacked, nil
+}
+
+func (s *fakeDeviceRefStore) ListActiveSnapshots(ctx context.Context) ([]*database.Snapshot, error) {
+	return s.snapshots, nil
+}
+
+func (s *fakeDeviceRefStore) ReleaseDeviceID(ctx context.Context, deviceID string) error {
+	s.released = append(s.released, deviceID)
+	return nil
+}
+
+// fakeDeviceDeleter maps active device names to IDs and records deletions.
+type fakeDeviceDeleter struct {
+	ids     map[string]string
+	deleted []string // "<deviceName>/<deviceID>"
+	err     error
+}
+
+func (f *fakeDeviceDeleter) ThinDeviceID(ctx context.Context, deviceName string) (string, error) {
+	id, ok := f.ids[deviceName]
+	if !ok {
+		return "", errors.New("no such device")
+	}
+	return id, nil
+}
+
+func (f *fakeDeviceDeleter) SafeDeleteDevice(ctx context.Context, poolName, deviceName, deviceID string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.deleted = append(f.deleted, deviceName+"/"+deviceID)
+	return nil
+}
+
+func TestDeleteDevice_ResolvesID(t *testing.T) {
+	dm := &fakeDeviceDeleter{ids: map[string]string{"thin-42": "42"}}
+	store := &fakeDeviceRefStore{}
+
+	id, err := deleteDevice(context.Background(), quietLogger(), store, dm, "pool", "thin-42", "", false)
+	if err != nil {
+		t.Fatalf("deleteDevice() error = %v", err)
+	}
+	if id != "42" || len(dm.deleted) != 1 || dm.deleted[0] != "thin-42/42" {
+		t.Errorf("deleteDevice() = %q, deleted %v; want thin-42/42", id, dm.deleted)
+	}
+	if len(store.released) != 1 || store.released[0] != "42" {
+		t.Errorf("released device IDs = %v, want [42]", store.released)
+	}
+
+	// An inactive device has no table to read the ID from.
+	if _, err := deleteDevice(context.Background(), quietLogger(), &fakeDeviceRefStore{}, dm, "pool", "thin-7", "", false); err == nil {
+		t.Error("deleteDevice() of an inactive device without --device-id succeeded")
+	}
+}
+
+func TestDeleteDevice_RefusesReferenced(t *testing.T) {
+	tests := []struct {
+		name  string
+		store *fakeDeviceRefStore
+		want  string
+	}{
+		{
+			name:  "unpacked image",
+			store: &fakeDeviceRefStore{unpacked: []*database.UnpackedImage{{ImageID: "img1", DeviceID: "42", DeviceName: "thin-img1"}}},
+			want:  "remove-image",
+		},
+		{
+			name:  "active snapshot",
+			store: &fakeDeviceRefStore{snapshots: []*database.Snapshot{{SnapshotID: "snap-1", SnapshotName: "thin-42", Active: true}}},
+			want:  "deactivate-snapshot",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm := &fakeDeviceDeleter{}
+			_, err := deleteDevice(context.Background(), quietLogger(), tt.store, dm, "pool", "thin-42", "42", false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("deleteDevice() error = %v, want it to point at %s", err, tt.want)
+			}
+			if len(dm.deleted) != 0 {
+				t.Errorf("referenced device deleted: %v", dm.deleted)
+			}
+		})
+	}
+}
+
+func TestDeleteDevice_DryRun(t *testing.T) {
+	dm := &fakeDeviceDeleter{}
+
+	id, err := deleteDevice(context.Background(), quietLogger(), &fakeDeviceRefStore{}, dm, "pool", "thin-42", "42", true)
+	if err != nil || id != "42" {
+		t.Fatalf("deleteDevice() = %q, %v", id, err)
+	}
+	if len(dm.deleted) != 0 {
+		t.Errorf("dry run deleted %v", dm.deleted)
+	}
+}
+
+func TestDeleteDevice_Mounted(t *testing.T) {
+	dm := &fakeDeviceDeleter{err: &devicemapper.DeviceMountedError{DeviceName: "thin-42", MountPoint: "/mnt/x"}}
+
+	_, err := deleteDevice(context.Background(), quietLogger(), &fakeDeviceRefStore{}, dm, "pool", "thin-42", "42", false)
+	var mounted *devicemapper.DeviceMountedError
+	if !errors.As(err, &mounted) {
+		t.Errorf("deleteDevice() error = %v, want a DeviceMountedError", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/humanize"
+)
+
+// dmOperationStore is the subset of *database.DB that dmRecorder writes to.
+type dmOperationStore interface {
+	StartDMOperation(ctx context.Context, op database.DMOperation) (int64, error)
+	FinishDMOperation(ctx context.Context, id int64, duration time.Duration, errMsg string) error
+	RecordDMOperation(ctx context.Context, op database.DMOperation) error
+}
+
+// dmRecorder records every devicemapper operation in the dm_operations table,
+// so a durable trail survives a kernel panic that loses the logs. The row is
+// written before the operation runs and completed when it returns.
+type dmRecorder struct {
+	store dmOperationStore
+}
+
+// StartOperation implements devicemapper.OperationRecorder.
+func (r dmRecorder) StartOperation(ctx context.Context, op devicemapper.Operation) (int64, error) {
+	return r.store.StartDMOperation(ctx, dmOperationRow(op))
+}
+
+// FinishOperation implements devicemapper.OperationRecorder. If the start
+// was not recorded, the whole operation is recorded now instead.
+func (r dmRecorder) FinishOperation(ctx context.Context, id int64, op devicemapper.Operation) error {
+	rec := dmOperationRow(op)
+	if id == 0 {
+		rec.Finished = true
+		return r.store.RecordDMOperation(ctx, rec)
+	}
+	return r.store.FinishDMOperation(ctx, id, rec.Duration, rec.Error)
+}
+
+func dmOperationRow(op devicemapper.Operation) database.DMOperation {
+	rec := database.DMOperation{
+		Operation:  op.Op,
+		Pool:       op.Pool,
+		DeviceName: op.DeviceName,
+		DeviceID:   op.DeviceID,
+		OriginID:   op.OriginID,
+		OldSectors: op.OldSectors,
+		NewSectors: op.NewSectors,
+		StartedAt:  op.StartedAt,
+		Duration:   op.Duration,
+	}
+	if op.Err != nil {
+		rec.Error = op.Err.Error()
+	}
+	return rec
+}
+
+// runDMHistory prints the most recent devicemapper operations.
+func runDMHistory(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	db, err := database.New(database.Config{Path: cfg.DBPath})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	ops, err := db.ListDMOperations(ctx, cfg.Limit)
+	if err != nil {
+		return err
+	}
+
+	printDMHistory(os.Stdout, ops)
+	return nil
+}
+
+// printDMHistory writes the dm-history report, oldest operation first.
+func printDMHistory(w io.Writer, ops []database.DMOperation) {
+	if len(ops) == 0 {
+		fmt.Fprintln(w, "No devicemapper operations recorded")
+		return
+	}
+
+	fmt.Fprintf(w, "%-25s %-11s %-10s %-20s %-9s %-9s %-9s %s\n", "STARTED", "OPERATION", "POOL", "DEVICE", "ID", "ORIGIN", "DURATION", "RESULT")
+	for _, op := range ops {
+		result := "ok"
+		switch {
+		case !op.Finished:
+			result = "started, never returned"
+		case op.Error != "":
+			result = "error: " + op.Error
+		}
+		if op.NewSectors > 0 {
+			result = fmt.Sprintf("%s (%d -> %d sectors)", result, op.OldSectors, op.NewSectors)
+		}
+		fmt.Fprintf(w, "%-25s %-11s %-10s %-20s %-9s %-9s %-9s %s\n",
+			op.StartedAt.Format(time.RFC3339), op.Operation, dash(op.Pool), dash(op.DeviceName),
+			dash(op.DeviceID), dash(op.OriginID), opDuration(op), result)
+	}
+}
+
+// opDuration is op's duration, unknown for an operation that never returned.
+func opDuration(op database.DMOperation) string {
+	if !op.Finished {
+		return "-"
+	}
+	return humanize.Duration(op.Duration)
+}
+
+// dash stands in for an empty column.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// fakeDMStore keeps the rows dmRecorder writes, with row i having ID i+1.
+type fakeDMStore struct {
+	rows     []database.DMOperation
+	startErr error
+}
+
+func (f *fakeDMStore) StartDMOperation(ctx context.Context, op database.DMOperation) (int64, error) {
+	if f.startErr != nil {
+		return 0, f.startErr
+	}
+	f.rows = append(f.rows, op)
+	return int64(len(f.rows)), nil
+}
+
+func (f *fakeDMStore) FinishDMOperation(ctx context.Context, id int64, duration time.Duration, errMsg string) error {
+	row := &f.rows[id-1]
+	row.Duration, row.Error, row.Finished = duration, errMsg, true
+	return nil
+}
+
+func (f *fakeDMStore) RecordDMOperation(ctx context.Context, op database.DMOperation) error {
+	f.rows = append(f.rows, op)
+	return nil
+}
+
+func TestDMRecorder_RecordsOutcome(t *testing.T) {
+	store := &fakeDMStore{}
+	rec := dmRecorder{store}
+	ctx := context.Background()
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	snap := devicemapper.Operation{Op: devicemapper.OpCreateSnap, Pool: "pool", DeviceID: "7", OriginID: "3", StartedAt: start}
+	snapID, err := rec.StartOperation(ctx, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deactivate := devicemapper.Operation{Op: devicemapper.OpDeactivate, DeviceName: "snap-7", StartedAt: start}
+	deactivateID, err := rec.StartOperation(ctx, deactivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Until it returns, the operation is on record as started
+	if len(store.rows) != 2 || store.rows[0].Finished {
+		t.Fatalf("rows after start = %+v, want 2 unfinished", store.rows)
+	}
+
+	snap.Duration = 40 * time.Millisecond
+	deactivate.Err = errors.New("device busy")
+	if err := rec.FinishOperation(ctx, snapID, snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.FinishOperation(ctx, deactivateID, deactivate); err != nil {
+		t.Fatal(err)
+	}
+
+	// A start that failed to record is recorded whole when it finishes
+	store.startErr = errors.New("database is locked")
+	del := devicemapper.Operation{Op: devicemapper.OpDelete, Pool: "pool", DeviceID: "7", StartedAt: start}
+	id, _ := rec.StartOperation(ctx, del)
+	if err := rec.FinishOperation(ctx, id, del); err != nil {
+		t.Fatal(err)
+	}
+	resize := devicemapper.Operation{Op: devicemapper.OpResize, Pool: "pool", DeviceName: "thin-3", DeviceID: "3", OldSectors: 100, NewSectors: 200, StartedAt: start}
+	id, _ = rec.StartOperation(ctx, resize)
+	if err := rec.FinishOperation(ctx, id, resize); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []database.DMOperation{
+		{Operation: "create_snap", Pool: "pool", DeviceID: "7", OriginID: "3", StartedAt: start, Duration: 40 * time.Millisecond, Finished: true},
+		{Operation: "deactivate", DeviceName: "snap-7", StartedAt: start, Error: "device busy", Finished: true},
+		{Operation: "delete", Pool: "pool", DeviceID: "7", StartedAt: start, Finished: true},
+		{Operation: "resize", Pool: "pool", DeviceName: "thin-3", DeviceID: "3", OldSectors: 100, NewSectors: 200, StartedAt: start, Finished: true},
+	}
+	if len(store.rows) != len(want) {
+		t.Fatalf("recorded %d rows, want %d", len(store.rows), len(want))
+	}
+	for i := range want {
+		if store.rows[i] != want[i] {
+			t.Errorf("row %d = %+v, want %+v", i, store.rows[i], want[i])
+		}
+	}
+}
+
+func TestPrintDMHistory(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	printDMHistory(&out, []database.DMOperation{
+		{Operation: "create_thin", Pool: "pool", DeviceName: "thin-42", DeviceID: "42", StartedAt: start, Duration: 1500 * time.Millisecond, Finished: true},
+		{Operation: "delete", Pool: "pool", DeviceID: "42", StartedAt: start.Add(time.Minute), Error: "device busy", Finished: true},
+		{Operation: "deactivate", DeviceName: "snap-7", StartedAt: start.Add(2 * time.Minute)},
+		{Operation: "resize", Pool: "pool", DeviceName: "thin-42", DeviceID: "42", OldSectors: 8388608, NewSectors: 16777216, StartedAt: start.Add(3 * time.Minute), Duration: time.Second, Finished: true},
+	})
+
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want header and 4 rows:\n%s", len(lines), out.String())
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "2026-03-01T12:00:00Z create_thin pool thin-42 42 - 1.5s ok" {
+		t.Errorf("row 1 = %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "error: device busy") || !strings.Contains(lines[2], " - ") {
+		t.Errorf("row 2 = %q", lines[2])
+	}
+	if fields := strings.Fields(lines[3]); strings.Join(fields[len(fields)-4:], " ") != "- started, never returned" {
+		t.Errorf("row 3 = %q, want an unfinished operation", lines[3])
+	}
+	if !strings.HasSuffix(lines[4], "ok (8388608 -> 16777216 sectors)") {
+		t.Errorf("row 4 = %q, want the resize's old and new size", lines[4])
+	}
+
+	out.Reset()
+	printDMHistory(&out, nil)
+	if !strings.Contains(out.String(), "No devicemapper operations recorded") {
+		t.Errorf("empty history = %q", out.String())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultShutdownTimeout bounds how long the daemon drains in-flight work on
+// SIGINT/SIGTERM. It matches the default extraction timeout so an unpack that
+// has just started can still finish.
+const DefaultShutdownTimeout = 5 * time.Minute
+
+// errShuttingDown is returned by pipeline runs that were waiting for the
+// operation guard when the daemon started draining.
+var errShuttingDown = errors.New("daemon is shutting down")
+
+// drainPollInterval is how often drain checks for executing FSM runs.
+var drainPollInterval = 100 * time.Millisecond
+
+// runCounter is the subset of *fsm.Manager used by drain.
+type runCounter interface {
+	Running() int
+}
+
+// drain waits for in-flight work to finish before the daemon cancels its
+// context: pipeline runs started through the API (when api is non-nil), then
+// any FSM run still executing, such as one resumed at startup. Each FSM
+// transition ends at a persisted checkpoint, so a run that finishes here is
+// never interrupted mid-mkfs or mid-snapshot.
+//
+// The caller must stop new work first (apiServer.Drain). drain reports false
+// if timeout elapses first; the remaining runs are then cancelled by the
+// caller and resumed on the next start.
+func drain(api *apiServer, runs runCounter, timeout time.Duration, logger logrus.FieldLogger) bool {
+	deadline := time.After(timeout)
+
+	if api != nil {
+		done := make(chan struct{})
+		go func() {
+			api.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-deadline:
+			logger.WithField("timeout", timeout).Warn("timed out waiting for API pipeline runs to finish")
+			return false
+		}
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		n := runs.Running()
+		if n == 0 {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			logger.WithFields(logrus.Fields{
+				"timeout": timeout,
+				"running": n,
+			}).Warn("timed out waiting for FSM runs to finish")
+			return false
+		}
+	}
+}
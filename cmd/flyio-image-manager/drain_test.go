@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRuns reports a settable number of executing FSM runs.
+type fakeRuns struct{ n atomic.Int32 }
+
+func (f *fakeRuns) Running() int { return int(f.n.Load()) }
+
+func TestDrain_WaitsForInFlightRun(t *testing.T) {
+	p := &fakePipeline{release: make(chan struct{})}
+	api, srv := newTestAPI(t, &fakeAPIStore{}, p, nil)
+
+	resp, err := http.Post(srv.URL+"/images/process", "application/json", strings.NewReader(`{"s3_key":"images/big.tar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+
+	api.Drain()
+	done := make(chan bool, 1)
+	go func() { done <- drain(api, &fakeRuns{}, 5*time.Second, quietLogger()) }()
+
+	select {
+	case <-done:
+		t.Fatal("drain returned while a run was still in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// New work is refused while draining
+	resp, err = http.Post(srv.URL+"/images/process", "application/json", strings.NewReader(`{"s3_key":"images/other.tar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status while draining = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	resp, err = http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("healthz while draining = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	close(p.release)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("drain() = false, want true once the run completed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after the run completed")
+	}
+	if len(p.calls) != 1 {
+		t.Errorf("pipeline calls = %v, want only the run accepted before draining", p.calls)
+	}
+}
+
+func TestDrain_WaitsForRunningFSMs(t *testing.T) {
+	old := drainPollInterval
+	drainPollInterval = 5 * time.Millisecond
+	t.Cleanup(func() { drainPollInterval = old })
+
+	runs := &fakeRuns{}
+	runs.n.Store(1)
+	done := make(chan bool, 1)
+	go func() { done <- drain(nil, runs, 5*time.Second, quietLogger()) }()
+
+	select {
+	case <-done:
+		t.Fatal("drain returned while an FSM run was executing")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	runs.n.Store(0)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("drain() = false, want true once no runs are executing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after the run finished")
+	}
+}
+
+func TestDrain_Timeout(t *testing.T) {
+	runs := &fakeRuns{}
+	runs.n.Store(1)
+
+	start := time.Now()
+	if drain(nil, runs, 50*time.Millisecond, quietLogger()) {
+		t.Error("drain() = true, want false when runs outlast the timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("drain took %v, want it to stop at the timeout", elapsed)
+	}
+}
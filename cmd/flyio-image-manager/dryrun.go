@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/superfly/fsm"
+	"github.com/superfly/fsm/checksum"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/extraction"
+	"github.com/superfly/fsm/humanize"
+	"github.com/superfly/fsm/tui"
+	"github.com/superfly/fsm/unpack"
+)
+
+// dryRunStore is the subset of *database.DB used by process-image --dry-run.
+type dryRunStore interface {
+	GetImageByID(ctx context.Context, imageID string) (*database.Image, error)
+	GetDeviceID(ctx context.Context, owner string) (string, error)
+}
+
+// DryRunReport describes a downloaded and validated image and the thin
+// device unpack would create for it.
+type DryRunReport struct {
+	Bucket    string
+	S3Key     string
+	ImageID   string
+	LocalPath string
+	Checksum  string // "algo:hex"
+	SizeBytes int64
+
+	Entries      int   // Archive entries, each needing an inode
+	ContentBytes int64 // Sum of regular file sizes in the archive
+
+	DeviceID   string
+	DeviceName string
+	DeviceSize int64
+}
+
+// runProcessDryRun runs the download FSM, which verifies the checksum and the
+// tarball's structure and security, and reports the device unpack would
+// create. It registers no unpack or activate FSM and runs no dmsetup
+// commands, but it takes the manager lock since it writes the FSM database.
+func runProcessDryRun(cfg Config) error {
+	ctx := context.Background()
+
+	if err := acquireManagerLock(cfg.FSMDBPath, cfg.LockWait); err != nil {
+		return err
+	}
+	defer releaseManagerLock(cfg.FSMDBPath)
+
+	p, closePipeline, err := startDownloadPipeline(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closePipeline()
+
+	report, err := dryRunProcessImage(ctx, cfg, p, p.deps.DB, tui.NewProgressTracker())
+	if err != nil {
+		return err
+	}
+	printDryRunReport(os.Stdout, report)
+	return nil
+}
+
+// startDownloadPipeline is startPipeline with only the download FSM
+// registered. The returned pipeline cannot install images.
+func startDownloadPipeline(ctx context.Context, cfg Config) (*pipeline, func(), error) {
+	deps, err := initializeDependencies(ctx, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize dependencies: %w", err)
+	}
+
+	manager, err := fsm.New(fsm.Config{
+		Logger: log,
+		DBPath: cfg.FSMDBPath,
+		Queues: map[string]int{"download": cfg.DownloadQueueSize},
+	})
+	if err != nil {
+		deps.Close()
+		return nil, nil, fmt.Errorf("failed to create FSM manager: %w", err)
+	}
+	closePipeline := func() {
+		manager.Shutdown(5 * time.Second)
+		deps.Close()
+	}
+
+	downloadStart, downloadResume, err := registerDownloadFSM(ctx, manager, deps, cfg)
+	if err != nil {
+		closePipeline()
+		return nil, nil, err
+	}
+	if err := downloadResume(ctx); err != nil {
+		log.WithError(err).Warn("failed to resume download FSM runs")
+	}
+
+	return &pipeline{
+		manager:       manager,
+		deps:          deps,
+		downloadStart: downloadStart,
+	}, closePipeline, nil
+}
+
+// dryRunProcessImage runs p's download phase for cfg.S3Key/cfg.ImageID and
+// sizes the device unpack would create from the downloaded tarball. It never
+// starts an unpack or activate run.
+func dryRunProcessImage(ctx context.Context, cfg Config, p *pipeline, store dryRunStore, tracker *tui.ProgressTracker) (*DryRunReport, error) {
+	if err := p.download(ctx, cfg, tracker); err != nil {
+		return nil, err
+	}
+
+	img, err := store.GetImageByID(ctx, cfg.ImageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get downloaded image metadata: %w", err)
+	}
+	if img == nil {
+		return nil, fmt.Errorf("image not found in database after download")
+	}
+
+	stats, err := extraction.ScanArchive(ctx, img.LocalPath, extraction.CompressionAuto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", img.LocalPath, err)
+	}
+
+	// An ID already allocated to the image wins over the derived one.
+	deviceID, err := store.GetDeviceID(ctx, database.ImageDeviceOwner(cfg.ImageID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up device ID: %w", err)
+	}
+	if deviceID == "" {
+		deviceID = unpack.DeviceIDForImage(cfg.ImageID)
+	}
+
+	return &DryRunReport{
+		Bucket:       cfg.S3Bucket,
+		S3Key:        cfg.S3Key,
+		ImageID:      cfg.ImageID,
+		LocalPath:    img.LocalPath,
+		Checksum:     checksum.Checksum{Algo: checksum.Algo(img.ChecksumAlgo), Hex: img.Checksum}.String(),
+		SizeBytes:    img.SizeBytes,
+		Entries:      stats.Entries,
+		ContentBytes: stats.TotalBytes,
+		DeviceID:     deviceID,
+		DeviceName:   unpack.DeviceNameForID(deviceID),
+		DeviceSize:   dryRunDeviceSize(cfg, stats.TotalBytes),
+	}, nil
+}
+
+// dryRunDeviceSize returns the device size unpack would choose for an archive
+// of contentBytes: --device-size, else the --size-overhead estimate capped at
+// --max-device-size, else defaultDeviceSize.
+func dryRunDeviceSize(cfg Config, contentBytes int64) int64 {
+	if cfg.DeviceSize > 0 {
+		return cfg.DeviceSize
+	}
+	if cfg.SizeOverhead > 0 {
+		size := unpack.EstimateDeviceSize(contentBytes, cfg.SizeOverhead)
+		if cfg.MaxDeviceSize > 0 && size > cfg.MaxDeviceSize {
+			size = cfg.MaxDeviceSize
+		}
+		return size
+	}
+	return defaultDeviceSize
+}
+
+// printDryRunReport writes a dry run's findings.
+func printDryRunReport(w io.Writer, r *DryRunReport) {
+	fmt.Fprintf(w, "Dry run for s3://%s/%s\n", r.Bucket, r.S3Key)
+	fmt.Fprintf(w, "  Image ID:    %s\n", r.ImageID)
+	fmt.Fprintf(w, "  Tarball:     %s (%s)\n", r.LocalPath, humanize.Bytes(r.SizeBytes))
+	fmt.Fprintf(w, "  Checksum:    %s\n", r.Checksum)
+	fmt.Fprintf(w, "  Contents:    %d entries, %s\n", r.Entries, humanize.Bytes(r.ContentBytes))
+	fmt.Fprintf(w, "  Device:      %s (ID %s)\n", r.DeviceName, r.DeviceID)
+	fmt.Fprintf(w, "  Device size: %s\n", humanize.Bytes(r.DeviceSize))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Download and validation passed; unpack and activate were skipped.")
+}
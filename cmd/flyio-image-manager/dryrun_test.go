@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+
+	"github.com/superfly/fsm"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/download"
+	"github.com/superfly/fsm/s3"
+	"github.com/superfly/fsm/tui"
+	"github.com/superfly/fsm/unpack"
+)
+
+// fakeObjectStore serves one object from memory and counts downloads.
+type fakeObjectStore struct {
+	data  []byte
+	calls int
+}
+
+func (f *fakeObjectStore) DownloadImage(ctx context.Context, bucket, key, destPath string) (*s3.DownloadResult, error) {
+	f.calls++
+	if err := os.WriteFile(destPath, f.data, 0644); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(f.data)
+	return &s3.DownloadResult{
+		LocalPath:        destPath,
+		Checksum:         hex.EncodeToString(sum[:]),
+		ExpectedChecksum: hex.EncodeToString(sum[:]),
+		SizeBytes:        int64(len(f.data)),
+	}, nil
+}
+
+func (f *fakeObjectStore) GetObjectSize(ctx context.Context, bucket, key string) (int64, error) {
+	return int64(len(f.data)), nil
+}
+
+func (f *fakeObjectStore) SetProgressFunc(fn s3.ProgressFunc) {}
+func (f *fakeObjectStore) SuppressLogs()                      {}
+
+// dryRunTarball returns a small image tarball.
+func dryRunTarball(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, body := range map[string]string{
+		"rootfs/etc/hostname": "alpine\n",
+		"rootfs/bin/app":      "#!/bin/sh\necho hi\n",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDryRunProcessImage_SkipsDeviceWork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	db, err := database.New(database.Config{Path: filepath.Join(dir, "images.db")})
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+	defer db.Close()
+
+	manager, err := fsm.New(fsm.Config{
+		Logger: quietLogger(),
+		DBPath: filepath.Join(dir, "fsm"),
+		Queues: map[string]int{"download": 1},
+	})
+	if err != nil {
+		t.Fatalf("fsm.New() error = %v", err)
+	}
+	defer manager.Shutdown(5 * time.Second)
+
+	store := &fakeObjectStore{data: dryRunTarball(t)}
+	downloadStart, _, err := download.Register(ctx, manager, &download.Dependencies{
+		DB:       db,
+		Store:    store,
+		LocalDir: dir,
+	})
+	if err != nil {
+		t.Fatalf("download.Register() error = %v", err)
+	}
+
+	// Unpack and activate are the only phases that touch devicemapper; the
+	// dry run must never start them.
+	var deviceRuns int
+	p := &pipeline{
+		manager:       manager,
+		downloadStart: downloadStart,
+		unpackStart: func(context.Context, string, *fsm.Request[fsm.ImageUnpackRequest, fsm.ImageUnpackResponse], ...fsm.StartOptionsFn) (ulid.ULID, error) {
+			deviceRuns++
+			return ulid.ULID{}, nil
+		},
+		activateStart: func(context.Context, string, *fsm.Request[fsm.ImageActivateRequest, fsm.ImageActivateResponse], ...fsm.StartOptionsFn) (ulid.ULID, error) {
+			deviceRuns++
+			return ulid.ULID{}, nil
+		},
+	}
+
+	cfg := Config{
+		S3Bucket:      "images",
+		S3Key:         "images/alpine.tar",
+		ImageID:       fsm.DeriveImageIDFromS3Key("images/alpine.tar"),
+		SizeOverhead:  2,
+		MaxDeviceSize: 1 << 40,
+	}
+	report, err := dryRunProcessImage(ctx, cfg, p, db, tui.NewProgressTracker())
+	if err != nil {
+		t.Fatalf("dryRunProcessImage() error = %v", err)
+	}
+
+	if store.calls != 1 {
+		t.Errorf("downloads = %d, want 1", store.calls)
+	}
+	if deviceRuns != 0 {
+		t.Errorf("started %d unpack/activate runs, want 0", deviceRuns)
+	}
+	if _, err := os.Stat(report.LocalPath); err != nil {
+		t.Errorf("downloaded tarball: %v", err)
+	}
+	if report.Entries != 2 {
+		t.Errorf("Entries = %d, want 2", report.Entries)
+	}
+	if want := unpack.DeviceNameForImage(cfg.ImageID); report.DeviceName != want {
+		t.Errorf("DeviceName = %q, want %q", report.DeviceName, want)
+	}
+	if want := unpack.EstimateDeviceSize(report.ContentBytes, 2); report.DeviceSize != want {
+		t.Errorf("DeviceSize = %d, want %d", report.DeviceSize, want)
+	}
+}
+
+func TestDryRunDeviceSize(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want int64
+	}{
+		{"default", Config{}, defaultDeviceSize},
+		{"override", Config{DeviceSize: 1 << 30, SizeOverhead: 2}, 1 << 30},
+		{"estimate", Config{SizeOverhead: 2}, unpack.EstimateDeviceSize(1<<30, 2)},
+		{"capped", Config{SizeOverhead: 2, MaxDeviceSize: 1 << 30}, 1 << 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dryRunDeviceSize(tt.cfg, 1<<30); got != tt.want {
+				t.Errorf("dryRunDeviceSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
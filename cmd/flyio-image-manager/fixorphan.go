@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/unpack"
+)
+
+// orphanStore is the subset of *database.DB used by fix-orphan.
+type orphanStore interface {
+	deviceRefStore
+	GetDeviceIDOwner(ctx context.Context, deviceID string) (string, error)
+	GetImageByID(ctx context.Context, imageID string) (*database.Image, error)
+	ClearImageError(ctx context.Context, imageID string) error
+}
+
+// runFixOrphan removes a device an unpack aborted on with an
+// unpack.OrphanedDeviceError. Without --force it only reports what it would do.
+func runFixOrphan(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+	if cfg.DeviceName == "" {
+		return fmt.Errorf("--device-name is required")
+	}
+
+	ctx := context.Background()
+	logger := log.WithField("command", "fix-orphan")
+
+	if !cfg.Force {
+		logger.Info("Running without --force - no changes will be made")
+	}
+
+	return withDMCommand(ctx, cfg, "fix-orphan:"+cfg.DeviceName, !cfg.Force, func() error {
+		db, err := database.New(database.Config{Path: cfg.DBPath})
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+		dmClient.SetOperationRecorder(dmRecorder{db})
+
+		orphan := &unpack.OrphanedDeviceError{DeviceName: cfg.DeviceName, DeviceID: cfg.DeviceID}
+		img, err := fixOrphan(ctx, logger, db, dmClient, cfg.PoolName, orphan, !cfg.Force)
+		if err != nil {
+			return err
+		}
+
+		if !cfg.Force {
+			fmt.Printf("Would delete orphaned device %s (id %s); re-run with --force to delete it\n", orphan.DeviceName, orphan.DeviceID)
+			return nil
+		}
+		fmt.Printf("Deleted orphaned device %s (id %s)\n", orphan.DeviceName, orphan.DeviceID)
+		if img != nil {
+			fmt.Printf("Image %s can be processed again: flyio-image-manager process-image --s3-key %s\n", img.ImageID, img.S3Key)
+		}
+		return nil
+	})
+}
+
+// fixOrphan deletes the device named by orphan with the safe delete sequence
+// and clears the error its abort left on the image, so the image can be
+// processed again. A missing orphan.DeviceID is read from the active device
+// and filled in. It returns the image the device was allocated to, or nil if
+// the device ID was not allocated to an image.
+//
+// A device still recorded as an unpacked image or an active snapshot is not
+// an orphan and is refused, as by delete-device.
+func fixOrphan(ctx context.Context, logger logrus.FieldLogger, store orphanStore, dm deviceDeleter, poolName string, orphan *unpack.OrphanedDeviceError, dryRun bool) (*database.Image, error) {
+	if orphan.DeviceID == "" {
+		id, err := dm.ThinDeviceID(ctx, orphan.DeviceName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve device ID for %s (pass --device-id if the device is not active): %w", orphan.DeviceName, err)
+		}
+		orphan.DeviceID = id
+	}
+
+	// Look the owner up first: deleting the device releases its ID.
+	owner, err := store.GetDeviceIDOwner(ctx, orphan.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	var img *database.Image
+	if imageID, ok := strings.CutPrefix(owner, "image:"); ok {
+		if img, err = store.GetImageByID(ctx, imageID); err != nil {
+			return nil, fmt.Errorf("failed to look up image %s: %w", imageID, err)
+		}
+	}
+
+	if _, err := deleteDevice(ctx, logger, store, dm, poolName, orphan.DeviceName, orphan.DeviceID, dryRun); err != nil {
+		return nil, err
+	}
+	if dryRun || img == nil {
+		return img, nil
+	}
+
+	if err := store.ClearImageError(ctx, img.ImageID); err != nil {
+		return img, fmt.Errorf("device %s deleted but clearing the error on image %s failed: %w", orphan.DeviceName, img.ImageID, err)
+	}
+	return img, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/unpack"
+)
+
+// fakeOrphanStore adds device ID owners, images and cleared errors to
+// fakeDeviceRefStore.
+type fakeOrphanStore struct {
+	fakeDeviceRefStore
+	owners  map[string]string
+	images  map[string]*database.Image
+	cleared []string
+}
+
+func (s *fakeOrphanStore) GetDeviceIDOwner(ctx context.Context, deviceID string) (string, error) {
+	return s.owners[deviceID], nil
+}
+
+func (s *fakeOrphanStore) GetImageByID(ctx context.Context, imageID string) (*database.Image, error) {
+	return s.images[imageID], nil
+}
+
+func (s *fakeOrphanStore) ClearImageError(ctx context.Context, imageID string) error {
+	s.cleared = append(s.cleared, imageID)
+	return nil
+}
+
+func TestFixOrphan_ConsumesUnpackError(t *testing.T) {
+	// The error an unpack aborted with, as it reaches the caller.
+	err := fmt.Errorf("unpack failed: %w", &unpack.OrphanedDeviceError{DeviceName: "thin-42", DeviceID: "42"})
+	var orphan *unpack.OrphanedDeviceError
+	if !errors.As(err, &orphan) {
+		t.Fatalf("errors.As(%v) failed", err)
+	}
+
+	store := &fakeOrphanStore{
+		owners: map[string]string{"42": "image:img1"},
+		images: map[string]*database.Image{"img1": {ImageID: "img1", S3Key: "images/img1.tar"}},
+	}
+	dm := &fakeDeviceDeleter{}
+
+	img, err := fixOrphan(context.Background(), quietLogger(), store, dm, "pool", orphan, false)
+	if err != nil {
+		t.Fatalf("fixOrphan() error = %v", err)
+	}
+	if img == nil || img.ImageID != "img1" {
+		t.Errorf("fixOrphan() image = %+v, want img1", img)
+	}
+	if len(dm.deleted) != 1 || dm.deleted[0] != "thin-42/42" {
+		t.Errorf("deleted = %v, want [thin-42/42]", dm.deleted)
+	}
+	if len(store.released) != 1 || store.released[0] != "42" {
+		t.Errorf("released device IDs = %v, want [42]", store.released)
+	}
+	if len(store.cleared) != 1 || store.cleared[0] != "img1" {
+		t.Errorf("cleared image errors = %v, want [img1]", store.cleared)
+	}
+}
+
+func TestFixOrphan_ResolvesID(t *testing.T) {
+	store := &fakeOrphanStore{}
+	dm := &fakeDeviceDeleter{ids: map[string]string{"thin-42": "42"}}
+	orphan := &unpack.OrphanedDeviceError{DeviceName: "thin-42"}
+
+	img, err := fixOrphan(context.Background(), quietLogger(), store, dm, "pool", orphan, false)
+	if err != nil {
+		t.Fatalf("fixOrphan() error = %v", err)
+	}
+	if orphan.DeviceID != "42" {
+		t.Errorf("orphan.DeviceID = %q, want 42", orphan.DeviceID)
+	}
+	if img != nil || len(store.cleared) != 0 {
+		t.Errorf("unowned device returned image %+v, cleared %v", img, store.cleared)
+	}
+}
+
+func TestFixOrphan_DryRun(t *testing.T) {
+	store := &fakeOrphanStore{
+		owners: map[string]string{"42": "image:img1"},
+		images: map[string]*database.Image{"img1": {ImageID: "img1"}},
+	}
+	dm := &fakeDeviceDeleter{}
+	orphan := &unpack.OrphanedDeviceError{DeviceName: "thin-42", DeviceID: "42"}
+
+	if _, err := fixOrphan(context.Background(), quietLogger(), store, dm, "pool", orphan, true); err != nil {
+		t.Fatalf("fixOrphan() error = %v", err)
+	}
+	if len(dm.deleted) != 0 || len(store.released) != 0 || len(store.cleared) != 0 {
+		t.Errorf("dry run deleted %v, released %v, cleared %v", dm.deleted, store.released, store.cleared)
+	}
+}
+
+func TestFixOrphan_RefusesRecordedDevice(t *testing.T) {
+	store := &fakeOrphanStore{
+		fakeDeviceRefStore: fakeDeviceRefStore{
+			unpacked: []*database.UnpackedImage{{ImageID: "img1", DeviceID: "42", DeviceName: "thin-42"}},
+		},
+	}
+	dm := &fakeDeviceDeleter{}
+	orphan := &unpack.OrphanedDeviceError{DeviceName: "thin-42", DeviceID: "42"}
+
+	if _, err := fixOrphan(context.Background(), quietLogger(), store, dm, "pool", orphan, false); err == nil {
+		t.Error("fixOrphan() of a device with an unpacked image record succeeded")
+	}
+	if len(dm.deleted) != 0 {
+		t.Errorf("recorded device deleted: %v", dm.deleted)
+	}
+}
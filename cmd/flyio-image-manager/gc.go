@@ -3,23 +3,30 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/superfly/fsm/database"
 	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/safeguards"
 )
 
 var (
 	// GC command flags (gcCmd is declared in main.go)
-	gcDryRun     *bool
-	gcForce      *bool
-	gcVerbose    *bool
-	gcIgnoreLock *bool
+	gcDryRun             *bool
+	gcForce              *bool
+	gcVerbose            *bool
+	gcIgnoreLock         *bool
+	gcMetadataDev        *string
+	gcDeleteMetadataOnly *bool
+	gcReclaimTars        *bool
+	gcTarMaxAge          *time.Duration
 )
 
 func init() {
@@ -28,6 +35,10 @@ func init() {
 	gcForce = gcCmd.Bool("force", false, "Actually perform cleanup (required for non-dry-run)")
 	gcVerbose = gcCmd.Bool("verbose", false, "Enable verbose logging")
 	gcIgnoreLock = gcCmd.Bool("ignore-lock", false, "Ignore manager lock file (DANGEROUS - may cause kernel panics if FSMs are running)")
+	gcMetadataDev = gcCmd.String("metadata-dev", "", "Pool metadata device scanned with thin_ls (default: /dev/mapper/<pool>_tmeta)")
+	gcDeleteMetadataOnly = gcCmd.Bool("delete-metadata-only", false, "With --force, also delete devices that exist only in pool metadata (not activated)")
+	gcReclaimTars = gcCmd.Bool("reclaim-tars", false, "Also delete downloaded tars in --local-dir for images with an active snapshot")
+	gcTarMaxAge = gcCmd.Duration("tar-max-age", 24*time.Hour, "With --reclaim-tars, only delete tars downloaded longer ago than this")
 }
 
 // runGC implements the garbage collection command for cleaning up orphaned devices.
@@ -93,6 +104,7 @@ func runGC(cfg Config) error {
 	// Initialize devicemapper client
 	dmClient := devicemapper.New()
 	dmClient.SetLogger(logrus.StandardLogger())
+	dmClient.SetOperationRecorder(dmRecorder{db})
 
 	// Pre-flight check: Verify pool is healthy before GC
 	// A corrupted or inaccessible pool can cause kernel panics during GC
@@ -112,19 +124,30 @@ func runGC(cfg Config) error {
 	logger.Warn("IMPORTANT: This command should only be run when the system is idle")
 
 	// Run garbage collection
-	result, err := garbageCollectOrphanedDevices(ctx, db, dmClient, cfg.PoolName, *gcDryRun)
+	result, err := garbageCollectOrphanedDevices(ctx, db, dmClient, cfg.PoolName, *gcMetadataDev, *gcDryRun, *gcDeleteMetadataOnly)
 	if err != nil {
 		return fmt.Errorf("garbage collection failed: %w", err)
 	}
 
+	if *gcReclaimTars {
+		if err := reclaimStaleTars(ctx, db, cfg.LocalDir, *gcTarMaxAge, *gcDryRun, result); err != nil {
+			return fmt.Errorf("tar reclamation failed: %w", err)
+		}
+	}
+
 	// Print summary
 	logger.Info("=== Garbage Collection Summary ===")
 	logger.WithFields(logrus.Fields{
-		"total_devices": result.TotalDevices,
-		"orphaned":      result.OrphanedCount,
-		"cleaned":       result.CleanedCount,
-		"failed":        result.FailedCount,
-		"skipped":       result.SkippedCount,
+		"total_devices":      result.TotalDevices,
+		"orphaned":           result.OrphanedCount,
+		"metadata_only":      result.MetadataOnlyCount,
+		"snapshots":          result.TotalSnapshots,
+		"orphaned_snapshots": result.OrphanedSnapshotCount,
+		"cleaned":            result.CleanedCount,
+		"failed":             result.FailedCount,
+		"skipped":            result.SkippedCount,
+		"reclaimed_tars":     result.ReclaimedTarCount,
+		"reclaimed_bytes":    result.ReclaimedBytes,
 	}).Info("Summary")
 
 	if *gcDryRun {
@@ -143,13 +166,35 @@ func runGC(cfg Config) error {
 }
 
 // GCResult contains the results of a garbage collection run.
+//
+// Unpack devices (thin-*) and activated snapshots (snap-*) are reported
+// separately; CleanedCount, FailedCount and SkippedCount cover both.
 type GCResult struct {
-	TotalDevices  int
-	OrphanedCount int
-	CleanedCount  int
-	FailedCount   int
-	SkippedCount  int
-	Orphans       []OrphanedDevice
+	TotalDevices      int
+	OrphanedCount     int
+	MetadataOnlyCount int // Subset of OrphanedCount that exists only in pool metadata
+	CleanedCount      int
+	FailedCount       int
+	SkippedCount      int
+	Orphans           []OrphanedDevice
+
+	TotalSnapshots        int
+	OrphanedSnapshotCount int
+	SnapshotOrphans       []OrphanedDevice
+
+	// Downloaded tars removed by --reclaim-tars (selected, in dry-run mode)
+	ReclaimedTarCount int
+	ReclaimedBytes    int64
+	ReclaimedTars     []ReclaimedTar
+}
+
+// ReclaimedTar is a downloaded image tar selected for deletion by reclaimStaleTars.
+type ReclaimedTar struct {
+	ImageID   string
+	Path      string
+	SizeBytes int64
+	Deleted   bool
+	Error     string
 }
 
 // OrphanedDevice represents a device that exists in devicemapper but not in the database.
@@ -157,18 +202,27 @@ type OrphanedDevice struct {
 	DeviceName string
 	DeviceID   string
 	Mounted    bool
-	Cleaned    bool
-	Failed     bool
-	Skipped    bool
-	Error      string
+	// MetadataOnly is true when the device exists in pool metadata but is not
+	// activated in /dev/mapper (e.g. after a crash between create and updateDB).
+	// Such devices have no DeviceName and can only be deleted from the pool.
+	MetadataOnly bool
+	// Reason explains why a snapshot device is orphaned (no row, or row inactive).
+	Reason  string
+	Cleaned bool
+	Failed  bool
+	Skipped bool
+	Error   string
 }
 
 // garbageCollectOrphanedDevices identifies and cleans up orphaned devices.
-func garbageCollectOrphanedDevices(ctx context.Context, db *database.DB, dmClient *devicemapper.Client, poolName string, dryRun bool) (*GCResult, error) {
+// metaDev is the pool metadata device scanned for non-activated devices; metadata-only
+// orphans are only deleted when deleteMetadataOnly is set.
+func garbageCollectOrphanedDevices(ctx context.Context, db *database.DB, dmClient *devicemapper.Client, poolName, metaDev string, dryRun, deleteMetadataOnly bool) (*GCResult, error) {
 	logger := logrus.WithField("function", "garbageCollectOrphanedDevices")
 
 	result := &GCResult{
-		Orphans: []OrphanedDevice{},
+		Orphans:         []OrphanedDevice{},
+		SnapshotOrphans: []OrphanedDevice{},
 	}
 
 	// Step 1: Get all thin devices from devicemapper
@@ -224,12 +278,61 @@ func garbageCollectOrphanedDevices(ctx context.Context, db *database.DB, dmClien
 		}
 	}
 
-	if result.OrphanedCount == 0 {
+	// Step 4b: Identify devices that exist only in pool metadata (not activated).
+	// These are invisible to dmsetup ls but still hold pool space.
+	logger.Info("Step 3b: Scanning pool metadata for non-activated devices")
+	metaOrphans, err := findMetadataOnlyOrphans(ctx, db, dbDevices, poolName, metaDev)
+	if err != nil {
+		logger.WithError(err).Warn("Pool metadata scan failed - metadata-only orphans will not be reported")
+	}
+	for _, orphan := range metaOrphans {
+		result.Orphans = append(result.Orphans, orphan)
+		result.OrphanedCount++
+		result.MetadataOnlyCount++
+
+		logger.WithField("device_id", orphan.DeviceID).Warn("Found metadata-only orphaned device")
+	}
+
+	// Step 4c: Identify snapshot devices (snap-*) without an active snapshots row,
+	// e.g. left behind when activate crashed before recording the snapshot.
+	logger.Info("Step 3c: Identifying orphaned snapshot devices")
+	snapDevices, err := listSnapshotDevices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshot devices: %w", err)
+	}
+	dbSnapshots, err := db.ListSnapshots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	result.TotalSnapshots = len(snapDevices)
+
+	for _, orphan := range findOrphanedSnapshots(snapDevices, dbSnapshots) {
+		mounted, err := isDeviceMounted(orphan.DeviceName)
+		if err != nil {
+			logger.WithError(err).WithField("device", orphan.DeviceName).Warn("Failed to check mount status")
+		}
+		orphan.Mounted = mounted
+
+		result.SnapshotOrphans = append(result.SnapshotOrphans, orphan)
+		result.OrphanedSnapshotCount++
+
+		logger.WithFields(logrus.Fields{
+			"device_name": orphan.DeviceName,
+			"device_id":   orphan.DeviceID,
+			"reason":      orphan.Reason,
+			"mounted":     mounted,
+		}).Warn("Found orphaned snapshot device")
+	}
+
+	if result.OrphanedCount == 0 && result.OrphanedSnapshotCount == 0 {
 		logger.Info("No orphaned devices found")
 		return result, nil
 	}
 
-	logger.WithField("count", result.OrphanedCount).Warn("Found orphaned devices")
+	logger.WithFields(logrus.Fields{
+		"devices":   result.OrphanedCount,
+		"snapshots": result.OrphanedSnapshotCount,
+	}).Warn("Found orphaned devices")
 
 	// Step 5: Clean up orphaned devices (if not dry run)
 	if !dryRun {
@@ -244,17 +347,25 @@ func garbageCollectOrphanedDevices(ctx context.Context, db *database.DB, dmClien
 		logger.Info("Step 4b: Cleaning up orphaned devices (one at a time with delays)")
 		for i := range result.Orphans {
 			orphan := &result.Orphans[i]
-			cleanupOrphanedDevice(ctx, dmClient, poolName, orphan)
-
-			if orphan.Cleaned {
-				result.CleanedCount++
-				// Wait between successful cleanups to let the kernel settle
-				time.Sleep(50 * time.Millisecond)
-			} else if orphan.Failed {
-				result.FailedCount++
-			} else if orphan.Skipped {
+			if orphan.MetadataOnly && !deleteMetadataOnly {
+				logger.WithField("device_id", orphan.DeviceID).Info("Skipping metadata-only orphan (use --delete-metadata-only to delete)")
+				orphan.Skipped = true
+				orphan.Error = "metadata-only orphan (use --delete-metadata-only to delete)"
 				result.SkippedCount++
+				continue
 			}
+			cleanupOrphanedDevice(ctx, dmClient, poolName, orphan)
+			releaseOrphanID(ctx, db, orphan)
+			result.countCleanup(orphan)
+		}
+
+		// Snapshots are removed the same way as unpack devices: unmount,
+		// suspend, remove, then delete the thin device from the pool.
+		for i := range result.SnapshotOrphans {
+			orphan := &result.SnapshotOrphans[i]
+			cleanupOrphanedDevice(ctx, dmClient, poolName, orphan)
+			releaseOrphanID(ctx, db, orphan)
+			result.countCleanup(orphan)
 		}
 
 		// Post-cleanup: Sync pool metadata again
@@ -269,6 +380,30 @@ func garbageCollectOrphanedDevices(ctx context.Context, db *database.DB, dmClien
 	return result, nil
 }
 
+// releaseOrphanID frees the device ID of an orphan that was deleted from the
+// pool. A failure only leaves the ID reserved, so it is logged and ignored.
+func releaseOrphanID(ctx context.Context, db *database.DB, orphan *OrphanedDevice) {
+	if !orphan.Cleaned {
+		return
+	}
+	if err := db.ReleaseDeviceID(ctx, orphan.DeviceID); err != nil {
+		logrus.WithError(err).WithField("device_id", orphan.DeviceID).Warn("failed to release device ID")
+	}
+}
+
+// countCleanup tallies the outcome of cleanupOrphanedDevice for orphan.
+func (r *GCResult) countCleanup(orphan *OrphanedDevice) {
+	if orphan.Cleaned {
+		r.CleanedCount++
+		// Wait between successful cleanups to let the kernel settle
+		time.Sleep(50 * time.Millisecond)
+	} else if orphan.Failed {
+		r.FailedCount++
+	} else if orphan.Skipped {
+		r.SkippedCount++
+	}
+}
+
 // DeviceInfo represents a devicemapper device.
 type DeviceInfo struct {
 	Name string
@@ -311,217 +446,354 @@ func listThinDevices(ctx context.Context) ([]DeviceInfo, error) {
 	return devices, nil
 }
 
-// isDeviceMounted checks if a device is currently mounted.
-func isDeviceMounted(deviceName string) (bool, error) {
-	cmd := exec.Command("grep", "-q", deviceName, "/proc/mounts")
-	err := cmd.Run()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-			return false, nil
-		}
-		return false, err
-	}
-	return true, nil
+// tarStore is the subset of *database.DB used to reclaim downloaded tars.
+type tarStore interface {
+	ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error)
 }
 
-// cleanupOrphanedDevice attempts to safely clean up a single orphaned device.
-// CRITICAL: This function must be extremely careful to avoid kernel panics.
-// We use --verifyudev for udev synchronization and add delays between operations.
-func cleanupOrphanedDevice(ctx context.Context, dmClient *devicemapper.Client, poolName string, orphan *OrphanedDevice) {
+// reclaimStaleTars deletes <imageID>.tar files under localDir, including its
+// --shard-storage subdirectories, once they are no longer needed: the image has
+// an active snapshot and was downloaded more than maxAge ago. Files that don't
+// match a completed download (including .part files of in-progress downloads)
+// are never touched.
+//
+// The images row is left as-is; if the image is processed again the download
+// FSM sees the missing file and re-downloads it.
+func reclaimStaleTars(ctx context.Context, store tarStore, localDir string, maxAge time.Duration, dryRun bool, result *GCResult) error {
 	logger := logrus.WithFields(logrus.Fields{
-		"device_name": orphan.DeviceName,
-		"device_id":   orphan.DeviceID,
+		"function":  "reclaimStaleTars",
+		"local_dir": localDir,
 	})
 
-	logger.Info("Attempting to clean up orphaned device")
+	if _, err := os.Stat(localDir); err != nil {
+		if os.IsNotExist(err) {
+			logger.Info("Local directory does not exist - no tars to reclaim")
+			return nil
+		}
+		return fmt.Errorf("failed to read local directory: %w", err)
+	}
 
-	// Skip if device is mounted
-	if orphan.Mounted {
-		logger.Warn("Device is mounted - skipping cleanup (unmount manually first)")
-		orphan.Skipped = true
-		orphan.Error = "device is mounted"
-		return
+	images, err := store.ListImages(ctx, database.DownloadStatusCompleted)
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+	byID := make(map[string]*database.Image, len(images))
+	for _, img := range images {
+		byID[img.ImageID] = img
 	}
 
-	// Pre-cleanup: Wait for any pending I/O to settle
-	logger.Debug("Waiting for I/O to settle before cleanup...")
-	time.Sleep(500 * time.Millisecond)
+	// Walk the whole tree: with --shard-storage tars live in ab/cd/ subdirectories.
+	cutoff := time.Now().Add(-maxAge)
+	return filepath.WalkDir(localDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == localDir {
+				return fmt.Errorf("failed to read local directory: %w", err)
+			}
+			logger.WithError(err).WithField("path", path).Warn("Failed to read storage directory")
+			return nil
+		}
+		imageID, ok := strings.CutSuffix(entry.Name(), ".tar")
+		if !ok || !entry.Type().IsRegular() {
+			return nil
+		}
+		img := byID[imageID]
+		if img == nil || img.ActivationStatus != database.ActivationStatusActive {
+			return nil
+		}
+		if img.DownloadedAt == nil || img.DownloadedAt.After(cutoff) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			logger.WithError(err).WithField("file", path).Warn("Failed to stat tar")
+			return nil
+		}
 
-	// Step 1: Try to unmount (in case it's mounted but we missed it)
-	logger.Debug("Step 1: Attempting unmount")
-	if err := unmountDeviceWithTimeout(ctx, orphan.DeviceName, 10*time.Second); err != nil {
-		logger.WithError(err).Warn("Unmount failed or timed out (may not have been mounted)")
-		// Continue anyway - device might not have been mounted
-	}
+		tar := ReclaimedTar{
+			ImageID:   imageID,
+			Path:      path,
+			SizeBytes: info.Size(),
+		}
+		tarLogger := logger.WithFields(logrus.Fields{
+			"image_id":      tar.ImageID,
+			"path":          tar.Path,
+			"size_bytes":    tar.SizeBytes,
+			"downloaded_at": img.DownloadedAt,
+		})
 
-	// Wait for udev to process unmount event
-	time.Sleep(500 * time.Millisecond)
+		if dryRun {
+			tarLogger.Info("DRY RUN: Would delete tar")
+		} else {
+			if err := os.Remove(tar.Path); err != nil {
+				tarLogger.WithError(err).Error("Failed to delete tar")
+				tar.Error = err.Error()
+				result.ReclaimedTars = append(result.ReclaimedTars, tar)
+				return nil
+			}
+			tar.Deleted = true
+			tarLogger.Info("Deleted tar")
+		}
 
-	// Step 2: Suspend the device first (safer than direct remove)
-	logger.Debug("Step 2: Suspending device before removal")
-	if err := suspendDeviceWithTimeout(ctx, orphan.DeviceName, 10*time.Second); err != nil {
-		logger.WithError(err).Warn("Suspend failed (continuing with removal)")
-	} else {
-		time.Sleep(300 * time.Millisecond) // Wait for suspend to take effect
-	}
+		result.ReclaimedTars = append(result.ReclaimedTars, tar)
+		result.ReclaimedTarCount++
+		result.ReclaimedBytes += tar.SizeBytes
+		return nil
+	})
+}
 
-	// Step 3: Try to deactivate with --verifyudev
-	logger.Debug("Step 3: Attempting deactivate with udev sync")
-	if err := deactivateDeviceWithTimeout(ctx, dmClient, orphan.DeviceName, 15*time.Second); err != nil {
-		logger.WithError(err).Error("Deactivate failed or timed out")
-		orphan.Failed = true
-		orphan.Error = fmt.Sprintf("deactivate failed: %v", err)
-		return
+// listSnapshotDevices lists all activated snap-* devices with their thin device IDs.
+// Unlike thin-* devices the ID is not part of the name, so it is read from the
+// thin target table.
+func listSnapshotDevices(ctx context.Context) ([]DeviceInfo, error) {
+	cmd := exec.CommandContext(ctx, "dmsetup", "table", "--target", "thin")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("dmsetup table failed: %w (output: %s)", err, string(output))
 	}
+	return parseSnapshotDevices(string(output)), nil
+}
 
-	// Wait for udev to process device removal
-	time.Sleep(500 * time.Millisecond)
-
-	// Step 4: Try to delete from thin pool
-	logger.Debug("Step 4: Attempting delete from thin pool")
-	if err := deleteThinDeviceWithTimeout(ctx, poolName, orphan.DeviceID, 10*time.Second); err != nil {
-		logger.WithError(err).Error("Delete failed or timed out")
-		orphan.Failed = true
-		orphan.Error = fmt.Sprintf("delete failed: %v", err)
-		return
+// parseSnapshotDevices returns the snap-* devices in `dmsetup table --target thin` output.
+// Format: <name>: 0 <sectors> thin <pool_dev> <device_id>
+func parseSnapshotDevices(output string) []DeviceInfo {
+	devices := []DeviceInfo{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[3] != "thin" {
+			continue
+		}
+		name := strings.TrimSuffix(fields[0], ":")
+		if !strings.HasPrefix(name, "snap-") {
+			continue
+		}
+		devices = append(devices, DeviceInfo{Name: name, ID: fields[5]})
 	}
+	return devices
+}
 
-	// Post-cleanup: Wait for pool metadata to settle
-	time.Sleep(300 * time.Millisecond)
+// findOrphanedSnapshots returns the snap-* devices in dmDevices that have no
+// active row in snapshots - either the row is missing or it was marked inactive
+// without the device being removed. Other devices are ignored.
+func findOrphanedSnapshots(dmDevices []DeviceInfo, snapshots []*database.Snapshot) []OrphanedDevice {
+	// A snapshot name can have several rows (re-activation after deactivate);
+	// the device is live if any of them is active.
+	active := make(map[string]bool)
+	for _, snap := range snapshots {
+		active[snap.SnapshotName] = active[snap.SnapshotName] || snap.Active
+	}
 
-	logger.Info("Successfully cleaned up orphaned device")
-	orphan.Cleaned = true
+	orphans := []OrphanedDevice{}
+	for _, dev := range dmDevices {
+		if !strings.HasPrefix(dev.Name, "snap-") {
+			continue
+		}
+		isActive, hasRow := active[dev.Name]
+		if isActive {
+			continue
+		}
+		reason := "no snapshot row in database"
+		if hasRow {
+			reason = "snapshot row is inactive"
+		}
+		orphans = append(orphans, OrphanedDevice{
+			DeviceName: dev.Name,
+			DeviceID:   dev.ID,
+			Reason:     reason,
+		})
+	}
+	return orphans
 }
 
-// unmountDeviceWithTimeout attempts to unmount a device with a timeout.
-func unmountDeviceWithTimeout(ctx context.Context, deviceName string, timeout time.Duration) error {
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	devicePath := "/dev/mapper/" + deviceName
-	cmd := exec.CommandContext(ctxWithTimeout, "umount", devicePath)
-	output, err := cmd.CombinedOutput()
+// findMetadataOnlyOrphans returns devices that exist in pool metadata but are neither
+// activated nor referenced by the database (as an unpacked image or any snapshot).
+//
+// CRITICAL: If the set of known device IDs cannot be fully built, no orphans are
+// returned - reporting a live snapshot as orphaned could lead to it being deleted.
+func findMetadataOnlyOrphans(ctx context.Context, db *database.DB, dbDevices []*database.UnpackedImage, poolName, metaDev string) ([]OrphanedDevice, error) {
+	metaIDs, err := listPoolMetadataDeviceIDs(ctx, poolName, metaDev)
+	if err != nil {
+		return nil, err
+	}
 
-	if ctxWithTimeout.Err() == context.DeadlineExceeded {
-		return fmt.Errorf("unmount timed out after %v", timeout)
+	activeIDs, err := listActiveThinDeviceIDs(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	known := make(map[string]bool)
+	for _, dev := range dbDevices {
+		known[dev.DeviceID] = true
+	}
+	images, err := db.ListImages(ctx, "")
 	if err != nil {
-		// Ignore "not mounted" errors
-		if strings.Contains(string(output), "not mounted") {
-			return nil
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	for _, img := range images {
+		snapshots, err := db.GetSnapshotsByImageID(ctx, img.ImageID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots for image %s: %w", img.ImageID, err)
+		}
+		for _, snap := range snapshots {
+			known[snap.SnapshotID] = true
 		}
-		return fmt.Errorf("unmount failed: %w (output: %s)", err, string(output))
 	}
 
-	return nil
+	orphans := []OrphanedDevice{}
+	for _, id := range metaIDs {
+		if known[id] || activeIDs[id] {
+			continue
+		}
+		orphans = append(orphans, OrphanedDevice{
+			DeviceID:     id,
+			MetadataOnly: true,
+		})
+	}
+	return orphans, nil
 }
 
-// suspendDeviceWithTimeout suspends a device before removal to prevent I/O races.
-// This is safer than directly removing a device that might have pending I/O.
-func suspendDeviceWithTimeout(ctx context.Context, deviceName string, timeout time.Duration) error {
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, timeout)
+// listPoolMetadataDeviceIDs enumerates every thin device ID recorded in the pool metadata,
+// including devices that are not activated. It reserves a metadata snapshot so thin_ls
+// reads a consistent copy without touching the live metadata.
+func listPoolMetadataDeviceIDs(ctx context.Context, poolName, metaDev string) ([]string, error) {
+	if metaDev == "" {
+		metaDev = fmt.Sprintf("/dev/mapper/%s_tmeta", poolName)
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctxWithTimeout, "dmsetup", "suspend", "--nolockfs", deviceName)
-	output, err := cmd.CombinedOutput()
+	cmd := exec.CommandContext(ctxWithTimeout, "dmsetup", "message", poolName, "0", "reserve_metadata_snap")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("reserve_metadata_snap failed: %w (output: %s)", err, string(output))
+	}
+	// Always release - a held metadata snapshot pins metadata blocks
+	defer exec.Command("dmsetup", "message", poolName, "0", "release_metadata_snap").Run()
 
+	cmd = exec.CommandContext(ctxWithTimeout, "thin_ls", "--metadata-snap", "--no-headers", "-o", "DEV", metaDev)
+	output, err := cmd.Output()
 	if ctxWithTimeout.Err() == context.DeadlineExceeded {
-		return fmt.Errorf("suspend timed out after %v", timeout)
+		return nil, fmt.Errorf("thin_ls timed out after 30s")
 	}
-
 	if err != nil {
-		outputStr := string(output)
-		// Ignore "not found" errors
-		if strings.Contains(outputStr, "not found") || strings.Contains(outputStr, "No such") {
-			return nil
-		}
-		return fmt.Errorf("suspend failed: %w (output: %s)", err, outputStr)
+		return nil, fmt.Errorf("thin_ls %s failed: %w", metaDev, err)
 	}
 
-	return nil
+	return parseThinLsOutput(string(output))
 }
 
-// deactivateDeviceWithTimeout attempts to deactivate a device with a timeout.
-// Uses --verifyudev to properly synchronize with udev, preventing race conditions
-// that can lead to kernel panics.
-func deactivateDeviceWithTimeout(ctx context.Context, dmClient *devicemapper.Client, deviceName string, timeout time.Duration) error {
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	// First try with --verifyudev for proper udev synchronization
-	cmd := exec.CommandContext(ctxWithTimeout, "dmsetup", "remove", "--verifyudev", deviceName)
-	output, err := cmd.CombinedOutput()
-
-	if err == nil {
-		return nil
+// parseThinLsOutput parses thin_ls output and returns the device IDs from the DEV column,
+// which must be the first column. A header line, if present, is skipped.
+func parseThinLsOutput(output string) ([]string, error) {
+	ids := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "DEV" {
+			continue
+		}
+		if _, err := strconv.ParseUint(fields[0], 10, 32); err != nil {
+			return nil, fmt.Errorf("unexpected thin_ls line %q", strings.TrimSpace(line))
+		}
+		ids = append(ids, fields[0])
 	}
+	return ids, nil
+}
 
-	outputStr := string(output)
-	// Check for "not found" - device already gone
-	if strings.Contains(outputStr, "not found") || strings.Contains(outputStr, "No such") {
-		return nil
+// listActiveThinDeviceIDs returns the device IDs of all activated thin targets,
+// regardless of device name (snapshots are not named thin-*).
+func listActiveThinDeviceIDs(ctx context.Context) (map[string]bool, error) {
+	cmd := exec.CommandContext(ctx, "dmsetup", "table", "--target", "thin")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("dmsetup table failed: %w (output: %s)", err, string(output))
 	}
+	return parseThinTargetTable(string(output)), nil
+}
 
-	// If --verifyudev fails, try without it as fallback
-	if ctxWithTimeout.Err() == nil {
-		logrus.WithField("device", deviceName).Warn("--verifyudev remove failed, trying standard remove")
-		cmd = exec.CommandContext(ctxWithTimeout, "dmsetup", "remove", deviceName)
-		output, err = cmd.CombinedOutput()
-		if err == nil {
-			return nil
-		}
-		outputStr = string(output)
-		if strings.Contains(outputStr, "not found") || strings.Contains(outputStr, "No such") {
-			return nil
+// parseThinTargetTable parses `dmsetup table --target thin` output.
+// Format: <name>: 0 <sectors> thin <pool_dev> <device_id>
+func parseThinTargetTable(output string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 6 && fields[3] == "thin" {
+			ids[fields[5]] = true
 		}
 	}
+	return ids
+}
 
-	if ctxWithTimeout.Err() == context.DeadlineExceeded {
-		return fmt.Errorf("deactivate timed out after %v", timeout)
+// isDeviceMounted checks if a device is currently mounted.
+func isDeviceMounted(deviceName string) (bool, error) {
+	cmd := exec.Command("grep", "-q", deviceName, "/proc/mounts")
+	err := cmd.Run()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, err
 	}
+	return true, nil
+}
 
-	return fmt.Errorf("deactivate failed: %w (output: %s)", err, outputStr)
+// orphanDeleter is the subset of *devicemapper.Client used to clean up orphans.
+type orphanDeleter interface {
+	SafeDeleteDevice(ctx context.Context, poolName, deviceName, deviceID string) error
 }
 
-// deleteThinDeviceWithTimeout attempts to delete a thin device with a timeout.
-func deleteThinDeviceWithTimeout(ctx context.Context, poolName string, deviceID string, timeout time.Duration) error {
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+// cleanupOrphanedDevice attempts to safely clean up a single orphaned device.
+// CRITICAL: This must be extremely careful to avoid kernel panics, so it uses
+// SafeDeleteDevice: suspend, udev-synced remove and delete, with delays between
+// each step, refusing devices that are mounted.
+func cleanupOrphanedDevice(ctx context.Context, dm orphanDeleter, poolName string, orphan *OrphanedDevice) {
+	logger := logrus.WithFields(logrus.Fields{
+		"device_name": orphan.DeviceName,
+		"device_id":   orphan.DeviceID,
+	})
 
-	cmd := exec.CommandContext(ctxWithTimeout, "dmsetup", "message", poolName, "0", fmt.Sprintf("delete %s", deviceID))
-	output, err := cmd.CombinedOutput()
+	logger.Info("Attempting to clean up orphaned device")
 
-	if ctxWithTimeout.Err() == context.DeadlineExceeded {
-		return fmt.Errorf("delete timed out after %v", timeout)
+	// Skip if device is mounted
+	if orphan.Mounted {
+		logger.Warn("Device is mounted - skipping cleanup (unmount manually first)")
+		orphan.Skipped = true
+		orphan.Error = "device is mounted"
+		return
 	}
 
-	if err != nil {
-		return fmt.Errorf("delete failed: %w (output: %s)", err, string(output))
+	// Metadata-only devices are not activated: nothing to check or deactivate
+	deviceName := orphan.DeviceName
+	if orphan.MetadataOnly {
+		deviceName = ""
 	}
 
-	return nil
+	err := dm.SafeDeleteDevice(ctx, poolName, deviceName, orphan.DeviceID)
+	switch {
+	case devicemapper.IsDeviceMountedError(err):
+		// Mounted since the scan
+		logger.WithError(err).Warn("Device is mounted - skipping cleanup (unmount manually first)")
+		orphan.Skipped = true
+		orphan.Error = "device is mounted"
+	case err != nil:
+		logger.WithError(err).Error("Cleanup failed or timed out")
+		orphan.Failed = true
+		orphan.Error = err.Error()
+	default:
+		logger.Info("Successfully cleaned up orphaned device")
+		orphan.Cleaned = true
+	}
 }
 
 // countDStateProcesses counts the number of processes in D-state (uninterruptible sleep).
 // D-state processes indicate potential kernel deadlock, often caused by stuck I/O operations.
 // Running devicemapper operations when D-state processes exist can trigger kernel panics.
+// Kernel threads are excluded; it reads /proc directly rather than running ps.
 func countDStateProcesses() (int, error) {
-	// Use ps to find D-state processes (state column contains 'D')
-	// Exclude kernel threads (those in brackets like [kworker/...])
-	cmd := exec.Command("sh", "-c", "ps aux | awk '$8 ~ /D/ && $11 !~ /^\\[/ {count++} END {print count+0}'")
-	output, err := cmd.CombinedOutput()
+	count, err := safeguards.CountDState(safeguards.ProcDir, func(p safeguards.ProcState) bool {
+		return !p.KernelThread()
+	})
 	if err != nil {
 		return 0, fmt.Errorf("failed to check D-state processes: %w", err)
 	}
-
-	countStr := strings.TrimSpace(string(output))
-	count := 0
-	if countStr != "" && countStr != "0" {
-		if _, err := fmt.Sscanf(countStr, "%d", &count); err != nil {
-			return 0, fmt.Errorf("failed to parse D-state count: %w", err)
-		}
-	}
-
 	return count, nil
 }
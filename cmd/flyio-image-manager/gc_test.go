@@ -8,9 +8,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/superfly/fsm/database"
 	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/download"
 )
 
 // TestListThinDevices_ParsesOutput tests that listThinDevices correctly parses dmsetup ls output.
@@ -125,36 +132,63 @@ func (f *fakeDeviceMgrForGC) CreateSnapshot(ctx context.Context, pool, originID,
 	panic("CreateSnapshot not implemented in fakeDeviceMgrForGC")
 }
 
+// fakeOrphanDeleter records SafeDeleteDevice calls.
+type fakeOrphanDeleter struct {
+	calls []string // "<deviceName>/<deviceID>"
+	err   error
+}
+
+func (f *fakeOrphanDeleter) SafeDeleteDevice(ctx context.Context, poolName, deviceName, deviceID string) error {
+	f.calls = append(f.calls, deviceName+"/"+deviceID)
+	return f.err
+}
+
 // TestCleanupOrphanedDevice_SkipsMounted tests that cleanup skips mounted devices.
 func TestCleanupOrphanedDevice_SkipsMounted(t *testing.T) {
-	// This test requires refactoring cleanupOrphanedDevice to accept a DeviceManager
-	// interface instead of *devicemapper.Client so we can inject a mock.
-	// For now, we skip and document the expected behavior.
-	t.Skip("Skipping - requires refactoring cleanupOrphanedDevice to accept interface")
+	dm := &fakeOrphanDeleter{}
+	orphan := &OrphanedDevice{DeviceName: "thin-42", DeviceID: "42", Mounted: true}
 
-	// Expected behavior (documented for future implementation):
-	// - When orphan.Mounted == true
-	// - THEN cleanupOrphanedDevice should:
-	//   - Set orphan.Skipped = true
-	//   - Set orphan.Error = "device is mounted"
-	//   - NOT call DeactivateDevice
-	//   - Log a warning message
+	cleanupOrphanedDevice(context.Background(), dm, "pool", orphan)
+
+	if !orphan.Skipped || orphan.Error != "device is mounted" {
+		t.Errorf("orphan = %+v, want skipped as mounted", orphan)
+	}
+	if len(dm.calls) != 0 {
+		t.Errorf("SafeDeleteDevice called for a mounted device: %v", dm.calls)
+	}
+
+	// A device mounted after the scan is refused by SafeDeleteDevice
+	dm.err = &devicemapper.DeviceMountedError{DeviceName: "thin-43", MountPoint: "/mnt/flyio/thin-43"}
+	orphan = &OrphanedDevice{DeviceName: "thin-43", DeviceID: "43"}
+	cleanupOrphanedDevice(context.Background(), dm, "pool", orphan)
+	if !orphan.Skipped || orphan.Failed {
+		t.Errorf("orphan = %+v, want skipped as mounted", orphan)
+	}
 }
 
 // TestCleanupOrphanedDevice_HandlesDeactivateFailure tests error handling.
 func TestCleanupOrphanedDevice_HandlesDeactivateFailure(t *testing.T) {
-	// This test requires refactoring cleanupOrphanedDevice to accept a DeviceManager
-	// interface and mocking exec.Command for unmount/delete operations.
-	// For now, we skip and document the expected behavior.
-	t.Skip("Skipping - requires refactoring and mocking exec.Command")
+	dm := &fakeOrphanDeleter{err: errors.New("deactivate failed: dmsetup remove timed out after 15s")}
+	orphan := &OrphanedDevice{DeviceName: "thin-42", DeviceID: "42"}
 
-	// Expected behavior (documented for future implementation):
-	// - When DeactivateDevice returns an error
-	// - THEN cleanupOrphanedDevice should:
-	//   - Set orphan.Failed = true
-	//   - Set orphan.Error = "deactivate failed: <error>"
-	//   - Log an error message
-	//   - NOT proceed to delete step
+	cleanupOrphanedDevice(context.Background(), dm, "pool", orphan)
+
+	if !orphan.Failed || orphan.Cleaned || !strings.HasPrefix(orphan.Error, "deactivate failed:") {
+		t.Errorf("orphan = %+v, want failed with the deactivate error", orphan)
+	}
+}
+
+// TestCleanupOrphanedDevice_MetadataOnly tests that metadata-only orphans are
+// deleted by ID alone.
+func TestCleanupOrphanedDevice_MetadataOnly(t *testing.T) {
+	dm := &fakeOrphanDeleter{}
+	orphan := &OrphanedDevice{DeviceID: "42", MetadataOnly: true}
+
+	cleanupOrphanedDevice(context.Background(), dm, "pool", orphan)
+
+	if !orphan.Cleaned || len(dm.calls) != 1 || dm.calls[0] != "/42" {
+		t.Errorf("orphan = %+v, calls = %v; want cleaned via SafeDeleteDevice(\"\", 42)", orphan, dm.calls)
+	}
 }
 
 // TestDeviceInfo_Structure tests that DeviceInfo has expected fields.
@@ -234,3 +268,236 @@ func TestGCCommand_Integration(t *testing.T) {
 	// so it should be run in a dedicated test environment.
 	t.Skip("Skipping integration test - requires root and devicemapper setup")
 }
+
+// TestParseThinLsOutput tests parsing of thin_ls DEV column output.
+func TestParseThinLsOutput(t *testing.T) {
+	output := `DEV
+      1
+  42317
+1000000
+`
+	ids, err := parseThinLsOutput(output)
+	if err != nil {
+		t.Fatalf("parseThinLsOutput failed: %v", err)
+	}
+	want := []string{"1", "42317", "1000000"}
+	if len(ids) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, ids)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Errorf("Expected ids[%d]=%s, got %s", i, want[i], ids[i])
+		}
+	}
+
+	// Extra columns (e.g. -o DEV,MAPPED_BYTES) are ignored
+	ids, err = parseThinLsOutput("DEV MAPPED_BYTES\n  7  1073741824\n")
+	if err != nil || len(ids) != 1 || ids[0] != "7" {
+		t.Errorf("Expected [7], got %v (err: %v)", ids, err)
+	}
+
+	if ids, err := parseThinLsOutput(""); err != nil || len(ids) != 0 {
+		t.Errorf("Expected no IDs for empty output, got %v (err: %v)", ids, err)
+	}
+
+	if _, err := parseThinLsOutput("bad metadata block\n"); err == nil {
+		t.Error("Expected error for unparseable thin_ls output")
+	}
+}
+
+// TestParseThinTargetTable tests parsing of dmsetup table --target thin output.
+func TestParseThinTargetTable(t *testing.T) {
+	output := `thin-42317: 0 20971520 thin 253:2 42317
+snap-abc: 0 20971520 thin 253:2 1042317
+`
+	ids := parseThinTargetTable(output)
+	if !ids["42317"] || !ids["1042317"] || len(ids) != 2 {
+		t.Errorf("Expected IDs 42317 and 1042317, got %v", ids)
+	}
+
+	if ids := parseThinTargetTable("No devices found\n"); len(ids) != 0 {
+		t.Errorf("Expected no IDs, got %v", ids)
+	}
+}
+
+// TestParseSnapshotDevices tests that only snap-* devices are taken from the thin target table.
+func TestParseSnapshotDevices(t *testing.T) {
+	output := `thin-42317: 0 20971520 thin 253:2 42317
+snap-abc: 0 20971520 thin 253:2 1042317
+snap-def: 0 20971520 thin 253:2 1042318
+pool: 0 209715200 thin-pool 253:0 253:1 128 32768 1 skip_block_zeroing
+`
+	devices := parseSnapshotDevices(output)
+	want := []DeviceInfo{{Name: "snap-abc", ID: "1042317"}, {Name: "snap-def", ID: "1042318"}}
+	if len(devices) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, devices)
+	}
+	for i := range want {
+		if devices[i] != want[i] {
+			t.Errorf("Expected devices[%d]=%v, got %v", i, want[i], devices[i])
+		}
+	}
+
+	if devices := parseSnapshotDevices("No devices found\n"); len(devices) != 0 {
+		t.Errorf("Expected no devices, got %v", devices)
+	}
+}
+
+// TestFindOrphanedSnapshots tests reconciliation of a mixed device list against the snapshots table.
+func TestFindOrphanedSnapshots(t *testing.T) {
+	dmDevices := []DeviceInfo{
+		{Name: "thin-100", ID: "100"},             // unpack device - handled by the thin-* pass
+		{Name: "snap-live", ID: "1000100"},        // active row
+		{Name: "snap-reactivated", ID: "1000101"}, // inactive and active rows
+		{Name: "snap-deactivated", ID: "1000102"}, // inactive row only
+		{Name: "snap-crashed", ID: "1000103"},     // no row at all
+	}
+	snapshots := []*database.Snapshot{
+		{SnapshotID: "1000100", SnapshotName: "snap-live", Active: true},
+		{SnapshotID: "1000090", SnapshotName: "snap-reactivated", Active: false},
+		{SnapshotID: "1000101", SnapshotName: "snap-reactivated", Active: true},
+		{SnapshotID: "1000102", SnapshotName: "snap-deactivated", Active: false},
+		{SnapshotID: "1000050", SnapshotName: "snap-gone", Active: false}, // row without device
+	}
+
+	orphans := findOrphanedSnapshots(dmDevices, snapshots)
+	if len(orphans) != 2 {
+		t.Fatalf("Expected 2 orphaned snapshots, got %+v", orphans)
+	}
+
+	byName := map[string]OrphanedDevice{}
+	for _, o := range orphans {
+		byName[o.DeviceName] = o
+	}
+	if o, ok := byName["snap-deactivated"]; !ok || o.DeviceID != "1000102" || o.Reason != "snapshot row is inactive" {
+		t.Errorf("snap-deactivated: got %+v", o)
+	}
+	if o, ok := byName["snap-crashed"]; !ok || o.DeviceID != "1000103" || o.Reason != "no snapshot row in database" {
+		t.Errorf("snap-crashed: got %+v", o)
+	}
+}
+
+// fakeTarStore serves canned image rows for reclaimStaleTars.
+type fakeTarStore struct {
+	images []*database.Image
+}
+
+func (f *fakeTarStore) ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error) {
+	var out []*database.Image
+	for _, img := range f.images {
+		if downloadStatus == "" || img.DownloadStatus == downloadStatus {
+			out = append(out, img)
+		}
+	}
+	return out, nil
+}
+
+func newTarFixture(t *testing.T) (string, *fakeTarStore) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, size := range map[string]int{
+		"old-active.tar":      100,
+		"recent-active.tar":   200,
+		"old-inactive.tar":    300,
+		"unknown.tar":         400,
+		"downloading.tar":     500,
+		"old-active.tar.part": 600,
+		"notes.txt":           700,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	store := &fakeTarStore{images: []*database.Image{
+		{ImageID: "old-active", DownloadStatus: database.DownloadStatusCompleted, ActivationStatus: database.ActivationStatusActive, DownloadedAt: &old},
+		{ImageID: "recent-active", DownloadStatus: database.DownloadStatusCompleted, ActivationStatus: database.ActivationStatusActive, DownloadedAt: &recent},
+		{ImageID: "old-inactive", DownloadStatus: database.DownloadStatusCompleted, ActivationStatus: database.ActivationStatusInactive, DownloadedAt: &old},
+		{ImageID: "downloading", DownloadStatus: database.DownloadStatusDownloading, ActivationStatus: database.ActivationStatusActive, DownloadedAt: &old},
+	}}
+	return dir, store
+}
+
+// TestReclaimStaleTars tests that only old tars of activated images are deleted.
+func TestReclaimStaleTars(t *testing.T) {
+	dir, store := newTarFixture(t)
+
+	result := &GCResult{}
+	if err := reclaimStaleTars(context.Background(), store, dir, 24*time.Hour, false, result); err != nil {
+		t.Fatalf("reclaimStaleTars failed: %v", err)
+	}
+
+	if result.ReclaimedTarCount != 1 || result.ReclaimedBytes != 100 {
+		t.Errorf("Expected 1 tar / 100 bytes reclaimed, got %d / %d", result.ReclaimedTarCount, result.ReclaimedBytes)
+	}
+	if len(result.ReclaimedTars) != 1 || result.ReclaimedTars[0].ImageID != "old-active" || !result.ReclaimedTars[0].Deleted {
+		t.Errorf("Unexpected reclaimed tars: %+v", result.ReclaimedTars)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "old-active.tar")); !os.IsNotExist(err) {
+		t.Error("Expected old-active.tar to be deleted")
+	}
+	for _, name := range []string{"recent-active.tar", "old-inactive.tar", "unknown.tar", "downloading.tar", "old-active.tar.part", "notes.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be kept: %v", name, err)
+		}
+	}
+}
+
+// TestReclaimStaleTars_DryRun tests that dry-run reports tars without deleting them.
+func TestReclaimStaleTars_DryRun(t *testing.T) {
+	dir, store := newTarFixture(t)
+
+	result := &GCResult{}
+	if err := reclaimStaleTars(context.Background(), store, dir, 24*time.Hour, true, result); err != nil {
+		t.Fatalf("reclaimStaleTars failed: %v", err)
+	}
+
+	if result.ReclaimedTarCount != 1 || result.ReclaimedBytes != 100 || result.ReclaimedTars[0].Deleted {
+		t.Errorf("Unexpected dry-run result: %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old-active.tar")); err != nil {
+		t.Errorf("Dry run must not delete tars: %v", err)
+	}
+}
+
+// TestReclaimStaleTars_MissingDir tests that a missing local directory is not an error.
+func TestReclaimStaleTars_MissingDir(t *testing.T) {
+	result := &GCResult{}
+	if err := reclaimStaleTars(context.Background(), &fakeTarStore{}, filepath.Join(t.TempDir(), "missing"), time.Hour, false, result); err != nil {
+		t.Fatalf("Expected no error for missing directory, got %v", err)
+	}
+	if result.ReclaimedTarCount != 0 {
+		t.Errorf("Expected nothing reclaimed, got %d", result.ReclaimedTarCount)
+	}
+}
+
+// TestReclaimStaleTars_Sharded tests that tars in --shard-storage
+// subdirectories are reclaimed.
+func TestReclaimStaleTars_Sharded(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := download.LocalPath(dir, "img_abcdef01", true)
+	if err := os.MkdirAll(filepath.Dir(tarPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tarPath, make([]byte, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	store := &fakeTarStore{images: []*database.Image{
+		{ImageID: "img_abcdef01", DownloadStatus: database.DownloadStatusCompleted, ActivationStatus: database.ActivationStatusActive, DownloadedAt: &old},
+	}}
+
+	result := &GCResult{}
+	if err := reclaimStaleTars(context.Background(), store, dir, 24*time.Hour, false, result); err != nil {
+		t.Fatalf("reclaimStaleTars failed: %v", err)
+	}
+	if result.ReclaimedTarCount != 1 || result.ReclaimedTars[0].Path != tarPath {
+		t.Errorf("Unexpected reclaimed tars: %+v", result.ReclaimedTars)
+	}
+	if _, err := os.Stat(tarPath); !os.IsNotExist(err) {
+		t.Error("Expected sharded tar to be deleted")
+	}
+}
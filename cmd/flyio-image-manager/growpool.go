@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// runGrowPool extends the thin-pool's data and metadata files and reloads the
+// pool with the larger data device, without taking it offline. Without
+// --force it only prints what it would do.
+func runGrowPool(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+	if cfg.AddData <= 0 && cfg.AddMeta <= 0 {
+		return fmt.Errorf("--add-data or --add-meta is required")
+	}
+
+	ctx := context.Background()
+
+	// The lock also keeps FSMs from allocating from the pool while it is
+	// suspended for the reload.
+	return withDMCommand(ctx, cfg, "grow-pool:"+cfg.PoolName, !cfg.Force, func() error {
+		pm := devicemapper.NewPoolManager(poolConfig(cfg), log)
+		plan, err := pm.PlanGrowth(ctx, cfg.AddData, cfg.AddMeta)
+		if err != nil {
+			return err
+		}
+		printGrowPlan(cfg.PoolName, plan, cfg.RawBytes)
+
+		if !cfg.Force {
+			fmt.Println("\nRe-run with --force to grow the pool.")
+			return nil
+		}
+
+		if err := pm.GrowPool(ctx, plan); err != nil {
+			return fmt.Errorf("failed to grow pool: %w", err)
+		}
+		fmt.Printf("\nPool '%s' grown.\n", cfg.PoolName)
+		return nil
+	})
+}
+
+// printGrowPlan prints the file sizes and table a grow-pool run changes.
+func printGrowPlan(poolName string, plan *devicemapper.PoolGrowPlan, rawBytes bool) {
+	fmt.Printf("Pool '%s':\n", poolName)
+	fmt.Printf("  data:     %s -> %s (%s on %s)\n",
+		formatSize(plan.DataBytes, rawBytes), formatSize(plan.NewDataBytes, rawBytes), plan.DataPath, plan.DataDevice)
+	fmt.Printf("  metadata: %s -> %s (%s on %s)\n",
+		formatSize(plan.MetaBytes, rawBytes), formatSize(plan.NewMetaBytes, rawBytes), plan.MetaPath, plan.MetaDevice)
+	fmt.Printf("  table:    %s\n", plan.Table)
+	fmt.Printf("         -> %s\n", plan.NewTable())
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// healthcheck exit codes.
+const (
+	healthExitOK         = 0 // Daemon running and every check passed
+	healthExitUnhealthy  = 1 // Pool or system check failed
+	healthExitNotRunning = 2 // No live process holds the manager lock
+)
+
+// healthcheckTimeout bounds the pool status query.
+const healthcheckTimeout = 10 * time.Second
+
+// healthProbe holds the checks run by the healthcheck command. Each is a
+// field so tests can inject failures without a pool or a running daemon.
+type healthProbe struct {
+	readLock     func() (*lockFileInfo, error) // nil info when no lock file exists
+	processAlive func(pid int) bool
+	checkPool    func(ctx context.Context) error
+	checkSystem  func() error // D-state processes, dm errors, memory and I/O pressure
+}
+
+// newHealthProbe returns a probe backed by the manager lock in --fsm-db,
+// dmsetup and the pre-flight system health check.
+func newHealthProbe(cfg Config) *healthProbe {
+	return &healthProbe{
+		readLock:     func() (*lockFileInfo, error) { return readManagerLock(cfg.FSMDBPath) },
+		processAlive: isProcessRunning,
+		checkPool:    func(ctx context.Context) error { return checkPoolExists(ctx, cfg.PoolName) },
+		checkSystem:  func() error { return checkSystemHealth(cfg) },
+	}
+}
+
+// healthCheck is the outcome of one check.
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// healthReport is the result of a probe, printed as one line or as JSON.
+type healthReport struct {
+	Status      string        `json:"status"` // healthy, unhealthy or not-running
+	Reason      string        `json:"reason"`
+	LockPID     int           `json:"lock_pid,omitempty"`
+	LockCommand string        `json:"lock_command,omitempty"`
+	Checks      []healthCheck `json:"checks"`
+}
+
+// ExitCode returns the process exit code for the report.
+func (r *healthReport) ExitCode() int {
+	switch r.Status {
+	case "healthy":
+		return healthExitOK
+	case "not-running":
+		return healthExitNotRunning
+	default:
+		return healthExitUnhealthy
+	}
+}
+
+// Run performs every check and reports the first failure as the reason. A
+// missing or stale manager lock means no daemon is running, which takes
+// precedence over pool and system failures.
+func (p *healthProbe) Run(ctx context.Context) *healthReport {
+	report := &healthReport{Status: "healthy", Reason: "ok"}
+	fail := func(status, reason string) {
+		if report.Status == "healthy" {
+			report.Status, report.Reason = status, reason
+		}
+	}
+	record := func(name string, err error) error {
+		c := healthCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		report.Checks = append(report.Checks, c)
+		return err
+	}
+
+	info, err := p.readLock()
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to read manager lock: %w", err)
+	case info == nil:
+		err = errors.New("manager lock not held: daemon is not running")
+	case !p.processAlive(info.PID):
+		err = fmt.Errorf("manager lock is stale: PID %d (%s) is not running", info.PID, info.Command)
+	}
+	if info != nil {
+		report.LockPID, report.LockCommand = info.PID, info.Command
+	}
+	if record("lock", err) != nil {
+		fail("not-running", err.Error())
+	}
+
+	if err := record("pool", p.checkPool(ctx)); err != nil {
+		fail("unhealthy", err.Error())
+	}
+	if err := record("system", p.checkSystem()); err != nil {
+		fail("unhealthy", err.Error())
+	}
+	return report
+}
+
+// readManagerLock returns the contents of the manager lock file in
+// fsmDBPath, or nil if there is none.
+func readManagerLock(fsmDBPath string) (*lockFileInfo, error) {
+	data, err := os.ReadFile(filepath.Join(fsmDBPath, "flyio-manager.lock"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var info lockFileInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid lock file: %w", err)
+	}
+	return &info, nil
+}
+
+// writeHealthReport prints the report as a single line, or as JSON.
+func writeHealthReport(w io.Writer, r *healthReport, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(r)
+	}
+	_, err := fmt.Fprintf(w, "%s: %s\n", r.Status, r.Reason)
+	return err
+}
+
+// runHealthcheck probes the daemon, pool and system for use as a systemd or
+// Kubernetes exec probe, and returns the exit code. It takes no lock and
+// changes nothing, so it is safe to run while the daemon is working.
+func runHealthcheck(cfg Config) (int, error) {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthcheckTimeout)
+	defer cancel()
+
+	report := newHealthProbe(cfg).Run(ctx)
+	if err := writeHealthReport(os.Stdout, report, cfg.JSON); err != nil {
+		return 0, err
+	}
+	return report.ExitCode(), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// healthyProbe returns a probe whose checks all pass, with the lock held by a
+// live daemon.
+func healthyProbe() *healthProbe {
+	return &healthProbe{
+		readLock:     func() (*lockFileInfo, error) { return &lockFileInfo{PID: 4242, Command: "daemon"}, nil },
+		processAlive: func(pid int) bool { return pid == 4242 },
+		checkPool:    func(ctx context.Context) error { return nil },
+		checkSystem:  func() error { return nil },
+	}
+}
+
+func TestHealthProbe_Healthy(t *testing.T) {
+	r := healthyProbe().Run(context.Background())
+	if r.Status != "healthy" || r.ExitCode() != healthExitOK {
+		t.Fatalf("report = %+v, want healthy with exit 0", r)
+	}
+	if r.LockPID != 4242 || r.LockCommand != "daemon" {
+		t.Errorf("lock = %d/%q, want 4242/daemon", r.LockPID, r.LockCommand)
+	}
+	if len(r.Checks) != 3 {
+		t.Errorf("checks = %+v, want lock, pool and system", r.Checks)
+	}
+	for _, c := range r.Checks {
+		if !c.OK {
+			t.Errorf("check %s failed: %s", c.Name, c.Error)
+		}
+	}
+}
+
+func TestHealthProbe_Failures(t *testing.T) {
+	tests := []struct {
+		name       string
+		mutate     func(p *healthProbe)
+		wantStatus string
+		wantExit   int
+		wantReason string
+	}{
+		{
+			name:       "no lock file",
+			mutate:     func(p *healthProbe) { p.readLock = func() (*lockFileInfo, error) { return nil, nil } },
+			wantStatus: "not-running",
+			wantExit:   healthExitNotRunning,
+			wantReason: "daemon is not running",
+		},
+		{
+			name:       "stale lock",
+			mutate:     func(p *healthProbe) { p.processAlive = func(int) bool { return false } },
+			wantStatus: "not-running",
+			wantExit:   healthExitNotRunning,
+			wantReason: "PID 4242 (daemon) is not running",
+		},
+		{
+			name: "unreadable lock",
+			mutate: func(p *healthProbe) {
+				p.readLock = func() (*lockFileInfo, error) { return nil, errors.New("permission denied") }
+			},
+			wantStatus: "not-running",
+			wantExit:   healthExitNotRunning,
+			wantReason: "permission denied",
+		},
+		{
+			name: "pool unhealthy",
+			mutate: func(p *healthProbe) {
+				p.checkPool = func(context.Context) error { return errors.New("needs_check flag set") }
+			},
+			wantStatus: "unhealthy",
+			wantExit:   healthExitUnhealthy,
+			wantReason: "needs_check",
+		},
+		{
+			name: "D-state buildup",
+			mutate: func(p *healthProbe) {
+				p.checkSystem = func() error { return errors.New("system unstable: 3 devicemapper-related D-state processes detected") }
+			},
+			wantStatus: "unhealthy",
+			wantExit:   healthExitUnhealthy,
+			wantReason: "D-state",
+		},
+		{
+			name: "stopped daemon outranks pool failure",
+			mutate: func(p *healthProbe) {
+				p.readLock = func() (*lockFileInfo, error) { return nil, nil }
+				p.checkPool = func(context.Context) error { return errors.New("pool missing") }
+			},
+			wantStatus: "not-running",
+			wantExit:   healthExitNotRunning,
+			wantReason: "not running",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := healthyProbe()
+			tt.mutate(p)
+			r := p.Run(context.Background())
+			if r.Status != tt.wantStatus || r.ExitCode() != tt.wantExit {
+				t.Errorf("status = %s (exit %d), want %s (exit %d)", r.Status, r.ExitCode(), tt.wantStatus, tt.wantExit)
+			}
+			if !strings.Contains(r.Reason, tt.wantReason) {
+				t.Errorf("reason = %q, want it to mention %q", r.Reason, tt.wantReason)
+			}
+			if len(r.Checks) != 3 {
+				t.Errorf("ran %d checks, want all 3 even after a failure", len(r.Checks))
+			}
+		})
+	}
+}
+
+func TestReadManagerLock(t *testing.T) {
+	dir := t.TempDir()
+	if info, err := readManagerLock(dir); err != nil || info != nil {
+		t.Fatalf("readManagerLock(empty) = %+v, %v; want nil, nil", info, err)
+	}
+
+	data, _ := json.Marshal(lockFileInfo{PID: 7, Timestamp: 1700000000, Command: "daemon"})
+	if err := os.WriteFile(filepath.Join(dir, "flyio-manager.lock"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := readManagerLock(dir)
+	if err != nil || info == nil || info.PID != 7 || info.Command != "daemon" {
+		t.Errorf("readManagerLock() = %+v, %v; want PID 7 daemon", info, err)
+	}
+}
+
+func TestWriteHealthReport(t *testing.T) {
+	p := healthyProbe()
+	p.checkPool = func(context.Context) error { return errors.New("pool missing") }
+	r := p.Run(context.Background())
+
+	var line bytes.Buffer
+	if err := writeHealthReport(&line, r, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := line.String(); got != "unhealthy: pool missing\n" {
+		t.Errorf("line = %q, want %q", got, "unhealthy: pool missing\n")
+	}
+
+	var out bytes.Buffer
+	if err := writeHealthReport(&out, r, true); err != nil {
+		t.Fatal(err)
+	}
+	var decoded healthReport
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out.String(), err)
+	}
+	if decoded.Status != "unhealthy" || len(decoded.Checks) != 3 || decoded.Checks[1].Error != "pool missing" {
+		t.Errorf("decoded = %+v, want the unhealthy report with the pool error", decoded)
+	}
+}
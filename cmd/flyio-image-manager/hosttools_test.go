@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// withLookPath makes probeHostTools see only the named tools, restoring the
+// real lookup and probed tools when the test ends.
+func withLookPath(t *testing.T, present ...string) {
+	t.Helper()
+	origLookPath, origTools := lookPath, devicemapper.Tools()
+	t.Cleanup(func() {
+		lookPath = origLookPath
+		devicemapper.SetTools(origTools)
+	})
+	lookPath = func(file string) (string, error) {
+		for _, p := range present {
+			if p == file {
+				return "/usr/bin/" + file, nil
+			}
+		}
+		return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+	}
+}
+
+func TestProbeHostTools_MissingTools(t *testing.T) {
+	withLookPath(t, "udevadm")
+
+	tools := probeHostTools()
+	if tools != (devicemapper.HostTools{Udevadm: true}) {
+		t.Errorf("probeHostTools() = %+v, want only udevadm", tools)
+	}
+	if devicemapper.Tools() != tools {
+		t.Errorf("devicemapper.Tools() = %+v, want the probed %+v", devicemapper.Tools(), tools)
+	}
+	for _, name := range tools.Missing() {
+		if hostToolFallbacks[name] == "" {
+			t.Errorf("no fallback described for %s", name)
+		}
+	}
+}
+
+func TestGetIOWait_WithoutVmstat(t *testing.T) {
+	withLookPath(t)
+	probeHostTools()
+
+	orig := ioWaitSampleInterval
+	ioWaitSampleInterval = 20 * time.Millisecond
+	t.Cleanup(func() { ioWaitSampleInterval = orig })
+
+	// Falls back to sampling /proc/stat rather than reporting zero
+	iowait, err := getIOWait(context.Background())
+	if err != nil {
+		t.Fatalf("getIOWait() error = %v", err)
+	}
+	if iowait < 0 || iowait > 100 {
+		t.Errorf("getIOWait() = %v, want a percentage", iowait)
+	}
+}
+
+func TestParseVmstatIOWait(t *testing.T) {
+	out := `procs -----------memory---------- ---swap-- -----io---- -system-- -------cpu-------
+ r  b   swpd   free   buff  cache   si   so    bi    bo   in   cs us sy id wa st gu
+ 1  0      0 3512884  54040 2111564    0    0   273   537  114  296  6  1 90  3  0  0
+ 2  0      0 3512884  54040 2111564    0    0     0     0   39  104  2  0 81 17  0  0
+`
+	got, err := parseVmstatIOWait(out)
+	if err != nil || got != 17 {
+		t.Errorf("parseVmstatIOWait() = %v, %v, want 17", got, err)
+	}
+	if _, err := parseVmstatIOWait("vmstat: not found\n"); err == nil {
+		t.Error("parseVmstatIOWait() of an error message succeeded")
+	}
+}
+
+func TestCountDmErrors(t *testing.T) {
+	lines := []string{
+		"EXT4-fs (dm-3): mounted filesystem",
+		"device-mapper: thin: 253:0: metadata operation failed",
+		"Buffer I/O error on dev dm-4, logical block 0",
+		"device-mapper: thin: Data device (dm-1) discard unsupported",
+	}
+	if got := countDmErrors(lines); got != 2 {
+		t.Errorf("countDmErrors() = %d, want 2", got)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/extraction"
+)
+
+// inspectStore is the subset of *database.DB used by inspect-snapshot.
+type inspectStore interface {
+	GetSnapshotByID(ctx context.Context, snapshotID string) (*database.Snapshot, error)
+	GetUnpackedImageByID(ctx context.Context, imageID string) (*database.UnpackedImage, error)
+	TouchSnapshot(ctx context.Context, snapshotID string) error
+}
+
+// snapshotInspector is the subset of *devicemapper.Client used by inspect-snapshot.
+type snapshotInspector interface {
+	DeviceExists(ctx context.Context, deviceName string) (bool, error)
+	ActivateDeviceReadOnly(ctx context.Context, poolName, deviceName, deviceID string, sizeBytes int64) error
+	DeactivateDevice(ctx context.Context, deviceName string) error
+	MountDeviceRO(ctx context.Context, devicePath, mountPoint string) error
+	UnmountDevice(ctx context.Context, mountPoint string) error
+	MaxDeviceSize() int64
+}
+
+// inspectSettleDelay is the pause between unmounting and deactivating a
+// device, so the unmount has settled before the device goes away.
+var inspectSettleDelay = 500 * time.Millisecond
+
+// runInspectSnapshot mounts a snapshot read-only and prints its top-level
+// directory listing.
+func runInspectSnapshot(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	logger := log.WithFields(logrus.Fields{
+		"command":     "inspect-snapshot",
+		"snapshot_id": cfg.SnapshotID,
+	})
+
+	// Mounting changes device state, so there is no dry run.
+	return withDMCommand(ctx, cfg, "inspect-snapshot:"+cfg.SnapshotID, false, func() error {
+		db, err := database.New(database.Config{Path: cfg.DBPath})
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+		dmClient.SetOperationRecorder(dmRecorder{db})
+
+		return inspectSnapshot(ctx, logger, db, dmClient, os.Stdout, cfg.PoolName, cfg.SnapshotID, cfg.MountPoint)
+	})
+}
+
+// inspectSnapshot mounts the snapshot device read-only at mountPoint (a
+// temporary directory if empty), writes the top-level entries of its root
+// filesystem to w, and unmounts it again. The root is found from the layout
+// recorded when the origin was unpacked.
+//
+// An inactive snapshot is activated read-only for the inspection and
+// deactivated afterwards; an active one is left as found.
+func inspectSnapshot(ctx context.Context, logger logrus.FieldLogger, store inspectStore, dm snapshotInspector, w io.Writer, poolName, snapshotID, mountPoint string) (err error) {
+	snap, err := store.GetSnapshotByID(ctx, snapshotID)
+	if err != nil {
+		return fmt.Errorf("failed to look up snapshot: %w", err)
+	}
+	if snap == nil {
+		return fmt.Errorf("snapshot not found: %s", snapshotID)
+	}
+
+	logger = logger.WithField("snapshot_name", snap.SnapshotName)
+
+	img, err := store.GetUnpackedImageByID(ctx, snap.ImageID)
+	if err != nil {
+		return fmt.Errorf("failed to look up unpacked image: %w", err)
+	}
+	var layout string
+	if img != nil {
+		layout = img.Layout
+	}
+
+	exists, err := dm.DeviceExists(ctx, snap.SnapshotName)
+	if err != nil {
+		return fmt.Errorf("failed to check device %s: %w", snap.SnapshotName, err)
+	}
+
+	if !exists {
+		// A snapshot's table must cover its origin's whole filesystem, so it is
+		// activated at the origin's device size, not the extracted content size
+		if img == nil {
+			return fmt.Errorf("origin of snapshot %s has not been unpacked", snapshotID)
+		}
+
+		logger.Info("snapshot inactive, activating read-only for inspection")
+		if err := dm.ActivateDeviceReadOnly(ctx, poolName, snap.SnapshotName, snap.SnapshotID, img.DeviceSize(dm.MaxDeviceSize())); err != nil {
+			return fmt.Errorf("failed to activate device %s: %w", snap.SnapshotName, err)
+		}
+		defer func() {
+			if derr := dm.DeactivateDevice(ctx, snap.SnapshotName); derr != nil {
+				logger.WithError(derr).Error("failed to deactivate device after inspection")
+				if err == nil {
+					err = fmt.Errorf("inspection finished but device %s is still active: %w", snap.SnapshotName, derr)
+				}
+			}
+		}()
+	}
+
+	if mountPoint == "" {
+		dir, err := os.MkdirTemp("", "inspect-"+snap.SnapshotName+"-")
+		if err != nil {
+			return fmt.Errorf("failed to create mount point: %w", err)
+		}
+		defer os.Remove(dir)
+		mountPoint = dir
+	}
+
+	if err := dm.MountDeviceRO(ctx, snap.DevicePath, mountPoint); err != nil {
+		return fmt.Errorf("failed to mount %s: %w", snap.DevicePath, err)
+	}
+	defer func() {
+		if uerr := dm.UnmountDevice(ctx, mountPoint); uerr != nil {
+			logger.WithError(uerr).Error("failed to unmount after inspection")
+			if err == nil {
+				err = fmt.Errorf("inspection finished but %s is still mounted: %w", mountPoint, uerr)
+			}
+			return
+		}
+		// Let the unmount settle before the device is deactivated.
+		if !exists {
+			time.Sleep(inspectSettleDelay)
+		}
+	}()
+
+	// Inspecting counts as use, so reap-snapshots leaves the snapshot alone.
+	if err := store.TouchSnapshot(ctx, snap.SnapshotID); err != nil {
+		logger.WithError(err).Warn("failed to record snapshot access")
+	}
+
+	rootDir := extraction.RootDir(mountPoint, layout)
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", rootDir, err)
+	}
+
+	fmt.Fprintf(w, "%s (%s, image %s) mounted read-only at %s:\n", snap.SnapshotID, snap.SnapshotName, snap.ImageID, mountPoint)
+	if rootDir != mountPoint {
+		fmt.Fprintf(w, "Root filesystem in %s/:\n", extraction.RootfsDir)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(w, "  %s\n", name)
+	}
+	return nil
+}
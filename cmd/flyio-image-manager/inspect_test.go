@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// fakeInspectStore holds one snapshot and its unpacked origin.
+type fakeInspectStore struct {
+	snap *database.Snapshot
+	img  *database.UnpackedImage
+
+	touched []string
+}
+
+func (f *fakeInspectStore) GetSnapshotByID(ctx context.Context, snapshotID string) (*database.Snapshot, error) {
+	if f.snap == nil || f.snap.SnapshotID != snapshotID {
+		return nil, nil
+	}
+	return f.snap, nil
+}
+
+func (f *fakeInspectStore) GetUnpackedImageByID(ctx context.Context, imageID string) (*database.UnpackedImage, error) {
+	return f.img, nil
+}
+
+func (f *fakeInspectStore) TouchSnapshot(ctx context.Context, snapshotID string) error {
+	f.touched = append(f.touched, snapshotID)
+	return nil
+}
+
+// fakeInspector records device calls. Mounting populates the mount point,
+// or its rootfs/ with rootfs set, with a small root filesystem.
+type fakeInspector struct {
+	active     bool
+	rootfs     bool
+	mountErr   error
+	unmountErr error
+
+	calls []string
+	size  int64 // Size passed to ActivateDeviceReadOnly
+}
+
+func (f *fakeInspector) DeviceExists(ctx context.Context, deviceName string) (bool, error) {
+	return f.active, nil
+}
+
+func (f *fakeInspector) ActivateDeviceReadOnly(ctx context.Context, poolName, deviceName, deviceID string, sizeBytes int64) error {
+	f.calls = append(f.calls, "activate-ro "+deviceName+" "+deviceID)
+	f.size = sizeBytes
+	return nil
+}
+
+func (f *fakeInspector) MaxDeviceSize() int64 { return devicemapper.DefaultMaxDeviceSize }
+
+func (f *fakeInspector) DeactivateDevice(ctx context.Context, deviceName string) error {
+	f.calls = append(f.calls, "deactivate "+deviceName)
+	return nil
+}
+
+func (f *fakeInspector) MountDeviceRO(ctx context.Context, devicePath, mountPoint string) error {
+	f.calls = append(f.calls, "mount-ro "+devicePath)
+	if f.mountErr != nil {
+		return f.mountErr
+	}
+	if f.rootfs {
+		mountPoint = filepath.Join(mountPoint, "rootfs")
+	}
+	for _, dir := range []string{"etc", "usr"} {
+		if err := os.MkdirAll(filepath.Join(mountPoint, dir), 0o755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(mountPoint, "app"), nil, 0o755)
+}
+
+func (f *fakeInspector) UnmountDevice(ctx context.Context, mountPoint string) error {
+	f.calls = append(f.calls, "unmount")
+	return f.unmountErr
+}
+
+func newInspectFixture() *fakeInspectStore {
+	return &fakeInspectStore{
+		snap: &database.Snapshot{SnapshotID: "1042", SnapshotName: "snap-img1", ImageID: "img1", DevicePath: "/dev/mapper/snap-img1", Active: true},
+		img:  &database.UnpackedImage{ImageID: "img1", DeviceName: "thin-img1", SizeBytes: 100 << 20, DeviceSizeBytes: 1 << 30},
+	}
+}
+
+func TestInspectSnapshot_ActiveDevice(t *testing.T) {
+	dm := &fakeInspector{active: true}
+	store := newInspectFixture()
+	mountPoint := t.TempDir()
+	var out bytes.Buffer
+
+	if err := inspectSnapshot(context.Background(), quietLogger(), store, dm, &out, "pool", "1042", mountPoint); err != nil {
+		t.Fatalf("inspectSnapshot() error = %v", err)
+	}
+	if len(store.touched) != 1 || store.touched[0] != "1042" {
+		t.Errorf("touched = %v, want the inspected snapshot recorded as accessed", store.touched)
+	}
+
+	if got := strings.Join(dm.calls, ","); got != "mount-ro /dev/mapper/snap-img1,unmount" {
+		t.Errorf("calls = %s, want a read-only mount and unmount only", got)
+	}
+	for _, want := range []string{"mounted read-only at " + mountPoint, "  app\n", "  etc/\n", "  usr/\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestInspectSnapshot_RootfsSubdir(t *testing.T) {
+	dm := &fakeInspector{active: true, rootfs: true}
+	store := newInspectFixture()
+	store.img.Layout = "rootfs-subdir"
+	var out bytes.Buffer
+
+	if err := inspectSnapshot(context.Background(), quietLogger(), store, dm, &out, "pool", "1042", t.TempDir()); err != nil {
+		t.Fatalf("inspectSnapshot() error = %v", err)
+	}
+	for _, want := range []string{"Root filesystem in rootfs/:\n", "  app\n", "  etc/\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "  rootfs/\n") {
+		t.Errorf("output lists the mount point instead of rootfs/:\n%s", out.String())
+	}
+}
+
+func TestInspectSnapshot_InactiveDevice(t *testing.T) {
+	old := inspectSettleDelay
+	inspectSettleDelay = 0
+	t.Cleanup(func() { inspectSettleDelay = old })
+
+	dm := &fakeInspector{}
+	var out bytes.Buffer
+
+	if err := inspectSnapshot(context.Background(), quietLogger(), newInspectFixture(), dm, &out, "pool", "1042", ""); err != nil {
+		t.Fatalf("inspectSnapshot() error = %v", err)
+	}
+
+	want := "activate-ro snap-img1 1042,mount-ro /dev/mapper/snap-img1,unmount,deactivate snap-img1"
+	if got := strings.Join(dm.calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+	if dm.size != 1<<30 {
+		t.Errorf("activated with %d bytes, want the origin's device size %d", dm.size, 1<<30)
+	}
+	if !strings.Contains(out.String(), "etc/") {
+		t.Errorf("output missing listing:\n%s", out.String())
+	}
+}
+
+func TestInspectSnapshot_Failures(t *testing.T) {
+	t.Run("unknown snapshot", func(t *testing.T) {
+		dm := &fakeInspector{active: true}
+		if err := inspectSnapshot(context.Background(), quietLogger(), newInspectFixture(), dm, &bytes.Buffer{}, "pool", "9999", t.TempDir()); err == nil {
+			t.Fatal("expected error")
+		}
+		if len(dm.calls) != 0 {
+			t.Errorf("calls = %v, want none", dm.calls)
+		}
+	})
+
+	t.Run("mount failure deactivates", func(t *testing.T) {
+		dm := &fakeInspector{mountErr: errors.New("wrong fs type")}
+		if err := inspectSnapshot(context.Background(), quietLogger(), newInspectFixture(), dm, &bytes.Buffer{}, "pool", "1042", t.TempDir()); err == nil {
+			t.Fatal("expected error")
+		}
+		if got := strings.Join(dm.calls, ","); got != "activate-ro snap-img1 1042,mount-ro /dev/mapper/snap-img1,deactivate snap-img1" {
+			t.Errorf("calls = %s", got)
+		}
+	})
+
+	t.Run("unmount failure is reported", func(t *testing.T) {
+		dm := &fakeInspector{active: true, unmountErr: errors.New("target is busy")}
+		err := inspectSnapshot(context.Background(), quietLogger(), newInspectFixture(), dm, &bytes.Buffer{}, "pool", "1042", t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), "still mounted") {
+			t.Errorf("error = %v, want it to report the mount left behind", err)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/humanize"
+)
+
+// runListImages lists downloaded images.
+func runListImages(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	db, err := database.New(database.Config{Path: cfg.DBPath})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	render := func(w io.Writer) error {
+		return renderImages(ctx, w, db, cfg.RawBytes)
+	}
+	if !cfg.Watch {
+		return render(os.Stdout)
+	}
+
+	// Watch until interrupted, reading the database afresh for each frame.
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return watch(ctx, os.Stdout, realClock{}, cfg.WatchInterval, "list-images", render)
+}
+
+// imageLister is the subset of *database.DB used by list-images.
+type imageLister interface {
+	ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error)
+	ListTags(ctx context.Context) (map[string][]string, error)
+}
+
+// renderImages reads the images and their tags and writes the list-images report.
+func renderImages(ctx context.Context, w io.Writer, store imageLister, rawBytes bool) error {
+	images, err := store.ListImages(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+	tags, err := store.ListTags(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	printImages(w, images, tags, rawBytes)
+	return nil
+}
+
+// printImages writes the list-images report.
+func printImages(w io.Writer, images []*database.Image, tags map[string][]string, rawBytes bool) {
+	fmt.Fprintf(w, "Found %d images:\n\n", len(images))
+	for _, img := range images {
+		fmt.Fprintf(w, "Image ID:         %s\n", img.ImageID)
+		if len(tags[img.ImageID]) > 0 {
+			fmt.Fprintf(w, "  Tags:           %s\n", strings.Join(tags[img.ImageID], ", "))
+		}
+		fmt.Fprintf(w, "  S3 Key:         %s\n", img.S3Key)
+		fmt.Fprintf(w, "  Local Path:     %s\n", img.LocalPath)
+		fmt.Fprintf(w, "  Size:           %s\n", formatSize(img.SizeBytes, rawBytes))
+		fmt.Fprintf(w, "  Status:         %s\n", img.DownloadStatus)
+		fmt.Fprintf(w, "  Activation:     %s\n", img.ActivationStatus)
+		if img.DownloadedAt != nil {
+			fmt.Fprintf(w, "  Downloaded At:  %s\n", img.DownloadedAt.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(w, "  Downloaded At:  (not completed)\n")
+		}
+		if img.LastError != "" {
+			fmt.Fprintf(w, "  Last Error:     %s\n", img.LastError)
+			if img.LastErrorAt != nil {
+				fmt.Fprintf(w, "  Failed At:      %s\n", img.LastErrorAt.Format(time.RFC3339))
+			}
+		}
+		if img.Quarantined() {
+			fmt.Fprintf(w, "  Quarantined:    %s\n", img.QuarantineReason)
+			fmt.Fprintf(w, "  Quarantined At: %s\n", img.QuarantinedAt.Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// runListSnapshots lists active snapshots.
+func runListSnapshots(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	db, err := database.New(database.Config{Path: cfg.DBPath})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	snapshots, err := db.ListActiveSnapshots(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	unpacked, err := db.ListUnpackedImages(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list unpacked images: %w", err)
+	}
+
+	// A snapshot has the virtual size of the device it was taken from.
+	sizes := make(map[string]int64, len(unpacked))
+	for _, u := range unpacked {
+		sizes[u.ImageID] = u.SizeBytes
+	}
+
+	printSnapshots(os.Stdout, snapshots, sizes, cfg.RawBytes)
+	return nil
+}
+
+// printSnapshots writes the list-snapshots report. sizes maps image IDs to
+// their unpacked device size; snapshots of images missing from it show no size.
+func printSnapshots(w io.Writer, snapshots []*database.Snapshot, sizes map[string]int64, rawBytes bool) {
+	fmt.Fprintf(w, "Found %d active snapshots:\n\n", len(snapshots))
+	for _, snap := range snapshots {
+		fmt.Fprintf(w, "Snapshot ID:      %s\n", snap.SnapshotID)
+		fmt.Fprintf(w, "  Image ID:       %s\n", snap.ImageID)
+		fmt.Fprintf(w, "  Snapshot Name:  %s\n", snap.SnapshotName)
+		fmt.Fprintf(w, "  Device Path:    %s\n", snap.DevicePath)
+		if size, ok := sizes[snap.ImageID]; ok {
+			fmt.Fprintf(w, "  Device Size:    %s\n", formatSize(size, rawBytes))
+		}
+		fmt.Fprintf(w, "  Active:         %v\n", snap.Active)
+		fmt.Fprintf(w, "  Created At:     %s\n", snap.CreatedAt.Format(time.RFC3339))
+		fmt.Fprintln(w)
+	}
+}
+
+// formatSize formats n for the list commands: human-readable by default, or
+// the exact byte count with --bytes.
+func formatSize(n int64, rawBytes bool) string {
+	if rawBytes {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return humanize.Bytes(n)
+}
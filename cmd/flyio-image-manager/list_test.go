@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/database"
+)
+
+func TestPrintImages_Sizes(t *testing.T) {
+	images := []*database.Image{{ImageID: "img1", S3Key: "a.tar", SizeBytes: 1536, DownloadStatus: "completed"}}
+
+	var human bytes.Buffer
+	printImages(&human, images, nil, false)
+	if !strings.Contains(human.String(), "  Size:           1.5 KB\n") {
+		t.Errorf("printImages() output:\n%s\nwant Size 1.5 KB", human.String())
+	}
+
+	var raw bytes.Buffer
+	printImages(&raw, images, nil, true)
+	if !strings.Contains(raw.String(), "  Size:           1536 bytes\n") {
+		t.Errorf("printImages(--bytes) output:\n%s\nwant Size 1536 bytes", raw.String())
+	}
+}
+
+func TestPrintSnapshots_Sizes(t *testing.T) {
+	snaps := []*database.Snapshot{
+		{SnapshotID: "s1", ImageID: "img1", Active: true, CreatedAt: time.Now()},
+		{SnapshotID: "s2", ImageID: "img2", Active: true, CreatedAt: time.Now()},
+	}
+	sizes := map[string]int64{"img1": 4 << 30}
+
+	var human bytes.Buffer
+	printSnapshots(&human, snaps, sizes, false)
+	out := human.String()
+	if !strings.Contains(out, "  Device Size:    4.0 GB\n") {
+		t.Errorf("printSnapshots() output:\n%s\nwant Device Size 4.0 GB", out)
+	}
+	// img2 has no unpacked record, so its snapshot shows no size
+	if strings.Count(out, "Device Size") != 1 {
+		t.Errorf("printSnapshots() output:\n%s\nwant one Device Size line", out)
+	}
+
+	var raw bytes.Buffer
+	printSnapshots(&raw, snaps, sizes, true)
+	if !strings.Contains(raw.String(), "  Device Size:    4294967296 bytes\n") {
+		t.Errorf("printSnapshots(--bytes) output:\n%s", raw.String())
+	}
+}
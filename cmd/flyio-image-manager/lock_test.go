@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// holdLock writes a manager lock in dir held by this (live) test process,
+// claiming to be built from version.
+func holdLock(t *testing.T, dir, version string) string {
+	t.Helper()
+	path := filepath.Join(dir, "flyio-manager.lock")
+	data, _ := json.Marshal(lockFileInfo{PID: os.Getpid(), Timestamp: time.Now().Unix(), Command: "daemon", Version: version})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// captureLockLog shortens lockRetryInterval and captures the global logger
+// for the rest of the test.
+func captureLockLog(t *testing.T) *bytes.Buffer {
+	oldInterval, oldOut := lockRetryInterval, log.Out
+	var buf bytes.Buffer
+	lockRetryInterval = 10 * time.Millisecond
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		lockRetryInterval = oldInterval
+		log.SetOutput(oldOut)
+	})
+	return &buf
+}
+
+func TestAcquireManagerLock_WaitsForRelease(t *testing.T) {
+	captureLockLog(t)
+	dir := t.TempDir()
+	path := holdLock(t, dir, Version)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Remove(path)
+	}()
+
+	if err := acquireManagerLock(dir, 5*time.Second); err != nil {
+		t.Fatalf("acquireManagerLock() error = %v", err)
+	}
+	defer releaseManagerLock(dir)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info lockFileInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != Version || info.PID != os.Getpid() {
+		t.Errorf("lock file = %+v, want version %s and our PID", info, Version)
+	}
+}
+
+func TestAcquireManagerLock_GivesUp(t *testing.T) {
+	captureLockLog(t)
+	dir := t.TempDir()
+	holdLock(t, dir, Version)
+
+	for _, wait := range []time.Duration{0, 50 * time.Millisecond} {
+		start := time.Now()
+		err := acquireManagerLock(dir, wait)
+		var held *lockHeldError
+		if !errors.As(err, &held) {
+			t.Fatalf("acquireManagerLock(wait=%v) error = %v, want lockHeldError", wait, err)
+		}
+		if elapsed := time.Since(start); elapsed > wait+time.Second {
+			t.Errorf("acquireManagerLock(wait=%v) took %v", wait, elapsed)
+		}
+	}
+}
+
+func TestAcquireManagerLock_WarnsOnVersionMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		warn    string // expected holder_version, "" for no warning
+	}{
+		{"same version", Version, ""},
+		{"different version", "v0.9.0", "holder_version=v0.9.0"},
+		{"older binary without version", "", "holder_version=unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLockLog(t)
+			dir := t.TempDir()
+			holdLock(t, dir, tt.version)
+
+			err := acquireManagerLock(dir, 30*time.Millisecond)
+			if err == nil {
+				t.Fatal("acquireManagerLock() succeeded on a held lock")
+			}
+
+			out := buf.String()
+			warned := strings.Contains(out, "held by a different flyio-image-manager version")
+			if warned != (tt.warn != "") {
+				t.Fatalf("warned = %v, want %v; log:\n%s", warned, tt.warn != "", out)
+			}
+			if tt.warn != "" {
+				if !strings.Contains(out, tt.warn) {
+					t.Errorf("log missing %q:\n%s", tt.warn, out)
+				}
+				// Retries against the same holder don't repeat the warning
+				if n := strings.Count(out, "different flyio-image-manager version"); n != 1 {
+					t.Errorf("warned %d times, want once", n)
+				}
+			}
+		})
+	}
+}
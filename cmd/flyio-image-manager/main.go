@@ -11,13 +11,17 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	stdlog "log"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,6 +30,7 @@ import (
 
 	fsm "github.com/superfly/fsm"
 	"github.com/superfly/fsm/activate"
+	"github.com/superfly/fsm/checksum"
 	"github.com/superfly/fsm/database"
 	"github.com/superfly/fsm/devicemapper"
 	"github.com/superfly/fsm/download"
@@ -37,43 +42,146 @@ import (
 )
 
 // Config holds application configuration.
+//
+// The yaml tags match the command-line flag names so a --config file uses
+// the same keys as the flags it replaces.
 type Config struct {
 	// S3 Configuration
-	S3Bucket string
-	S3Region string
+	S3Bucket      string `yaml:"bucket"`
+	S3Region      string `yaml:"region"`
+	S3Concurrency int    `yaml:"s3-concurrency"` // Parallel range requests for multipart downloads
+	S3Prefix      string `yaml:"prefix"`         // Key prefix the monitor's S3 browser lists
 
 	// Database Configuration
-	DBPath string
+	DBPath string `yaml:"db"`
 
 	// FSM Configuration
-	FSMDBPath string
+	FSMDBPath string `yaml:"fsm-db"`
 
 	// DeviceMapper Configuration
-	PoolName  string
-	MountRoot string
+	PoolName          string  `yaml:"pool"`
+	MountRoot         string  `yaml:"mount-root"`
+	PoolThreshold     float64 `yaml:"pool-threshold"`      // Pool data usage percentage above which operations are refused
+	PoolMetaThreshold float64 `yaml:"pool-meta-threshold"` // Pool metadata usage percentage above which operations are refused
+	PoolWarnThreshold float64 `yaml:"pool-warn-threshold"` // daemon: pool usage percentage at which an alert fires
+	AlertWebhook      string  `yaml:"alert-webhook"`       // daemon: URL to POST pool alerts to as JSON
+	OnCompleteWebhook string  `yaml:"on-complete-webhook"` // process-image, daemon: URL to POST each finished run to as JSON
+	OnCompleteExec    string  `yaml:"on-complete-exec"`    // process-image, daemon: shell command run with each finished run as JSON on stdin
+	Filesystem        string  `yaml:"filesystem"`          // Filesystem for new thin devices (ext4, xfs)
+	MountOptions      string  `yaml:"mount-options"`       // Options for mounting new thin devices during extraction
+	EnableJournal     bool    `yaml:"enable-journal"`      // Keep the ext4 journal on new thin devices
+	BestEffortExtract bool    `yaml:"best-effort-extract"` // Skip archive entries that fail to extract instead of failing the image
+	StripComponents   int     `yaml:"strip-components"`    // Leading path components stripped from archive entries
+	RootfsSubdir      bool    `yaml:"rootfs-subdir"`       // Extract images into rootfs/ on the device instead of its root
+	MaxFiles          int     `yaml:"max-files"`           // Most archive entries extracted per image
+	MaxTotalSize      int64   `yaml:"max-total-size"`      // Most bytes extracted per image
+	WriteConcurrency  int     `yaml:"write-concurrency"`   // Regular files written at once during extraction
+	MaxDeviceSize     int64   `yaml:"max-device-size"`     // Largest thin device size in bytes
+	DeviceSize        int64   `yaml:"device-size"`         // process-image: thin device size in bytes, overriding the estimate
+	SizeOverhead      float64 `yaml:"size-overhead"`       // Device size as a multiple of the tarball's content size (0 = fixed default)
+	PoolDataSize      int64   `yaml:"data-size"`           // Pool data file size in bytes (setup-pool)
+	PoolMetaSize      int64   `yaml:"meta-size"`           // Pool metadata file size in bytes (setup-pool)
+	PoolBlockSize     int     `yaml:"block-size"`          // Pool data block size in 512-byte sectors (setup-pool)
+	PoolAutoSize      bool    `yaml:"auto-size"`           // Size a new pool from the bucket contents (setup-pool)
+
+	// System Health Thresholds (pre-flight checks before devicemapper operations)
+	MaxLoad       float64 `yaml:"max-load"`     // Load average above which a warning is logged
+	LoadPerCPU    bool    `yaml:"load-per-cpu"` // Scale --max-load by the CPU count
+	MaxIOWait     float64 `yaml:"max-iowait"`   // I/O wait percentage above which operations are refused
+	MinMemPercent float64 `yaml:"min-mem-pct"`  // Available memory percentage below which operations are refused
+	MaxPressure   float64 `yaml:"max-pressure"` // PSI io/memory "full avg10" percentage above which operations are refused
 
 	// Storage Configuration
-	LocalDir string
+	LocalDir     string `yaml:"local-dir"`
+	ShardStorage bool   `yaml:"shard-storage"` // Store tars as LocalDir/ab/cd/<imageID>.tar (see download.LocalPath)
 
 	// Queue Configuration
-	DownloadQueueSize int
-	UnpackQueueSize   int
+	DownloadQueueSize int `yaml:"download-queue"`
+	UnpackQueueSize   int `yaml:"unpack-queue"`
 
 	// Timeout Configuration
-	DownloadTimeout time.Duration
-	UnpackTimeout   time.Duration
+	DownloadTimeout  time.Duration `yaml:"download-timeout"`   // S3 download transition
+	UnpackTimeout    time.Duration `yaml:"unpack-timeout"`     // Each layer extraction attempt
+	VerifyTimeout    time.Duration `yaml:"verify-timeout"`     // Filesystem layout verification
+	ShutdownTimeout  time.Duration `yaml:"shutdown-timeout"`   // daemon: how long to drain in-flight runs on SIGTERM
+	LockWait         time.Duration `yaml:"lock-wait"`          // How long to wait for another process's manager lock
+	PoolFullCooldown time.Duration `yaml:"pool-full-cooldown"` // How long devicemapper operations pause after the pool is found full
+
+	// Retry Configuration: how many times a failing transition is retried
+	// before the run aborts. 0 disables retries.
+	MaxDownloadRetries int `yaml:"max-download-retries"` // S3 download transition
+	MaxUnpackRetries   int `yaml:"max-unpack-retries"`   // Layer extraction transition
+	MaxActivateRetries int `yaml:"max-activate-retries"` // Snapshot creation transition
+
+	// ParanoidVerify re-hashes every tarball during validation and on the
+	// already-downloaded fast path instead of trusting cached checksums.
+	ParanoidVerify bool `yaml:"paranoid-verify"`
+
+	// StreamExtract extracts new images while they download, in one pass,
+	// instead of downloading them in full before unpacking. Images the
+	// database already knows about take the download phase as usual.
+	StreamExtract bool `yaml:"stream-extract"`
+
+	// ChecksumAlgo is the digest algorithm for new downloads: sha256,
+	// sha512 or blake3. Images already recorded keep their own.
+	ChecksumAlgo string `yaml:"checksum-algo"`
+
+	// Unquarantine releases images quarantined after failing security
+	// validation so they are downloaded and checked again.
+	Unquarantine bool `yaml:"unquarantine"`
 
 	// Logging
-	LogLevel string
+	LogLevel  string `yaml:"log-level"`
+	LogFormat string `yaml:"log-format"` // text or json; empty picks the command's default (see defaultLogFormat)
+
+	// API Configuration
+	Listen      string `yaml:"listen"`       // Daemon HTTP API listen address (empty disables the API)
+	MetricsAddr string `yaml:"metrics-addr"` // Separate listen address for /metrics (empty serves it on the API)
 
 	// Command-specific flags
-	S3Key      string
-	ImageID    string
-	AutoDerive bool // Auto-derive image ID from S3 key
+	S3Key       string `yaml:"s3-key"`
+	ImageID     string `yaml:"image-id"`
+	AutoDerive  bool   `yaml:"auto-derive"` // Auto-derive image ID from S3 key
+	SnapshotID  string `yaml:"snapshot-id"`
+	MountPoint  string `yaml:"mount"`        // inspect-snapshot mount point (default: a temporary directory)
+	DryRun      bool   `yaml:"dry-run"`      // Report what would change without touching devices or the database
+	Force       bool   `yaml:"force"`        // Allow remove-image and fix-orphan to deactivate and delete devices, grow-pool to grow the pool, reap-snapshots to deactivate, and unlock to remove a lock that may be held
+	KeepTar     bool   `yaml:"keep-tar"`     // Keep the downloaded tar when removing an image
+	KeysFile    string `yaml:"keys-file"`    // Newline-delimited S3 keys for process-batch ("-" for stdin)
+	Pipeline    bool   `yaml:"pipeline"`     // process-batch: download ahead of the unpack/activate lane
+	Plan        bool   `yaml:"plan"`         // process-image: print what would happen without running the FSMs
+	Tag         string `yaml:"tag"`          // process-image: tag to point at the image once it is activated
+	KeepMounted bool   `yaml:"keep-mounted"` // process-image: leave the unpacked device mounted and skip activate (debugging only)
+	JSON        bool   `yaml:"json"`         // healthcheck: print the report as JSON
+	RawBytes    bool   `yaml:"bytes"`        // list-images, list-snapshots: print sizes as exact byte counts
+	Limit       int    `yaml:"limit"`        // dm-history: most recent operations to print (0 for all)
+	Out         string `yaml:"out"`          // support-bundle: file to write the bundle to (default stdout)
+
+	// list-images watch mode
+	Watch         bool          `yaml:"watch"`    // Re-render the list every WatchInterval until interrupted
+	WatchInterval time.Duration `yaml:"interval"` // Time between refreshes
+
+	// delete-device flags
+	DeviceName string `yaml:"device-name"` // Thin device to remove
+	DeviceID   string `yaml:"device-id"`   // Pool device ID (read from the active device if omitted)
+
+	// reap-snapshots flags
+	Idle time.Duration `yaml:"idle"` // Deactivate snapshots not accessed for this long
+
+	// grow-pool flags
+	AddData int64 `yaml:"add-data"` // Bytes to add to the pool's data file
+	AddMeta int64 `yaml:"add-meta"` // Bytes to add to the pool's metadata file
+
+	// migrate flags
+	Status    bool `yaml:"status"`         // List migrations without applying them
+	SchemaVer bool `yaml:"schema-version"` // Print the schema version without applying migrations
 
 	// TUI flags
-	Quiet  bool // Suppress progress output
-	Inline bool // Run TUI inline (no alt-screen) for monitor command
+	Quiet         bool   `yaml:"quiet"`          // Suppress progress output
+	Inline        bool   `yaml:"inline"`         // Run TUI inline (no alt-screen) for monitor command
+	NoConfirm     bool   `yaml:"no-confirm"`     // Process images from the monitor, or force unlock, without a confirmation prompt
+	ShowCompleted bool   `yaml:"show-completed"` // List completed FSM runs in the monitor from the start
+	DebugLog      string `yaml:"debug-log"`      // Append logs to this file while a TUI runs, instead of discarding them
 }
 
 // DefaultConfig returns the default configuration.
@@ -81,19 +189,56 @@ func DefaultConfig() Config {
 	return Config{
 		S3Bucket:          "flyio-container-images",
 		S3Region:          "us-east-1",
+		S3Concurrency:     s3.DefaultConcurrency,
+		S3Prefix:          "images/",
 		DBPath:            "/var/lib/flyio/images.db",
 		FSMDBPath:         "/var/lib/flyio/fsm",
 		PoolName:          "pool",
 		MountRoot:         "/mnt/flyio",
+		PoolThreshold:     devicemapper.PoolCapacityThreshold,
+		PoolMetaThreshold: devicemapper.PoolCapacityThreshold,
+		PoolWarnThreshold: safeguards.DefaultPoolWarnPercent,
+		PoolFullCooldown:  devicemapper.DefaultPoolFullCooldown,
+		Filesystem:        string(devicemapper.FilesystemExt4),
+		MountOptions:      devicemapper.DefaultMountOptions,
+		MaxDeviceSize:     devicemapper.DefaultMaxDeviceSize,
+		SizeOverhead:      unpack.DefaultSizeOverhead,
+		MaxFiles:          extraction.DefaultMaxFiles,
+		MaxTotalSize:      extraction.DefaultMaxTotalSize,
+		WriteConcurrency:  1,
+		MaxLoad:           safeguards.DefaultMaxLoad,
+		LoadPerCPU:        true,
+		MaxIOWait:         safeguards.DefaultMaxIOWait,
+		MinMemPercent:     safeguards.DefaultMinMemPercent,
+		MaxPressure:       safeguards.DefaultMaxPressure,
+		PoolDataSize:      devicemapper.DefaultPoolDataSize,
+		PoolMetaSize:      devicemapper.DefaultPoolMetaSize,
+		PoolBlockSize:     devicemapper.DefaultPoolBlockSize,
 		LocalDir:          "/var/lib/flyio/images",
 		DownloadQueueSize: 5,
 		UnpackQueueSize:   1, // serialize devicemapper-heavy unpack operations
-		DownloadTimeout:   5 * time.Minute,
-		UnpackTimeout:     30 * time.Minute,
-		LogLevel:          "info",
+		DownloadTimeout:   download.DefaultDownloadTimeout,
+		UnpackTimeout:     unpack.DefaultExtractTimeout,
+		VerifyTimeout:     unpack.DefaultVerifyTimeout,
+		ShutdownTimeout:   DefaultShutdownTimeout,
+
+		MaxDownloadRetries: download.MaxRetriesDownload,
+		MaxUnpackRetries:   unpack.MaxRetriesExtractLayers,
+		MaxActivateRetries: activate.MaxRetriesCreateSnapshot,
+		ChecksumAlgo:       string(checksum.Default),
+		LogLevel:           "info",
+		Listen:             ":8080",
+		AutoDerive:         true,
+		WatchInterval:      2 * time.Second,
+		Limit:              50,
+		Idle:               DefaultReapIdle,
 	}
 }
 
+// Version is the build version, set with -ldflags "-X main.Version=$VERSION".
+// It is recorded in the manager lock file.
+var Version = "dev"
+
 var (
 	// Global logger
 	log = logrus.New()
@@ -112,6 +257,22 @@ var (
 	gcCmd         = flag.NewFlagSet("gc", flag.ExitOnError)
 	monitorCmd    = flag.NewFlagSet("monitor", flag.ExitOnError)
 	setupPoolCmd  = flag.NewFlagSet("setup-pool", flag.ExitOnError)
+	growPoolCmd   = flag.NewFlagSet("grow-pool", flag.ExitOnError)
+	deactivateCmd = flag.NewFlagSet("deactivate-snapshot", flag.ExitOnError)
+	reapCmd       = flag.NewFlagSet("reap-snapshots", flag.ExitOnError)
+	deleteDevCmd  = flag.NewFlagSet("delete-device", flag.ExitOnError)
+	fixOrphanCmd  = flag.NewFlagSet("fix-orphan", flag.ExitOnError)
+	verifyCmd     = flag.NewFlagSet("verify-image", flag.ExitOnError)
+	poolCheckCmd  = flag.NewFlagSet("pool-check", flag.ExitOnError)
+	removeCmd     = flag.NewFlagSet("remove-image", flag.ExitOnError)
+	batchCmd      = flag.NewFlagSet("process-batch", flag.ExitOnError)
+	recoverCmd    = flag.NewFlagSet("recover", flag.ExitOnError)
+	inspectCmd    = flag.NewFlagSet("inspect-snapshot", flag.ExitOnError)
+	healthCmd     = flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	migrateCmd    = flag.NewFlagSet("migrate", flag.ExitOnError)
+	dmHistoryCmd  = flag.NewFlagSet("dm-history", flag.ExitOnError)
+	supportCmd    = flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	unlockCmd     = flag.NewFlagSet("unlock", flag.ExitOnError)
 )
 
 func main() {
@@ -120,8 +281,16 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Parse global flags
-	config := DefaultConfig()
+	// Parse global flags. A --config file, if given, replaces the defaults;
+	// explicit flags still override it.
+	config, err := configFromArgs(os.Args[2:])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if config.LogFormat == "" {
+		config.LogFormat = defaultLogFormat(os.Args[1])
+	}
 
 	switch os.Args[1] {
 	case "process-image":
@@ -129,6 +298,11 @@ func main() {
 		if err := runProcessImage(config); err != nil {
 			log.WithError(err).Fatal("failed to process image")
 		}
+	case "process-batch":
+		parseProcessBatchFlags(&config, batchCmd, os.Args[2:])
+		if err := runProcessBatch(config); err != nil {
+			log.WithError(err).Fatal("batch processing failed")
+		}
 	case "list-images":
 		parseListImagesFlags(&config, listImagesCmd, os.Args[2:])
 		if err := runListImages(config); err != nil {
@@ -159,6 +333,87 @@ func main() {
 		if err := runSetupPool(config); err != nil {
 			log.WithError(err).Fatal("pool setup failed")
 		}
+	case "grow-pool":
+		parseGrowPoolFlags(&config, growPoolCmd, os.Args[2:])
+		if err := runGrowPool(config); err != nil {
+			log.WithError(err).Fatal("pool growth failed")
+		}
+	case "deactivate-snapshot":
+		parseDeactivateSnapshotFlags(&config, deactivateCmd, os.Args[2:])
+		if err := runDeactivateSnapshot(config); err != nil {
+			log.WithError(err).Fatal("failed to deactivate snapshot")
+		}
+	case "reap-snapshots":
+		parseReapSnapshotsFlags(&config, reapCmd, os.Args[2:])
+		if err := runReapSnapshots(config); err != nil {
+			log.WithError(err).Fatal("failed to reap idle snapshots")
+		}
+	case "delete-device":
+		parseDeleteDeviceFlags(&config, deleteDevCmd, os.Args[2:])
+		if err := runDeleteDevice(config); err != nil {
+			log.WithError(err).Fatal("failed to delete device")
+		}
+	case "fix-orphan":
+		parseFixOrphanFlags(&config, fixOrphanCmd, os.Args[2:])
+		if err := runFixOrphan(config); err != nil {
+			log.WithError(err).Fatal("failed to fix orphaned device")
+		}
+	case "verify-image":
+		parseVerifyImageFlags(&config, verifyCmd, os.Args[2:])
+		code, err := runVerifyImage(config)
+		if err != nil {
+			log.WithError(err).Fatal("failed to verify image")
+		}
+		os.Exit(code)
+	case "pool-check":
+		parsePoolCheckFlags(&config, poolCheckCmd, os.Args[2:])
+		code, err := runPoolCheck(config)
+		if err != nil {
+			log.WithError(err).Fatal("pool check failed")
+		}
+		os.Exit(code)
+	case "remove-image":
+		parseRemoveImageFlags(&config, removeCmd, os.Args[2:])
+		if err := runRemoveImage(config); err != nil {
+			log.WithError(err).Fatal("failed to remove image")
+		}
+	case "inspect-snapshot":
+		parseInspectSnapshotFlags(&config, inspectCmd, os.Args[2:])
+		if err := runInspectSnapshot(config); err != nil {
+			log.WithError(err).Fatal("failed to inspect snapshot")
+		}
+	case "recover":
+		parseRecoverFlags(&config, recoverCmd, os.Args[2:])
+		if err := runRecover(config); err != nil {
+			log.WithError(err).Fatal("recovery failed")
+		}
+	case "healthcheck":
+		parseHealthcheckFlags(&config, healthCmd, os.Args[2:])
+		code, err := runHealthcheck(config)
+		if err != nil {
+			log.WithError(err).Fatal("health check failed")
+		}
+		os.Exit(code)
+	case "migrate":
+		parseMigrateFlags(&config, migrateCmd, os.Args[2:])
+		if err := runMigrate(config); err != nil {
+			log.WithError(err).Fatal("migration failed")
+		}
+	case "dm-history":
+		parseDMHistoryFlags(&config, dmHistoryCmd, os.Args[2:])
+		if err := runDMHistory(config); err != nil {
+			log.WithError(err).Fatal("failed to read devicemapper history")
+		}
+	case "support-bundle":
+		parseSupportBundleFlags(&config, supportCmd, os.Args[2:])
+		if err := runSupportBundle(config); err != nil {
+			log.WithError(err).Fatal("failed to write support bundle")
+		}
+	case "unlock":
+		parseUnlockFlags(&config, unlockCmd, os.Args[2:])
+		if err := runUnlock(config); err != nil {
+			log.WithError(err).Fatal("failed to remove manager lock")
+		}
 	default:
 		fmt.Printf("Unknown command: %s\n", os.Args[1])
 		printUsage()
@@ -173,31 +428,96 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("Commands:")
 	fmt.Println("  process-image     Process a container image (download → unpack → activate)")
+	fmt.Println("  process-batch     Process S3 keys from a file or stdin, one at a time")
 	fmt.Println("  list-images       List downloaded images")
 	fmt.Println("  list-snapshots    List active snapshots")
-	fmt.Println("  daemon            Run as a daemon (future: API server)")
+	fmt.Println("  deactivate-snapshot  Remove an active snapshot device and mark it inactive")
+	fmt.Println("  reap-snapshots    Deactivate snapshots not accessed within --idle (dry run without --force)")
+	fmt.Println("  delete-device     Safely remove an unreferenced thin device from the pool")
+	fmt.Println("  fix-orphan        Remove an orphaned device an unpack aborted on so the image can be reprocessed")
+	fmt.Println("  verify-image      Run a read-only fsck on an image's unpacked device")
+	fmt.Println("  pool-check        Run thin_check on a metadata snapshot of the live pool")
+	fmt.Println("  inspect-snapshot  Mount a snapshot read-only and list its top-level directory")
+	fmt.Println("  remove-image      Delete an image with its snapshots, device and tar")
+	fmt.Println("  daemon            Run as a daemon serving the HTTP API")
 	fmt.Println("  gc                Garbage collect orphaned devices")
 	fmt.Println("  monitor           Interactive TUI dashboard for live FSM tracking")
 	fmt.Println("  setup-pool        Setup or recreate the devicemapper thin-pool")
+	fmt.Println("  grow-pool         Add data or metadata space to the thin-pool while it stays online")
+	fmt.Println("  recover           Recreate the pool and reconcile the database after a reboot")
+	fmt.Println("  healthcheck       Exit 0/1/2 for a healthy, unhealthy or stopped daemon (for probes)")
+	fmt.Println("  migrate           Apply pending database schema migrations, or show their status")
+	fmt.Println("  dm-history        Show the audit log of devicemapper operations")
+	fmt.Println("  support-bundle    Write the database, pool status, lock and host state as JSON for an issue")
+	fmt.Println("  unlock            Show who holds the manager lock and remove it if the holder is gone")
 	fmt.Println()
 	fmt.Println("Run 'flyio-image-manager <command> --help' for more information on a command.")
 }
 
-// parseProcessImageFlags parses flags for the process-image command.
-func parseProcessImageFlags(cfg *Config, fs *flag.FlagSet, args []string) {
-	fs.StringVar(&cfg.S3Key, "s3-key", "", "S3 object key (required)")
-	fs.StringVar(&cfg.ImageID, "image-id", "", "Image identifier (auto-derived from s3-key if omitted)")
-	fs.BoolVar(&cfg.AutoDerive, "auto-derive", true, "Auto-derive image ID from S3 key")
+// addPipelineFlags registers the flags shared by the commands that run images
+// through the download, unpack and activate pipeline: process-image,
+// process-batch and daemon.
+func addPipelineFlags(fs *flag.FlagSet, cfg *Config) {
 	fs.StringVar(&cfg.S3Bucket, "bucket", cfg.S3Bucket, "S3 bucket name")
-	fs.StringVar(&cfg.S3Region, "region", cfg.S3Region, "S3 region")
+	fs.StringVar(&cfg.S3Region, "region", cfg.S3Region, "S3 region (\"auto\" to look up the bucket's region)")
+	fs.IntVar(&cfg.S3Concurrency, "s3-concurrency", cfg.S3Concurrency, "Parallel range requests for large S3 downloads")
 	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
 	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
 	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
 	fs.StringVar(&cfg.MountRoot, "mount-root", cfg.MountRoot, "Mount root directory")
+	fs.Float64Var(&cfg.PoolThreshold, "pool-threshold", cfg.PoolThreshold, "Pool usage percentage (1-99) above which operations are refused")
+	fs.Float64Var(&cfg.PoolMetaThreshold, "pool-meta-threshold", cfg.PoolMetaThreshold, "Pool metadata usage percentage (1-99) above which operations are refused")
+	fs.DurationVar(&cfg.PoolFullCooldown, "pool-full-cooldown", cfg.PoolFullCooldown, "Pause devicemapper operations this long after the pool is found full, unless a pool status shows space freed sooner (0 disables)")
+	fs.StringVar(&cfg.Filesystem, "filesystem", cfg.Filesystem, "Filesystem for new thin devices (ext4, xfs)")
+	fs.StringVar(&cfg.MountOptions, "mount-options", cfg.MountOptions, "Options passed to mount -o for extraction (e.g. discard,errors=remount-ro)")
+	fs.BoolVar(&cfg.EnableJournal, "enable-journal", cfg.EnableJournal, "Keep the ext4 journal on new thin devices (slower, adds settle delays)")
+	fs.BoolVar(&cfg.BestEffortExtract, "best-effort-extract", cfg.BestEffortExtract, "Skip archive entries that fail to extract instead of failing the image (security violations still fail)")
+	fs.IntVar(&cfg.StripComponents, "strip-components", cfg.StripComponents, "Strip this many leading path components from archive entries (e.g. 1 for tarballs wrapped in rootfs/)")
+	fs.BoolVar(&cfg.RootfsSubdir, "rootfs-subdir", cfg.RootfsSubdir, "Extract images into a rootfs/ subdirectory of the device instead of its root")
+	fs.IntVar(&cfg.MaxFiles, "max-files", cfg.MaxFiles, "Most archive entries extracted per image")
+	fs.Int64Var(&cfg.MaxTotalSize, "max-total-size", cfg.MaxTotalSize, "Most bytes extracted per image")
+	fs.IntVar(&cfg.WriteConcurrency, "write-concurrency", cfg.WriteConcurrency, "Regular files written at once during extraction (1 writes them in archive order)")
+	fs.Int64Var(&cfg.MaxDeviceSize, "max-device-size", cfg.MaxDeviceSize, "Largest thin device size in bytes")
+	fs.Float64Var(&cfg.SizeOverhead, "size-overhead", cfg.SizeOverhead, "Size new thin devices at this multiple of the tarball's content size (0 uses a fixed 4GB)")
+	fs.Float64Var(&cfg.MaxLoad, "max-load", cfg.MaxLoad, "Load average above which a warning is logged before devicemapper operations")
+	fs.BoolVar(&cfg.LoadPerCPU, "load-per-cpu", cfg.LoadPerCPU, "Treat --max-load as per CPU")
+	fs.Float64Var(&cfg.MaxIOWait, "max-iowait", cfg.MaxIOWait, "I/O wait percentage above which devicemapper operations are refused")
+	fs.Float64Var(&cfg.MinMemPercent, "min-mem-pct", cfg.MinMemPercent, "Available memory percentage below which devicemapper operations are refused")
+	fs.Float64Var(&cfg.MaxPressure, "max-pressure", cfg.MaxPressure, "PSI io/memory full avg10 percentage above which devicemapper operations are refused (replaces --max-iowait and --min-mem-pct when /proc/pressure exists)")
 	fs.StringVar(&cfg.LocalDir, "local-dir", cfg.LocalDir, "Local storage directory")
+	fs.BoolVar(&cfg.ShardStorage, "shard-storage", cfg.ShardStorage, "Store downloads in LocalDir/ab/cd/<imageID>.tar subdirectories")
+	fs.DurationVar(&cfg.DownloadTimeout, "download-timeout", cfg.DownloadTimeout, "Timeout for the S3 download")
+	fs.BoolVar(&cfg.ParanoidVerify, "paranoid-verify", cfg.ParanoidVerify, "Re-hash downloaded and cached tarballs instead of trusting the checksum taken during download")
+	fs.BoolVar(&cfg.StreamExtract, "stream-extract", cfg.StreamExtract, "Extract new images while they download, checking the checksum on the same stream")
+	fs.StringVar(&cfg.ChecksumAlgo, "checksum-algo", cfg.ChecksumAlgo, "Checksum algorithm for new downloads (sha256, sha512 or blake3)")
+	fs.DurationVar(&cfg.UnpackTimeout, "unpack-timeout", cfg.UnpackTimeout, "Timeout for each layer extraction attempt")
+	fs.DurationVar(&cfg.VerifyTimeout, "verify-timeout", cfg.VerifyTimeout, "Timeout for filesystem layout verification")
+	fs.IntVar(&cfg.MaxDownloadRetries, "max-download-retries", cfg.MaxDownloadRetries, "Retries for a failed S3 download before giving up (0 to fail fast)")
+	fs.IntVar(&cfg.MaxUnpackRetries, "max-unpack-retries", cfg.MaxUnpackRetries, "Retries for a failed layer extraction before giving up (0 to fail fast)")
+	fs.IntVar(&cfg.MaxActivateRetries, "max-activate-retries", cfg.MaxActivateRetries, "Retries for a failed snapshot creation before giving up (0 to fail fast)")
+}
+
+// parseProcessImageFlags parses flags for the process-image command.
+func parseProcessImageFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.S3Key, "s3-key", cfg.S3Key, "S3 object key (required)")
+	fs.StringVar(&cfg.ImageID, "image-id", cfg.ImageID, "Image identifier (auto-derived from s3-key if omitted)")
+	fs.BoolVar(&cfg.AutoDerive, "auto-derive", cfg.AutoDerive, "Auto-derive image ID from S3 key")
+	fs.BoolVar(&cfg.Plan, "plan", cfg.Plan, "Print the derived IDs and which phases would run, without touching devicemapper")
+	fs.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "Download and validate the image and report the device it would get, without touching devicemapper")
+	fs.BoolVar(&cfg.KeepMounted, "keep-mounted", cfg.KeepMounted, "Debugging only: leave the unpacked device mounted under --mount-root and skip activate")
+	fs.StringVar(&cfg.Tag, "tag", cfg.Tag, "Tag the image (e.g. python:3.12-prod) on completion, moving the tag from any image that has it")
+	fs.StringVar(&cfg.OnCompleteWebhook, "on-complete-webhook", cfg.OnCompleteWebhook, "URL to POST a JSON summary to when an image finishes processing, successfully or not")
+	fs.StringVar(&cfg.OnCompleteExec, "on-complete-exec", cfg.OnCompleteExec, "Shell command to run with a JSON summary on stdin when an image finishes processing")
+	addPipelineFlags(fs, cfg)
+	fs.Int64Var(&cfg.DeviceSize, "device-size", cfg.DeviceSize, "Thin device size in bytes for this image (overrides the estimate)")
+	fs.BoolVar(&cfg.Unquarantine, "unquarantine", cfg.Unquarantine, "Process images quarantined after failing security validation again")
 	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level (debug, info, warn, error)")
-	fs.BoolVar(&cfg.Quiet, "quiet", false, "Suppress progress output (for scripting)")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.BoolVar(&cfg.Quiet, "quiet", cfg.Quiet, "Suppress progress output (for scripting)")
+	fs.StringVar(&cfg.DebugLog, "debug-log", cfg.DebugLog, "Append logs to this file while the TUI runs, instead of discarding them")
 
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
 	fs.Parse(args)
 
 	if cfg.S3Key == "" {
@@ -216,34 +536,147 @@ func parseProcessImageFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 		fs.Usage()
 		os.Exit(1)
 	}
+
+	if err := normalizeChecksumAlgo(cfg); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.Tag != "" {
+		if err := database.ValidateTag(cfg.Tag); err != nil {
+			fmt.Printf("Error: --tag: %v\n", err)
+			os.Exit(1)
+		}
+		if cfg.KeepMounted {
+			fmt.Println("Error: --tag is applied on activation, which --keep-mounted skips")
+			os.Exit(1)
+		}
+	}
+}
+
+// parseProcessBatchFlags parses flags for the process-batch command.
+func parseProcessBatchFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.KeysFile, "keys-file", cfg.KeysFile, "File of newline-delimited S3 keys, or - for stdin (required)")
+	fs.BoolVar(&cfg.Pipeline, "pipeline", cfg.Pipeline, "Download up to --download-queue images at once while unpacking one at a time")
+	fs.IntVar(&cfg.DownloadQueueSize, "download-queue", cfg.DownloadQueueSize, "Max concurrent downloads with --pipeline")
+	addPipelineFlags(fs, cfg)
+	fs.BoolVar(&cfg.Unquarantine, "unquarantine", cfg.Unquarantine, "Process images quarantined after failing security validation again")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level (debug, info, warn, error)")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if cfg.KeysFile == "" {
+		fmt.Println("Error: --keys-file is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := normalizeChecksumAlgo(cfg); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 }
 
 // parseListImagesFlags parses flags for the list-images command.
 func parseListImagesFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.BoolVar(&cfg.RawBytes, "bytes", cfg.RawBytes, "Print sizes as exact byte counts instead of KB/MB/GB")
+	fs.BoolVar(&cfg.Watch, "watch", cfg.Watch, "Clear the screen and refresh the list every --interval until interrupted")
+	fs.DurationVar(&cfg.WatchInterval, "interval", cfg.WatchInterval, "Refresh interval for --watch")
 	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
 	fs.Parse(args)
 }
 
 // parseListSnapshotsFlags parses flags for the list-snapshots command.
 func parseListSnapshotsFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.BoolVar(&cfg.RawBytes, "bytes", cfg.RawBytes, "Print sizes as exact byte counts instead of KB/MB/GB")
 	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
 	fs.Parse(args)
 }
 
-// parseDaemonFlags parses flags for the daemon command.
-func parseDaemonFlags(cfg *Config, fs *flag.FlagSet, args []string) {
-	fs.StringVar(&cfg.S3Bucket, "bucket", cfg.S3Bucket, "S3 bucket name")
-	fs.StringVar(&cfg.S3Region, "region", cfg.S3Region, "S3 region")
+// parseDMHistoryFlags parses flags for the dm-history command.
+func parseDMHistoryFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
-	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.IntVar(&cfg.Limit, "limit", cfg.Limit, "Print the most recent N operations (0 for all)")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseSupportBundleFlags parses flags for the support-bundle command.
+func parseSupportBundleFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.Out, "out", cfg.Out, "Write the bundle to this file instead of stdout")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory (for the manager lock file)")
 	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
-	fs.StringVar(&cfg.MountRoot, "mount-root", cfg.MountRoot, "Mount root directory")
-	fs.StringVar(&cfg.LocalDir, "local-dir", cfg.LocalDir, "Local storage directory")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseUnlockFlags parses flags for the unlock command.
+func parseUnlockFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory (holds the manager lock)")
+	fs.BoolVar(&cfg.Force, "force", cfg.Force, "Remove the lock even if its holder may be running or devicemapper processes are stuck in D state (DANGEROUS)")
+	fs.BoolVar(&cfg.NoConfirm, "no-confirm", cfg.NoConfirm, "Remove the lock with --force without asking for confirmation")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseDaemonFlags parses flags for the daemon command.
+func parseDaemonFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	addPipelineFlags(fs, cfg)
+	fs.Float64Var(&cfg.PoolWarnThreshold, "pool-warn-threshold", cfg.PoolWarnThreshold, "Pool usage percentage at which to log a warning and send --alert-webhook (below --pool-threshold)")
+	fs.StringVar(&cfg.AlertWebhook, "alert-webhook", cfg.AlertWebhook, "URL to POST a JSON alert to when pool usage crosses --pool-warn-threshold")
+	fs.StringVar(&cfg.OnCompleteWebhook, "on-complete-webhook", cfg.OnCompleteWebhook, "URL to POST a JSON summary to when an image finishes processing, successfully or not")
+	fs.StringVar(&cfg.OnCompleteExec, "on-complete-exec", cfg.OnCompleteExec, "Shell command to run with a JSON summary on stdin when an image finishes processing")
 	fs.IntVar(&cfg.DownloadQueueSize, "download-queue", cfg.DownloadQueueSize, "Download queue size")
 	fs.IntVar(&cfg.UnpackQueueSize, "unpack-queue", cfg.UnpackQueueSize, "Unpack queue size")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "How long to wait on SIGINT/SIGTERM for in-flight runs to finish before cancelling them")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "HTTP API listen address (empty to disable)")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "Serve /metrics on a separate address (default: on the API listener)")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseHealthcheckFlags parses flags for the healthcheck command.
+func parseHealthcheckFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory (holds the manager lock)")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.Float64Var(&cfg.MaxLoad, "max-load", cfg.MaxLoad, "Load average above which a warning is logged before devicemapper operations")
+	fs.BoolVar(&cfg.LoadPerCPU, "load-per-cpu", cfg.LoadPerCPU, "Treat --max-load as per CPU")
+	fs.Float64Var(&cfg.MaxIOWait, "max-iowait", cfg.MaxIOWait, "I/O wait percentage above which devicemapper operations are refused")
+	fs.Float64Var(&cfg.MinMemPercent, "min-mem-pct", cfg.MinMemPercent, "Available memory percentage below which devicemapper operations are refused")
+	fs.Float64Var(&cfg.MaxPressure, "max-pressure", cfg.MaxPressure, "PSI io/memory full avg10 percentage above which devicemapper operations are refused (replaces --max-iowait and --min-mem-pct when /proc/pressure exists)")
+	fs.BoolVar(&cfg.JSON, "json", cfg.JSON, "Print the result and each check as JSON")
 	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseMigrateFlags parses flags for the migrate command.
+func parseMigrateFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.BoolVar(&cfg.Status, "status", cfg.Status, "List migrations and whether each is applied, without applying any")
+	fs.BoolVar(&cfg.SchemaVer, "schema-version", cfg.SchemaVer, "Print the database's schema version and exit, without applying migrations")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
 	fs.Parse(args)
 }
 
@@ -251,8 +684,161 @@ func parseDaemonFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 func parseGCFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
 	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LocalDir, "local-dir", cfg.LocalDir, "Local storage directory (for --reclaim-tars)")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseDeactivateSnapshotFlags parses flags for the deactivate-snapshot command.
+func parseDeactivateSnapshotFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.SnapshotID, "snapshot-id", cfg.SnapshotID, "Snapshot to deactivate")
+	fs.StringVar(&cfg.ImageID, "image-id", cfg.ImageID, "Deactivate all active snapshots of this image")
+	fs.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "Show what would be deactivated without making changes")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if (cfg.SnapshotID == "") == (cfg.ImageID == "") {
+		fmt.Println("Error: exactly one of --snapshot-id or --image-id is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// parseReapSnapshotsFlags parses flags for the reap-snapshots command.
+func parseReapSnapshotsFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.DurationVar(&cfg.Idle, "idle", cfg.Idle, "Deactivate snapshots not accessed for this long")
+	fs.BoolVar(&cfg.Force, "force", cfg.Force, "Deactivate the idle snapshots (otherwise only list them)")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseDeleteDeviceFlags parses flags for the delete-device command.
+func parseDeleteDeviceFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.DeviceName, "device-name", cfg.DeviceName, "Thin device to delete (required)")
+	fs.StringVar(&cfg.DeviceID, "device-id", cfg.DeviceID, "Pool device ID (read from the active device if omitted)")
+	fs.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "Show what would be deleted without making changes")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if cfg.DeviceName == "" {
+		fmt.Println("Error: --device-name is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// parseFixOrphanFlags parses flags for the fix-orphan command.
+func parseFixOrphanFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.DeviceName, "device-name", cfg.DeviceName, "Orphaned device named in the unpack error (required)")
+	fs.StringVar(&cfg.DeviceID, "device-id", cfg.DeviceID, "Pool device ID (read from the active device if omitted)")
+	fs.BoolVar(&cfg.Force, "force", cfg.Force, "Delete the device (otherwise only report what would be deleted)")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
 	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
 	fs.Parse(args)
+
+	if cfg.DeviceName == "" {
+		fmt.Println("Error: --device-name is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// parseVerifyImageFlags parses flags for the verify-image command.
+func parseVerifyImageFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.ImageID, "image-id", cfg.ImageID, "Image whose unpacked device to check (required)")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if cfg.ImageID == "" {
+		fmt.Println("Error: --image-id is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// parsePoolCheckFlags parses flags for the pool-check command.
+func parsePoolCheckFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseInspectSnapshotFlags parses flags for the inspect-snapshot command.
+func parseInspectSnapshotFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.SnapshotID, "snapshot-id", cfg.SnapshotID, "Snapshot to inspect (required)")
+	fs.StringVar(&cfg.MountPoint, "mount", cfg.MountPoint, "Mount point (default: a temporary directory)")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if cfg.SnapshotID == "" {
+		fmt.Println("Error: --snapshot-id is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// parseRemoveImageFlags parses flags for the remove-image command.
+func parseRemoveImageFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.StringVar(&cfg.ImageID, "image-id", cfg.ImageID, "Image to remove (required)")
+	fs.BoolVar(&cfg.Force, "force", cfg.Force, "Deactivate and delete devices (otherwise only database rows are removed)")
+	fs.BoolVar(&cfg.KeepTar, "keep-tar", cfg.KeepTar, "Keep the downloaded tar")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LocalDir, "local-dir", cfg.LocalDir, "Local storage directory")
+	fs.BoolVar(&cfg.ShardStorage, "shard-storage", cfg.ShardStorage, "Store downloads in LocalDir/ab/cd/<imageID>.tar subdirectories")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if cfg.ImageID == "" {
+		fmt.Println("Error: --image-id is required")
+		fs.Usage()
+		os.Exit(1)
+	}
 }
 
 // parseMonitorFlags parses flags for the monitor command.
@@ -261,7 +847,28 @@ func parseMonitorFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
 	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
 	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
-	fs.BoolVar(&cfg.Inline, "inline", false, "Run inline (no alt-screen, for SSH/scripting)")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.BoolVar(&cfg.Inline, "inline", cfg.Inline, "Run inline (no alt-screen, for SSH/scripting)")
+	fs.BoolVar(&cfg.NoConfirm, "no-confirm", cfg.NoConfirm, "Process images on Enter without asking for confirmation")
+	fs.BoolVar(&cfg.Unquarantine, "unquarantine", cfg.Unquarantine, "Allow processing images quarantined after failing security validation")
+	fs.BoolVar(&cfg.ShowCompleted, "show-completed", cfg.ShowCompleted, "List completed FSM runs as well as live and failed ones (toggle with 'a')")
+	fs.StringVar(&cfg.DebugLog, "debug-log", cfg.DebugLog, "Append logs to this file while the TUI runs, instead of discarding them")
+	fs.StringVar(&cfg.S3Prefix, "prefix", cfg.S3Prefix, "Only browse S3 keys under this prefix")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// parseRecoverFlags parses flags for the recover command.
+func parseRecoverFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "Report missing devices without changing the pool or database")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path (pool files stored in same directory)")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
 	fs.Parse(args)
 }
 
@@ -269,22 +876,59 @@ func parseMonitorFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 func parseSetupPoolFlags(cfg *Config, fs *flag.FlagSet, args []string) {
 	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path (pool files stored in same directory)")
 	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.Int64Var(&cfg.PoolDataSize, "data-size", cfg.PoolDataSize, "Pool data file size in bytes")
+	fs.Int64Var(&cfg.PoolMetaSize, "meta-size", cfg.PoolMetaSize, "Pool metadata file size in bytes")
+	fs.IntVar(&cfg.PoolBlockSize, "block-size", cfg.PoolBlockSize, "Pool data block size in 512-byte sectors (multiple of 128)")
+	fs.BoolVar(&cfg.PoolAutoSize, "auto-size", cfg.PoolAutoSize, "Size the pool from the total size of the images in the bucket (overrides --data-size and --meta-size)")
+	fs.StringVar(&cfg.S3Bucket, "bucket", cfg.S3Bucket, "S3 bucket name (for --auto-size)")
+	fs.StringVar(&cfg.S3Region, "region", cfg.S3Region, "S3 region (for --auto-size)")
 	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	registerConfigFlag(fs)
 	fs.Parse(args)
 }
 
+// parseGrowPoolFlags parses flags for the grow-pool command.
+func parseGrowPoolFlags(cfg *Config, fs *flag.FlagSet, args []string) {
+	fs.Int64Var(&cfg.AddData, "add-data", cfg.AddData, "Bytes to add to the pool data file")
+	fs.Int64Var(&cfg.AddMeta, "add-meta", cfg.AddMeta, "Bytes to add to the pool metadata file")
+	fs.BoolVar(&cfg.Force, "force", cfg.Force, "Grow the pool (otherwise only print what would change)")
+	fs.BoolVar(&cfg.RawBytes, "bytes", cfg.RawBytes, "Print sizes as exact byte counts instead of KB/MB/GB")
+	fs.StringVar(&cfg.DBPath, "db", cfg.DBPath, "Database path (pool files stored in same directory)")
+	fs.StringVar(&cfg.FSMDBPath, "fsm-db", cfg.FSMDBPath, "FSM database directory")
+	fs.StringVar(&cfg.PoolName, "pool", cfg.PoolName, "DeviceMapper pool name")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format (text, json; default json for daemon, text otherwise)")
+	fs.DurationVar(&cfg.LockWait, "lock-wait", cfg.LockWait, "Wait up to this long for another process to release the manager lock (0 fails at once)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+}
+
+// poolConfig returns the thin-pool configuration for cfg. Pool files live
+// next to the database.
+func poolConfig(cfg Config) devicemapper.PoolConfig {
+	pc := devicemapper.DefaultPoolConfig(filepath.Dir(cfg.DBPath))
+	pc.PoolName = cfg.PoolName
+	pc.DataSizeBytes = cfg.PoolDataSize
+	pc.MetaSizeBytes = cfg.PoolMetaSize
+	pc.DataBlockSize = cfg.PoolBlockSize
+	return pc
+}
+
 // runSetupPool creates or recreates the devicemapper thin-pool.
 func runSetupPool(cfg Config) error {
-	if err := setupLogger(cfg.LogLevel); err != nil {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
 		return err
 	}
 
 	ctx := context.Background()
 
-	// Initialize pool manager
-	poolConfig := devicemapper.DefaultPoolConfig(filepath.Dir(cfg.DBPath))
-	poolConfig.PoolName = cfg.PoolName
-	pm := devicemapper.NewPoolManager(poolConfig, log)
+	// Validate sizes before touching any devices.
+	pc := poolConfig(cfg)
+	if err := pc.Validate(); err != nil {
+		return err
+	}
+	pm := devicemapper.NewPoolManager(pc, log)
 
 	// Check current status
 	status, err := pm.GetPoolStatus(ctx)
@@ -310,6 +954,13 @@ func runSetupPool(cfg Config) error {
 		return nil
 	}
 
+	if cfg.PoolAutoSize {
+		if pc, err = autoSizePoolConfig(ctx, cfg, pc); err != nil {
+			return err
+		}
+		pm = devicemapper.NewPoolManager(pc, log)
+	}
+
 	// Pool doesn't exist - create it
 	log.Info("creating thin-pool")
 	if err := pm.CreatePool(ctx); err != nil {
@@ -321,11 +972,73 @@ func runSetupPool(cfg Config) error {
 	return nil
 }
 
-// setupLogger configures the global logger.
-func setupLogger(level string) error {
-	log.SetFormatter(&logrus.JSONFormatter{
-		TimestampFormat: time.RFC3339Nano,
-	})
+// autoSizePoolConfig lists the images in the bucket and returns pc with the
+// data and metadata sizes recommended for their total size.
+func autoSizePoolConfig(ctx context.Context, cfg Config, pc devicemapper.PoolConfig) (devicemapper.PoolConfig, error) {
+	s3Client, err := s3.New(ctx, newS3Config(cfg))
+	if err != nil {
+		return pc, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	objects, err := s3Client.ListImagesDetailed(ctx, cfg.S3Bucket, "images/")
+	if err != nil {
+		return pc, fmt.Errorf("failed to list bucket: %w", err)
+	}
+
+	var totalSize int64
+	var count int
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		totalSize += obj.Size
+		count++
+	}
+	if count == 0 {
+		return pc, fmt.Errorf("no images found in s3://%s/images/", cfg.S3Bucket)
+	}
+
+	rec := devicemapper.RecommendPoolConfig(pc.DataDir, totalSize)
+	pc.DataSizeBytes = rec.DataSizeBytes
+	pc.MetaSizeBytes = rec.MetaSizeBytes
+
+	log.WithFields(logrus.Fields{
+		"bucket":      cfg.S3Bucket,
+		"images":      count,
+		"total_bytes": totalSize,
+		"data_size":   pc.DataSizeBytes,
+		"meta_size":   pc.MetaSizeBytes,
+	}).Info("auto-sized pool from bucket")
+
+	return pc, pc.Validate()
+}
+
+// defaultLogFormat returns the log format for command when --log-format is
+// not given: JSON for the daemon, whose logs usually go to a collector, and
+// text for commands run by hand.
+func defaultLogFormat(command string) string {
+	if command == "daemon" {
+		return "json"
+	}
+	return "text"
+}
+
+// setupLogger configures the global logger's level and format ("text" or
+// "json"). The interactive TUIs discard log output separately.
+func setupLogger(level, format string) error {
+	switch format {
+	case "json":
+		log.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+	case "text":
+		log.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339,
+		})
+	default:
+		return fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
 
 	lvl, err := logrus.ParseLevel(level)
 	if err != nil {
@@ -341,19 +1054,85 @@ type lockFileInfo struct {
 	PID       int    `json:"pid"`
 	Timestamp int64  `json:"timestamp"`
 	Command   string `json:"command"`
+	Version   string `json:"version,omitempty"` // Empty for binaries older than the field
+}
+
+// lockRetryInterval is how often acquireManagerLock retries a held lock while
+// waiting for it. Tests shorten it.
+var lockRetryInterval = time.Second
+
+// lockHeldError reports a manager lock held by a live process.
+type lockHeldError struct {
+	lockPath string
+	holder   *lockFileInfo // nil if the lock file could not be parsed
+}
+
+func (e *lockHeldError) Error() string {
+	if e.holder == nil {
+		return fmt.Sprintf("another flyio-image-manager process is running (lock file exists at %s). Wait for it to complete, or run unlock if it has gone", e.lockPath)
+	}
+	return fmt.Sprintf("another flyio-image-manager process is running (PID %d, command: %s, version: %s, started: %s). Wait for it to complete, retry with --lock-wait, or run unlock if it has gone (lock file: %s)",
+		e.holder.PID, e.holder.Command, lockVersion(e.holder.Version), time.Unix(e.holder.Timestamp, 0).Format(time.RFC3339), e.lockPath)
+}
+
+// lockVersion names a lock holder's version, which older binaries don't record.
+func lockVersion(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
 }
 
 // acquireManagerLock creates a lock file to prevent concurrent manager processes.
 // This prevents multiple flyio-image-manager processes from running simultaneously,
 // which could cause concurrent devicemapper operations and kernel panics.
 //
-// The lock file contains the process ID, timestamp, and command name for debugging.
-// Returns an error if the lock file already exists (another process is running).
+// The lock file contains the process ID, timestamp, command name and build
+// version for debugging. If a live process holds the lock, acquisition retries
+// every lockRetryInterval for up to wait before returning an error; a zero wait
+// fails immediately. A holder built from a different version is logged as a
+// warning, since its FSM state or schema may not match ours.
+func acquireManagerLock(fsmDBPath string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	warnedPID := 0
+
+	for {
+		err := tryManagerLock(fsmDBPath)
+		var held *lockHeldError
+		if !errors.As(err, &held) {
+			return err
+		}
+
+		if h := held.holder; h != nil && h.PID != warnedPID {
+			warnedPID = h.PID
+			if h.Version != Version {
+				log.WithFields(logrus.Fields{
+					"holder_pid":     h.PID,
+					"holder_command": h.Command,
+					"holder_version": lockVersion(h.Version),
+					"version":        Version,
+				}).Warn("manager lock is held by a different flyio-image-manager version")
+			}
+		}
+
+		if time.Now().Add(lockRetryInterval).After(deadline) {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			"lock_path": held.lockPath,
+			"remaining": time.Until(deadline).Round(time.Second).String(),
+		}).Info("waiting for manager lock")
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// tryManagerLock makes one attempt at the manager lock. It removes a lock left
+// by a dead process and returns a *lockHeldError if a live process holds it.
 //
 // CRITICAL: Uses O_EXCL flag for atomic lock acquisition to prevent race conditions.
 // This is essential for kernel panic prevention - without atomic locking, two processes
 // can both pass the existence check and start concurrent devicemapper operations.
-func acquireManagerLock(fsmDBPath string) error {
+func tryManagerLock(fsmDBPath string) error {
 	lockPath := filepath.Join(fsmDBPath, "flyio-manager.lock")
 
 	// Ensure the FSMDBPath directory exists
@@ -366,6 +1145,7 @@ func acquireManagerLock(fsmDBPath string) error {
 		PID:       os.Getpid(),
 		Timestamp: time.Now().Unix(),
 		Command:   filepath.Base(os.Args[0]),
+		Version:   Version,
 	}
 	if len(os.Args) > 1 {
 		info.Command = os.Args[1] // Use subcommand name (process-image, daemon, etc.)
@@ -389,8 +1169,7 @@ func acquireManagerLock(fsmDBPath string) error {
 				if json.Unmarshal(existingData, &existingInfo) == nil {
 					// Check if the process is still running
 					if isProcessRunning(existingInfo.PID) {
-						return fmt.Errorf("another flyio-image-manager process is running (PID %d, command: %s, started: %s). Wait for it to complete or remove the lock file at %s",
-							existingInfo.PID, existingInfo.Command, time.Unix(existingInfo.Timestamp, 0).Format(time.RFC3339), lockPath)
+						return &lockHeldError{lockPath: lockPath, holder: &existingInfo}
 					}
 					// Process is dead - stale lock file
 					log.WithFields(logrus.Fields{
@@ -402,10 +1181,10 @@ func acquireManagerLock(fsmDBPath string) error {
 						return fmt.Errorf("failed to remove stale lock file: %w", removeErr)
 					}
 					// Retry lock acquisition after removing stale lock
-					return acquireManagerLock(fsmDBPath)
+					return tryManagerLock(fsmDBPath)
 				}
 			}
-			return fmt.Errorf("another flyio-image-manager process is running (lock file exists at %s). Wait for it to complete or remove the lock file manually", lockPath)
+			return &lockHeldError{lockPath: lockPath}
 		}
 		return fmt.Errorf("failed to create lock file: %w", err)
 	}
@@ -425,6 +1204,7 @@ func acquireManagerLock(fsmDBPath string) error {
 		"lock_path": lockPath,
 		"pid":       info.PID,
 		"command":   info.Command,
+		"version":   info.Version,
 	}).Info("acquired manager lock (atomic)")
 
 	return nil
@@ -458,137 +1238,135 @@ func preFlightStabilize(ctx context.Context, poolName string) {
 // checkSystemHealth performs pre-flight checks before devicemapper operations.
 // This prevents operations when the system is in a state that could cause kernel panics.
 //
-// Checks performed:
+// Readings taken (judged against the --max-load, --max-iowait, --min-mem-pct
+// and --max-pressure thresholds by safeguards.SystemHealthChecker.Evaluate):
 // 1. D-state processes: Indicates kernel-level I/O issues (dm-thin stuck)
-// 2. High load average: System under stress, operations may timeout/hang
+// 2. Load average: System under stress, operations may timeout/hang
 // 3. Kernel dm-thin errors: Check dmesg for recent devicemapper errors
-// 4. Pool health: Check if thin-pool needs_check flag is set
-// 5. Memory pressure: Check for OOM conditions
+// 4. Memory pressure: PSI memory stalls, else free memory and swap from /proc/meminfo
+// 5. I/O pressure: PSI I/O stalls, else I/O wait from vmstat
 //
 // This is CRITICAL for kernel panic prevention - the D-state buildup we observed
 // before panics can be detected early and operations refused.
-func checkSystemHealth() error {
+func checkSystemHealth(cfg Config) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	checker := safeguards.NewSystemHealthChecker(cfg.PoolName, log)
+	checker.SetThresholds(healthThresholds(cfg))
+	readings := safeguards.HealthReadings{CPUs: runtime.NumCPU()}
+
 	// Check 1: D-state processes (uninterruptible sleep)
-	// These indicate kernel-level issues, often with devicemapper
-	dStateCount, err := countDmRelatedDState(ctx)
+	// These indicate kernel-level issues, often with devicemapper; refuse
+	// before running anything else on a wedged system
+	dStateCount, err := countDmRelatedDState()
 	if err != nil {
 		log.WithError(err).Warn("failed to check D-state processes, continuing anyway")
 	} else if dStateCount > 0 {
-		return fmt.Errorf("system unstable: %d devicemapper-related D-state processes detected. "+
-			"This indicates kernel-level I/O issues. Reboot recommended before proceeding", dStateCount)
+		readings.DStateProcs = dStateCount
+		return checker.Evaluate(readings)
 	}
 
 	// Check 2: Load average - high load can cause timeouts and cascading failures
-	loadAvg, err := getLoadAverage()
-	if err != nil {
+	if readings.LoadAvg, err = getLoadAverage(); err != nil {
 		log.WithError(err).Warn("failed to check load average, continuing anyway")
-	} else if loadAvg > 4.0 {
-		log.WithField("load_avg", loadAvg).Warn("high system load detected, operations may be slow")
-		// Don't fail, just warn - high load alone isn't dangerous
 	}
 
 	// Check 3: Recent kernel dm-thin errors in dmesg
 	// Only flag truly critical errors, not old messages
-	dmErrors, err := checkDmesgForDmErrors(ctx)
-	if err != nil {
+	if readings.DmErrors, err = checkDmesgForDmErrors(ctx); err != nil {
 		log.WithError(err).Warn("failed to check dmesg for dm errors, continuing anyway")
-	} else if dmErrors > 2 {
-		// Only block if there are multiple critical errors (indicates active issue)
-		return fmt.Errorf("system unstable: %d critical devicemapper errors in recent kernel log. "+
-			"This indicates active dm-thin issues. Wait 30 seconds or reboot before proceeding", dmErrors)
-	} else if dmErrors > 0 {
-		// Warn but don't block for 1-2 errors (could be transient)
-		log.WithField("dm_errors", dmErrors).Warn("detected devicemapper messages in dmesg, proceeding with caution")
 	}
 
-	// Check 4: Memory pressure (OOM conditions can cause dm hangs)
-	memPressure, err := checkMemoryPressure()
-	if err != nil {
-		log.WithError(err).Warn("failed to check memory pressure, continuing anyway")
-	} else if memPressure {
-		return fmt.Errorf("system unstable: high memory pressure detected. " +
-			"This can cause devicemapper operations to hang. Free memory or reboot")
-	}
+	// Checks 4 and 5: memory and I/O pressure. PSI stall times predict dm hangs
+	// far better than free memory and I/O wait, so those are only read on
+	// kernels without /proc/pressure.
+	if err := safeguards.ReadPressure(safeguards.PressureDir, &readings); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.WithError(err).Warn("failed to read pressure stall information, falling back to meminfo and vmstat")
+		}
 
-	// Check 5: Any I/O wait percentage > 50% indicates storage bottleneck
-	ioWait, err := getIOWait(ctx)
-	if err != nil {
-		log.WithError(err).Warn("failed to check I/O wait, continuing anyway")
-	} else if ioWait > 50.0 {
-		return fmt.Errorf("system unstable: I/O wait at %.1f%% indicates storage bottleneck. "+
-			"Wait for I/O to settle or reboot", ioWait)
+		// Check 4: Memory pressure (OOM conditions can cause dm hangs)
+		if err := readMemInfo(&readings); err != nil {
+			log.WithError(err).Warn("failed to check memory pressure, continuing anyway")
+		}
+
+		// Check 5: I/O wait percentage indicates a storage bottleneck
+		if readings.IOWait, err = getIOWait(ctx); err != nil {
+			log.WithError(err).Warn("failed to check I/O wait, continuing anyway")
+		}
 	}
 
+	if err := checker.Evaluate(readings); err != nil {
+		return err
+	}
 	log.Debug("system health check passed")
 	return nil
 }
 
+// healthThresholds returns the system health thresholds set by the
+// --max-load, --load-per-cpu, --max-iowait, --min-mem-pct and --max-pressure flags.
+func healthThresholds(cfg Config) safeguards.HealthThresholds {
+	t := safeguards.DefaultHealthThresholds()
+	t.MaxLoad = cfg.MaxLoad
+	t.LoadPerCPU = cfg.LoadPerCPU
+	t.MaxIOWait = cfg.MaxIOWait
+	t.MinMemPercent = cfg.MinMemPercent
+	t.MaxPressure = cfg.MaxPressure
+	return t
+}
+
 // countDmRelatedDState counts D-state processes related to devicemapper.
-// These are the dangerous ones that indicate dm-thin stack issues.
-func countDmRelatedDState(ctx context.Context) (int, error) {
-	// More robust D-state detection - look for ANY D-state process that mentions dm, thin, or jbd2
-	// in the entire line (not just specific columns). This catches kernel threads that appear
-	// in brackets like [kworker/u128:0+dm-thin] or [jbd2/dm-1-8]
-	cmd := exec.CommandContext(ctx, "sh", "-c",
-		`ps aux 2>/dev/null | awk '$8 ~ /^D/ && ($0 ~ /dm/ || $0 ~ /thin/ || $0 ~ /jbd2/ || $0 ~ /kworker.*\+/) {count++} END {print count+0}'`)
-	output, err := cmd.CombinedOutput()
+// These are the dangerous ones that indicate dm-thin stack issues: dm and
+// thin threads, jbd2 journal threads like [jbd2/dm-1-8], kworkers busy on a
+// workqueue like [kworker/u128:0+dm-thin], and tasks blocked in dm functions.
+// It reads /proc directly, so it cannot hang behind a stuck ps.
+func countDmRelatedDState() (int, error) {
+	count, err := safeguards.CountDState(safeguards.ProcDir, safeguards.ProcState.DmRelated)
 	if err != nil {
-		if ctx.Err() != nil {
-			return 0, fmt.Errorf("D-state check timed out (system may be hung): %w", ctx.Err())
-		}
 		return 0, fmt.Errorf("failed to check D-state processes: %w", err)
 	}
-
-	countStr := strings.TrimSpace(string(output))
-	var count int
-	if countStr != "" && countStr != "0" {
-		fmt.Sscanf(countStr, "%d", &count)
-	}
 	return count, nil
 }
 
+// dmErrorPattern matches kernel log lines that indicate active dm-thin issues:
+// "needs_check" (pool corruption), I/O errors on dm devices, and failed
+// metadata operations. General "device-mapper: thin" messages can be
+// informational and are not matched.
+var dmErrorPattern = regexp.MustCompile(`(?i)(needs_check|I/O error.*dm|dm.*I/O error|metadata operation failed)`)
+
 // checkDmesgForDmErrors checks kernel log for recent devicemapper errors.
 // Returns count of CRITICAL dm-related errors that indicate active issues.
-// Only looks at very recent messages (last 30 lines) to avoid false positives from old errors.
+// Only looks at very recent messages (last 30 lines) to avoid false positives
+// from old errors. The log comes from dmesg, or /dev/kmsg on hosts without it;
+// a log that cannot be read is an error rather than a clean bill of health.
 func checkDmesgForDmErrors(ctx context.Context) (int, error) {
-	// Only check the last 30 lines of dmesg (very recent messages)
-	// and only look for critical errors that indicate active dm-thin issues:
-	// - "needs_check" - pool corruption
-	// - "I/O error" combined with dm - active I/O failures
-	// - "metadata operation failed" - metadata corruption
-	// Exclude general "device-mapper: thin" messages as those can be informational
-	cmd := exec.CommandContext(ctx, "sh", "-c",
-		`dmesg 2>/dev/null | tail -30 | grep -ciE '(needs_check|I/O error.*dm|dm.*I/O error|metadata operation failed)' || echo 0`)
-	output, err := cmd.CombinedOutput()
+	lines, err := safeguards.KernelLogTail(ctx, safeguards.KmsgPath, 30)
 	if err != nil {
-		if ctx.Err() != nil {
-			return 0, fmt.Errorf("dmesg check timed out: %w", ctx.Err())
-		}
-		// dmesg might fail if not root, that's ok
-		return 0, nil
+		return 0, err
 	}
+	return countDmErrors(lines), nil
+}
 
-	countStr := strings.TrimSpace(string(output))
-	var count int
-	fmt.Sscanf(countStr, "%d", &count)
-	return count, nil
+// countDmErrors returns how many kernel log lines match dmErrorPattern.
+func countDmErrors(lines []string) int {
+	count := 0
+	for _, line := range lines {
+		if dmErrorPattern.MatchString(line) {
+			count++
+		}
+	}
+	return count
 }
 
-// checkMemoryPressure checks if system is under memory pressure.
-// Returns true if available memory is below 5% or swap is heavily used.
-func checkMemoryPressure() (bool, error) {
+// readMemInfo fills in the memory and swap readings from /proc/meminfo.
+func readMemInfo(r *safeguards.HealthReadings) error {
 	data, err := os.ReadFile("/proc/meminfo")
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	lines := strings.Split(string(data), "\n")
-	var memTotal, memAvailable, swapTotal, swapFree int64
-
-	for _, line := range lines {
+	for _, line := range strings.Split(string(data), "\n") {
 		fields := strings.Fields(line)
 		if len(fields) < 2 {
 			continue
@@ -598,63 +1376,79 @@ func checkMemoryPressure() (bool, error) {
 
 		switch fields[0] {
 		case "MemTotal:":
-			memTotal = value
+			r.MemTotalKB = value
 		case "MemAvailable:":
-			memAvailable = value
+			r.MemAvailableKB = value
 		case "SwapTotal:":
-			swapTotal = value
+			r.SwapTotalKB = value
 		case "SwapFree:":
-			swapFree = value
+			r.SwapFreeKB = value
 		}
 	}
+	return nil
+}
 
-	// Check if available memory is below 5%
-	if memTotal > 0 && memAvailable > 0 {
-		availPercent := float64(memAvailable) / float64(memTotal) * 100
-		if availPercent < 5.0 {
-			log.WithFields(logrus.Fields{
-				"mem_available_pct": availPercent,
-				"mem_available_kb":  memAvailable,
-				"mem_total_kb":      memTotal,
-			}).Warn("low memory condition detected")
-			return true, nil
-		}
-	}
+// ioWaitSampleInterval is how long getIOWait measures I/O wait over.
+var ioWaitSampleInterval = time.Second
 
-	// Check if swap is more than 80% used (indicates memory pressure)
-	if swapTotal > 0 {
-		swapUsedPercent := float64(swapTotal-swapFree) / float64(swapTotal) * 100
-		if swapUsedPercent > 80.0 {
-			log.WithFields(logrus.Fields{
-				"swap_used_pct": swapUsedPercent,
-				"swap_free_kb":  swapFree,
-				"swap_total_kb": swapTotal,
-			}).Warn("high swap usage detected")
-			return true, nil
-		}
+// getIOWait returns the current I/O wait percentage over
+// ioWaitSampleInterval, from vmstat or, on hosts without it, by sampling
+// /proc/stat directly.
+func getIOWait(ctx context.Context) (float64, error) {
+	if !devicemapper.Tools().Vmstat {
+		return safeguards.SampleIOWait(ctx, safeguards.ProcDir, ioWaitSampleInterval)
 	}
 
-	return false, nil
-}
-
-// getIOWait returns the current I/O wait percentage from /proc/stat.
-func getIOWait(ctx context.Context) (float64, error) {
-	// Use vmstat to get current I/O wait percentage
-	cmd := exec.CommandContext(ctx, "sh", "-c",
-		`vmstat 1 2 2>/dev/null | tail -1 | awk '{print $16}'`)
-	output, err := cmd.CombinedOutput()
+	// The second report covers the interval; the first is since boot
+	interval := strconv.Itoa(max(1, int(ioWaitSampleInterval.Seconds())))
+	output, err := exec.CommandContext(ctx, "vmstat", interval, "2").Output()
 	if err != nil {
 		if ctx.Err() != nil {
 			return 0, fmt.Errorf("vmstat timed out: %w", ctx.Err())
 		}
-		// vmstat might not be available, that's ok
-		return 0, nil
+		return 0, fmt.Errorf("vmstat: %w", err)
+	}
+	return parseVmstatIOWait(string(output))
+}
+
+// parseVmstatIOWait returns the "wa" column of vmstat's last report.
+func parseVmstatIOWait(output string) (float64, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 3 {
+		return 0, fmt.Errorf("unexpected vmstat output %q", output)
+	}
+	col := slices.Index(strings.Fields(lines[1]), "wa")
+	last := strings.Fields(lines[len(lines)-1])
+	if col < 0 || col >= len(last) {
+		return 0, fmt.Errorf("no wa column in vmstat output %q", output)
 	}
+	return strconv.ParseFloat(last[col], 64)
+}
+
+// lookPath finds host tools for probeHostTools. Tests replace it.
+var lookPath = exec.LookPath
 
-	ioWaitStr := strings.TrimSpace(string(output))
-	var ioWait float64
-	fmt.Sscanf(ioWaitStr, "%f", &ioWait)
-	return ioWait, nil
+// hostToolFallbacks says what replaces each optional host tool when it is
+// missing.
+var hostToolFallbacks = map[string]string{
+	"udevadm": "pausing instead of udevadm settle",
+	"vmstat":  "sampling /proc/stat for I/O wait",
+	"dmesg":   "reading /dev/kmsg for kernel errors",
+}
+
+// probeHostTools records which of udevadm, vmstat and dmesg are installed,
+// for the health checks and pool stabilization to choose their fallbacks,
+// and logs each missing tool once.
+func probeHostTools() devicemapper.HostTools {
+	tools := devicemapper.ProbeHostTools(lookPath)
+	devicemapper.SetTools(tools)
+	for _, name := range tools.Missing() {
+		log.WithFields(logrus.Fields{
+			"tool":     name,
+			"fallback": hostToolFallbacks[name],
+		}).Warn("host tool not found, using fallback")
+	}
+	return tools
 }
 
 // getLoadAverage returns the 1-minute load average.
@@ -671,10 +1465,10 @@ func getLoadAverage() (float64, error) {
 // initializeSafeguards sets up the operation guard and pool manager.
 // This should be called early in the application startup.
 func initializeSafeguards(cfg Config) error {
+	probeHostTools()
+
 	// Initialize pool manager
-	poolConfig := devicemapper.DefaultPoolConfig(filepath.Dir(cfg.DBPath))
-	poolConfig.PoolName = cfg.PoolName
-	poolManager = devicemapper.NewPoolManager(poolConfig, log)
+	poolManager = devicemapper.NewPoolManager(poolConfig(cfg), log)
 
 	// Initialize health checker
 	healthChecker := safeguards.NewSystemHealthChecker(cfg.PoolName, log)
@@ -690,6 +1484,30 @@ func initializeSafeguards(cfg Config) error {
 	return nil
 }
 
+// withDMCommand runs fn, the body of a one-shot command that touches
+// devicemapper, with the command's safety gates applied in one place:
+//
+//   - Unless dryRun, the manager lock is held so no FSM runs devicemapper
+//     operations concurrently. A dry run changes nothing, so it doesn't need
+//     the lock and can run alongside a daemon.
+//   - fn runs under the operation guard, whose system health check refuses
+//     to start on an unhealthy system (D-state processes, pool in error or
+//     read-only state), where even reading device state can hang and
+//     changing it can panic the kernel.
+func withDMCommand(ctx context.Context, cfg Config, name string, dryRun bool, fn func() error) error {
+	if !dryRun {
+		if err := acquireManagerLock(cfg.FSMDBPath, cfg.LockWait); err != nil {
+			return err
+		}
+		defer releaseManagerLock(cfg.FSMDBPath)
+	}
+
+	if err := initializeSafeguards(cfg); err != nil {
+		return fmt.Errorf("failed to initialize safeguards: %w", err)
+	}
+	return operationGuard.WithOperation(ctx, name, fn)
+}
+
 // ensurePoolReady checks if the pool exists and creates it if needed.
 // This is the main entry point for startup pool validation.
 func ensurePoolReady(ctx context.Context, cfg Config) error {
@@ -727,12 +1545,19 @@ func checkPoolExists(ctx context.Context, poolName string) error {
 		return fmt.Errorf("failed to check pool status: %w (output: %s)", err, string(output))
 	}
 
-	// Check for needs_check flag in the output
-	if strings.Contains(string(output), "needs_check") {
+	info, err := devicemapper.ParsePoolStatusOutput(poolName, string(output))
+	if err != nil {
+		return fmt.Errorf("failed to parse pool status: %w", err)
+	}
+	if info.NeedsCheck {
 		return fmt.Errorf("thin-pool %q has needs_check flag set - pool may be corrupted. "+
 			"Run: sudo dmsetup message %s 0 reserve_metadata_snap && "+
 			"sudo thin_check /dev/mapper/%s_tmeta", poolName, poolName, poolName)
 	}
+	if !info.Healthy() {
+		return fmt.Errorf("thin-pool %q is %s - recreate it using the setup commands in the README",
+			poolName, strings.Join(info.Problems(), ", "))
+	}
 
 	return nil
 }
@@ -758,10 +1583,17 @@ func releaseManagerLock(fsmDBPath string) error {
 
 // runProcessImage processes a single image through the complete pipeline.
 func runProcessImage(cfg Config) error {
-	if err := setupLogger(cfg.LogLevel); err != nil {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
 		return err
 	}
 
+	if cfg.Plan {
+		return runProcessPlan(cfg)
+	}
+	if cfg.DryRun {
+		return runProcessDryRun(cfg)
+	}
+
 	startTime := time.Now()
 
 	// Initialize progress tracking
@@ -774,7 +1606,7 @@ func runProcessImage(cfg Config) error {
 		cliProgress.PrintHeader(cfg.ImageID, cfg.S3Key)
 		tracker.Subscribe(cliProgress.CreateProgressCallback())
 
-		result, err := runFSMPipeline(cfg, tracker, false) // CLI mode: don't suppress logs
+		result, err := runNotifiedPipeline(context.Background(), cfg, tracker, false) // CLI mode: don't suppress logs
 		if err != nil {
 			tracker.ReportError(err)
 			cliProgress.PrintSummary(&tui.ProcessResult{Error: err, TotalTime: time.Since(startTime)})
@@ -792,9 +1624,12 @@ func runProcessImage(cfg Config) error {
 	}
 
 	// Interactive mode: use Bubble Tea TUI
-	// Suppress all log output to avoid mixing with TUI output
-	log.SetOutput(io.Discard)    // Suppress logrus
-	stdlog.SetOutput(io.Discard) // Suppress standard library log (used by database)
+	// Keep all log output out of the TUI (discarded, or sent to --debug-log)
+	closeLogs, err := redirectTUILogs(cfg.DebugLog)
+	if err != nil {
+		return err
+	}
+	defer closeLogs()
 
 	model := tui.NewProgressModel(cfg.ImageID, cfg.S3Key, false)
 	program := tea.NewProgram(model)
@@ -804,7 +1639,7 @@ func runProcessImage(cfg Config) error {
 
 	// Run FSM pipeline in a goroutine
 	go func() {
-		result, err := runFSMPipeline(cfg, tracker, true) // TUI mode: suppress logs
+		result, err := runNotifiedPipeline(context.Background(), cfg, tracker, true) // TUI mode: suppress logs
 		if err != nil {
 			tui.SendAllComplete(program, "", "", "", "", time.Since(startTime), err)
 			return
@@ -834,18 +1669,85 @@ type pipelineResult struct {
 	SnapshotID   string
 	SnapshotName string
 	DevicePath   string
+	Layout       string // Where the root filesystem is on the device (see extraction.RootDir)
+}
+
+// runNotifiedPipeline is runFSMPipeline followed by the --on-complete-webhook
+// and --on-complete-exec notifications, which are sent whether or not the run
+// succeeded.
+func runNotifiedPipeline(ctx context.Context, cfg Config, tracker *tui.ProgressTracker, suppressLogs bool) (*pipelineResult, error) {
+	start := time.Now()
+	result, err := runFSMPipeline(ctx, cfg, tracker, suppressLogs)
+	notifyCompletion(ctx, newCompletionNotifier(cfg, &http.Client{}), log, cfg, result, time.Since(start), err)
+	return result, err
 }
 
 // runFSMPipeline runs the Download → Unpack → Activate FSM pipeline.
 // This is extracted from runProcessImage to allow both CLI and TUI modes to share the same logic.
 // If suppressLogs is true, S3 client logging is disabled (for TUI mode).
-func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool) (*pipelineResult, error) {
-	ctx := context.Background()
+// Cancelling ctx stops waiting on the current phase and shuts the FSM manager down.
+func runFSMPipeline(ctx context.Context, cfg Config, tracker *tui.ProgressTracker, suppressLogs bool) (*pipelineResult, error) {
+	// Acquire manager lock to prevent concurrent processes
+	// This prevents multiple flyio-image-manager processes from running devicemapper
+	// operations concurrently, which can cause kernel panics.
+	if err := acquireManagerLock(cfg.FSMDBPath, cfg.LockWait); err != nil {
+		return nil, err
+	}
+	defer releaseManagerLock(cfg.FSMDBPath)
+
+	return runFSMPipelineLocked(ctx, cfg, tracker, suppressLogs)
+}
+
+// runFSMPipelineLocked is runFSMPipeline for callers that already hold the
+// manager lock, such as process-batch which holds it for the whole batch.
+func runFSMPipelineLocked(ctx context.Context, cfg Config, tracker *tui.ProgressTracker, suppressLogs bool) (*pipelineResult, error) {
+	if err := prepareDeviceWork(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(logrus.Fields{
+		"s3_key":   cfg.S3Key,
+		"image_id": cfg.ImageID,
+		"bucket":   cfg.S3Bucket,
+	}).Info("processing image")
+
+	p, closePipeline, err := startPipeline(ctx, cfg, suppressLogs)
+	if err != nil {
+		return nil, err
+	}
+	defer closePipeline()
+
+	// Wire up progress callbacks for S3 download
+	p.deps.S3Client.SetProgressFunc(func(downloaded, total int64, speed float64) {
+		tracker.UpdateWithTotal(downloaded, total)
+	})
+
+	// Wire up progress callbacks for tar extraction
+	// The extractor pre-scans the tar headers, so bytes give an accurate percentage
+	p.deps.Extractor.SetProgressFunc(func(filesExtracted int, bytesExtracted, totalBytes int64, currentFile string) {
+		if totalBytes > 0 {
+			tracker.UpdateWithTotal(bytesExtracted, totalBytes)
+			return
+		}
+		// Total unknown: fall back to file count (indeterminate progress)
+		tracker.Update(int64(filesExtracted))
+	})
 
+	// Keep the unpack bar moving through verification and cleanup
+	p.deps.UnpackProgress.SetProgressFunc(func(step string, done, total int, message string) {
+		tracker.UpdateStep(tui.UnpackStep(step), done, total, message)
+	})
+
+	return p.run(ctx, cfg, tracker)
+}
+
+// prepareDeviceWork runs the checks required before an image's devicemapper
+// phases: pool stabilization, the system health check and pool readiness.
+func prepareDeviceWork(ctx context.Context, cfg Config) error {
 	// Initialize safeguards if not already done
 	if operationGuard == nil {
 		if err := initializeSafeguards(cfg); err != nil {
-			return nil, fmt.Errorf("failed to initialize safeguards: %w", err)
+			return fmt.Errorf("failed to initialize safeguards: %w", err)
 		}
 	}
 
@@ -856,56 +1758,39 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 
 	// CRITICAL: Pre-flight system health check before devicemapper operations
 	// D-state processes indicate kernel-level issues that can cause panics
-	if err := checkSystemHealth(); err != nil {
-		return nil, fmt.Errorf("system health check failed: %w", err)
+	if err := checkSystemHealth(cfg); err != nil {
+		return fmt.Errorf("system health check failed: %w", err)
 	}
 
 	// CRITICAL: Ensure pool exists and is healthy (auto-create if missing after reboot)
 	if err := ensurePoolReady(ctx, cfg); err != nil {
-		return nil, fmt.Errorf("pool not ready: %w", err)
-	}
-
-	log.WithFields(logrus.Fields{
-		"s3_key":   cfg.S3Key,
-		"image_id": cfg.ImageID,
-		"bucket":   cfg.S3Bucket,
-	}).Info("processing image")
-
-	// Acquire manager lock to prevent concurrent processes
-	// This prevents multiple flyio-image-manager processes from running devicemapper
-	// operations concurrently, which can cause kernel panics.
-	if err := acquireManagerLock(cfg.FSMDBPath); err != nil {
-		return nil, err
+		return fmt.Errorf("pool not ready: %w", err)
 	}
-	defer releaseManagerLock(cfg.FSMDBPath)
+	return nil
+}
 
+// startPipeline initializes dependencies and an FSM manager with the three
+// FSMs registered and in-flight runs resumed. The returned func shuts the
+// manager down and closes the dependencies.
+func startPipeline(ctx context.Context, cfg Config, suppressLogs bool) (*pipeline, func(), error) {
 	// Initialize dependencies
 	deps, err := initializeDependencies(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize dependencies: %w", err)
+		return nil, nil, fmt.Errorf("failed to initialize dependencies: %w", err)
 	}
-	defer deps.Close()
 
-	// Suppress all client logs in TUI mode to avoid mixing with display
-	if suppressLogs {
+	// Suppress all client logs in TUI mode to avoid mixing with display, or
+	// send them to the --debug-log file along with everything else
+	if suppressLogs && cfg.DebugLog != "" {
+		deps.S3Client.SetLogger(log)
+		deps.DeviceMgr.SetLogger(log)
+		deps.Extractor.SetLogger(log)
+	} else if suppressLogs {
 		deps.S3Client.SuppressLogs()
 		deps.DeviceMgr.SuppressLogs()
 		deps.Extractor.SuppressLogs()
 	}
 
-	// Wire up progress callbacks for S3 download
-	deps.S3Client.SetProgressFunc(func(downloaded, total int64, speed float64) {
-		tracker.UpdateWithTotal(downloaded, total)
-	})
-
-	// Wire up progress callbacks for tar extraction
-	// Note: We use bytesExtracted for more accurate progress since file count isn't known ahead
-	deps.Extractor.SetProgressFunc(func(filesExtracted int, bytesExtracted int64, currentFile string) {
-		// For extraction, we don't have a good total, so just update with file count
-		// The TUI will show indeterminate progress for this phase
-		tracker.Update(int64(filesExtracted))
-	})
-
 	// Initialize FSM manager with serial queues for ALL phases.
 	// CRITICAL: All devicemapper operations must be serialized to prevent kernel panics.
 	// The dm-thin pool cannot handle concurrent operations safely.
@@ -919,24 +1804,31 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 		},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create FSM manager: %w", err)
+		deps.Close()
+		return nil, nil, fmt.Errorf("failed to create FSM manager: %w", err)
+	}
+	closePipeline := func() {
+		manager.Shutdown(5 * time.Second)
+		deps.Close()
 	}
-	defer manager.Shutdown(5 * time.Second)
 
 	// Register FSMs
 	downloadStart, downloadResume, err := registerDownloadFSM(ctx, manager, deps, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to register download FSM: %w", err)
+		closePipeline()
+		return nil, nil, fmt.Errorf("failed to register download FSM: %w", err)
 	}
 
 	unpackStart, unpackResume, err := registerUnpackFSM(ctx, manager, deps, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to register unpack FSM: %w", err)
+		closePipeline()
+		return nil, nil, fmt.Errorf("failed to register unpack FSM: %w", err)
 	}
 
 	activateStart, activateResume, err := registerActivateFSM(ctx, manager, deps, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to register activate FSM: %w", err)
+		closePipeline()
+		return nil, nil, fmt.Errorf("failed to register activate FSM: %w", err)
 	}
 
 	// Resume any in-flight FSMs (in case of crash recovery)
@@ -951,6 +1843,75 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 		log.WithError(err).Warn("failed to resume activate FSM runs")
 	}
 
+	return &pipeline{
+		manager:       manager,
+		deps:          deps,
+		downloadStart: downloadStart,
+		unpackStart:   unpackStart,
+		activateStart: activateStart,
+	}, closePipeline, nil
+}
+
+// pipeline is a registered set of Download, Unpack and Activate FSMs that
+// images are run through. It is shared by process-image and the daemon API.
+type pipeline struct {
+	manager       *fsm.Manager
+	deps          *Dependencies
+	downloadStart fsm.Start[fsm.ImageDownloadRequest, fsm.ImageDownloadResponse]
+	unpackStart   fsm.Start[fsm.ImageUnpackRequest, fsm.ImageUnpackResponse]
+	activateStart fsm.Start[fsm.ImageActivateRequest, fsm.ImageActivateResponse]
+}
+
+// run takes cfg.S3Key/cfg.ImageID through the download, unpack and activate
+// phases, reporting progress to tracker. With --stream-extract, an image that
+// has not been downloaded skips the download phase and is downloaded by
+// unpack as it extracts.
+func (p *pipeline) run(ctx context.Context, cfg Config, tracker *tui.ProgressTracker) (*pipelineResult, error) {
+	stream, err := p.streams(ctx, cfg)
+	if err != nil {
+		tracker.ReportError(err)
+		return nil, err
+	}
+	if !stream {
+		if err := p.download(ctx, cfg, tracker); err != nil {
+			return nil, err
+		}
+	}
+	return p.install(ctx, cfg, tracker)
+}
+
+// streams reports whether cfg's image is left to unpack to download while it
+// extracts (--stream-extract). Only images with neither a database record nor
+// a local file are streamed: the download phase resumes partial downloads,
+// re-checks existing files and refuses quarantined images, none of which a
+// stream can do.
+func (p *pipeline) streams(ctx context.Context, cfg Config) (bool, error) {
+	if !cfg.StreamExtract {
+		return false, nil
+	}
+	img, err := p.deps.DB.GetImageByID(ctx, cfg.ImageID)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up image: %w", err)
+	}
+	if img != nil {
+		return false, nil
+	}
+	localPath := download.LocalPath(cfg.LocalDir, cfg.ImageID, cfg.ShardStorage)
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// download runs the download phase for cfg.S3Key/cfg.ImageID. It does not
+// touch devicemapper, so several downloads may run at once.
+func (p *pipeline) download(ctx context.Context, cfg Config, tracker *tui.ProgressTracker) (err error) {
+	defer func() {
+		if err != nil {
+			fsmFailuresTotal.WithLabelValues("download").Inc()
+		}
+	}()
+
 	// ========== DOWNLOAD PHASE ==========
 	downloadReq := &fsm.ImageDownloadRequest{
 		S3Key:   cfg.S3Key,
@@ -966,52 +1927,100 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 	tracker.StartPhase(tui.PhaseDownload, 0)
 
 	request := fsm.NewRequest(downloadReq, &downloadResp)
-	version, err := downloadStart(ctx, cfg.ImageID, request, fsm.WithQueue("download"))
+	version, err := p.downloadStart(ctx, cfg.ImageID, request, fsm.WithQueue("download"))
 	if err != nil {
 		tracker.ReportError(err)
-		return nil, fmt.Errorf("download FSM failed: %w", err)
+		return fmt.Errorf("download FSM failed: %w", err)
 	}
 
-	if err := manager.Wait(ctx, version); err != nil {
+	if err := p.manager.Wait(ctx, version); err != nil {
 		// HandoffError is not a failure - it means the FSM detected work was already done
 		// Check both by type and by error message (backoff wrapping may hide the type)
 		var handoffErr *fsm.HandoffError
 		isHandoff := errors.As(err, &handoffErr) || strings.Contains(err.Error(), "FSM handoff to")
 		if !isHandoff {
 			tracker.ReportError(err)
-			return nil, fmt.Errorf("failed waiting for download FSM: %w", err)
+			return fmt.Errorf("failed waiting for download FSM: %w", err)
 		}
 		log.Info("download FSM handed off (image already downloaded)")
 	}
 
 	// Complete download phase
 	tracker.CompletePhase()
+	return nil
+}
+
+// poolSpacePollInterval is how often an unpack waiting on a full pool reads
+// the pool status to see whether gc has freed space.
+const poolSpacePollInterval = 5 * time.Second
+
+// install runs the unpack and activate phases for an image that download has
+// completed.
+//
+// CRITICAL: Both phases run devicemapper operations; callers must not run two
+// installs at once.
+func (p *pipeline) install(ctx context.Context, cfg Config, tracker *tui.ProgressTracker) (_ *pipelineResult, err error) {
+	phase := "unpack"
+	defer func() {
+		if err != nil {
+			fsmFailuresTotal.WithLabelValues(phase).Inc()
+		}
+	}()
 
 	// Query database for download results (FSM doesn't populate response variable)
-	downloadedImage, err := deps.DB.GetImageByID(ctx, cfg.ImageID)
+	downloadedImage, err := p.deps.DB.GetImageByID(ctx, cfg.ImageID)
 	if err != nil {
 		tracker.ReportError(err)
 		return nil, fmt.Errorf("failed to get downloaded image metadata: %w", err)
 	}
-	if downloadedImage == nil {
+
+	// ========== UNPACK PHASE ==========
+	var unpackReq *fsm.ImageUnpackRequest
+	switch {
+	case downloadedImage != nil:
+		log.WithFields(logrus.Fields{
+			"image_id":   downloadedImage.ImageID,
+			"local_path": downloadedImage.LocalPath,
+			"checksum":   downloadedImage.Checksum,
+			"algo":       downloadedImage.ChecksumAlgo,
+			"size_bytes": downloadedImage.SizeBytes,
+		}).Info("download FSM completed")
+
+		unpackReq = &fsm.ImageUnpackRequest{
+			ImageID:    downloadedImage.ImageID,
+			LocalPath:  downloadedImage.LocalPath,
+			Checksum:   downloadedImage.Checksum,
+			PoolName:   cfg.PoolName,
+			DeviceSize: cfg.DeviceSize,
+		}
+	case cfg.StreamExtract:
+		// Not downloaded yet: unpack streams the image from S3, saving it to
+		// its usual local path as it extracts
+		log.WithField("s3_key", cfg.S3Key).Info("streaming image into unpack")
+
+		unpackReq = &fsm.ImageUnpackRequest{
+			ImageID:    cfg.ImageID,
+			LocalPath:  download.LocalPath(cfg.LocalDir, cfg.ImageID, cfg.ShardStorage),
+			PoolName:   cfg.PoolName,
+			DeviceSize: cfg.DeviceSize,
+			S3Key:      cfg.S3Key,
+			Bucket:     cfg.S3Bucket,
+		}
+	default:
 		err := fmt.Errorf("image not found in database after download")
 		tracker.ReportError(err)
 		return nil, err
 	}
 
-	log.WithFields(logrus.Fields{
-		"image_id":   downloadedImage.ImageID,
-		"local_path": downloadedImage.LocalPath,
-		"checksum":   downloadedImage.Checksum,
-		"size_bytes": downloadedImage.SizeBytes,
-	}).Info("download FSM completed")
-
-	// ========== UNPACK PHASE ==========
-	unpackReq := &fsm.ImageUnpackRequest{
-		ImageID:   downloadedImage.ImageID,
-		LocalPath: downloadedImage.LocalPath,
-		Checksum:  downloadedImage.Checksum,
-		PoolName:  cfg.PoolName,
+	// The pool was found full recently; wait out the cool-down (or for gc to
+	// free space, seen by polling the pool) rather than have the unpack FSM
+	// refused straight away
+	if breaker := p.deps.DeviceMgr.PoolBreaker(); breaker.Remaining() > 0 {
+		log.WithField("remaining", breaker.Remaining().Round(time.Second)).Warn("devicemapper pool full, waiting before unpacking")
+		if err := p.deps.DeviceMgr.WaitForPoolSpace(ctx, cfg.PoolName, poolSpacePollInterval); err != nil {
+			tracker.ReportError(err)
+			return nil, fmt.Errorf("waiting for pool-full cool-down: %w", err)
+		}
 	}
 
 	var unpackResp fsm.ImageUnpackResponse
@@ -1021,13 +2030,13 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 	tracker.StartPhase(tui.PhaseUnpack, 0)
 
 	unpackRequest := fsm.NewRequest(unpackReq, &unpackResp)
-	unpackVersion, err := unpackStart(ctx, cfg.ImageID, unpackRequest, fsm.WithQueue("unpack"))
+	unpackVersion, err := p.unpackStart(ctx, cfg.ImageID, unpackRequest, fsm.WithQueue("unpack"))
 	if err != nil {
 		tracker.ReportError(err)
 		return nil, fmt.Errorf("unpack FSM failed: %w", err)
 	}
 
-	if err := manager.Wait(ctx, unpackVersion); err != nil {
+	if err := p.manager.Wait(ctx, unpackVersion); err != nil {
 		// HandoffError is not a failure - it means the FSM detected work was already done
 		// Check both by type and by error message (backoff wrapping may hide the type)
 		var handoffErr *fsm.HandoffError
@@ -1043,7 +2052,7 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 	tracker.CompletePhase()
 
 	// Query database for unpack results
-	unpackedImage, err := deps.DB.CheckImageUnpacked(ctx, cfg.ImageID)
+	unpackedImage, err := p.deps.DB.CheckImageUnpacked(ctx, cfg.ImageID)
 	if err != nil {
 		tracker.ReportError(err)
 		return nil, fmt.Errorf("failed to get unpacked image metadata: %w", err)
@@ -1061,30 +2070,47 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 		"device_path": unpackedImage.DevicePath,
 		"size_bytes":  unpackedImage.SizeBytes,
 		"file_count":  unpackedImage.FileCount,
+		"layout":      unpackedImage.Layout,
 	}).Info("unpack FSM completed")
 
+	if cfg.KeepMounted {
+		// The origin is still mounted and active; snapshotting it now could
+		// corrupt the snapshot, so stop here.
+		log.WithFields(logrus.Fields{
+			"device_name": unpackedImage.DeviceName,
+			"mount_point": filepath.Join(cfg.MountRoot, unpackedImage.DeviceName),
+		}).Warn("--keep-mounted: skipping activate; unmount and deactivate the device before activating this image")
+		return &pipelineResult{
+			ImageID:    unpackedImage.ImageID,
+			DevicePath: unpackedImage.DevicePath,
+			Layout:     unpackedImage.Layout,
+		}, nil
+	}
+
 	// ========== ACTIVATE PHASE ==========
 	activateReq := &fsm.ImageActivateRequest{
 		ImageID:    unpackedImage.ImageID,
 		DeviceID:   unpackedImage.DeviceID,
 		DeviceName: unpackedImage.DeviceName,
 		PoolName:   cfg.PoolName,
+		Layout:     unpackedImage.Layout,
 	}
 
 	var activateResp fsm.ImageActivateResponse
 	log.Info("starting activate FSM")
 
 	// Start activate phase tracking
+	phase = "activate"
 	tracker.StartPhase(tui.PhaseActivate, 0)
 
 	activateRequest := fsm.NewRequest(activateReq, &activateResp)
-	activateVersion, err := activateStart(ctx, cfg.ImageID, activateRequest, fsm.WithQueue("activate"))
+	activateVersion, err := p.activateStart(ctx, cfg.ImageID, activateRequest, fsm.WithQueue("activate"))
 	if err != nil {
 		tracker.ReportError(err)
 		return nil, fmt.Errorf("activate FSM failed: %w", err)
 	}
 
-	if err := manager.Wait(ctx, activateVersion); err != nil {
+	if err := p.manager.Wait(ctx, activateVersion); err != nil {
 		// HandoffError is not a failure - it means the FSM detected work was already done
 		// Check both by type and by error message (backoff wrapping may hide the type)
 		var handoffErr *fsm.HandoffError
@@ -1100,7 +2126,7 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 	tracker.CompletePhase()
 
 	// Query database for activate results (FSM doesn't populate response variable)
-	snapshots, err := deps.DB.GetSnapshotsByImageID(ctx, cfg.ImageID)
+	snapshots, err := p.deps.DB.GetSnapshotsByImageID(ctx, cfg.ImageID)
 	if err != nil {
 		tracker.ReportError(err)
 		return nil, fmt.Errorf("failed to get snapshot metadata: %w", err)
@@ -1120,88 +2146,34 @@ func runFSMPipeline(cfg Config, tracker *tui.ProgressTracker, suppressLogs bool)
 		"active":        snapshot.Active,
 	}).Info("activate FSM completed")
 
+	if cfg.Tag != "" {
+		if err := p.deps.DB.AddImageTag(ctx, cfg.ImageID, cfg.Tag); err != nil {
+			tracker.ReportError(err)
+			return nil, fmt.Errorf("image activated but tagging failed: %w", err)
+		}
+		log.WithFields(logrus.Fields{
+			"image_id": cfg.ImageID,
+			"tag":      cfg.Tag,
+		}).Info("tagged image")
+	}
+
 	return &pipelineResult{
 		ImageID:      snapshot.ImageID,
 		SnapshotID:   snapshot.SnapshotID,
 		SnapshotName: snapshot.SnapshotName,
 		DevicePath:   snapshot.DevicePath,
+		Layout:       unpackedImage.Layout,
 	}, nil
 }
 
-// runListImages lists downloaded images.
-func runListImages(cfg Config) error {
-	if err := setupLogger(cfg.LogLevel); err != nil {
-		return err
-	}
-
-	ctx := context.Background()
-
-	db, err := database.New(database.Config{Path: cfg.DBPath})
-	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
-	}
-	defer db.Close()
-
-	images, err := db.ListImages(ctx, "")
-	if err != nil {
-		return fmt.Errorf("failed to list images: %w", err)
-	}
-
-	fmt.Printf("Found %d images:\n\n", len(images))
-	for _, img := range images {
-		fmt.Printf("Image ID:         %s\n", img.ImageID)
-		fmt.Printf("  S3 Key:         %s\n", img.S3Key)
-		fmt.Printf("  Local Path:     %s\n", img.LocalPath)
-		fmt.Printf("  Size:           %d bytes\n", img.SizeBytes)
-		fmt.Printf("  Status:         %s\n", img.DownloadStatus)
-		fmt.Printf("  Activation:     %s\n", img.ActivationStatus)
-		if img.DownloadedAt != nil {
-			fmt.Printf("  Downloaded At:  %s\n", img.DownloadedAt.Format(time.RFC3339))
-		} else {
-			fmt.Printf("  Downloaded At:  (not completed)\n")
-		}
-		fmt.Println()
-	}
-
-	return nil
-}
-
-// runListSnapshots lists active snapshots.
-func runListSnapshots(cfg Config) error {
-	if err := setupLogger(cfg.LogLevel); err != nil {
+// runDaemon runs the application as a daemon serving the HTTP API (see api.go).
+func runDaemon(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
 		return err
 	}
-
-	ctx := context.Background()
-
-	db, err := database.New(database.Config{Path: cfg.DBPath})
-	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
-	}
-	defer db.Close()
-
-	snapshots, err := db.ListActiveSnapshots(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to list snapshots: %w", err)
-	}
-
-	fmt.Printf("Found %d active snapshots:\n\n", len(snapshots))
-	for _, snap := range snapshots {
-		fmt.Printf("Snapshot ID:      %s\n", snap.SnapshotID)
-		fmt.Printf("  Image ID:       %s\n", snap.ImageID)
-		fmt.Printf("  Snapshot Name:  %s\n", snap.SnapshotName)
-		fmt.Printf("  Device Path:    %s\n", snap.DevicePath)
-		fmt.Printf("  Active:         %v\n", snap.Active)
-		fmt.Printf("  Created At:     %s\n", snap.CreatedAt.Format(time.RFC3339))
-		fmt.Println()
-	}
-
-	return nil
-}
-
-// runDaemon runs the application as a daemon with API server (future work).
-func runDaemon(cfg Config) error {
-	if err := setupLogger(cfg.LogLevel); err != nil {
+	// Checked here rather than in parseDaemonFlags, which a config reload
+	// also runs.
+	if err := normalizeChecksumAlgo(&cfg); err != nil {
 		return err
 	}
 
@@ -1213,7 +2185,7 @@ func runDaemon(cfg Config) error {
 	// Acquire manager lock to prevent concurrent processes
 	// This prevents multiple flyio-image-manager processes from running devicemapper
 	// operations concurrently, which can cause kernel panics.
-	if err := acquireManagerLock(cfg.FSMDBPath); err != nil {
+	if err := acquireManagerLock(cfg.FSMDBPath, cfg.LockWait); err != nil {
 		return err
 	}
 	defer releaseManagerLock(cfg.FSMDBPath)
@@ -1242,17 +2214,17 @@ func runDaemon(cfg Config) error {
 	defer manager.Shutdown(5 * time.Second)
 
 	// Register FSMs
-	_, downloadResume, err := registerDownloadFSM(ctx, manager, deps, cfg)
+	downloadStart, downloadResume, err := registerDownloadFSM(ctx, manager, deps, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to register download FSM: %w", err)
 	}
 
-	_, unpackResume, err := registerUnpackFSM(ctx, manager, deps, cfg)
+	unpackStart, unpackResume, err := registerUnpackFSM(ctx, manager, deps, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to register unpack FSM: %w", err)
 	}
 
-	_, activateResume, err := registerActivateFSM(ctx, manager, deps, cfg)
+	activateStart, activateResume, err := registerActivateFSM(ctx, manager, deps, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to register activate FSM: %w", err)
 	}
@@ -1269,21 +2241,142 @@ func runDaemon(cfg Config) error {
 		log.WithError(err).Warn("failed to resume activate FSM runs")
 	}
 
+	// Warn (and page, with --alert-webhook) before capacity checks start
+	// refusing operations.
+	if cfg.PoolWarnThreshold <= 0 || cfg.PoolWarnThreshold >= min(cfg.PoolThreshold, cfg.PoolMetaThreshold) {
+		return fmt.Errorf("invalid --pool-warn-threshold %.1f: must be above 0 and below --pool-threshold and --pool-meta-threshold", cfg.PoolWarnThreshold)
+	}
+	deps.DeviceMgr.SetPoolObserver(newPoolAlerter(cfg, log, &http.Client{}).Observe)
+
+	// Prometheus metrics are collected from the database and pool status at
+	// scrape time; the collectors are registered once here.
+	metrics := newMetricsHandler(deps.DB, deps.DeviceMgr, cfg.PoolName, log)
+
+	// Runs take their config from live, which SIGHUP updates with the
+	// reloaded settings
+	live := &liveConfig{cfg: cfg}
+
+	// Start the HTTP API. Pipeline runs it triggers share this manager and
+	// lock, and go through the operation guard one image at a time (with a
+	// health check first), on top of the serialized unpack/activate queues.
+	var api *apiServer
+	apiErrCh := make(chan error, 2)
+	if cfg.Listen != "" {
+		if operationGuard == nil {
+			if err := initializeSafeguards(cfg); err != nil {
+				return fmt.Errorf("failed to initialize safeguards: %w", err)
+			}
+		}
+
+		p := &pipeline{
+			manager:       manager,
+			deps:          deps,
+			downloadStart: downloadStart,
+			unpackStart:   unpackStart,
+			activateStart: activateStart,
+		}
+		completion := newCompletionNotifier(cfg, &http.Client{})
+		process := func(ctx context.Context, s3Key, imageID string) (*pipelineResult, error) {
+			runCfg := live.Load()
+			runCfg.S3Key = s3Key
+			runCfg.ImageID = imageID
+			start := time.Now()
+
+			var result *pipelineResult
+			err := operationGuard.WithOperation(ctx, "process-image:"+imageID, func() error {
+				// Runs queued behind the guard must not start once draining
+				if api.isDraining() {
+					return errShuttingDown
+				}
+				preFlightStabilize(ctx, cfg.PoolName)
+				if err := ensurePoolReady(ctx, cfg); err != nil {
+					return fmt.Errorf("pool not ready: %w", err)
+				}
+				var err error
+				result, err = p.run(ctx, runCfg, tui.NewProgressTracker())
+				return err
+			})
+			// Notify in the background so a slow endpoint doesn't hold up the API
+			go notifyCompletion(context.Background(), completion, log, runCfg, result, time.Since(start), err)
+			return result, err
+		}
+
+		healthChecker := safeguards.NewSystemHealthChecker(cfg.PoolName, log)
+		api = newAPIServer(ctx, deps.DB, process, healthChecker.CheckAll, log)
+		mux := http.NewServeMux()
+		mux.Handle("/", api.Handler())
+		if cfg.MetricsAddr == "" {
+			mux.Handle("GET /metrics", metrics)
+		}
+		srv := &http.Server{
+			Addr:              cfg.Listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			apiErrCh <- serveAPI(ctx, srv)
+		}()
+		log.WithField("listen", cfg.Listen).Info("HTTP API listening")
+	}
+
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", metrics)
+		srv := &http.Server{
+			Addr:              cfg.MetricsAddr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			apiErrCh <- serveAPI(ctx, srv)
+		}()
+		log.WithField("metrics_addr", cfg.MetricsAddr).Info("metrics listening")
+	}
+
 	log.Info("daemon started successfully")
 
+	// SIGHUP re-reads --config and applies the settings that can change
+	// without dropping the lock or in-flight runs (see reloadableSettings)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	reloader := &daemonReloader{
+		args:   os.Args[2:],
+		cfg:    cfg,
+		live:   live,
+		queues: manager,
+		pool:   deps.DeviceMgr,
+		logger: log,
+	}
+	go reloader.watch(ctx, hupCh)
+
 	// Setup signal handling for graceful shutdown
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	sig := <-sigCh
-	log.WithField("signal", sig).Info("received shutdown signal")
+	select {
+	case sig := <-sigCh:
+		log.WithField("signal", sig).Info("received shutdown signal")
+	case err := <-apiErrCh:
+		return fmt.Errorf("HTTP API server failed: %w", err)
+	}
 
-	// Graceful shutdown
-	log.Info("shutting down gracefully...")
+	// Graceful shutdown: refuse new work and let in-flight runs reach the end
+	// of their FSM before anything is cancelled, so an unpack is not cut off
+	// mid-mkfs and left as an orphaned device.
+	log.WithField("timeout", cfg.ShutdownTimeout).Info("shutting down gracefully, draining in-flight runs...")
+	if api != nil {
+		api.Drain()
+	}
+	if drain(api, manager, cfg.ShutdownTimeout, log) {
+		log.Info("in-flight runs drained")
+	}
 	cancel()
 
-	// Give FSMs time to persist state
-	time.Sleep(2 * time.Second)
+	// Let API-triggered runs observe the cancellation and return
+	if api != nil {
+		api.Wait()
+	}
 
 	log.Info("shutdown complete")
 	return nil
@@ -1291,9 +2384,12 @@ func runDaemon(cfg Config) error {
 
 // runMonitor runs the interactive TUI dashboard for live FSM tracking.
 func runMonitor(cfg Config) error {
-	// Suppress log output to avoid mixing with TUI
-	log.SetOutput(io.Discard)
-	stdlog.SetOutput(io.Discard)
+	// Keep log output out of the TUI (discarded, or sent to --debug-log)
+	closeLogs, err := redirectTUILogs(cfg.DebugLog)
+	if err != nil {
+		return err
+	}
+	defer closeLogs()
 
 	// Open database for reading statistics
 	// Track the error for diagnostics display in the TUI
@@ -1315,9 +2411,7 @@ func runMonitor(cfg Config) error {
 	}
 
 	// Create S3 client for browsing images
-	s3Client, err := s3.New(context.Background(), s3.Config{
-		Region: cfg.S3Region,
-	})
+	s3Client, err := s3.New(context.Background(), newS3Config(cfg))
 	if err != nil {
 		// S3 client creation failed - continue without it
 		s3Client = nil
@@ -1330,10 +2424,16 @@ func runMonitor(cfg Config) error {
 	if s3Client != nil {
 		fetcher.SetS3Client(s3Client)
 	}
+	fetcher.SetS3Prefix(cfg.S3Prefix)
+
+	// Report per-image pool allocation in the S3 browser (logs would corrupt the TUI)
+	dmClient := devicemapper.New()
+	dmClient.SuppressLogs()
+	fetcher.SetDeviceMapperClient(dmClient)
 
 	// Set image processing function with progress callback
 	fetcher.SetImageProcessFuncWithProgress(func(ctx context.Context, s3Key string, progressCh chan<- tui.ProgressEvent) error {
-		return runImageProcessFromTUIWithProgress(cfg, s3Key, progressCh)
+		return runImageProcessFromTUIWithProgress(ctx, cfg, s3Key, progressCh)
 	})
 
 	// Create dashboard model with configuration
@@ -1341,6 +2441,9 @@ func runMonitor(cfg Config) error {
 		Title:           "Fly.io Image Manager Dashboard",
 		RefreshInterval: time.Second,
 		Fetcher:         fetcher,
+		NoConfirm:       cfg.NoConfirm,
+		ShowCompleted:   cfg.ShowCompleted,
+		Unquarantine:    cfg.Unquarantine,
 	}
 	model := tui.NewDashboardModelWithConfig(dashboardCfg)
 
@@ -1361,7 +2464,7 @@ func runMonitor(cfg Config) error {
 
 // runImageProcessFromTUI runs the image processing pipeline from the TUI.
 // This is a simplified version that runs synchronously.
-func runImageProcessFromTUI(cfg Config, s3Key string) error {
+func runImageProcessFromTUI(ctx context.Context, cfg Config, s3Key string) error {
 	// Create a simple progress tracker that does nothing (TUI handles display)
 	tracker := &tui.ProgressTracker{}
 
@@ -1372,11 +2475,11 @@ func runImageProcessFromTUI(cfg Config, s3Key string) error {
 	// when triggered from the TUI dashboard. The ImageID must be derived deterministically
 	// from the S3 key for idempotency to work correctly.
 	pipelineCfg.ImageID = fsm.DeriveImageIDFromS3Key(s3Key)
-	result, err := runFSMPipeline(pipelineCfg, tracker, true)
+	result, err := runFSMPipeline(ctx, pipelineCfg, tracker, true)
 
 	// CRITICAL: ALWAYS perform stabilization after ANY devicemapper operation,
 	// even on failure. This prevents kernel panics when processing sequential images.
-	stabilizeAfterOperation(cfg.PoolName, result != nil)
+	stabilizeAfterOperation(ctx, cfg.PoolName, result != nil)
 
 	return err
 }
@@ -1387,19 +2490,19 @@ func runImageProcessFromTUI(cfg Config, s3Key string) error {
 // PERFORMANCE OPTIMIZED: With ext4 journaling disabled and FSM stabilization
 // already handling the critical paths, this function is now minimal.
 // The heavy D-state checking is only done on failure to avoid overhead.
-func stabilizeAfterOperation(poolName string, wasSuccessful bool) {
-	ctx := context.Background()
+// Cancelling ctx, e.g. on shutdown, cuts the dmsetup and udevadm calls short.
+func stabilizeAfterOperation(ctx context.Context, poolName string, wasSuccessful bool) {
 	deviceMgr := devicemapper.New()
 
 	// Sync pool metadata to force commit
 	_ = deviceMgr.SyncPoolMetadata(ctx, poolName)
 
 	// Quick udev settle - just process pending events
-	exec.Command("udevadm", "settle", "--timeout=0").Run()
+	devicemapper.SettleUdev(ctx, 0)
 
 	// Only check for D-state on failure (expensive operation)
 	if !wasSuccessful {
-		dStateCount, _ := countDmRelatedDState(ctx)
+		dStateCount, _ := countDmRelatedDState()
 		if dStateCount > 0 {
 			logrus.Warnf("Detected %d D-state processes after failed operation", dStateCount)
 		}
@@ -1408,7 +2511,8 @@ func stabilizeAfterOperation(poolName string, wasSuccessful bool) {
 
 // runImageProcessFromTUIWithProgress runs the image processing pipeline from the TUI with progress updates.
 // Progress events are sent to the provided channel for real-time display in the dashboard.
-func runImageProcessFromTUIWithProgress(cfg Config, s3Key string, progressCh chan<- tui.ProgressEvent) error {
+// The dashboard cancels ctx when the user aborts the run.
+func runImageProcessFromTUIWithProgress(ctx context.Context, cfg Config, s3Key string, progressCh chan<- tui.ProgressEvent) error {
 	// Create a progress tracker that sends events to the channel
 	tracker := tui.NewProgressTracker()
 
@@ -1444,7 +2548,7 @@ func runImageProcessFromTUIWithProgress(cfg Config, s3Key string, progressCh cha
 	pipelineCfg.S3Key = s3Key
 	// CRITICAL: Derive ImageID from S3 key for idempotency
 	pipelineCfg.ImageID = fsm.DeriveImageIDFromS3Key(s3Key)
-	result, err := runFSMPipeline(pipelineCfg, tracker, true)
+	result, err := runFSMPipeline(ctx, pipelineCfg, tracker, true)
 
 	// Send completion/error event
 	if err != nil {
@@ -1461,7 +2565,7 @@ func runImageProcessFromTUIWithProgress(cfg Config, s3Key string, progressCh cha
 
 	// CRITICAL: ALWAYS perform stabilization after ANY devicemapper operation,
 	// even on failure. This prevents kernel panics when processing sequential images.
-	stabilizeAfterOperation(cfg.PoolName, result != nil && err == nil)
+	stabilizeAfterOperation(ctx, cfg.PoolName, result != nil && err == nil)
 
 	return err
 }
@@ -1472,6 +2576,33 @@ type Dependencies struct {
 	S3Client  *s3.Client
 	DeviceMgr *devicemapper.Client
 	Extractor *extraction.Extractor
+
+	// UnpackProgress receives the unpack FSM's verify-layout and update-db
+	// step progress.
+	UnpackProgress *stepProgress
+}
+
+// stepProgress forwards unpack step progress to a callback that each run
+// can replace, as Extractor.SetProgressFunc does for extraction.
+type stepProgress struct {
+	mu sync.Mutex
+	fn unpack.StepProgressFunc
+}
+
+// SetProgressFunc sets the callback for unpack step progress.
+func (s *stepProgress) SetProgressFunc(fn unpack.StepProgressFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fn = fn
+}
+
+func (s *stepProgress) report(step string, done, total int, message string) {
+	s.mu.Lock()
+	fn := s.fn
+	s.mu.Unlock()
+	if fn != nil {
+		fn(step, done, total, message)
+	}
 }
 
 // Close closes all dependencies.
@@ -1481,6 +2612,22 @@ func (d *Dependencies) Close() {
 	}
 }
 
+// newS3Config returns the S3 client configuration for cfg. A --region of
+// "auto" looks up the bucket's region instead.
+func newS3Config(cfg Config) s3.Config {
+	sc := s3.Config{
+		Region:       cfg.S3Region,
+		Bucket:       cfg.S3Bucket,
+		Concurrency:  cfg.S3Concurrency,
+		ChecksumAlgo: checksum.Algo(cfg.ChecksumAlgo),
+	}
+	if cfg.S3Region == "auto" {
+		sc.Region = ""
+		sc.AutoDetectRegion = true
+	}
+	return sc
+}
+
 // initializeDependencies initializes all external dependencies.
 func initializeDependencies(ctx context.Context, cfg Config) (*Dependencies, error) {
 	// Create directories
@@ -1504,10 +2651,7 @@ func initializeDependencies(ctx context.Context, cfg Config) (*Dependencies, err
 	}
 
 	// Initialize S3 client
-	s3Client, err := s3.New(ctx, s3.Config{
-		Region: cfg.S3Region,
-		Bucket: cfg.S3Bucket,
-	})
+	s3Client, err := s3.New(ctx, newS3Config(cfg))
 	if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to create S3 client: %w", err)
@@ -1515,24 +2659,60 @@ func initializeDependencies(ctx context.Context, cfg Config) (*Dependencies, err
 
 	// Initialize DeviceMapper client
 	deviceMgr := devicemapper.New()
+	if err := deviceMgr.SetCapacityThreshold(cfg.PoolThreshold); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid --pool-threshold: %w", err)
+	}
+	if err := deviceMgr.SetMetadataCapacityThreshold(cfg.PoolMetaThreshold); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid --pool-meta-threshold: %w", err)
+	}
+	if err := deviceMgr.SetMaxDeviceSize(cfg.MaxDeviceSize); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid --max-device-size: %w", err)
+	}
+	deviceMgr.SetOperationRecorder(dmRecorder{db})
+	if cfg.PoolFullCooldown > 0 {
+		deviceMgr.SetPoolBreaker(devicemapper.NewPoolBreaker(cfg.PoolFullCooldown))
+	}
 
 	// Initialize Extractor
 	extractor := extraction.New()
 
 	return &Dependencies{
-		DB:        db,
-		S3Client:  s3Client,
-		DeviceMgr: deviceMgr,
-		Extractor: extractor,
+		DB:             db,
+		S3Client:       s3Client,
+		DeviceMgr:      deviceMgr,
+		Extractor:      extractor,
+		UnpackProgress: &stepProgress{},
 	}, nil
 }
 
+// retryPolicyFromFlag returns a policy that sets state's retry limit from a
+// --max-*-retries value. The flag's 0 means no retries, but a RetryPolicy
+// reads zero as the package default, so it is stored as a negative entry.
+func retryPolicyFromFlag(state string, n int) fsm.RetryPolicy {
+	if n <= 0 {
+		n = -1
+	}
+	return fsm.RetryPolicy{state: n}
+}
+
 // registerDownloadFSM registers the Download FSM with the manager.
 func registerDownloadFSM(ctx context.Context, manager *fsm.Manager, deps *Dependencies, cfg Config) (fsm.Start[fsm.ImageDownloadRequest, fsm.ImageDownloadResponse], fsm.Resume, error) {
 	downloadDeps := &download.Dependencies{
 		DB:       deps.DB,
-		S3Client: deps.S3Client,
+		Store:    deps.S3Client,
 		LocalDir: cfg.LocalDir,
+		Timeouts: download.PhaseTimeouts{Download: cfg.DownloadTimeout},
+		Retries:  retryPolicyFromFlag(download.StateDownload, cfg.MaxDownloadRetries),
+
+		ShardStorage:   cfg.ShardStorage,
+		ParanoidVerify: cfg.ParanoidVerify,
+		ChecksumAlgo:   checksum.Algo(cfg.ChecksumAlgo),
+		MaxFiles:       cfg.MaxFiles,
+		MaxTotalSize:   cfg.MaxTotalSize,
+		Unquarantine:   cfg.Unquarantine,
 	}
 
 	start, resume, err := download.Register(ctx, manager, downloadDeps)
@@ -1548,15 +2728,50 @@ func registerDownloadFSM(ctx context.Context, manager *fsm.Manager, deps *Depend
 	return start, resume, nil
 }
 
+// defaultDeviceSize is the thin device size used when neither --device-size
+// nor --size-overhead applies: 4GB leaves room for large image expansion
+// (node.tar expands to ~1.5GB).
+const defaultDeviceSize = 4 * 1024 * 1024 * 1024
+
 // registerUnpackFSM registers the Unpack FSM with the manager.
 func registerUnpackFSM(ctx context.Context, manager *fsm.Manager, deps *Dependencies, cfg Config) (fsm.Start[fsm.ImageUnpackRequest, fsm.ImageUnpackResponse], fsm.Resume, error) {
+	filesystem, err := devicemapper.ParseFilesystem(cfg.Filesystem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --filesystem: %w", err)
+	}
+	if cfg.MountOptions != "" {
+		if err := devicemapper.ValidateMountOptions(cfg.MountOptions); err != nil {
+			return nil, nil, fmt.Errorf("invalid --mount-options: %w", err)
+		}
+	}
+
 	unpackDeps := &unpack.Dependencies{
-		DB:          deps.DB,
-		DeviceMgr:   deps.DeviceMgr,
-		Extractor:   deps.Extractor,
-		PoolName:    cfg.PoolName,
-		MountRoot:   cfg.MountRoot,
-		DefaultSize: 4 * 1024 * 1024 * 1024, // 4GB - room for large image expansion (node.tar expands to ~1.5GB)
+		DB:                deps.DB,
+		DeviceMgr:         deps.DeviceMgr,
+		Extractor:         deps.Extractor,
+		PoolName:          cfg.PoolName,
+		MountRoot:         cfg.MountRoot,
+		DefaultSize:       defaultDeviceSize,
+		SizeOverhead:      cfg.SizeOverhead,
+		Filesystem:        filesystem,
+		MountOptions:      cfg.MountOptions,
+		EnableJournal:     cfg.EnableJournal,
+		BestEffortExtract: cfg.BestEffortExtract,
+		StripComponents:   cfg.StripComponents,
+		RootfsSubdir:      cfg.RootfsSubdir,
+		MaxFiles:          cfg.MaxFiles,
+		MaxTotalSize:      cfg.MaxTotalSize,
+		WriteConcurrency:  cfg.WriteConcurrency,
+		KeepMounted:       cfg.KeepMounted,
+		Progress:          deps.UnpackProgress.report,
+		Timeouts: unpack.PhaseTimeouts{
+			Extract: cfg.UnpackTimeout,
+			Verify:  cfg.VerifyTimeout,
+		},
+		Retries: retryPolicyFromFlag(unpack.StateExtractLayers, cfg.MaxUnpackRetries),
+	}
+	if cfg.StreamExtract {
+		unpackDeps.Stream = deps.S3Client
 	}
 
 	start, resume, err := unpack.Register(ctx, manager, unpackDeps)
@@ -1574,6 +2789,7 @@ func registerActivateFSM(ctx context.Context, manager *fsm.Manager, deps *Depend
 		DB:        deps.DB,
 		DeviceMgr: deps.DeviceMgr,
 		PoolName:  cfg.PoolName,
+		Retries:   retryPolicyFromFlag(activate.StateCreateSnapshot, cfg.MaxActivateRetries),
 	}
 
 	start, resume, err := activate.Register(ctx, manager, activateDeps)
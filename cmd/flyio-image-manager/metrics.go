@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// fsmFailuresTotal counts pipeline runs that failed, by the phase that failed.
+var fsmFailuresTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "flyio_fsm_failures_total",
+		Help: "Pipeline runs that failed, by phase (download, unpack, activate).",
+	},
+	[]string{"phase"},
+)
+
+// metricsStore is the subset of *database.DB queried on each scrape.
+type metricsStore interface {
+	ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error)
+	ListUnpackedImages(ctx context.Context) ([]*database.UnpackedImage, error)
+	ListActiveSnapshots(ctx context.Context) ([]*database.Snapshot, error)
+}
+
+// poolStatusSource is the subset of *devicemapper.Client queried on each scrape.
+type poolStatusSource interface {
+	ParsePoolStatus(ctx context.Context, poolName string) (*devicemapper.PoolInfo, error)
+}
+
+// imageCollector reports image, snapshot and pool state from the database and
+// dmsetup at scrape time, so the values are correct across process restarts.
+type imageCollector struct {
+	store    metricsStore
+	pool     poolStatusSource
+	poolName string
+	logger   logrus.FieldLogger
+
+	downloaded      *prometheus.Desc
+	downloadBytes   *prometheus.Desc
+	unpacked        *prometheus.Desc
+	activated       *prometheus.Desc
+	activeSnapshots *prometheus.Desc
+	poolUp          *prometheus.Desc
+	poolDataUsage   *prometheus.Desc
+	poolMetaUsage   *prometheus.Desc
+}
+
+func newImageCollector(store metricsStore, pool poolStatusSource, poolName string, logger logrus.FieldLogger) *imageCollector {
+	poolLabels := prometheus.Labels{"pool": poolName}
+	return &imageCollector{
+		store:    store,
+		pool:     pool,
+		poolName: poolName,
+		logger:   logger.WithField("component", "metrics"),
+
+		downloaded:      prometheus.NewDesc("flyio_images_downloaded", "Images with a completed download.", nil, nil),
+		downloadBytes:   prometheus.NewDesc("flyio_downloaded_bytes", "Bytes of downloaded images.", nil, nil),
+		unpacked:        prometheus.NewDesc("flyio_images_unpacked", "Images unpacked into thin devices.", nil, nil),
+		activated:       prometheus.NewDesc("flyio_images_activated", "Images with an active snapshot.", nil, nil),
+		activeSnapshots: prometheus.NewDesc("flyio_active_snapshots", "Active snapshot devices.", nil, nil),
+		poolUp:          prometheus.NewDesc("flyio_pool_up", "Whether the thin-pool status could be read (1) or not (0).", nil, poolLabels),
+		poolDataUsage:   prometheus.NewDesc("flyio_pool_data_usage_percent", "Thin-pool data space in use.", nil, poolLabels),
+		poolMetaUsage:   prometheus.NewDesc("flyio_pool_metadata_usage_percent", "Thin-pool metadata space in use.", nil, poolLabels),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *imageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.downloaded
+	ch <- c.downloadBytes
+	ch <- c.unpacked
+	ch <- c.activated
+	ch <- c.activeSnapshots
+	ch <- c.poolUp
+	ch <- c.poolDataUsage
+	ch <- c.poolMetaUsage
+}
+
+// Collect implements prometheus.Collector. A failed database query is reported
+// as an invalid metric; an unreadable pool sets flyio_pool_up to 0.
+func (c *imageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if images, err := c.store.ListImages(ctx, ""); err != nil {
+		c.logger.WithError(err).Warn("failed to list images for metrics")
+		ch <- prometheus.NewInvalidMetric(c.downloaded, err)
+		ch <- prometheus.NewInvalidMetric(c.downloadBytes, err)
+		ch <- prometheus.NewInvalidMetric(c.activated, err)
+	} else {
+		var downloaded, activated int
+		var bytes int64
+		for _, img := range images {
+			if img.DownloadStatus == database.DownloadStatusCompleted {
+				downloaded++
+				bytes += img.SizeBytes
+			}
+			if img.ActivationStatus == database.ActivationStatusActive {
+				activated++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.downloaded, prometheus.GaugeValue, float64(downloaded))
+		ch <- prometheus.MustNewConstMetric(c.downloadBytes, prometheus.GaugeValue, float64(bytes))
+		ch <- prometheus.MustNewConstMetric(c.activated, prometheus.GaugeValue, float64(activated))
+	}
+
+	if unpacked, err := c.store.ListUnpackedImages(ctx); err != nil {
+		c.logger.WithError(err).Warn("failed to list unpacked images for metrics")
+		ch <- prometheus.NewInvalidMetric(c.unpacked, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.unpacked, prometheus.GaugeValue, float64(len(unpacked)))
+	}
+
+	if snapshots, err := c.store.ListActiveSnapshots(ctx); err != nil {
+		c.logger.WithError(err).Warn("failed to list snapshots for metrics")
+		ch <- prometheus.NewInvalidMetric(c.activeSnapshots, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.activeSnapshots, prometheus.GaugeValue, float64(len(snapshots)))
+	}
+
+	info, err := c.pool.ParsePoolStatus(ctx, c.poolName)
+	if err != nil {
+		c.logger.WithError(err).Debug("failed to read pool status for metrics")
+		ch <- prometheus.MustNewConstMetric(c.poolUp, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.poolUp, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(c.poolDataUsage, prometheus.GaugeValue, info.DataUsagePercent())
+	ch <- prometheus.MustNewConstMetric(c.poolMetaUsage, prometheus.GaugeValue, info.MetaUsagePercent())
+}
+
+// newMetricsHandler registers the image collector and failure counter on a
+// dedicated registry and returns a /metrics handler. The FSM library's own
+// metrics (fsm_action_count etc.) from the default registry are served too.
+func newMetricsHandler(store metricsStore, pool poolStatusSource, poolName string, logger logrus.FieldLogger) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newImageCollector(store, pool, poolName, logger), fsmFailuresTotal)
+
+	return promhttp.HandlerFor(
+		prometheus.Gatherers{reg, prometheus.DefaultGatherer},
+		promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError},
+	)
+}
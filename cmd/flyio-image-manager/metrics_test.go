@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// fakeMetricsStore serves canned rows for the metrics collector.
+type fakeMetricsStore struct {
+	fakeAPIStore
+	unpacked []*database.UnpackedImage
+}
+
+func (f *fakeMetricsStore) ListUnpackedImages(ctx context.Context) ([]*database.UnpackedImage, error) {
+	return f.unpacked, f.err
+}
+
+// fakePoolStatus returns a fixed pool status.
+type fakePoolStatus struct {
+	info *devicemapper.PoolInfo
+	err  error
+}
+
+func (f *fakePoolStatus) ParsePoolStatus(ctx context.Context, poolName string) (*devicemapper.PoolInfo, error) {
+	return f.info, f.err
+}
+
+func scrapeMetrics(t *testing.T, store metricsStore, pool poolStatusSource) string {
+	t.Helper()
+	srv := httptest.NewServer(newMetricsHandler(store, pool, "pool", quietLogger()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	store := &fakeMetricsStore{
+		fakeAPIStore: fakeAPIStore{
+			images: []*database.Image{
+				{ImageID: "img-1", DownloadStatus: database.DownloadStatusCompleted, SizeBytes: 1000, ActivationStatus: database.ActivationStatusActive},
+				{ImageID: "img-2", DownloadStatus: database.DownloadStatusCompleted, SizeBytes: 500},
+				{ImageID: "img-3", DownloadStatus: database.DownloadStatusDownloading},
+			},
+			snapshots: []*database.Snapshot{
+				{SnapshotID: "snap-1", ImageID: "img-1", Active: true},
+			},
+		},
+		unpacked: []*database.UnpackedImage{{ImageID: "img-1"}, {ImageID: "img-2"}},
+	}
+	pool := &fakePoolStatus{info: &devicemapper.PoolInfo{
+		TotalDataBlocks: 1000, UsedDataBlocks: 250,
+		TotalMetaBlocks: 100, UsedMetaBlocks: 10,
+	}}
+
+	fsmFailuresTotal.WithLabelValues("unpack").Inc()
+	body := scrapeMetrics(t, store, pool)
+
+	for _, want := range []string{
+		"# TYPE flyio_images_downloaded gauge",
+		"flyio_images_downloaded 2",
+		"flyio_downloaded_bytes 1500",
+		"flyio_images_unpacked 2",
+		"flyio_images_activated 1",
+		"flyio_active_snapshots 1",
+		`flyio_pool_up{pool="pool"} 1`,
+		`flyio_pool_data_usage_percent{pool="pool"} 25`,
+		`flyio_pool_metadata_usage_percent{pool="pool"} 10`,
+		`flyio_fsm_failures_total{phase="unpack"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsEndpoint_PoolUnavailable(t *testing.T) {
+	store := &fakeMetricsStore{}
+	pool := &fakePoolStatus{err: errors.New("pool not found")}
+
+	body := scrapeMetrics(t, store, pool)
+
+	if !strings.Contains(body, `flyio_pool_up{pool="pool"} 0`) {
+		t.Errorf("expected flyio_pool_up 0\n%s", body)
+	}
+	if strings.Contains(body, "flyio_pool_data_usage_percent{") {
+		t.Errorf("pool usage should be omitted when the pool is unreadable\n%s", body)
+	}
+	if !strings.Contains(body, "flyio_images_downloaded 0") {
+		t.Errorf("image metrics should still be served\n%s", body)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/superfly/fsm/database"
+)
+
+// migrateStore is the subset of *database.DB used by migrate.
+type migrateStore interface {
+	SchemaVersion(ctx context.Context) (int, error)
+	MigrationStatus(ctx context.Context) ([]database.MigrationStatus, error)
+	Migrate(ctx context.Context) ([]int, error)
+}
+
+// runMigrate applies pending schema migrations to --db, or with --status or
+// --schema-version only reports on them. Every other command applies
+// migrations when it opens the database; this runs them on their own, e.g.
+// before starting an upgraded daemon.
+func runMigrate(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	db, err := database.New(database.Config{Path: cfg.DBPath, SkipMigrations: true})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	switch {
+	case cfg.SchemaVer:
+		version, err := db.SchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(version)
+		return nil
+	case cfg.Status:
+		return printMigrationStatus(ctx, os.Stdout, db)
+	default:
+		return applyMigrations(ctx, os.Stdout, db)
+	}
+}
+
+// applyMigrations runs pending migrations and reports each one applied.
+func applyMigrations(ctx context.Context, w io.Writer, store migrateStore) error {
+	from, err := store.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if from > database.LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", from, database.LatestSchemaVersion())
+	}
+
+	applied, err := store.Migrate(ctx)
+	for _, version := range applied {
+		fmt.Fprintf(w, "Applied migration %d\n", version)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Fprintf(w, "Schema is up to date (version %d)\n", from)
+		return nil
+	}
+	fmt.Fprintf(w, "Migrated schema from version %d to %d\n", from, applied[len(applied)-1])
+	return nil
+}
+
+// printMigrationStatus lists every migration and when it was applied.
+func printMigrationStatus(ctx context.Context, w io.Writer, store migrateStore) error {
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := store.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	fmt.Fprintf(w, "%-8s %-25s %s\n", "VERSION", "APPLIED", "DESCRIPTION")
+	for _, m := range status {
+		applied := "pending"
+		if m.AppliedAt != nil {
+			applied = m.AppliedAt.Format(time.RFC3339)
+		} else {
+			pending++
+		}
+		fmt.Fprintf(w, "%-8d %-25s %s\n", m.Version, applied, m.Description)
+	}
+
+	fmt.Fprintf(w, "\nSchema version %d of %d, %d pending\n", version, database.LatestSchemaVersion(), pending)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/database"
+)
+
+// fakeMigrateStore is a schema at version with the remaining migrations
+// pending.
+type fakeMigrateStore struct {
+	version    int
+	migrateErr error
+}
+
+func (s *fakeMigrateStore) SchemaVersion(ctx context.Context) (int, error) {
+	return s.version, nil
+}
+
+func (s *fakeMigrateStore) MigrationStatus(ctx context.Context) ([]database.MigrationStatus, error) {
+	var status []database.MigrationStatus
+	for v := 1; v <= database.LatestSchemaVersion(); v++ {
+		m := database.MigrationStatus{Version: v, Description: "migration"}
+		if v <= s.version {
+			at := time.Date(2025, 11, 21, 20, 0, 0, 0, time.UTC)
+			m.AppliedAt = &at
+		}
+		status = append(status, m)
+	}
+	return status, nil
+}
+
+func (s *fakeMigrateStore) Migrate(ctx context.Context) ([]int, error) {
+	var applied []int
+	for v := s.version + 1; v <= database.LatestSchemaVersion(); v++ {
+		if s.migrateErr != nil {
+			return applied, s.migrateErr
+		}
+		applied = append(applied, v)
+		s.version = v
+	}
+	return applied, nil
+}
+
+func TestApplyMigrations(t *testing.T) {
+	latest := database.LatestSchemaVersion()
+	store := &fakeMigrateStore{version: 1}
+
+	var out bytes.Buffer
+	if err := applyMigrations(context.Background(), &out, store); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Applied migration 2\n") || !strings.Contains(out.String(), "from version 1 to") {
+		t.Errorf("output = %q, want each applied migration and the version change", out.String())
+	}
+	if store.version != latest {
+		t.Errorf("version = %d, want %d", store.version, latest)
+	}
+
+	out.Reset()
+	if err := applyMigrations(context.Background(), &out, store); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "up to date") {
+		t.Errorf("second run output = %q, want up to date", out.String())
+	}
+}
+
+func TestApplyMigrations_Errors(t *testing.T) {
+	newer := &fakeMigrateStore{version: database.LatestSchemaVersion() + 1}
+	if err := applyMigrations(context.Background(), &bytes.Buffer{}, newer); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("applyMigrations(newer schema) = %v, want newer-than-build error", err)
+	}
+
+	failing := &fakeMigrateStore{version: 1, migrateErr: errors.New("disk I/O error")}
+	if err := applyMigrations(context.Background(), &bytes.Buffer{}, failing); err == nil {
+		t.Error("applyMigrations() succeeded despite a failed migration")
+	}
+}
+
+func TestPrintMigrationStatus(t *testing.T) {
+	var out bytes.Buffer
+	if err := printMigrationStatus(context.Background(), &out, &fakeMigrateStore{version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if !strings.Contains(got, "2025-11-21T20:00:00Z") || !strings.Contains(got, "pending") {
+		t.Errorf("status = %q, want applied and pending migrations", got)
+	}
+	latest := database.LatestSchemaVersion()
+	if want := fmt.Sprintf("Schema version 1 of %d, %d pending\n", latest, latest-1); !strings.HasSuffix(got, want) {
+		t.Errorf("status = %q, want it to end with %q", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// onCompleteExecTimeout bounds each --on-complete-exec command.
+const onCompleteExecTimeout = 30 * time.Second
+
+// completionPayload is the JSON body POSTed to --on-complete-webhook and
+// written to --on-complete-exec's stdin when a pipeline run finishes.
+type completionPayload struct {
+	S3Key           string    `json:"s3_key"`
+	ImageID         string    `json:"image_id"`
+	SnapshotID      string    `json:"snapshot_id,omitempty"`
+	SnapshotName    string    `json:"snapshot_name,omitempty"`
+	DevicePath      string    `json:"device_path,omitempty"`
+	Layout          string    `json:"layout,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Success         bool      `json:"success"`
+	Error           string    `json:"error,omitempty"`
+	Time            time.Time `json:"time"`
+}
+
+func newCompletionPayload(cfg Config, result *pipelineResult, duration time.Duration, runErr error, now time.Time) completionPayload {
+	p := completionPayload{
+		S3Key:           cfg.S3Key,
+		ImageID:         cfg.ImageID,
+		DurationSeconds: duration.Seconds(),
+		Success:         runErr == nil,
+		Time:            now.UTC(),
+	}
+	if result != nil {
+		p.SnapshotID = result.SnapshotID
+		p.SnapshotName = result.SnapshotName
+		p.DevicePath = result.DevicePath
+		p.Layout = result.Layout
+	}
+	if runErr != nil {
+		p.Error = runErr.Error()
+	}
+	return p
+}
+
+// notifier tells an external system that a pipeline run finished.
+type notifier interface {
+	Notify(ctx context.Context, payload completionPayload) error
+}
+
+// webhookNotifier POSTs the payload to a URL.
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, payload completionPayload) error {
+	return postJSON(ctx, n.client, n.url, payload)
+}
+
+// execNotifier runs a shell command with the payload on stdin.
+type execNotifier struct {
+	command string
+}
+
+func (n *execNotifier) Notify(ctx context.Context, payload completionPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, onCompleteExecTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", n.command)
+	cmd.Stdin = bytes.NewReader(body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%q: %w: %s", n.command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// notifiers sends to each notifier in turn, returning their errors joined.
+type notifiers []notifier
+
+func (ns notifiers) Notify(ctx context.Context, payload completionPayload) error {
+	var errs []error
+	for _, n := range ns {
+		if err := n.Notify(ctx, payload); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newCompletionNotifier returns the notifier for --on-complete-webhook and
+// --on-complete-exec, or nil if neither is set.
+func newCompletionNotifier(cfg Config, client *http.Client) notifier {
+	var ns notifiers
+	if cfg.OnCompleteWebhook != "" {
+		ns = append(ns, &webhookNotifier{client: client, url: cfg.OnCompleteWebhook})
+	}
+	if cfg.OnCompleteExec != "" {
+		ns = append(ns, &execNotifier{command: cfg.OnCompleteExec})
+	}
+	if len(ns) == 0 {
+		return nil
+	}
+	return ns
+}
+
+// notifyCompletion reports a finished run of cfg.S3Key/cfg.ImageID to n. A
+// failed notification is logged; it never changes the run's outcome.
+func notifyCompletion(ctx context.Context, n notifier, logger logrus.FieldLogger, cfg Config, result *pipelineResult, duration time.Duration, runErr error) {
+	if n == nil {
+		return
+	}
+	payload := newCompletionPayload(cfg, result, duration, runErr, time.Now())
+	if err := n.Notify(ctx, payload); err != nil {
+		logger.WithError(err).WithField("image_id", cfg.ImageID).Warn("failed to send completion notification")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifyCompletion_Webhook(t *testing.T) {
+	tests := []struct {
+		name   string
+		result *pipelineResult
+		err    error
+		want   completionPayload
+	}{
+		{
+			name: "success",
+			result: &pipelineResult{
+				ImageID:      "img_abc",
+				SnapshotID:   "42-snap",
+				SnapshotName: "snap-img_abc",
+				DevicePath:   "/dev/mapper/thin-42-snap",
+			},
+			want: completionPayload{
+				S3Key:           "images/alpine.tar",
+				ImageID:         "img_abc",
+				SnapshotID:      "42-snap",
+				SnapshotName:    "snap-img_abc",
+				DevicePath:      "/dev/mapper/thin-42-snap",
+				DurationSeconds: 90,
+				Success:         true,
+			},
+		},
+		{
+			name: "failure",
+			err:  errors.New("unpack FSM failed: pool full"),
+			want: completionPayload{
+				S3Key:           "images/alpine.tar",
+				ImageID:         "img_abc",
+				DurationSeconds: 90,
+				Error:           "unpack FSM failed: pool full",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(chan completionPayload, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var p completionPayload
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("webhook request = %s %s, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+				}
+				if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+					t.Errorf("decode payload: %v", err)
+				}
+				got <- p
+			}))
+			defer srv.Close()
+
+			cfg := Config{S3Key: "images/alpine.tar", ImageID: "img_abc", OnCompleteWebhook: srv.URL}
+			n := newCompletionNotifier(cfg, srv.Client())
+			notifyCompletion(context.Background(), n, quietLogger(), cfg, tt.result, 90*time.Second, tt.err)
+
+			select {
+			case p := <-got:
+				if p.Time.IsZero() {
+					t.Error("payload time is zero")
+				}
+				p.Time = time.Time{}
+				if p != tt.want {
+					t.Errorf("payload = %+v, want %+v", p, tt.want)
+				}
+			default:
+				t.Fatal("no webhook POST received")
+			}
+		})
+	}
+}
+
+func TestNotifyCompletion_Exec(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "payload.json")
+	cfg := Config{S3Key: "images/alpine.tar", ImageID: "img_abc", OnCompleteExec: "cat > " + out}
+
+	n := newCompletionNotifier(cfg, http.DefaultClient)
+	notifyCompletion(context.Background(), n, quietLogger(), cfg, &pipelineResult{SnapshotID: "42-snap"}, time.Second, nil)
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("command did not write the payload: %v", err)
+	}
+	var p completionPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if p.ImageID != "img_abc" || p.SnapshotID != "42-snap" || !p.Success {
+		t.Errorf("payload = %+v, want a successful run of img_abc", p)
+	}
+}
+
+func TestNotifiers_JoinsErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	n := newCompletionNotifier(Config{OnCompleteWebhook: srv.URL, OnCompleteExec: "exit 3"}, srv.Client())
+	err := n.Notify(context.Background(), completionPayload{})
+	if err == nil {
+		t.Fatal("Notify() error = nil, want the webhook and command failures")
+	}
+
+	if newCompletionNotifier(Config{}, http.DefaultClient) != nil {
+		t.Error("newCompletionNotifier() with nothing configured is not nil")
+	}
+}
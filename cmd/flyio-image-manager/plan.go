@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/superfly/fsm/activate"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/humanize"
+	"github.com/superfly/fsm/s3"
+	"github.com/superfly/fsm/unpack"
+)
+
+// planStore is the subset of *database.DB used by process-image --plan.
+type planStore interface {
+	CheckImageDownloaded(ctx context.Context, s3Key string) (*database.Image, error)
+	CheckImageUnpacked(ctx context.Context, imageID string) (*database.UnpackedImage, error)
+	CheckSnapshotExists(ctx context.Context, imageID, snapshotName string) (*database.Snapshot, error)
+	GetDeviceID(ctx context.Context, owner string) (string, error)
+	GetDeviceIDOwner(ctx context.Context, deviceID string) (string, error)
+}
+
+// objectSizer is the subset of *s3.Client used by process-image --plan.
+type objectSizer interface {
+	GetObjectSize(ctx context.Context, bucket, key string) (int64, error)
+}
+
+// PlanStep is what process-image would do in one phase.
+type PlanStep struct {
+	Skip   bool   // The FSM would hand off without doing any work
+	Reason string // Why, from the database state
+}
+
+// ProcessPlan describes what process-image would do for one S3 key.
+type ProcessPlan struct {
+	Bucket       string
+	S3Key        string
+	ImageID      string
+	ObjectSize   int64
+	DeviceID     string
+	DeviceName   string
+	SnapshotName string
+
+	Download PlanStep
+	Unpack   PlanStep
+	Activate PlanStep
+}
+
+// runProcessPlan prints what process-image would do without running any FSM.
+// It reads the database and HEADs the S3 object; it takes no locks and runs
+// no dmsetup commands, so it is safe to use while other work is in flight.
+func runProcessPlan(cfg Config) error {
+	ctx := context.Background()
+
+	db, err := database.New(database.Config{Path: cfg.DBPath})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	s3Client, err := s3.New(ctx, newS3Config(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	s3Client.SetLogger(log)
+
+	plan, err := planProcessImage(ctx, db, s3Client, cfg.S3Bucket, cfg.S3Key, cfg.ImageID)
+	if err != nil {
+		return err
+	}
+	printProcessPlan(os.Stdout, plan)
+	return nil
+}
+
+// planProcessImage derives the identifiers process-image would use and
+// predicts, from the database alone, which phases would be skipped.
+//
+// The FSMs also check that recorded devices still exist before skipping a
+// phase. The plan cannot see a device removed behind the database's back;
+// 'recover' reconciles those rows.
+func planProcessImage(ctx context.Context, store planStore, objects objectSizer, bucket, s3Key, imageID string) (*ProcessPlan, error) {
+	size, err := objects.GetObjectSize(ctx, bucket, s3Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up s3://%s/%s: %w", bucket, s3Key, err)
+	}
+
+	plan := &ProcessPlan{
+		Bucket:       bucket,
+		S3Key:        s3Key,
+		ImageID:      imageID,
+		ObjectSize:   size,
+		DeviceID:     unpack.DeviceIDForImage(imageID),
+		DeviceName:   unpack.DeviceNameForImage(imageID),
+		SnapshotName: activate.SnapshotNameForImage(imageID),
+	}
+
+	img, err := store.CheckImageDownloaded(ctx, s3Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check download: %w", err)
+	}
+	switch {
+	case img == nil:
+		plan.Download.Reason = "not downloaded"
+	case !fileHasSize(img.LocalPath, img.SizeBytes):
+		plan.Download.Reason = fmt.Sprintf("recorded, but %s is missing or the wrong size", img.LocalPath)
+	default:
+		plan.Download = PlanStep{Skip: true, Reason: "already at " + img.LocalPath}
+	}
+
+	unpacked, err := store.CheckImageUnpacked(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check unpacked image: %w", err)
+	}
+	if unpacked == nil {
+		holder, err := planDeviceID(ctx, store, plan)
+		if err != nil {
+			return nil, err
+		}
+		plan.Unpack.Reason = fmt.Sprintf("not unpacked; will create %s", plan.DeviceName)
+		if holder != "" {
+			plan.Unpack.Reason = fmt.Sprintf("not unpacked; ID %s is held by %s, so the device will get the next free ID", plan.DeviceID, holder)
+		}
+	} else {
+		// An existing record wins over the derived name.
+		plan.DeviceID, plan.DeviceName = unpacked.DeviceID, unpacked.DeviceName
+		plan.Unpack = PlanStep{Skip: true, Reason: "already unpacked to " + unpacked.DeviceName}
+	}
+
+	snap, err := store.CheckSnapshotExists(ctx, imageID, plan.SnapshotName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check snapshot: %w", err)
+	}
+	if snap == nil {
+		plan.Activate.Reason = fmt.Sprintf("no active snapshot; will create %s", plan.SnapshotName)
+	} else {
+		plan.Activate = PlanStep{Skip: true, Reason: fmt.Sprintf("snapshot %s already active at %s", snap.SnapshotID, snap.DevicePath)}
+	}
+
+	return plan, nil
+}
+
+// planDeviceID replaces the image's preferred device ID with the one already
+// allocated to it, if any. Otherwise it returns the owner holding the preferred
+// ID, if another image or snapshot does, in which case unpack will allocate an
+// ID the plan cannot predict.
+func planDeviceID(ctx context.Context, store planStore, plan *ProcessPlan) (string, error) {
+	id, err := store.GetDeviceID(ctx, database.ImageDeviceOwner(plan.ImageID))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up device ID: %w", err)
+	}
+	if id != "" {
+		plan.DeviceID, plan.DeviceName = id, unpack.DeviceNameForID(id)
+		return "", nil
+	}
+
+	holder, err := store.GetDeviceIDOwner(ctx, plan.DeviceID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up device ID owner: %w", err)
+	}
+	return holder, nil
+}
+
+// fileHasSize reports whether path exists with the given size, which is what
+// the download FSM checks before trusting a recorded download.
+func fileHasSize(path string, size int64) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Size() == size
+}
+
+// printProcessPlan writes a plan in the order the phases would run.
+func printProcessPlan(w io.Writer, p *ProcessPlan) {
+	fmt.Fprintf(w, "Plan for s3://%s/%s\n", p.Bucket, p.S3Key)
+	fmt.Fprintf(w, "  Image ID:    %s\n", p.ImageID)
+	fmt.Fprintf(w, "  Object size: %s\n", humanize.Bytes(p.ObjectSize))
+	fmt.Fprintf(w, "  Device:      %s (ID %s)\n", p.DeviceName, p.DeviceID)
+	fmt.Fprintf(w, "  Snapshot:    %s\n", p.SnapshotName)
+	fmt.Fprintln(w)
+	for _, s := range []struct {
+		phase string
+		step  PlanStep
+	}{
+		{"download", p.Download},
+		{"unpack", p.Unpack},
+		{"activate", p.Activate},
+	} {
+		action := "run "
+		if s.step.Skip {
+			action = "skip"
+		}
+		fmt.Fprintf(w, "  %-9s %s  %s\n", s.phase, action, s.step.Reason)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fsm "github.com/superfly/fsm"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/unpack"
+)
+
+// fakePlanStore returns fixed rows regardless of the key asked for.
+type fakePlanStore struct {
+	image     *database.Image
+	unpacked  *database.UnpackedImage
+	snapshot  *database.Snapshot
+	deviceIDs map[string]string // owner -> allocated device ID
+}
+
+func (f *fakePlanStore) CheckImageDownloaded(ctx context.Context, s3Key string) (*database.Image, error) {
+	return f.image, nil
+}
+
+func (f *fakePlanStore) CheckImageUnpacked(ctx context.Context, imageID string) (*database.UnpackedImage, error) {
+	return f.unpacked, nil
+}
+
+func (f *fakePlanStore) CheckSnapshotExists(ctx context.Context, imageID, snapshotName string) (*database.Snapshot, error) {
+	return f.snapshot, nil
+}
+
+func (f *fakePlanStore) GetDeviceID(ctx context.Context, owner string) (string, error) {
+	return f.deviceIDs[owner], nil
+}
+
+func (f *fakePlanStore) GetDeviceIDOwner(ctx context.Context, deviceID string) (string, error) {
+	for owner, id := range f.deviceIDs {
+		if id == deviceID {
+			return owner, nil
+		}
+	}
+	return "", nil
+}
+
+// fakeSizer reports every object as size bytes, or fails with err.
+type fakeSizer struct {
+	size int64
+	err  error
+}
+
+func (f fakeSizer) GetObjectSize(ctx context.Context, bucket, key string) (int64, error) {
+	return f.size, f.err
+}
+
+func TestPlanProcessImage_FreshImage(t *testing.T) {
+	imageID := fsm.DeriveImageIDFromS3Key("images/golang/1.tar")
+
+	plan, err := planProcessImage(context.Background(), &fakePlanStore{}, fakeSizer{size: 3 << 30}, "flyio-images", "images/golang/1.tar", imageID)
+	if err != nil {
+		t.Fatalf("planProcessImage() error = %v", err)
+	}
+
+	if plan.Download.Skip || plan.Unpack.Skip || plan.Activate.Skip {
+		t.Errorf("plan = %+v, want every phase to run", plan)
+	}
+	if plan.DeviceName != "thin-"+plan.DeviceID || plan.SnapshotName != "snap-"+imageID {
+		t.Errorf("derived device %s (ID %s) and snapshot %s", plan.DeviceName, plan.DeviceID, plan.SnapshotName)
+	}
+
+	var out bytes.Buffer
+	printProcessPlan(&out, plan)
+	for _, want := range []string{
+		"Plan for s3://flyio-images/images/golang/1.tar",
+		"Image ID:    " + imageID,
+		"Object size: 3.0 GB",
+		"Device:      " + plan.DeviceName + " (ID " + plan.DeviceID + ")",
+		"download  run   not downloaded",
+		"unpack    run   not unpacked; will create " + plan.DeviceName,
+		"activate  run   no active snapshot; will create snap-" + imageID,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("plan output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPlanProcessImage_AlreadyUnpacked(t *testing.T) {
+	imageID := fsm.DeriveImageIDFromS3Key("images/golang/1.tar")
+	tarPath := filepath.Join(t.TempDir(), imageID+".tar")
+	if err := os.WriteFile(tarPath, make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &fakePlanStore{
+		image:    &database.Image{ImageID: imageID, LocalPath: tarPath, SizeBytes: 1024},
+		unpacked: &database.UnpackedImage{ImageID: imageID, DeviceID: "4242", DeviceName: "thin-4242"},
+	}
+	plan, err := planProcessImage(context.Background(), store, fakeSizer{size: 1024}, "flyio-images", "images/golang/1.tar", imageID)
+	if err != nil {
+		t.Fatalf("planProcessImage() error = %v", err)
+	}
+
+	if !plan.Download.Skip || !plan.Unpack.Skip || plan.Activate.Skip {
+		t.Errorf("plan = %+v, want download and unpack skipped and activate to run", plan)
+	}
+	if plan.DeviceName != "thin-4242" || plan.DeviceID != "4242" {
+		t.Errorf("device = %s (ID %s), want the recorded thin-4242", plan.DeviceName, plan.DeviceID)
+	}
+
+	var out bytes.Buffer
+	printProcessPlan(&out, plan)
+	for _, want := range []string{
+		"download  skip  already at " + tarPath,
+		"unpack    skip  already unpacked to thin-4242",
+		"activate  run   no active snapshot",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("plan output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPlanProcessImage_RecordedDownloadMissing(t *testing.T) {
+	store := &fakePlanStore{
+		image: &database.Image{LocalPath: filepath.Join(t.TempDir(), "gone.tar"), SizeBytes: 1024},
+	}
+	plan, err := planProcessImage(context.Background(), store, fakeSizer{size: 1024}, "flyio-images", "images/golang/1.tar", "img_1234abcd5678ef00")
+	if err != nil {
+		t.Fatalf("planProcessImage() error = %v", err)
+	}
+	if plan.Download.Skip || !strings.Contains(plan.Download.Reason, "missing") {
+		t.Errorf("download step = %+v, want a re-download of the missing file", plan.Download)
+	}
+}
+
+func TestPlanProcessImage_HeadFails(t *testing.T) {
+	_, err := planProcessImage(context.Background(), &fakePlanStore{}, fakeSizer{err: errors.New("NotFound")}, "flyio-images", "images/nope.tar", "img_1234abcd5678ef00")
+	if err == nil {
+		t.Fatal("expected error when the object cannot be found")
+	}
+}
+
+func TestPlanProcessImage_AllocatedDeviceID(t *testing.T) {
+	imageID := fsm.DeriveImageIDFromS3Key("images/golang/1.tar")
+	preferred := unpack.DeviceIDForImage(imageID)
+
+	// An ID allocated by an earlier, interrupted unpack wins over the preferred one.
+	store := &fakePlanStore{deviceIDs: map[string]string{database.ImageDeviceOwner(imageID): "77"}}
+	plan, err := planProcessImage(context.Background(), store, fakeSizer{size: 1 << 20}, "flyio-images", "images/golang/1.tar", imageID)
+	if err != nil {
+		t.Fatalf("planProcessImage() error = %v", err)
+	}
+	if plan.DeviceID != "77" || plan.DeviceName != "thin-77" {
+		t.Errorf("plan device = %s (ID %s), want thin-77", plan.DeviceName, plan.DeviceID)
+	}
+
+	// A preferred ID held by another image is reported, not promised.
+	store = &fakePlanStore{deviceIDs: map[string]string{database.ImageDeviceOwner("img_other"): preferred}}
+	plan, err = planProcessImage(context.Background(), store, fakeSizer{size: 1 << 20}, "flyio-images", "images/golang/1.tar", imageID)
+	if err != nil {
+		t.Fatalf("planProcessImage() error = %v", err)
+	}
+	if !strings.Contains(plan.Unpack.Reason, "image:img_other") {
+		t.Errorf("Unpack.Reason = %q, want it to name the holder of ID %s", plan.Unpack.Reason, preferred)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// runPoolCheck runs thin_check against a metadata snapshot of the pool and
+// returns thin_check's exit status (0 when clean) as the process exit code.
+func runPoolCheck(cfg Config) (int, error) {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+
+	// The lock also keeps FSMs from reserving or releasing the metadata
+	// snapshot while thin_check reads it.
+	var result *devicemapper.PoolCheckResult
+	err := withDMCommand(ctx, cfg, "pool-check:"+cfg.PoolName, false, func() error {
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+
+		var err error
+		result, err = dmClient.CheckPoolMetadata(ctx, cfg.PoolName)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if result.Clean {
+		fmt.Printf("%s: clean (metadata %s)\n", cfg.PoolName, result.MetadataDevice)
+		return 0, nil
+	}
+	fmt.Printf("%s: CORRUPT (thin_check exited %d on metadata %s)\n\n%s", cfg.PoolName, result.ExitCode, result.MetadataDevice, result.Output)
+	return result.ExitCode, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// DefaultReapIdle is how long a snapshot must go unaccessed before
+// reap-snapshots deactivates it.
+const DefaultReapIdle = 24 * time.Hour
+
+// idleDeactivator is the subset of *devicemapper.Client used by
+// reap-snapshots. A snapshot that has not been accessed may still be in use by
+// a VM, so only devices that are unmounted and not held open are removed, and
+// never with --force.
+type idleDeactivator interface {
+	DeactivateIdleDevice(ctx context.Context, deviceName string) error
+}
+
+// idleSnapshotStore is the subset of *database.DB used by reap-snapshots.
+type idleSnapshotStore interface {
+	ListIdleSnapshots(ctx context.Context, idleSince time.Time) ([]*database.Snapshot, error)
+	DeactivateSnapshot(ctx context.Context, snapshotID string) error
+}
+
+// runReapSnapshots deactivates active snapshots that have not been accessed
+// for cfg.Idle. Without --force it only reports them.
+func runReapSnapshots(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+	if cfg.Idle <= 0 {
+		return fmt.Errorf("--idle must be positive, got %s", cfg.Idle)
+	}
+
+	ctx := context.Background()
+	logger := log.WithFields(logrus.Fields{
+		"command": "reap-snapshots",
+		"idle":    cfg.Idle.String(),
+	})
+	dryRun := !cfg.Force
+
+	if dryRun {
+		logger.Info("Running in DRY RUN mode - no changes will be made (use --force to deactivate)")
+	}
+
+	return withDMCommand(ctx, cfg, "reap-snapshots", dryRun, func() error {
+		db, err := database.New(database.Config{Path: cfg.DBPath})
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+		dmClient.SetOperationRecorder(dmRecorder{db})
+
+		now := time.Now()
+		reaped, err := reapSnapshots(ctx, logger, db, dmClient, now, cfg.Idle, dryRun)
+		for _, snap := range reaped {
+			idleFor := now.Sub(snap.LastAccess()).Round(time.Minute)
+			if dryRun {
+				fmt.Printf("Would deactivate %s (device %s, idle %s)\n", snap.SnapshotID, snap.SnapshotName, idleFor)
+			} else {
+				fmt.Printf("Deactivated %s (device %s, idle %s)\n", snap.SnapshotID, snap.SnapshotName, idleFor)
+			}
+		}
+		if err == nil && len(reaped) == 0 {
+			fmt.Printf("No snapshots idle for more than %s\n", cfg.Idle)
+		}
+		return err
+	})
+}
+
+// reapSnapshots deactivates the active snapshots not accessed since
+// now-idle, least recently accessed first, and returns those it deactivated
+// (or, in dry-run mode, would deactivate). Snapshots whose devices are in use
+// are skipped.
+func reapSnapshots(ctx context.Context, logger logrus.FieldLogger, store idleSnapshotStore, dm idleDeactivator, now time.Time, idle time.Duration, dryRun bool) ([]*database.Snapshot, error) {
+	targets, err := store.ListIdleSnapshots(ctx, now.Add(-idle))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list idle snapshots: %w", err)
+	}
+	return deactivateEach(ctx, logger, store, dm.DeactivateIdleDevice, targets, dryRun)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// ListIdleSnapshots mirrors the database: active snapshots last accessed
+// before idleSince, least recently accessed first.
+func (s *fakeSnapshotStore) ListIdleSnapshots(ctx context.Context, idleSince time.Time) ([]*database.Snapshot, error) {
+	var out []*database.Snapshot
+	for _, snap := range s.snapshots {
+		if snap.Active && snap.LastAccess().Before(idleSince) {
+			out = append(out, snap)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastAccess().Before(out[j].LastAccess()) })
+	return out, nil
+}
+
+// fakeIdleDeactivator records the devices it removed, reporting those in busy
+// as in use.
+type fakeIdleDeactivator struct {
+	removed []string
+	busy    map[string]bool
+}
+
+func (f *fakeIdleDeactivator) DeactivateIdleDevice(ctx context.Context, deviceName string) error {
+	if f.busy[deviceName] {
+		return &devicemapper.DeviceBusyError{DeviceName: deviceName, OpenCount: 1}
+	}
+	f.removed = append(f.removed, deviceName)
+	return nil
+}
+
+func TestReapSnapshots(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	accessed := now.Add(-time.Hour)
+	newStore := func() *fakeSnapshotStore {
+		return newFakeSnapshotStore(
+			&database.Snapshot{SnapshotID: "1", SnapshotName: "snap-old", Active: true, CreatedAt: now.Add(-72 * time.Hour)},
+			&database.Snapshot{SnapshotID: "2", SnapshotName: "snap-used", Active: true, CreatedAt: now.Add(-72 * time.Hour), LastAccessedAt: &accessed},
+			&database.Snapshot{SnapshotID: "3", SnapshotName: "snap-idle", Active: true, CreatedAt: now.Add(-30 * time.Hour)},
+			&database.Snapshot{SnapshotID: "4", SnapshotName: "snap-new", Active: true, CreatedAt: now.Add(-time.Hour)},
+		)
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		store := newStore()
+		dm := &fakeIdleDeactivator{}
+		reaped, err := reapSnapshots(context.Background(), quietLogger(), store, dm, now, 24*time.Hour, true)
+		if err != nil {
+			t.Fatalf("reapSnapshots() error = %v", err)
+		}
+		if got := snapshotNames(reaped); got != "snap-old,snap-idle" {
+			t.Errorf("reaped = %s, want snap-old,snap-idle", got)
+		}
+		if len(dm.removed) != 0 || !store.snapshots["1"].Active {
+			t.Errorf("dry run changed state: removed %v", dm.removed)
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		store := newStore()
+		dm := &fakeIdleDeactivator{}
+		if _, err := reapSnapshots(context.Background(), quietLogger(), store, dm, now, 24*time.Hour, false); err != nil {
+			t.Fatalf("reapSnapshots() error = %v", err)
+		}
+		if got := strings.Join(dm.removed, ","); got != "snap-old,snap-idle" {
+			t.Errorf("removed devices = %s, want snap-old,snap-idle", got)
+		}
+		for id, wantActive := range map[string]bool{"1": false, "2": true, "3": false, "4": true} {
+			if store.snapshots[id].Active != wantActive {
+				t.Errorf("snapshot %s active = %v, want %v", id, store.snapshots[id].Active, wantActive)
+			}
+		}
+	})
+
+	t.Run("busy snapshot is skipped", func(t *testing.T) {
+		// Idle only means unaccessed; a VM may still have the device open
+		store := newStore()
+		dm := &fakeIdleDeactivator{busy: map[string]bool{"snap-old": true}}
+		reaped, err := reapSnapshots(context.Background(), quietLogger(), store, dm, now, 24*time.Hour, false)
+		if err != nil {
+			t.Fatalf("reapSnapshots() error = %v", err)
+		}
+		if got := snapshotNames(reaped); got != "snap-idle" {
+			t.Errorf("reaped = %s, want snap-idle", got)
+		}
+		if !store.snapshots["1"].Active || store.snapshots["3"].Active {
+			t.Errorf("active = %v/%v, want the busy snapshot kept active and the idle one deactivated", store.snapshots["1"].Active, store.snapshots["3"].Active)
+		}
+	})
+}
+
+func snapshotNames(snaps []*database.Snapshot) string {
+	var names []string
+	for _, s := range snaps {
+		names = append(names, s.SnapshotName)
+	}
+	return strings.Join(names, ",")
+}
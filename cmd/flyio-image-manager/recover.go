@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// recoverStore is the subset of *database.DB used by recover.
+type recoverStore interface {
+	ListUnpackedImages(ctx context.Context) ([]*database.UnpackedImage, error)
+	ListActiveSnapshots(ctx context.Context) ([]*database.Snapshot, error)
+	GetSnapshotsByImageID(ctx context.Context, imageID string) ([]*database.Snapshot, error)
+	DeactivateSnapshot(ctx context.Context, snapshotID string) error
+	DeleteSnapshot(ctx context.Context, snapshotID string) error
+	DeleteUnpackedImage(ctx context.Context, imageID string) error
+}
+
+// deviceChecker is the subset of *devicemapper.Client used by recover.
+type deviceChecker interface {
+	DeviceExists(ctx context.Context, deviceName string) (bool, error)
+}
+
+// RecoverResult reports what recover found and changed.
+type RecoverResult struct {
+	SnapshotsChecked int
+	UnpackedChecked  int
+
+	// SnapshotsDeactivated lists active snapshots whose device was missing.
+	SnapshotsDeactivated []string
+	// UnpackedRemoved lists images whose unpacked device was missing; their
+	// unpacked row and snapshot rows were deleted so the next run re-unpacks.
+	UnpackedRemoved []string
+	// UnpackedKept lists images whose unpacked device is missing but which
+	// still have a live snapshot, so their rows were left alone.
+	UnpackedKept []string
+}
+
+// runRecover reconciles the database against the devices that actually
+// exist, for use after a reboot or kernel panic.
+func runRecover(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	logger := log.WithField("command", "recover")
+
+	if cfg.DryRun {
+		logger.Info("Running in DRY RUN mode - no changes will be made")
+	}
+
+	return withDMCommand(ctx, cfg, "recover", cfg.DryRun, func() error {
+		// The pool has to be there before its devices can be checked. In
+		// dry-run mode a missing pool is only reported; every device will
+		// show as missing.
+		if cfg.DryRun {
+			if err := checkPoolExists(ctx, cfg.PoolName); err != nil {
+				logger.WithError(err).Warn("pool not ready")
+			}
+		} else if err := ensurePoolReady(ctx, cfg); err != nil {
+			return err
+		}
+
+		db, err := database.New(database.Config{Path: cfg.DBPath})
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+		dmClient.SetOperationRecorder(dmRecorder{db})
+
+		result, err := reconcileDevices(ctx, logger, db, dmClient, cfg.DryRun)
+		if result != nil {
+			printRecoverResult(result, cfg.DryRun)
+		}
+		return err
+	})
+}
+
+// printRecoverResult prints a summary of a recover run.
+func printRecoverResult(r *RecoverResult, dryRun bool) {
+	verb := ""
+	if dryRun {
+		verb = "Would have "
+	}
+	fmt.Printf("Checked %d active snapshots and %d unpacked images\n", r.SnapshotsChecked, r.UnpackedChecked)
+	for _, id := range r.SnapshotsDeactivated {
+		fmt.Printf("%sDeactivated snapshot %s (device missing)\n", verb, id)
+	}
+	for _, id := range r.UnpackedRemoved {
+		fmt.Printf("%sRemoved unpacked record for %s (device missing)\n", verb, id)
+	}
+	for _, id := range r.UnpackedKept {
+		fmt.Printf("Kept unpacked record for %s: device missing but a snapshot is still active\n", id)
+	}
+	if len(r.SnapshotsDeactivated) == 0 && len(r.UnpackedRemoved) == 0 && len(r.UnpackedKept) == 0 {
+		fmt.Println("Database matches devicemapper state")
+	}
+}
+
+// reconcileDevices marks database rows whose device no longer exists so the
+// next process-image recreates them: active snapshots are deactivated and
+// unpacked images are deleted along with their snapshot rows (which reference
+// the unpacked device).
+//
+// CRITICAL: Only database rows are changed. A device that is merely inactive
+// still holds blocks in the pool; 'gc' finds it in pool metadata as an orphan.
+//
+// Processing stops at the first error, leaving the remaining rows for a rerun.
+func reconcileDevices(ctx context.Context, logger logrus.FieldLogger, store recoverStore, dm deviceChecker, dryRun bool) (*RecoverResult, error) {
+	result := &RecoverResult{}
+
+	snapshots, err := store.ListActiveSnapshots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list active snapshots: %w", err)
+	}
+	liveSnapshots := make(map[string]bool) // image IDs with an existing snapshot device
+	for _, snap := range snapshots {
+		result.SnapshotsChecked++
+		exists, err := dm.DeviceExists(ctx, snap.SnapshotName)
+		if err != nil {
+			return result, fmt.Errorf("failed to check device %s: %w", snap.SnapshotName, err)
+		}
+		if exists {
+			liveSnapshots[snap.ImageID] = true
+			continue
+		}
+
+		logger.WithFields(logrus.Fields{
+			"snapshot_id":   snap.SnapshotID,
+			"snapshot_name": snap.SnapshotName,
+			"image_id":      snap.ImageID,
+		}).Warn("snapshot device missing, marking inactive")
+		if !dryRun {
+			if err := store.DeactivateSnapshot(ctx, snap.SnapshotID); err != nil {
+				return result, err
+			}
+		}
+		result.SnapshotsDeactivated = append(result.SnapshotsDeactivated, snap.SnapshotID)
+	}
+
+	unpacked, err := store.ListUnpackedImages(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list unpacked images: %w", err)
+	}
+	for _, img := range unpacked {
+		result.UnpackedChecked++
+		exists, err := dm.DeviceExists(ctx, img.DeviceName)
+		if err != nil {
+			return result, fmt.Errorf("failed to check device %s: %w", img.DeviceName, err)
+		}
+		if exists {
+			continue
+		}
+
+		imgLogger := logger.WithFields(logrus.Fields{
+			"image_id":    img.ImageID,
+			"device_name": img.DeviceName,
+		})
+		if liveSnapshots[img.ImageID] {
+			imgLogger.Warn("unpacked device missing but a snapshot is still active, leaving rows alone")
+			result.UnpackedKept = append(result.UnpackedKept, img.ImageID)
+			continue
+		}
+
+		imgLogger.Warn("unpacked device missing, removing unpacked record")
+		if !dryRun {
+			snaps, err := store.GetSnapshotsByImageID(ctx, img.ImageID)
+			if err != nil {
+				return result, fmt.Errorf("failed to look up snapshots: %w", err)
+			}
+			for _, snap := range snaps {
+				if err := store.DeleteSnapshot(ctx, snap.SnapshotID); err != nil {
+					return result, err
+				}
+			}
+			if err := store.DeleteUnpackedImage(ctx, img.ImageID); err != nil {
+				return result, err
+			}
+		}
+		result.UnpackedRemoved = append(result.UnpackedRemoved, img.ImageID)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/superfly/fsm/database"
+)
+
+// fakeRecoverStore is an in-memory recoverStore. Deleting an unpacked image
+// that still has snapshot rows fails, like the ON DELETE RESTRICT foreign key.
+type fakeRecoverStore struct {
+	*fakeSnapshotStore
+	unpacked map[string]*database.UnpackedImage
+}
+
+func newFakeRecoverStore(unpacked []*database.UnpackedImage, snaps ...*database.Snapshot) *fakeRecoverStore {
+	s := &fakeRecoverStore{
+		fakeSnapshotStore: newFakeSnapshotStore(snaps...),
+		unpacked:          make(map[string]*database.UnpackedImage),
+	}
+	for _, u := range unpacked {
+		s.unpacked[u.ImageID] = u
+	}
+	return s
+}
+
+func (s *fakeRecoverStore) ListUnpackedImages(ctx context.Context) ([]*database.UnpackedImage, error) {
+	var out []*database.UnpackedImage
+	for _, u := range s.unpacked {
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ImageID < out[j].ImageID })
+	return out, nil
+}
+
+func (s *fakeRecoverStore) ListActiveSnapshots(ctx context.Context) ([]*database.Snapshot, error) {
+	var out []*database.Snapshot
+	for _, snap := range s.snapshots {
+		if snap.Active {
+			out = append(out, snap)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SnapshotID < out[j].SnapshotID })
+	return out, nil
+}
+
+func (s *fakeRecoverStore) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	delete(s.snapshots, snapshotID)
+	return nil
+}
+
+func (s *fakeRecoverStore) DeleteUnpackedImage(ctx context.Context, imageID string) error {
+	for _, snap := range s.snapshots {
+		if snap.ImageID == imageID {
+			return fmt.Errorf("FOREIGN KEY constraint failed: snapshot %s", snap.SnapshotID)
+		}
+	}
+	delete(s.unpacked, imageID)
+	return nil
+}
+
+// fakeDeviceChecker reports the devices in exists as present.
+type fakeDeviceChecker struct {
+	exists  map[string]bool
+	err     error
+	checked []string
+}
+
+func (f *fakeDeviceChecker) DeviceExists(ctx context.Context, deviceName string) (bool, error) {
+	f.checked = append(f.checked, deviceName)
+	if f.err != nil {
+		return false, f.err
+	}
+	return f.exists[deviceName], nil
+}
+
+func recoverFixture() *fakeRecoverStore {
+	return newFakeRecoverStore(
+		[]*database.UnpackedImage{
+			{ImageID: "img-ok", DeviceName: "thin-ok"},
+			{ImageID: "img-gone", DeviceName: "thin-gone"},
+			{ImageID: "img-origin-gone", DeviceName: "thin-origin-gone"},
+		},
+		&database.Snapshot{SnapshotID: "snap-ok", SnapshotName: "snap-ok", ImageID: "img-ok", Active: true},
+		&database.Snapshot{SnapshotID: "snap-gone", SnapshotName: "snap-gone", ImageID: "img-gone", Active: true},
+		&database.Snapshot{SnapshotID: "snap-old", SnapshotName: "snap-old", ImageID: "img-gone", Active: false},
+		&database.Snapshot{SnapshotID: "snap-live", SnapshotName: "snap-live", ImageID: "img-origin-gone", Active: true},
+	)
+}
+
+func TestReconcileDevices_MixedExistence(t *testing.T) {
+	store := recoverFixture()
+	dm := &fakeDeviceChecker{exists: map[string]bool{
+		"thin-ok":   true,
+		"snap-ok":   true,
+		"snap-live": true,
+	}}
+
+	result, err := reconcileDevices(context.Background(), quietLogger(), store, dm, false)
+	if err != nil {
+		t.Fatalf("reconcileDevices() error = %v", err)
+	}
+
+	if result.SnapshotsChecked != 3 || result.UnpackedChecked != 3 {
+		t.Errorf("checked %d snapshots and %d unpacked, want 3 and 3", result.SnapshotsChecked, result.UnpackedChecked)
+	}
+	if fmt.Sprint(result.SnapshotsDeactivated) != "[snap-gone]" {
+		t.Errorf("SnapshotsDeactivated = %v, want [snap-gone]", result.SnapshotsDeactivated)
+	}
+	if fmt.Sprint(result.UnpackedRemoved) != "[img-gone]" {
+		t.Errorf("UnpackedRemoved = %v, want [img-gone]", result.UnpackedRemoved)
+	}
+	if fmt.Sprint(result.UnpackedKept) != "[img-origin-gone]" {
+		t.Errorf("UnpackedKept = %v, want [img-origin-gone]", result.UnpackedKept)
+	}
+
+	// The missing image is gone with all its snapshot rows, so the next
+	// process-image unpacks it from scratch.
+	if _, ok := store.unpacked["img-gone"]; ok {
+		t.Error("img-gone unpacked row still present")
+	}
+	for _, id := range []string{"snap-gone", "snap-old"} {
+		if _, ok := store.snapshots[id]; ok {
+			t.Errorf("%s row still present after its origin was removed", id)
+		}
+	}
+
+	// Everything backed by a live device is untouched.
+	if _, ok := store.unpacked["img-ok"]; !ok {
+		t.Error("img-ok unpacked row removed")
+	}
+	if _, ok := store.unpacked["img-origin-gone"]; !ok {
+		t.Error("img-origin-gone unpacked row removed while its snapshot is live")
+	}
+	if !store.snapshots["snap-ok"].Active || !store.snapshots["snap-live"].Active {
+		t.Error("snapshots with existing devices were deactivated")
+	}
+}
+
+func TestReconcileDevices_DryRun(t *testing.T) {
+	store := recoverFixture()
+	dm := &fakeDeviceChecker{exists: map[string]bool{}}
+
+	result, err := reconcileDevices(context.Background(), quietLogger(), store, dm, true)
+	if err != nil {
+		t.Fatalf("reconcileDevices() error = %v", err)
+	}
+	if len(result.SnapshotsDeactivated) != 3 || len(result.UnpackedRemoved) != 3 {
+		t.Errorf("dry run reported %d snapshots and %d unpacked, want 3 and 3",
+			len(result.SnapshotsDeactivated), len(result.UnpackedRemoved))
+	}
+	if len(store.unpacked) != 3 || len(store.snapshots) != 4 {
+		t.Errorf("dry run changed the database: %d unpacked, %d snapshots", len(store.unpacked), len(store.snapshots))
+	}
+	for id, snap := range store.snapshots {
+		if id != "snap-old" && !snap.Active {
+			t.Errorf("dry run deactivated %s", id)
+		}
+	}
+}
+
+func TestReconcileDevices_CheckFailureStops(t *testing.T) {
+	store := recoverFixture()
+	dm := &fakeDeviceChecker{err: errors.New("dmsetup timed out")}
+
+	if _, err := reconcileDevices(context.Background(), quietLogger(), store, dm, false); err == nil {
+		t.Fatal("expected error when the device check fails")
+	}
+	if len(dm.checked) != 1 {
+		t.Errorf("checked %d devices after a failure, want 1", len(dm.checked))
+	}
+	if len(store.unpacked) != 3 || !store.snapshots["snap-gone"].Active {
+		t.Error("a failed device check must not change the database")
+	}
+}
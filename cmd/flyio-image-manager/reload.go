@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// reloadableSettings are the config keys a running daemon applies on SIGHUP.
+// Changes to any other key are logged and take effect on the next restart.
+var reloadableSettings = map[string]bool{
+	"log-level":           true,
+	"download-queue":      true,
+	"unpack-queue":        true,
+	"pool-threshold":      true,
+	"pool-meta-threshold": true,
+	"pool-warn-threshold": true,
+	"max-load":            true,
+	"load-per-cpu":        true,
+	"max-iowait":          true,
+	"min-mem-pct":         true,
+	"max-pressure":        true,
+}
+
+// liveConfig holds the config a running daemon hands to each pipeline run,
+// so the system health check of a run started after a SIGHUP uses the
+// reloaded thresholds.
+type liveConfig struct {
+	mu  sync.RWMutex
+	cfg Config
+}
+
+// Load returns the config in effect.
+func (l *liveConfig) Load() Config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+// Store replaces the config in effect.
+func (l *liveConfig) Store(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+}
+
+// queueResizer changes FSM queue sizes; *fsm.Manager in production.
+type queueResizer interface {
+	ResizeQueue(name string, size int) error
+}
+
+// poolThresholdSetter takes new pool capacity thresholds and the alerter
+// built from them; *devicemapper.Client in production.
+type poolThresholdSetter interface {
+	SetCapacityThreshold(threshold float64) error
+	SetMetadataCapacityThreshold(threshold float64) error
+	SetPoolObserver(fn func(info devicemapper.PoolInfo))
+}
+
+// daemonReloader re-reads the daemon's config on SIGHUP and applies the
+// reloadable settings. The manager lock and in-flight runs are untouched.
+type daemonReloader struct {
+	args   []string // daemon command line, re-applied over the file so flags still win
+	cfg    Config   // settings in effect
+	live   *liveConfig
+	queues queueResizer
+	pool   poolThresholdSetter
+	logger logrus.FieldLogger
+}
+
+// loadDaemonConfig builds the daemon's config as main does: the --config
+// file in args, then the flags in args on top.
+func loadDaemonConfig(args []string) (Config, error) {
+	cfg, err := configFromArgs(args)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = defaultLogFormat("daemon")
+	}
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	parseDaemonFlags(&cfg, fs, args)
+	return cfg, nil
+}
+
+// watch reloads the config each time a signal arrives on sigs, until ctx is
+// cancelled.
+func (r *daemonReloader) watch(ctx context.Context, sigs <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigs:
+			r.logger.WithField("signal", sig).Info("received reload signal")
+			r.reload()
+		}
+	}
+}
+
+// reload re-reads the config and applies each changed reloadable setting,
+// logging the old and new values. An invalid value is logged and the
+// current one kept; the rest of the reload still goes ahead.
+func (r *daemonReloader) reload() {
+	if configPathFromArgs(r.args) == "" {
+		r.logger.Warn("daemon was started without --config, nothing to reload")
+		return
+	}
+	next, err := loadDaemonConfig(r.args)
+	if err != nil {
+		r.logger.WithError(err).Error("config reload failed, keeping the current config")
+		return
+	}
+
+	if next.LogLevel != r.cfg.LogLevel {
+		if lvl, err := logrus.ParseLevel(next.LogLevel); err != nil {
+			r.logger.WithError(err).Error("invalid log-level, keeping the current level")
+		} else {
+			log.SetLevel(lvl)
+			r.logChange("log-level", r.cfg.LogLevel, next.LogLevel)
+			r.cfg.LogLevel = next.LogLevel
+		}
+	}
+
+	for _, q := range []struct {
+		setting, queue string
+		cur            *int
+		next           int
+	}{
+		{"download-queue", "download", &r.cfg.DownloadQueueSize, next.DownloadQueueSize},
+		{"unpack-queue", "unpack", &r.cfg.UnpackQueueSize, next.UnpackQueueSize},
+	} {
+		if q.next == *q.cur {
+			continue
+		}
+		if err := r.queues.ResizeQueue(q.queue, q.next); err != nil {
+			r.logger.WithError(err).Errorf("failed to apply %s, keeping %d", q.setting, *q.cur)
+			continue
+		}
+		r.logChange(q.setting, *q.cur, q.next)
+		*q.cur = q.next
+	}
+
+	if next.PoolThreshold != r.cfg.PoolThreshold || next.PoolMetaThreshold != r.cfg.PoolMetaThreshold || next.PoolWarnThreshold != r.cfg.PoolWarnThreshold {
+		if err := r.applyPoolThresholds(next); err != nil {
+			r.logger.WithError(err).Error("failed to apply pool thresholds, keeping the current ones")
+		}
+	}
+
+	r.applyHealthThresholds(next)
+	r.live.Store(r.cfg)
+
+	if settings := restartRequiredSettings(r.cfg, next); len(settings) > 0 {
+		r.logger.WithField("settings", strings.Join(settings, ", ")).Warn("changed settings take effect after a restart")
+	}
+}
+
+// applyHealthThresholds takes the system health thresholds from next. They
+// are read by the pre-flight health check of each run, so runs already past
+// it are unaffected.
+func (r *daemonReloader) applyHealthThresholds(next Config) {
+	for _, s := range []struct {
+		setting   string
+		cur, next *float64
+	}{
+		{"max-load", &r.cfg.MaxLoad, &next.MaxLoad},
+		{"max-iowait", &r.cfg.MaxIOWait, &next.MaxIOWait},
+		{"min-mem-pct", &r.cfg.MinMemPercent, &next.MinMemPercent},
+		{"max-pressure", &r.cfg.MaxPressure, &next.MaxPressure},
+	} {
+		if *s.next != *s.cur {
+			r.logChange(s.setting, *s.cur, *s.next)
+			*s.cur = *s.next
+		}
+	}
+	if next.LoadPerCPU != r.cfg.LoadPerCPU {
+		r.logChange("load-per-cpu", r.cfg.LoadPerCPU, next.LoadPerCPU)
+		r.cfg.LoadPerCPU = next.LoadPerCPU
+	}
+}
+
+// applyPoolThresholds sets the pool capacity thresholds from next and
+// replaces the pool alerter, whose warn level is relative to them. The three
+// thresholds are checked together, so they are applied together or not at all.
+func (r *daemonReloader) applyPoolThresholds(next Config) error {
+	if next.PoolWarnThreshold <= 0 || next.PoolWarnThreshold >= min(next.PoolThreshold, next.PoolMetaThreshold) {
+		return fmt.Errorf("invalid pool-warn-threshold %.1f: must be above 0 and below pool-threshold and pool-meta-threshold", next.PoolWarnThreshold)
+	}
+	for _, t := range []float64{next.PoolThreshold, next.PoolMetaThreshold} {
+		if t < 1 || t > 99 {
+			return fmt.Errorf("pool thresholds must be between 1 and 99, got %.1f", t)
+		}
+	}
+	if err := r.pool.SetCapacityThreshold(next.PoolThreshold); err != nil {
+		return err
+	}
+	if err := r.pool.SetMetadataCapacityThreshold(next.PoolMetaThreshold); err != nil {
+		return err
+	}
+
+	alertCfg := r.cfg
+	alertCfg.PoolThreshold = next.PoolThreshold
+	alertCfg.PoolMetaThreshold = next.PoolMetaThreshold
+	alertCfg.PoolWarnThreshold = next.PoolWarnThreshold
+	r.pool.SetPoolObserver(newPoolAlerter(alertCfg, r.logger, &http.Client{}).Observe)
+
+	for _, s := range []struct {
+		setting   string
+		old, next float64
+	}{
+		{"pool-threshold", r.cfg.PoolThreshold, next.PoolThreshold},
+		{"pool-meta-threshold", r.cfg.PoolMetaThreshold, next.PoolMetaThreshold},
+		{"pool-warn-threshold", r.cfg.PoolWarnThreshold, next.PoolWarnThreshold},
+	} {
+		if s.old != s.next {
+			r.logChange(s.setting, s.old, s.next)
+		}
+	}
+	r.cfg = alertCfg
+	return nil
+}
+
+// logChange records a setting the reload applied.
+func (r *daemonReloader) logChange(setting string, old, new any) {
+	r.logger.WithFields(logrus.Fields{"setting": setting, "old": old, "new": new}).Info("config setting changed")
+}
+
+// restartRequiredSettings returns the config keys, other than the reloadable
+// ones, whose values differ between cur and next.
+func restartRequiredSettings(cur, next Config) []string {
+	var settings []string
+	cv, nv := reflect.ValueOf(cur), reflect.ValueOf(next)
+	for i := 0; i < cv.NumField(); i++ {
+		key, _, _ := strings.Cut(cv.Type().Field(i).Tag.Get("yaml"), ",")
+		if key == "" || key == "-" || reloadableSettings[key] {
+			continue
+		}
+		if !reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			settings = append(settings, key)
+		}
+	}
+	return settings
+}
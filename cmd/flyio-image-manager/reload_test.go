@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// fakeQueues records queue resizes.
+type fakeQueues struct {
+	resized map[string]int
+}
+
+func (f *fakeQueues) ResizeQueue(name string, size int) error {
+	if f.resized == nil {
+		f.resized = make(map[string]int)
+	}
+	f.resized[name] = size
+	return nil
+}
+
+// fakePoolThresholds records the thresholds and observer it is given.
+type fakePoolThresholds struct {
+	data, meta float64
+	observer   func(devicemapper.PoolInfo)
+}
+
+func (f *fakePoolThresholds) SetCapacityThreshold(t float64) error {
+	f.data = t
+	return nil
+}
+
+func (f *fakePoolThresholds) SetMetadataCapacityThreshold(t float64) error {
+	f.meta = t
+	return nil
+}
+
+func (f *fakePoolThresholds) SetPoolObserver(fn func(devicemapper.PoolInfo)) {
+	f.observer = fn
+}
+
+// sighup delivers one SIGHUP to the reloader's watch loop and waits for the
+// reload to finish.
+func sighup(t *testing.T, r *daemonReloader) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		r.watch(ctx, sigs)
+		close(done)
+	}()
+	sigs <- syscall.SIGHUP
+	cancel()
+	<-done
+}
+
+func TestDaemonReloader_SIGHUP(t *testing.T) {
+	defer func(l logrus.Level) { log.SetLevel(l) }(log.Level)
+	log.SetLevel(logrus.InfoLevel)
+
+	path := writeConfigFile(t, "log-level: info\n")
+	// --download-queue on the command line must keep overriding the file
+	args := []string{"--config", path, "--download-queue", "7"}
+	cfg, err := loadDaemonConfig(args)
+	if err != nil {
+		t.Fatalf("loadDaemonConfig() error = %v", err)
+	}
+
+	queues := &fakeQueues{}
+	pool := &fakePoolThresholds{}
+	live := &liveConfig{cfg: cfg}
+	r := &daemonReloader{args: args, cfg: cfg, live: live, queues: queues, pool: pool, logger: quietLogger()}
+
+	if err := os.WriteFile(path, []byte(`
+log-level: debug
+download-queue: 2
+unpack-queue: 3
+pool-threshold: 80
+pool-meta-threshold: 75
+pool-warn-threshold: 60
+max-load: 64
+load-per-cpu: false
+max-pressure: 25
+bucket: other-bucket
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sighup(t, r)
+
+	if log.GetLevel() != logrus.DebugLevel {
+		t.Errorf("log level = %v, want debug", log.GetLevel())
+	}
+	if want := map[string]int{"unpack": 3}; !reflect.DeepEqual(queues.resized, want) {
+		t.Errorf("resized queues = %v, want %v", queues.resized, want)
+	}
+	if pool.data != 80 || pool.meta != 75 || pool.observer == nil {
+		t.Errorf("pool thresholds = %.0f/%.0f (observer set: %v), want 80/75 with a new alerter", pool.data, pool.meta, pool.observer != nil)
+	}
+	if r.cfg.LogLevel != "debug" || r.cfg.UnpackQueueSize != 3 || r.cfg.DownloadQueueSize != 7 || r.cfg.PoolWarnThreshold != 60 {
+		t.Errorf("config in effect = level %s, queues %d/%d, warn %.0f; want debug, 7/3, 60",
+			r.cfg.LogLevel, r.cfg.DownloadQueueSize, r.cfg.UnpackQueueSize, r.cfg.PoolWarnThreshold)
+	}
+	// The bucket is not reloadable and stays as it was
+	if r.cfg.S3Bucket != cfg.S3Bucket {
+		t.Errorf("bucket = %q, want %q until restart", r.cfg.S3Bucket, cfg.S3Bucket)
+	}
+
+	// Runs started from now on check system health against the new thresholds
+	th := healthThresholds(live.Load())
+	if th.MaxLoad != 64 || th.LoadPerCPU || th.MaxPressure != 25 || th.MaxIOWait != cfg.MaxIOWait {
+		t.Errorf("health thresholds = %+v, want max-load 64 absolute, max-pressure 25 and max-iowait %.0f", th, cfg.MaxIOWait)
+	}
+	if live.Load().S3Bucket != cfg.S3Bucket {
+		t.Errorf("runs see bucket %q, want %q until restart", live.Load().S3Bucket, cfg.S3Bucket)
+	}
+}
+
+func TestDaemonReloader_InvalidValuesKept(t *testing.T) {
+	defer func(l logrus.Level) { log.SetLevel(l) }(log.Level)
+	log.SetLevel(logrus.InfoLevel)
+
+	path := writeConfigFile(t, "log-level: info\n")
+	args := []string{"--config", path}
+	cfg, err := loadDaemonConfig(args)
+	if err != nil {
+		t.Fatalf("loadDaemonConfig() error = %v", err)
+	}
+	pool := &fakePoolThresholds{}
+	r := &daemonReloader{args: args, cfg: cfg, live: &liveConfig{cfg: cfg}, queues: &fakeQueues{}, pool: pool, logger: quietLogger()}
+
+	// A warn threshold above the hard threshold is rejected as a group
+	if err := os.WriteFile(path, []byte("log-level: loud\npool-threshold: 50\npool-warn-threshold: 60\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sighup(t, r)
+
+	if log.GetLevel() != logrus.InfoLevel || r.cfg.LogLevel != "info" {
+		t.Errorf("log level = %v (%s), want info kept", log.GetLevel(), r.cfg.LogLevel)
+	}
+	if pool.data != 0 || r.cfg.PoolThreshold != cfg.PoolThreshold {
+		t.Errorf("pool threshold applied (%.0f, %.0f), want %.0f kept", pool.data, r.cfg.PoolThreshold, cfg.PoolThreshold)
+	}
+
+	// A file that no longer parses leaves everything as it was
+	if err := os.WriteFile(path, []byte("log-level: [debug\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sighup(t, r)
+	if log.GetLevel() != logrus.InfoLevel {
+		t.Errorf("log level = %v after a bad file, want info", log.GetLevel())
+	}
+}
+
+func TestRestartRequiredSettings(t *testing.T) {
+	cur := DefaultConfig()
+	next := cur
+	next.LogLevel = "debug"
+	next.UnpackQueueSize = 4
+	next.S3Bucket = "other"
+	next.ShutdownTimeout = cur.ShutdownTimeout * 2
+
+	got := restartRequiredSettings(cur, next)
+	if want := []string{"bucket", "shutdown-timeout"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restartRequiredSettings() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/download"
+)
+
+// removeStore is the subset of *database.DB used by remove-image.
+type removeStore interface {
+	GetImageByID(ctx context.Context, imageID string) (*database.Image, error)
+	GetUnpackedImageByID(ctx context.Context, imageID string) (*database.UnpackedImage, error)
+	GetSnapshotsByImageID(ctx context.Context, imageID string) ([]*database.Snapshot, error)
+	DeleteSnapshot(ctx context.Context, snapshotID string) error
+	DeleteUnpackedImage(ctx context.Context, imageID string) error
+	DeleteImage(ctx context.Context, imageID string) error
+	ReleaseDeviceID(ctx context.Context, deviceID string) error
+}
+
+// deviceRemover is the subset of *devicemapper.Client used by remove-image.
+// SafeDeleteDevice treats an already-missing device as success.
+type deviceRemover interface {
+	SafeDeleteDevice(ctx context.Context, poolName, deviceName, deviceID string) error
+}
+
+// RemoveResult reports what remove-image removed.
+type RemoveResult struct {
+	SnapshotRows []string // Snapshot IDs whose rows were deleted
+	UnpackedRow  bool
+	ImageRow     bool
+
+	// DevicesDeleted lists devices removed from the pool (--force). Without
+	// --force, DevicesLeft lists the devices left for 'gc --force'.
+	DevicesDeleted []string
+	DevicesLeft    []string
+
+	TarPath    string
+	TarDeleted bool
+}
+
+// runRemoveImage deletes an image and everything derived from it.
+func runRemoveImage(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	logger := log.WithFields(logrus.Fields{
+		"command":  "remove-image",
+		"image_id": cfg.ImageID,
+	})
+
+	if !cfg.Force {
+		logger.Warn("running without --force - devices are left in the pool for 'gc --force'")
+	}
+
+	// Without --force the rows are still deleted, so this is never a dry run.
+	return withDMCommand(ctx, cfg, "remove-image:"+cfg.ImageID, false, func() error {
+		db, err := database.New(database.Config{Path: cfg.DBPath})
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+		dmClient.SetOperationRecorder(dmRecorder{db})
+
+		tarPath := download.LocalPath(cfg.LocalDir, cfg.ImageID, cfg.ShardStorage)
+		result, err := removeImage(ctx, logger, db, dmClient, cfg.PoolName, tarPath, cfg.ImageID, cfg.Force, cfg.KeepTar)
+		if result != nil {
+			printRemoveResult(cfg.ImageID, result)
+		}
+		return err
+	})
+}
+
+// printRemoveResult prints a summary of a remove-image run.
+func printRemoveResult(imageID string, r *RemoveResult) {
+	if len(r.SnapshotRows) == 0 && !r.UnpackedRow && !r.ImageRow && len(r.DevicesDeleted) == 0 && !r.TarDeleted {
+		fmt.Printf("%s: nothing to remove\n", imageID)
+		return
+	}
+	for _, id := range r.SnapshotRows {
+		fmt.Printf("Removed snapshot record %s\n", id)
+	}
+	if r.UnpackedRow {
+		fmt.Println("Removed unpacked image record")
+	}
+	if r.ImageRow {
+		fmt.Println("Removed image record")
+	}
+	for _, name := range r.DevicesDeleted {
+		fmt.Printf("Deleted device %s\n", name)
+	}
+	for _, name := range r.DevicesLeft {
+		fmt.Printf("Would delete device %s (rerun with --force, or run 'gc --force')\n", name)
+	}
+	if r.TarDeleted {
+		fmt.Printf("Deleted %s\n", r.TarPath)
+	}
+}
+
+// removeImage removes an image in dependency order: snapshots, then the
+// unpacked device, then the image row, then the downloaded tar.
+//
+// CRITICAL: Devicemapper calls only happen with force. Without it only database
+// rows are removed and the devices become orphans for 'gc --force', matching
+// the fail-dumb cleanup policy.
+//
+// tarPath is the downloaded tar to delete when the image row does not record one.
+//
+// Each step skips state that is already gone, so a run interrupted part-way can
+// simply be repeated. A device that cannot be removed stops the run and keeps
+// its row, so the database never forgets a device that still exists.
+func removeImage(ctx context.Context, logger logrus.FieldLogger, store removeStore, dm deviceRemover, poolName, tarPath, imageID string, force, keepTar bool) (*RemoveResult, error) {
+	result := &RemoveResult{}
+
+	img, err := store.GetImageByID(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up image: %w", err)
+	}
+	unpacked, err := store.GetUnpackedImageByID(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up unpacked image: %w", err)
+	}
+	snapshots, err := store.GetSnapshotsByImageID(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up snapshots: %w", err)
+	}
+
+	// Snapshots first: their rows reference the unpacked device (ON DELETE RESTRICT).
+	for _, snap := range snapshots {
+		snapLogger := logger.WithFields(logrus.Fields{
+			"snapshot_id":   snap.SnapshotID,
+			"snapshot_name": snap.SnapshotName,
+		})
+		if err := removeDevice(ctx, snapLogger, store, dm, poolName, snap.SnapshotName, snap.SnapshotID, force, result); err != nil {
+			return result, err
+		}
+		if err := store.DeleteSnapshot(ctx, snap.SnapshotID); err != nil {
+			return result, fmt.Errorf("failed to delete snapshot record %s: %w", snap.SnapshotID, err)
+		}
+		snapLogger.Info("snapshot record removed")
+		result.SnapshotRows = append(result.SnapshotRows, snap.SnapshotID)
+	}
+
+	if unpacked != nil {
+		devLogger := logger.WithFields(logrus.Fields{
+			"device_name": unpacked.DeviceName,
+			"device_id":   unpacked.DeviceID,
+		})
+		if err := removeDevice(ctx, devLogger, store, dm, poolName, unpacked.DeviceName, unpacked.DeviceID, force, result); err != nil {
+			return result, err
+		}
+		if err := store.DeleteUnpackedImage(ctx, imageID); err != nil {
+			return result, fmt.Errorf("failed to delete unpacked image record: %w", err)
+		}
+		devLogger.Info("unpacked image record removed")
+		result.UnpackedRow = true
+	}
+
+	if img != nil {
+		if img.LocalPath != "" {
+			tarPath = img.LocalPath
+		}
+		if err := store.DeleteImage(ctx, imageID); err != nil {
+			return result, fmt.Errorf("failed to delete image record: %w", err)
+		}
+		logger.Info("image record removed")
+		result.ImageRow = true
+	}
+
+	if keepTar {
+		return result, nil
+	}
+	result.TarPath = tarPath
+	if err := os.Remove(tarPath); err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return result, fmt.Errorf("failed to delete %s: %w", tarPath, err)
+	}
+	logger.WithField("path", tarPath).Info("downloaded tar removed")
+	result.TarDeleted = true
+
+	return result, nil
+}
+
+// removeDevice deletes one thin device with SafeDeleteDevice and frees its
+// device ID when force is set, or records it in result.DevicesLeft otherwise.
+// A mounted device is refused, never force-removed.
+func removeDevice(ctx context.Context, logger logrus.FieldLogger, store removeStore, dm deviceRemover, poolName, deviceName, deviceID string, force bool, result *RemoveResult) error {
+	if !force {
+		logger.Info("leaving device in pool (no --force)")
+		result.DevicesLeft = append(result.DevicesLeft, deviceName)
+		return nil
+	}
+
+	logger.Info("deleting device from pool")
+	// A DeviceMountedError stops the run here too, keeping the row
+	if err := dm.SafeDeleteDevice(ctx, poolName, deviceName, deviceID); err != nil {
+		return fmt.Errorf("failed to delete device %s: %w", deviceName, err)
+	}
+
+	if err := store.ReleaseDeviceID(ctx, deviceID); err != nil {
+		return fmt.Errorf("device %s deleted but releasing its ID failed: %w", deviceName, err)
+	}
+
+	result.DevicesDeleted = append(result.DevicesDeleted, deviceName)
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// fakeRemoveStore is an in-memory removeStore that records deletes into a
+// shared call log, so tests can check ordering against device operations.
+type fakeRemoveStore struct {
+	image     *database.Image
+	unpacked  *database.UnpackedImage
+	snapshots []*database.Snapshot
+
+	calls *[]string
+}
+
+func (s *fakeRemoveStore) GetImageByID(ctx context.Context, imageID string) (*database.Image, error) {
+	return s.image, nil
+}
+
+func (s *fakeRemoveStore) GetUnpackedImageByID(ctx context.Context, imageID string) (*database.UnpackedImage, error) {
+	return s.unpacked, nil
+}
+
+func (s *fakeRemoveStore) GetSnapshotsByImageID(ctx context.Context, imageID string) ([]*database.Snapshot, error) {
+	return s.snapshots, nil
+}
+
+func (s *fakeRemoveStore) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	*s.calls = append(*s.calls, "db:snapshot "+snapshotID)
+	for i, snap := range s.snapshots {
+		if snap.SnapshotID == snapshotID {
+			s.snapshots = append(s.snapshots[:i], s.snapshots[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("snapshot not found: " + snapshotID)
+}
+
+func (s *fakeRemoveStore) DeleteUnpackedImage(ctx context.Context, imageID string) error {
+	*s.calls = append(*s.calls, "db:unpacked "+imageID)
+	// Mirror the ON DELETE RESTRICT on snapshots.origin_device_id.
+	if len(s.snapshots) > 0 {
+		return errors.New("FOREIGN KEY constraint failed")
+	}
+	s.unpacked = nil
+	return nil
+}
+
+func (s *fakeRemoveStore) DeleteImage(ctx context.Context, imageID string) error {
+	*s.calls = append(*s.calls, "db:image "+imageID)
+	s.image = nil
+	return nil
+}
+
+func (s *fakeRemoveStore) ReleaseDeviceID(ctx context.Context, deviceID string) error {
+	*s.calls = append(*s.calls, "db:release "+deviceID)
+	return nil
+}
+
+// fakeDeviceRemover records device operations into the shared call log.
+type fakeDeviceRemover struct {
+	calls     *[]string
+	deleteErr map[string]error
+}
+
+func (f *fakeDeviceRemover) SafeDeleteDevice(ctx context.Context, poolName, deviceName, deviceID string) error {
+	*f.calls = append(*f.calls, "dm:delete "+deviceName+" "+deviceID)
+	return f.deleteErr[deviceName]
+}
+
+func newRemoveFixture(t *testing.T) (*fakeRemoveStore, *fakeDeviceRemover, string) {
+	t.Helper()
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "img-1.tar")
+	if err := os.WriteFile(tarPath, []byte("tar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	store := &fakeRemoveStore{
+		image:    &database.Image{ImageID: "img-1", LocalPath: tarPath},
+		unpacked: &database.UnpackedImage{ImageID: "img-1", DeviceID: "42", DeviceName: "thin-42"},
+		snapshots: []*database.Snapshot{
+			{SnapshotID: "100", SnapshotName: "snap-a", ImageID: "img-1", OriginDeviceID: "42", Active: true},
+			{SnapshotID: "101", SnapshotName: "snap-b", ImageID: "img-1", OriginDeviceID: "42"},
+		},
+		calls: &calls,
+	}
+	return store, &fakeDeviceRemover{calls: &calls}, dir
+}
+
+func TestRemoveImage_ForceOrder(t *testing.T) {
+	store, dm, dir := newRemoveFixture(t)
+
+	result, err := removeImage(context.Background(), quietLogger(), store, dm, "pool", filepath.Join(dir, "img-1.tar"), "img-1", true, false)
+	if err != nil {
+		t.Fatalf("removeImage() error = %v", err)
+	}
+
+	want := []string{
+		"dm:delete snap-a 100", "db:release 100", "db:snapshot 100",
+		"dm:delete snap-b 101", "db:release 101", "db:snapshot 101",
+		"dm:delete thin-42 42", "db:release 42", "db:unpacked img-1",
+		"db:image img-1",
+	}
+	if got := strings.Join(*store.calls, ","); got != strings.Join(want, ",") {
+		t.Errorf("calls =\n  %s\nwant\n  %s", got, strings.Join(want, ","))
+	}
+	if len(result.DevicesDeleted) != 3 || len(result.DevicesLeft) != 0 {
+		t.Errorf("devices deleted/left = %v/%v", result.DevicesDeleted, result.DevicesLeft)
+	}
+	if !result.TarDeleted {
+		t.Error("tar should be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "img-1.tar")); !os.IsNotExist(err) {
+		t.Errorf("tar still exists: %v", err)
+	}
+}
+
+func TestRemoveImage_WithoutForceOnlyRemovesRows(t *testing.T) {
+	store, dm, dir := newRemoveFixture(t)
+
+	result, err := removeImage(context.Background(), quietLogger(), store, dm, "pool", filepath.Join(dir, "img-1.tar"), "img-1", false, true)
+	if err != nil {
+		t.Fatalf("removeImage() error = %v", err)
+	}
+
+	want := "db:snapshot 100,db:snapshot 101,db:unpacked img-1,db:image img-1"
+	if got := strings.Join(*store.calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+	if got := strings.Join(result.DevicesLeft, ","); got != "snap-a,snap-b,thin-42" {
+		t.Errorf("DevicesLeft = %s", got)
+	}
+	if result.TarDeleted {
+		t.Error("--keep-tar should keep the tar")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "img-1.tar")); err != nil {
+		t.Errorf("tar should still exist: %v", err)
+	}
+}
+
+func TestRemoveImage_DeviceFailureKeepsRows(t *testing.T) {
+	store, dm, dir := newRemoveFixture(t)
+	dm.deleteErr = map[string]error{"snap-b": errors.New("device busy")}
+
+	result, err := removeImage(context.Background(), quietLogger(), store, dm, "pool", filepath.Join(dir, "img-1.tar"), "img-1", true, false)
+	if err == nil || !strings.Contains(err.Error(), "snap-b") {
+		t.Fatalf("error = %v, want snap-b deletion failure", err)
+	}
+	if got := strings.Join(result.SnapshotRows, ","); got != "100" {
+		t.Errorf("SnapshotRows = %s, want only 100", got)
+	}
+	if store.unpacked == nil || store.image == nil {
+		t.Error("unpacked and image rows must be kept when a snapshot device cannot be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "img-1.tar")); err != nil {
+		t.Errorf("tar should still exist: %v", err)
+	}
+}
+
+func TestRemoveImage_MountedDeviceKeepsRow(t *testing.T) {
+	store, dm, dir := newRemoveFixture(t)
+	store.snapshots = nil
+	dm.deleteErr = map[string]error{"thin-42": &devicemapper.DeviceMountedError{DeviceName: "thin-42", MountPoint: "/mnt/flyio/thin-42"}}
+
+	result, err := removeImage(context.Background(), quietLogger(), store, dm, "pool", filepath.Join(dir, "img-1.tar"), "img-1", true, false)
+	var mounted *devicemapper.DeviceMountedError
+	if !errors.As(err, &mounted) || !strings.Contains(err.Error(), "unmount it") {
+		t.Fatalf("error = %v, want a DeviceMountedError telling the user to unmount", err)
+	}
+	if store.unpacked == nil || store.image == nil || result.UnpackedRow {
+		t.Error("unpacked and image rows must be kept while the device is mounted")
+	}
+	for _, call := range *store.calls {
+		if call == "db:release 42" {
+			t.Error("device ID of a mounted device was released")
+		}
+	}
+}
+
+func TestRemoveImage_ResumesPartialRemoval(t *testing.T) {
+	store, dm, dir := newRemoveFixture(t)
+	// A previous run removed the snapshots and the unpacked row, then stopped.
+	store.snapshots = nil
+	store.unpacked = nil
+
+	result, err := removeImage(context.Background(), quietLogger(), store, dm, "pool", filepath.Join(dir, "img-1.tar"), "img-1", true, false)
+	if err != nil {
+		t.Fatalf("removeImage() error = %v", err)
+	}
+	if got := strings.Join(*store.calls, ","); got != "db:image img-1" {
+		t.Errorf("calls = %s, want only the image row delete", got)
+	}
+	if !result.ImageRow || !result.TarDeleted {
+		t.Errorf("result = %+v", result)
+	}
+
+	// Running again finds nothing left and succeeds.
+	*store.calls = nil
+	result, err = removeImage(context.Background(), quietLogger(), store, dm, "pool", filepath.Join(dir, "img-1.tar"), "img-1", true, false)
+	if err != nil {
+		t.Fatalf("second removeImage() error = %v", err)
+	}
+	if len(*store.calls) != 0 || result.ImageRow || result.TarDeleted {
+		t.Errorf("second run should be a no-op, calls = %v, result = %+v", *store.calls, result)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/safeguards"
+)
+
+// supportBundleTimeout bounds gathering a support bundle.
+const supportBundleTimeout = 30 * time.Second
+
+// supportStore is the subset of *database.DB dumped into a support bundle.
+type supportStore interface {
+	ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error)
+	ListUnpackedImages(ctx context.Context) ([]*database.UnpackedImage, error)
+	ListSnapshots(ctx context.Context) ([]*database.Snapshot, error)
+}
+
+// supportSources are where a support bundle's sections come from. Each
+// non-database source is a field so tests can run without a pool or procfs.
+type supportSources struct {
+	store     supportStore
+	pool      poolStatusSource
+	poolName  string
+	readLock  func() (*lockFileInfo, error)
+	dState    func() ([]safeguards.ProcState, error)
+	hostTools func() devicemapper.HostTools
+}
+
+// supportBundle is the JSON document written by support-bundle. Nothing is
+// redacted: bundles are for internal issues only.
+type supportBundle struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Version     string    `json:"version"`
+	Hostname    string    `json:"hostname"`
+
+	Images         []*database.Image         `json:"images"`
+	UnpackedImages []*database.UnpackedImage `json:"unpacked_images"`
+	Snapshots      []*database.Snapshot      `json:"snapshots"`
+
+	Pool            *devicemapper.PoolInfo `json:"pool"`
+	Lock            *lockFileInfo          `json:"lock"` // nil when no manager lock file exists
+	DStateCount     int                    `json:"d_state_count"`
+	DStateProcesses []string               `json:"d_state_processes"`
+	Tools           devicemapper.HostTools `json:"tools"`
+
+	// Errors maps each section that could not be gathered to why. A broken
+	// host is when a bundle is most needed, so one failure never stops the rest.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// gatherSupportBundle collects every section of the bundle from src.
+func gatherSupportBundle(ctx context.Context, src supportSources, now time.Time) *supportBundle {
+	b := &supportBundle{
+		GeneratedAt:     now.UTC(),
+		Version:         Version,
+		Images:          []*database.Image{},
+		UnpackedImages:  []*database.UnpackedImage{},
+		Snapshots:       []*database.Snapshot{},
+		DStateProcesses: []string{},
+		Tools:           src.hostTools(),
+	}
+	fail := func(section string, err error) {
+		if b.Errors == nil {
+			b.Errors = make(map[string]string)
+		}
+		b.Errors[section] = err.Error()
+	}
+
+	if host, err := os.Hostname(); err == nil {
+		b.Hostname = host
+	}
+
+	if images, err := src.store.ListImages(ctx, ""); err != nil {
+		fail("images", err)
+	} else if images != nil {
+		b.Images = images
+	}
+	if unpacked, err := src.store.ListUnpackedImages(ctx); err != nil {
+		fail("unpacked_images", err)
+	} else if unpacked != nil {
+		b.UnpackedImages = unpacked
+	}
+	if snaps, err := src.store.ListSnapshots(ctx); err != nil {
+		fail("snapshots", err)
+	} else if snaps != nil {
+		b.Snapshots = snaps
+	}
+
+	if info, err := src.pool.ParsePoolStatus(ctx, src.poolName); err != nil {
+		fail("pool", err)
+	} else {
+		b.Pool = info
+	}
+
+	if lock, err := src.readLock(); err != nil {
+		fail("lock", err)
+	} else {
+		b.Lock = lock
+	}
+
+	if procs, err := src.dState(); err != nil {
+		fail("d_state", err)
+	} else {
+		b.DStateCount = len(procs)
+		for _, p := range procs {
+			b.DStateProcesses = append(b.DStateProcesses, p.String())
+		}
+	}
+
+	return b
+}
+
+// writeSupportBundle writes the bundle as indented JSON.
+func writeSupportBundle(w io.Writer, b *supportBundle) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(b)
+}
+
+// runSupportBundle writes the database contents, pool status, manager lock,
+// D-state processes and host tools as one JSON document to --out, or stdout.
+// It takes no lock and changes nothing.
+func runSupportBundle(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), supportBundleTimeout)
+	defer cancel()
+
+	db, err := database.New(database.Config{Path: cfg.DBPath})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	dmClient := devicemapper.New()
+	dmClient.SetLogger(log)
+
+	bundle := gatherSupportBundle(ctx, supportSources{
+		store:     db,
+		pool:      dmClient,
+		poolName:  cfg.PoolName,
+		readLock:  func() (*lockFileInfo, error) { return readManagerLock(cfg.FSMDBPath) },
+		dState:    func() ([]safeguards.ProcState, error) { return safeguards.DStateProcs(safeguards.ProcDir) },
+		hostTools: devicemapper.Tools,
+	}, time.Now())
+
+	if cfg.Out == "" {
+		return writeSupportBundle(os.Stdout, bundle)
+	}
+
+	f, err := os.Create(cfg.Out)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	if err := writeSupportBundle(f, bundle); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Support bundle written to %s\n", cfg.Out)
+	return nil
+}
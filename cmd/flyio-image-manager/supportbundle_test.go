@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/safeguards"
+)
+
+// fakeSupportStore returns fixed rows.
+type fakeSupportStore struct {
+	images   []*database.Image
+	unpacked []*database.UnpackedImage
+	snaps    []*database.Snapshot
+	err      error
+}
+
+func (f *fakeSupportStore) ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error) {
+	return f.images, f.err
+}
+
+func (f *fakeSupportStore) ListUnpackedImages(ctx context.Context) ([]*database.UnpackedImage, error) {
+	return f.unpacked, f.err
+}
+
+func (f *fakeSupportStore) ListSnapshots(ctx context.Context) ([]*database.Snapshot, error) {
+	return f.snaps, f.err
+}
+
+func fakeSupportSources(store supportStore, pool poolStatusSource) supportSources {
+	return supportSources{
+		store:    store,
+		pool:     pool,
+		poolName: "pool",
+		readLock: func() (*lockFileInfo, error) {
+			return &lockFileInfo{PID: 4242, Command: "daemon", Version: "v1.2.3"}, nil
+		},
+		dState: func() ([]safeguards.ProcState, error) {
+			return []safeguards.ProcState{{PID: 99, Comm: "kworker/u8:2+dm-thin", State: 'D'}}, nil
+		},
+		hostTools: func() devicemapper.HostTools { return devicemapper.HostTools{Udevadm: true, Dmesg: true} },
+	}
+}
+
+func TestSupportBundle_JSON(t *testing.T) {
+	store := &fakeSupportStore{
+		images:   []*database.Image{{ImageID: "img1", S3Key: "images/img1.tar", DownloadStatus: "completed"}},
+		unpacked: []*database.UnpackedImage{{ImageID: "img1", DeviceID: "5", DeviceName: "thin-5"}},
+		snaps:    []*database.Snapshot{{ImageID: "img1", SnapshotID: "1000005", SnapshotName: "snap-img1", Active: true}},
+	}
+	pool := &fakePoolStatus{info: &devicemapper.PoolInfo{Name: "pool", TotalDataBlocks: 1000, UsedDataBlocks: 250}}
+
+	b := gatherSupportBundle(context.Background(), fakeSupportSources(store, pool), time.Now())
+	var buf bytes.Buffer
+	if err := writeSupportBundle(&buf, b); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("bundle is not valid JSON: %v\n%s", err, buf.String())
+	}
+	for _, key := range []string{"generated_at", "version", "images", "unpacked_images", "snapshots", "pool", "lock", "d_state_count", "d_state_processes", "tools"} {
+		if _, ok := doc[key]; !ok {
+			t.Errorf("bundle missing %q", key)
+		}
+	}
+	if _, ok := doc["errors"]; ok {
+		t.Errorf("bundle has errors: %s", doc["errors"])
+	}
+
+	var got struct {
+		Snapshots []database.Snapshot    `json:"snapshots"`
+		Pool      devicemapper.PoolInfo  `json:"pool"`
+		Lock      lockFileInfo           `json:"lock"`
+		DState    int                    `json:"d_state_count"`
+		Tools     devicemapper.HostTools `json:"tools"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Snapshots) != 1 || got.Snapshots[0].SnapshotID != "1000005" {
+		t.Errorf("snapshots = %+v", got.Snapshots)
+	}
+	if got.Pool.UsedDataBlocks != 250 || got.Lock.PID != 4242 || got.DState != 1 || !got.Tools.Udevadm || got.Tools.Vmstat {
+		t.Errorf("bundle = %+v", got)
+	}
+}
+
+func TestSupportBundle_PartialFailure(t *testing.T) {
+	store := &fakeSupportStore{err: errors.New("database is locked")}
+	pool := &fakePoolStatus{err: errors.New("pool \"pool\" does not exist")}
+
+	b := gatherSupportBundle(context.Background(), fakeSupportSources(store, pool), time.Now())
+	for _, section := range []string{"images", "unpacked_images", "snapshots", "pool"} {
+		if b.Errors[section] == "" {
+			t.Errorf("no error recorded for %s", section)
+		}
+	}
+	// The sections that could be read are still there.
+	if b.Lock == nil || b.DStateCount != 1 {
+		t.Errorf("lock = %+v, d_state_count = %d; want them gathered despite the failures", b.Lock, b.DStateCount)
+	}
+
+	var buf bytes.Buffer
+	if err := writeSupportBundle(&buf, b); err != nil || !json.Valid(buf.Bytes()) {
+		t.Errorf("writeSupportBundle() = %v, valid JSON = %v", err, json.Valid(buf.Bytes()))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+
+	"github.com/superfly/fsm/tui"
+)
+
+// redirectTUILogs keeps logrus and the standard library logger (used by the
+// database) off the terminal while a TUI owns it. With path empty their output
+// is discarded; otherwise it is appended to path, along with tui.DebugLog
+// messages. The returned func closes the file.
+func redirectTUILogs(path string) (func(), error) {
+	if path == "" {
+		log.SetOutput(io.Discard)
+		stdlog.SetOutput(io.Discard)
+		return func() {}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open debug log: %w", err)
+	}
+	log.SetOutput(f)
+	stdlog.SetOutput(f)
+	tui.SetDebugOutput(f)
+	return func() {
+		tui.SetDebugOutput(nil)
+		log.SetOutput(io.Discard)
+		stdlog.SetOutput(io.Discard)
+		f.Close()
+	}, nil
+}
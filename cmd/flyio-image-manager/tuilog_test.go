@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/superfly/fsm/tui"
+)
+
+// captureTerminal redirects stdout and stderr for the rest of the test and
+// returns a func that restores them and reports what was written.
+func captureTerminal(t *testing.T) func() string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldOut, oldErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	return func() string {
+		os.Stdout, os.Stderr = oldOut, oldErr
+		w.Close()
+		out, _ := io.ReadAll(r)
+		return string(out)
+	}
+}
+
+func TestRedirectTUILogs_DebugLog(t *testing.T) {
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		stdlog.SetOutput(os.Stderr)
+	})
+	path := filepath.Join(t.TempDir(), "tui.log")
+
+	terminal := captureTerminal(t)
+	closeLogs, err := redirectTUILogs(path)
+	if err != nil {
+		terminal()
+		t.Fatalf("redirectTUILogs() error = %v", err)
+	}
+	log.Error("logrus line")
+	stdlog.Print("stdlog line")
+	tui.DebugLog("tui line")
+	closeLogs()
+	printed := terminal()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"logrus line", "stdlog line", "tui line"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("debug log missing %q:\n%s", want, data)
+		}
+	}
+	if printed != "" {
+		t.Errorf("logs reached the terminal: %q", printed)
+	}
+}
+
+func TestRedirectTUILogs_Discard(t *testing.T) {
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		stdlog.SetOutput(os.Stderr)
+	})
+
+	terminal := captureTerminal(t)
+	closeLogs, err := redirectTUILogs("")
+	if err != nil {
+		terminal()
+		t.Fatalf("redirectTUILogs() error = %v", err)
+	}
+	log.Error("logrus line")
+	stdlog.Print("stdlog line")
+	closeLogs()
+	if printed := terminal(); printed != "" {
+		t.Errorf("logs reached the terminal: %q", printed)
+	}
+}
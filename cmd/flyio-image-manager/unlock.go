@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/safeguards"
+)
+
+// lockPIDReuseSlack is how much later than the lock's timestamp the process
+// now holding its PID may have started and still be taken for the holder.
+// The holder writes the timestamp after it starts, and process start times
+// are read to about a second.
+const lockPIDReuseSlack = 2 * time.Second
+
+// lockHolderState is what unlock found at a manager lock's PID.
+type lockHolderState int
+
+const (
+	holderDead   lockHolderState = iota // No process has the PID
+	holderReused                        // The PID belongs to a process started after the lock was taken
+	holderLive                          // The holder may still be running
+)
+
+func (s lockHolderState) String() string {
+	switch s {
+	case holderDead:
+		return "not running"
+	case holderReused:
+		return "PID reused by a later process"
+	}
+	return "running"
+}
+
+// lockInspector holds the process checks run by the unlock command. Each is
+// a field so tests can stand in for live, dead and reused PIDs.
+type lockInspector struct {
+	processAlive func(pid int) bool
+	startTime    func(pid int) (time.Time, error)
+	dmDState     func() ([]safeguards.ProcState, error) // dm-related D-state processes
+}
+
+// newLockInspector returns an inspector backed by signal 0 and procfs.
+func newLockInspector() *lockInspector {
+	return &lockInspector{
+		processAlive: isProcessRunning,
+		startTime: func(pid int) (time.Time, error) {
+			return safeguards.ProcStartTime(safeguards.ProcDir, pid)
+		},
+		dmDState: func() ([]safeguards.ProcState, error) {
+			procs, err := safeguards.DStateProcs(safeguards.ProcDir)
+			var dm []safeguards.ProcState
+			for _, p := range procs {
+				if p.DmRelated() {
+					dm = append(dm, p)
+				}
+			}
+			return dm, err
+		},
+	}
+}
+
+// holderState classifies the process at info's PID. A live PID only counts
+// as reused when its start time is known and clearly after the lock was
+// taken; anything that can't be proven stale is live.
+func (i *lockInspector) holderState(info *lockFileInfo) lockHolderState {
+	if info.PID <= 0 || !i.processAlive(info.PID) {
+		return holderDead
+	}
+	if info.Timestamp <= 0 {
+		return holderLive
+	}
+	started, err := i.startTime(info.PID)
+	if err != nil {
+		return holderLive
+	}
+	if started.After(time.Unix(info.Timestamp, 0).Add(lockPIDReuseSlack)) {
+		return holderReused
+	}
+	return holderLive
+}
+
+// unlockOptions are the unlock command's flags.
+type unlockOptions struct {
+	force     bool // Remove a lock that can't be proven stale
+	noConfirm bool // Don't ask before a forced removal
+}
+
+// errUnlockDeclined is returned when the user answers no at the prompt.
+var errUnlockDeclined = errors.New("lock left in place")
+
+// runUnlock removes the manager lock in --fsm-db after showing who holds it.
+func runUnlock(cfg Config) error {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return err
+	}
+	opts := unlockOptions{force: cfg.Force, noConfirm: cfg.NoConfirm}
+	return unlockManagerLock(os.Stdout, os.Stdin, filepath.Join(cfg.FSMDBPath, "flyio-manager.lock"), newLockInspector(), opts)
+}
+
+// unlockManagerLock prints the holder of the lock at lockPath and removes the
+// lock if it is provably stale: its PID is not running, or now belongs to a
+// process started after the lock was taken. A lock that may still be held is
+// only removed with opts.force, after a confirmation read from in unless
+// opts.noConfirm. Nothing is removed while dm-related processes are stuck in
+// D state unless opts.force, since the holder may be in the middle of a
+// devicemapper operation.
+func unlockManagerLock(w io.Writer, in io.Reader, lockPath string, insp *lockInspector, opts unlockOptions) error {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Fprintf(w, "No manager lock at %s\n", lockPath)
+			return nil
+		}
+		return fmt.Errorf("failed to read manager lock: %w", err)
+	}
+
+	fmt.Fprintf(w, "Lock file: %s\n", lockPath)
+	state := holderLive
+	var info lockFileInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		fmt.Fprintf(w, "Holder:    unknown (invalid lock file: %v)\n", err)
+	} else {
+		state = insp.holderState(&info)
+		started := time.Unix(info.Timestamp, 0)
+		fmt.Fprintf(w, "PID:       %d (%s)\n", info.PID, state)
+		fmt.Fprintf(w, "Command:   %s\n", info.Command)
+		fmt.Fprintf(w, "Version:   %s\n", lockVersion(info.Version))
+		fmt.Fprintf(w, "Taken:     %s (%s ago)\n", started.Format(time.RFC3339), time.Since(started).Round(time.Second))
+	}
+
+	// A holder stuck in the kernel still owns the devicemapper operation it
+	// started; letting another process in now is how the kernel panics
+	dm, err := insp.dmDState()
+	forced := false
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "Warning: could not check for D-state processes: %v\n", err)
+	case len(dm) > 0:
+		fmt.Fprintf(w, "D-state devicemapper processes:\n")
+		for _, p := range dm {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+		if !opts.force {
+			return fmt.Errorf("%d devicemapper processes are stuck in D state; reboot rather than removing the lock, or use --force (DANGEROUS)", len(dm))
+		}
+		forced = true
+	}
+
+	if state == holderLive {
+		if !opts.force {
+			return errors.New("lock may still be held, refusing to remove it; stop the holder, or use --force if you are sure it is gone")
+		}
+		forced = true
+	}
+	if forced && !opts.noConfirm && !confirm(w, in, "Remove the lock anyway?") {
+		return errUnlockDeclined
+	}
+
+	// Don't remove a lock someone else took while we were looking
+	if current, err := os.ReadFile(lockPath); err != nil || !bytes.Equal(current, data) {
+		return errors.New("lock file changed while it was inspected, run unlock again")
+	}
+	if err := os.Remove(lockPath); err != nil {
+		return fmt.Errorf("failed to remove lock file: %w", err)
+	}
+	log.WithFields(logrus.Fields{
+		"lock_path":  lockPath,
+		"holder_pid": info.PID,
+		"holder":     state.String(),
+		"forced":     forced,
+	}).Warn("removed manager lock")
+	fmt.Fprintf(w, "Removed %s\n", lockPath)
+	return nil
+}
+
+// confirm asks question on w and reports whether the answer read from in is yes.
+func confirm(w io.Writer, in io.Reader, question string) bool {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/safeguards"
+)
+
+// fakeLockInspector reports the holder's PID as alive and started at
+// started (zero for dead), with dm as the stuck D-state processes.
+func fakeLockInspector(started time.Time, dm ...safeguards.ProcState) *lockInspector {
+	return &lockInspector{
+		processAlive: func(int) bool { return !started.IsZero() },
+		startTime:    func(int) (time.Time, error) { return started, nil },
+		dmDState:     func() ([]safeguards.ProcState, error) { return dm, nil },
+	}
+}
+
+func writeLockFile(t *testing.T, info lockFileInfo) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "flyio-manager.lock")
+	data, _ := json.Marshal(info)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUnlockManagerLock(t *testing.T) {
+	captureLockLog(t)
+	taken := time.Now().Add(-time.Hour).Truncate(time.Second)
+	stuck := safeguards.ProcState{PID: 412, Comm: "kworker/u8:2+dm-thin", State: 'D'}
+
+	tests := []struct {
+		name       string
+		insp       *lockInspector
+		opts       unlockOptions
+		answer     string
+		wantErr    string
+		wantRemove bool
+		wantOut    string
+	}{
+		{
+			name:       "dead PID",
+			insp:       fakeLockInspector(time.Time{}),
+			wantRemove: true,
+			wantOut:    "PID:       4242 (not running)",
+		},
+		{
+			name:       "reused PID",
+			insp:       fakeLockInspector(taken.Add(10 * time.Minute)),
+			wantRemove: true,
+			wantOut:    "PID reused by a later process",
+		},
+		{
+			name:    "live PID",
+			insp:    fakeLockInspector(taken.Add(-time.Second)),
+			wantErr: "may still be held",
+			wantOut: "PID:       4242 (running)",
+		},
+		{
+			name:    "PID started just after the lock time is the holder",
+			insp:    fakeLockInspector(taken.Add(time.Second)),
+			wantErr: "may still be held",
+		},
+		{
+			name:       "live PID forced and confirmed",
+			insp:       fakeLockInspector(taken),
+			opts:       unlockOptions{force: true},
+			answer:     "y\n",
+			wantRemove: true,
+			wantOut:    "[y/N]",
+		},
+		{
+			name:    "live PID forced and declined",
+			insp:    fakeLockInspector(taken),
+			opts:    unlockOptions{force: true},
+			answer:  "\n",
+			wantErr: errUnlockDeclined.Error(),
+		},
+		{
+			name:       "live PID forced without confirmation",
+			insp:       fakeLockInspector(taken),
+			opts:       unlockOptions{force: true, noConfirm: true},
+			wantRemove: true,
+		},
+		{
+			name:    "dead PID with dm processes in D state",
+			insp:    fakeLockInspector(time.Time{}, stuck),
+			wantErr: "stuck in D state",
+			wantOut: "412 kworker/u8:2+dm-thin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeLockFile(t, lockFileInfo{PID: 4242, Timestamp: taken.Unix(), Command: "daemon", Version: "v1.2.3"})
+			var out bytes.Buffer
+			err := unlockManagerLock(&out, strings.NewReader(tt.answer), path, tt.insp, tt.opts)
+
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unlockManagerLock() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("unlockManagerLock() error = %v, want %q", err, tt.wantErr)
+			}
+			_, statErr := os.Stat(path)
+			if removed := errors.Is(statErr, os.ErrNotExist); removed != tt.wantRemove {
+				t.Errorf("lock removed = %v, want %v", removed, tt.wantRemove)
+			}
+			if !strings.Contains(out.String(), "Command:   daemon") || !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("output = %q, want the holder and %q", out.String(), tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestUnlockManagerLock_NoLockOrInvalid(t *testing.T) {
+	captureLockLog(t)
+	insp := fakeLockInspector(time.Time{})
+
+	var out bytes.Buffer
+	missing := filepath.Join(t.TempDir(), "flyio-manager.lock")
+	if err := unlockManagerLock(&out, strings.NewReader(""), missing, insp, unlockOptions{}); err != nil {
+		t.Fatalf("unlockManagerLock() with no lock error = %v", err)
+	}
+	if !strings.Contains(out.String(), "No manager lock") {
+		t.Errorf("output = %q, want no lock reported", out.String())
+	}
+
+	// A lock that can't be parsed can't be proven stale
+	if err := os.WriteFile(missing, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlockManagerLock(&out, strings.NewReader(""), missing, insp, unlockOptions{}); err == nil {
+		t.Fatal("unlockManagerLock() removed an unreadable lock without --force")
+	}
+	if err := unlockManagerLock(&out, strings.NewReader(""), missing, insp, unlockOptions{force: true, noConfirm: true}); err != nil {
+		t.Fatalf("unlockManagerLock(--force) error = %v", err)
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock still present after --force: %v", err)
+	}
+}
+
+func TestLockInspector_ThisProcess(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no procfs")
+	}
+	insp := newLockInspector()
+
+	// A lock taken now by this process is held by a live process
+	now := &lockFileInfo{PID: os.Getpid(), Timestamp: time.Now().Unix()}
+	if got := insp.holderState(now); got != holderLive {
+		t.Errorf("holderState(this process) = %v, want running", got)
+	}
+	// One dated before this process started has had its PID reused
+	old := &lockFileInfo{PID: os.Getpid(), Timestamp: time.Now().Add(-24 * 365 * time.Hour).Unix()}
+	if got := insp.holderState(old); got != holderReused {
+		t.Errorf("holderState(year-old lock) = %v, want PID reused", got)
+	}
+}
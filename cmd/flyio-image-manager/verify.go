@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// verifyStore is the subset of *database.DB used by verify-image.
+type verifyStore interface {
+	GetUnpackedImageByID(ctx context.Context, imageID string) (*database.UnpackedImage, error)
+}
+
+// filesystemVerifier is the subset of *devicemapper.Client used by verify-image.
+type filesystemVerifier interface {
+	DeviceExists(ctx context.Context, deviceName string) (bool, error)
+	ActivateDeviceReadOnly(ctx context.Context, poolName, deviceName, deviceID string, sizeBytes int64) error
+	DeactivateDevice(ctx context.Context, deviceName string) error
+	CheckFilesystem(ctx context.Context, devicePath string) (*devicemapper.FsckResult, error)
+	MaxDeviceSize() int64
+}
+
+// runVerifyImage checks the filesystem on an image's unpacked device and
+// returns the checker's exit status (0 when clean) as the process exit code.
+func runVerifyImage(cfg Config) (int, error) {
+	if err := setupLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	logger := log.WithFields(logrus.Fields{
+		"command":  "verify-image",
+		"image_id": cfg.ImageID,
+	})
+
+	// An inactive device is activated for the check, so there is no dry run.
+	var result *devicemapper.FsckResult
+	err := withDMCommand(ctx, cfg, "verify-image:"+cfg.ImageID, false, func() error {
+		db, err := database.New(database.Config{Path: cfg.DBPath})
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		dmClient := devicemapper.New()
+		dmClient.SetLogger(log)
+		dmClient.SetOperationRecorder(dmRecorder{db})
+
+		result, err = verifyImage(ctx, logger, db, dmClient, cfg.PoolName, cfg.ImageID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if result.Clean {
+		fmt.Printf("%s: clean (%s)\n", cfg.ImageID, result.Filesystem)
+		return 0, nil
+	}
+	fmt.Printf("%s: DIRTY (%s check exited %d)\n\n%s", cfg.ImageID, result.Filesystem, result.ExitCode, result.Output)
+	return result.ExitCode, nil
+}
+
+// verifyImage runs a read-only filesystem check on the unpacked device of imageID.
+//
+// An inactive device is activated read-only for the check and deactivated
+// again afterwards; a device that was already active is left as found. A
+// mounted device is refused: CheckFilesystem returns a DeviceMountedError
+// rather than check a filesystem that may be written while it reads.
+func verifyImage(ctx context.Context, logger logrus.FieldLogger, store verifyStore, dm filesystemVerifier, poolName, imageID string) (result *devicemapper.FsckResult, err error) {
+	img, err := store.GetUnpackedImageByID(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up unpacked image: %w", err)
+	}
+	if img == nil {
+		return nil, fmt.Errorf("image %s has not been unpacked", imageID)
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"device_name": img.DeviceName,
+		"device_id":   img.DeviceID,
+	})
+
+	exists, err := dm.DeviceExists(ctx, img.DeviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check device %s: %w", img.DeviceName, err)
+	}
+
+	if !exists {
+		// Activate at the device's full size: a table shorter than the
+		// filesystem makes fsck report a size mismatch
+		logger.Info("device inactive, activating read-only for verification")
+		if err := dm.ActivateDeviceReadOnly(ctx, poolName, img.DeviceName, img.DeviceID, img.DeviceSize(dm.MaxDeviceSize())); err != nil {
+			return nil, fmt.Errorf("failed to activate device %s: %w", img.DeviceName, err)
+		}
+		defer func() {
+			if derr := dm.DeactivateDevice(ctx, img.DeviceName); derr != nil {
+				logger.WithError(derr).Error("failed to deactivate device after verification")
+				if err == nil {
+					err = fmt.Errorf("verification finished but device %s is still active: %w", img.DeviceName, derr)
+				}
+			}
+		}()
+	}
+
+	return dm.CheckFilesystem(ctx, img.DevicePath)
+}
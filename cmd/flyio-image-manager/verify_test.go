@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// fakeVerifyStore returns a single unpacked image row.
+type fakeVerifyStore struct {
+	img *database.UnpackedImage
+	err error
+}
+
+func (f *fakeVerifyStore) GetUnpackedImageByID(ctx context.Context, imageID string) (*database.UnpackedImage, error) {
+	if f.img == nil || f.img.ImageID != imageID {
+		return nil, f.err
+	}
+	return f.img, f.err
+}
+
+// fakeVerifier records device calls and returns a canned fsck result.
+type fakeVerifier struct {
+	active        bool
+	fsck          *devicemapper.FsckResult
+	fsckErr       error
+	deactivateErr error
+
+	calls []string
+	size  int64 // Size passed to ActivateDeviceReadOnly
+}
+
+func (f *fakeVerifier) DeviceExists(ctx context.Context, deviceName string) (bool, error) {
+	return f.active, nil
+}
+
+func (f *fakeVerifier) ActivateDeviceReadOnly(ctx context.Context, poolName, deviceName, deviceID string, sizeBytes int64) error {
+	f.calls = append(f.calls, "activate-ro "+deviceName+" "+deviceID)
+	f.size = sizeBytes
+	f.active = true
+	return nil
+}
+
+func (f *fakeVerifier) DeactivateDevice(ctx context.Context, deviceName string) error {
+	f.calls = append(f.calls, "deactivate "+deviceName)
+	if f.deactivateErr != nil {
+		return f.deactivateErr
+	}
+	f.active = false
+	return nil
+}
+
+func (f *fakeVerifier) MaxDeviceSize() int64 { return devicemapper.DefaultMaxDeviceSize }
+
+func (f *fakeVerifier) CheckFilesystem(ctx context.Context, devicePath string) (*devicemapper.FsckResult, error) {
+	f.calls = append(f.calls, "fsck "+devicePath)
+	return f.fsck, f.fsckErr
+}
+
+func testUnpackedImage() *fakeVerifyStore {
+	return &fakeVerifyStore{img: &database.UnpackedImage{
+		ImageID:         "img-1",
+		DeviceID:        "42",
+		DeviceName:      "thin-42",
+		DevicePath:      "/dev/mapper/thin-42",
+		SizeBytes:       100 << 20,
+		DeviceSizeBytes: 1 << 30,
+	}}
+}
+
+func TestVerifyImage_ActivatesInactiveDevice(t *testing.T) {
+	dm := &fakeVerifier{fsck: &devicemapper.FsckResult{Filesystem: devicemapper.FilesystemExt4, Clean: true}}
+
+	result, err := verifyImage(context.Background(), quietLogger(), testUnpackedImage(), dm, "pool", "img-1")
+	if err != nil {
+		t.Fatalf("verifyImage() error = %v", err)
+	}
+	if !result.Clean {
+		t.Errorf("result = %+v, want clean", result)
+	}
+
+	want := "activate-ro thin-42 42,fsck /dev/mapper/thin-42,deactivate thin-42"
+	if got := strings.Join(dm.calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+	if dm.active {
+		t.Error("device should be deactivated again after verification")
+	}
+	if dm.size != 1<<30 {
+		t.Errorf("activated with %d bytes, want the device size %d", dm.size, 1<<30)
+	}
+}
+
+// TestVerifyImage_LegacyRowActivatesAtMaxSize verifies that a row recorded
+// before the device size was stored activates at the largest device size
+// rather than the smaller extracted content size.
+func TestVerifyImage_LegacyRowActivatesAtMaxSize(t *testing.T) {
+	store := testUnpackedImage()
+	store.img.DeviceSizeBytes = 0
+	dm := &fakeVerifier{fsck: &devicemapper.FsckResult{Clean: true}}
+
+	if _, err := verifyImage(context.Background(), quietLogger(), store, dm, "pool", "img-1"); err != nil {
+		t.Fatalf("verifyImage() error = %v", err)
+	}
+	if dm.size != devicemapper.DefaultMaxDeviceSize {
+		t.Errorf("activated with %d bytes, want %d", dm.size, devicemapper.DefaultMaxDeviceSize)
+	}
+}
+
+func TestVerifyImage_LeavesActiveDeviceActive(t *testing.T) {
+	dm := &fakeVerifier{active: true, fsck: &devicemapper.FsckResult{Clean: true}}
+
+	if _, err := verifyImage(context.Background(), quietLogger(), testUnpackedImage(), dm, "pool", "img-1"); err != nil {
+		t.Fatalf("verifyImage() error = %v", err)
+	}
+	if got := strings.Join(dm.calls, ","); got != "fsck /dev/mapper/thin-42" {
+		t.Errorf("calls = %s, want only fsck", got)
+	}
+	if !dm.active {
+		t.Error("a device that was already active must stay active")
+	}
+}
+
+func TestVerifyImage_Dirty(t *testing.T) {
+	dm := &fakeVerifier{fsck: &devicemapper.FsckResult{Filesystem: devicemapper.FilesystemExt4, ExitCode: 4, Output: "Inode 12 has illegal blocks"}}
+
+	result, err := verifyImage(context.Background(), quietLogger(), testUnpackedImage(), dm, "pool", "img-1")
+	if err != nil {
+		t.Fatalf("a dirty filesystem is a result, not an error: %v", err)
+	}
+	if result.Clean || result.ExitCode != 4 {
+		t.Errorf("result = %+v, want dirty with exit code 4", result)
+	}
+	if dm.active {
+		t.Error("device should be deactivated even when the check finds errors")
+	}
+}
+
+func TestVerifyImage_FsckError(t *testing.T) {
+	dm := &fakeVerifier{fsckErr: errors.New("e2fsck: no such file")}
+
+	if _, err := verifyImage(context.Background(), quietLogger(), testUnpackedImage(), dm, "pool", "img-1"); err == nil {
+		t.Fatal("expected error when fsck cannot run")
+	}
+	if dm.active {
+		t.Error("device should be deactivated when fsck fails")
+	}
+}
+
+func TestVerifyImage_DeactivateFailure(t *testing.T) {
+	dm := &fakeVerifier{
+		fsck:          &devicemapper.FsckResult{Clean: true},
+		deactivateErr: errors.New("device busy"),
+	}
+
+	result, err := verifyImage(context.Background(), quietLogger(), testUnpackedImage(), dm, "pool", "img-1")
+	if err == nil || !strings.Contains(err.Error(), "still active") {
+		t.Fatalf("error = %v, want deactivation failure", err)
+	}
+	if result == nil || !result.Clean {
+		t.Errorf("fsck result should still be returned, got %+v", result)
+	}
+}
+
+func TestVerifyImage_NotUnpacked(t *testing.T) {
+	dm := &fakeVerifier{}
+
+	_, err := verifyImage(context.Background(), quietLogger(), &fakeVerifyStore{}, dm, "pool", "missing")
+	if err == nil || !strings.Contains(err.Error(), "not been unpacked") {
+		t.Fatalf("error = %v, want not-unpacked error", err)
+	}
+	if len(dm.calls) != 0 {
+		t.Errorf("no device operations expected, got %v", dm.calls)
+	}
+}
+
+func TestVerifyImage_MountedDevice(t *testing.T) {
+	dm := &fakeVerifier{
+		active:  true,
+		fsckErr: &devicemapper.DeviceMountedError{DeviceName: "thin-42", MountPoint: "/mnt/thin-42"},
+	}
+
+	_, err := verifyImage(context.Background(), quietLogger(), testUnpackedImage(), dm, "pool", "img-1")
+	var mounted *devicemapper.DeviceMountedError
+	if !errors.As(err, &mounted) {
+		t.Fatalf("error = %v, want a DeviceMountedError", err)
+	}
+	if !dm.active || strings.Contains(strings.Join(dm.calls, ","), "deactivate") {
+		t.Errorf("a mounted device must be left active; calls = %v", dm.calls)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// clearScreen moves the cursor home and clears the terminal. Unlike the TUI's
+// alt-screen it works on any ANSI terminal, including over plain SSH, and
+// leaves the last frame on screen after exit.
+const clearScreen = "\033[H\033[2J"
+
+// clock is the time source for watch mode, replaced in tests.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// watch calls render every interval until ctx is done, replacing the screen
+// with each frame. A render error is shown in its frame rather than ending the
+// watch, so a briefly locked database doesn't stop it.
+func watch(ctx context.Context, w io.Writer, clk clock, interval time.Duration, title string, render func(w io.Writer) error) error {
+	if interval <= 0 {
+		return fmt.Errorf("watch interval must be positive, got %v", interval)
+	}
+
+	for {
+		// Build the whole frame first so the screen is cleared and redrawn
+		// in one write, without flicker.
+		var frame bytes.Buffer
+		frame.WriteString(clearScreen)
+		fmt.Fprintf(&frame, "Every %v: %s    %s\n\n", interval, title, clk.Now().Format(time.RFC3339))
+		if err := render(&frame); err != nil {
+			fmt.Fprintf(&frame, "Error: %v\n", err)
+		}
+		if _, err := w.Write(frame.Bytes()); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-clk.After(interval):
+		}
+	}
+}
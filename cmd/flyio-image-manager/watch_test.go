@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/fsm/database"
+)
+
+// fakeClock returns a fixed time and fires each After immediately, recording
+// the requested durations. After the given number of ticks it cancels the
+// watch instead.
+type fakeClock struct {
+	now    time.Time
+	ticks  int
+	cancel context.CancelFunc
+	waits  []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	if len(c.waits) > c.ticks {
+		c.cancel()
+		return nil
+	}
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+// fakeImageLister serves a fixed set of images and tags.
+type fakeImageLister struct {
+	images []*database.Image
+	tags   map[string][]string
+	reads  int
+}
+
+func (f *fakeImageLister) ListImages(ctx context.Context, downloadStatus string) ([]*database.Image, error) {
+	f.reads++
+	return f.images, nil
+}
+
+func (f *fakeImageLister) ListTags(ctx context.Context) (map[string][]string, error) {
+	return f.tags, nil
+}
+
+func TestRenderImages_Stable(t *testing.T) {
+	downloaded := time.Date(2025, 11, 21, 20, 0, 35, 0, time.UTC)
+	store := &fakeImageLister{
+		images: []*database.Image{
+			{ImageID: "img1", S3Key: "a.tar", SizeBytes: 1536, DownloadStatus: "completed", DownloadedAt: &downloaded},
+			{ImageID: "img2", S3Key: "b.tar", SizeBytes: 5 << 20, DownloadStatus: "downloading"},
+		},
+		tags: map[string][]string{"img1": {"alpine:latest"}},
+	}
+
+	var first, second bytes.Buffer
+	if err := renderImages(context.Background(), &first, store, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := renderImages(context.Background(), &second, store, false); err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("renderImages() output changed between renders:\n%s\n---\n%s", first.String(), second.String())
+	}
+	for _, want := range []string{"Found 2 images:", "Tags:           alpine:latest", "Size:           1.5 KB", "Size:           5.0 MB", "Downloaded At:  (not completed)"} {
+		if !strings.Contains(first.String(), want) {
+			t.Errorf("renderImages() output missing %q:\n%s", want, first.String())
+		}
+	}
+}
+
+func TestWatch_HonorsInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := &fakeClock{now: time.Date(2025, 11, 21, 20, 0, 0, 0, time.UTC), ticks: 3, cancel: cancel}
+	store := &fakeImageLister{images: []*database.Image{{ImageID: "img1", SizeBytes: 1536}}}
+
+	var out bytes.Buffer
+	err := watch(ctx, &out, clk, 5*time.Second, "list-images", func(w io.Writer) error {
+		return renderImages(ctx, w, store, false)
+	})
+	if err != nil {
+		t.Fatalf("watch() error = %v", err)
+	}
+
+	// One frame up front, then one per tick, each read fresh from the store.
+	if store.reads != 4 {
+		t.Errorf("store read %d times, want 4", store.reads)
+	}
+	for i, d := range clk.waits {
+		if d != 5*time.Second {
+			t.Errorf("wait %d = %v, want the 5s interval", i, d)
+		}
+	}
+
+	frames := strings.Split(out.String(), clearScreen)[1:]
+	if len(frames) != 4 {
+		t.Fatalf("got %d frames, want 4", len(frames))
+	}
+	if !strings.HasPrefix(frames[0], "Every 5s: list-images    2025-11-21T20:00:00Z\n\n") {
+		t.Errorf("frame header = %q", strings.SplitN(frames[0], "\n", 2)[0])
+	}
+	for i := 1; i < len(frames); i++ {
+		if frames[i] != frames[0] {
+			t.Errorf("frame %d differs from frame 0 for an unchanged database:\n%s\n---\n%s", i, frames[i], frames[0])
+		}
+	}
+}
+
+func TestWatch_KeepsGoingOnErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := &fakeClock{ticks: 1, cancel: cancel}
+
+	renders := 0
+	var out bytes.Buffer
+	err := watch(ctx, &out, clk, time.Second, "list-images", func(w io.Writer) error {
+		renders++
+		return errors.New("database is locked")
+	})
+	if err != nil {
+		t.Fatalf("watch() error = %v", err)
+	}
+	if renders != 2 || strings.Count(out.String(), "Error: database is locked") != 2 {
+		t.Errorf("renders = %d, output:\n%s\nwant the error shown in both frames", renders, out.String())
+	}
+}
+
+func TestWatch_RejectsNonPositiveInterval(t *testing.T) {
+	err := watch(context.Background(), io.Discard, realClock{}, 0, "list-images", func(io.Writer) error { return nil })
+	if err == nil {
+		t.Error("watch() with a zero interval succeeded")
+	}
+}
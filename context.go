@@ -36,3 +36,9 @@ func IsRestartFromContext(ctx context.Context) bool {
 	}
 	return v.(bool)
 }
+
+// MockRetryContext returns ctx as a transition sees it on its count-th retry.
+// Use it with MockRequest to test a transition's retry limit.
+func MockRetryContext(ctx context.Context, count uint64) context.Context {
+	return withRetry(ctx, count)
+}
@@ -25,7 +25,7 @@
 //	}
 //
 //	// Store downloaded image metadata
-//	err = db.StoreImageMetadata(ctx, imageID, s3Key, localPath, checksum, sizeBytes)
+//	err = db.StoreImageMetadata(ctx, imageID, s3Key, localPath, sum, sizeBytes)
 //	if err != nil {
 //		log.Fatal(err)
 //	}
@@ -37,7 +37,12 @@
 //   - unpacked_images: Images extracted into devicemapper devices
 //   - snapshots: Active devicemapper snapshots
 //
-// See schema.go for complete table definitions and indexes.
+// A tags table maps human-readable tags (e.g. "python:3.12-prod") to image IDs.
+//
+// See schema.go for complete table definitions and indexes, and
+// migrations.go for the ordered migrations that build them. Each applied
+// migration is recorded in schema_migrations, so schema changes reach
+// existing databases the next time they are opened.
 //
 // # Concurrency
 //
@@ -77,6 +82,10 @@ type Config struct {
 
 	// ConnMaxLifetime is the maximum lifetime of a connection
 	ConnMaxLifetime time.Duration
+
+	// SkipMigrations opens the database without applying pending
+	// migrations, for inspecting an old database (see DB.MigrationStatus)
+	SkipMigrations bool
 }
 
 // DefaultConfig returns a default database configuration.
@@ -99,7 +108,8 @@ func DefaultConfig() Config {
 //   - Memory-mapped I/O (256MB)
 //
 // The function automatically creates tables if they don't exist and applies
-// any pending schema migrations.
+// any pending schema migrations, in order, recording each in the
+// schema_migrations table.
 //
 // Parameters:
 //   - cfg: Database configuration (path, connection pool settings)
@@ -155,7 +165,7 @@ func New(cfg Config) (*DB, error) {
 	}
 
 	// Initialize schema
-	if err := d.initSchema(); err != nil {
+	if err := d.initSchema(cfg.SkipMigrations); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
@@ -178,68 +188,19 @@ func (d *DB) Path() string {
 	return d.path
 }
 
-// initSchema creates the database schema if it doesn't exist.
-func (d *DB) initSchema() error {
+// initSchema creates the schema_migrations table and, unless skipMigrations
+// is set, applies any pending migrations (see migrations.go).
+func (d *DB) initSchema(skipMigrations bool) error {
 	// Create schema_migrations table first
 	if _, err := d.db.Exec(schemaMigrationsTable); err != nil {
 		return fmt.Errorf("failed to create schema_migrations table: %w", err)
 	}
 
-	// Run migrations
-	migrations := []migration{
-		{version: 1, description: "Initial schema", sql: initialSchema},
-		{version: 2, description: "Add image_locks table", sql: imageLocksSchema},
-	}
-
-	for _, m := range migrations {
-		if err := d.runMigration(m); err != nil {
-			return fmt.Errorf("migration %d failed: %w", m.version, err)
-		}
-	}
-
-	return nil
-}
-
-type migration struct {
-	version     int
-	description string
-	sql         string
-}
-
-func (d *DB) runMigration(m migration) error {
-	// Check if migration already applied
-	var exists bool
-	err := d.db.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = ?)", m.version).Scan(&exists)
-	if err != nil {
-		return fmt.Errorf("failed to check migration status: %w", err)
-	}
-
-	if exists {
-		return nil // Migration already applied
-	}
-
-	// Run migration in a transaction
-	tx, err := d.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
-
-	// Execute migration SQL
-	if _, err := tx.Exec(m.sql); err != nil {
-		return fmt.Errorf("failed to execute migration SQL: %w", err)
+	if skipMigrations {
+		return nil
 	}
-
-	// Record migration
-	if _, err := tx.Exec("INSERT INTO schema_migrations (version, description) VALUES (?, ?)", m.version, m.description); err != nil {
-		return fmt.Errorf("failed to record migration: %w", err)
-	}
-
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit migration: %w", err)
-	}
-
-	return nil
+	_, err := d.Migrate(context.Background())
+	return err
 }
 
 // AcquireImageLock attempts to acquire an exclusive lock for the given image.
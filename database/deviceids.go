@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// MaxDeviceID is the largest thin device ID devicemapper accepts (24 bits).
+const MaxDeviceID = 1<<24 - 1
+
+// maxDeviceID bounds allocation; tests lower it to exercise exhaustion.
+var maxDeviceID uint32 = MaxDeviceID
+
+// ErrDeviceIDsExhausted is returned by AllocateDeviceID when every thin device
+// ID is in use.
+var ErrDeviceIDsExhausted = errors.New("thin device ID space exhausted")
+
+// ImageDeviceOwner returns the device_ids owner key for an image's unpacked device.
+func ImageDeviceOwner(imageID string) string {
+	return "image:" + imageID
+}
+
+// SnapshotDeviceOwner returns the device_ids owner key for a snapshot device.
+func SnapshotDeviceOwner(snapshotName string) string {
+	return "snapshot:" + snapshotName
+}
+
+// AllocateDeviceID returns the thin device ID recorded for owner, allocating
+// one on first use. A new ID is preferred if free, otherwise the next free ID
+// above it, wrapping around to 1; no two owners ever share an ID. Returns
+// ErrDeviceIDsExhausted when all IDs up to MaxDeviceID are taken.
+//
+// An allocation outlives the device it names until ReleaseDeviceID, so an ID
+// is never reused while the pool might still hold its thin device.
+func (d *DB) AllocateDeviceID(ctx context.Context, owner string, preferred uint32) (string, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id uint32
+	err = tx.QueryRowContext(ctx, `SELECT device_id FROM device_ids WHERE owner = ?`, owner).Scan(&id)
+	if err == nil {
+		return strconv.FormatUint(uint64(id), 10), nil
+	}
+	if err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to look up device ID: %w", err)
+	}
+
+	if preferred < 1 || preferred > maxDeviceID {
+		preferred = 1
+	}
+	id, err = nextFreeDeviceID(ctx, tx, preferred)
+	if err == nil && id == 0 {
+		id, err = nextFreeDeviceID(ctx, tx, 1)
+	}
+	if err != nil {
+		return "", err
+	}
+	if id == 0 {
+		return "", ErrDeviceIDsExhausted
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO device_ids (device_id, owner) VALUES (?, ?)`, id, owner); err != nil {
+		return "", fmt.Errorf("failed to record device ID: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit device ID: %w", err)
+	}
+	return strconv.FormatUint(uint64(id), 10), nil
+}
+
+// nextFreeDeviceID returns the lowest free ID at or above from, or 0 if every
+// ID from there to maxDeviceID is taken.
+func nextFreeDeviceID(ctx context.Context, tx *sql.Tx, from uint32) (uint32, error) {
+	var taken bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM device_ids WHERE device_id = ?)`, from).Scan(&taken)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check device ID: %w", err)
+	}
+	if !taken {
+		return from, nil
+	}
+
+	// from is taken: find the end of the run of taken IDs starting there.
+	query := `
+		SELECT d.device_id + 1 FROM device_ids d
+		WHERE d.device_id >= ? AND d.device_id < ?
+		  AND NOT EXISTS (SELECT 1 FROM device_ids e WHERE e.device_id = d.device_id + 1)
+		ORDER BY d.device_id
+		LIMIT 1
+	`
+	var id uint32
+	err = tx.QueryRowContext(ctx, query, from, maxDeviceID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free device ID: %w", err)
+	}
+	return id, nil
+}
+
+// ReleaseDeviceID frees deviceID for reuse. Call it only once the thin device
+// has been deleted from the pool. Releasing an unallocated ID is a no-op.
+func (d *DB) ReleaseDeviceID(ctx context.Context, deviceID string) error {
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM device_ids WHERE device_id = ?`, deviceID); err != nil {
+		return fmt.Errorf("failed to release device ID: %w", err)
+	}
+	return nil
+}
+
+// GetDeviceID returns the device ID allocated to owner, or "" if none is.
+func (d *DB) GetDeviceID(ctx context.Context, owner string) (string, error) {
+	var id uint32
+	err := d.db.QueryRowContext(ctx, `SELECT device_id FROM device_ids WHERE owner = ?`, owner).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up device ID: %w", err)
+	}
+	return strconv.FormatUint(uint64(id), 10), nil
+}
+
+// GetDeviceIDOwner returns the owner deviceID is allocated to, such as
+// "image:<image_id>", or "" if the ID is free.
+func (d *DB) GetDeviceIDOwner(ctx context.Context, deviceID string) (string, error) {
+	var owner string
+	err := d.db.QueryRowContext(ctx, `SELECT owner FROM device_ids WHERE device_id = ?`, deviceID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up device ID owner: %w", err)
+	}
+	return owner, nil
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAllocateDeviceID(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	id, err := db.AllocateDeviceID(ctx, ImageDeviceOwner("img1"), 1000)
+	if err != nil || id != "1000" {
+		t.Fatalf("AllocateDeviceID(free preferred) = %q, %v; want 1000", id, err)
+	}
+	// Stable per owner, whatever the preferred ID
+	if again, err := db.AllocateDeviceID(ctx, ImageDeviceOwner("img1"), 7); err != nil || again != id {
+		t.Errorf("AllocateDeviceID(same owner) = %q, %v; want %q", again, err, id)
+	}
+	// A different owner wanting the same ID gets the next free one
+	if other, err := db.AllocateDeviceID(ctx, SnapshotDeviceOwner("snap-img1"), 1000); err != nil || other != "1001" {
+		t.Errorf("AllocateDeviceID(taken preferred) = %q, %v; want 1001", other, err)
+	}
+	if other, err := db.AllocateDeviceID(ctx, ImageDeviceOwner("img2"), 1000); err != nil || other != "1002" {
+		t.Errorf("AllocateDeviceID(taken run) = %q, %v; want 1002", other, err)
+	}
+	// Out-of-range preferences start from 1
+	if low, err := db.AllocateDeviceID(ctx, ImageDeviceOwner("img3"), 0); err != nil || low != "1" {
+		t.Errorf("AllocateDeviceID(0) = %q, %v; want 1", low, err)
+	}
+
+	if err := db.ReleaseDeviceID(ctx, "1000"); err != nil {
+		t.Fatal(err)
+	}
+	if reused, err := db.AllocateDeviceID(ctx, ImageDeviceOwner("img4"), 1000); err != nil || reused != "1000" {
+		t.Errorf("AllocateDeviceID(released) = %q, %v; want 1000", reused, err)
+	}
+}
+
+func TestDeviceIDLookups(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	id, err := db.AllocateDeviceID(ctx, ImageDeviceOwner("img1"), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetDeviceID(ctx, ImageDeviceOwner("img1")); err != nil || got != id {
+		t.Errorf("GetDeviceID(img1) = %q, %v; want %q", got, err, id)
+	}
+	if got, err := db.GetDeviceIDOwner(ctx, id); err != nil || got != ImageDeviceOwner("img1") {
+		t.Errorf("GetDeviceIDOwner(%s) = %q, %v; want image:img1", id, got, err)
+	}
+
+	// Neither lookup allocates
+	if got, err := db.GetDeviceID(ctx, ImageDeviceOwner("img2")); err != nil || got != "" {
+		t.Errorf("GetDeviceID(unallocated) = %q, %v; want empty", got, err)
+	}
+	if got, err := db.GetDeviceIDOwner(ctx, "43"); err != nil || got != "" {
+		t.Errorf("GetDeviceIDOwner(free) = %q, %v; want empty", got, err)
+	}
+}
+
+func TestAllocateDeviceID_WrapAndExhaust(t *testing.T) {
+	old := maxDeviceID
+	maxDeviceID = 4
+	t.Cleanup(func() { maxDeviceID = old })
+
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	// Preferring the top of the range wraps around to the free IDs below it
+	seen := make(map[string]bool)
+	for i := range 4 {
+		id, err := db.AllocateDeviceID(ctx, ImageDeviceOwner(fmt.Sprint(i)), 4)
+		if err != nil {
+			t.Fatalf("AllocateDeviceID(#%d) error = %v", i, err)
+		}
+		if seen[id] {
+			t.Fatalf("AllocateDeviceID(#%d) = %s, already allocated", i, id)
+		}
+		seen[id] = true
+	}
+
+	_, err := db.AllocateDeviceID(ctx, ImageDeviceOwner("one-too-many"), 1)
+	if !errors.Is(err, ErrDeviceIDsExhausted) {
+		t.Errorf("AllocateDeviceID(full) error = %v, want ErrDeviceIDsExhausted", err)
+	}
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RecordDMOperation appends op to the dm_operations audit log as it is. ID
+// is ignored.
+func (d *DB) RecordDMOperation(ctx context.Context, op DMOperation) error {
+	_, err := d.insertDMOperation(ctx, op)
+	return err
+}
+
+// StartDMOperation appends op to the dm_operations audit log as unfinished,
+// before it runs, and returns its ID for FinishDMOperation. ID, Duration,
+// Error and Finished are ignored.
+func (d *DB) StartDMOperation(ctx context.Context, op DMOperation) (int64, error) {
+	op.Duration, op.Error, op.Finished = 0, "", false
+	return d.insertDMOperation(ctx, op)
+}
+
+// FinishDMOperation records the duration and error (empty on success) of the
+// operation started as id.
+func (d *DB) FinishDMOperation(ctx context.Context, id int64, duration time.Duration, errMsg string) error {
+	query := `UPDATE dm_operations SET duration_ms = ?, error = ?, finished = 1 WHERE id = ?`
+	res, err := d.db.ExecContext(ctx, query, duration.Milliseconds(), errMsg, id)
+	if err != nil {
+		return fmt.Errorf("failed to finish dm operation %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("dm operation %d not found", id)
+	}
+	return nil
+}
+
+func (d *DB) insertDMOperation(ctx context.Context, op DMOperation) (int64, error) {
+	query := `
+		INSERT INTO dm_operations (operation, pool, device_name, device_id, origin_id, old_sectors, new_sectors, started_at, duration_ms, error, finished)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := d.db.ExecContext(ctx, query, op.Operation, op.Pool, op.DeviceName, op.DeviceID, op.OriginID, op.OldSectors, op.NewSectors,
+		op.StartedAt, op.Duration.Milliseconds(), op.Error, op.Finished)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record dm operation: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read dm operation ID: %w", err)
+	}
+	return id, nil
+}
+
+// ListDMOperations returns the most recent limit operations from the audit
+// log, oldest first. A limit of 0 or less returns every operation.
+func (d *DB) ListDMOperations(ctx context.Context, limit int) ([]DMOperation, error) {
+	if limit <= 0 {
+		limit = -1 // SQLite: no limit
+	}
+	query := `
+		SELECT id, operation, pool, device_name, device_id, origin_id, old_sectors, new_sectors, started_at, duration_ms, error, finished
+		FROM (SELECT * FROM dm_operations ORDER BY id DESC LIMIT ?)
+		ORDER BY id
+	`
+	rows, err := d.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dm operations: %w", err)
+	}
+	defer rows.Close()
+
+	var ops []DMOperation
+	for rows.Next() {
+		var op DMOperation
+		var durationMS int64
+		if err := rows.Scan(&op.ID, &op.Operation, &op.Pool, &op.DeviceName, &op.DeviceID, &op.OriginID, &op.OldSectors, &op.NewSectors,
+			&op.StartedAt, &durationMS, &op.Error, &op.Finished); err != nil {
+			return nil, fmt.Errorf("failed to scan dm operation: %w", err)
+		}
+		op.Duration = time.Duration(durationMS) * time.Millisecond
+		ops = append(ops, op)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating dm operations: %w", err)
+	}
+	return ops, nil
+}
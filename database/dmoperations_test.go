@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDMOperations_RecordAndList(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	ops := []DMOperation{
+		{Operation: "create_thin", Pool: "pool", DeviceName: "thin-1", DeviceID: "1", StartedAt: start, Duration: 1500 * time.Millisecond, Finished: true},
+		{Operation: "create_snap", Pool: "pool", DeviceID: "2", OriginID: "1", StartedAt: start.Add(time.Minute), Duration: 20 * time.Millisecond, Finished: true},
+		{Operation: "delete", Pool: "pool", DeviceID: "1", StartedAt: start.Add(2 * time.Minute), Error: "device busy", Finished: true},
+		{Operation: "resize", Pool: "pool", DeviceName: "thin-2", DeviceID: "2", OldSectors: 8388608, NewSectors: 16777216, StartedAt: start.Add(3 * time.Minute), Finished: true},
+	}
+	for _, op := range ops {
+		if err := db.RecordDMOperation(ctx, op); err != nil {
+			t.Fatalf("RecordDMOperation() error = %v", err)
+		}
+	}
+
+	all, err := db.ListDMOperations(ctx, 0)
+	if err != nil {
+		t.Fatalf("ListDMOperations() error = %v", err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("ListDMOperations(0) returned %d operations, want 4", len(all))
+	}
+	got := all[0]
+	if got.Operation != "create_thin" || got.DeviceName != "thin-1" || got.Duration != 1500*time.Millisecond || !got.StartedAt.Equal(start) || got.Error != "" {
+		t.Errorf("first operation = %+v", got)
+	}
+	if all[1].OriginID != "1" || all[2].Error != "device busy" || all[3].OldSectors != 8388608 || all[3].NewSectors != 16777216 {
+		t.Errorf("operations = %+v", all)
+	}
+
+	// A limit keeps the newest operations, still oldest first
+	recent, err := db.ListDMOperations(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 2 || recent[0].Operation != "delete" || recent[1].Operation != "resize" {
+		t.Errorf("ListDMOperations(2) = %+v, want delete then resize", recent)
+	}
+}
+
+func TestDMOperations_StartAndFinish(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	hung, err := db.StartDMOperation(ctx, DMOperation{Operation: "deactivate", DeviceName: "snap-1", StartedAt: start})
+	if err != nil {
+		t.Fatalf("StartDMOperation() error = %v", err)
+	}
+	done, err := db.StartDMOperation(ctx, DMOperation{Operation: "delete", Pool: "pool", DeviceID: "2", StartedAt: start.Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FinishDMOperation(ctx, done, 300*time.Millisecond, "device busy"); err != nil {
+		t.Fatalf("FinishDMOperation() error = %v", err)
+	}
+	if err := db.FinishDMOperation(ctx, done+100, 0, ""); err == nil {
+		t.Error("FinishDMOperation() of an unknown ID succeeded")
+	}
+
+	ops, err := db.ListDMOperations(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || ops[0].ID != hung || ops[0].Finished {
+		t.Fatalf("operations = %+v, want the unfinished deactivate first", ops)
+	}
+	if !ops[1].Finished || ops[1].Duration != 300*time.Millisecond || ops[1].Error != "device busy" {
+		t.Errorf("finished operation = %+v", ops[1])
+	}
+}
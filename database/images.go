@@ -8,6 +8,8 @@ import (
 	"log"
 	"strings"
 	"time"
+
+	"github.com/superfly/fsm/checksum"
 )
 
 // Download reservation errors used by higher layers (e.g. Download FSM) to
@@ -24,27 +26,35 @@ var (
 	// considered stale). Callers should not start a competing download. They can
 	// either fail fast or wait and retry later.
 	ErrDownloadInProgress = errors.New("download in progress")
+
+	// ErrImageQuarantined indicates that the image failed security validation
+	// and was quarantined (see QuarantineImage). It is not downloaded or
+	// unpacked again until UnquarantineImage releases it.
+	ErrImageQuarantined = errors.New("image quarantined")
 )
 
 // CheckImageDownloaded checks if an image has already been downloaded.
 // Returns the image if it exists and is completed, nil if not found or incomplete.
 func (d *DB) CheckImageDownloaded(ctx context.Context, s3Key string) (*Image, error) {
 	query := `
-		SELECT id, image_id, s3_key, local_path, checksum, size_bytes,
+		SELECT id, image_id, s3_key, local_path, checksum, checksum_algo, size_bytes,
 		       download_status, activation_status, created_at,
 		       download_started_at, downloaded_at,
-		       activated_at, updated_at
+		       activated_at, updated_at, last_error, last_error_at,
+		       quarantine_reason, quarantined_at
 		FROM images
 		WHERE s3_key = ? AND download_status = ?
 	`
 
 	var img Image
-	var startedAt, downloadedAt, activatedAt sql.NullTime
+	var startedAt, downloadedAt, activatedAt, lastErrorAt, quarantinedAt sql.NullTime
+	var lastError, quarantineReason sql.NullString
 
 	err := d.db.QueryRowContext(ctx, query, s3Key, DownloadStatusCompleted).Scan(
-		&img.ID, &img.ImageID, &img.S3Key, &img.LocalPath, &img.Checksum,
+		&img.ID, &img.ImageID, &img.S3Key, &img.LocalPath, &img.Checksum, &img.ChecksumAlgo,
 		&img.SizeBytes, &img.DownloadStatus, &img.ActivationStatus,
 		&img.CreatedAt, &startedAt, &downloadedAt, &activatedAt, &img.UpdatedAt,
+		&lastError, &lastErrorAt, &quarantineReason, &quarantinedAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -63,25 +73,33 @@ func (d *DB) CheckImageDownloaded(ctx context.Context, s3Key string) (*Image, er
 	if activatedAt.Valid {
 		img.ActivatedAt = &activatedAt.Time
 	}
+	img.setLastError(lastError, lastErrorAt)
+	img.setQuarantine(quarantineReason, quarantinedAt)
 
 	return &img, nil
 }
 
-// StoreImageMetadata stores or updates image metadata after successful download.
-func (d *DB) StoreImageMetadata(ctx context.Context, imageID, s3Key, localPath, checksum string, sizeBytes int64) error {
+// StoreImageMetadata stores or updates image metadata after successful
+// download, recording the checksum's algorithm alongside its digest.
+func (d *DB) StoreImageMetadata(ctx context.Context, imageID, s3Key, localPath string, sum checksum.Checksum, sizeBytes int64) error {
+	algo := sum.Algo
+	if algo == "" {
+		algo = checksum.Default
+	}
 	query := `
-		INSERT INTO images (image_id, s3_key, local_path, checksum, size_bytes, download_status, downloaded_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO images (image_id, s3_key, local_path, checksum, checksum_algo, size_bytes, download_status, downloaded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(s3_key) DO UPDATE SET
 			local_path = excluded.local_path,
 			checksum = excluded.checksum,
+			checksum_algo = excluded.checksum_algo,
 			size_bytes = excluded.size_bytes,
 			download_status = excluded.download_status,
 			downloaded_at = excluded.downloaded_at,
 			updated_at = CURRENT_TIMESTAMP
 	`
 
-	res, err := d.db.ExecContext(ctx, query, imageID, s3Key, localPath, checksum, sizeBytes, DownloadStatusCompleted, time.Now())
+	res, err := d.db.ExecContext(ctx, query, imageID, s3Key, localPath, sum.Hex, string(algo), sizeBytes, DownloadStatusCompleted, time.Now())
 	if err != nil {
 		return fmt.Errorf("failed to store image metadata: %w", err)
 	}
@@ -103,21 +121,24 @@ const downloadStaleThreshold = 1 * time.Hour
 // GetImageByS3Key retrieves an image row by its S3 key.
 func (d *DB) GetImageByS3Key(ctx context.Context, s3Key string) (*Image, error) {
 	query := `
-		SELECT id, image_id, s3_key, local_path, checksum, size_bytes,
+		SELECT id, image_id, s3_key, local_path, checksum, checksum_algo, size_bytes,
 		       download_status, activation_status, created_at,
 		       download_started_at, downloaded_at,
-		       activated_at, updated_at
+		       activated_at, updated_at, last_error, last_error_at,
+		       quarantine_reason, quarantined_at
 		FROM images
 		WHERE s3_key = ?
 	`
 
 	var img Image
-	var startedAt, downloadedAt, activatedAt sql.NullTime
+	var startedAt, downloadedAt, activatedAt, lastErrorAt, quarantinedAt sql.NullTime
+	var lastError, quarantineReason sql.NullString
 
 	err := d.db.QueryRowContext(ctx, query, s3Key).Scan(
-		&img.ID, &img.ImageID, &img.S3Key, &img.LocalPath, &img.Checksum,
+		&img.ID, &img.ImageID, &img.S3Key, &img.LocalPath, &img.Checksum, &img.ChecksumAlgo,
 		&img.SizeBytes, &img.DownloadStatus, &img.ActivationStatus,
 		&img.CreatedAt, &startedAt, &downloadedAt, &activatedAt, &img.UpdatedAt,
+		&lastError, &lastErrorAt, &quarantineReason, &quarantinedAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -136,6 +157,8 @@ func (d *DB) GetImageByS3Key(ctx context.Context, s3Key string) (*Image, error)
 	if activatedAt.Valid {
 		img.ActivatedAt = &activatedAt.Time
 	}
+	img.setLastError(lastError, lastErrorAt)
+	img.setQuarantine(quarantineReason, quarantinedAt)
 
 	return &img, nil
 }
@@ -151,6 +174,7 @@ func (d *DB) GetImageByS3Key(ctx context.Context, s3Key string) (*Image, error)
 //   - If a row exists with "completed", returns ErrDownloadAlreadyCompleted.
 //   - If a row exists with a non-stale "downloading", returns
 //     ErrDownloadInProgress.
+//   - If the row is quarantined, returns ErrImageQuarantined with the reason.
 func (d *DB) ReserveImageDownload(ctx context.Context, imageID, s3Key string) error {
 	now := time.Now()
 	staleBefore := now.Add(-downloadStaleThreshold)
@@ -164,9 +188,10 @@ func (d *DB) ReserveImageDownload(ctx context.Context, imageID, s3Key string) er
 			download_started_at = excluded.download_started_at,
 			downloaded_at = NULL,
 			updated_at = CURRENT_TIMESTAMP
-		WHERE images.download_status IN ('pending','failed')
-		   OR (images.download_status = 'downloading'
-		       AND (images.download_started_at IS NULL OR images.download_started_at < ?));
+		WHERE images.quarantined_at IS NULL
+		  AND (images.download_status IN ('pending','failed')
+		       OR (images.download_status = 'downloading'
+		           AND (images.download_started_at IS NULL OR images.download_started_at < ?)));
 	`
 
 	res, err := d.db.ExecContext(ctx, query, imageID, s3Key, DownloadStatusDownloading, now, staleBefore)
@@ -196,6 +221,9 @@ func (d *DB) ReserveImageDownload(ctx context.Context, imageID, s3Key string) er
 	if img == nil {
 		return fmt.Errorf("reservation failed but image row missing for s3_key %s", s3Key)
 	}
+	if img.Quarantined() {
+		return img.quarantineError()
+	}
 
 	switch img.DownloadStatus {
 	case DownloadStatusCompleted:
@@ -215,24 +243,69 @@ func (d *DB) ReserveImageDownload(ctx context.Context, imageID, s3Key string) er
 	}
 }
 
+// ResumeImageDownload claims the download reservation for an S3 object whose
+// previous download was interrupted and left a resumable partial file.
+//
+// Unlike ReserveImageDownload it takes over a non-stale "downloading" row: the
+// caller is expected to have verified that no process still holds the partial
+// file. Returns ErrDownloadAlreadyCompleted if the download has completed, or
+// ErrImageQuarantined if the image is quarantined.
+func (d *DB) ResumeImageDownload(ctx context.Context, imageID, s3Key string) error {
+	query := `
+		INSERT INTO images (image_id, s3_key, local_path, checksum, size_bytes, download_status, download_started_at)
+		VALUES (?, ?, '', '', 0, ?, ?)
+		ON CONFLICT(s3_key) DO UPDATE SET
+			image_id = excluded.image_id,
+			download_status = excluded.download_status,
+			download_started_at = excluded.download_started_at,
+			downloaded_at = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE images.download_status != ? AND images.quarantined_at IS NULL;
+	`
+
+	res, err := d.db.ExecContext(ctx, query, imageID, s3Key, DownloadStatusDownloading, time.Now(), DownloadStatusCompleted)
+	if err != nil {
+		return fmt.Errorf("resume image download failed for s3_key %s: %w", s3Key, err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("resume image download: failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		img, err := d.GetImageByS3Key(ctx, s3Key)
+		if err != nil {
+			return err
+		}
+		if img != nil && img.Quarantined() {
+			return img.quarantineError()
+		}
+		return ErrDownloadAlreadyCompleted
+	}
+	return nil
+}
+
 // GetImageByID retrieves an image by its image_id.
 func (d *DB) GetImageByID(ctx context.Context, imageID string) (*Image, error) {
 	query := `
-		SELECT id, image_id, s3_key, local_path, checksum, size_bytes,
+		SELECT id, image_id, s3_key, local_path, checksum, checksum_algo, size_bytes,
 		       download_status, activation_status, created_at,
 		       download_started_at, downloaded_at,
-		       activated_at, updated_at
+		       activated_at, updated_at, last_error, last_error_at,
+		       quarantine_reason, quarantined_at
 		FROM images
 		WHERE image_id = ?
 	`
 
 	var img Image
-	var startedAt, downloadedAt, activatedAt sql.NullTime
+	var startedAt, downloadedAt, activatedAt, lastErrorAt, quarantinedAt sql.NullTime
+	var lastError, quarantineReason sql.NullString
 
 	err := d.db.QueryRowContext(ctx, query, imageID).Scan(
-		&img.ID, &img.ImageID, &img.S3Key, &img.LocalPath, &img.Checksum,
+		&img.ID, &img.ImageID, &img.S3Key, &img.LocalPath, &img.Checksum, &img.ChecksumAlgo,
 		&img.SizeBytes, &img.DownloadStatus, &img.ActivationStatus,
 		&img.CreatedAt, &startedAt, &downloadedAt, &activatedAt, &img.UpdatedAt,
+		&lastError, &lastErrorAt, &quarantineReason, &quarantinedAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -248,10 +321,96 @@ func (d *DB) GetImageByID(ctx context.Context, imageID string) (*Image, error) {
 	if activatedAt.Valid {
 		img.ActivatedAt = &activatedAt.Time
 	}
+	img.setLastError(lastError, lastErrorAt)
+	img.setQuarantine(quarantineReason, quarantinedAt)
 
 	return &img, nil
 }
 
+// RecordImageError records why an FSM gave up on an image, so list-images
+// and the dashboard can explain an image that never activated. It does nothing
+// if the image has no row yet, e.g. when a download aborts before reserving
+// one.
+func (d *DB) RecordImageError(ctx context.Context, imageID, reason string) error {
+	query := `
+		UPDATE images
+		SET last_error = ?, last_error_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE image_id = ?
+	`
+	if _, err := d.db.ExecContext(ctx, query, reason, time.Now(), imageID); err != nil {
+		return fmt.Errorf("failed to record image error: %w", err)
+	}
+	return nil
+}
+
+// ClearImageError clears the error recorded by RecordImageError once a later
+// run succeeds.
+func (d *DB) ClearImageError(ctx context.Context, imageID string) error {
+	query := `
+		UPDATE images
+		SET last_error = NULL, last_error_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE image_id = ? AND last_error IS NOT NULL
+	`
+	if _, err := d.db.ExecContext(ctx, query, imageID); err != nil {
+		return fmt.Errorf("failed to clear image error: %w", err)
+	}
+	return nil
+}
+
+// setLastError fills in LastError and LastErrorAt from nullable columns.
+func (img *Image) setLastError(msg sql.NullString, at sql.NullTime) {
+	img.LastError = msg.String
+	if at.Valid {
+		img.LastErrorAt = &at.Time
+	}
+}
+
+// QuarantineImage marks an image that failed security validation so it is
+// not downloaded or unpacked again until UnquarantineImage releases it. A
+// download that had not completed is marked failed, since its file is
+// removed. It does nothing if the image has no row.
+func (d *DB) QuarantineImage(ctx context.Context, imageID, reason string) error {
+	query := `
+		UPDATE images
+		SET quarantine_reason = ?, quarantined_at = ?,
+		    download_status = CASE WHEN download_status = ? THEN download_status ELSE ? END,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE image_id = ?
+	`
+	if _, err := d.db.ExecContext(ctx, query, reason, time.Now(), DownloadStatusCompleted, DownloadStatusFailed, imageID); err != nil {
+		return fmt.Errorf("failed to quarantine image: %w", err)
+	}
+	return nil
+}
+
+// UnquarantineImage releases an image from quarantine so it can be processed
+// again.
+func (d *DB) UnquarantineImage(ctx context.Context, imageID string) error {
+	query := `
+		UPDATE images
+		SET quarantine_reason = NULL, quarantined_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE image_id = ? AND quarantined_at IS NOT NULL
+	`
+	if _, err := d.db.ExecContext(ctx, query, imageID); err != nil {
+		return fmt.Errorf("failed to unquarantine image: %w", err)
+	}
+	return nil
+}
+
+// setQuarantine fills in QuarantineReason and QuarantinedAt from nullable
+// columns.
+func (img *Image) setQuarantine(reason sql.NullString, at sql.NullTime) {
+	img.QuarantineReason = reason.String
+	if at.Valid {
+		img.QuarantinedAt = &at.Time
+	}
+}
+
+// quarantineError returns ErrImageQuarantined with the image's reason.
+func (img *Image) quarantineError() error {
+	return fmt.Errorf("%w: %s", ErrImageQuarantined, img.QuarantineReason)
+}
+
 // UpdateImageActivationStatus updates the activation status of an image.
 func (d *DB) UpdateImageActivationStatus(ctx context.Context, imageID, status string) error {
 	query := `
@@ -283,12 +442,41 @@ func (d *DB) UpdateImageActivationStatus(ctx context.Context, imageID, status st
 	return nil
 }
 
+// DeleteImage deletes an image record.
+// Its tags are deleted with it. Unpacked image and snapshot rows cascade, but callers removing an image should
+// delete them first so devicemapper state can be handled per row.
+func (d *DB) DeleteImage(ctx context.Context, imageID string) error {
+	// Tags would cascade too, but only where the foreign_keys pragma is on
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM tags WHERE image_id = ?`, imageID); err != nil {
+		return fmt.Errorf("failed to delete image tags: %w", err)
+	}
+
+	query := `DELETE FROM images WHERE image_id = ?`
+
+	result, err := d.db.ExecContext(ctx, query, imageID)
+	if err != nil {
+		return fmt.Errorf("failed to delete image: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rows == 0 {
+		return fmt.Errorf("image not found: %s", imageID)
+	}
+
+	return nil
+}
+
 // ListImages lists all images with optional status filter.
 func (d *DB) ListImages(ctx context.Context, downloadStatus string) ([]*Image, error) {
 	query := `
-		SELECT id, image_id, s3_key, local_path, checksum, size_bytes, 
+		SELECT id, image_id, s3_key, local_path, checksum, checksum_algo, size_bytes, 
 		       download_status, activation_status, created_at, downloaded_at, 
-		       activated_at, updated_at
+		       activated_at, updated_at, last_error, last_error_at,
+		       quarantine_reason, quarantined_at
 		FROM images
 	`
 
@@ -309,12 +497,14 @@ func (d *DB) ListImages(ctx context.Context, downloadStatus string) ([]*Image, e
 	var images []*Image
 	for rows.Next() {
 		var img Image
-		var downloadedAt, activatedAt sql.NullTime
+		var downloadedAt, activatedAt, lastErrorAt, quarantinedAt sql.NullTime
+		var lastError, quarantineReason sql.NullString
 
 		err := rows.Scan(
-			&img.ID, &img.ImageID, &img.S3Key, &img.LocalPath, &img.Checksum,
+			&img.ID, &img.ImageID, &img.S3Key, &img.LocalPath, &img.Checksum, &img.ChecksumAlgo,
 			&img.SizeBytes, &img.DownloadStatus, &img.ActivationStatus,
 			&img.CreatedAt, &downloadedAt, &activatedAt, &img.UpdatedAt,
+			&lastError, &lastErrorAt, &quarantineReason, &quarantinedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan image: %w", err)
@@ -326,6 +516,8 @@ func (d *DB) ListImages(ctx context.Context, downloadStatus string) ([]*Image, e
 		if activatedAt.Valid {
 			img.ActivatedAt = &activatedAt.Time
 		}
+		img.setLastError(lastError, lastErrorAt)
+		img.setQuarantine(quarantineReason, quarantinedAt)
 
 		images = append(images, &img)
 	}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/superfly/fsm/checksum"
+)
+
+func TestRecordImageError(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	storeTestImage(t, db, "img-a")
+
+	reason := "unpack failed in verify-layout: invalid filesystem layout: symlink escapes rootfs"
+	if err := db.RecordImageError(ctx, "img-a", reason); err != nil {
+		t.Fatal(err)
+	}
+	img, err := db.GetImageByID(ctx, "img-a")
+	if err != nil || img == nil {
+		t.Fatalf("GetImageByID() = %+v, %v", img, err)
+	}
+	if img.LastError != reason || img.LastErrorAt == nil {
+		t.Errorf("LastError = %q at %v, want %q with a time", img.LastError, img.LastErrorAt, reason)
+	}
+
+	images, err := db.ListImages(ctx, "")
+	if err != nil || len(images) != 1 || images[0].LastError != reason {
+		t.Errorf("ListImages() = %+v, %v; want the recorded error", images, err)
+	}
+
+	if err := db.ClearImageError(ctx, "img-a"); err != nil {
+		t.Fatal(err)
+	}
+	if img, _ := db.GetImageByID(ctx, "img-a"); img.LastError != "" || img.LastErrorAt != nil {
+		t.Errorf("after clear LastError = %q at %v, want none", img.LastError, img.LastErrorAt)
+	}
+
+	// No row yet: nothing to record against
+	if err := db.RecordImageError(ctx, "missing", reason); err != nil {
+		t.Errorf("RecordImageError(missing image) = %v, want nil", err)
+	}
+}
+
+func TestStoreImageMetadata_ChecksumAlgo(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	sum := checksum.Checksum{Algo: checksum.BLAKE3, Hex: "6437b3ac"}
+	if err := db.StoreImageMetadata(ctx, "img-b3", "images/b3.tar", "/tmp/b3.tar", sum, 3); err != nil {
+		t.Fatal(err)
+	}
+	img, err := db.CheckImageDownloaded(ctx, "images/b3.tar")
+	if err != nil || img == nil {
+		t.Fatalf("CheckImageDownloaded() = %+v, %v", img, err)
+	}
+	if img.Checksum != sum.Hex || img.ChecksumAlgo != "blake3" {
+		t.Errorf("stored checksum = %s:%s, want %v", img.ChecksumAlgo, img.Checksum, sum)
+	}
+
+	// Without an algorithm the digest is recorded as SHA256
+	storeTestImage(t, db, "img-a")
+	if img, _ := db.GetImageByID(ctx, "img-a"); img == nil || img.ChecksumAlgo != "sha256" {
+		t.Errorf("default checksum algorithm = %+v, want sha256", img)
+	}
+}
+
+func TestQuarantineImage(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	// A download rejected in validate is quarantined before it completes
+	if err := db.ReserveImageDownload(ctx, "img-q", "images/q.tar"); err != nil {
+		t.Fatal(err)
+	}
+	reason := "security validation failed: path traversal detected: ../../etc/passwd"
+	if err := db.QuarantineImage(ctx, "img-q", reason); err != nil {
+		t.Fatal(err)
+	}
+	img, err := db.GetImageByID(ctx, "img-q")
+	if err != nil || img == nil {
+		t.Fatalf("GetImageByID() = %+v, %v", img, err)
+	}
+	if !img.Quarantined() || img.QuarantineReason != reason || img.DownloadStatus != DownloadStatusFailed {
+		t.Errorf("image = quarantined %v (%q), status %s; want quarantined, failed", img.Quarantined(), img.QuarantineReason, img.DownloadStatus)
+	}
+
+	for name, reserve := range map[string]func(context.Context, string, string) error{
+		"ReserveImageDownload": db.ReserveImageDownload,
+		"ResumeImageDownload":  db.ResumeImageDownload,
+	} {
+		err := reserve(ctx, "img-q", "images/q.tar")
+		if !errors.Is(err, ErrImageQuarantined) || !strings.Contains(err.Error(), reason) {
+			t.Errorf("%s() = %v, want ErrImageQuarantined with the reason", name, err)
+		}
+	}
+
+	if err := db.UnquarantineImage(ctx, "img-q"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReserveImageDownload(ctx, "img-q", "images/q.tar"); err != nil {
+		t.Errorf("ReserveImageDownload() after unquarantine = %v, want nil", err)
+	}
+
+	// A completed download quarantined by unpack keeps its status
+	storeTestImage(t, db, "img-a")
+	if err := db.QuarantineImage(ctx, "img-a", "invalid filesystem layout"); err != nil {
+		t.Fatal(err)
+	}
+	if img, _ := db.GetImageByID(ctx, "img-a"); !img.Quarantined() || img.DownloadStatus != DownloadStatusCompleted {
+		t.Errorf("image = quarantined %v, status %s; want quarantined, completed", img.Quarantined(), img.DownloadStatus)
+	}
+}
@@ -1,73 +1,143 @@
 package database
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
-// Migration 2: Add trace correlation fields for observability
-const migration002TraceCorrelation = `
--- Add trace_id and span_id to images table for request correlation
-ALTER TABLE images ADD COLUMN trace_id TEXT;
-ALTER TABLE images ADD COLUMN span_id TEXT;
+// migration is one versioned schema change. Versions start at 1 and must
+// increase by one; each migration runs in its own transaction and is recorded
+// in schema_migrations.
+type migration struct {
+	version     int
+	description string
+	sql         string
+}
 
--- Add trace_id to unpacked_images table
-ALTER TABLE unpacked_images ADD COLUMN trace_id TEXT;
+// migrations contains all database migrations in order. Append new schema
+// changes here; never edit or reorder a migration that has shipped.
+var migrations = []migration{
+	{version: 1, description: "Initial schema", sql: initialSchema},
+	{version: 2, description: "Add image_locks table", sql: imageLocksSchema},
+	{version: 3, description: "Add tags table", sql: tagsSchema},
+	{version: 4, description: "Add images.last_error and last_error_at", sql: imageLastErrorSchema},
+	{version: 5, description: "Add device_ids table", sql: deviceIDsSchema},
+	{version: 6, description: "Add dm_operations table", sql: dmOperationsSchema},
+	{version: 7, description: "Add snapshots.last_accessed_at", sql: snapshotLastAccessedSchema},
+	{version: 8, description: "Add images.checksum_algo", sql: imageChecksumAlgoSchema},
+	{version: 9, description: "Add images.quarantine_reason and quarantined_at", sql: imageQuarantineSchema},
+	{version: 10, description: "Add unpacked_images.layout", sql: unpackedLayoutSchema},
+	{version: 11, description: "Add dm_operations.finished", sql: dmOperationsFinishedSchema},
+	{version: 12, description: "Add unpacked_images.device_size_bytes", sql: unpackedDeviceSizeSchema},
+	{version: 13, description: "Add dm_operations.old_sectors and new_sectors", sql: dmOperationsSectorsSchema},
+}
 
--- Add trace_id to snapshots table
-ALTER TABLE snapshots ADD COLUMN trace_id TEXT;
+// LatestSchemaVersion returns the schema version this build migrates to.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
 
--- Add indexes for trace lookups
-CREATE INDEX IF NOT EXISTS idx_images_trace_id ON images(trace_id);
-CREATE INDEX IF NOT EXISTS idx_unpacked_images_trace_id ON unpacked_images(trace_id);
-CREATE INDEX IF NOT EXISTS idx_snapshots_trace_id ON snapshots(trace_id);
-`
+// MigrationStatus describes one migration and whether it has been applied.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	AppliedAt   *time.Time // nil if pending
+}
 
-// migrations contains all database migrations in order
-var migrations = []struct {
-	version     int
-	description string
-	sql         string
-}{
-	{
-		version:     1,
-		description: "Initial schema with images, unpacked_images, and snapshots tables",
-		sql:         initialSchema,
-	},
-	{
-		version:     2,
-		description: "Add trace_id fields for OpenTelemetry correlation",
-		sql:         migration002TraceCorrelation,
-	},
+// SchemaVersion returns the highest migration version applied to the
+// database, or 0 for an empty database.
+func (d *DB) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := d.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
 }
 
-// ApplyMigrations applies all pending database migrations
-func (d *DB) ApplyMigrations() error {
-	// Get current version
-	currentVersion := 0
-	row := d.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
-	if err := row.Scan(&currentVersion); err != nil {
-		// If table doesn't exist, start from 0
-		currentVersion = 0
+// MigrationStatus lists every migration known to this build, in order, with
+// when it was applied.
+func (d *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
 	}
+	defer rows.Close()
 
-	// Apply pending migrations
-	for _, migration := range migrations {
-		if migration.version <= currentVersion {
-			continue
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan migration: %w", err)
 		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating migrations: %w", err)
+	}
 
-		// Execute migration
-		if _, err := d.db.Exec(migration.sql); err != nil {
-			return fmt.Errorf("failed to apply migration %d: %w", migration.version, err)
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.version, Description: m.description}
+		if at, ok := applied[m.version]; ok {
+			s.AppliedAt = &at
 		}
+		status = append(status, s)
+	}
+	return status, nil
+}
 
-		// Record migration
-		if _, err := d.db.Exec(
-			"INSERT INTO schema_migrations (version, description) VALUES (?, ?)",
-			migration.version,
-			migration.description,
-		); err != nil {
-			return fmt.Errorf("failed to record migration %d: %w", migration.version, err)
+// Migrate applies every pending migration in order and returns the versions
+// it applied. New calls it unless Config.SkipMigrations is set.
+func (d *DB) Migrate(ctx context.Context) ([]int, error) {
+	var applied []int
+	for _, m := range migrations {
+		ran, err := d.runMigration(ctx, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d failed: %w", m.version, err)
+		}
+		if ran {
+			applied = append(applied, m.version)
 		}
 	}
+	return applied, nil
+}
+
+// runMigration applies m if it has not been applied yet, reporting whether
+// it ran.
+func (d *DB) runMigration(ctx context.Context, m migration) (bool, error) {
+	// Run migration in a transaction
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Check if migration already applied
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = ?)", m.version).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check migration status: %w", err)
+	}
+	if exists {
+		return false, nil // Migration already applied
+	}
+
+	// Execute migration SQL
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return false, fmt.Errorf("failed to execute migration SQL: %w", err)
+	}
+
+	// Record migration
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, description) VALUES (?, ?)", m.version, m.description); err != nil {
+		return false, fmt.Errorf("failed to record migration: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit migration: %w", err)
+	}
 
-	return nil
+	return true, nil
 }
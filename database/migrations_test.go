@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeV1Fixture creates a database as an early release left it: the
+// version 1 schema with one image downloaded, unpacked and activated.
+func writeV1Fixture(t *testing.T, path string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stmts := []string{
+		schemaMigrationsTable,
+		initialSchema,
+		`INSERT INTO schema_migrations (version, description) VALUES (1, 'Initial schema')`,
+		`INSERT INTO images (image_id, s3_key, local_path, checksum, size_bytes, download_status, activation_status)
+		 VALUES ('img-old', 'images/old.tar', '/var/lib/flyio/images/img-old.tar', 'sha256:abc', 4096, 'completed', 'active')`,
+		`INSERT INTO unpacked_images (image_id, device_id, device_name, device_path, size_bytes, file_count, layout_verified)
+		 VALUES ('img-old', '42', 'thin-42', '/dev/mapper/thin-42', 4096, 7, 1)`,
+		`INSERT INTO snapshots (image_id, snapshot_id, snapshot_name, device_path, origin_device_id)
+		 VALUES ('img-old', '43', 'snap-img-old', '/dev/mapper/snap-img-old', '42')`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("fixture: %v", err)
+		}
+	}
+}
+
+func TestMigrate_OldSchema(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "images.db")
+	writeV1Fixture(t, cfg.Path)
+
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New(old schema): %v", err)
+	}
+	defer db.Close()
+
+	version, err := db.SchemaVersion(ctx)
+	if err != nil || version != LatestSchemaVersion() {
+		t.Fatalf("SchemaVersion() = %d, %v; want %d", version, err, LatestSchemaVersion())
+	}
+
+	// Existing rows survive
+	img, err := db.GetImageByID(ctx, "img-old")
+	if err != nil || img == nil || img.S3Key != "images/old.tar" || img.ActivationStatus != ActivationStatusActive {
+		t.Errorf("image after migration = %+v, %v", img, err)
+	}
+	if img != nil && img.ChecksumAlgo != "sha256" {
+		t.Errorf("checksum algorithm after migration = %q, want sha256", img.ChecksumAlgo)
+	}
+	unpacked, err := db.CheckImageUnpacked(ctx, "img-old")
+	if err != nil || unpacked == nil || unpacked.DeviceName != "thin-42" || unpacked.FileCount != 7 {
+		t.Errorf("unpacked image after migration = %+v, %v", unpacked, err)
+	}
+	snaps, err := db.GetSnapshotsByImageID(ctx, "img-old")
+	if err != nil || len(snaps) != 1 || snaps[0].SnapshotName != "snap-img-old" {
+		t.Errorf("snapshots after migration = %+v, %v", snaps, err)
+	}
+
+	// And the new tables work
+	if err := db.AcquireImageLock(ctx, "img-old", "test"); err != nil {
+		t.Errorf("AcquireImageLock() after migration: %v", err)
+	}
+	if err := db.AddImageTag(ctx, "img-old", "old:latest"); err != nil {
+		t.Errorf("AddImageTag() after migration: %v", err)
+	}
+
+	// Device IDs already in use are carried into device_ids
+	for owner, want := range map[string]string{
+		ImageDeviceOwner("img-old"):         "42",
+		SnapshotDeviceOwner("snap-img-old"): "43",
+		ImageDeviceOwner("img-new"):         "44",
+	} {
+		if id, err := db.AllocateDeviceID(ctx, owner, 42); err != nil || id != want {
+			t.Errorf("AllocateDeviceID(%s) after migration = %q, %v; want %q", owner, id, err, want)
+		}
+	}
+}
+
+func TestMigrate_SkipAndApply(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "images.db")
+	writeV1Fixture(t, cfg.Path)
+
+	cfg.SkipMigrations = true
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if version, _ := db.SchemaVersion(ctx); version != 1 {
+		t.Errorf("SchemaVersion() with SkipMigrations = %d, want 1", version)
+	}
+	status, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != LatestSchemaVersion() {
+		t.Fatalf("MigrationStatus() returned %d migrations, want %d", len(status), LatestSchemaVersion())
+	}
+	for _, s := range status {
+		if applied := s.AppliedAt != nil; applied != (s.Version == 1) {
+			t.Errorf("migration %d applied = %v, want only version 1 applied", s.Version, applied)
+		}
+	}
+
+	applied, err := db.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("Migrate() applied %v, want %v", applied, want)
+	}
+	if applied, err := db.Migrate(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("second Migrate() = %v, %v; want nothing to apply", applied, err)
+	}
+}
+
+func TestMigrations_Ordered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migrations[%d] has version %d, want %d", i, m.version, i+1)
+		}
+		if m.description == "" || m.sql == "" {
+			t.Errorf("migration %d is missing a description or SQL", m.version)
+		}
+	}
+}
@@ -9,6 +9,7 @@ type Image struct {
 	S3Key             string
 	LocalPath         string
 	Checksum          string
+	ChecksumAlgo      string // "sha256", "sha512" or "blake3"
 	SizeBytes         int64
 	DownloadStatus    string
 	ActivationStatus  string
@@ -17,21 +18,49 @@ type Image struct {
 	DownloadedAt      *time.Time
 	ActivatedAt       *time.Time
 	UpdatedAt         time.Time
+
+	// LastError is why the last FSM run for the image aborted, e.g.
+	// "unpack failed in verify-layout: ...". Empty once a later run succeeds.
+	LastError   string
+	LastErrorAt *time.Time
+
+	// QuarantinedAt is set when the image failed security validation, e.g. a
+	// tarball with path traversal; QuarantineReason says why. A quarantined
+	// image is not processed again until it is released.
+	QuarantineReason string
+	QuarantinedAt    *time.Time
 }
 
+// Quarantined reports whether the image is quarantined.
+func (img *Image) Quarantined() bool { return img.QuarantinedAt != nil }
+
 // UnpackedImage represents an image extracted into a devicemapper device.
 type UnpackedImage struct {
-	ID             int64
-	ImageID        string
-	DeviceID       string
-	DeviceName     string
-	DevicePath     string
-	SizeBytes      int64
-	FileCount      int
-	LayoutVerified bool
-	CreatedAt      time.Time
-	UnpackedAt     time.Time
-	UpdatedAt      time.Time
+	ID              int64
+	ImageID         string
+	DeviceID        string
+	DeviceName      string
+	DevicePath      string
+	SizeBytes       int64 // extracted content, smaller than the device
+	DeviceSizeBytes int64 // thin device size including growth; activate with DeviceSize
+	FileCount       int
+	LayoutVerified  bool
+	Layout          string // extraction.LayoutDirectRoot or LayoutRootfsSubdir; empty if unpacked before it was recorded
+	CreatedAt       time.Time
+	UnpackedAt      time.Time
+	UpdatedAt       time.Time
+}
+
+// DeviceSize returns the size to activate the image's device, or a snapshot of
+// it, with. Rows unpacked before the device size was recorded return
+// fallback, which should be at least as large as any device this build
+// creates: a thin device table longer than its filesystem is harmless, but a
+// shorter one fails fsck and mount.
+func (img *UnpackedImage) DeviceSize(fallback int64) int64 {
+	if img.DeviceSizeBytes > 0 {
+		return img.DeviceSizeBytes
+	}
+	return fallback
 }
 
 // Snapshot represents an active devicemapper snapshot.
@@ -46,6 +75,32 @@ type Snapshot struct {
 	CreatedAt      time.Time
 	DeactivatedAt  *time.Time
 	UpdatedAt      time.Time
+	LastAccessedAt *time.Time // nil if not accessed since creation
+}
+
+// LastAccess returns when the snapshot was last accessed, or its creation
+// time if it never has been.
+func (s *Snapshot) LastAccess() time.Time {
+	if s.LastAccessedAt != nil {
+		return *s.LastAccessedAt
+	}
+	return s.CreatedAt
+}
+
+// DMOperation is one devicemapper operation from the dm_operations audit log.
+type DMOperation struct {
+	ID         int64
+	Operation  string // create_thin, create_snap, activate, deactivate, delete or resize
+	Pool       string
+	DeviceName string
+	DeviceID   string
+	OriginID   string // Origin device ID for create_snap
+	OldSectors int64  // Device size before a resize
+	NewSectors int64  // Device size requested by a resize
+	StartedAt  time.Time
+	Duration   time.Duration
+	Error      string // Empty if the operation succeeded
+	Finished   bool   // False if the operation was started but never returned
 }
 
 // DownloadStatus constants
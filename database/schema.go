@@ -103,3 +103,113 @@ CREATE TABLE IF NOT EXISTS image_locks (
 
 CREATE INDEX IF NOT EXISTS idx_image_locks_locked_at ON image_locks(locked_at);
 `
+
+// tagsSchema adds the tags table for human-readable image aliases (version 3).
+// Each tag names exactly one image; an image may carry any number of tags.
+const tagsSchema = `
+-- tags table: friendly names such as "python:3.12-prod" for derived image IDs
+CREATE TABLE IF NOT EXISTS tags (
+    tag TEXT PRIMARY KEY,
+    image_id TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (image_id) REFERENCES images(image_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_tags_image_id ON tags(image_id);
+`
+
+// imageLastErrorSchema records why an image's last FSM run aborted (version 4).
+const imageLastErrorSchema = `
+ALTER TABLE images ADD COLUMN last_error TEXT;
+ALTER TABLE images ADD COLUMN last_error_at DATETIME;
+`
+
+// deviceIDsSchema adds the device_ids table, which allocates thin device IDs
+// so no two images or snapshots share one (version 5). IDs already recorded
+// for unpacked images and snapshots are carried over.
+const deviceIDsSchema = `
+-- device_ids table: every thin device ID in use, and the image or snapshot it belongs to
+CREATE TABLE IF NOT EXISTS device_ids (
+    device_id INTEGER PRIMARY KEY,
+    owner TEXT NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    CHECK (device_id BETWEEN 1 AND 16777215)
+);
+
+INSERT OR IGNORE INTO device_ids (device_id, owner)
+SELECT CAST(device_id AS INTEGER), 'image:' || image_id FROM unpacked_images;
+
+INSERT OR IGNORE INTO device_ids (device_id, owner)
+SELECT CAST(snapshot_id AS INTEGER), 'snapshot:' || snapshot_name FROM snapshots;
+`
+
+// dmOperationsSchema adds the dm_operations audit log (version 6): one row per
+// devicemapper create, snapshot, activate, deactivate or delete, kept for
+// post-incident analysis after a kernel panic.
+const dmOperationsSchema = `
+-- dm_operations table: append-only record of devicemapper operations
+CREATE TABLE IF NOT EXISTS dm_operations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    operation TEXT NOT NULL,
+    pool TEXT NOT NULL DEFAULT '',
+    device_name TEXT NOT NULL DEFAULT '',
+    device_id TEXT NOT NULL DEFAULT '',
+    origin_id TEXT NOT NULL DEFAULT '',
+    started_at DATETIME NOT NULL,
+    duration_ms INTEGER NOT NULL,
+    error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_dm_operations_started_at ON dm_operations(started_at);
+`
+
+// snapshotLastAccessedSchema records when each snapshot was last handed out
+// or inspected (version 7), so idle snapshots can be deactivated. NULL means
+// never accessed since creation.
+const snapshotLastAccessedSchema = `
+ALTER TABLE snapshots ADD COLUMN last_accessed_at DATETIME;
+`
+
+// imageChecksumAlgoSchema records which algorithm produced images.checksum
+// (version 8). Every digest stored before it was SHA256.
+const imageChecksumAlgoSchema = `
+ALTER TABLE images ADD COLUMN checksum_algo TEXT NOT NULL DEFAULT 'sha256';
+`
+
+// imageQuarantineSchema records images quarantined after failing security
+// validation (version 9).
+const imageQuarantineSchema = `
+ALTER TABLE images ADD COLUMN quarantine_reason TEXT;
+ALTER TABLE images ADD COLUMN quarantined_at DATETIME;
+`
+
+// unpackedLayoutSchema records where on an unpacked device the root
+// filesystem is (version 10). Rows from before it have an empty layout.
+const unpackedLayoutSchema = `
+ALTER TABLE unpacked_images ADD COLUMN layout TEXT NOT NULL DEFAULT '';
+`
+
+// dmOperationsFinishedSchema lets a dm_operations row be written before its
+// operation runs and completed afterwards (version 11). A row left unfinished
+// is an operation that never returned. Rows from before it were finished.
+const dmOperationsFinishedSchema = `
+ALTER TABLE dm_operations ADD COLUMN finished INTEGER NOT NULL DEFAULT 1;
+`
+
+// dmOperationsSectorsSchema records the device size before and after a
+// resize (version 13). Other operations, and rows from before it, have 0.
+const dmOperationsSectorsSchema = `
+ALTER TABLE dm_operations ADD COLUMN old_sectors INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE dm_operations ADD COLUMN new_sectors INTEGER NOT NULL DEFAULT 0;
+`
+
+// unpackedDeviceSizeSchema records the size of each unpacked image's thin
+// device, including growth during extraction (version 12). size_bytes is the
+// extracted content, which is smaller than the filesystem. Rows from before it
+// have 0.
+const unpackedDeviceSizeSchema = `
+ALTER TABLE unpacked_images ADD COLUMN device_size_bytes INTEGER NOT NULL DEFAULT 0;
+`
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sort"
 	"time"
 )
 
@@ -13,18 +14,18 @@ import (
 func (d *DB) CheckSnapshotExists(ctx context.Context, imageID, snapshotName string) (*Snapshot, error) {
 	query := `
 		SELECT id, image_id, snapshot_id, snapshot_name, device_path, origin_device_id,
-		       active, created_at, deactivated_at, updated_at
+		       active, created_at, deactivated_at, updated_at, last_accessed_at
 		FROM snapshots
 		WHERE image_id = ? AND snapshot_name = ? AND active = 1
 	`
 
 	var snap Snapshot
-	var deactivatedAt sql.NullTime
+	var deactivatedAt, lastAccessedAt sql.NullTime
 
 	err := d.db.QueryRowContext(ctx, query, imageID, snapshotName).Scan(
 		&snap.ID, &snap.ImageID, &snap.SnapshotID, &snap.SnapshotName,
 		&snap.DevicePath, &snap.OriginDeviceID, &snap.Active,
-		&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt,
+		&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt, &lastAccessedAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -37,6 +38,9 @@ func (d *DB) CheckSnapshotExists(ctx context.Context, imageID, snapshotName stri
 	if deactivatedAt.Valid {
 		snap.DeactivatedAt = &deactivatedAt.Time
 	}
+	if lastAccessedAt.Valid {
+		snap.LastAccessedAt = &lastAccessedAt.Time
+	}
 
 	return &snap, nil
 }
@@ -48,6 +52,7 @@ func (d *DB) StoreSnapshot(ctx context.Context, imageID, snapshotID, snapshotNam
 		VALUES (?, ?, ?, ?, ?, 1, ?)
 		ON CONFLICT(snapshot_name) DO UPDATE SET
 			active = 1,
+			last_accessed_at = excluded.created_at,
 			updated_at = CURRENT_TIMESTAMP
 	`
 
@@ -68,18 +73,18 @@ func (d *DB) StoreSnapshot(ctx context.Context, imageID, snapshotID, snapshotNam
 func (d *DB) GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot, error) {
 	query := `
 		SELECT id, image_id, snapshot_id, snapshot_name, device_path, origin_device_id,
-		       active, created_at, deactivated_at, updated_at
+		       active, created_at, deactivated_at, updated_at, last_accessed_at
 		FROM snapshots
 		WHERE snapshot_id = ?
 	`
 
 	var snap Snapshot
-	var deactivatedAt sql.NullTime
+	var deactivatedAt, lastAccessedAt sql.NullTime
 
 	err := d.db.QueryRowContext(ctx, query, snapshotID).Scan(
 		&snap.ID, &snap.ImageID, &snap.SnapshotID, &snap.SnapshotName,
 		&snap.DevicePath, &snap.OriginDeviceID, &snap.Active,
-		&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt,
+		&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt, &lastAccessedAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -92,6 +97,9 @@ func (d *DB) GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot,
 	if deactivatedAt.Valid {
 		snap.DeactivatedAt = &deactivatedAt.Time
 	}
+	if lastAccessedAt.Valid {
+		snap.LastAccessedAt = &lastAccessedAt.Time
+	}
 
 	return &snap, nil
 }
@@ -100,7 +108,7 @@ func (d *DB) GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot,
 func (d *DB) GetSnapshotsByImageID(ctx context.Context, imageID string) ([]*Snapshot, error) {
 	query := `
 		SELECT id, image_id, snapshot_id, snapshot_name, device_path, origin_device_id,
-		       active, created_at, deactivated_at, updated_at
+		       active, created_at, deactivated_at, updated_at, last_accessed_at
 		FROM snapshots
 		WHERE image_id = ?
 		ORDER BY created_at DESC
@@ -115,12 +123,12 @@ func (d *DB) GetSnapshotsByImageID(ctx context.Context, imageID string) ([]*Snap
 	var snapshots []*Snapshot
 	for rows.Next() {
 		var snap Snapshot
-		var deactivatedAt sql.NullTime
+		var deactivatedAt, lastAccessedAt sql.NullTime
 
 		err := rows.Scan(
 			&snap.ID, &snap.ImageID, &snap.SnapshotID, &snap.SnapshotName,
 			&snap.DevicePath, &snap.OriginDeviceID, &snap.Active,
-			&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt,
+			&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt, &lastAccessedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
@@ -129,6 +137,9 @@ func (d *DB) GetSnapshotsByImageID(ctx context.Context, imageID string) ([]*Snap
 		if deactivatedAt.Valid {
 			snap.DeactivatedAt = &deactivatedAt.Time
 		}
+		if lastAccessedAt.Valid {
+			snap.LastAccessedAt = &lastAccessedAt.Time
+		}
 
 		snapshots = append(snapshots, &snap)
 	}
@@ -167,6 +178,51 @@ func (d *DB) DeactivateSnapshot(ctx context.Context, snapshotID string) error {
 	return nil
 }
 
+// TouchSnapshot records that a snapshot was accessed now: handed out again by
+// activate, or mounted for inspection.
+func (d *DB) TouchSnapshot(ctx context.Context, snapshotID string) error {
+	query := `UPDATE snapshots SET last_accessed_at = ? WHERE snapshot_id = ?`
+
+	result, err := d.db.ExecContext(ctx, query, time.Now(), snapshotID)
+	if err != nil {
+		return fmt.Errorf("failed to record snapshot access: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rows == 0 {
+		return fmt.Errorf("snapshot not found: %s", snapshotID)
+	}
+
+	return nil
+}
+
+// ListIdleSnapshots lists active snapshots last accessed (or, if never
+// accessed, created) before idleSince, least recently accessed first.
+//
+// The cutoff is applied after scanning rather than in SQL: timestamps are
+// stored as text in the writer's time zone, which SQLite cannot compare.
+func (d *DB) ListIdleSnapshots(ctx context.Context, idleSince time.Time) ([]*Snapshot, error) {
+	active, err := d.ListActiveSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var idle []*Snapshot
+	for _, snap := range active {
+		if snap.LastAccess().Before(idleSince) {
+			idle = append(idle, snap)
+		}
+	}
+	sort.SliceStable(idle, func(i, j int) bool {
+		return idle[i].LastAccess().Before(idle[j].LastAccess())
+	})
+	return idle, nil
+}
+
 // DeleteSnapshot deletes a snapshot record.
 // This should be used when cleaning up after a failed activation.
 func (d *DB) DeleteSnapshot(ctx context.Context, snapshotID string) error {
@@ -193,7 +249,7 @@ func (d *DB) DeleteSnapshot(ctx context.Context, snapshotID string) error {
 func (d *DB) ListActiveSnapshots(ctx context.Context) ([]*Snapshot, error) {
 	query := `
 		SELECT id, image_id, snapshot_id, snapshot_name, device_path, origin_device_id,
-		       active, created_at, deactivated_at, updated_at
+		       active, created_at, deactivated_at, updated_at, last_accessed_at
 		FROM snapshots
 		WHERE active = 1
 		ORDER BY created_at DESC
@@ -208,12 +264,12 @@ func (d *DB) ListActiveSnapshots(ctx context.Context) ([]*Snapshot, error) {
 	var snapshots []*Snapshot
 	for rows.Next() {
 		var snap Snapshot
-		var deactivatedAt sql.NullTime
+		var deactivatedAt, lastAccessedAt sql.NullTime
 
 		err := rows.Scan(
 			&snap.ID, &snap.ImageID, &snap.SnapshotID, &snap.SnapshotName,
 			&snap.DevicePath, &snap.OriginDeviceID, &snap.Active,
-			&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt,
+			&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt, &lastAccessedAt,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
@@ -222,6 +278,55 @@ func (d *DB) ListActiveSnapshots(ctx context.Context) ([]*Snapshot, error) {
 		if deactivatedAt.Valid {
 			snap.DeactivatedAt = &deactivatedAt.Time
 		}
+		if lastAccessedAt.Valid {
+			snap.LastAccessedAt = &lastAccessedAt.Time
+		}
+
+		snapshots = append(snapshots, &snap)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating snapshots: %w", err)
+	}
+
+	return snapshots, nil
+}
+
+// ListSnapshots lists all snapshots, active and inactive.
+func (d *DB) ListSnapshots(ctx context.Context) ([]*Snapshot, error) {
+	query := `
+		SELECT id, image_id, snapshot_id, snapshot_name, device_path, origin_device_id,
+		       active, created_at, deactivated_at, updated_at, last_accessed_at
+		FROM snapshots
+		ORDER BY created_at DESC
+	`
+
+	rows, err := d.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	var snapshots []*Snapshot
+	for rows.Next() {
+		var snap Snapshot
+		var deactivatedAt, lastAccessedAt sql.NullTime
+
+		err := rows.Scan(
+			&snap.ID, &snap.ImageID, &snap.SnapshotID, &snap.SnapshotName,
+			&snap.DevicePath, &snap.OriginDeviceID, &snap.Active,
+			&snap.CreatedAt, &deactivatedAt, &snap.UpdatedAt, &lastAccessedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
+		}
+
+		if deactivatedAt.Valid {
+			snap.DeactivatedAt = &deactivatedAt.Time
+		}
+		if lastAccessedAt.Valid {
+			snap.LastAccessedAt = &lastAccessedAt.Time
+		}
 
 		snapshots = append(snapshots, &snap)
 	}
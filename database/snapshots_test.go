@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListIdleSnapshots(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	storeTestImage(t, db, "img")
+	if err := db.StoreUnpackedImage(ctx, "img", "1", "thin-1", "/dev/mapper/thin-1", 1024, 1<<30, 1, "direct-root"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	// A writer in another time zone must still compare correctly.
+	east := time.FixedZone("PKT", 5*60*60)
+
+	seeds := []struct {
+		id           string
+		createdAt    time.Time
+		lastAccessed *time.Time
+		active       bool
+	}{
+		{id: "10", createdAt: now.Add(-48 * time.Hour)},                                              // never accessed, idle
+		{id: "11", createdAt: now.Add(-72 * time.Hour), lastAccessed: ptr(now.Add(-30 * time.Hour))}, // accessed, still idle
+		{id: "12", createdAt: now.Add(-72 * time.Hour), lastAccessed: ptr(now.Add(-time.Hour))},      // recently accessed
+		{id: "13", createdAt: now.Add(-2 * time.Hour)},                                               // new
+		{id: "14", createdAt: now.Add(-96 * time.Hour).In(east)},                                     // idle, other zone
+		{id: "15", createdAt: now.Add(-time.Hour).In(east)},                                          // new, other zone
+		{id: "16", createdAt: now.Add(-96 * time.Hour), active: false},                               // already inactive
+	}
+	for _, s := range seeds {
+		name := "snap-" + s.id
+		if err := db.StoreSnapshot(ctx, "img", s.id, name, "/dev/mapper/"+name, "1"); err != nil {
+			t.Fatal(err)
+		}
+		_, err := db.db.ExecContext(ctx, "UPDATE snapshots SET created_at = ?, last_accessed_at = ? WHERE snapshot_id = ?",
+			s.createdAt, s.lastAccessed, s.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.id == "16" {
+			if err := db.DeactivateSnapshot(ctx, s.id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	idle, err := db.ListIdleSnapshots(ctx, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("ListIdleSnapshots() error = %v", err)
+	}
+	var got []string
+	for _, snap := range idle {
+		got = append(got, snap.SnapshotID)
+	}
+	// Least recently accessed first.
+	if want := []string{"14", "10", "11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListIdleSnapshots() = %v, want %v", got, want)
+	}
+}
+
+func TestTouchSnapshot(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	storeTestImage(t, db, "img")
+	if err := db.StoreUnpackedImage(ctx, "img", "1", "thin-1", "/dev/mapper/thin-1", 1024, 1<<30, 1, "direct-root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StoreSnapshot(ctx, "img", "10", "snap-10", "/dev/mapper/snap-10", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := db.GetSnapshotByID(ctx, "10")
+	if err != nil || snap.LastAccessedAt != nil {
+		t.Fatalf("new snapshot LastAccessedAt = %v, %v; want nil", snap.LastAccessedAt, err)
+	}
+
+	before := time.Now()
+	if err := db.TouchSnapshot(ctx, "10"); err != nil {
+		t.Fatalf("TouchSnapshot() error = %v", err)
+	}
+	snap, err = db.GetSnapshotByID(ctx, "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.LastAccessedAt == nil || snap.LastAccessedAt.Before(before) {
+		t.Errorf("LastAccessedAt = %v, want at or after %v", snap.LastAccessedAt, before)
+	}
+	if idle, _ := db.ListIdleSnapshots(ctx, before); len(idle) != 0 {
+		t.Errorf("touched snapshot listed as idle: %v", idle)
+	}
+
+	if err := db.TouchSnapshot(ctx, "missing"); err == nil {
+		t.Error("TouchSnapshot() of a missing snapshot succeeded")
+	}
+}
+
+func ptr(t time.Time) *time.Time { return &t }
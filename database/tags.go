@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxTagLength is the longest tag accepted, matching the Docker tag limit.
+const maxTagLength = 128
+
+// ValidateTag checks that tag is usable as an image tag: non-empty, at most
+// 128 characters and free of whitespace and control characters. Tags like
+// "python:3.12-prod" are otherwise free-form.
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("tag must not be empty")
+	}
+	if len(tag) > maxTagLength {
+		return fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+	}
+	if i := strings.IndexFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }); i >= 0 {
+		return fmt.Errorf("tag %q contains whitespace or control characters", tag)
+	}
+	return nil
+}
+
+// AddImageTag points tag at imageID. A tag names at most one image, so
+// adding a tag that is already on another image moves it; adding it to the
+// image it is already on is a no-op. The image must exist.
+func (d *DB) AddImageTag(ctx context.Context, imageID, tag string) error {
+	if err := ValidateTag(tag); err != nil {
+		return err
+	}
+
+	// Select from images rather than relying on the foreign key, which is
+	// only enforced on connections that ran the foreign_keys pragma. The
+	// WHERE is required by SQLite's upsert syntax after a SELECT.
+	query := `
+		INSERT INTO tags (tag, image_id)
+		SELECT ?, image_id FROM images WHERE image_id = ?
+		ON CONFLICT(tag) DO UPDATE SET
+			image_id = excluded.image_id,
+			updated_at = CURRENT_TIMESTAMP
+	`
+	result, err := d.db.ExecContext(ctx, query, tag, imageID)
+	if err != nil {
+		return fmt.Errorf("failed to tag image: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("image not found: %s", imageID)
+	}
+	return nil
+}
+
+// RemoveImageTag removes tag from whichever image it names.
+// This is idempotent - it does not error if the tag doesn't exist.
+func (d *DB) RemoveImageTag(ctx context.Context, tag string) error {
+	query := `DELETE FROM tags WHERE tag = ?`
+	if _, err := d.db.ExecContext(ctx, query, tag); err != nil {
+		return fmt.Errorf("failed to remove tag: %w", err)
+	}
+	return nil
+}
+
+// GetImageByTag retrieves the image a tag names. Returns nil if the tag
+// doesn't exist.
+func (d *DB) GetImageByTag(ctx context.Context, tag string) (*Image, error) {
+	var imageID string
+	err := d.db.QueryRowContext(ctx, `SELECT image_id FROM tags WHERE tag = ?`, tag).Scan(&imageID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tag: %w", err)
+	}
+	return d.GetImageByID(ctx, imageID)
+}
+
+// ListImageTags returns the tags on an image, sorted.
+func (d *DB) ListImageTags(ctx context.Context, imageID string) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT tag FROM tags WHERE image_id = ? ORDER BY tag`, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tags: %w", err)
+	}
+	return tags, nil
+}
+
+// ListTags returns every tag, sorted, keyed by the image it names.
+func (d *DB) ListTags(ctx context.Context) (map[string][]string, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT image_id, tag FROM tags ORDER BY tag`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var imageID, tag string
+		if err := rows.Scan(&imageID, &tag); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags[imageID] = append(tags[imageID], tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tags: %w", err)
+	}
+	return tags, nil
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/superfly/fsm/checksum"
+)
+
+// newTestDB opens a fresh database in a temp dir.
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "images.db")
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// storeTestImage records a completed download for imageID.
+func storeTestImage(t *testing.T, db *DB, imageID string) {
+	t.Helper()
+	err := db.StoreImageMetadata(context.Background(), imageID, "images/"+imageID+".tar", "/tmp/"+imageID+".tar", checksum.Checksum{Hex: "0"}, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTagsMigration(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Path = filepath.Join(t.TempDir(), "images.db")
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Reopening must not re-run applied migrations
+	db, err = New(cfg)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = 3").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("migration 3 recorded %d times, want 1", count)
+	}
+	if _, err := db.db.Exec("SELECT tag, image_id, created_at, updated_at FROM tags"); err != nil {
+		t.Errorf("tags table missing: %v", err)
+	}
+}
+
+func TestImageTags(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	storeTestImage(t, db, "img-a")
+	storeTestImage(t, db, "img-b")
+
+	if err := db.AddImageTag(ctx, "img-a", "python:3.12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddImageTag(ctx, "img-a", "python:3.12-prod"); err != nil {
+		t.Fatal(err)
+	}
+	// Re-adding is a no-op
+	if err := db.AddImageTag(ctx, "img-a", "python:3.12"); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := db.GetImageByTag(ctx, "python:3.12")
+	if err != nil || img == nil || img.ImageID != "img-a" {
+		t.Fatalf("GetImageByTag() = %+v, %v; want img-a", img, err)
+	}
+	tags, err := db.ListImageTags(ctx, "img-a")
+	if err != nil || !reflect.DeepEqual(tags, []string{"python:3.12", "python:3.12-prod"}) {
+		t.Errorf("ListImageTags(img-a) = %v, %v", tags, err)
+	}
+
+	// Re-target the tag to a newer image
+	if err := db.AddImageTag(ctx, "img-b", "python:3.12"); err != nil {
+		t.Fatal(err)
+	}
+	if img, _ := db.GetImageByTag(ctx, "python:3.12"); img == nil || img.ImageID != "img-b" {
+		t.Errorf("after re-target GetImageByTag() = %+v, want img-b", img)
+	}
+	all, err := db.ListTags(ctx)
+	want := map[string][]string{"img-a": {"python:3.12-prod"}, "img-b": {"python:3.12"}}
+	if err != nil || !reflect.DeepEqual(all, want) {
+		t.Errorf("ListTags() = %v, %v; want %v", all, err, want)
+	}
+
+	if err := db.RemoveImageTag(ctx, "python:3.12"); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := db.GetImageByTag(ctx, "python:3.12"); err != nil || img != nil {
+		t.Errorf("GetImageByTag(removed) = %+v, %v; want nil", img, err)
+	}
+	if err := db.RemoveImageTag(ctx, "python:3.12"); err != nil {
+		t.Errorf("RemoveImageTag(missing) = %v, want nil", err)
+	}
+
+	// Deleting an image deletes its tags
+	if err := db.DeleteImage(ctx, "img-a"); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := db.GetImageByTag(ctx, "python:3.12-prod"); err != nil || img != nil {
+		t.Errorf("tag survived image deletion: %+v, %v", img, err)
+	}
+}
+
+func TestAddImageTag_Errors(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.AddImageTag(ctx, "missing", "latest")
+	if err == nil || !strings.Contains(err.Error(), "image not found") {
+		t.Errorf("AddImageTag(unknown image) = %v, want image not found", err)
+	}
+
+	storeTestImage(t, db, "img-a")
+	for _, tag := range []string{"", "has space", "tab\tbed", strings.Repeat("x", maxTagLength+1)} {
+		if err := db.AddImageTag(ctx, "img-a", tag); err == nil {
+			t.Errorf("AddImageTag(%q) succeeded, want error", tag)
+		}
+	}
+}
@@ -13,7 +13,7 @@ import (
 func (d *DB) CheckImageUnpacked(ctx context.Context, imageID string) (*UnpackedImage, error) {
 	query := `
 		SELECT id, image_id, device_id, device_name, device_path, size_bytes,
-		       file_count, layout_verified, created_at, unpacked_at, updated_at
+		       device_size_bytes, file_count, layout_verified, layout, created_at, unpacked_at, updated_at
 		FROM unpacked_images
 		WHERE image_id = ? AND layout_verified = 1
 	`
@@ -21,7 +21,7 @@ func (d *DB) CheckImageUnpacked(ctx context.Context, imageID string) (*UnpackedI
 	var img UnpackedImage
 	err := d.db.QueryRowContext(ctx, query, imageID).Scan(
 		&img.ID, &img.ImageID, &img.DeviceID, &img.DeviceName, &img.DevicePath,
-		&img.SizeBytes, &img.FileCount, &img.LayoutVerified,
+		&img.SizeBytes, &img.DeviceSizeBytes, &img.FileCount, &img.LayoutVerified, &img.Layout,
 		&img.CreatedAt, &img.UnpackedAt, &img.UpdatedAt,
 	)
 
@@ -35,23 +35,27 @@ func (d *DB) CheckImageUnpacked(ctx context.Context, imageID string) (*UnpackedI
 	return &img, nil
 }
 
-// StoreUnpackedImage stores or updates unpacked image metadata.
-func (d *DB) StoreUnpackedImage(ctx context.Context, imageID, deviceID, deviceName, devicePath string, sizeBytes int64, fileCount int) error {
+// StoreUnpackedImage stores or updates unpacked image metadata. sizeBytes is
+// the extracted content and deviceSizeBytes the thin device's final size;
+// layout is where on the device the root filesystem is.
+func (d *DB) StoreUnpackedImage(ctx context.Context, imageID, deviceID, deviceName, devicePath string, sizeBytes, deviceSizeBytes int64, fileCount int, layout string) error {
 	query := `
-		INSERT INTO unpacked_images (image_id, device_id, device_name, device_path, size_bytes, file_count, layout_verified, unpacked_at)
-		VALUES (?, ?, ?, ?, ?, ?, 1, ?)
+		INSERT INTO unpacked_images (image_id, device_id, device_name, device_path, size_bytes, device_size_bytes, file_count, layout_verified, layout, unpacked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?, ?)
 		ON CONFLICT(image_id) DO UPDATE SET
 			device_id = excluded.device_id,
 			device_name = excluded.device_name,
 			device_path = excluded.device_path,
 			size_bytes = excluded.size_bytes,
+			device_size_bytes = excluded.device_size_bytes,
 			file_count = excluded.file_count,
 			layout_verified = 1,
+			layout = excluded.layout,
 			unpacked_at = excluded.unpacked_at,
 			updated_at = CURRENT_TIMESTAMP
 	`
 
-	res, err := d.db.ExecContext(ctx, query, imageID, deviceID, deviceName, devicePath, sizeBytes, fileCount, time.Now())
+	res, err := d.db.ExecContext(ctx, query, imageID, deviceID, deviceName, devicePath, sizeBytes, deviceSizeBytes, fileCount, layout, time.Now())
 	if err != nil {
 		return fmt.Errorf("failed to store unpacked image: %w", err)
 	}
@@ -68,7 +72,7 @@ func (d *DB) StoreUnpackedImage(ctx context.Context, imageID, deviceID, deviceNa
 func (d *DB) GetUnpackedImageByID(ctx context.Context, imageID string) (*UnpackedImage, error) {
 	query := `
 		SELECT id, image_id, device_id, device_name, device_path, size_bytes,
-		       file_count, layout_verified, created_at, unpacked_at, updated_at
+		       device_size_bytes, file_count, layout_verified, layout, created_at, unpacked_at, updated_at
 		FROM unpacked_images
 		WHERE image_id = ?
 	`
@@ -76,7 +80,7 @@ func (d *DB) GetUnpackedImageByID(ctx context.Context, imageID string) (*Unpacke
 	var img UnpackedImage
 	err := d.db.QueryRowContext(ctx, query, imageID).Scan(
 		&img.ID, &img.ImageID, &img.DeviceID, &img.DeviceName, &img.DevicePath,
-		&img.SizeBytes, &img.FileCount, &img.LayoutVerified,
+		&img.SizeBytes, &img.DeviceSizeBytes, &img.FileCount, &img.LayoutVerified, &img.Layout,
 		&img.CreatedAt, &img.UnpackedAt, &img.UpdatedAt,
 	)
 
@@ -94,7 +98,7 @@ func (d *DB) GetUnpackedImageByID(ctx context.Context, imageID string) (*Unpacke
 func (d *DB) GetUnpackedImageByDeviceID(ctx context.Context, deviceID string) (*UnpackedImage, error) {
 	query := `
 		SELECT id, image_id, device_id, device_name, device_path, size_bytes,
-		       file_count, layout_verified, created_at, unpacked_at, updated_at
+		       device_size_bytes, file_count, layout_verified, layout, created_at, unpacked_at, updated_at
 		FROM unpacked_images
 		WHERE device_id = ?
 	`
@@ -102,7 +106,7 @@ func (d *DB) GetUnpackedImageByDeviceID(ctx context.Context, deviceID string) (*
 	var img UnpackedImage
 	err := d.db.QueryRowContext(ctx, query, deviceID).Scan(
 		&img.ID, &img.ImageID, &img.DeviceID, &img.DeviceName, &img.DevicePath,
-		&img.SizeBytes, &img.FileCount, &img.LayoutVerified,
+		&img.SizeBytes, &img.DeviceSizeBytes, &img.FileCount, &img.LayoutVerified, &img.Layout,
 		&img.CreatedAt, &img.UnpackedAt, &img.UpdatedAt,
 	)
 
@@ -142,7 +146,7 @@ func (d *DB) DeleteUnpackedImage(ctx context.Context, imageID string) error {
 func (d *DB) ListUnpackedImages(ctx context.Context) ([]*UnpackedImage, error) {
 	query := `
 		SELECT id, image_id, device_id, device_name, device_path, size_bytes,
-		       file_count, layout_verified, created_at, unpacked_at, updated_at
+		       device_size_bytes, file_count, layout_verified, layout, created_at, unpacked_at, updated_at
 		FROM unpacked_images
 		ORDER BY unpacked_at DESC
 	`
@@ -158,7 +162,7 @@ func (d *DB) ListUnpackedImages(ctx context.Context) ([]*UnpackedImage, error) {
 		var img UnpackedImage
 		err := rows.Scan(
 			&img.ID, &img.ImageID, &img.DeviceID, &img.DeviceName, &img.DevicePath,
-			&img.SizeBytes, &img.FileCount, &img.LayoutVerified,
+			&img.SizeBytes, &img.DeviceSizeBytes, &img.FileCount, &img.LayoutVerified, &img.Layout,
 			&img.CreatedAt, &img.UnpackedAt, &img.UpdatedAt,
 		)
 		if err != nil {
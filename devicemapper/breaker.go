@@ -0,0 +1,170 @@
+package devicemapper
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// DefaultPoolFullCooldown is how long a PoolBreaker refuses operations after
+// the pool is found full.
+const DefaultPoolFullCooldown = 30 * time.Second
+
+// poolBreakerJitter is the largest extra cool-down, as a fraction of the
+// cool-down, added to each trip so processes sharing a pool do not all check
+// it again at the same moment.
+const poolBreakerJitter = 0.2
+
+// PoolBreaker is a circuit breaker for a full pool. Once a capacity check
+// finds the pool full, the breaker opens and refuses further operations with
+// the same PoolFullError, without running dmsetup status, until one of:
+//
+//   - the cool-down (plus jitter) has passed; the next check then goes to the
+//     pool and opens the breaker again if it is still full
+//   - a pool status read by this process shows usage back under the
+//     threshold that tripped it; Client.WaitForPoolSpace polls for one, which
+//     is how space freed by gc in another process is noticed
+//   - a device is deleted through this process's Client, which may have
+//     reclaimed space
+//
+// The breaker is in-process state: deletions by other processes only close
+// it through a later pool status.
+//
+// A nil *PoolBreaker is always closed.
+type PoolBreaker struct {
+	cooldown time.Duration
+	now      func() time.Time
+	jitter   func(max time.Duration) time.Duration
+
+	mu        sync.Mutex
+	tripped   *PoolFullError // Refusal that opened the breaker; nil when closed
+	openUntil time.Time
+	closed    chan struct{} // Closed when the breaker closes early, to wake Wait
+}
+
+// NewPoolBreaker returns a closed breaker that stays open for cooldown after
+// each pool-full refusal.
+func NewPoolBreaker(cooldown time.Duration) *PoolBreaker {
+	return &PoolBreaker{
+		cooldown: cooldown,
+		now:      time.Now,
+		jitter: func(max time.Duration) time.Duration {
+			if max <= 0 {
+				return 0
+			}
+			return rand.N(max)
+		},
+	}
+}
+
+// Trip opens the breaker after err, or keeps it open for a fresh cool-down if
+// it already was.
+func (b *PoolBreaker) Trip(err *PoolFullError) {
+	if b == nil || err == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tripped == nil {
+		b.closed = make(chan struct{})
+	}
+	b.tripped = err
+	b.openUntil = b.now().Add(b.cooldown + b.jitter(time.Duration(float64(b.cooldown)*poolBreakerJitter)))
+}
+
+// Allow returns nil if an operation may go ahead, or, while the breaker is
+// open, a copy of the PoolFullError that opened it with RetryAt set.
+func (b *PoolBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tripped == nil || !b.now().Before(b.openUntil) {
+		return nil
+	}
+	refused := *b.tripped
+	refused.RetryAt = b.openUntil
+	return &refused
+}
+
+// Remaining returns how long the breaker stays open, or 0 if it is closed.
+func (b *PoolBreaker) Remaining() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tripped == nil {
+		return 0
+	}
+	return max(b.openUntil.Sub(b.now()), 0)
+}
+
+// Observe closes the breaker if info shows the pool writable and under the
+// threshold that tripped it.
+func (b *PoolBreaker) Observe(info PoolInfo) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tripped == nil || !info.Healthy() {
+		return
+	}
+	used := info.DataUsagePercent()
+	if b.tripped.Metadata {
+		used = info.MetaUsagePercent()
+	}
+	if used < b.tripped.Threshold {
+		b.closeLocked()
+	}
+}
+
+// Reset closes the breaker once this process may have reclaimed space, e.g.
+// after deleting a device. Space freed by other processes is only seen by
+// Observe.
+func (b *PoolBreaker) Reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tripped != nil {
+		b.closeLocked()
+	}
+}
+
+func (b *PoolBreaker) closeLocked() {
+	b.tripped = nil
+	close(b.closed)
+}
+
+// Wait blocks while the breaker is open: until the cool-down has passed, the
+// breaker is closed early, or ctx is done.
+func (b *PoolBreaker) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	if b.tripped == nil {
+		b.mu.Unlock()
+		return nil
+	}
+	closed, wait := b.closed, b.openUntil.Sub(b.now())
+	b.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-closed:
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
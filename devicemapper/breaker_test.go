@@ -0,0 +1,235 @@
+package devicemapper
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for a PoolBreaker.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+// newTestBreaker returns a breaker on a fake clock with no jitter.
+func newTestBreaker(cooldown time.Duration) (*PoolBreaker, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	b := NewPoolBreaker(cooldown)
+	b.now = clock.now
+	b.jitter = func(time.Duration) time.Duration { return 0 }
+	return b, clock
+}
+
+func mustPoolInfo(t *testing.T, usedMeta, totalMeta, usedData, totalData int) PoolInfo {
+	t.Helper()
+	info, err := ParsePoolStatusOutput("pool", poolStatusLine(usedMeta, totalMeta, usedData, totalData))
+	if err != nil {
+		t.Fatalf("ParsePoolStatusOutput: %v", err)
+	}
+	return *info
+}
+
+func TestPoolBreaker_ConsecutiveTripsStayOpen(t *testing.T) {
+	b, clock := newTestBreaker(30 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("new breaker Allow() = %v, want nil", err)
+	}
+
+	b.Trip(&PoolFullError{PoolName: "pool", UsedPercent: 80, Threshold: 70})
+	clock.t = clock.t.Add(20 * time.Second)
+	// A second refusal before the cool-down ends starts a fresh one
+	b.Trip(&PoolFullError{PoolName: "pool", UsedPercent: 85, Threshold: 70})
+	clock.t = clock.t.Add(20 * time.Second)
+
+	err := b.Allow()
+	if !IsPoolFullError(err) {
+		t.Fatalf("Allow() = %v, want PoolFullError", err)
+	}
+	pfe := err.(*PoolFullError)
+	if pfe.UsedPercent != 85 || !pfe.RetryAt.Equal(clock.t.Add(10*time.Second)) {
+		t.Errorf("refusal = %+v, want usage 85 and RetryAt in 10s", pfe)
+	}
+	if !strings.Contains(err.Error(), "paused until") {
+		t.Errorf("Error() = %q, want the pause mentioned", err)
+	}
+	if got := b.Remaining(); got != 10*time.Second {
+		t.Errorf("Remaining() = %v, want 10s", got)
+	}
+
+	clock.t = clock.t.Add(10 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow() after the cool-down = %v, want nil", err)
+	}
+	if got := b.Remaining(); got != 0 {
+		t.Errorf("Remaining() after the cool-down = %v, want 0", got)
+	}
+}
+
+func TestPoolBreaker_ObserveCapacity(t *testing.T) {
+	tests := []struct {
+		name     string
+		tripped  PoolFullError
+		info     func(t *testing.T) PoolInfo
+		wantOpen bool
+	}{
+		{
+			name:    "data back under threshold",
+			tripped: PoolFullError{Threshold: 70},
+			info:    func(t *testing.T) PoolInfo { return mustPoolInfo(t, 100, 1000, 500, 1000) },
+		},
+		{
+			name:     "data still over threshold",
+			tripped:  PoolFullError{Threshold: 70},
+			info:     func(t *testing.T) PoolInfo { return mustPoolInfo(t, 100, 1000, 750, 1000) },
+			wantOpen: true,
+		},
+		{
+			name:     "metadata still over threshold",
+			tripped:  PoolFullError{Threshold: 70, Metadata: true},
+			info:     func(t *testing.T) PoolInfo { return mustPoolInfo(t, 800, 1000, 100, 1000) },
+			wantOpen: true,
+		},
+		{
+			name:    "metadata back under threshold",
+			tripped: PoolFullError{Threshold: 70, Metadata: true},
+			info:    func(t *testing.T) PoolInfo { return mustPoolInfo(t, 500, 1000, 900, 1000) },
+		},
+		{
+			name:    "read-only pool",
+			tripped: PoolFullError{Threshold: 70},
+			info: func(t *testing.T) PoolInfo {
+				info := mustPoolInfo(t, 100, 1000, 100, 1000)
+				info.ReadOnly = true
+				return info
+			},
+			wantOpen: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := newTestBreaker(time.Minute)
+			b.Trip(&tt.tripped)
+			b.Observe(tt.info(t))
+			if open := b.Allow() != nil; open != tt.wantOpen {
+				t.Errorf("open = %v, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestPoolBreaker_ResetWakesWait(t *testing.T) {
+	b := NewPoolBreaker(time.Hour)
+	b.Trip(&PoolFullError{Threshold: 70})
+
+	done := make(chan error, 1)
+	go func() { done <- b.Wait(context.Background()) }()
+	b.Reset()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Wait() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() still blocked after Reset")
+	}
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow() after Reset = %v, want nil", err)
+	}
+
+	// Wait on an open breaker gives up with its context
+	b.Trip(&PoolFullError{Threshold: 70})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Wait(ctx); err != context.Canceled {
+		t.Errorf("Wait() with a cancelled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestPoolBreaker_Jitter(t *testing.T) {
+	b := NewPoolBreaker(10 * time.Second)
+	for range 50 {
+		b.Trip(&PoolFullError{Threshold: 70})
+		if got := b.Remaining(); got > 12*time.Second || got < 9*time.Second {
+			t.Fatalf("Remaining() = %v, want 10s plus at most 20%%", got)
+		}
+	}
+
+	var nilBreaker *PoolBreaker
+	nilBreaker.Trip(&PoolFullError{})
+	if err := nilBreaker.Allow(); err != nil || nilBreaker.Wait(context.Background()) != nil {
+		t.Error("nil breaker refused an operation")
+	}
+}
+
+func TestCheckPoolCapacity_Breaker(t *testing.T) {
+	r := fakeExec(t)
+	r.outputs["dmsetup status"] = poolStatusLine(100, 1000, 800, 1000)
+
+	c := newTestClient(t)
+	b, clock := newTestBreaker(30 * time.Second)
+	c.SetPoolBreaker(b)
+
+	if _, err := c.CheckPoolCapacity(context.Background(), "pool", 0); !IsPoolFullError(err) {
+		t.Fatalf("first check = %v, want PoolFullError", err)
+	}
+	calls := len(r.calls)
+
+	// While the breaker is open the pool is not queried again
+	for range 3 {
+		if _, err := c.CheckPoolCapacity(context.Background(), "pool", 0); !IsPoolFullError(err) {
+			t.Fatalf("check while open = %v, want PoolFullError", err)
+		}
+	}
+	if len(r.calls) != calls {
+		t.Errorf("ran %d more commands while the breaker was open, want 0", len(r.calls)-calls)
+	}
+
+	// After the cool-down the pool is checked again and has room
+	clock.t = clock.t.Add(31 * time.Second)
+	r.outputs["dmsetup status"] = poolStatusLine(100, 1000, 300, 1000)
+	if _, err := c.CheckPoolCapacity(context.Background(), "pool", 0); err != nil {
+		t.Fatalf("check after the cool-down = %v, want nil", err)
+	}
+
+	// A status read elsewhere (e.g. metrics) showing space closes it early
+	r.outputs["dmsetup status"] = poolStatusLine(100, 1000, 800, 1000)
+	if _, err := c.CheckPoolCapacity(context.Background(), "pool", 0); !IsPoolFullError(err) {
+		t.Fatalf("check on a full pool = %v, want PoolFullError", err)
+	}
+	r.outputs["dmsetup status"] = poolStatusLine(100, 1000, 300, 1000)
+	if _, err := c.ParsePoolStatus(context.Background(), "pool"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow() after a pool status under the threshold = %v, want nil", err)
+	}
+}
+
+func TestWaitForPoolSpace(t *testing.T) {
+	r := fakeExec(t)
+	c := newTestClient(t)
+	b, _ := newTestBreaker(time.Hour)
+	c.SetPoolBreaker(b)
+	b.Trip(&PoolFullError{Threshold: 70})
+
+	// Space freed by another process is only seen by polling the pool
+	r.outputs["dmsetup status"] = poolStatusLine(100, 1000, 800, 1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WaitForPoolSpace(ctx, "pool", 10*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("WaitForPoolSpace() on a full pool = %v, want the context deadline", err)
+	}
+	if findCommand(r.calls, "dmsetup") == nil {
+		t.Error("WaitForPoolSpace() never read the pool status")
+	}
+
+	r.outputs["dmsetup status"] = poolStatusLine(100, 1000, 300, 1000)
+	if err := c.WaitForPoolSpace(context.Background(), "pool", 10*time.Millisecond); err != nil {
+		t.Fatalf("WaitForPoolSpace() = %v, want nil once the pool has room", err)
+	}
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow() after WaitForPoolSpace = %v, want nil", err)
+	}
+}
@@ -0,0 +1,1320 @@
+// dm_test.go - Development tests for devicemapper package.
+//
+// Unit tests for pool capacity evaluation and device creation. These tests never
+// invoke dmsetup or mkfs; external commands are captured via execCommandContext.
+
+package devicemapper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	c := New()
+	c.SuppressLogs()
+	return c
+}
+
+func TestSetCapacityThreshold_Validation(t *testing.T) {
+	c := newTestClient(t)
+
+	if got := c.CapacityThreshold(); got != PoolCapacityThreshold {
+		t.Fatalf("default threshold = %.1f, want %.1f", got, PoolCapacityThreshold)
+	}
+
+	for _, bad := range []float64{0, 0.5, 99.5, 100, -10} {
+		if err := c.SetCapacityThreshold(bad); err == nil {
+			t.Errorf("SetCapacityThreshold(%.1f) succeeded, want error", bad)
+		}
+	}
+	if got := c.CapacityThreshold(); got != PoolCapacityThreshold {
+		t.Fatalf("threshold changed after rejected values: %.1f", got)
+	}
+
+	for _, good := range []float64{1, 90, 99} {
+		if err := c.SetCapacityThreshold(good); err != nil {
+			t.Errorf("SetCapacityThreshold(%.1f) = %v, want nil", good, err)
+		}
+	}
+}
+
+func TestEvaluatePoolCapacity_ThresholdBoundary(t *testing.T) {
+	c := newTestClient(t)
+	if err := c.SetCapacityThreshold(90); err != nil {
+		t.Fatalf("SetCapacityThreshold: %v", err)
+	}
+
+	// 80% full pool is accepted at a 90% threshold (rejected at the 70% default).
+	info := &PoolInfo{Name: "pool", UsedDataBlocks: 800, TotalDataBlocks: 1000}
+	if err := c.evaluatePoolCapacity(c.logger, "pool", info, 0); err != nil {
+		t.Fatalf("80%% usage at 90%% threshold: unexpected error %v", err)
+	}
+
+	// Just below the boundary is accepted.
+	info.UsedDataBlocks = 899
+	if err := c.evaluatePoolCapacity(c.logger, "pool", info, 0); err != nil {
+		t.Fatalf("89.9%% usage at 90%% threshold: unexpected error %v", err)
+	}
+
+	// Exactly at the boundary is rejected.
+	info.UsedDataBlocks = 900
+	err := c.evaluatePoolCapacity(c.logger, "pool", info, 4096)
+	if !IsPoolFullError(err) {
+		t.Fatalf("90%% usage at 90%% threshold: got %v, want PoolFullError", err)
+	}
+	pfe := err.(*PoolFullError)
+	if pfe.Threshold != 90 || pfe.FreeBlocks != 100 || pfe.RequiredBytes != 4096 {
+		t.Fatalf("unexpected PoolFullError fields: %+v", pfe)
+	}
+}
+
+func TestEvaluatePoolCapacity_DefaultThresholdRejects(t *testing.T) {
+	c := newTestClient(t)
+
+	info := &PoolInfo{Name: "pool", UsedDataBlocks: 800, TotalDataBlocks: 1000}
+	if err := c.evaluatePoolCapacity(c.logger, "pool", info, 0); !IsPoolFullError(err) {
+		t.Fatalf("80%% usage at default threshold: got %v, want PoolFullError", err)
+	}
+}
+
+// poolStatusLine builds a synthetic `dmsetup status` line for a thin-pool.
+func poolStatusLine(usedMeta, totalMeta, usedData, totalData int) string {
+	return fmt.Sprintf("0 4194304 thin-pool 7 %d/%d %d/%d - rw discard_passdown queue_if_no_space - 1024",
+		usedMeta, totalMeta, usedData, totalData)
+}
+
+func TestParsePoolStatusOutput(t *testing.T) {
+	info, err := ParsePoolStatusOutput("pool", poolStatusLine(120, 1024, 4000, 16384))
+	if err != nil {
+		t.Fatalf("ParsePoolStatusOutput: %v", err)
+	}
+	if info.TransactionID != 7 || info.UsedMetaBlocks != 120 || info.TotalMetaBlocks != 1024 ||
+		info.UsedDataBlocks != 4000 || info.TotalDataBlocks != 16384 {
+		t.Fatalf("unexpected pool info: %+v", info)
+	}
+	if info.DataBlockSize != 256 || info.FreeDataBytes() != (16384-4000)*128<<10 {
+		t.Errorf("DataBlockSize = %d, FreeDataBytes = %d, want 256 sectors and %d bytes", info.DataBlockSize, info.FreeDataBytes(), (16384-4000)*128<<10)
+	}
+
+	if _, err := ParsePoolStatusOutput("pool", "0 4194304 thin-pool"); err == nil {
+		t.Fatal("expected error for truncated status line")
+	}
+}
+
+func TestParsePoolStatusOutput_Flags(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		mode        string
+		noSpace     string
+		readOnly    bool
+		outOfSpace  bool
+		needsCheck  bool
+		failed      bool
+		wantHealthy bool
+	}{
+		{
+			name:        "healthy",
+			status:      "0 4194304 thin-pool 7 120/1024 4000/16384 - rw discard_passdown queue_if_no_space - 1024",
+			mode:        "rw",
+			noSpace:     "queue_if_no_space",
+			wantHealthy: true,
+		},
+		{
+			name:       "read-only with needs_check",
+			status:     "0 4194304 thin-pool 9 1024/1024 4000/16384 - ro no_discard_passdown queue_if_no_space needs_check 1024",
+			mode:       "ro",
+			noSpace:    "queue_if_no_space",
+			readOnly:   true,
+			needsCheck: true,
+		},
+		{
+			name:       "out of data space",
+			status:     "0 4194304 thin-pool 12 300/1024 16384/16384 - out_of_data_space discard_passdown error_if_no_space - 1024",
+			mode:       "out_of_data_space",
+			noSpace:    "error_if_no_space",
+			outOfSpace: true,
+		},
+		{
+			name:       "needs_check while rw",
+			status:     "0 4194304 thin-pool 3 120/1024 10/16384 - rw discard_passdown queue_if_no_space needs_check 1024",
+			mode:       "rw",
+			noSpace:    "queue_if_no_space",
+			needsCheck: true,
+		},
+		{
+			name:        "older kernel without trailing fields",
+			status:      "0 4194304 thin-pool 7 120/1024 4000/16384 - rw discard_passdown",
+			mode:        "rw",
+			wantHealthy: true,
+		},
+		{
+			name:   "failed pool",
+			status: "0 4194304 thin-pool Fail",
+			mode:   "Fail",
+			failed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParsePoolStatusOutput("pool", tt.status)
+			if err != nil {
+				t.Fatalf("ParsePoolStatusOutput: %v", err)
+			}
+			if info.MetadataMode != tt.mode || info.NoSpaceMode != tt.noSpace {
+				t.Errorf("mode = %q/%q, want %q/%q", info.MetadataMode, info.NoSpaceMode, tt.mode, tt.noSpace)
+			}
+			if info.ReadOnly != tt.readOnly || info.OutOfDataSpace != tt.outOfSpace ||
+				info.NeedsCheck != tt.needsCheck || info.Failed != tt.failed {
+				t.Errorf("flags = %+v", info)
+			}
+			if got := info.Healthy(); got != tt.wantHealthy {
+				t.Errorf("Healthy() = %v, want %v", got, tt.wantHealthy)
+			}
+		})
+	}
+}
+
+func TestEvaluatePoolCapacity_RefusesUnhealthyPool(t *testing.T) {
+	c := newTestClient(t)
+
+	// Usage is well under both thresholds; only the pool state should matter.
+	for _, status := range []string{
+		"0 4194304 thin-pool 9 10/1024 10/16384 - ro no_discard_passdown queue_if_no_space - 1024",
+		"0 4194304 thin-pool 9 10/1024 10/16384 - rw discard_passdown queue_if_no_space needs_check 1024",
+		"0 4194304 thin-pool Fail",
+	} {
+		info, err := ParsePoolStatusOutput("pool", status)
+		if err != nil {
+			t.Fatalf("ParsePoolStatusOutput(%q): %v", status, err)
+		}
+		err = c.evaluatePoolCapacity(c.logger, "pool", info, 0)
+		if !IsPoolUnhealthyError(err) {
+			t.Errorf("%q: got %v, want PoolUnhealthyError", status, err)
+		}
+	}
+}
+
+func TestCheckPoolCapacity_ReadOnlyPool(t *testing.T) {
+	r := fakeExec(t)
+	r.outputs["dmsetup status"] = "0 4194304 thin-pool 9 10/1024 10/16384 - ro no_discard_passdown queue_if_no_space needs_check 1024"
+	c := newTestClient(t)
+
+	_, err := c.CheckPoolCapacity(context.Background(), "pool", 0)
+	if !IsPoolUnhealthyError(err) {
+		t.Fatalf("CheckPoolCapacity = %v, want PoolUnhealthyError", err)
+	}
+	if !strings.Contains(err.Error(), "needs_check") {
+		t.Errorf("error %q should mention needs_check", err)
+	}
+}
+
+func TestPoolInfoUsagePercent(t *testing.T) {
+	info := &PoolInfo{UsedDataBlocks: 250, TotalDataBlocks: 1000, UsedMetaBlocks: 3, TotalMetaBlocks: 4}
+	if got := info.DataUsagePercent(); got != 25 {
+		t.Errorf("DataUsagePercent() = %v, want 25", got)
+	}
+	if got := info.MetaUsagePercent(); got != 75 {
+		t.Errorf("MetaUsagePercent() = %v, want 75", got)
+	}
+
+	empty := &PoolInfo{}
+	if empty.DataUsagePercent() != 0 || empty.MetaUsagePercent() != 0 {
+		t.Error("usage of a pool with no blocks should be 0")
+	}
+}
+
+func TestParseThinStatusOutput(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      string
+		wantMapped  int64
+		wantHighest int64
+	}{
+		{"snapshot with cow data", "0 20971520 thin 1048576 20971519\n", 1048576, 20971519},
+		{"fresh device", "0 20971520 thin 0 -\n", 0, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := parseThinStatusOutput("snap-1", tt.output)
+			if err != nil {
+				t.Fatalf("parseThinStatusOutput: %v", err)
+			}
+			if status.MappedSectors != tt.wantMapped || status.HighestMappedSector != tt.wantHighest {
+				t.Fatalf("unexpected status: %+v", status)
+			}
+			if status.MappedBytes() != tt.wantMapped*512 {
+				t.Fatalf("MappedBytes = %d, want %d", status.MappedBytes(), tt.wantMapped*512)
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"0 20971520 thin Fail",
+		poolStatusLine(120, 1024, 4000, 16384),
+		"0 20971520 thin 1048576",
+		"0 20971520 thin abc 10",
+	} {
+		if _, err := parseThinStatusOutput("snap-1", bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestParseThinStatusList(t *testing.T) {
+	output := "snap-1: 0 20971520 thin 1048576 20971519\n" +
+		"img-2: 0 20971520 thin 0 -\n" +
+		"snap-failed: 0 20971520 thin Fail\n"
+	statuses := parseThinStatusList(output)
+	if len(statuses) != 2 {
+		t.Fatalf("got %d statuses, want 2: %+v", len(statuses), statuses)
+	}
+	if s := statuses["snap-1"]; s == nil || s.Name != "snap-1" || s.MappedSectors != 1048576 {
+		t.Errorf("snap-1 = %+v", s)
+	}
+	if s := statuses["img-2"]; s == nil || s.MappedSectors != 0 || s.HighestMappedSector != -1 {
+		t.Errorf("img-2 = %+v", s)
+	}
+
+	if statuses := parseThinStatusList("No devices found\n"); len(statuses) != 0 {
+		t.Errorf("expected no statuses, got %+v", statuses)
+	}
+}
+
+func TestEvaluatePoolCapacity_DataFull(t *testing.T) {
+	c := newTestClient(t)
+
+	info, err := ParsePoolStatusOutput("pool", poolStatusLine(100, 1000, 750, 1000))
+	if err != nil {
+		t.Fatalf("ParsePoolStatusOutput: %v", err)
+	}
+
+	err = c.evaluatePoolCapacity(c.logger, "pool", info, 0)
+	if !IsPoolFullError(err) {
+		t.Fatalf("got %v, want PoolFullError", err)
+	}
+	if pfe := err.(*PoolFullError); pfe.Metadata {
+		t.Fatalf("expected data exhaustion, got metadata: %v", pfe)
+	}
+}
+
+func TestEvaluatePoolCapacity_MetadataFull(t *testing.T) {
+	c := newTestClient(t)
+
+	// Data at 40% but metadata at 80% - must still be refused.
+	info, err := ParsePoolStatusOutput("pool", poolStatusLine(800, 1000, 400, 1000))
+	if err != nil {
+		t.Fatalf("ParsePoolStatusOutput: %v", err)
+	}
+
+	err = c.evaluatePoolCapacity(c.logger, "pool", info, 0)
+	if !IsPoolFullError(err) {
+		t.Fatalf("got %v, want PoolFullError", err)
+	}
+	pfe := err.(*PoolFullError)
+	if !pfe.Metadata || pfe.UsedMetaBlocks != 800 || pfe.TotalMetaBlocks != 1000 {
+		t.Fatalf("unexpected PoolFullError fields: %+v", pfe)
+	}
+	if !strings.Contains(pfe.Error(), "metadata") || !strings.Contains(pfe.Error(), "800/1000") {
+		t.Fatalf("error message missing metadata usage: %s", pfe.Error())
+	}
+
+	// Raising the metadata threshold lets the same pool through.
+	if err := c.SetMetadataCapacityThreshold(90); err != nil {
+		t.Fatalf("SetMetadataCapacityThreshold: %v", err)
+	}
+	if err := c.evaluatePoolCapacity(c.logger, "pool", info, 0); err != nil {
+		t.Fatalf("80%% metadata at 90%% threshold: unexpected error %v", err)
+	}
+}
+
+// recordedCommand is a single external command captured by fakeExec.
+type recordedCommand struct {
+	name string
+	args []string
+}
+
+// fakeRunner captures commands issued through execCommandContext.
+// Commands are keyed by "<name> <first arg>" (e.g. "dmsetup table") for scripting.
+type fakeRunner struct {
+	calls     []recordedCommand
+	outputs   map[string]string // key -> stdout of a successful run
+	failures  map[string]bool   // key -> command exits non-zero
+	exitCodes map[string]int    // key -> command exits with this status
+}
+
+// fakeExec replaces execCommandContext for the duration of a test. Every command
+// is recorded; unscripted commands succeed with empty output.
+func fakeExec(t *testing.T) *fakeRunner {
+	t.Helper()
+	r := &fakeRunner{outputs: map[string]string{}, failures: map[string]bool{}, exitCodes: map[string]int{}}
+	orig := execCommandContext
+	execCommandContext = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		r.calls = append(r.calls, recordedCommand{name: name, args: args})
+		key := name
+		if len(args) > 0 {
+			key += " " + args[0]
+		}
+		if code, ok := r.exitCodes[key]; ok {
+			return exec.CommandContext(ctx, "sh", "-c", fmt.Sprintf("exit %d", code))
+		}
+		if r.failures[key] {
+			return exec.CommandContext(ctx, "false")
+		}
+		if out, ok := r.outputs[key]; ok {
+			return exec.CommandContext(ctx, "printf", "%s", out)
+		}
+		return exec.CommandContext(ctx, "true")
+	}
+	t.Cleanup(func() { execCommandContext = orig })
+	return r
+}
+
+// sequence returns the recorded commands as "<name> <first arg>" strings.
+func (r *fakeRunner) sequence() []string {
+	seq := make([]string, 0, len(r.calls))
+	for _, c := range r.calls {
+		key := c.name
+		if len(c.args) > 0 {
+			key += " " + c.args[0]
+		}
+		seq = append(seq, key)
+	}
+	return seq
+}
+
+// findCommand returns the first recorded invocation of name, or nil.
+func findCommand(calls []recordedCommand, name string) *recordedCommand {
+	for i := range calls {
+		if calls[i].name == name {
+			return &calls[i]
+		}
+	}
+	return nil
+}
+
+func TestCreateThinDeviceWithOpts_MkfsPerFilesystem(t *testing.T) {
+	tests := []struct {
+		fs       Filesystem
+		wantBin  string
+		wantArgs []string
+		skipBin  string
+	}{
+		{FilesystemExt4, "mkfs.ext4", []string{"-F", "-O", "^has_journal", "/dev/mapper/thin-42"}, "mkfs.xfs"},
+		{FilesystemXFS, "mkfs.xfs", []string{"-f", "/dev/mapper/thin-42"}, "mkfs.ext4"},
+		{"", "mkfs.ext4", []string{"-F", "-O", "^has_journal", "/dev/mapper/thin-42"}, "mkfs.xfs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.fs), func(t *testing.T) {
+			r := fakeExec(t)
+			c := newTestClient(t)
+
+			info, err := c.CreateThinDeviceWithOpts(context.Background(), "pool", "42", 1<<30, CreateThinDeviceOpts{Filesystem: tt.fs})
+			if err != nil {
+				t.Fatalf("CreateThinDeviceWithOpts: %v", err)
+			}
+			if info.DevicePath != "/dev/mapper/thin-42" {
+				t.Fatalf("unexpected device path %q", info.DevicePath)
+			}
+
+			mkfs := findCommand(r.calls, tt.wantBin)
+			if mkfs == nil {
+				t.Fatalf("%s was not invoked; calls: %v", tt.wantBin, r.sequence())
+			}
+			if strings.Join(mkfs.args, " ") != strings.Join(tt.wantArgs, " ") {
+				t.Fatalf("%s args = %v, want %v", tt.wantBin, mkfs.args, tt.wantArgs)
+			}
+			if findCommand(r.calls, tt.skipBin) != nil {
+				t.Fatalf("%s should not be invoked for %q", tt.skipBin, tt.fs)
+			}
+		})
+	}
+}
+
+func TestCreateThinDeviceWithOpts_Journal(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     CreateThinDeviceOpts
+		wantBin  string
+		wantArgs string
+	}{
+		{"ext4 default", CreateThinDeviceOpts{Filesystem: FilesystemExt4}, "mkfs.ext4", "-F -O ^has_journal /dev/mapper/thin-42"},
+		{"ext4 journal", CreateThinDeviceOpts{Filesystem: FilesystemExt4, EnableJournal: true}, "mkfs.ext4", "-F /dev/mapper/thin-42"},
+		{"xfs ignores journal", CreateThinDeviceOpts{Filesystem: FilesystemXFS, EnableJournal: true}, "mkfs.xfs", "-f /dev/mapper/thin-42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			c := newTestClient(t)
+
+			if _, err := c.CreateThinDeviceWithOpts(context.Background(), "pool", "42", 1<<30, tt.opts); err != nil {
+				t.Fatalf("CreateThinDeviceWithOpts: %v", err)
+			}
+			mkfs := findCommand(r.calls, tt.wantBin)
+			if mkfs == nil {
+				t.Fatalf("%s was not invoked; calls: %v", tt.wantBin, r.sequence())
+			}
+			if got := strings.Join(mkfs.args, " "); got != tt.wantArgs {
+				t.Fatalf("%s args = %q, want %q", tt.wantBin, got, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestCreateThinDeviceWithOpts_RejectsUnknownFilesystem(t *testing.T) {
+	r := fakeExec(t)
+	c := newTestClient(t)
+
+	_, err := c.CreateThinDeviceWithOpts(context.Background(), "pool", "42", 1<<30, CreateThinDeviceOpts{Filesystem: "btrfs"})
+	if err == nil {
+		t.Fatal("expected error for unsupported filesystem")
+	}
+	if len(r.calls) != 0 {
+		t.Fatalf("no commands should run for invalid options, got %v", r.sequence())
+	}
+}
+
+func TestCreateThinDevice_MaxDeviceSize(t *testing.T) {
+	const size150GB = 150 * 1024 * 1024 * 1024
+	ctx := context.Background()
+
+	r := fakeExec(t)
+	c := newTestClient(t)
+	if got := c.MaxDeviceSize(); got != DefaultMaxDeviceSize {
+		t.Fatalf("default MaxDeviceSize = %d, want %d", got, DefaultMaxDeviceSize)
+	}
+
+	if _, err := c.CreateThinDevice(ctx, "pool", "42", size150GB); err == nil || !strings.Contains(err.Error(), "size too large") {
+		t.Fatalf("150GB at default limit: got %v, want size too large", err)
+	}
+	if len(r.calls) != 0 {
+		t.Fatalf("rejected device ran commands: %v", r.sequence())
+	}
+
+	if err := c.SetMaxDeviceSize(200 * 1024 * 1024 * 1024); err != nil {
+		t.Fatalf("SetMaxDeviceSize: %v", err)
+	}
+	info, err := c.CreateThinDevice(ctx, "pool", "42", size150GB)
+	if err != nil {
+		t.Fatalf("150GB after raising limit: %v", err)
+	}
+	if info.SizeBytes != size150GB {
+		t.Fatalf("SizeBytes = %d, want %d", info.SizeBytes, int64(size150GB))
+	}
+
+	// Positive-size validation is independent of the limit.
+	if _, err := c.CreateThinDevice(ctx, "pool", "42", 0); err == nil {
+		t.Fatal("expected error for zero size")
+	}
+	for _, bad := range []int64{0, -1} {
+		if err := c.SetMaxDeviceSize(bad); err == nil {
+			t.Errorf("SetMaxDeviceSize(%d): expected error", bad)
+		}
+	}
+}
+
+// fakeMounts points procMountsPath at a temporary mount table for the test.
+func fakeMounts(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mounts")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write mounts: %v", err)
+	}
+	orig := procMountsPath
+	procMountsPath = path
+	t.Cleanup(func() { procMountsPath = orig })
+}
+
+// TestFindMount_ResolvesDMNode verifies that a device listed in the mount
+// table by its /dev/dm-N node is found through its /dev/mapper symlink.
+func TestFindMount_ResolvesDMNode(t *testing.T) {
+	dir := t.TempDir()
+	node := filepath.Join(dir, "dm-3")
+	if err := os.WriteFile(node, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "thin-42")
+	if err := os.Symlink(node, link); err != nil {
+		t.Fatal(err)
+	}
+	fakeMounts(t, node+" /mnt/flyio/thin-42 ext4 rw 0 0\n")
+
+	mountPoint, fsType, err := findMount(link)
+	if err != nil {
+		t.Fatalf("findMount() error = %v", err)
+	}
+	if mountPoint != "/mnt/flyio/thin-42" || fsType != "ext4" {
+		t.Errorf("findMount() = %q, %q; want /mnt/flyio/thin-42, ext4", mountPoint, fsType)
+	}
+}
+
+// roomyPoolStatus is a 20GiB pool of 128KiB blocks with about 19.5GiB free.
+const roomyPoolStatus = "0 41943040 thin-pool 7 120/1024 4000/163840 - rw discard_passdown queue_if_no_space - 1024"
+
+func TestResizeThinDevice_SuspendReloadResumeOrder(t *testing.T) {
+	tests := []struct {
+		fsType   string
+		growCmd  string
+		growArgs string
+	}{
+		{"ext4", "resize2fs", "/dev/mapper/thin-42"},
+		{"xfs", "xfs_growfs", "/mnt/flyio/thin-42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fsType, func(t *testing.T) {
+			r := fakeExec(t)
+			r.outputs["dmsetup table"] = "0 8388608 thin 253:0 42\n"
+			r.outputs["dmsetup status"] = roomyPoolStatus
+			fakeMounts(t, "/dev/mapper/thin-42 /mnt/flyio/thin-42 "+tt.fsType+" rw,noatime 0 0\n")
+			c := newTestClient(t)
+
+			if err := c.ResizeThinDevice(context.Background(), "pool", "thin-42", "42", 8<<30); err != nil {
+				t.Fatalf("ResizeThinDevice: %v", err)
+			}
+
+			want := []string{"dmsetup table", "dmsetup status", "dmsetup suspend", "dmsetup reload", "dmsetup resume", tt.growCmd + " " + tt.growArgs}
+			if got := r.sequence(); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("command sequence = %v, want %v", got, want)
+			}
+
+			reload := r.calls[3]
+			if table := reload.args[len(reload.args)-1]; table != "0 16777216 thin 253:0 42" {
+				t.Fatalf("reload table = %q", table)
+			}
+		})
+	}
+}
+
+func TestResizeThinDevice_ResumesAfterFailedReload(t *testing.T) {
+	r := fakeExec(t)
+	r.outputs["dmsetup table"] = "0 8388608 thin 253:0 42"
+	r.outputs["dmsetup status"] = roomyPoolStatus
+	r.failures["dmsetup reload"] = true
+	fakeMounts(t, "/dev/mapper/thin-42 /mnt/flyio/thin-42 ext4 rw 0 0\n")
+	c := newTestClient(t)
+
+	if err := c.ResizeThinDevice(context.Background(), "pool", "thin-42", "42", 8<<30); err == nil {
+		t.Fatal("expected error when reload fails")
+	}
+
+	want := []string{"dmsetup table", "dmsetup status", "dmsetup suspend", "dmsetup reload", "dmsetup resume"}
+	if got := r.sequence(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("command sequence = %v, want %v", got, want)
+	}
+}
+
+func TestResizeThinDevice_RecordsOperation(t *testing.T) {
+	for _, failReload := range []bool{false, true} {
+		t.Run(fmt.Sprintf("failReload=%v", failReload), func(t *testing.T) {
+			r := fakeExec(t)
+			r.outputs["dmsetup table"] = "0 8388608 thin 253:0 42"
+			r.outputs["dmsetup status"] = roomyPoolStatus
+			r.failures["dmsetup reload"] = failReload
+			fakeMounts(t, "/dev/mapper/thin-42 /mnt/flyio/thin-42 ext4 rw 0 0\n")
+			c := newTestClient(t)
+			rec := &fakeRecorder{c: c}
+			c.SetOperationRecorder(rec)
+
+			err := c.ResizeThinDevice(context.Background(), "pool", "thin-42", "42", 8<<30)
+			if (err != nil) != failReload {
+				t.Fatalf("ResizeThinDevice() error = %v, want failure %v", err, failReload)
+			}
+			if len(rec.ops) != 1 {
+				t.Fatalf("recorded %d operations, want 1", len(rec.ops))
+			}
+			op := rec.ops[0]
+			if op.Op != OpResize || op.DeviceName != "thin-42" || op.DeviceID != "42" || op.OldSectors != 8388608 || op.NewSectors != 16777216 {
+				t.Errorf("recorded %+v, want resize of thin-42 (42) from 8388608 to 16777216 sectors", op)
+			}
+			if op.Err != err {
+				t.Errorf("recorded error %v, want %v", op.Err, err)
+			}
+			if rec.heldLockCalls != 0 {
+				t.Errorf("recorder called %d times with the client's lock held", rec.heldLockCalls)
+			}
+		})
+	}
+
+	// A device already at the requested size is not resized or recorded
+	r := fakeExec(t)
+	r.outputs["dmsetup table"] = "0 8388608 thin 253:0 42"
+	c := newTestClient(t)
+	rec := &fakeRecorder{c: c}
+	c.SetOperationRecorder(rec)
+	if err := c.ResizeThinDevice(context.Background(), "pool", "thin-42", "42", 4<<30); err != nil {
+		t.Fatalf("same-size resize: %v", err)
+	}
+	if rec.started != 0 {
+		t.Errorf("same-size resize recorded %d operations", rec.started)
+	}
+}
+
+func TestResizeThinDevice_NoopAndLimits(t *testing.T) {
+	r := fakeExec(t)
+	r.outputs["dmsetup table"] = "0 8388608 thin 253:0 42"
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	// Same size: nothing beyond the table read.
+	if err := c.ResizeThinDevice(ctx, "pool", "thin-42", "42", 4<<30); err != nil {
+		t.Fatalf("same-size resize: %v", err)
+	}
+	if got := r.sequence(); len(got) != 1 {
+		t.Fatalf("same-size resize ran %v", got)
+	}
+
+	if err := c.ResizeThinDevice(ctx, "pool", "thin-42", "42", DefaultMaxDeviceSize+1); err == nil {
+		t.Fatal("expected error above the max device size")
+	}
+
+	// Not mounted: refuse before suspending.
+	fakeMounts(t, "")
+	r.calls = nil
+	if err := c.ResizeThinDevice(ctx, "pool", "thin-42", "42", 8<<30); err == nil {
+		t.Fatal("expected error for unmounted device")
+	}
+	if len(r.calls) != 1 {
+		t.Fatalf("unmounted resize should only read the table, ran %v", r.sequence())
+	}
+}
+
+// TestResizeThinDevice_PoolTooSmall verifies that growing a device by more
+// than the pool's free data space is refused before the device is suspended.
+func TestResizeThinDevice_PoolTooSmall(t *testing.T) {
+	r := fakeExec(t)
+	r.outputs["dmsetup table"] = "0 8388608 thin 253:0 42"
+	// 2GiB pool of 128KiB blocks, 24% used: about 1.5GiB free
+	r.outputs["dmsetup status"] = poolStatusLine(120, 1024, 4000, 16384)
+	fakeMounts(t, "/dev/mapper/thin-42 /mnt/flyio/thin-42 ext4 rw 0 0\n")
+	c := newTestClient(t)
+
+	err := c.ResizeThinDevice(context.Background(), "pool", "thin-42", "42", 8<<30)
+	poolFull, ok := err.(*PoolFullError)
+	if !ok {
+		t.Fatalf("ResizeThinDevice error = %v, want PoolFullError", err)
+	}
+	if poolFull.RequiredBytes != 4<<30 || poolFull.FreeBlocks != 16384-4000 {
+		t.Errorf("PoolFullError = %+v, want 4GiB required and %d free blocks", poolFull, 16384-4000)
+	}
+	want := []string{"dmsetup table", "dmsetup status"}
+	if got := r.sequence(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("command sequence = %v, want %v", got, want)
+	}
+}
+
+func TestActivateDeviceReadOnly(t *testing.T) {
+	r := fakeExec(t)
+	c := newTestClient(t)
+
+	if err := c.ActivateDevice(context.Background(), "pool", "thin-42", "42", 1<<30); err != nil {
+		t.Fatalf("ActivateDevice: %v", err)
+	}
+	if err := c.ActivateDeviceReadOnly(context.Background(), "pool", "thin-42", "42", 1<<30); err != nil {
+		t.Fatalf("ActivateDeviceReadOnly: %v", err)
+	}
+
+	if len(r.calls) != 2 {
+		t.Fatalf("expected 2 dmsetup create calls, got %v", r.sequence())
+	}
+	rw := strings.Join(r.calls[0].args, " ")
+	ro := strings.Join(r.calls[1].args, " ")
+	if strings.Contains(rw, "--readonly") {
+		t.Errorf("ActivateDevice args = %q, should not be read-only", rw)
+	}
+	if ro != "create thin-42 --table 0 2097152 thin /dev/mapper/pool 42 --readonly" {
+		t.Errorf("ActivateDeviceReadOnly args = %q", ro)
+	}
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	tests := []struct {
+		name      string
+		fsType    string
+		exitCode  int
+		wantBin   string
+		wantArgs  string
+		wantClean bool
+		wantErr   bool
+	}{
+		{name: "ext4 clean", fsType: "ext4", wantBin: "e2fsck", wantArgs: "-n -f /dev/mapper/thin-42", wantClean: true},
+		{name: "ext4 errors left uncorrected", fsType: "ext4", exitCode: 4, wantBin: "e2fsck"},
+		{name: "ext4 operational error", fsType: "ext4", exitCode: 8, wantBin: "e2fsck", wantErr: true},
+		{name: "xfs clean", fsType: "xfs", wantBin: "xfs_repair", wantArgs: "-n /dev/mapper/thin-42", wantClean: true},
+		{name: "xfs corruption", fsType: "xfs", exitCode: 1, wantBin: "xfs_repair"},
+		{name: "unsupported", fsType: "btrfs", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			c := newTestClient(t)
+			fakeMounts(t, "")
+			r.outputs["blkid -o"] = tt.fsType + "\n"
+			if tt.exitCode != 0 {
+				r.exitCodes[tt.wantBin+" -n"] = tt.exitCode
+			}
+
+			result, err := c.CheckFilesystem(context.Background(), "/dev/mapper/thin-42")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckFilesystem: %v", err)
+			}
+
+			if result.Clean != tt.wantClean || result.ExitCode != tt.exitCode || string(result.Filesystem) != tt.fsType {
+				t.Errorf("result = %+v, want clean=%v exit=%d fs=%s", result, tt.wantClean, tt.exitCode, tt.fsType)
+			}
+			cmd := findCommand(r.calls, tt.wantBin)
+			if cmd == nil {
+				t.Fatalf("%s was not invoked; calls: %v", tt.wantBin, r.sequence())
+			}
+			if tt.wantArgs != "" && strings.Join(cmd.args, " ") != tt.wantArgs {
+				t.Errorf("%s args = %v, want %s", tt.wantBin, cmd.args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestCheckFilesystem_Mounted(t *testing.T) {
+	r := fakeExec(t)
+	c := newTestClient(t)
+	fakeMounts(t, "/dev/mapper/thin-42 /mnt/thin-42 ext4 rw,relatime 0 0\n")
+	r.outputs["blkid -o"] = "ext4\n"
+
+	_, err := c.CheckFilesystem(context.Background(), "/dev/mapper/thin-42")
+	mounted, ok := err.(*DeviceMountedError)
+	if !ok || mounted.MountPoint != "/mnt/thin-42" {
+		t.Fatalf("CheckFilesystem() error = %v, want a DeviceMountedError for /mnt/thin-42", err)
+	}
+	if len(r.calls) != 0 {
+		t.Errorf("nothing should run against a mounted device; calls: %v", r.sequence())
+	}
+}
+
+func TestCheckFilesystem_BlkidFailure(t *testing.T) {
+	r := fakeExec(t)
+	c := newTestClient(t)
+	fakeMounts(t, "")
+	r.failures["blkid -o"] = true
+
+	if _, err := c.CheckFilesystem(context.Background(), "/dev/mapper/thin-42"); err == nil {
+		t.Fatal("expected error when the filesystem cannot be detected")
+	}
+	if findCommand(r.calls, "e2fsck") != nil || findCommand(r.calls, "xfs_repair") != nil {
+		t.Errorf("no checker should run without a detected filesystem; calls: %v", r.sequence())
+	}
+}
+
+func TestMountDeviceOptions(t *testing.T) {
+	dir := t.TempDir()
+	dev := filepath.Join(dir, "thin-42")
+	if err := os.WriteFile(dev, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		mount func(c *Client, devicePath, mountPoint string) error
+		want  string
+	}{
+		{"read-write", func(c *Client, d, m string) error { return c.MountDevice(context.Background(), d, m) }, "-o noatime,nodiratime"},
+		{"read-only", func(c *Client, d, m string) error { return c.MountDeviceRO(context.Background(), d, m) }, "-o ro,noatime"},
+		{"custom", func(c *Client, d, m string) error {
+			return c.MountDeviceWithOpts(context.Background(), d, m, "ro,discard,errors=remount-ro")
+		}, "-o ro,discard,errors=remount-ro"},
+		{"custom default", func(c *Client, d, m string) error { return c.MountDeviceWithOpts(context.Background(), d, m, "") }, "-o noatime,nodiratime"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			mountPoint := filepath.Join(dir, "mnt-"+tt.name)
+
+			if err := tt.mount(newTestClient(t), dev, mountPoint); err != nil {
+				t.Fatalf("mount: %v", err)
+			}
+			cmd := findCommand(r.calls, "mount")
+			if cmd == nil {
+				t.Fatalf("no mount command, ran %v", r.sequence())
+			}
+			if got, want := strings.Join(cmd.args, " "), tt.want+" "+dev+" "+mountPoint; got != want {
+				t.Errorf("mount args = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMountDeviceWithOpts_RejectsInjection(t *testing.T) {
+	dir := t.TempDir()
+	dev := filepath.Join(dir, "thin-42")
+	if err := os.WriteFile(dev, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []string{
+		"noatime;reboot",
+		"noatime && rm -rf /",
+		"noatime|cat",
+		"ro,$(id)",
+		"ro,`id`",
+		"ro noatime",
+		"ro,\nnoatime",
+		"-o,remount",
+		"ro,,noatime",
+		"errors='remount-ro'",
+		"uid=>0",
+	} {
+		t.Run(opts, func(t *testing.T) {
+			r := fakeExec(t)
+			err := newTestClient(t).MountDeviceWithOpts(context.Background(), dev, filepath.Join(dir, "mnt"), opts)
+			if err == nil {
+				t.Fatalf("MountDeviceWithOpts(%q) succeeded", opts)
+			}
+			if findCommand(r.calls, "mount") != nil {
+				t.Errorf("mount ran with rejected options %q", opts)
+			}
+		})
+	}
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	for _, opts := range []string{"noatime,nodiratime", "ro", "discard", "errors=remount-ro", "logbsize=256k,inode64", "context=system_u:object_r:tmp_t:s0"} {
+		if err := ValidateMountOptions(opts); err != nil {
+			t.Errorf("ValidateMountOptions(%q) = %v, want nil", opts, err)
+		}
+	}
+	if err := ValidateMountOptions(""); err == nil {
+		t.Error("ValidateMountOptions(\"\") succeeded")
+	}
+}
+
+// noSettle skips the pauses between SafeDeleteDevice steps for the test.
+func noSettle(t *testing.T) {
+	t.Helper()
+	orig := settle
+	settle = func(time.Duration) {}
+	t.Cleanup(func() { settle = orig })
+}
+
+func TestSafeDeleteDevice_Order(t *testing.T) {
+	r := fakeExec(t)
+	fakeMounts(t, "/dev/mapper/thin-7 /mnt/flyio/thin-7 ext4 rw 0 0\n")
+	noSettle(t)
+	c := newTestClient(t)
+
+	if err := c.SafeDeleteDevice(context.Background(), "pool", "thin-42", "42"); err != nil {
+		t.Fatalf("SafeDeleteDevice: %v", err)
+	}
+
+	want := []string{"dmsetup info", "dmsetup suspend", "dmsetup remove", "dmsetup message"}
+	if got := r.sequence(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("command sequence = %v, want %v", got, want)
+	}
+	if args := strings.Join(r.calls[1].args, " "); args != "suspend --nolockfs thin-42" {
+		t.Errorf("suspend args = %q", args)
+	}
+	if args := strings.Join(r.calls[2].args, " "); args != "remove --verifyudev thin-42" {
+		t.Errorf("remove args = %q", args)
+	}
+	if args := strings.Join(r.calls[3].args, " "); args != "message pool 0 delete 42" {
+		t.Errorf("message args = %q", args)
+	}
+}
+
+func TestSafeDeleteDevice_RefusesMounted(t *testing.T) {
+	r := fakeExec(t)
+	fakeMounts(t, "/dev/mapper/thin-42 /mnt/flyio/thin-42 ext4 rw 0 0\n")
+	noSettle(t)
+	c := newTestClient(t)
+
+	err := c.SafeDeleteDevice(context.Background(), "pool", "thin-42", "42")
+	if !IsDeviceMountedError(err) {
+		t.Fatalf("SafeDeleteDevice error = %v, want DeviceMountedError", err)
+	}
+	if !strings.Contains(err.Error(), "/mnt/flyio/thin-42") {
+		t.Errorf("error %q does not name the mount point", err)
+	}
+	if len(r.calls) != 0 {
+		t.Errorf("commands run for a mounted device: %v", r.sequence())
+	}
+}
+
+func TestSafeDeleteDevice_InactiveAndMetadataOnly(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		deviceName string
+		want       []string
+	}{
+		{name: "inactive", deviceName: "thin-42", want: []string{"dmsetup info", "dmsetup message"}},
+		{name: "metadata only", want: []string{"dmsetup message"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			r.exitCodes["dmsetup info"] = 1 // device not active
+			fakeMounts(t, "")
+			noSettle(t)
+			c := newTestClient(t)
+
+			if err := c.SafeDeleteDevice(context.Background(), "pool", tt.deviceName, "42"); err != nil {
+				t.Fatalf("SafeDeleteDevice: %v", err)
+			}
+			if got := r.sequence(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("command sequence = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafeDeleteDevice_RemoveFailureSkipsDelete(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		suspendFails bool
+		want         []string
+	}{
+		// A device left suspended would block its I/O in D state
+		{name: "suspended device is resumed", want: []string{"dmsetup info", "dmsetup suspend", "dmsetup remove", "dmsetup remove", "dmsetup resume"}},
+		{name: "unsuspended device is left alone", suspendFails: true, want: []string{"dmsetup info", "dmsetup suspend", "dmsetup remove", "dmsetup remove"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			r.failures["dmsetup remove"] = true
+			r.failures["dmsetup suspend"] = tt.suspendFails
+			fakeMounts(t, "")
+			noSettle(t)
+			c := newTestClient(t)
+
+			if err := c.SafeDeleteDevice(context.Background(), "pool", "thin-42", "42"); err == nil {
+				t.Fatal("expected error when the device cannot be removed")
+			}
+			if got := r.sequence(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("command sequence = %v, want %v (no delete after a failed remove)", got, tt.want)
+			}
+			if last := r.calls[len(r.calls)-1]; !tt.suspendFails && strings.Join(last.args, " ") != "resume thin-42" {
+				t.Errorf("resume args = %q", strings.Join(last.args, " "))
+			}
+		})
+	}
+}
+
+func TestDeactivateIdleDevice(t *testing.T) {
+	tests := []struct {
+		name     string
+		mounts   string
+		open     string
+		infoExit int // Non-zero for a device that is not active
+		wantBusy bool
+		want     []string
+	}{
+		{name: "idle", open: "0\n", want: []string{"dmsetup info", "dmsetup remove"}},
+		{name: "held open", open: "1\n", wantBusy: true, want: []string{"dmsetup info"}},
+		{name: "mounted", mounts: "/dev/mapper/snap-7 /mnt/vm ext4 rw 0 0\n", wantBusy: true},
+		{name: "not active", infoExit: 1, want: []string{"dmsetup info"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			r.outputs["dmsetup info"] = tt.open
+			if tt.infoExit != 0 {
+				r.exitCodes["dmsetup info"] = tt.infoExit
+			}
+			fakeMounts(t, tt.mounts)
+			c := newTestClient(t)
+
+			err := c.DeactivateIdleDevice(context.Background(), "snap-7")
+			if IsDeviceBusyError(err) != tt.wantBusy || (!tt.wantBusy && err != nil) {
+				t.Fatalf("DeactivateIdleDevice() error = %v, want busy %v", err, tt.wantBusy)
+			}
+			if got := r.sequence(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("command sequence = %v, want %v", got, tt.want)
+			}
+			for _, c := range r.calls {
+				if strings.Contains(strings.Join(c.args, " "), "--force") {
+					t.Errorf("ran dmsetup %v, want no --force", c.args)
+				}
+			}
+		})
+	}
+}
+
+func TestThinDeviceID(t *testing.T) {
+	r := fakeExec(t)
+	r.outputs["dmsetup table"] = "0 8388608 thin 253:0 42\n"
+	c := newTestClient(t)
+
+	id, err := c.ThinDeviceID(context.Background(), "thin-42")
+	if err != nil || id != "42" {
+		t.Fatalf("ThinDeviceID() = %q, %v; want 42", id, err)
+	}
+}
+
+// fakePoolDevices points devMapperDir and sysDevBlockDir at temporary
+// directories, with 7:0 linked to loop0 as for a loop-backed pool.
+func fakePoolDevices(t *testing.T) (mapperDir string) {
+	t.Helper()
+	mapperDir, sysDir := t.TempDir(), t.TempDir()
+	if err := os.Symlink("../../devices/virtual/block/loop0", filepath.Join(sysDir, "7:0")); err != nil {
+		t.Fatal(err)
+	}
+	origMapper, origSys := devMapperDir, sysDevBlockDir
+	devMapperDir, sysDevBlockDir = mapperDir, sysDir
+	t.Cleanup(func() { devMapperDir, sysDevBlockDir = origMapper, origSys })
+	return mapperDir
+}
+
+const loopPoolTable = "0 2097152 thin-pool 7:0 7:1 128 32768 1 skip_block_zeroing\n"
+
+func TestCheckPoolMetadata_Bracketing(t *testing.T) {
+	tests := []struct {
+		name      string
+		exitCode  int
+		wantClean bool
+	}{
+		{"clean", 0, true},
+		{"corrupt", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			fakePoolDevices(t)
+			r.outputs["dmsetup table"] = loopPoolTable
+			if tt.exitCode != 0 {
+				r.exitCodes["thin_check --metadata-snap"] = tt.exitCode
+			}
+
+			result, err := newTestClient(t).CheckPoolMetadata(context.Background(), "pool")
+			if err != nil {
+				t.Fatalf("CheckPoolMetadata: %v", err)
+			}
+			if result.Clean != tt.wantClean || result.ExitCode != tt.exitCode || result.MetadataDevice != "/dev/loop0" {
+				t.Errorf("result = %+v", result)
+			}
+
+			want := []string{"dmsetup table", "dmsetup message", "thin_check --metadata-snap", "dmsetup message"}
+			if got := r.sequence(); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("command sequence = %v, want %v", got, want)
+			}
+			if args := strings.Join(r.calls[1].args, " "); args != "message pool 0 reserve_metadata_snap" {
+				t.Errorf("reserve args = %q", args)
+			}
+			if args := strings.Join(r.calls[2].args, " "); args != "--metadata-snap /dev/loop0" {
+				t.Errorf("thin_check args = %q", args)
+			}
+			if args := strings.Join(r.calls[3].args, " "); args != "message pool 0 release_metadata_snap" {
+				t.Errorf("release args = %q", args)
+			}
+		})
+	}
+}
+
+func TestCheckPoolMetadata_LVMTmeta(t *testing.T) {
+	r := fakeExec(t)
+	mapperDir := fakePoolDevices(t)
+	tmeta := filepath.Join(mapperDir, "pool_tmeta")
+	if err := os.WriteFile(tmeta, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := newTestClient(t).CheckPoolMetadata(context.Background(), "pool")
+	if err != nil {
+		t.Fatalf("CheckPoolMetadata: %v", err)
+	}
+	if result.MetadataDevice != tmeta {
+		t.Errorf("metadata device = %q, want %q", result.MetadataDevice, tmeta)
+	}
+	want := []string{"dmsetup message", "thin_check --metadata-snap", "dmsetup message"}
+	if got := r.sequence(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("command sequence = %v, want %v (no pool table read)", got, want)
+	}
+}
+
+func TestCheckPoolMetadata_ReserveFails(t *testing.T) {
+	r := fakeExec(t)
+	fakePoolDevices(t)
+	r.outputs["dmsetup table"] = loopPoolTable
+	r.failures["dmsetup message"] = true
+
+	if _, err := newTestClient(t).CheckPoolMetadata(context.Background(), "pool"); err == nil {
+		t.Fatal("CheckPoolMetadata succeeded without a metadata snapshot")
+	}
+	if findCommand(r.calls, "thin_check") != nil {
+		t.Errorf("thin_check ran without a reserved snapshot; ran %v", r.sequence())
+	}
+	// Nothing was reserved, so nothing is released
+	if got := r.sequence(); len(got) != 2 {
+		t.Errorf("command sequence = %v, want only the table read and the reserve", got)
+	}
+}
+
+func TestCheckPoolMetadata_NotAPool(t *testing.T) {
+	r := fakeExec(t)
+	fakePoolDevices(t)
+	r.outputs["dmsetup table"] = "0 8388608 thin 253:0 42\n"
+
+	if _, err := newTestClient(t).CheckPoolMetadata(context.Background(), "thin-42"); err == nil {
+		t.Fatal("CheckPoolMetadata succeeded on a thin device")
+	}
+	if findCommand(r.calls, "thin_check") != nil {
+		t.Errorf("thin_check ran; ran %v", r.sequence())
+	}
+}
+
+// fakeRecorder keeps every finished operation, and checks on each call that
+// the client's lock is not held. With runner set, it also keeps how many
+// commands had run when each operation started.
+type fakeRecorder struct {
+	c      *Client
+	runner *fakeRunner
+
+	ops           []Operation
+	started       int
+	callsAtStart  []int
+	heldLockCalls int
+}
+
+func (f *fakeRecorder) checkLock() {
+	if f.c != nil && !f.c.mu.TryLock() {
+		f.heldLockCalls++
+		return
+	}
+	if f.c != nil {
+		f.c.mu.Unlock()
+	}
+}
+
+func (f *fakeRecorder) StartOperation(ctx context.Context, op Operation) (int64, error) {
+	f.checkLock()
+	f.started++
+	if f.runner != nil {
+		f.callsAtStart = append(f.callsAtStart, len(f.runner.calls))
+	}
+	return int64(f.started), nil
+}
+
+func (f *fakeRecorder) FinishOperation(ctx context.Context, id int64, op Operation) error {
+	f.checkLock()
+	f.ops = append(f.ops, op)
+	return nil
+}
+
+func TestCreateThinDevice_RecordsOperation(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    bool
+		wantErr bool
+	}{
+		{"success", false, false},
+		{"create_thin fails", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			r.failures["dmsetup message"] = tt.fail
+			c := newTestClient(t)
+			rec := &fakeRecorder{c: c, runner: r}
+			c.SetOperationRecorder(rec)
+
+			before := time.Now()
+			_, err := c.CreateThinDevice(context.Background(), "pool", "42", 1<<30)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateThinDevice() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(rec.ops) != 1 {
+				t.Fatalf("recorded %d operations, want 1: %+v", len(rec.ops), rec.ops)
+			}
+			op := rec.ops[0]
+			if op.Op != OpCreateThin || op.Pool != "pool" || op.DeviceID != "42" || op.DeviceName != "thin-42" {
+				t.Errorf("recorded %+v, want create_thin of thin-42 (42) in pool", op)
+			}
+			if op.StartedAt.Before(before) || op.Duration < 0 {
+				t.Errorf("recorded start %v, duration %v", op.StartedAt, op.Duration)
+			}
+			if op.Err != err {
+				t.Errorf("recorded error %v, want %v", op.Err, err)
+			}
+			// Recorded before dmsetup runs, so a hang still leaves a row
+			if len(rec.callsAtStart) != 1 || rec.callsAtStart[0] != 0 {
+				t.Errorf("commands run before the start was recorded = %v, want 0", rec.callsAtStart)
+			}
+			if rec.heldLockCalls != 0 {
+				t.Errorf("recorder called %d times with the client's lock held", rec.heldLockCalls)
+			}
+		})
+	}
+}
+
+func TestRecordOperation_Optional(t *testing.T) {
+	fakeExec(t)
+	c := newTestClient(t)
+
+	// Without a recorder, operations run as before
+	if err := c.DeleteDevice(context.Background(), "pool", "42"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+
+	rec := &fakeRecorder{c: c}
+	c.SetOperationRecorder(rec)
+	if err := c.DeleteDevice(context.Background(), "pool", "42"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	if len(rec.ops) != 1 || rec.ops[0].Op != OpDelete || rec.ops[0].Err != nil {
+		t.Errorf("recorded %+v, want one successful delete", rec.ops)
+	}
+}
+
+func TestStabilizePool_CancelledContext(t *testing.T) {
+	// Every command but release_metadata_snap blocks until its context is done
+	var calls []string
+	orig := execCommandContext
+	execCommandContext = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		if args[len(args)-1] == "release_metadata_snap" {
+			return exec.CommandContext(ctx, "true")
+		}
+		return exec.CommandContext(ctx, "sleep", "10")
+	}
+	t.Cleanup(func() { execCommandContext = orig })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan struct{})
+	go func() {
+		StabilizePool(ctx, "pool", 5*time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StabilizePool blocked after its context was cancelled")
+	}
+
+	// The metadata snapshot is released even though the reserve was cut short
+	want := "dmsetup message pool 0 release_metadata_snap"
+	if len(calls) < 2 || calls[1] != want {
+		t.Errorf("commands = %v, want %q after the reserve", calls, want)
+	}
+
+	// An already-cancelled context runs nothing
+	calls = nil
+	StabilizePool(ctx, "pool", 0)
+	if len(calls) != 0 {
+		t.Errorf("commands run with a cancelled context: %v", calls)
+	}
+}
@@ -10,12 +10,30 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Default pool sizes.
+const (
+	DefaultPoolDataSize = 2 * 1024 * 1024 * 1024 // 2GB
+	DefaultPoolMetaSize = 1 * 1024 * 1024        // 1MB
+
+	// DefaultPoolBlockSize is the data block size in 512-byte sectors
+	// (128KB). Every CoW break copies a whole block, so small blocks keep
+	// snapshot writes cheap.
+	DefaultPoolBlockSize = 256
+)
+
+// dm-thin accepts data block sizes from 64KB to 1GB in multiples of 64KB.
+const (
+	minPoolBlockSize = 128
+	maxPoolBlockSize = 2097152
+)
+
 // PoolConfig contains configuration for pool setup.
 type PoolConfig struct {
 	// PoolName is the name of the thin pool (default: "pool")
@@ -26,9 +44,10 @@ type PoolConfig struct {
 	DataSizeBytes int64
 	// MetaSizeBytes is the size of the metadata device (default: 1MB)
 	MetaSizeBytes int64
-	// DataBlockSize is the block size for data in sectors (default: 2048 = 1MB)
+	// DataBlockSize is the block size for data in sectors (default: 256 = 128KB)
 	DataBlockSize int
-	// LowWaterMark is the low water mark in blocks (default: 32768)
+	// LowWaterMark is the number of free data blocks at which the kernel
+	// raises a dm event. Zero means 1% of the data blocks.
 	LowWaterMark int
 }
 
@@ -37,13 +56,74 @@ func DefaultPoolConfig(dataDir string) PoolConfig {
 	return PoolConfig{
 		PoolName:      "pool",
 		DataDir:       dataDir,
-		DataSizeBytes: 2 * 1024 * 1024 * 1024, // 2GB
-		MetaSizeBytes: 1 * 1024 * 1024,         // 1MB
-		DataBlockSize: 2048,                    // 1MB blocks
-		LowWaterMark:  32768,
+		DataSizeBytes: DefaultPoolDataSize,
+		MetaSizeBytes: DefaultPoolMetaSize,
+		DataBlockSize: DefaultPoolBlockSize,
 	}
 }
 
+// RecommendPoolConfig returns a pool configuration sized for totalBytes of
+// images: data is twice the image total plus 30% for snapshots and CoW,
+// rounded up to a whole GB (minimum 2GB), and metadata is 0.2% of data
+// (minimum 4MB).
+func RecommendPoolConfig(dataDir string, totalBytes int64) PoolConfig {
+	const gb = 1024 * 1024 * 1024
+
+	dataSize := (totalBytes*26/10 + gb - 1) / gb * gb
+	dataSize = max(dataSize, 2*gb)
+
+	metaSize := max(dataSize/500, 4*1024*1024)
+
+	config := DefaultPoolConfig(dataDir)
+	config.DataSizeBytes = dataSize
+	config.MetaSizeBytes = metaSize
+	return config
+}
+
+// Validate checks that the sizes in the config describe a pool dm-thin will
+// accept.
+func (c PoolConfig) Validate() error {
+	if c.DataBlockSize < minPoolBlockSize || c.DataBlockSize > maxPoolBlockSize || c.DataBlockSize%minPoolBlockSize != 0 {
+		return fmt.Errorf("invalid data block size %d sectors: must be a multiple of %d between %d and %d",
+			c.DataBlockSize, minPoolBlockSize, minPoolBlockSize, maxPoolBlockSize)
+	}
+	if c.MetaSizeBytes <= 0 {
+		return fmt.Errorf("invalid metadata size %d bytes", c.MetaSizeBytes)
+	}
+	blockBytes := int64(c.DataBlockSize) * 512
+	if c.DataSizeBytes < blockBytes {
+		return fmt.Errorf("invalid data size %d bytes: must hold at least one %d byte block", c.DataSizeBytes, blockBytes)
+	}
+	if blocks := c.dataBlocks(); c.LowWaterMark < 0 || int64(c.LowWaterMark) >= blocks {
+		return fmt.Errorf("invalid low water mark %d: must be below the %d data blocks", c.LowWaterMark, blocks)
+	}
+	return nil
+}
+
+// Table returns the dmsetup table for a thin pool on the given metadata and
+// data devices. The pool length is the data size rounded down to a whole
+// number of blocks.
+func (c PoolConfig) Table(metaDev, dataDev string) (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("0 %d thin-pool %s %s %d %d",
+		c.dataBlocks()*int64(c.DataBlockSize), metaDev, dataDev, c.DataBlockSize, c.lowWaterMark()), nil
+}
+
+// dataBlocks returns the number of whole data blocks in the data device.
+func (c PoolConfig) dataBlocks() int64 {
+	return c.DataSizeBytes / 512 / int64(c.DataBlockSize)
+}
+
+// lowWaterMark returns LowWaterMark, or 1% of the data blocks if it is unset.
+func (c PoolConfig) lowWaterMark() int64 {
+	if c.LowWaterMark > 0 {
+		return int64(c.LowWaterMark)
+	}
+	return max(c.dataBlocks()/100, 1)
+}
+
 // PoolStatus represents the status of a thin pool.
 type PoolStatus struct {
 	Exists         bool
@@ -91,15 +171,19 @@ func (pm *PoolManager) GetPoolStatus(ctx context.Context) (*PoolStatus, error) {
 	}
 
 	status.Exists = true
-	outputStr := string(output)
-	if strings.Contains(outputStr, "needs_check") {
-		status.NeedsCheck = true
-	}
-	if strings.Contains(outputStr, "ro ") || strings.Contains(outputStr, " ro") {
-		status.ReadOnly = true
-	}
-	if strings.Contains(outputStr, "Error") || strings.Contains(outputStr, "error") {
-		status.ErrorState = "error detected in pool status"
+	info, err := ParsePoolStatusOutput(pm.config.PoolName, string(output))
+	if err != nil {
+		status.ErrorState = err.Error()
+	} else {
+		status.NeedsCheck = info.NeedsCheck
+		status.ReadOnly = info.ReadOnly
+		status.MetadataUsed = info.UsedMetaBlocks
+		status.MetadataTotal = info.TotalMetaBlocks
+		status.DataUsed = info.UsedDataBlocks
+		status.DataTotal = info.TotalDataBlocks
+		if info.Failed || info.OutOfDataSpace {
+			status.ErrorState = "pool is " + strings.Join(info.Problems(), ", ")
+		}
 	}
 
 	// Try to find loop devices
@@ -157,12 +241,17 @@ func (pm *PoolManager) EnsurePoolExists(ctx context.Context) error {
 // CreatePool creates a new thin pool from scratch.
 func (pm *PoolManager) CreatePool(ctx context.Context) error {
 	pm.logger.WithFields(logrus.Fields{
-		"data_dir":  pm.config.DataDir,
-		"data_size": pm.config.DataSizeBytes,
-		"meta_size": pm.config.MetaSizeBytes,
-		"pool_name": pm.config.PoolName,
+		"data_dir":   pm.config.DataDir,
+		"data_size":  pm.config.DataSizeBytes,
+		"meta_size":  pm.config.MetaSizeBytes,
+		"block_size": pm.config.DataBlockSize,
+		"pool_name":  pm.config.PoolName,
 	}).Info("creating new thin pool")
 
+	if err := pm.config.Validate(); err != nil {
+		return err
+	}
+
 	if err := os.MkdirAll(pm.config.DataDir, 0755); err != nil {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
@@ -172,10 +261,10 @@ func (pm *PoolManager) CreatePool(ctx context.Context) error {
 
 	pm.cleanupExistingLoops(ctx, metaPath, dataPath)
 
-	if err := pm.createPoolFile(metaPath, pm.config.MetaSizeBytes); err != nil {
+	if err := pm.createPoolFile(ctx, metaPath, pm.config.MetaSizeBytes); err != nil {
 		return fmt.Errorf("failed to create metadata file: %w", err)
 	}
-	if err := pm.createPoolFile(dataPath, pm.config.DataSizeBytes); err != nil {
+	if err := pm.createPoolFile(ctx, dataPath, pm.config.DataSizeBytes); err != nil {
 		return fmt.Errorf("failed to create data file: %w", err)
 	}
 
@@ -187,17 +276,23 @@ func (pm *PoolManager) CreatePool(ctx context.Context) error {
 
 	dataDev, err := pm.setupLoopDevice(ctx, dataPath)
 	if err != nil {
+		pm.detachLoops(metaDev)
 		return fmt.Errorf("failed to setup data loop device: %w", err)
 	}
 	pm.logger.WithField("device", dataDev).Info("data loop device created")
 
-	poolSectors := pm.config.DataSizeBytes / 512
-	table := fmt.Sprintf("0 %d thin-pool %s %s %d %d",
-		poolSectors, metaDev, dataDev, pm.config.DataBlockSize, pm.config.LowWaterMark)
+	table, err := pm.config.Table(metaDev, dataDev)
+	if err != nil {
+		pm.detachLoops(metaDev, dataDev)
+		return err
+	}
+	pm.logger.WithField("table", table).Debug("pool table")
 
 	cmd := exec.CommandContext(ctx, "dmsetup", "create", "--verifyudev", pm.config.PoolName, "--table", table)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
+		// Don't leave the loop devices behind to collide with the next attempt.
+		pm.detachLoops(metaDev, dataDev)
 		return fmt.Errorf("failed to create pool: %w (output: %s)", err, output)
 	}
 
@@ -205,9 +300,9 @@ func (pm *PoolManager) CreatePool(ctx context.Context) error {
 	return pm.verifyPool(ctx)
 }
 
-func (pm *PoolManager) createPoolFile(path string, size int64) error {
+func (pm *PoolManager) createPoolFile(ctx context.Context, path string, size int64) error {
 	os.Remove(path)
-	cmd := exec.Command("fallocate", "-l", fmt.Sprintf("%d", size), path)
+	cmd := exec.CommandContext(ctx, "fallocate", "-l", fmt.Sprintf("%d", size), path)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("fallocate failed: %w (output: %s)", err, output)
@@ -233,6 +328,18 @@ func (pm *PoolManager) cleanupExistingLoops(ctx context.Context, paths ...string
 	}
 }
 
+// detachLoops detaches loop devices set up by a failed CreatePool. It uses a
+// fresh context so cleanup still runs after the caller's is cancelled.
+func (pm *PoolManager) detachLoops(devs ...string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, dev := range devs {
+		if output, err := exec.CommandContext(ctx, "losetup", "-d", dev).CombinedOutput(); err != nil {
+			pm.logger.WithError(err).WithField("device", dev).WithField("output", string(output)).Warn("failed to detach loop device")
+		}
+	}
+}
+
 func (pm *PoolManager) verifyPool(ctx context.Context) error {
 	status, err := pm.GetPoolStatus(ctx)
 	if err != nil {
@@ -291,3 +398,220 @@ func (pm *PoolManager) DestroyPool(ctx context.Context) error {
 	pm.logger.Info("pool destroyed")
 	return nil
 }
+
+// maxPoolMetaSize is the most metadata dm-thin will use; a larger metadata
+// device is accepted but the excess is ignored.
+const maxPoolMetaSize = 255 * (1 << 14) * 8 * 512
+
+// PoolTable is a parsed thin-pool table line:
+// 0 <length> thin-pool <metadata dev> <data dev> <block size> <low water mark> [<feature args>...]
+type PoolTable struct {
+	Length       int64 // Pool length in 512-byte sectors
+	MetaDev      string
+	DataDev      string
+	BlockSize    int // Data block size in sectors
+	LowWaterMark int64
+	Features     []string // Feature count and arguments, passed through as-is
+}
+
+// ParsePoolTable parses the output of 'dmsetup table <pool>'.
+func ParsePoolTable(table string) (PoolTable, error) {
+	fields := strings.Fields(table)
+	if len(fields) < 7 || fields[0] != "0" || fields[2] != "thin-pool" {
+		return PoolTable{}, fmt.Errorf("not a thin-pool table: %q", strings.TrimSpace(table))
+	}
+	length, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return PoolTable{}, fmt.Errorf("invalid pool length %q: %w", fields[1], err)
+	}
+	blockSize, err := strconv.Atoi(fields[5])
+	if err != nil || blockSize <= 0 {
+		return PoolTable{}, fmt.Errorf("invalid data block size %q", fields[5])
+	}
+	lowWater, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return PoolTable{}, fmt.Errorf("invalid low water mark %q: %w", fields[6], err)
+	}
+	return PoolTable{
+		Length:       length,
+		MetaDev:      fields[3],
+		DataDev:      fields[4],
+		BlockSize:    blockSize,
+		LowWaterMark: lowWater,
+		Features:     fields[7:],
+	}, nil
+}
+
+// String returns the table in the form dmsetup create and reload accept.
+func (t PoolTable) String() string {
+	s := fmt.Sprintf("0 %d thin-pool %s %s %d %d", t.Length, t.MetaDev, t.DataDev, t.BlockSize, t.LowWaterMark)
+	if len(t.Features) > 0 {
+		s += " " + strings.Join(t.Features, " ")
+	}
+	return s
+}
+
+// PoolGrowPlan describes growing a pool's backing files and the table it is
+// reloaded with afterwards.
+type PoolGrowPlan struct {
+	Table PoolTable // Current table
+
+	DataPath, MetaPath     string
+	DataDevice, MetaDevice string // Loop devices backing the pool files
+
+	DataBytes, NewDataBytes int64
+	MetaBytes, NewMetaBytes int64
+}
+
+// NewTable returns the current table with the pool length extended to the
+// whole data blocks in the grown data file. Only the length changes; the
+// devices, block size, low water mark and features are kept.
+func (p PoolGrowPlan) NewTable() PoolTable {
+	t := p.Table
+	blockSectors := int64(t.BlockSize)
+	t.Length = max(p.NewDataBytes/512/blockSectors*blockSectors, t.Length)
+	return t
+}
+
+// planPoolGrowth works out the new file sizes for adding addData and addMeta
+// bytes to a pool whose files are dataBytes and metaBytes long. Growing the
+// data file must add at least one whole data block to the pool.
+func planPoolGrowth(table PoolTable, dataBytes, metaBytes, addData, addMeta int64) (PoolGrowPlan, error) {
+	if addData < 0 || addMeta < 0 {
+		return PoolGrowPlan{}, fmt.Errorf("pools can only grow: got data %+d bytes, metadata %+d bytes", addData, addMeta)
+	}
+	if addData == 0 && addMeta == 0 {
+		return PoolGrowPlan{}, fmt.Errorf("nothing to grow: add data or metadata space")
+	}
+
+	plan := PoolGrowPlan{
+		Table:        table,
+		DataBytes:    dataBytes,
+		NewDataBytes: dataBytes + addData,
+		MetaBytes:    metaBytes,
+		NewMetaBytes: metaBytes + addMeta,
+	}
+
+	if addData > 0 && plan.NewTable().Length <= table.Length {
+		return PoolGrowPlan{}, fmt.Errorf("adding %d bytes of data gives the pool no new %d byte blocks",
+			addData, int64(table.BlockSize)*512)
+	}
+	if addMeta > 0 && plan.NewMetaBytes > maxPoolMetaSize {
+		return PoolGrowPlan{}, fmt.Errorf("metadata size %d bytes exceeds the %d bytes dm-thin can use",
+			plan.NewMetaBytes, int64(maxPoolMetaSize))
+	}
+	return plan, nil
+}
+
+// PlanGrowth reads the pool's table and backing files and returns the plan
+// for adding addData and addMeta bytes. It changes nothing. Only pools made
+// by CreatePool, whose files are loop-mounted from DataDir, can be grown.
+func (pm *PoolManager) PlanGrowth(ctx context.Context, addData, addMeta int64) (*PoolGrowPlan, error) {
+	output, err := exec.CommandContext(ctx, "dmsetup", "table", pm.config.PoolName).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pool table: %w (output: %s)", err, output)
+	}
+	table, err := ParsePoolTable(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	metaPath := filepath.Join(pm.config.DataDir, "pool_meta")
+	dataPath := filepath.Join(pm.config.DataDir, "pool_data")
+
+	var sizes [2]int64
+	for i, path := range []string{dataPath, metaPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat pool file: %w", err)
+		}
+		sizes[i] = info.Size()
+	}
+
+	plan, err := planPoolGrowth(table, sizes[0], sizes[1], addData, addMeta)
+	if err != nil {
+		return nil, err
+	}
+	plan.DataPath, plan.MetaPath = dataPath, metaPath
+
+	plan.DataDevice = pm.findLoopDevice(ctx, dataPath)
+	plan.MetaDevice = pm.findLoopDevice(ctx, metaPath)
+	if plan.DataDevice == "" || plan.MetaDevice == "" {
+		return nil, fmt.Errorf("pool files in %s are not attached to loop devices; only pools created by setup-pool can be grown", pm.config.DataDir)
+	}
+	return &plan, nil
+}
+
+// GrowPool carries out plan online: it extends the backing files, tells the
+// loop devices their new capacity, and reloads the pool with the longer
+// table. Thin devices stay active throughout; I/O to them blocks while the
+// pool is suspended.
+//
+// Files already grown are left grown if a later step fails: the extra space
+// is unused until a GrowPool succeeds.
+func (pm *PoolManager) GrowPool(ctx context.Context, plan *PoolGrowPlan) error {
+	pm.logger.WithFields(logrus.Fields{
+		"pool_name":      pm.config.PoolName,
+		"data_size":      plan.DataBytes,
+		"new_data_size":  plan.NewDataBytes,
+		"meta_size":      plan.MetaBytes,
+		"new_meta_size":  plan.NewMetaBytes,
+		"current_length": plan.Table.Length,
+	}).Warn("growing thin pool")
+
+	grow := []struct {
+		path, dev     string
+		size, newSize int64
+	}{
+		{plan.MetaPath, plan.MetaDevice, plan.MetaBytes, plan.NewMetaBytes},
+		{plan.DataPath, plan.DataDevice, plan.DataBytes, plan.NewDataBytes},
+	}
+	for _, g := range grow {
+		if g.newSize == g.size {
+			continue
+		}
+		// fallocate past the end extends the file and keeps its contents.
+		if output, err := exec.CommandContext(ctx, "fallocate", "-l", fmt.Sprintf("%d", g.newSize), g.path).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to grow %s: %w (output: %s)", g.path, err, output)
+		}
+		if output, err := exec.CommandContext(ctx, "losetup", "--set-capacity", g.dev).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to update capacity of %s: %w (output: %s)", g.dev, err, output)
+		}
+		pm.logger.WithFields(logrus.Fields{"file": g.path, "device": g.dev, "size": g.newSize}).Info("pool file grown")
+	}
+
+	// Reloading with the same table still makes the pool pick up a larger
+	// metadata device when it resumes.
+	table := plan.NewTable().String()
+	pm.logger.WithField("table", table).Info("reloading pool table")
+	if err := pm.reloadPool(ctx, table); err != nil {
+		return err
+	}
+
+	pm.logger.Info("thin pool grown")
+	return pm.verifyPool(ctx)
+}
+
+// reloadPool suspends the pool, loads table and resumes it. The pool is
+// resumed even if the reload fails, so it is never left suspended.
+func (pm *PoolManager) reloadPool(ctx context.Context, table string) error {
+	name := pm.config.PoolName
+	if output, err := exec.CommandContext(ctx, "dmsetup", "suspend", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to suspend pool: %w (output: %s)", err, output)
+	}
+
+	// A rejected table is never loaded, so resume brings back the old one.
+	reloadOutput, reloadErr := exec.CommandContext(ctx, "dmsetup", "reload", name, "--table", table).CombinedOutput()
+
+	// A fresh context: a cancelled caller must not leave the pool suspended.
+	resumeCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if output, err := exec.CommandContext(resumeCtx, "dmsetup", "resume", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to resume pool (run 'dmsetup resume %s'): %w (output: %s)", name, err, output)
+	}
+
+	if reloadErr != nil {
+		return fmt.Errorf("failed to reload pool table: %w (output: %s)", reloadErr, reloadOutput)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package devicemapper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPoolConfigTable(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PoolConfig
+		want   string
+	}{
+		{
+			name:   "defaults",
+			config: DefaultPoolConfig("/var/lib/flyio"),
+			// 2GB / 128KB = 16384 blocks, low water mark 1% = 163.
+			want: "0 4194304 thin-pool /dev/loop0 /dev/loop1 256 163",
+		},
+		{
+			name: "explicit low water mark",
+			config: PoolConfig{
+				DataSizeBytes: 100 * 1024 * 1024 * 1024,
+				MetaSizeBytes: 200 * 1024 * 1024,
+				DataBlockSize: 128,
+				LowWaterMark:  4096,
+			},
+			want: "0 209715200 thin-pool /dev/loop0 /dev/loop1 128 4096",
+		},
+		{
+			name: "data size rounded down to whole blocks",
+			config: PoolConfig{
+				DataSizeBytes: 1024*1024*1024 + 1000,
+				MetaSizeBytes: 4 * 1024 * 1024,
+				DataBlockSize: 2048,
+			},
+			want: "0 2097152 thin-pool /dev/loop0 /dev/loop1 2048 10",
+		},
+		{
+			name: "tiny pool keeps a low water mark of one block",
+			config: PoolConfig{
+				DataSizeBytes: 10 * 64 * 1024,
+				MetaSizeBytes: 1024 * 1024,
+				DataBlockSize: 128,
+			},
+			want: "0 1280 thin-pool /dev/loop0 /dev/loop1 128 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.Table("/dev/loop0", "/dev/loop1")
+			if err != nil {
+				t.Fatalf("Table() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Table() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolConfigTable_Invalid(t *testing.T) {
+	valid := DefaultPoolConfig("/var/lib/flyio")
+
+	tests := []struct {
+		name    string
+		modify  func(*PoolConfig)
+		wantErr string
+	}{
+		{"block size too small", func(c *PoolConfig) { c.DataBlockSize = 64 }, "block size"},
+		{"block size too large", func(c *PoolConfig) { c.DataBlockSize = 2 * maxPoolBlockSize }, "block size"},
+		{"block size not a multiple of 128", func(c *PoolConfig) { c.DataBlockSize = 300 }, "block size"},
+		{"zero metadata size", func(c *PoolConfig) { c.MetaSizeBytes = 0 }, "metadata size"},
+		{"data smaller than a block", func(c *PoolConfig) { c.DataSizeBytes = 1024 }, "data size"},
+		{"low water mark above pool size", func(c *PoolConfig) { c.LowWaterMark = 32768 }, "low water mark"},
+		{"negative low water mark", func(c *PoolConfig) { c.LowWaterMark = -1 }, "low water mark"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.modify(&c)
+			table, err := c.Table("/dev/loop0", "/dev/loop1")
+			if err == nil {
+				t.Fatalf("Table() = %q, want error", table)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Table() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRecommendPoolConfig(t *testing.T) {
+	const (
+		mb = int64(1024 * 1024)
+		gb = 1024 * mb
+	)
+
+	tests := []struct {
+		name       string
+		totalBytes int64
+		wantData   int64
+		wantMeta   int64
+	}{
+		// The 2GB data floor already puts 0.2% above the 4MB metadata floor.
+		{"empty bucket gets the 2GB minimum", 0, 2 * gb, 2 * gb / 500},
+		{"small bucket gets the 2GB minimum", 500 * mb, 2 * gb, 2 * gb / 500},
+		// 1GB × 2.6 = 2.6GB, rounded up to 3GB; 0.2% is ~6MB.
+		{"1GB", gb, 3 * gb, 3 * gb / 500},
+		// 10GB × 2.6 = 26GB exactly.
+		{"10GB", 10 * gb, 26 * gb, 26 * gb / 500},
+		// 1TB × 2.6 = 2662.4GB, rounded up to 2663GB.
+		{"1TB", 1024 * gb, 2663 * gb, 2663 * gb / 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := RecommendPoolConfig("/var/lib/flyio", tt.totalBytes)
+			if c.DataSizeBytes != tt.wantData {
+				t.Errorf("DataSizeBytes = %d, want %d", c.DataSizeBytes, tt.wantData)
+			}
+			if c.MetaSizeBytes != tt.wantMeta {
+				t.Errorf("MetaSizeBytes = %d, want %d", c.MetaSizeBytes, tt.wantMeta)
+			}
+			if c.DataBlockSize != DefaultPoolBlockSize || c.DataDir != "/var/lib/flyio" {
+				t.Errorf("config = %+v, want default block size and data dir", c)
+			}
+			if c.MetaSizeBytes < 4*mb {
+				t.Errorf("MetaSizeBytes = %d, below the 4MB minimum", c.MetaSizeBytes)
+			}
+			if err := c.Validate(); err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePoolTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		table string
+		want  PoolTable
+	}{
+		{
+			name:  "setup-pool",
+			table: "0 4194304 thin-pool 7:0 7:1 256 163\n",
+			want:  PoolTable{Length: 4194304, MetaDev: "7:0", DataDev: "7:1", BlockSize: 256, LowWaterMark: 163},
+		},
+		{
+			name:  "feature args",
+			table: "0 209715200 thin-pool 253:0 253:1 128 4096 1 skip_block_zeroing",
+			want: PoolTable{Length: 209715200, MetaDev: "253:0", DataDev: "253:1", BlockSize: 128, LowWaterMark: 4096,
+				Features: []string{"1", "skip_block_zeroing"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePoolTable(tt.table)
+			if err != nil {
+				t.Fatalf("ParsePoolTable() error = %v", err)
+			}
+			if got.String() != tt.want.String() {
+				t.Errorf("ParsePoolTable() = %q, want %q", got, tt.want)
+			}
+			if got.String() != strings.TrimSpace(tt.table) {
+				t.Errorf("String() = %q, want the input %q back", got, strings.TrimSpace(tt.table))
+			}
+		})
+	}
+
+	for _, bad := range []string{"", "0 2048 linear 7:1 0", "0 x thin-pool 7:0 7:1 256 163", "0 4194304 thin-pool 7:0 7:1 256"} {
+		if _, err := ParsePoolTable(bad); err == nil {
+			t.Errorf("ParsePoolTable(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestPlanPoolGrowth(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+	table, err := ParsePoolTable("0 4194304 thin-pool 7:0 7:1 256 163 1 skip_block_zeroing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		addData, addMeta   int64
+		wantData, wantMeta int64
+		wantTable          string
+		wantErr            string
+	}{
+		{
+			name:      "data",
+			addData:   8 * gb,
+			wantData:  10 * gb,
+			wantMeta:  DefaultPoolMetaSize,
+			wantTable: "0 20971520 thin-pool 7:0 7:1 256 163 1 skip_block_zeroing",
+		},
+		{
+			name:     "data rounded down to whole blocks",
+			addData:  gb + 1000,
+			wantData: 3*gb + 1000,
+			wantMeta: DefaultPoolMetaSize,
+			// 3GB / 128KB = 24576 blocks of 256 sectors.
+			wantTable: "0 6291456 thin-pool 7:0 7:1 256 163 1 skip_block_zeroing",
+		},
+		{
+			name:      "metadata only keeps the length",
+			addMeta:   63 * 1024 * 1024,
+			wantData:  2 * gb,
+			wantMeta:  64 * 1024 * 1024,
+			wantTable: "0 4194304 thin-pool 7:0 7:1 256 163 1 skip_block_zeroing",
+		},
+		{name: "nothing", wantErr: "nothing to grow"},
+		{name: "shrink", addData: -gb, wantErr: "only grow"},
+		{name: "less than a block", addData: 64 * 1024, wantErr: "no new"},
+		{name: "metadata past the dm-thin limit", addMeta: 16 * gb, wantErr: "exceeds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := planPoolGrowth(table, 2*gb, DefaultPoolMetaSize, tt.addData, tt.addMeta)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("planPoolGrowth() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("planPoolGrowth() error = %v", err)
+			}
+			if plan.NewDataBytes != tt.wantData || plan.NewMetaBytes != tt.wantMeta {
+				t.Errorf("new sizes = %d data, %d meta; want %d, %d", plan.NewDataBytes, plan.NewMetaBytes, tt.wantData, tt.wantMeta)
+			}
+			if got := plan.NewTable().String(); got != tt.wantTable {
+				t.Errorf("NewTable() = %q, want %q", got, tt.wantTable)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package devicemapper
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// HostTools records which optional host tools are installed. Callers that
+// would shell out to one check here first and take an explicit fallback when
+// it is missing, rather than treating a failed command as "nothing to report".
+type HostTools struct {
+	Udevadm bool `json:"udevadm"` // udevadm settle, after device creation and removal
+	Vmstat  bool `json:"vmstat"`  // I/O wait; without it /proc/stat is sampled instead
+	Dmesg   bool `json:"dmesg"`   // Kernel log; without it /dev/kmsg is read instead
+}
+
+// UdevSettleFallback is how long stabilization pauses in place of
+// "udevadm settle" when udevadm is not installed, to give udev time to
+// create or remove device nodes.
+const UdevSettleFallback = 100 * time.Millisecond
+
+// SettleUdev runs "udevadm settle" with the given timeout. Without udevadm it
+// pauses for UdevSettleFallback instead, so device nodes still get a chance
+// to appear or go before the next step. Cancelling ctx cuts either short.
+func SettleUdev(ctx context.Context, timeout time.Duration) {
+	if !Tools().Udevadm {
+		select {
+		case <-time.After(UdevSettleFallback):
+		case <-ctx.Done():
+		}
+		return
+	}
+	execCommandContext(ctx, "udevadm", "settle", fmt.Sprintf("--timeout=%d", int(timeout.Seconds()))).Run()
+}
+
+// ProbeHostTools looks up udevadm, vmstat and dmesg with lookPath, which is
+// exec.LookPath outside tests.
+func ProbeHostTools(lookPath func(file string) (string, error)) HostTools {
+	found := func(name string) bool {
+		_, err := lookPath(name)
+		return err == nil
+	}
+	return HostTools{
+		Udevadm: found("udevadm"),
+		Vmstat:  found("vmstat"),
+		Dmesg:   found("dmesg"),
+	}
+}
+
+// Missing returns the names of the tools that were not found.
+func (t HostTools) Missing() []string {
+	var missing []string
+	if !t.Udevadm {
+		missing = append(missing, "udevadm")
+	}
+	if !t.Vmstat {
+		missing = append(missing, "vmstat")
+	}
+	if !t.Dmesg {
+		missing = append(missing, "dmesg")
+	}
+	return missing
+}
+
+var (
+	toolsMu sync.Mutex
+	tools   *HostTools
+)
+
+// Tools returns the host's tools, probing PATH on first use unless SetTools
+// has already recorded them.
+func Tools() HostTools {
+	toolsMu.Lock()
+	defer toolsMu.Unlock()
+	if tools == nil {
+		t := ProbeHostTools(exec.LookPath)
+		tools = &t
+	}
+	return *tools
+}
+
+// SetTools records the host's tools, replacing any earlier probe. The CLI
+// probes once at startup and logs what it found; tests use it to simulate
+// missing tools.
+func SetTools(t HostTools) {
+	toolsMu.Lock()
+	defer toolsMu.Unlock()
+	tools = &t
+}
@@ -0,0 +1,75 @@
+package devicemapper
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+// lookPathWithout returns a lookup that finds every tool except missing.
+func lookPathWithout(missing ...string) func(string) (string, error) {
+	return func(file string) (string, error) {
+		if slices.Contains(missing, file) {
+			return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+		}
+		return "/usr/bin/" + file, nil
+	}
+}
+
+func TestProbeHostTools(t *testing.T) {
+	all := ProbeHostTools(lookPathWithout())
+	if all != (HostTools{Udevadm: true, Vmstat: true, Dmesg: true}) || len(all.Missing()) != 0 {
+		t.Errorf("all tools present: got %+v, missing %v", all, all.Missing())
+	}
+
+	some := ProbeHostTools(lookPathWithout("udevadm", "dmesg"))
+	if some != (HostTools{Vmstat: true}) {
+		t.Errorf("ProbeHostTools() = %+v, want only vmstat", some)
+	}
+	if got := some.Missing(); !slices.Equal(got, []string{"udevadm", "dmesg"}) {
+		t.Errorf("Missing() = %v, want [udevadm dmesg]", got)
+	}
+
+	none := ProbeHostTools(func(string) (string, error) { return "", errors.New("no PATH") })
+	if len(none.Missing()) != 3 {
+		t.Errorf("Missing() = %v, want all three", none.Missing())
+	}
+}
+
+func TestSetTools(t *testing.T) {
+	prev := Tools()
+	t.Cleanup(func() { SetTools(prev) })
+
+	SetTools(HostTools{Dmesg: true})
+	if got := Tools(); got != (HostTools{Dmesg: true}) {
+		t.Errorf("Tools() = %+v after SetTools, want only dmesg", got)
+	}
+}
+
+func TestSettleUdev(t *testing.T) {
+	prev := Tools()
+	t.Cleanup(func() { SetTools(prev) })
+
+	for _, tt := range []struct {
+		name    string
+		udevadm bool
+	}{{"missing", false}, {"present", true}} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fakeExec(t)
+			if tt.udevadm {
+				SetTools(ProbeHostTools(lookPathWithout()))
+			} else {
+				SetTools(ProbeHostTools(lookPathWithout("udevadm")))
+			}
+
+			SettleUdev(context.Background(), 0)
+
+			settled := len(r.calls) == 1 && r.calls[0].name == "udevadm" && slices.Equal(r.calls[0].args, []string{"settle", "--timeout=0"})
+			if settled != tt.udevadm || (!tt.udevadm && len(r.calls) != 0) {
+				t.Errorf("udevadm present = %v, but commands run were %v", tt.udevadm, r.calls)
+			}
+		})
+	}
+}
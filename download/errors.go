@@ -0,0 +1,77 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+
+	"github.com/superfly/fsm/s3"
+)
+
+// AccessDeniedError reports that S3 refused access to an image object.
+// The download is aborted rather than retried: it cannot succeed until the
+// credentials or bucket policy change.
+type AccessDeniedError struct {
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("S3 access denied for s3://%s/%s: %v", e.Bucket, e.Key, e.Err)
+}
+
+func (e *AccessDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// SizeLimitError reports that an image object is larger than the client will
+// download.
+type SizeLimitError struct {
+	Key string
+	Err error
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("image %s too large: %v", e.Key, e.Err)
+}
+
+func (e *SizeLimitError) Unwrap() error {
+	return e.Err
+}
+
+// accessDeniedCodes are the S3 error codes returned for a refused request.
+var accessDeniedCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"Forbidden":             true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+}
+
+// isAccessDeniedError reports whether err is an S3 API error refusing access.
+func isAccessDeniedError(err error) bool {
+	var denied *AccessDeniedError
+	if errors.As(err, &denied) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && accessDeniedCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	// HeadObject responses have no body to carry an error code, so a refused
+	// HEAD may only be recognisable by its HTTP status.
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusForbidden
+}
+
+// isSizeLimitError reports whether err is the S3 client refusing an object
+// over its download size limit.
+func isSizeLimitError(err error) bool {
+	var tooLarge *SizeLimitError
+	return errors.As(err, &tooLarge) || errors.Is(err, s3.ErrObjectTooLarge)
+}
@@ -0,0 +1,170 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/superfly/fsm/s3"
+)
+
+// sdkError builds the error chain the AWS SDK returns for a failed S3 call:
+// an OperationError wrapping a ResponseError wrapping the decoded API error.
+func sdkError(operation string, status int, apiErr error) error {
+	return &smithy.OperationError{
+		ServiceID:     "S3",
+		OperationName: operation,
+		Err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+				Err:      apiErr,
+			},
+			RequestID: "req-1",
+		},
+	}
+}
+
+func TestIsAccessDeniedError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "GetObject AccessDenied",
+			err:  sdkError("GetObject", 403, &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}),
+			want: true,
+		},
+		{
+			name: "HeadObject Forbidden",
+			err:  sdkError("HeadObject", 403, &smithy.GenericAPIError{Code: "Forbidden"}),
+			want: true,
+		},
+		{
+			name: "bad credentials",
+			err:  sdkError("GetObject", 403, &smithy.GenericAPIError{Code: "InvalidAccessKeyId"}),
+			want: true,
+		},
+		{
+			name: "403 without an error code",
+			err:  sdkError("HeadObject", 403, errors.New("http response error")),
+			want: true,
+		},
+		{
+			name: "wrapped by the client",
+			err:  fmt.Errorf("failed to download: %w", sdkError("GetObject", 403, &smithy.GenericAPIError{Code: "AccessDenied"})),
+			want: true,
+		},
+		{
+			name: "bare API error",
+			err:  &smithy.GenericAPIError{Code: "AccessDenied"},
+			want: true,
+		},
+		{
+			name: "403 mid-chain",
+			err:  fmt.Errorf("download golang/1.tar: %w (attempt 3)", sdkError("GetObject", 403, &smithy.GenericAPIError{Code: "AccessDenied"})),
+			want: true,
+		},
+		{
+			name: "already classified",
+			err:  &AccessDeniedError{Bucket: "images", Key: "a.tar", Err: errors.New("denied")},
+			want: true,
+		},
+		{
+			name: "NoSuchKey",
+			err:  sdkError("GetObject", 404, &smithy.GenericAPIError{Code: "NoSuchKey"}),
+		},
+		{
+			name: "server error",
+			err:  sdkError("GetObject", 503, &smithy.GenericAPIError{Code: "SlowDown"}),
+		},
+		{
+			name: "403 in an unrelated message",
+			err:  errors.New("read 4031 bytes: connection reset"),
+		},
+		{
+			name: "AccessDenied in an unrelated message",
+			err:  errors.New("open /var/lib/AccessDenied.tar: no such file"),
+		},
+		{name: "nil", err: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAccessDeniedError(tt.err); got != tt.want {
+				t.Errorf("isAccessDeniedError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSizeLimitError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "client size check",
+			err:  fmt.Errorf("%w: %d bytes (max %d)", s3.ErrObjectTooLarge, 20<<30, 10<<30),
+			want: true,
+		},
+		{
+			name: "wrapped size check",
+			err:  fmt.Errorf("multipart download: %w", fmt.Errorf("%w: 1 bytes (max 0)", s3.ErrObjectTooLarge)),
+			want: true,
+		},
+		{
+			name: "bare sentinel",
+			err:  s3.ErrObjectTooLarge,
+			want: true,
+		},
+		{
+			name: "sentinel mid-message",
+			err:  fmt.Errorf("part 3: %w (retrying disabled)", s3.ErrObjectTooLarge),
+			want: true,
+		},
+		{
+			name: "already classified",
+			err:  &SizeLimitError{Key: "a.tar", Err: s3.ErrObjectTooLarge},
+			want: true,
+		},
+		{
+			name: "too large in an unrelated message",
+			err:  errors.New("file too large"),
+		},
+		{
+			name: "SDK EntityTooLarge",
+			err:  sdkError("GetObject", 400, &smithy.GenericAPIError{Code: "EntityTooLarge"}),
+		},
+		{name: "nil", err: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSizeLimitError(tt.err); got != tt.want {
+				t.Errorf("isSizeLimitError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifiedErrorsUnwrap(t *testing.T) {
+	cause := sdkError("GetObject", 403, &smithy.GenericAPIError{Code: "AccessDenied"})
+	var err error = &AccessDeniedError{Bucket: "images", Key: "golang/1.tar", Err: cause}
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "AccessDenied" {
+		t.Errorf("AccessDeniedError does not unwrap to the SDK error: %v", err)
+	}
+
+	err = &SizeLimitError{Key: "golang/1.tar", Err: fmt.Errorf("%w: 2 bytes (max 1)", s3.ErrObjectTooLarge)}
+	if !errors.Is(err, s3.ErrObjectTooLarge) {
+		t.Errorf("SizeLimitError does not unwrap to s3.ErrObjectTooLarge: %v", err)
+	}
+}
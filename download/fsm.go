@@ -4,8 +4,6 @@ package download
 import (
 	"archive/tar"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -14,9 +12,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	fsm "github.com/superfly/fsm"
 
+	"github.com/superfly/fsm/checksum"
 	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/extraction"
 	"github.com/superfly/fsm/s3"
 )
 
@@ -29,16 +30,123 @@ const (
 	MaxRetriesValidate = 2
 	// MaxRetriesStoreMetadata is the maximum number of retries for database writes
 	MaxRetriesStoreMetadata = 5
+
+	// MultipartThreshold is the object size above which images are downloaded
+	// with parallel ranged requests instead of a single GetObject stream.
+	MultipartThreshold = 256 * 1024 * 1024 // 256MB
 )
 
+// DatabaseManager defines the database operations used by the Download FSM.
+// *database.DB implements it; tests substitute a fake.
+type DatabaseManager interface {
+	CheckImageDownloaded(ctx context.Context, s3Key string) (*database.Image, error)
+	ReserveImageDownload(ctx context.Context, imageID, s3Key string) error
+	ResumeImageDownload(ctx context.Context, imageID, s3Key string) error
+	StoreImageMetadata(ctx context.Context, imageID, s3Key, localPath string, sum checksum.Checksum, sizeBytes int64) error
+	RecordImageError(ctx context.Context, imageID, reason string) error
+	ClearImageError(ctx context.Context, imageID string) error
+	QuarantineImage(ctx context.Context, imageID, reason string) error
+	UnquarantineImage(ctx context.Context, imageID string) error
+}
+
+var _ DatabaseManager = (*database.DB)(nil)
+
 // Dependencies holds the external dependencies for the Download FSM.
 type Dependencies struct {
-	DB       *database.DB
-	S3Client *s3.Client
+	DB       DatabaseManager
+	Store    ObjectStore // Usually *s3.Client
 	S3Bucket string
 	LocalDir string // Base directory for downloaded images (e.g., "/var/lib/flyio/images")
+	Timeouts PhaseTimeouts
+
+	// ShardStorage stores images in two levels of subdirectories of LocalDir
+	// named after their ID (see LocalPath), so no single directory holds every image.
+	ShardStorage bool
+
+	// ParanoidVerify re-hashes files whose checksum is already known: the
+	// download in validate, and unchanged files on the already-downloaded path.
+	ParanoidVerify bool
+
+	// ChecksumAlgo hashes downloads the store returned no digest for. The
+	// store hashes the rest with its own algorithm, so keep them the same.
+	// Recorded digests are always checked with the algorithm they were taken with.
+	ChecksumAlgo checksum.Algo
+
+	// MaxFiles and MaxTotalSize are the extraction limits applied by the
+	// security scan in validate. Keep them in step with unpack's so downloads
+	// are not rejected for images unpack would extract. Zero uses the
+	// extraction package defaults.
+	MaxFiles     int
+	MaxTotalSize int64
+
+	// Unquarantine releases a quarantined image (one that failed security
+	// validation) so it is downloaded and checked again. Without it,
+	// check-exists aborts on a quarantined image.
+	Unquarantine bool
+
+	Retries fsm.RetryPolicy
 }
 
+// LocalPath returns where an image is stored under localDir: <imageID>.tar, or
+// with sharded set ab/cd/<imageID>.tar, where abcd are the first four hex
+// characters of the ID after its "img_" prefix. IDs too short to shard are
+// stored flat.
+func LocalPath(localDir, imageID string, sharded bool) string {
+	name := imageID + ".tar"
+	if !sharded {
+		return filepath.Join(localDir, name)
+	}
+	digits := strings.TrimPrefix(imageID, "img_")
+	if len(digits) < 4 {
+		return filepath.Join(localDir, name)
+	}
+	return filepath.Join(localDir, digits[:2], digits[2:4], name)
+}
+
+// localPath returns where the Download FSM stores imageID.
+func (d *Dependencies) localPath(imageID string) string {
+	return LocalPath(d.LocalDir, imageID, d.ShardStorage)
+}
+
+// Default transition timeouts, used for PhaseTimeouts fields left at zero.
+const (
+	DefaultDownloadTimeout      = 10 * time.Minute
+	DefaultValidateTimeout      = 2 * time.Minute
+	DefaultStoreMetadataTimeout = 15 * time.Second
+)
+
+// PhaseTimeouts bounds the work done by each Download transition. Zero fields
+// use the Default*Timeout constants.
+type PhaseTimeouts struct {
+	Download      time.Duration // Fetching the object, including any resume
+	Validate      time.Duration // Checksum, tar structure and security checks
+	StoreMetadata time.Duration // Recording the downloaded image
+}
+
+func (t PhaseTimeouts) download() time.Duration { return orDefault(t.Download, DefaultDownloadTimeout) }
+
+func (t PhaseTimeouts) validate() time.Duration { return orDefault(t.Validate, DefaultValidateTimeout) }
+
+func (t PhaseTimeouts) storeMetadata() time.Duration {
+	return orDefault(t.StoreMetadata, DefaultStoreMetadataTimeout)
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// States of the Download FSM. They also key Dependencies.Retries, whose
+// missing entries use the MaxRetries* constants.
+const (
+	StateCheckExists   = "check-exists"
+	StateDownload      = "download"
+	StateValidate      = "validate"
+	StateStoreMetadata = "store-metadata"
+)
+
 // ImageDownloadRequest represents the request to download a container image from S3.
 //
 // Callers SHOULD NOT choose ImageID directly. Instead, they should derive a
@@ -64,8 +172,8 @@ func checkExists(deps *Dependencies) fsm.Transition[ImageDownloadRequest, ImageD
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for database operations
-		if retryCount > MaxRetriesCheckExists {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for check-exists transition", MaxRetriesCheckExists))
+		if limit := deps.Retries.Limit(StateCheckExists, MaxRetriesCheckExists); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for check-exists transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -88,10 +196,11 @@ func checkExists(deps *Dependencies) fsm.Transition[ImageDownloadRequest, ImageD
 		}
 
 		validateExisting := func(img *database.Image) (*fsm.Response[ImageDownloadResponse], error) {
+			stored := checksum.Checksum{Algo: checksum.Algo(img.ChecksumAlgo), Hex: img.Checksum}
 			logger.WithFields(map[string]any{
 				"image_id":   img.ImageID,
 				"local_path": img.LocalPath,
-				"checksum":   img.Checksum,
+				"checksum":   stored,
 			}).Info("image found in database, verifying file")
 
 			// Verify file exists
@@ -114,18 +223,22 @@ func checkExists(deps *Dependencies) fsm.Transition[ImageDownloadRequest, ImageD
 				return nil, nil
 			}
 
-			// Verify checksum if available
-			if img.Checksum != "" {
-				actualChecksum, err := computeFileChecksum(img.LocalPath)
+			// Verify checksum if available. A file that has not been written
+			// since the download was recorded still has the stored checksum.
+			if img.Checksum != "" && !deps.ParanoidVerify && unchangedSince(fileInfo, img.DownloadedAt) {
+				logger.Debug("file unchanged since download, skipping checksum")
+			} else if img.Checksum != "" {
+				sums, err := hashFile(img.LocalPath, stored.Algo)
 				if err != nil {
 					logger.WithError(err).Error("failed to compute checksum")
 					return nil, fmt.Errorf("failed to compute checksum: %w", err)
 				}
+				actual := sums[0]
 
-				if actualChecksum != img.Checksum {
+				if !actual.Matches(stored) {
 					logger.WithFields(map[string]any{
-						"expected": img.Checksum,
-						"actual":   actualChecksum,
+						"expected": stored,
+						"actual":   actual,
 					}).Warn("checksum mismatch, will re-download")
 					return nil, nil
 				}
@@ -137,6 +250,7 @@ func checkExists(deps *Dependencies) fsm.Transition[ImageDownloadRequest, ImageD
 				ImageID:      img.ImageID,
 				LocalPath:    img.LocalPath,
 				Checksum:     img.Checksum,
+				ChecksumAlgo: img.ChecksumAlgo,
 				SizeBytes:    img.SizeBytes,
 				Downloaded:   false,
 				AlreadyExist: true,
@@ -147,6 +261,25 @@ func checkExists(deps *Dependencies) fsm.Transition[ImageDownloadRequest, ImageD
 			return fsm.NewResponse(resp), fsm.Handoff(req.Run().StartVersion)
 		}
 
+		// A quarantined image failed security validation and is only
+		// processed again if the caller asked to release it.
+		releaseQuarantine := func(reason error) error {
+			if !deps.Unquarantine {
+				logger.WithError(reason).Warn("image is quarantined; pass --unquarantine to process it again")
+				return fsm.Abort(reason)
+			}
+			logger.WithError(reason).Warn("releasing image from quarantine")
+			if err := deps.DB.UnquarantineImage(ctx, imageID); err != nil {
+				return fmt.Errorf("failed to release image from quarantine: %w", err)
+			}
+			return nil
+		}
+
+		if existing != nil && existing.Quarantined() {
+			if err := releaseQuarantine(fmt.Errorf("%w: %s", database.ErrImageQuarantined, existing.QuarantineReason)); err != nil {
+				return nil, err
+			}
+		}
 		if existing != nil {
 			if resp, err := validateExisting(existing); err != nil || resp != nil {
 				return resp, err
@@ -155,7 +288,27 @@ func checkExists(deps *Dependencies) fsm.Transition[ImageDownloadRequest, ImageD
 
 		// No valid completed download; attempt to reserve a download slot in the
 		// database so that only one downloader is active for this S3 key.
-		if err := deps.DB.ReserveImageDownload(ctx, imageID, s3Key); err != nil {
+		reserve := deps.DB.ReserveImageDownload
+
+		// An interrupted download leaves a .part file behind. If no process holds
+		// it, take over the reservation and let the download transition resume
+		// from it instead of waiting for the stale threshold.
+		localPath := deps.localPath(imageID)
+		partial, err := s3.CheckPartialDownload(localPath)
+		if err != nil {
+			logger.WithError(err).Error("failed to check for partial download")
+			return nil, fmt.Errorf("partial download check failed: %w", err)
+		}
+		if partial.Exists {
+			if partial.InUse {
+				logger.Warn("partial download is being written by another process")
+				return nil, fsm.Abort(fmt.Errorf("download already in progress for %s", s3Key))
+			}
+			logger.WithField("partial_bytes", partial.Size).Info("found interrupted download, will resume")
+			reserve = deps.DB.ResumeImageDownload
+		}
+
+		if err := reserve(ctx, imageID, s3Key); err != nil {
 			switch {
 			case errors.Is(err, database.ErrDownloadAlreadyCompleted):
 				logger.Info("download already completed by another process; re-checking metadata")
@@ -171,6 +324,14 @@ func checkExists(deps *Dependencies) fsm.Transition[ImageDownloadRequest, ImageD
 			case errors.Is(err, database.ErrDownloadInProgress):
 				logger.WithError(err).Warn("another downloader is already in progress for this S3 key")
 				return nil, fsm.Abort(fmt.Errorf("download already in progress for %s", s3Key))
+			case errors.Is(err, database.ErrImageQuarantined):
+				if err := releaseQuarantine(err); err != nil {
+					return nil, err
+				}
+				if err := reserve(ctx, imageID, s3Key); err != nil {
+					logger.WithError(err).Error("failed to reserve download slot after release from quarantine")
+					return nil, fmt.Errorf("download reservation failed: %w", err)
+				}
 			default:
 				logger.WithError(err).Error("failed to reserve download slot")
 				return nil, fmt.Errorf("download reservation failed: %w", err)
@@ -182,20 +343,23 @@ func checkExists(deps *Dependencies) fsm.Transition[ImageDownloadRequest, ImageD
 	}
 }
 
-// computeFileChecksum computes the SHA256 checksum of a file.
-func computeFileChecksum(path string) (string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+// hashFile computes a file's checksums in one read. Tests replace it to count
+// full reads.
+var hashFile = checksum.FileAll
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
+// unchangedSince reports whether fi was last modified no later than
+// downloadedAt, i.e. the file is as it was when its checksum was recorded.
+func unchangedSince(fi os.FileInfo, downloadedAt *time.Time) bool {
+	return downloadedAt != nil && !fi.ModTime().After(*downloadedAt)
+}
 
-	return hex.EncodeToString(hash.Sum(nil)), nil
+// verifyObjectChecksum compares a file's SHA256 against the authoritative
+// checksum published by S3. An empty expected checksum is not an error.
+func verifyObjectChecksum(actual, expected string) error {
+	if expected == "" || strings.EqualFold(actual, expected) {
+		return nil
+	}
+	return fmt.Errorf("checksum mismatch with S3 object: expected %s, got %s", expected, actual)
 }
 
 // downloadFromS3 downloads the image from S3 to local storage.
@@ -205,65 +369,108 @@ func downloadFromS3(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Ima
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for S3 download operations
-		if retryCount > MaxRetriesDownload {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for download transition", MaxRetriesDownload))
+		if limit := deps.Retries.Limit(StateDownload, MaxRetriesDownload); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for download transition", limit))
 		}
 
 		if retryCount > 0 {
 			logger.WithField("retry_count", retryCount).Info("retrying download transition")
 		}
 
-		s3Key := req.Msg.S3Key
-		imageID := req.Msg.ImageID
-		bucket := req.Msg.Bucket
-		if bucket == "" {
-			bucket = deps.S3Bucket
+		resp, err := fetchImage(ctx, deps, req.Msg, logger)
+		if err != nil {
+			return nil, err
 		}
+		return fsm.NewResponse(resp), nil
+	}
+}
 
-		logger.WithFields(map[string]interface{}{
-			"s3_key":   s3Key,
-			"image_id": imageID,
-			"bucket":   bucket,
-		}).Info("downloading image from S3")
-
-		// Use generous timeout for S3 download (large images can take time)
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, 10*time.Minute)
-		defer cancel()
+// fetchImage downloads an image from the object store to its local path and
+// returns the response the download transition records. Errors the store
+// reports as permanent are returned as fsm.Abort.
+func fetchImage(ctx context.Context, deps *Dependencies, msg *ImageDownloadRequest, logger logrus.FieldLogger) (*ImageDownloadResponse, error) {
+	s3Key := msg.S3Key
+	imageID := msg.ImageID
+	bucket := msg.Bucket
+	if bucket == "" {
+		bucket = deps.S3Bucket
+	}
 
-		// Determine local path
-		localPath := filepath.Join(deps.LocalDir, fmt.Sprintf("%s.tar", imageID))
+	logger.WithFields(map[string]interface{}{
+		"s3_key":   s3Key,
+		"image_id": imageID,
+		"bucket":   bucket,
+	}).Info("downloading image from S3")
+
+	// Use generous timeout for S3 download (large images can take time)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, deps.Timeouts.download())
+	defer cancel()
+
+	// Determine local path, creating its shard directories if needed
+	localPath := deps.localPath(imageID)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		logger.WithError(err).Error("failed to create storage directory")
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
 
-		// Download from S3
-		result, err := deps.S3Client.DownloadImage(ctxWithTimeout, bucket, s3Key, localPath)
-		if err != nil {
-			logger.WithError(err).Error("S3 download failed")
-			// Check for specific error types
-			if isAccessDeniedError(err) {
-				return nil, fsm.Abort(fmt.Errorf("S3 access denied: %w", err))
+	// Download from S3, splitting large objects into parallel ranged requests
+	// when the store supports it. If the size lookup fails, fall back to the
+	// streaming download, which reports the underlying error itself. An
+	// interrupted download is always resumed with the streaming client,
+	// which picks up its .part file. A presigned URL, when given, replaces
+	// bucket and key for the download itself.
+	var (
+		result *s3.DownloadResult
+		err    error
+	)
+	if msg.PresignedURL != "" {
+		presigned, ok := deps.Store.(presignedStore)
+		if !ok {
+			return nil, fsm.Abort(fmt.Errorf("object store does not support presigned URL downloads"))
+		}
+		logger.Info("downloading from presigned URL")
+		result, err = presigned.DownloadImageFromURL(ctxWithTimeout, msg.PresignedURL, localPath)
+	} else {
+		download := deps.Store.DownloadImage
+		if multipart, ok := deps.Store.(multipartStore); ok {
+			partial, _ := s3.CheckPartialDownload(localPath)
+			if size, err := deps.Store.GetObjectSize(ctxWithTimeout, bucket, s3Key); err == nil && size > MultipartThreshold && !partial.Exists {
+				logger.WithField("size", size).Info("using multipart download")
+				download = multipart.DownloadImageMultipart
 			}
-			if isSizeLimitError(err) {
-				return nil, fsm.Abort(fmt.Errorf("file too large: %w", err))
-			}
-			return nil, fmt.Errorf("S3 download failed: %w", err)
 		}
-
-		logger.WithFields(map[string]interface{}{
-			"local_path": result.LocalPath,
-			"checksum":   result.Checksum,
-			"size":       result.SizeBytes,
-		}).Info("download completed")
-
-		// Store in response for next transition
-		resp := &ImageDownloadResponse{
-			ImageID:    imageID,
-			LocalPath:  result.LocalPath,
-			Checksum:   result.Checksum,
-			SizeBytes:  result.SizeBytes,
-			Downloaded: true,
+		result, err = download(ctxWithTimeout, bucket, s3Key, localPath)
+	}
+	if err != nil {
+		logger.WithError(err).Error("S3 download failed")
+		// Check for specific error types
+		if isAccessDeniedError(err) {
+			return nil, fsm.Abort(&AccessDeniedError{Bucket: bucket, Key: s3Key, Err: err})
 		}
-
-		return fsm.NewResponse(resp), nil
+		if isSizeLimitError(err) {
+			return nil, fsm.Abort(&SizeLimitError{Key: s3Key, Err: err})
+		}
+		if errors.Is(err, s3.ErrPartialInUse) {
+			return nil, fsm.Abort(fmt.Errorf("download already in progress: %w", err))
+		}
+		return nil, fmt.Errorf("S3 download failed: %w", err)
 	}
+
+	logger.WithFields(map[string]interface{}{
+		"local_path": result.LocalPath,
+		"checksum":   result.Checksum,
+		"size":       result.SizeBytes,
+	}).Info("download completed")
+
+	return &ImageDownloadResponse{
+		ImageID:          imageID,
+		LocalPath:        result.LocalPath,
+		Checksum:         result.Checksum,
+		ChecksumAlgo:     string(result.ChecksumAlgo),
+		ExpectedChecksum: result.ExpectedChecksum,
+		SizeBytes:        result.SizeBytes,
+		Downloaded:       true,
+	}, nil
 }
 
 // validateBlob validates the downloaded tarball for integrity and security.
@@ -273,24 +480,44 @@ func validateBlob(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Image
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for validation operations
-		if retryCount > MaxRetriesValidate {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for validate transition", MaxRetriesValidate))
+		if limit := deps.Retries.Limit(StateValidate, MaxRetriesValidate); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for validate transition", limit))
 		}
 
 		if retryCount > 0 {
 			logger.WithField("retry_count", retryCount).Info("retrying validate transition")
 		}
 
-		localPath := req.W.Msg.LocalPath
-		expectedChecksum := req.W.Msg.Checksum
+		// A checksum mismatch deletes the file and fails the attempt, so a
+		// retry that finds it missing downloads it again. The download
+		// reservation taken in check-exists is refreshed first so no other
+		// process takes the download over as stale meanwhile.
+		var resp *fsm.Response[ImageDownloadResponse]
+		msg := *req.W.Msg
+		if _, err := os.Stat(msg.LocalPath); retryCount > 0 && os.IsNotExist(err) {
+			logger.Info("re-downloading after checksum mismatch")
+			if err := deps.DB.ResumeImageDownload(ctx, req.Msg.ImageID, req.Msg.S3Key); err != nil {
+				logger.WithError(err).Error("failed to refresh download reservation")
+				return nil, fmt.Errorf("failed to refresh download reservation: %w", err)
+			}
+			fetched, err := fetchImage(ctx, deps, req.Msg, logger)
+			if err != nil {
+				return nil, err
+			}
+			msg = *fetched
+			resp = fsm.NewResponse(&msg)
+		}
+
+		localPath := msg.LocalPath
+		recorded := checksum.Checksum{Algo: checksum.Algo(msg.ChecksumAlgo), Hex: msg.Checksum}
 
 		logger.WithFields(map[string]interface{}{
 			"local_path": localPath,
-			"checksum":   expectedChecksum,
+			"checksum":   recorded,
 		}).Info("validating downloaded blob")
 
 		// Use timeout for validation operations (tarball scanning can take time)
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		ctxWithTimeout, cancel := context.WithTimeout(ctx, deps.Timeouts.validate())
 		defer cancel()
 
 		// Check if context already timed out
@@ -305,6 +532,16 @@ func validateBlob(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Image
 			return nil, fsm.Abort(fmt.Errorf("downloaded file not found: %w", err))
 		}
 
+		// A mismatch is usually a corrupt or truncated transfer: delete the
+		// file and retry, which downloads it again, until the retry limit.
+		mismatch := func(err error) error {
+			os.Remove(localPath)
+			if limit := deps.Retries.Limit(StateValidate, MaxRetriesValidate); retryCount >= limit {
+				return fsm.Abort(fmt.Errorf("%w (after %d downloads)", err, retryCount+1))
+			}
+			return err
+		}
+
 		// Verify file size is reasonable
 		if fileInfo.Size() == 0 {
 			logger.Error("file is empty")
@@ -313,21 +550,68 @@ func validateBlob(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Image
 
 		logger.WithField("size", fileInfo.Size()).Info("file size verified")
 
-		// Verify checksum (already computed during download, but double-check)
-		actualChecksum, err := computeFileChecksum(localPath)
-		if err != nil {
-			logger.WithError(err).Error("failed to compute checksum")
-			return nil, fmt.Errorf("checksum computation failed: %w", err)
+		// The download hashed the file as it was written. Only hash it again
+		// if that digest is missing or paranoid verification was requested.
+		// S3 publishes a SHA256, so a download hashed another way also needs
+		// one to compare against the object below. Whatever is needed is
+		// taken in a single read of the file.
+		localAlgo := recorded.Algo
+		if recorded.IsZero() {
+			localAlgo = deps.ChecksumAlgo
 		}
+		rehash := recorded.IsZero() || deps.ParanoidVerify
+		needSHA256 := msg.ExpectedChecksum != "" && localAlgo.OrDefault() != checksum.SHA256
 
-		if actualChecksum != expectedChecksum {
+		var algos []checksum.Algo
+		if rehash {
+			algos = append(algos, localAlgo)
+		}
+		if needSHA256 {
+			algos = append(algos, checksum.SHA256)
+		}
+		actual, published := recorded, recorded
+		if len(algos) > 0 {
+			sums, err := hashFile(localPath, algos...)
+			if err != nil {
+				logger.WithError(err).Error("failed to compute checksum")
+				return nil, fmt.Errorf("checksum computation failed: %w", err)
+			}
+			if rehash {
+				actual = sums[0]
+			}
+			published = actual
+			if needSHA256 {
+				published = sums[len(sums)-1]
+			}
+		}
+
+		if rehash {
+			if recorded.IsZero() {
+				// Carry the digest forward so store-metadata records it.
+				msg.Checksum = actual.Hex
+				msg.ChecksumAlgo = string(actual.Algo)
+				resp = fsm.NewResponse(&msg)
+			} else if !actual.Matches(recorded) {
+				logger.WithFields(map[string]interface{}{
+					"expected": recorded,
+					"actual":   actual,
+				}).Error("checksum mismatch")
+				return nil, mismatch(fmt.Errorf("checksum mismatch: expected %s, got %s", recorded, actual))
+			}
+		}
+
+		// Compare against the checksum S3 publishes for the object. The check
+		// above only catches local corruption; this one catches an object that
+		// was corrupted or truncated in S3 (or in transit).
+		if err := verifyObjectChecksum(published.Hex, msg.ExpectedChecksum); err != nil {
 			logger.WithFields(map[string]interface{}{
-				"expected": expectedChecksum,
-				"actual":   actualChecksum,
-			}).Error("checksum mismatch")
-			// Clean up corrupted file
-			os.Remove(localPath)
-			return nil, fsm.Abort(fmt.Errorf("checksum mismatch: expected %s, got %s", expectedChecksum, actualChecksum))
+				"expected": msg.ExpectedChecksum,
+				"actual":   published.Hex,
+			}).Error("S3 object checksum mismatch")
+			return nil, mismatch(err)
+		}
+		if msg.ExpectedChecksum == "" {
+			logger.Warn("S3 object publishes no SHA256 (ChecksumSHA256 or x-amz-meta-sha256); verified against local download only")
 		}
 
 		logger.Info("checksum verified")
@@ -342,18 +626,27 @@ func validateBlob(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Image
 
 		logger.Info("tar structure validated")
 
-		// Security checks: scan for path traversal and suspicious content
-		if err := performSecurityChecks(localPath); err != nil {
+		// Security checks: the same per-entry checks and limits extraction
+		// applies, so nothing is rejected later that could be caught here
+		if err := extraction.New().Validate(ctxWithTimeout, localPath, validationOptions(deps)); err != nil {
 			logger.WithError(err).Error("security validation failed")
 			// Clean up malicious file
 			os.Remove(localPath)
+			// Keep a hostile image from reappearing as available; limits and
+			// unreadable archives are not quarantined
+			if extraction.IsSecurityViolation(err) {
+				if qErr := deps.DB.QuarantineImage(ctx, req.Msg.ImageID, err.Error()); qErr != nil {
+					logger.WithError(qErr).Error("failed to quarantine image")
+				}
+			}
 			return nil, fsm.Abort(fmt.Errorf("security validation failed: %w", err))
 		}
 
 		logger.Info("security checks passed")
 
-		// Validation successful, pass through response
-		return nil, nil
+		// Validation successful; resp is nil unless the file was downloaded
+		// again or its checksum was filled in
+		return resp, nil
 	}
 }
 
@@ -364,8 +657,8 @@ func storeMetadata(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Imag
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for database operations
-		if retryCount > MaxRetriesStoreMetadata {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for store-metadata transition", MaxRetriesStoreMetadata))
+		if limit := deps.Retries.Limit(StateStoreMetadata, MaxRetriesStoreMetadata); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for store-metadata transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -375,23 +668,23 @@ func storeMetadata(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Imag
 		imageID := req.Msg.ImageID
 		s3Key := req.Msg.S3Key
 		localPath := req.W.Msg.LocalPath
-		checksum := req.W.Msg.Checksum
+		sum := checksum.Checksum{Algo: checksum.Algo(req.W.Msg.ChecksumAlgo).OrDefault(), Hex: req.W.Msg.Checksum}
 		sizeBytes := req.W.Msg.SizeBytes
 
 		logger.WithFields(map[string]interface{}{
 			"image_id":   imageID,
 			"s3_key":     s3Key,
 			"local_path": localPath,
-			"checksum":   checksum,
+			"checksum":   sum,
 			"size":       sizeBytes,
 		}).Info("storing image metadata in database")
 
 		// Use timeout for database operations
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, 15*time.Second)
+		ctxWithTimeout, cancel := context.WithTimeout(ctx, deps.Timeouts.storeMetadata())
 		defer cancel()
 
 		// Store in database
-		err := deps.DB.StoreImageMetadata(ctxWithTimeout, imageID, s3Key, localPath, checksum, sizeBytes)
+		err := deps.DB.StoreImageMetadata(ctxWithTimeout, imageID, s3Key, localPath, sum, sizeBytes)
 		if err != nil {
 			logger.WithError(err).Error("failed to store metadata")
 			return nil, fmt.Errorf("database update failed: %w", err)
@@ -403,7 +696,8 @@ func storeMetadata(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Imag
 		resp := &ImageDownloadResponse{
 			ImageID:      imageID,
 			LocalPath:    localPath,
-			Checksum:     checksum,
+			Checksum:     sum.Hex,
+			ChecksumAlgo: string(sum.Algo),
 			SizeBytes:    sizeBytes,
 			Downloaded:   true,
 			AlreadyExist: false,
@@ -413,46 +707,17 @@ func storeMetadata(deps *Dependencies) fsm.Transition[ImageDownloadRequest, Imag
 	}
 }
 
-// Helper functions
-
-func isAccessDeniedError(err error) bool {
-	if err == nil {
-		return false
-	}
-	errStr := err.Error()
-	return contains(errStr, "AccessDenied") || contains(errStr, "403") || contains(errStr, "Forbidden")
-}
-
-func isSizeLimitError(err error) bool {
-	if err == nil {
-		return false
-	}
-	return contains(err.Error(), "too large")
-}
-
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr || len(s) > len(substr) && (s[:len(substr)] == substr || s[len(s)-len(substr):] == substr || containsMiddle(s, substr)))
-}
-
-func containsMiddle(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
-		}
-	}
-	return false
-}
-
 // validateTarStructure validates that the file is a valid tar archive.
+// Gzip and zstd compressed tarballs are detected by magic bytes and decompressed.
 func validateTarStructure(path string) error {
-	file, err := os.Open(path)
+	stream, err := extraction.OpenTarStream(path, extraction.CompressionAuto)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
-	defer file.Close()
+	defer stream.Close()
 
 	// Try to read tar header
-	tarReader := tar.NewReader(file)
+	tarReader := tar.NewReader(stream)
 
 	// Read at least one header to verify it's a valid tar
 	_, err = tarReader.Next()
@@ -463,76 +728,31 @@ func validateTarStructure(path string) error {
 	return nil
 }
 
-// performSecurityChecks scans the tarball for malicious content.
-func performSecurityChecks(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+// validationOptions returns the extraction limits the security scan applies,
+// matching those unpack extracts with.
+func validationOptions(deps *Dependencies) extraction.ExtractionOptions {
+	opts := extraction.DefaultOptions()
+	opts.Timeout = 0 // bounded by the validate transition's timeout
+	if deps.MaxFiles > 0 {
+		opts.MaxFiles = deps.MaxFiles
 	}
-	defer file.Close()
-
-	tarReader := tar.NewReader(file)
-	fileCount := 0
-	const maxFiles = 100000
-
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error reading tar: %w", err)
-		}
-
-		fileCount++
-		if fileCount > maxFiles {
-			return fmt.Errorf("too many files in archive: %d (max %d)", fileCount, maxFiles)
-		}
-
-		// Check for path traversal
-		if strings.Contains(header.Name, "..") {
-			return fmt.Errorf("path traversal detected: %s", header.Name)
-		}
-
-		// Check for absolute paths
-		if filepath.IsAbs(header.Name) {
-			return fmt.Errorf("absolute path not allowed: %s", header.Name)
-		}
-
-		// Check for suspicious symlinks
-		if header.Typeflag == tar.TypeSymlink {
-			// For relative symlink targets, verify they don't escape the archive root.
-			if !filepath.IsAbs(header.Linkname) {
-				// Resolve the symlink relative to the symlink's directory
-				symlinkDir := filepath.Dir(header.Name)
-				resolvedPath := filepath.Join(symlinkDir, header.Linkname)
-				cleanedPath := filepath.Clean("/" + resolvedPath)
-				// If clean path doesn't start with /, it tried to escape
-				if !strings.HasPrefix(cleanedPath, "/") {
-					return fmt.Errorf("symlink escapes root: %s -> %s (resolves to %s)", header.Name, header.Linkname, cleanedPath)
-				}
-			}
-			// Absolute symlink targets are allowed (common in container images)
-		}
-
-		// Check file size
-		const maxFileSize = 1 * 1024 * 1024 * 1024 // 1GB
-		if header.Size > maxFileSize {
-			return fmt.Errorf("file too large: %s (%d bytes, max %d)", header.Name, header.Size, maxFileSize)
-		}
+	if deps.MaxTotalSize > 0 {
+		opts.MaxTotalSize = deps.MaxTotalSize
 	}
-
-	return nil
+	return opts
 }
 
 // Register registers the Download FSM with the manager.
 // Returns start and resume functions for the FSM.
 func Register(ctx context.Context, manager *fsm.Manager, deps *Dependencies) (fsm.Start[ImageDownloadRequest, ImageDownloadResponse], fsm.Resume, error) {
 	return fsm.Register[ImageDownloadRequest, ImageDownloadResponse](manager, "download-image").
-		Start("check-exists", checkExists(deps)).
-		To("download", downloadFromS3(deps)).
-		To("validate", validateBlob(deps)).
-		To("store-metadata", storeMetadata(deps)).
-		End("complete").
+		Start(StateCheckExists, checkExists(deps)).
+		To(StateDownload, downloadFromS3(deps)).
+		To(StateValidate, validateBlob(deps)).
+		To(StateStoreMetadata, storeMetadata(deps)).
+		// An image whose download aborts before its row is reserved has
+		// nowhere to record the reason; the error is still returned.
+		End("complete", fsm.WithFinalizers(fsm.RecordImageFailure[ImageDownloadRequest, ImageDownloadResponse](
+			"download", deps.DB, func(r *ImageDownloadRequest) string { return r.ImageID }))).
 		Build(ctx)
 }
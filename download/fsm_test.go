@@ -0,0 +1,352 @@
+package download
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	fsm "github.com/superfly/fsm"
+
+	"github.com/superfly/fsm/checksum"
+	"github.com/superfly/fsm/extraction"
+	"github.com/superfly/fsm/s3"
+)
+
+func TestVerifyObjectChecksum(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	tests := []struct {
+		name     string
+		actual   string
+		expected string
+		wantErr  bool
+	}{
+		{name: "match", actual: sum, expected: sum},
+		{name: "match case-insensitive", actual: sum, expected: strings.ToUpper(sum)},
+		{name: "no published checksum", actual: sum, expected: ""},
+		{name: "mismatch", actual: sum, expected: strings.Repeat("0", 64), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyObjectChecksum(tt.actual, tt.expected)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyObjectChecksum() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// blockingStore is an ObjectStore whose downloads block until ctx is done.
+type blockingStore struct{ memStore }
+
+func (b *blockingStore) DownloadImage(ctx context.Context, bucket, key, destPath string) (*s3.DownloadResult, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDownloadFromS3_Timeout(t *testing.T) {
+	deps := &Dependencies{
+		Store:    &blockingStore{},
+		S3Bucket: "images",
+		LocalDir: t.TempDir(),
+		Timeouts: PhaseTimeouts{Download: 50 * time.Millisecond},
+	}
+	req := fsm.MockRequest(&fsm.Request[ImageDownloadRequest, ImageDownloadResponse]{
+		Msg: &ImageDownloadRequest{S3Key: "golang/1.tar", ImageID: "img_1234abcd5678ef00"},
+	}, logrus.New(), fsm.Run{})
+
+	start := time.Now()
+	_, err := downloadFromS3(deps)(context.Background(), req)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("downloadFromS3() error = %v, want context.DeadlineExceeded", err)
+	}
+	var abortErr *fsm.AbortError
+	if errors.As(err, &abortErr) {
+		t.Errorf("downloadFromS3() aborted on a timeout, want a retryable error: %v", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("downloadFromS3() took %v, want it bounded by the 50ms timeout", elapsed)
+	}
+}
+
+// TestDownloadFromS3_RetryLimit verifies that the download entry of
+// Retries, not MaxRetriesDownload, decides when a retried download aborts.
+func TestDownloadFromS3_RetryLimit(t *testing.T) {
+	deps := &Dependencies{
+		Store:    &blockingStore{},
+		S3Bucket: "images",
+		LocalDir: t.TempDir(),
+		Timeouts: PhaseTimeouts{Download: 50 * time.Millisecond},
+		Retries:  fsm.RetryPolicy{StateDownload: 1},
+	}
+	req := fsm.MockRequest(&fsm.Request[ImageDownloadRequest, ImageDownloadResponse]{
+		Msg: &ImageDownloadRequest{S3Key: "golang/1.tar", ImageID: "img_1234abcd5678ef00"},
+	}, logrus.New(), fsm.Run{})
+	ctx := fsm.MockRetryContext(context.Background(), 2)
+	var abortErr *fsm.AbortError
+
+	_, err := downloadFromS3(deps)(ctx, req)
+	if !errors.As(err, &abortErr) {
+		t.Errorf("downloadFromS3() on retry 2 with limit 1 error = %v, want an abort", err)
+	}
+
+	// The default limit (5) still allows the second retry.
+	deps.Retries = nil
+	_, err = downloadFromS3(deps)(ctx, req)
+	if !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &abortErr) {
+		t.Errorf("downloadFromS3() on retry 2 with the default limit error = %v, want a retryable timeout", err)
+	}
+
+	// Raising the limit allows retries past the default.
+	deps.Retries = fsm.RetryPolicy{StateDownload: 10}
+	_, err = downloadFromS3(deps)(fsm.MockRetryContext(context.Background(), MaxRetriesDownload+1), req)
+	if errors.As(err, &abortErr) {
+		t.Errorf("downloadFromS3() on retry %d with limit 10 aborted: %v", MaxRetriesDownload+1, err)
+	}
+}
+
+// countHashes replaces hashFile for the test and returns a pointer to the
+// number of full-file hashes since.
+func countHashes(t *testing.T) *int {
+	n := new(int)
+	old := hashFile
+	hashFile = func(path string, algos ...checksum.Algo) ([]checksum.Checksum, error) {
+		*n++
+		return old(path, algos...)
+	}
+	t.Cleanup(func() { hashFile = old })
+	return n
+}
+
+func TestValidateBlob_HashCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		paranoid   bool
+		wantHashes int
+	}{
+		// The download's own digest is trusted.
+		{name: "normal", wantHashes: 1},
+		{name: "paranoid", paranoid: true, wantHashes: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashes := countHashes(t)
+			deps := &Dependencies{
+				// memStore hashes the object as it writes it, like s3.Client.
+				Store:          &memStore{objects: map[string][]byte{"images/golang/1.tar": testTarball(t)}},
+				S3Bucket:       "images",
+				LocalDir:       t.TempDir(),
+				ParanoidVerify: tt.paranoid,
+			}
+			req := fsm.MockRequest(&fsm.Request[ImageDownloadRequest, ImageDownloadResponse]{
+				Msg: &ImageDownloadRequest{S3Key: "golang/1.tar", ImageID: "img_1234abcd5678ef00"},
+			}, logrus.New(), fsm.Run{})
+
+			resp, err := downloadFromS3(deps)(context.Background(), req)
+			if err != nil {
+				t.Fatalf("downloadFromS3() error = %v", err)
+			}
+			*hashes++ // the hash taken during the download
+			req.W = *resp
+
+			if _, err := validateBlob(deps)(context.Background(), req); err != nil {
+				t.Fatalf("validateBlob() error = %v", err)
+			}
+			if *hashes != tt.wantHashes {
+				t.Errorf("file hashed %d times, want %d", *hashes, tt.wantHashes)
+			}
+		})
+	}
+}
+
+func TestValidateBlob_FillsMissingChecksum(t *testing.T) {
+	hashes := countHashes(t)
+	image := testTarball(t)
+	localPath := filepath.Join(t.TempDir(), "img.tar")
+	if err := os.WriteFile(localPath, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := fsm.MockRequest(&fsm.Request[ImageDownloadRequest, ImageDownloadResponse]{
+		Msg: &ImageDownloadRequest{S3Key: "golang/1.tar", ImageID: "img_1234abcd5678ef00"},
+		W:   fsm.Response[ImageDownloadResponse]{Msg: &ImageDownloadResponse{LocalPath: localPath}},
+	}, logrus.New(), fsm.Run{})
+
+	resp, err := validateBlob(&Dependencies{ChecksumAlgo: checksum.BLAKE3})(context.Background(), req)
+	if err != nil {
+		t.Fatalf("validateBlob() error = %v", err)
+	}
+	want, err := checksum.Reader(checksum.BLAKE3, bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || resp.Msg.Checksum != want.Hex || resp.Msg.ChecksumAlgo != "blake3" {
+		t.Errorf("validateBlob() response = %+v, want the computed blake3 checksum", resp)
+	}
+	if *hashes != 1 {
+		t.Errorf("file hashed %d times, want 1", *hashes)
+	}
+}
+
+func TestValidateBlob_ChecksumAlgo(t *testing.T) {
+	image := testTarball(t)
+	published := sha256.Sum256(image)
+
+	for _, algo := range checksum.Algos {
+		t.Run(string(algo), func(t *testing.T) {
+			good, err := checksum.Reader(algo, bytes.NewReader(image))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bad, err := checksum.Reader(algo, bytes.NewReader(append(image, 0)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name    string
+				sum     checksum.Checksum
+				wantErr bool
+			}{
+				{name: "match", sum: good},
+				{name: "mismatch", sum: bad, wantErr: true},
+				// The same digest recorded under another algorithm is not a match
+				{name: "wrong algorithm", sum: checksum.Checksum{Algo: "sha512", Hex: good.Hex}, wantErr: algo != checksum.SHA512},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					hashes := countHashes(t)
+					localPath := filepath.Join(t.TempDir(), "img.tar")
+					if err := os.WriteFile(localPath, image, 0644); err != nil {
+						t.Fatal(err)
+					}
+					req := fsm.MockRequest(&fsm.Request[ImageDownloadRequest, ImageDownloadResponse]{
+						Msg: &ImageDownloadRequest{S3Key: "golang/1.tar", ImageID: "img_1234abcd5678ef00"},
+						W: fsm.Response[ImageDownloadResponse]{Msg: &ImageDownloadResponse{
+							LocalPath:        localPath,
+							Checksum:         tt.sum.Hex,
+							ChecksumAlgo:     string(tt.sum.Algo),
+							ExpectedChecksum: hex.EncodeToString(published[:]),
+						}},
+					}, logrus.New(), fsm.Run{})
+
+					// Retries are disabled so a mismatch aborts at once
+					deps := &Dependencies{ParanoidVerify: true, Retries: fsm.RetryPolicy{StateValidate: -1}}
+					_, err := validateBlob(deps)(context.Background(), req)
+					if (err != nil) != tt.wantErr {
+						t.Fatalf("validateBlob() error = %v, wantErr %v", err, tt.wantErr)
+					}
+					if tt.wantErr && !strings.Contains(err.Error(), "checksum mismatch") {
+						t.Errorf("validateBlob() error = %v, want a checksum mismatch", err)
+					}
+					// The local and published digests come from one read
+					if *hashes != 1 {
+						t.Errorf("file hashed %d times, want 1", *hashes)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestUnchangedSince(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "img.tar")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later := fi.ModTime().Add(time.Second)
+	earlier := fi.ModTime().Add(-time.Second)
+	if !unchangedSince(fi, &later) {
+		t.Error("file written before the download was recorded reported as changed")
+	}
+	if unchangedSince(fi, &earlier) {
+		t.Error("file written after the download was recorded reported as unchanged")
+	}
+	if unchangedSince(fi, nil) {
+		t.Error("file with no recorded download time reported as unchanged")
+	}
+}
+
+// writeEntriesTar writes a tarball at path holding n empty files.
+func writeEntriesTar(t *testing.T, path string, n int) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for i := range n {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("file%d", i), Typeflag: tar.TypeReg, Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidationOptions_Limits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.tar")
+	writeEntriesTar(t, path, 5)
+
+	tests := []struct {
+		deps    Dependencies
+		wantErr bool
+	}{
+		{deps: Dependencies{MaxFiles: 5}},
+		{deps: Dependencies{MaxFiles: 4}, wantErr: true},
+		{deps: Dependencies{}}, // extraction defaults
+	}
+	for _, tt := range tests {
+		err := extraction.New().Validate(context.Background(), path, validationOptions(&tt.deps))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Validate(MaxFiles=%d) error = %v, wantErr %v", tt.deps.MaxFiles, err, tt.wantErr)
+		}
+	}
+
+	opts := validationOptions(&Dependencies{MaxTotalSize: 1 << 40})
+	if opts.MaxTotalSize != 1<<40 || opts.MaxFiles != extraction.DefaultMaxFiles {
+		t.Errorf("validationOptions() limits = %d files, %d bytes", opts.MaxFiles, opts.MaxTotalSize)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		imageID string
+		sharded bool
+		want    string
+	}{
+		{"flat", "img_abcdef0123", false, "/data/img_abcdef0123.tar"},
+		{"sharded", "img_abcdef0123", true, "/data/ab/cd/img_abcdef0123.tar"},
+		{"sharded without prefix", "abcdef0123", true, "/data/ab/cd/abcdef0123.tar"},
+		{"too short to shard", "img_abc", true, "/data/img_abc.tar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LocalPath("/data", tt.imageID, tt.sharded); got != tt.want {
+				t.Errorf("LocalPath() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
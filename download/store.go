@@ -0,0 +1,48 @@
+package download
+
+import (
+	"context"
+
+	"github.com/superfly/fsm/s3"
+)
+
+// ObjectStore is the object storage the Download FSM fetches images from.
+// *s3.Client is the default implementation; a MinIO or GCS client can be
+// dropped in without touching the FSM.
+//
+// Implementations should report a refused request as *AccessDeniedError (or
+// an error carrying a smithy API error code or a 403 status) and an oversized
+// object as an error wrapping s3.ErrObjectTooLarge, so the FSM aborts instead
+// of retrying.
+type ObjectStore interface {
+	// DownloadImage downloads bucket/key to destPath, resuming from the
+	// .part file left by an interrupted download if there is one.
+	DownloadImage(ctx context.Context, bucket, key, destPath string) (*s3.DownloadResult, error)
+
+	// GetObjectSize returns the size of bucket/key in bytes.
+	GetObjectSize(ctx context.Context, bucket, key string) (int64, error)
+
+	// SetProgressFunc sets the callback for download progress updates.
+	SetProgressFunc(fn s3.ProgressFunc)
+
+	// SuppressLogs disables the store's log output (used in TUI mode).
+	SuppressLogs()
+}
+
+// multipartStore is implemented by stores that can download large objects
+// with parallel ranged requests. Stores without it always use DownloadImage.
+type multipartStore interface {
+	DownloadImageMultipart(ctx context.Context, bucket, key, destPath string) (*s3.DownloadResult, error)
+}
+
+// presignedStore is implemented by stores that can download from a presigned
+// GET URL, for buckets we have no credentials for.
+type presignedStore interface {
+	DownloadImageFromURL(ctx context.Context, url, destPath string) (*s3.DownloadResult, error)
+}
+
+var (
+	_ ObjectStore    = (*s3.Client)(nil)
+	_ multipartStore = (*s3.Client)(nil)
+	_ presignedStore = (*s3.Client)(nil)
+)
@@ -0,0 +1,539 @@
+package download
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/sirupsen/logrus"
+	fsm "github.com/superfly/fsm"
+
+	"github.com/superfly/fsm/checksum"
+	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/s3"
+)
+
+// memStore is an in-memory ObjectStore. Objects are keyed by "bucket/key";
+// keys in denied fail the way S3 refuses a request.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	denied  map[string]bool
+	calls   int
+}
+
+func (m *memStore) DownloadImage(ctx context.Context, bucket, key, destPath string) (*s3.DownloadResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+
+	if m.denied[bucket+"/"+key] {
+		return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+	}
+	data, ok := m.objects[bucket+"/"+key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+
+	if err := os.WriteFile(destPath, data, 0644); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return &s3.DownloadResult{
+		LocalPath:        destPath,
+		Checksum:         hex.EncodeToString(sum[:]),
+		ExpectedChecksum: hex.EncodeToString(sum[:]),
+		SizeBytes:        int64(len(data)),
+	}, nil
+}
+
+// corruptingStore is a memStore whose first `corrupt` downloads arrive
+// truncated, the way a broken transfer does: the local digest covers the
+// truncated file while the object's published digest does not.
+type corruptingStore struct {
+	*memStore
+	corrupt int
+}
+
+func (c *corruptingStore) DownloadImage(ctx context.Context, bucket, key, destPath string) (*s3.DownloadResult, error) {
+	result, err := c.memStore.DownloadImage(ctx, bucket, key, destPath)
+	if err != nil || c.calls > c.corrupt {
+		return result, err
+	}
+	data, err := os.ReadFile(destPath)
+	if err != nil {
+		return nil, err
+	}
+	data = data[:len(data)/2]
+	if err := os.WriteFile(destPath, data, 0644); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	result.Checksum = hex.EncodeToString(sum[:])
+	result.SizeBytes = int64(len(data))
+	return result, nil
+}
+
+func (m *memStore) GetObjectSize(ctx context.Context, bucket, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[bucket+"/"+key]
+	if !ok {
+		return 0, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	return int64(len(data)), nil
+}
+
+func (m *memStore) SetProgressFunc(fn s3.ProgressFunc) {}
+
+func (m *memStore) SuppressLogs() {}
+
+// testTarball returns a small, valid image tarball.
+func testTarball(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, body := range map[string]string{
+		"rootfs/etc/hostname": "golang\n",
+		"rootfs/bin/app":      "#!/bin/sh\necho hi\n",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// runDownloadFSM registers the Download FSM against store and a fresh
+// database and runs one request to completion.
+func runDownloadFSM(t *testing.T, store ObjectStore, s3Key string) (*database.DB, string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := database.New(database.Config{Path: filepath.Join(dir, "images.db")})
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	localDir := filepath.Join(dir, "images")
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	localPath, err := runDownloadFSMWith(t, &Dependencies{DB: db, Store: store, LocalDir: localDir}, s3Key)
+	return db, localPath, err
+}
+
+// runDownloadFSMWith registers the Download FSM with deps, reading from the
+// "images" bucket, and runs one request to completion. It returns the image's
+// local path.
+func runDownloadFSMWith(t *testing.T, deps *Dependencies, s3Key string) (string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	manager, err := fsm.New(fsm.Config{
+		Logger: logger,
+		DBPath: filepath.Join(t.TempDir(), "fsm"),
+		Queues: map[string]int{"download": 1},
+	})
+	if err != nil {
+		t.Fatalf("fsm.New() error = %v", err)
+	}
+	defer manager.Shutdown(5 * time.Second)
+
+	deps.S3Bucket = "images"
+	start, _, err := Register(ctx, manager, deps)
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	imageID := fsm.DeriveImageIDFromS3Key(s3Key)
+	var resp ImageDownloadResponse
+	version, err := start(ctx, imageID, fsm.NewRequest(&ImageDownloadRequest{S3Key: s3Key, ImageID: imageID}, &resp), fsm.WithQueue("download"))
+	if err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	return deps.localPath(imageID), manager.Wait(ctx, version)
+}
+
+func TestDownloadFSM_MemStore(t *testing.T) {
+	image := testTarball(t)
+	store := &memStore{objects: map[string][]byte{"images/golang/1.tar": image}}
+
+	db, localPath, err := runDownloadFSM(t, store, "golang/1.tar")
+	if err != nil {
+		t.Fatalf("download FSM failed: %v", err)
+	}
+
+	got, err := os.ReadFile(localPath)
+	if err != nil || !bytes.Equal(got, image) {
+		t.Fatalf("downloaded file = %d bytes, err %v; want %d bytes", len(got), err, len(image))
+	}
+
+	img, err := db.CheckImageDownloaded(context.Background(), "golang/1.tar")
+	if err != nil || img == nil {
+		t.Fatalf("CheckImageDownloaded() = %v, %v", img, err)
+	}
+	sum := sha256.Sum256(image)
+	if img.Checksum != hex.EncodeToString(sum[:]) || img.SizeBytes != int64(len(image)) || img.LocalPath != localPath {
+		t.Errorf("stored metadata = %+v", img)
+	}
+}
+
+func TestDownloadFSM_MemStoreAccessDenied(t *testing.T) {
+	store := &memStore{
+		objects: map[string][]byte{"images/golang/1.tar": testTarball(t)},
+		denied:  map[string]bool{"images/golang/1.tar": true},
+	}
+
+	db, localPath, err := runDownloadFSM(t, store, "golang/1.tar")
+	if err == nil {
+		t.Fatal("download FSM succeeded, want access denied")
+	}
+	if store.calls != 1 {
+		t.Errorf("DownloadImage called %d times, want 1 (access denied must abort, not retry)", store.calls)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Errorf("local file exists after a refused download: %v", err)
+	}
+	if img, _ := db.CheckImageDownloaded(context.Background(), "golang/1.tar"); img != nil {
+		t.Errorf("image recorded as downloaded after a refused download: %+v", img)
+	}
+}
+
+// fakeDB is an in-memory DatabaseManager keyed by S3 key.
+type fakeDB struct {
+	mu       sync.Mutex
+	images   map[string]*database.Image // Completed downloads
+	reserved map[string]string          // S3 key -> image ID
+	errors   map[string]string          // Image ID -> recorded error
+
+	quarantined map[string]string // Image ID -> quarantine reason
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		images:   make(map[string]*database.Image),
+		reserved: make(map[string]string),
+		errors:   make(map[string]string),
+
+		quarantined: make(map[string]string),
+	}
+}
+
+func (f *fakeDB) CheckImageDownloaded(ctx context.Context, s3Key string) (*database.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := f.images[s3Key]
+	if img == nil {
+		return nil, nil
+	}
+	if reason, ok := f.quarantined[img.ImageID]; ok {
+		quarantined := *img
+		now := time.Now()
+		quarantined.QuarantineReason, quarantined.QuarantinedAt = reason, &now
+		return &quarantined, nil
+	}
+	return img, nil
+}
+
+func (f *fakeDB) ReserveImageDownload(ctx context.Context, imageID, s3Key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if reason, ok := f.quarantined[imageID]; ok {
+		return fmt.Errorf("%w: %s", database.ErrImageQuarantined, reason)
+	}
+	if f.images[s3Key] != nil {
+		return database.ErrDownloadAlreadyCompleted
+	}
+	f.reserved[s3Key] = imageID
+	return nil
+}
+
+func (f *fakeDB) ResumeImageDownload(ctx context.Context, imageID, s3Key string) error {
+	return f.ReserveImageDownload(ctx, imageID, s3Key)
+}
+
+func (f *fakeDB) StoreImageMetadata(ctx context.Context, imageID, s3Key, localPath string, sum checksum.Checksum, sizeBytes int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	f.images[s3Key] = &database.Image{
+		ImageID:      imageID,
+		S3Key:        s3Key,
+		LocalPath:    localPath,
+		Checksum:     sum.Hex,
+		ChecksumAlgo: string(sum.Algo),
+		SizeBytes:    sizeBytes,
+		DownloadedAt: &now,
+	}
+	delete(f.reserved, s3Key)
+	return nil
+}
+
+func (f *fakeDB) RecordImageError(ctx context.Context, imageID, reason string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[imageID] = reason
+	return nil
+}
+
+func (f *fakeDB) ClearImageError(ctx context.Context, imageID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.errors, imageID)
+	return nil
+}
+
+func (f *fakeDB) QuarantineImage(ctx context.Context, imageID, reason string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.quarantined[imageID] = reason
+	return nil
+}
+
+func (f *fakeDB) UnquarantineImage(ctx context.Context, imageID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.quarantined, imageID)
+	return nil
+}
+
+// TestDownloadFSM_FakeDB runs the whole Download FSM (check-exists →
+// download → validate → store-metadata) against memStore and fakeDB.
+func TestDownloadFSM_FakeDB(t *testing.T) {
+	const s3Key = "golang/1.tar"
+	image := testTarball(t)
+	sum := sha256.Sum256(image)
+	digest := checksum.Checksum{Algo: checksum.SHA256, Hex: hex.EncodeToString(sum[:])}
+
+	tests := []struct {
+		name       string
+		object     []byte
+		denied     bool
+		downloaded bool // The image is already on disk and recorded
+		wantErr    bool
+		wantCalls  int  // DownloadImage calls
+		wantStored bool // Metadata recorded for the image
+	}{
+		{name: "fresh download", object: image, wantCalls: 1, wantStored: true},
+		{name: "already downloaded", object: image, downloaded: true, wantCalls: 0, wantStored: true},
+		{name: "access denied", object: image, denied: true, wantErr: true, wantCalls: 1},
+		{name: "not a tarball", object: []byte("definitely not a tar archive"), wantErr: true, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localDir := t.TempDir()
+			imageID := fsm.DeriveImageIDFromS3Key(s3Key)
+			db := newFakeDB()
+			store := &memStore{objects: map[string][]byte{"images/" + s3Key: tt.object}}
+			if tt.denied {
+				store.denied = map[string]bool{"images/" + s3Key: true}
+			}
+			if tt.downloaded {
+				path := filepath.Join(localDir, imageID+".tar")
+				if err := os.WriteFile(path, image, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.StoreImageMetadata(context.Background(), imageID, s3Key, path, digest, int64(len(image))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			localPath, err := runDownloadFSMWith(t, &Dependencies{DB: db, Store: store, LocalDir: localDir}, s3Key)
+			// check-exists hands off a run whose image is already downloaded.
+			var handoff *fsm.HandoffError
+			if errors.As(err, &handoff) {
+				err = nil
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("download FSM error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if store.calls != tt.wantCalls {
+				t.Errorf("DownloadImage called %d times, want %d", store.calls, tt.wantCalls)
+			}
+
+			img, _ := db.CheckImageDownloaded(context.Background(), s3Key)
+			if (img != nil) != tt.wantStored {
+				t.Fatalf("stored metadata = %+v, wantStored %v", img, tt.wantStored)
+			}
+			if img != nil && (img.Checksum != digest.Hex || img.SizeBytes != int64(len(image)) || img.LocalPath != localPath) {
+				t.Errorf("stored metadata = %+v", img)
+			}
+			if _, recorded := db.errors[imageID]; recorded != tt.wantErr {
+				t.Errorf("image error recorded = %v (%q), want %v", recorded, db.errors[imageID], tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestDownloadFSM_ShardStorage verifies that a sharded download is stored
+// under its shard directories and found there by a later run.
+func TestDownloadFSM_ShardStorage(t *testing.T) {
+	const s3Key = "golang/1.tar"
+	image := testTarball(t)
+	localDir := t.TempDir()
+	db := newFakeDB()
+	store := &memStore{objects: map[string][]byte{"images/" + s3Key: image}}
+	deps := &Dependencies{DB: db, Store: store, LocalDir: localDir, ShardStorage: true}
+
+	localPath, err := runDownloadFSMWith(t, deps, s3Key)
+	if err != nil {
+		t.Fatalf("download FSM failed: %v", err)
+	}
+	imageID := fsm.DeriveImageIDFromS3Key(s3Key)
+	digits := strings.TrimPrefix(imageID, "img_")
+	if want := filepath.Join(localDir, digits[:2], digits[2:4], imageID+".tar"); localPath != want {
+		t.Fatalf("local path = %s, want %s", localPath, want)
+	}
+	if got, err := os.ReadFile(localPath); err != nil || !bytes.Equal(got, image) {
+		t.Fatalf("stored file = %d bytes, err %v; want %d bytes", len(got), err, len(image))
+	}
+	if img, _ := db.CheckImageDownloaded(context.Background(), s3Key); img == nil || img.LocalPath != localPath {
+		t.Fatalf("stored metadata = %+v, want local path %s", img, localPath)
+	}
+
+	// A second run finds the sharded file and does not download again.
+	_, err = runDownloadFSMWith(t, deps, s3Key)
+	var handoff *fsm.HandoffError
+	if err != nil && !errors.As(err, &handoff) {
+		t.Fatalf("second download FSM run failed: %v", err)
+	}
+	if store.calls != 1 {
+		t.Errorf("DownloadImage called %d times, want 1", store.calls)
+	}
+}
+
+// TestDownloadFSM_Quarantine verifies that a tarball with path traversal
+// leaves the image quarantined, that a later run does not download it again,
+// and that Unquarantine releases it.
+func TestDownloadFSM_Quarantine(t *testing.T) {
+	const s3Key = "golang/1.tar"
+	imageID := fsm.DeriveImageIDFromS3Key(s3Key)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	body := "root::0:0:root:/root:/bin/sh\n"
+	if err := tw.WriteHeader(&tar.Header{Name: "../../etc/passwd", Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.New(database.Config{Path: filepath.Join(t.TempDir(), "images.db")})
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store := &memStore{objects: map[string][]byte{"images/" + s3Key: buf.Bytes()}}
+	deps := &Dependencies{DB: db, Store: store, LocalDir: t.TempDir()}
+
+	localPath, err := runDownloadFSMWith(t, deps, s3Key)
+	if err == nil {
+		t.Fatal("download FSM accepted a tarball with path traversal")
+	}
+	img, err := db.GetImageByID(context.Background(), imageID)
+	if err != nil || img == nil {
+		t.Fatalf("GetImageByID() = %+v, %v", img, err)
+	}
+	if !img.Quarantined() || !strings.Contains(img.QuarantineReason, "path traversal") {
+		t.Fatalf("image quarantined = %v (%q), want quarantined for path traversal", img.Quarantined(), img.QuarantineReason)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Errorf("rejected download left on disk: %v", err)
+	}
+
+	// Reprocessing is refused before anything is downloaded
+	_, err = runDownloadFSMWith(t, deps, s3Key)
+	if !errors.Is(err, database.ErrImageQuarantined) {
+		t.Fatalf("second run error = %v, want ErrImageQuarantined", err)
+	}
+	if store.calls != 1 {
+		t.Errorf("DownloadImage called %d times, want 1", store.calls)
+	}
+
+	// Released, a fixed object downloads normally
+	store.objects["images/"+s3Key] = testTarball(t)
+	deps.Unquarantine = true
+	if _, err := runDownloadFSMWith(t, deps, s3Key); err != nil {
+		t.Fatalf("run with Unquarantine error = %v", err)
+	}
+	if img, _ := db.CheckImageDownloaded(context.Background(), s3Key); img == nil || img.Quarantined() {
+		t.Errorf("image after release = %+v, want downloaded and not quarantined", img)
+	}
+}
+
+// TestDownloadFSM_ChecksumMismatchRedownloads verifies that a corrupt transfer
+// is downloaded again, and that the run aborts once every allowed attempt
+// is corrupt.
+func TestDownloadFSM_ChecksumMismatchRedownloads(t *testing.T) {
+	const s3Key = "golang/1.tar"
+	image := testTarball(t)
+
+	tests := []struct {
+		name      string
+		corrupt   int
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "corrupt then good", corrupt: 1, wantCalls: 2},
+		{name: "corrupt until the last retry", corrupt: MaxRetriesValidate, wantCalls: MaxRetriesValidate + 1},
+		{name: "always corrupt", corrupt: 100, wantErr: true, wantCalls: MaxRetriesValidate + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			store := &corruptingStore{memStore: &memStore{objects: map[string][]byte{"images/" + s3Key: image}}, corrupt: tt.corrupt}
+
+			localPath, err := runDownloadFSMWith(t, &Dependencies{DB: db, Store: store, LocalDir: t.TempDir()}, s3Key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("download FSM error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if store.calls != tt.wantCalls {
+				t.Errorf("DownloadImage called %d times, want %d", store.calls, tt.wantCalls)
+			}
+
+			img, _ := db.CheckImageDownloaded(context.Background(), s3Key)
+			if tt.wantErr {
+				if img != nil {
+					t.Errorf("corrupt download recorded: %+v", img)
+				}
+				if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+					t.Errorf("corrupt file kept: %v", err)
+				}
+				return
+			}
+			if got, err := os.ReadFile(localPath); err != nil || !bytes.Equal(got, image) {
+				t.Fatalf("stored file = %d bytes, err %v; want %d bytes", len(got), err, len(image))
+			}
+			sum := sha256.Sum256(image)
+			if img == nil || img.Checksum != hex.EncodeToString(sum[:]) || img.SizeBytes != int64(len(image)) {
+				t.Errorf("stored metadata = %+v, want the good download", img)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package extraction
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies how a tarball is compressed.
+type Compression string
+
+const (
+	// CompressionAuto detects compression from the file's magic bytes.
+	CompressionAuto Compression = ""
+	// CompressionNone is a plain, uncompressed tar archive.
+	CompressionNone Compression = "none"
+	// CompressionGzip is a gzip-compressed tar archive (.tar.gz).
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd is a zstd-compressed tar archive (.tar.zst).
+	CompressionZstd Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DetectCompression inspects the leading magic bytes of r without consuming them.
+// Anything that is not gzip or zstd is treated as an uncompressed tar.
+func DetectCompression(r *bufio.Reader) (Compression, error) {
+	magic, err := r.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read magic bytes: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CompressionZstd, nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CompressionGzip, nil
+	default:
+		return CompressionNone, nil
+	}
+}
+
+// OpenTarStream opens a tarball and returns a reader over the uncompressed tar stream.
+// With CompressionAuto the compression is detected from the magic bytes.
+// The caller must Close the returned reader.
+func OpenTarStream(path string, compression Compression) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tarball: %w", err)
+	}
+
+	stream, err := newTarStream(file, compression)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	stream.closers = append(stream.closers, file)
+	return stream, nil
+}
+
+// newTarStream returns a reader over the uncompressed tar stream read from r.
+// Closing it releases the decompressor but leaves r open.
+func newTarStream(r io.Reader, compression Compression) (*tarStream, error) {
+	br := bufio.NewReader(r)
+	if compression == CompressionAuto {
+		var err error
+		compression, err = DetectCompression(br)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch compression {
+	case CompressionNone:
+		return &tarStream{Reader: br}, nil
+
+	case CompressionGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip stream: %w", err)
+		}
+		return &tarStream{Reader: gz, closers: []io.Closer{gz}}, nil
+
+	case CompressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd stream: %w", err)
+		}
+		zrc := zr.IOReadCloser()
+		return &tarStream{Reader: zrc, closers: []io.Closer{zrc}}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported compression %q (want none, gzip, or zstd)", compression)
+	}
+}
+
+// tarStream couples a decompressing reader with the resources it reads from.
+type tarStream struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close releases the decompressor and then the underlying file, if any.
+func (s *tarStream) Close() error {
+	var firstErr error
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -8,8 +8,10 @@
 //
 //   - Path traversal prevention (rejects ".." and absolute paths)
 //   - Symlink validation (ensures targets stay within extraction root)
+//   - Hardlink validation (targets must resolve inside extraction root)
 //   - Resource limits (file size, total size, file count, timeout)
 //   - Dangerous permissions rejection (setuid/setgid bits)
+//   - Device nodes only under dev/, and only when AllowDeviceNodes is set
 //   - Atomic extraction with cleanup on failure
 //
 // # Threat Model
@@ -49,6 +51,27 @@
 //
 // These limits prevent resource exhaustion from malicious archives.
 //
+// # Compression
+//
+// Gzip and zstd tarballs are detected by magic bytes and decompressed on the fly;
+// set ExtractionOptions.Compression to override detection.
+//
+// # Streaming
+//
+// ExtractReader extracts from an io.Reader instead of a file, so an S3 body can
+// be unpacked as it arrives rather than written to disk and read back. To keep
+// a checksum (or a copy on disk), wrap the body in an io.TeeReader; the reader
+// is consumed to EOF on success. Streaming gives up the header pre-scan, so
+// progress totals come from ExtractionOptions.TotalBytes.
+//
+// # Validation
+//
+// Validate runs the same per-entry checks and limits as Extract over the
+// archive headers without writing anything, so a download can be rejected
+// before a device is allocated for it. Extract applies those checks inline as
+// it reads each header rather than in a separate pass, so an archive that
+// passed Validate is extracted in a single read with identical results.
+//
 // # Error Handling
 //
 // Security violations return descriptive errors that should be treated as
@@ -59,19 +82,26 @@ package extraction
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
-// ProgressFunc is called periodically during extraction with progress updates
-type ProgressFunc func(filesExtracted int, bytesExtracted int64, currentFile string)
+// ProgressFunc is called periodically during extraction with progress updates.
+// totalBytes is the uncompressed size of all regular files in the archive, or 0 if unknown.
+type ProgressFunc func(filesExtracted int, bytesExtracted, totalBytes int64, currentFile string)
 
 // Extractor handles secure tarball extraction.
 type Extractor struct {
@@ -118,16 +148,59 @@ type ExtractionOptions struct {
 
 	// StripComponents strips N leading components from file names
 	StripComponents int
+
+	// Compression of the tarball (default: detected from magic bytes)
+	Compression Compression
+
+	// PreserveOwnership applies each entry's uid/gid from the tar header
+	// (default: true when running as root)
+	PreserveOwnership bool
+
+	// TotalBytes is the uncompressed size of the archive's regular files, reported to
+	// the progress callback. If zero and a progress callback is set, Extract pre-scans
+	// the archive headers to compute it.
+	TotalBytes int64
+
+	// OCIWhiteouts interprets OCI layer whiteout markers when extracting layers
+	// on top of each other: ".wh.<name>" removes <name> from the destination and
+	// ".wh..wh..opq" clears the contents of its directory from earlier layers.
+	OCIWhiteouts bool
+
+	// AllowDeviceNodes creates character and block device entries under dev/
+	// with mknod, which requires root (default: false, device entries are skipped)
+	AllowDeviceNodes bool
+
+	// BestEffort skips entries that fail to extract, recording them in
+	// ExtractionResult.SkippedEntries, instead of failing the whole archive.
+	// Security violations (setuid/setgid bits, oversized files, devices outside
+	// dev/, link targets escaping destDir) and size/count limits still fail.
+	BestEffort bool
+
+	// WriteConcurrency is how many regular files are written at once (default:
+	// 1, in archive order). Above 1, files up to 4MB are read from the archive
+	// and written by a pool of workers; directories, links, devices and
+	// whiteouts are still created in archive order, after any pending write
+	// they depend on. Results match a sequential extraction.
+	WriteConcurrency int
 }
 
+// Default extraction limits. The download FSM's pre-extraction scan applies
+// the same file count and size limits so it never rejects what unpack accepts.
+const (
+	DefaultMaxFileSize  = 1 * 1024 * 1024 * 1024  // 1GB
+	DefaultMaxTotalSize = 10 * 1024 * 1024 * 1024 // 10GB
+	DefaultMaxFiles     = 100000
+)
+
 // DefaultOptions returns default extraction options.
 func DefaultOptions() ExtractionOptions {
 	return ExtractionOptions{
-		MaxFileSize:     1 * 1024 * 1024 * 1024,  // 1GB
-		MaxTotalSize:    10 * 1024 * 1024 * 1024, // 10GB
-		MaxFiles:        100000,
-		Timeout:         30 * time.Minute,
-		StripComponents: 0,
+		MaxFileSize:       DefaultMaxFileSize,
+		MaxTotalSize:      DefaultMaxTotalSize,
+		MaxFiles:          DefaultMaxFiles,
+		Timeout:           30 * time.Minute,
+		StripComponents:   0,
+		PreserveOwnership: os.Geteuid() == 0,
 	}
 }
 
@@ -141,6 +214,43 @@ type ExtractionResult struct {
 
 	// Duration is how long the extraction took
 	Duration time.Duration
+
+	// SkippedEntries lists the entries that failed to extract with
+	// ExtractionOptions.BestEffort set, in archive order
+	SkippedEntries []EntryError
+}
+
+// EntryError is an archive entry skipped by a best-effort extraction.
+type EntryError struct {
+	Path string // Entry name in the archive
+	Err  error
+}
+
+func (e EntryError) Error() string { return e.Err.Error() }
+
+func (e EntryError) Unwrap() error { return e.Err }
+
+// unsafeEntryError marks an entry error as a security violation, which fails
+// the extraction even with ExtractionOptions.BestEffort set.
+type unsafeEntryError struct{ error }
+
+func (e unsafeEntryError) Unwrap() error { return e.error }
+
+// permissionError marks an entry or tree rejected for dangerous permissions:
+// setuid or setgid bits, or a world-writable critical directory. Unlike an
+// unsafeEntryError, BestEffort may still skip such an entry.
+type permissionError struct{ error }
+
+func (e permissionError) Unwrap() error { return e.error }
+
+// IsSecurityViolation reports whether err, returned by Validate, Extract or
+// VerifyLayout, rejects the tarball as hostile (path traversal, an escaping
+// link, a setuid or setgid entry, a world-writable critical directory) rather
+// than for a limit, a malformed archive or an I/O failure.
+func IsSecurityViolation(err error) bool {
+	var unsafe unsafeEntryError
+	var perm permissionError
+	return errors.As(err, &unsafe) || errors.As(err, &perm)
 }
 
 // Extract extracts a tarball to a destination directory with security checks.
@@ -161,19 +271,274 @@ func (e *Extractor) Extract(ctx context.Context, tarPath, destDir string, opts E
 		defer cancel()
 	}
 
-	// Open tarball
-	file, err := os.Open(tarPath)
+	// Pre-scan headers so progress can be reported as a percentage
+	totalBytes := opts.TotalBytes
+	if totalBytes <= 0 && e.progressFunc != nil {
+		scanned, err := ScanTotalBytes(ctx, tarPath, opts.Compression)
+		if err != nil {
+			// Not fatal: the extraction pass below reports the real error, if any
+			logger.WithError(err).Debug("pre-scan failed, progress total unknown")
+		} else {
+			totalBytes = scanned
+		}
+	}
+
+	// Open tarball, decompressing gzip/zstd if needed
+	stream, err := OpenTarStream(tarPath, opts.Compression)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open tarball: %w", err)
+		return nil, err
 	}
-	defer file.Close()
+	defer stream.Close()
+
+	return e.extract(ctx, logger, stream, destDir, opts, totalBytes, startTime)
+}
+
+// ExtractReader extracts a tar stream, such as an S3 response body, to a
+// destination directory with the same security checks as Extract. Nothing is
+// written to disk besides the extracted entries.
+//
+// The stream cannot be pre-scanned, so the progress total is opts.TotalBytes
+// (0 if unknown). On success r has been read to EOF, so a tee on r (e.g. a
+// hash of the downloaded object) has seen every byte. r is not closed.
+func (e *Extractor) ExtractReader(ctx context.Context, r io.Reader, destDir string, opts ExtractionOptions) (*ExtractionResult, error) {
+	startTime := time.Now()
+
+	logger := e.logger.WithFields(logrus.Fields{
+		"tar":  "(stream)",
+		"dest": destDir,
+	})
+
+	logger.Info("starting streaming extraction")
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	stream, err := newTarStream(r, opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	result, err := e.extract(ctx, logger, stream, destDir, opts, opts.TotalBytes, startTime)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tar reader stops at the end-of-archive marker; read the padding
+	// and anything after it so the caller's view of r is complete.
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return nil, fmt.Errorf("failed to read to end of stream: %w", err)
+	}
+	return result, nil
+}
+
+// validateRoot stands in for the destination directory when Validate checks
+// an archive without extracting it. Paths are only compared, never touched.
+const validateRoot = "/validate"
+
+// Validate reads every header in a tarball and applies the checks Extract
+// would, without extracting anything: the per-entry security checks and the
+// file count and total size limits in opts. It returns the first violation,
+// or an error if the archive cannot be read.
+func (e *Extractor) Validate(ctx context.Context, tarPath string, opts ExtractionOptions) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	stream, err := OpenTarStream(tarPath, opts.Compression)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	tarReader := tar.NewReader(stream)
+	var files int
+	var bytes int64
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("validation cancelled: %w", ctx.Err())
+		default:
+		}
+
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		targetPath, skip, err := e.checkEntry(validateRoot, header, opts)
+		if err != nil {
+			return fmt.Errorf("security validation failed for %s: %w", header.Name, err)
+		}
+		if skip || (opts.OCIWhiteouts && strings.HasPrefix(filepath.Base(targetPath), whiteoutPrefix)) {
+			continue
+		}
+
+		// Same limits, checked at the same point, as extract
+		if files >= opts.MaxFiles {
+			return fmt.Errorf("file count limit exceeded: %d", opts.MaxFiles)
+		}
+		if bytes+header.Size > opts.MaxTotalSize {
+			return fmt.Errorf("total size limit exceeded: %d bytes", opts.MaxTotalSize)
+		}
+		if extractable(header, opts) {
+			files++
+			if header.Typeflag == tar.TypeReg {
+				bytes += header.Size
+			}
+		}
+	}
+}
 
+// extractable reports whether extract creates an entry of this type, and so
+// counts it toward MaxFiles; other entries are skipped with a warning.
+func extractable(header *tar.Header, opts ExtractionOptions) bool {
+	switch header.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+		return true
+	case tar.TypeChar, tar.TypeBlock:
+		return opts.AllowDeviceNodes
+	}
+	return false
+}
+
+// extract writes the entries of an uncompressed tar stream to destDir.
+func (e *Extractor) extract(ctx context.Context, logger logrus.FieldLogger, stream io.Reader, destDir string, opts ExtractionOptions, totalBytes int64, startTime time.Time) (*ExtractionResult, error) {
 	// Create tar reader
-	tarReader := tar.NewReader(file)
+	tarReader := tar.NewReader(stream)
+
+	// Track extraction stats. Regular files may be written on worker
+	// goroutines (see WriteConcurrency), so the totals are atomic.
+	var filesExtracted, bytesExtracted atomic.Int64
+
+	// Write regular files concurrently when asked; totals then include
+	// writes in flight so limits are checked as if they had finished
+	var writer *fileWriter
+	totals := func() (int64, int64) {
+		return filesExtracted.Load(), bytesExtracted.Load()
+	}
+	if opts.WriteConcurrency > 1 {
+		writer = newFileWriter(opts.WriteConcurrency, &filesExtracted, &bytesExtracted)
+		defer writer.Wait()
+		totals = writer.Totals
+	}
+
+	// Hardlinks whose target appears later in the archive are created in a second pass
+	var pendingLinks []*tar.Header
 
-	// Track extraction stats
-	var filesExtracted int
-	var bytesExtracted int64
+	// Paths created by this extraction; whiteouts only apply to earlier layers.
+	// Whiteouts wait for pending writes, so only marking needs the lock.
+	var extracted map[string]bool
+	var extractedMu sync.Mutex
+	if opts.OCIWhiteouts {
+		extracted = make(map[string]bool)
+	}
+	markExtracted := func(targetPath string) {
+		if extracted == nil {
+			return
+		}
+		extractedMu.Lock()
+		defer extractedMu.Unlock()
+		// Mark implicitly created parents too, so an opaque whiteout keeps them
+		root := filepath.Clean(destDir)
+		for p := targetPath; p != root && !extracted[p]; p = filepath.Dir(p) {
+			extracted[p] = true
+		}
+	}
+
+	// Apply tar ownership to created entries. If we are not privileged to chown,
+	// warn once and leave the remaining entries owned by the current user.
+	var preserveOwnership atomic.Bool
+	preserveOwnership.Store(opts.PreserveOwnership)
+	applyOwnership := func(path string, header *tar.Header) error {
+		if !preserveOwnership.Load() {
+			return nil
+		}
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				if preserveOwnership.CompareAndSwap(true, false) {
+					logger.WithError(err).Warn("not permitted to preserve file ownership; extracted files will be owned by the current user")
+				}
+				return nil
+			}
+			return fmt.Errorf("failed to set ownership of %s: %w", header.Name, err)
+		}
+		return nil
+	}
+
+	// In best-effort mode a failed entry is logged and skipped instead of
+	// failing the archive. A partially written regular file is removed so
+	// skipped files are absent rather than truncated. Entries are numbered in
+	// archive order so skips reported by write workers can be put back in it.
+	type skippedEntry struct {
+		seq int
+		EntryError
+	}
+	var skipped []skippedEntry
+	var skippedMu sync.Mutex
+	var seq int
+	skipEntry := func(seq int, header *tar.Header, targetPath string, err error) error {
+		var unsafe unsafeEntryError
+		if !opts.BestEffort || errors.As(err, &unsafe) {
+			return err
+		}
+		logger.WithError(err).WithField("path", header.Name).Warn("skipping entry that failed to extract")
+		if header.Typeflag == tar.TypeReg {
+			os.Remove(targetPath)
+		}
+		skippedMu.Lock()
+		skipped = append(skipped, skippedEntry{seq: seq, EntryError: EntryError{Path: header.Name, Err: err}})
+		skippedMu.Unlock()
+		return nil
+	}
+
+	// writeFile writes a regular file from r, returning the bytes written and
+	// the entry's error after skipEntry.
+	writeFile := func(seq int, targetPath string, header *tar.Header, r io.Reader) (int64, error) {
+		size, err := e.extractFile(targetPath, header, r, opts.MaxFileSize)
+		if err != nil {
+			err = fmt.Errorf("failed to extract file %s: %w", header.Name, err)
+		} else {
+			err = applyOwnership(targetPath, header)
+		}
+		if err != nil {
+			if err := skipEntry(seq, header, targetPath, err); err != nil {
+				return size, err
+			}
+			return size, errEntrySkipped
+		}
+		markExtracted(targetPath)
+		return size, nil
+	}
+
+	// Progress is reported each time another 100 files have been extracted
+	nextProgress := int64(100)
+	reportProgress := func(currentFile string) {
+		if e.progressFunc == nil {
+			return
+		}
+		if n := filesExtracted.Load(); n >= nextProgress {
+			e.progressFunc(int(n), bytesExtracted.Load(), totalBytes, currentFile)
+			nextProgress = n - n%100 + 100
+		}
+	}
+
+	// waitForWrites blocks until pending writes finish, so the next entry
+	// sees them on disk. It is a no-op for sequential extraction.
+	waitForWrites := func() error {
+		if writer == nil {
+			return nil
+		}
+		return writer.Wait()
+	}
 
 	// Ensure destination directory exists
 	if err := os.MkdirAll(destDir, 0755); err != nil {
@@ -189,6 +554,13 @@ func (e *Extractor) Extract(ctx context.Context, tarPath, destDir string, opts E
 		default:
 		}
 
+		// Stop at the first write that failed on a worker
+		if writer != nil {
+			if err := writer.Err(); err != nil {
+				return nil, err
+			}
+		}
+
 		// Read next header
 		header, err := tarReader.Next()
 		if err == io.EOF {
@@ -197,46 +569,114 @@ func (e *Extractor) Extract(ctx context.Context, tarPath, destDir string, opts E
 		if err != nil {
 			return nil, fmt.Errorf("failed to read tar header: %w", err)
 		}
+		seq++
 
-		// Validate and sanitize path
-		targetPath, err := e.sanitizePath(destDir, header.Name, opts.StripComponents)
+		// Security checks, shared with Validate
+		targetPath, skip, err := e.checkEntry(destDir, header, opts)
 		if err != nil {
-			logger.WithField("path", header.Name).Warn("skipping invalid path")
-			continue // Skip invalid paths
+			return nil, fmt.Errorf("security validation failed for %s: %w", header.Name, err)
+		}
+		if skip {
+			logger.WithField("path", header.Name).Debug("skipping entry removed by StripComponents")
+			continue
 		}
 
-		// Security checks
-		if err := e.validateHeader(header, opts); err != nil {
-			return nil, fmt.Errorf("security validation failed for %s: %w", header.Name, err)
+		// OCI whiteouts delete content from earlier layers and are not extracted
+		// themselves. They may remove whole trees, so pending writes finish first.
+		if opts.OCIWhiteouts && strings.HasPrefix(filepath.Base(targetPath), whiteoutPrefix) {
+			if err := waitForWrites(); err != nil {
+				return nil, err
+			}
+			if err := e.applyWhiteout(targetPath, extracted); err != nil {
+				if err := skipEntry(seq, header, targetPath, fmt.Errorf("failed to apply whiteout %s: %w", header.Name, err)); err != nil {
+					return nil, err
+				}
+			}
+			continue
 		}
 
+		files, written := totals()
+
 		// Check file count limit
-		if filesExtracted >= opts.MaxFiles {
+		if files >= int64(opts.MaxFiles) {
 			return nil, fmt.Errorf("file count limit exceeded: %d", opts.MaxFiles)
 		}
 
 		// Check total size limit
-		if bytesExtracted+header.Size > opts.MaxTotalSize {
+		if written+header.Size > opts.MaxTotalSize {
 			return nil, fmt.Errorf("total size limit exceeded: %d bytes", opts.MaxTotalSize)
 		}
 
+		// An entry at, above or below a pending write waits for it, and a
+		// hardlink waits for every pending write since its target may be one
+		if writer != nil && (header.Typeflag == tar.TypeLink || writer.Overlaps(targetPath)) {
+			if err := writer.Wait(); err != nil {
+				return nil, err
+			}
+		}
+
 		// Extract based on type
+		var entryErr error
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := e.extractDir(targetPath, header); err != nil {
-				return nil, fmt.Errorf("failed to extract directory %s: %w", header.Name, err)
+				entryErr = fmt.Errorf("failed to extract directory %s: %w", header.Name, err)
+			} else {
+				entryErr = applyOwnership(targetPath, header)
 			}
 
 		case tar.TypeReg:
-			size, err := e.extractFile(targetPath, header, tarReader, opts.MaxFileSize)
+			if writer != nil && header.Size <= maxConcurrentFileSize {
+				// The archive can only be read in order, so read the contents
+				// here and hand them to a worker
+				data := make([]byte, header.Size)
+				if _, err := io.ReadFull(tarReader, data); err != nil {
+					entryErr = fmt.Errorf("failed to extract file %s: failed to read file: %w", header.Name, err)
+					break
+				}
+				entrySeq := seq
+				writer.Go(targetPath, header.Size, func() (int64, error) {
+					return writeFile(entrySeq, targetPath, header, bytes.NewReader(data))
+				})
+				reportProgress(header.Name)
+				continue
+			}
+			size, err := writeFile(seq, targetPath, header, tarReader)
+			bytesExtracted.Add(size)
+			if errors.Is(err, errEntrySkipped) {
+				continue
+			}
 			if err != nil {
-				return nil, fmt.Errorf("failed to extract file %s: %w", header.Name, err)
+				return nil, err
 			}
-			bytesExtracted += size
+			filesExtracted.Add(1)
+			reportProgress(header.Name)
+			continue
 
 		case tar.TypeSymlink:
 			if err := e.extractSymlink(destDir, targetPath, header); err != nil {
-				return nil, fmt.Errorf("failed to extract symlink %s: %w", header.Name, err)
+				entryErr = fmt.Errorf("failed to extract symlink %s: %w", header.Name, err)
+			} else {
+				entryErr = applyOwnership(targetPath, header)
+			}
+
+		case tar.TypeChar, tar.TypeBlock:
+			if !opts.AllowDeviceNodes {
+				logger.WithField("path", header.Name).Warn("skipping device node (device nodes not enabled)")
+				continue
+			}
+			if err := e.extractDevice(targetPath, header); err != nil {
+				entryErr = fmt.Errorf("failed to extract device %s: %w", header.Name, err)
+			} else {
+				entryErr = applyOwnership(targetPath, header)
+			}
+
+		case tar.TypeLink:
+			created, err := e.extractHardlink(destDir, targetPath, header, opts.StripComponents)
+			if err != nil {
+				entryErr = fmt.Errorf("failed to extract hardlink %s: %w", header.Name, err)
+			} else if !created {
+				pendingLinks = append(pendingLinks, header)
 			}
 
 		default:
@@ -246,42 +686,192 @@ func (e *Extractor) Extract(ctx context.Context, tarPath, destDir string, opts E
 			}).Warn("skipping unsupported file type")
 			continue
 		}
+		if entryErr != nil {
+			if err := skipEntry(seq, header, targetPath, entryErr); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
-		filesExtracted++
+		filesExtracted.Add(1)
+		markExtracted(targetPath)
+		reportProgress(header.Name)
+	}
+
+	// Every regular file must be on disk before forward hardlinks are created
+	if err := waitForWrites(); err != nil {
+		return nil, err
+	}
 
-		// Call progress callback every 100 files to avoid overhead
-		if e.progressFunc != nil && filesExtracted%100 == 0 {
-			e.progressFunc(filesExtracted, bytesExtracted, header.Name)
+	// Second pass: targets of forward-referencing hardlinks must exist by now
+	for _, header := range pendingLinks {
+		targetPath, err := e.sanitizePath(destDir, header.Name, opts.StripComponents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract hardlink %s: %w", header.Name, err)
+		}
+		created, err := e.extractHardlink(destDir, targetPath, header, opts.StripComponents)
+		if err != nil {
+			err = fmt.Errorf("failed to extract hardlink %s: %w", header.Name, err)
+		} else if !created {
+			err = fmt.Errorf("hardlink target not found in archive: %s -> %s", header.Name, header.Linkname)
 		}
+		if err != nil {
+			seq++
+			if err := skipEntry(seq, header, targetPath, err); err != nil {
+				return nil, err
+			}
+			filesExtracted.Add(-1)
+		}
+	}
+
+	// Skips reported by write workers arrive out of order
+	sort.SliceStable(skipped, func(i, j int) bool { return skipped[i].seq < skipped[j].seq })
+	skippedEntries := make([]EntryError, len(skipped))
+	for i, s := range skipped {
+		skippedEntries[i] = s.EntryError
 	}
 
 	duration := time.Since(startTime)
+	files, written := int(filesExtracted.Load()), bytesExtracted.Load()
 
 	logger.WithFields(logrus.Fields{
-		"files":    filesExtracted,
-		"bytes":    bytesExtracted,
+		"files":    files,
+		"bytes":    written,
 		"duration": duration,
+		"skipped":  len(skippedEntries),
 	}).Info("extraction completed")
 
 	// Final progress callback
 	if e.progressFunc != nil {
-		e.progressFunc(filesExtracted, bytesExtracted, "")
+		e.progressFunc(files, written, totalBytes, "")
 	}
 
 	return &ExtractionResult{
-		FilesExtracted: filesExtracted,
-		BytesExtracted: bytesExtracted,
+		FilesExtracted: files,
+		BytesExtracted: written,
 		Duration:       duration,
+		SkippedEntries: skippedEntries,
 	}, nil
 }
 
-// sanitizePath validates and sanitizes a file path.
+// OCI layer whiteout markers (see the OCI image spec, "Whiteouts").
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// applyWhiteout handles an OCI whiteout marker at markerPath. A ".wh.<name>" marker
+// removes <name> from the same directory; an opaque marker removes everything in the
+// directory. Entries created by the current extraction (in extracted) are kept.
+func (e *Extractor) applyWhiteout(markerPath string, extracted map[string]bool) error {
+	dir := filepath.Dir(markerPath)
+	base := filepath.Base(markerPath)
+
+	if base == whiteoutOpaque {
+		e.logger.WithField("dir", dir).Debug("applying opaque whiteout")
+		return e.clearOpaqueDir(dir, extracted)
+	}
+
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid whiteout name %q", base)
+	}
+
+	target := filepath.Join(dir, name)
+	if extracted[target] {
+		return nil
+	}
+	e.logger.WithField("path", target).Debug("applying whiteout")
+	if err := os.RemoveAll(target); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", target, err)
+	}
+	return nil
+}
+
+// clearOpaqueDir removes the contents of dir that were not created by the current
+// extraction. Directories created by the current extraction are descended into,
+// since earlier layers may have populated them too.
+func (e *Extractor) clearOpaqueDir(dir string, extracted map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !extracted[path] {
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+			continue
+		}
+		if entry.IsDir() {
+			if err := e.clearOpaqueDir(path, extracted); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ArchiveStats summarizes an archive's headers.
+type ArchiveStats struct {
+	Entries    int   // Headers of every type, each needing an inode once extracted
+	TotalBytes int64 // Sum of regular file sizes
+}
+
+// ScanArchive reads every header in the archive, counting entries and summing the
+// sizes of regular files. Entry contents are skipped, so this is cheap for
+// uncompressed archives; compressed archives are decompressed in full.
+func ScanArchive(ctx context.Context, tarPath string, compression Compression) (ArchiveStats, error) {
+	stream, err := OpenTarStream(tarPath, compression)
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+	defer stream.Close()
+
+	var stats ArchiveStats
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return ArchiveStats{}, fmt.Errorf("failed to read tar header: %w", err)
+		}
+		stats.Entries++
+		if header.Typeflag == tar.TypeReg {
+			stats.TotalBytes += header.Size
+		}
+	}
+}
+
+// ScanTotalBytes returns the total size of the archive's regular files (see
+// ScanArchive). It is used for progress totals and to size devices before extraction.
+func ScanTotalBytes(ctx context.Context, tarPath string, compression Compression) (int64, error) {
+	stats, err := ScanArchive(ctx, tarPath, compression)
+	if err != nil {
+		return 0, err
+	}
+	return stats.TotalBytes, nil
+}
+
+// errStrippedAway is returned by sanitizePath for a path with no components
+// left after StripComponents, such as the wrapper directory itself.
+var errStrippedAway = errors.New("path has fewer components than strip count")
+
+// sanitizePath validates and sanitizes a file path. Absolute paths and paths
+// escaping baseDir are security violations (unsafeEntryError).
 func (e *Extractor) sanitizePath(baseDir, path string, stripComponents int) (string, error) {
 	// Strip leading components if requested
 	if stripComponents > 0 {
 		parts := strings.Split(path, "/")
 		if len(parts) <= stripComponents {
-			return "", fmt.Errorf("path has fewer components than strip count")
+			return "", errStrippedAway
 		}
 		path = strings.Join(parts[stripComponents:], "/")
 	}
@@ -291,12 +881,13 @@ func (e *Extractor) sanitizePath(baseDir, path string, stripComponents int) (str
 
 	// Check for absolute paths
 	if filepath.IsAbs(cleanPath) {
-		return "", fmt.Errorf("absolute paths not allowed: %s", path)
+		return "", unsafeEntryError{fmt.Errorf("absolute paths not allowed: %s", path)}
 	}
 
-	// Check for path traversal
-	if strings.Contains(cleanPath, "..") {
-		return "", fmt.Errorf("path traversal detected: %s", path)
+	// Check for path traversal. Match ".." components only: names such as the
+	// OCI opaque whiteout ".wh..wh..opq" legitimately contain "..".
+	if hasDotDotComponent(cleanPath) {
+		return "", unsafeEntryError{fmt.Errorf("path traversal detected: %s", path)}
 	}
 
 	// Join with base directory
@@ -305,12 +896,63 @@ func (e *Extractor) sanitizePath(baseDir, path string, stripComponents int) (str
 	// Verify the path is within the base directory
 	if !strings.HasPrefix(fullPath, filepath.Clean(baseDir)+string(os.PathSeparator)) &&
 		fullPath != filepath.Clean(baseDir) {
-		return "", fmt.Errorf("path escapes base directory: %s", path)
+		return "", unsafeEntryError{fmt.Errorf("path escapes base directory: %s", path)}
 	}
 
 	return fullPath, nil
 }
 
+// hasDotDotComponent reports whether any "/"-separated component of path is "..".
+func hasDotDotComponent(path string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEntry runs the per-entry security checks shared by Extract and
+// Validate, and returns the entry's destination under baseDir: the path must
+// stay inside baseDir, the header must pass validateHeader, device nodes must
+// land under dev/, and link targets must resolve inside baseDir. skip is true
+// for entries removed entirely by StripComponents.
+func (e *Extractor) checkEntry(baseDir string, header *tar.Header, opts ExtractionOptions) (targetPath string, skip bool, err error) {
+	targetPath, err = e.sanitizePath(baseDir, header.Name, opts.StripComponents)
+	if errors.Is(err, errStrippedAway) {
+		return "", true, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if err := e.validateHeader(header, opts); err != nil {
+		return "", false, err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock:
+		// The sanitized path is checked, so StripComponents cannot move a
+		// device out of dev/
+		if opts.AllowDeviceNodes && !isUnderDev(baseDir, targetPath) {
+			return "", false, fmt.Errorf("device files only allowed in /dev")
+		}
+	case tar.TypeSymlink:
+		if err := e.validateSymlinkTarget(baseDir, targetPath, header.Linkname); err != nil {
+			return "", false, fmt.Errorf("invalid symlink target: %w", err)
+		}
+	case tar.TypeLink:
+		linkTarget, err := e.sanitizePath(baseDir, header.Linkname, opts.StripComponents)
+		if err != nil {
+			return "", false, fmt.Errorf("invalid hardlink target: %w", err)
+		}
+		if err := e.validateHardlinkTarget(baseDir, linkTarget); err != nil {
+			return "", false, fmt.Errorf("invalid hardlink target: %w", err)
+		}
+	}
+	return targetPath, false, nil
+}
+
 // validateHeader performs security checks on a tar header.
 func (e *Extractor) validateHeader(header *tar.Header, opts ExtractionOptions) error {
 	// Check file size
@@ -321,11 +963,11 @@ func (e *Extractor) validateHeader(header *tar.Header, opts ExtractionOptions) e
 	// Check for dangerous permissions
 	mode := os.FileMode(header.Mode)
 	if mode&os.ModeSetuid != 0 {
-		return fmt.Errorf("setuid bit not allowed")
+		return permissionError{fmt.Errorf("setuid bit not allowed")}
 	}
 
 	if mode&os.ModeSetgid != 0 {
-		return fmt.Errorf("setgid bit not allowed")
+		return permissionError{fmt.Errorf("setgid bit not allowed")}
 	}
 
 	// Check for device files (except in /dev)
@@ -383,6 +1025,64 @@ func (e *Extractor) extractFile(path string, header *tar.Header, reader io.Reade
 	return written, nil
 }
 
+// Largest device numbers Linux can represent: 12-bit major, 20-bit minor.
+const (
+	maxDeviceMajor = 1<<12 - 1
+	maxDeviceMinor = 1<<20 - 1
+)
+
+// deviceNumber returns the dev_t for a device entry's major and minor numbers.
+func deviceNumber(header *tar.Header) (uint64, error) {
+	if header.Devmajor < 0 || header.Devmajor > maxDeviceMajor {
+		return 0, fmt.Errorf("device major %d out of range (0-%d)", header.Devmajor, maxDeviceMajor)
+	}
+	if header.Devminor < 0 || header.Devminor > maxDeviceMinor {
+		return 0, fmt.Errorf("device minor %d out of range (0-%d)", header.Devminor, maxDeviceMinor)
+	}
+	return unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)), nil
+}
+
+// isUnderDev reports whether path lies inside the dev/ directory of baseDir.
+// The sanitized path is checked, so StripComponents is taken into account.
+func isUnderDev(baseDir, path string) bool {
+	rel, err := filepath.Rel(baseDir, path)
+	return err == nil && strings.HasPrefix(rel, "dev"+string(filepath.Separator))
+}
+
+// extractDevice creates a character or block device node.
+func (e *Extractor) extractDevice(path string, header *tar.Header) error {
+	dev, err := deviceNumber(header)
+	if err != nil {
+		return err
+	}
+
+	mode := uint32(header.Mode & 0o777)
+	if header.Typeflag == tar.TypeChar {
+		mode |= unix.S_IFCHR
+	} else {
+		mode |= unix.S_IFBLK
+	}
+
+	// Ensure parent directory exists
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", err)
+	}
+
+	// Remove existing entry if it exists
+	os.Remove(path)
+
+	if err := unix.Mknod(path, mode, int(dev)); err != nil {
+		return fmt.Errorf("mknod failed: %w", err)
+	}
+
+	// mknod applies the umask; set the archive's permissions exactly
+	if err := os.Chmod(path, os.FileMode(header.Mode&0o777)); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+
+	return nil
+}
+
 // extractSymlink creates a symlink.
 func (e *Extractor) extractSymlink(baseDir, path string, header *tar.Header) error {
 	// Validate symlink target
@@ -406,6 +1106,47 @@ func (e *Extractor) extractSymlink(baseDir, path string, header *tar.Header) err
 	return nil
 }
 
+// extractHardlink creates a hardlink to an already-extracted entry. Hardlink targets are
+// archive paths, so they are resolved relative to baseDir rather than the link's directory.
+// It returns false without error if the target has not been extracted yet.
+func (e *Extractor) extractHardlink(baseDir, path string, header *tar.Header, stripComponents int) (bool, error) {
+	targetPath, err := e.sanitizePath(baseDir, header.Linkname, stripComponents)
+	if err != nil {
+		return false, unsafeEntryError{fmt.Errorf("invalid hardlink target: %w", err)}
+	}
+	if err := e.validateHardlinkTarget(baseDir, targetPath); err != nil {
+		return false, fmt.Errorf("invalid hardlink target: %w", err)
+	}
+
+	if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	// Ensure parent directory exists
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, fmt.Errorf("failed to create parent directory: %w", err)
+	}
+
+	// Remove existing file if it exists
+	os.Remove(path)
+
+	if err := os.Link(targetPath, path); err != nil {
+		return false, fmt.Errorf("failed to create hardlink: %w", err)
+	}
+
+	return true, nil
+}
+
+// validateHardlinkTarget validates that a resolved hardlink target doesn't escape the
+// base directory, using the same containment check as validateSymlinkTarget.
+func (e *Extractor) validateHardlinkTarget(baseDir, targetPath string) error {
+	cleanTarget := filepath.Clean(targetPath)
+	if !strings.HasPrefix(cleanTarget, filepath.Clean(baseDir)+string(os.PathSeparator)) {
+		return unsafeEntryError{fmt.Errorf("hardlink target escapes base directory: %s", targetPath)}
+	}
+	return nil
+}
+
 // validateSymlinkTarget validates that a symlink target doesn't escape the base directory.
 func (e *Extractor) validateSymlinkTarget(baseDir, linkPath, target string) error {
 	// For relative symlink targets, verify they don't escape the base directory.
@@ -419,13 +1160,39 @@ func (e *Extractor) validateSymlinkTarget(baseDir, linkPath, target string) erro
 		// Verify the target is within the base directory
 		if !strings.HasPrefix(cleanTarget, filepath.Clean(baseDir)+string(os.PathSeparator)) &&
 			cleanTarget != filepath.Clean(baseDir) {
-			return fmt.Errorf("symlink target escapes base directory: %s -> %s", linkPath, target)
+			return unsafeEntryError{fmt.Errorf("symlink target escapes base directory: %s -> %s", linkPath, target)}
 		}
 	}
 
 	return nil
 }
 
+// Root filesystem layouts detected by VerifyLayout.
+const (
+	LayoutDirectRoot   = "direct-root"   // The root filesystem is the destination itself
+	LayoutRootfsSubdir = "rootfs-subdir" // The root filesystem is under RootfsDir
+)
+
+// RootfsDir is the subdirectory holding the root filesystem in the
+// rootfs-subdir layout.
+const RootfsDir = "rootfs"
+
+// RootDir returns the root filesystem directory under destDir for layout.
+// An empty layout, for filesystems whose layout was not recorded, is detected
+// the way VerifyLayout does: rootfs/ if present, else destDir.
+func RootDir(destDir, layout string) string {
+	switch layout {
+	case LayoutRootfsSubdir:
+		return filepath.Join(destDir, RootfsDir)
+	case LayoutDirectRoot:
+		return destDir
+	}
+	if info, err := os.Stat(filepath.Join(destDir, RootfsDir)); err == nil && info.IsDir() {
+		return filepath.Join(destDir, RootfsDir)
+	}
+	return destDir
+}
+
 // VerifyLayout verifies the canonical filesystem layout of an extracted
 // container root filesystem. It supports two layouts:
 //  1. Legacy "rootfs/" layout: destDir/rootfs/{etc,usr,var,...}
@@ -442,10 +1209,10 @@ func (e *Extractor) VerifyLayout(destDir string) error {
 	rootDir := ""
 	layout := ""
 
-	rootfsPath := filepath.Join(destDir, "rootfs")
+	rootfsPath := filepath.Join(destDir, RootfsDir)
 	if info, err := os.Stat(rootfsPath); err == nil && info.IsDir() {
 		rootDir = rootfsPath
-		layout = "rootfs-subdir"
+		layout = LayoutRootfsSubdir
 	} else {
 		// Fallback to direct-root layout: look for standard top-level dirs.
 		candidates := []string{"etc", "usr", "var"}
@@ -453,7 +1220,7 @@ func (e *Extractor) VerifyLayout(destDir string) error {
 			p := filepath.Join(destDir, name)
 			if info, err := os.Stat(p); err == nil && info.IsDir() {
 				rootDir = destDir
-				layout = "direct-root"
+				layout = LayoutDirectRoot
 				break
 			}
 		}
@@ -504,7 +1271,7 @@ func (e *Extractor) checkPermissions(destDir string) error {
 			relPath, _ := filepath.Rel(destDir, path)
 			if strings.HasPrefix(relPath, "etc") || strings.HasPrefix(relPath, "usr") {
 				if info.Mode().Perm()&0002 != 0 {
-					return fmt.Errorf("world-writable directory in critical path: %s", relPath)
+					return permissionError{fmt.Errorf("world-writable directory in critical path: %s", relPath)}
 				}
 			}
 		}
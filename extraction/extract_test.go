@@ -7,10 +7,22 @@
 package extraction
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
 )
 
 // TestVerifyLayout_DirectRootSuccess verifies that VerifyLayout accepts a
@@ -70,6 +82,32 @@ func TestVerifyLayout_InvalidLayout(t *testing.T) {
 	}
 }
 
+// TestRootDir verifies that a recorded layout is followed as given and an
+// unrecorded one is detected like VerifyLayout.
+func TestRootDir(t *testing.T) {
+	direct := t.TempDir()
+	withRootfs := t.TempDir()
+	if err := os.Mkdir(filepath.Join(withRootfs, RootfsDir), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	tests := []struct {
+		dest, layout, want string
+	}{
+		{direct, LayoutDirectRoot, direct},
+		{direct, LayoutRootfsSubdir, filepath.Join(direct, RootfsDir)},
+		{direct, "", direct},
+		{withRootfs, "", filepath.Join(withRootfs, RootfsDir)},
+		// An image that happens to ship a /rootfs directory keeps its root
+		{withRootfs, LayoutDirectRoot, withRootfs},
+	}
+	for _, tt := range tests {
+		if got := RootDir(tt.dest, tt.layout); got != tt.want {
+			t.Errorf("RootDir(%s, %q) = %s, want %s", tt.dest, tt.layout, got, tt.want)
+		}
+	}
+}
+
 // TestVerifyLayout_WorldWritableCriticalDir ensures world-writable critical
 // directories are rejected.
 func TestVerifyLayout_WorldWritableCriticalDir(t *testing.T) {
@@ -90,3 +128,993 @@ func TestVerifyLayout_WorldWritableCriticalDir(t *testing.T) {
 		t.Fatalf("VerifyLayout should reject world-writable etc directory")
 	}
 }
+
+// writeTarFixture writes a small tar archive containing etc/hostname and
+// returns its bytes.
+func writeTarFixture(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := []byte("fly\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+		t.Fatalf("write dir header: %v", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}); err != nil {
+		t.Fatalf("write file header: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// compressedFixtures returns the tar fixture in every supported compression,
+// keyed by file name.
+func compressedFixtures(t *testing.T) map[string][]byte {
+	t.Helper()
+	raw := writeTarFixture(t)
+	fixtures := map[string][]byte{"image.tar": raw}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(raw); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	zw.Close()
+	fixtures["image.tar.gz"] = gz.Bytes()
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd: %v", err)
+	}
+	fixtures["image.tar.zst"] = enc.EncodeAll(raw, nil)
+	enc.Close()
+	return fixtures
+}
+
+// TestExtract_CompressedTarballs verifies that gzip and zstd tarballs are
+// detected by magic bytes and extracted like plain tarballs.
+func TestExtract_CompressedTarballs(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range compressedFixtures(t) {
+		t.Run(name, func(t *testing.T) {
+			tarPath := filepath.Join(dir, name)
+			if err := os.WriteFile(tarPath, data, 0o644); err != nil {
+				t.Fatalf("write fixture: %v", err)
+			}
+
+			dest := t.TempDir()
+			result, err := New().Extract(context.Background(), tarPath, dest, DefaultOptions())
+			if err != nil {
+				t.Fatalf("Extract(%s): %v", name, err)
+			}
+			if result.FilesExtracted != 2 {
+				t.Errorf("FilesExtracted = %d, want 2", result.FilesExtracted)
+			}
+			got, err := os.ReadFile(filepath.Join(dest, "etc", "hostname"))
+			if err != nil || string(got) != "fly\n" {
+				t.Errorf("etc/hostname = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// TestExtract_CompressionOverride verifies that an explicit Compression skips
+// detection, and that a mismatched override fails instead of extracting garbage.
+func TestExtract_CompressionOverride(t *testing.T) {
+	fixtures := compressedFixtures(t)
+	dir := t.TempDir()
+	gzPath := filepath.Join(dir, "image.tar.gz")
+	if err := os.WriteFile(gzPath, fixtures["image.tar.gz"], 0o644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+
+	opts := DefaultOptions()
+	opts.Compression = CompressionGzip
+	if _, err := New().Extract(context.Background(), gzPath, t.TempDir(), opts); err != nil {
+		t.Fatalf("Extract with gzip override: %v", err)
+	}
+
+	opts.Compression = CompressionNone
+	if _, err := New().Extract(context.Background(), gzPath, t.TempDir(), opts); err == nil {
+		t.Fatal("Extract of gzip data as uncompressed tar should fail")
+	}
+
+	opts.Compression = "bzip2"
+	if _, err := New().Extract(context.Background(), gzPath, t.TempDir(), opts); err == nil {
+		t.Fatal("Extract with unsupported compression should fail")
+	}
+}
+
+// TestOpenTarStream_CorruptZstd verifies that a corrupt zstd stream surfaces
+// as an error rather than a silently truncated archive.
+func TestOpenTarStream_CorruptZstd(t *testing.T) {
+	zst := compressedFixtures(t)["image.tar.zst"]
+	path := filepath.Join(t.TempDir(), "image.tar.zst")
+	if err := os.WriteFile(path, zst[:len(zst)/2], 0o644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+
+	if _, err := New().Extract(context.Background(), path, t.TempDir(), DefaultOptions()); err == nil {
+		t.Fatal("Extract of truncated zstd tarball should fail")
+	}
+}
+
+// TestExtractReader_Streams verifies that an in-memory stream is extracted
+// like a tarball on disk, and that the stream is read to the end so a tee
+// sees the whole object.
+func TestExtractReader_Streams(t *testing.T) {
+	for name, data := range compressedFixtures(t) {
+		t.Run(name, func(t *testing.T) {
+			// Trailing zero blocks after the end-of-archive marker are
+			// common in the wild and must still reach the tee.
+			if name == "image.tar" {
+				data = append(bytes.Clone(data), make([]byte, 10240)...)
+			}
+
+			hash := sha256.New()
+			dest := t.TempDir()
+			result, err := New().ExtractReader(context.Background(), io.TeeReader(bytes.NewReader(data), hash), dest, DefaultOptions())
+			if err != nil {
+				t.Fatalf("ExtractReader(%s): %v", name, err)
+			}
+			if result.FilesExtracted != 2 {
+				t.Errorf("FilesExtracted = %d, want 2", result.FilesExtracted)
+			}
+			got, err := os.ReadFile(filepath.Join(dest, "etc", "hostname"))
+			if err != nil || string(got) != "fly\n" {
+				t.Errorf("etc/hostname = %q, %v", got, err)
+			}
+
+			want := sha256.Sum256(data)
+			if !bytes.Equal(hash.Sum(nil), want[:]) {
+				t.Error("tee did not see the whole stream")
+			}
+		})
+	}
+}
+
+// TestExtractReader_SecurityChecks verifies that streamed archives get the
+// same validation as archives on disk.
+func TestExtractReader_SecurityChecks(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	tw.Close()
+
+	if _, err := New().ExtractReader(context.Background(), &buf, t.TempDir(), DefaultOptions()); err == nil {
+		t.Fatal("ExtractReader of a device file outside dev/ should fail")
+	}
+
+	opts := DefaultOptions()
+	opts.MaxFiles = 1
+	if _, err := New().ExtractReader(context.Background(), bytes.NewReader(writeTarFixture(t)), t.TempDir(), opts); err == nil {
+		t.Fatal("ExtractReader past the file count limit should fail")
+	}
+}
+
+// TestExtractReader_TruncatedStream verifies that a stream cut off mid-entry,
+// as from a dropped connection, fails rather than extracting a short file.
+func TestExtractReader_TruncatedStream(t *testing.T) {
+	data := writeTarFixture(t)
+	// Header blocks for etc/ and etc/hostname, then half of the file data.
+	truncated := data[:1024+2]
+
+	if _, err := New().ExtractReader(context.Background(), bytes.NewReader(truncated), t.TempDir(), DefaultOptions()); err == nil {
+		t.Fatal("ExtractReader of a truncated stream should fail")
+	}
+}
+
+// writeTar writes the given headers (with optional contents for regular files)
+// to a tar file under dir and returns its path.
+func writeTar(t *testing.T, dir string, headers []*tar.Header, contents map[string]string) string {
+	t.Helper()
+	path := filepath.Join(dir, "links.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create tar: %v", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, h := range headers {
+		body := contents[h.Name]
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("write header %s: %v", h.Name, err)
+		}
+		if body != "" {
+			if _, err := tw.Write([]byte(body)); err != nil {
+				t.Fatalf("write %s: %v", h.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	return path
+}
+
+// TestExtract_Hardlinks verifies busybox-style hardlinked applets are created as
+// real hardlinks, including links that appear before their target in the archive.
+func TestExtract_Hardlinks(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		// Forward reference: target appears later in the archive.
+		{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755},
+		{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+		{Name: "usr/bin/env", Typeflag: tar.TypeLink, Linkname: "./bin/busybox"},
+	}
+	tarPath := writeTar(t, t.TempDir(), headers, map[string]string{"bin/busybox": "#!busybox\n"})
+
+	dest := t.TempDir()
+	result, err := New().Extract(context.Background(), tarPath, dest, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if result.FilesExtracted != len(headers) {
+		t.Errorf("FilesExtracted = %d, want %d", result.FilesExtracted, len(headers))
+	}
+
+	target, err := os.Stat(filepath.Join(dest, "bin", "busybox"))
+	if err != nil {
+		t.Fatalf("stat busybox: %v", err)
+	}
+	for _, link := range []string{"bin/sh", "bin/ls", "usr/bin/env"} {
+		info, err := os.Stat(filepath.Join(dest, link))
+		if err != nil {
+			t.Fatalf("stat %s: %v", link, err)
+		}
+		if !os.SameFile(target, info) {
+			t.Errorf("%s is not a hardlink to bin/busybox", link)
+		}
+	}
+}
+
+// TestExtract_HardlinkEscapeRejected verifies hardlinks cannot point outside
+// the extraction root.
+func TestExtract_HardlinkEscapeRejected(t *testing.T) {
+	for _, linkname := range []string{"../../etc/passwd", "/etc/passwd"} {
+		headers := []*tar.Header{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "etc/shadow", Typeflag: tar.TypeLink, Linkname: linkname},
+		}
+		tarPath := writeTar(t, t.TempDir(), headers, nil)
+
+		dest := t.TempDir()
+		if _, err := New().Extract(context.Background(), tarPath, dest, DefaultOptions()); err == nil {
+			t.Errorf("Extract should reject hardlink to %q", linkname)
+		}
+		if _, err := os.Lstat(filepath.Join(dest, "etc", "shadow")); !os.IsNotExist(err) {
+			t.Errorf("hardlink to %q was created", linkname)
+		}
+	}
+}
+
+// TestExtract_HardlinkMissingTarget verifies a hardlink whose target never
+// appears in the archive fails extraction.
+func TestExtract_HardlinkMissingTarget(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+	}
+	tarPath := writeTar(t, t.TempDir(), headers, nil)
+
+	if _, err := New().Extract(context.Background(), tarPath, t.TempDir(), DefaultOptions()); err == nil {
+		t.Fatal("Extract should fail for hardlink with missing target")
+	}
+}
+
+// badEntryArchive returns an archive with good entries around two that cannot
+// be extracted: a file beneath a regular file, and a hardlink to a missing target.
+func badEntryArchive(t *testing.T) string {
+	headers := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755},
+		{Name: "etc", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/missing"},
+		{Name: "usr/bin/env", Typeflag: tar.TypeSymlink, Linkname: "../../bin/busybox"},
+	}
+	return writeTar(t, t.TempDir(), headers, map[string]string{
+		"bin/busybox": "#!busybox\n",
+		"etc":         "not a directory\n",
+		"etc/passwd":  "root:x:0:0::/root:/bin/sh\n",
+	})
+}
+
+// TestExtract_BadEntryStrict verifies a single failed entry fails the whole
+// archive by default.
+func TestExtract_BadEntryStrict(t *testing.T) {
+	tarPath := badEntryArchive(t)
+
+	_, err := New().Extract(context.Background(), tarPath, t.TempDir(), DefaultOptions())
+	if err == nil || !strings.Contains(err.Error(), "etc/passwd") {
+		t.Fatalf("Extract error = %v, want failure naming etc/passwd", err)
+	}
+}
+
+// TestExtract_BadEntryBestEffort verifies that with BestEffort the failed
+// entries are skipped and reported while the rest of the archive is extracted.
+func TestExtract_BadEntryBestEffort(t *testing.T) {
+	tarPath := badEntryArchive(t)
+	opts := DefaultOptions()
+	opts.BestEffort = true
+
+	dest := t.TempDir()
+	result, err := New().Extract(context.Background(), tarPath, dest, opts)
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+
+	var skipped []string
+	for _, entry := range result.SkippedEntries {
+		skipped = append(skipped, entry.Path)
+		if entry.Err == nil || !strings.Contains(entry.Error(), entry.Path) {
+			t.Errorf("skipped %s: error %v does not name the entry", entry.Path, entry.Err)
+		}
+	}
+	if strings.Join(skipped, ",") != "etc/passwd,bin/sh" {
+		t.Errorf("SkippedEntries = %v, want [etc/passwd bin/sh]", skipped)
+	}
+	if result.FilesExtracted != 4 {
+		t.Errorf("FilesExtracted = %d, want 4", result.FilesExtracted)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dest, "usr", "bin", "env")); err != nil || string(data) != "#!busybox\n" {
+		t.Errorf("usr/bin/env = %q, %v; want the busybox contents", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "bin", "sh")); !os.IsNotExist(err) {
+		t.Errorf("skipped hardlink bin/sh exists: %v", err)
+	}
+}
+
+// TestExtract_BestEffortSecurityViolation verifies BestEffort does not skip
+// past entries that try to escape the extraction root.
+func TestExtract_BestEffortSecurityViolation(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BestEffort = true
+
+	for _, h := range []*tar.Header{
+		{Name: "etc/shadow", Typeflag: tar.TypeLink, Linkname: "../../etc/shadow"},
+		{Name: "etc/evil", Typeflag: tar.TypeSymlink, Linkname: "../../../etc/shadow"},
+	} {
+		headers := []*tar.Header{
+			{Name: "bin/ok", Typeflag: tar.TypeReg, Mode: 0o644},
+			h,
+		}
+		tarPath := writeTar(t, t.TempDir(), headers, map[string]string{"bin/ok": "ok\n"})
+
+		if _, err := New().Extract(context.Background(), tarPath, t.TempDir(), opts); err == nil {
+			t.Errorf("Extract with BestEffort accepted %s -> %s", h.Name, h.Linkname)
+		}
+	}
+}
+
+// TestExtract_PreserveOwnership verifies uid/gid from tar headers are applied to
+// files, directories, and symlinks (the symlink itself, not its target).
+func TestExtract_PreserveOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to chown")
+	}
+
+	headers := []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755, Uid: 0, Gid: 0},
+		{Name: "home/app/", Typeflag: tar.TypeDir, Mode: 0o750, Uid: 1000, Gid: 1001},
+		{Name: "home/app/config", Typeflag: tar.TypeReg, Mode: 0o640, Uid: 1000, Gid: 42},
+		{Name: "home/app/link", Typeflag: tar.TypeSymlink, Linkname: "config", Uid: 2000, Gid: 2001},
+	}
+	tarPath := writeTar(t, t.TempDir(), headers, map[string]string{"home/app/config": "key=value\n"})
+
+	opts := DefaultOptions()
+	if !opts.PreserveOwnership {
+		t.Fatal("DefaultOptions should preserve ownership when running as root")
+	}
+
+	dest := t.TempDir()
+	if _, err := New().Extract(context.Background(), tarPath, dest, opts); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+
+	for _, h := range headers {
+		info, err := os.Lstat(filepath.Join(dest, h.Name))
+		if err != nil {
+			t.Fatalf("lstat %s: %v", h.Name, err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if int(stat.Uid) != h.Uid || int(stat.Gid) != h.Gid {
+			t.Errorf("%s owned by %d:%d, want %d:%d", h.Name, stat.Uid, stat.Gid, h.Uid, h.Gid)
+		}
+	}
+
+	// With PreserveOwnership disabled, entries keep the current user's ownership.
+	opts.PreserveOwnership = false
+	dest = t.TempDir()
+	if _, err := New().Extract(context.Background(), tarPath, dest, opts); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(dest, "home/app/config"))
+	if err != nil {
+		t.Fatalf("lstat: %v", err)
+	}
+	if uid := info.Sys().(*syscall.Stat_t).Uid; int(uid) != os.Geteuid() {
+		t.Errorf("config owned by uid %d with PreserveOwnership=false, want %d", uid, os.Geteuid())
+	}
+}
+
+// TestExtract_OCIWhiteouts extracts two layers into the same directory and
+// verifies that regular and opaque whiteouts in the upper layer remove content
+// from the lower layer, while content added by the upper layer is kept.
+func TestExtract_OCIWhiteouts(t *testing.T) {
+	dest := t.TempDir()
+	opts := DefaultOptions()
+	opts.OCIWhiteouts = true
+
+	lower := writeTar(t, t.TempDir(), []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "etc/keep.conf", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "etc/remove.conf", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "var/cache/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "var/cache/old/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "var/cache/old/data", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "var/cache/stale", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "opt/tool/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "opt/tool/bin", Typeflag: tar.TypeReg, Mode: 0o755},
+	}, map[string]string{
+		"etc/keep.conf": "keep", "etc/remove.conf": "remove",
+		"var/cache/old/data": "old", "var/cache/stale": "stale", "opt/tool/bin": "bin",
+	})
+	if _, err := New().Extract(context.Background(), lower, dest, opts); err != nil {
+		t.Fatalf("Extract(lower): %v", err)
+	}
+
+	upper := writeTar(t, t.TempDir(), []*tar.Header{
+		{Name: "etc/.wh.remove.conf", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "opt/.wh.tool", Typeflag: tar.TypeReg, Mode: 0o644},
+		// Content added before the opaque marker in the same layer must survive.
+		{Name: "var/cache/new", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "var/cache/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"var/cache/new": "new"})
+	if _, err := New().Extract(context.Background(), upper, dest, opts); err != nil {
+		t.Fatalf("Extract(upper): %v", err)
+	}
+
+	for _, path := range []string{"etc/keep.conf", "var/cache/new"} {
+		if _, err := os.Lstat(filepath.Join(dest, path)); err != nil {
+			t.Errorf("%s should exist: %v", path, err)
+		}
+	}
+	for _, path := range []string{
+		"etc/remove.conf", "opt/tool", "var/cache/old", "var/cache/stale",
+		"etc/.wh.remove.conf", "opt/.wh.tool", "var/cache/.wh..wh..opq",
+	} {
+		if _, err := os.Lstat(filepath.Join(dest, path)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been removed (err: %v)", path, err)
+		}
+	}
+}
+
+// TestExtract_OCIWhiteoutsDisabled verifies whiteout markers are extracted as
+// ordinary files unless OCIWhiteouts is set.
+func TestExtract_OCIWhiteoutsDisabled(t *testing.T) {
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dest, "file"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	tarPath := writeTar(t, t.TempDir(), []*tar.Header{
+		{Name: ".wh.file", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, nil)
+	if _, err := New().Extract(context.Background(), tarPath, dest, DefaultOptions()); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+
+	for _, path := range []string{"file", ".wh.file"} {
+		if _, err := os.Lstat(filepath.Join(dest, path)); err != nil {
+			t.Errorf("%s should exist: %v", path, err)
+		}
+	}
+}
+
+// TestExtract_ProgressReportsTotal verifies the progress callback receives the
+// archive's total size from the pre-scan, and that the reported percentage
+// never decreases and reaches 100%.
+func TestExtract_ProgressReportsTotal(t *testing.T) {
+	var headers []*tar.Header
+	contents := map[string]string{}
+	var wantTotal int64
+	for i := 0; i < 250; i++ {
+		name := filepath.Join("data", "file"+strconv.Itoa(i))
+		body := strings.Repeat("x", i+1)
+		headers = append(headers, &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644})
+		contents[name] = body
+		wantTotal += int64(len(body))
+	}
+	tarPath := writeTar(t, t.TempDir(), headers, contents)
+
+	var percents []float64
+	ex := New()
+	ex.SetProgressFunc(func(filesExtracted int, bytesExtracted, totalBytes int64, currentFile string) {
+		if totalBytes != wantTotal {
+			t.Errorf("totalBytes = %d, want %d", totalBytes, wantTotal)
+		}
+		percents = append(percents, float64(bytesExtracted)/float64(totalBytes))
+	})
+
+	if _, err := ex.Extract(context.Background(), tarPath, t.TempDir(), DefaultOptions()); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+
+	if len(percents) < 3 {
+		t.Fatalf("expected intermediate progress callbacks, got %d", len(percents))
+	}
+	for i := 1; i < len(percents); i++ {
+		if percents[i] < percents[i-1] {
+			t.Errorf("progress went backwards: %.3f -> %.3f", percents[i-1], percents[i])
+		}
+	}
+	if last := percents[len(percents)-1]; last != 1 {
+		t.Errorf("final progress = %.3f, want 1", last)
+	}
+
+	// An explicit TotalBytes is reported as-is without a pre-scan.
+	opts := DefaultOptions()
+	opts.TotalBytes = 4 * wantTotal
+	wantTotal = opts.TotalBytes
+	percents = nil
+	if _, err := ex.Extract(context.Background(), tarPath, t.TempDir(), opts); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+}
+
+// TestExtract_DeviceNodes verifies that device entries under dev/ are created
+// with mknod only when AllowDeviceNodes is set.
+func TestExtract_DeviceNodes(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mknod requires root")
+	}
+
+	headers := []*tar.Header{
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3},
+		{Name: "dev/random", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 8},
+		{Name: "dev/loop0", Typeflag: tar.TypeBlock, Mode: 0o660, Devmajor: 7, Devminor: 0},
+	}
+	tarPath := writeTar(t, t.TempDir(), headers, nil)
+
+	// Disabled by default: the entries are skipped.
+	dest := t.TempDir()
+	result, err := New().Extract(context.Background(), tarPath, dest, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if result.FilesExtracted != 1 {
+		t.Errorf("FilesExtracted = %d, want 1 (the dev/ directory only)", result.FilesExtracted)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "dev", "null")); !os.IsNotExist(err) {
+		t.Errorf("dev/null created without AllowDeviceNodes: %v", err)
+	}
+
+	opts := DefaultOptions()
+	opts.AllowDeviceNodes = true
+	dest = t.TempDir()
+	if _, err := New().Extract(context.Background(), tarPath, dest, opts); err != nil {
+		t.Fatalf("Extract with AllowDeviceNodes: %v", err)
+	}
+	for _, h := range headers[1:] {
+		info, err := os.Lstat(filepath.Join(dest, h.Name))
+		if err != nil {
+			t.Fatalf("lstat %s: %v", h.Name, err)
+		}
+		wantType := os.ModeDevice | os.ModeCharDevice
+		if h.Typeflag == tar.TypeBlock {
+			wantType = os.ModeDevice
+		}
+		if info.Mode().Type() != wantType || info.Mode().Perm() != os.FileMode(h.Mode) {
+			t.Errorf("%s mode = %v, want %v|%v", h.Name, info.Mode(), wantType, os.FileMode(h.Mode))
+		}
+		rdev := info.Sys().(*syscall.Stat_t).Rdev
+		if major, minor := unix.Major(rdev), unix.Minor(rdev); int64(major) != h.Devmajor || int64(minor) != h.Devminor {
+			t.Errorf("%s is %d:%d, want %d:%d", h.Name, major, minor, h.Devmajor, h.Devminor)
+		}
+	}
+}
+
+// TestExtract_DeviceNodeOutsideDev verifies that device entries elsewhere are
+// rejected even with AllowDeviceNodes set, including via StripComponents.
+func TestExtract_DeviceNodeOutsideDev(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AllowDeviceNodes = true
+
+	tarPath := writeTar(t, t.TempDir(), []*tar.Header{
+		{Name: "etc/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3},
+	}, nil)
+	if _, err := New().Extract(context.Background(), tarPath, t.TempDir(), opts); err == nil {
+		t.Error("Extract of a device node under etc/ should fail")
+	}
+
+	// dev/null in the archive lands at null once the first component is stripped.
+	opts.StripComponents = 1
+	tarPath = writeTar(t, t.TempDir(), []*tar.Header{
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3},
+	}, nil)
+	if _, err := New().Extract(context.Background(), tarPath, t.TempDir(), opts); err == nil {
+		t.Error("Extract of a device node stripped out of dev/ should fail")
+	}
+}
+
+func TestDeviceNumber(t *testing.T) {
+	tests := []struct {
+		name         string
+		major, minor int64
+		wantErr      bool
+	}{
+		{name: "null", major: 1, minor: 3},
+		{name: "loop0", major: 7, minor: 0},
+		{name: "largest", major: maxDeviceMajor, minor: maxDeviceMinor},
+		{name: "major too large", major: maxDeviceMajor + 1, wantErr: true},
+		{name: "minor too large", major: 1, minor: maxDeviceMinor + 1, wantErr: true},
+		{name: "negative major", major: -1, wantErr: true},
+		{name: "negative minor", major: 1, minor: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, err := deviceNumber(&tar.Header{Devmajor: tt.major, Devminor: tt.minor})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deviceNumber() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if int64(unix.Major(dev)) != tt.major || int64(unix.Minor(dev)) != tt.minor {
+				t.Errorf("deviceNumber() = %d:%d, want %d:%d", unix.Major(dev), unix.Minor(dev), tt.major, tt.minor)
+			}
+		})
+	}
+}
+
+// TestExtract_Limits verifies MaxFiles and MaxTotalSize accept an archive
+// exactly at the limit and reject one entry or byte over it.
+func TestExtract_Limits(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "b", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "c", Typeflag: tar.TypeReg, Mode: 0o644},
+	}
+	tarPath := writeTar(t, t.TempDir(), headers, map[string]string{"a": "1234", "b": "5678", "c": "90"})
+
+	tests := []struct {
+		name         string
+		maxFiles     int
+		maxTotalSize int64
+		wantErr      string
+	}{
+		{name: "at file limit", maxFiles: 3, maxTotalSize: DefaultMaxTotalSize},
+		{name: "over file limit", maxFiles: 2, maxTotalSize: DefaultMaxTotalSize, wantErr: "file count limit exceeded"},
+		{name: "at size limit", maxFiles: DefaultMaxFiles, maxTotalSize: 10},
+		{name: "over size limit", maxFiles: DefaultMaxFiles, maxTotalSize: 9, wantErr: "total size limit exceeded"},
+	}
+	for _, tt := range tests {
+		for _, concurrency := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/concurrency=%d", tt.name, concurrency), func(t *testing.T) {
+				opts := DefaultOptions()
+				opts.MaxFiles = tt.maxFiles
+				opts.MaxTotalSize = tt.maxTotalSize
+				opts.WriteConcurrency = concurrency
+
+				result, err := New().Extract(context.Background(), tarPath, t.TempDir(), opts)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("Extract error = %v, want %q", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Extract: %v", err)
+				}
+				if result.FilesExtracted != 3 || result.BytesExtracted != 10 {
+					t.Errorf("extracted %d files, %d bytes; want 3, 10", result.FilesExtracted, result.BytesExtracted)
+				}
+			})
+		}
+	}
+}
+
+// TestValidate_AgreesWithExtract runs Validate and Extract over a corpus of
+// tricky entries and checks both accept or reject each one alike.
+func TestValidate_AgreesWithExtract(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		strip   int
+		wantErr bool
+	}{
+		{name: "plain file", headers: []*tar.Header{{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644}}},
+		{name: "traversal", headers: []*tar.Header{{Name: "../etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644}}, wantErr: true},
+		{name: "nested traversal", headers: []*tar.Header{{Name: "etc/../../passwd", Typeflag: tar.TypeReg, Mode: 0o644}}, wantErr: true},
+		{name: "absolute path", headers: []*tar.Header{{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644}}, wantErr: true},
+		{name: "dots in name", headers: []*tar.Header{{Name: "etc/..hidden", Typeflag: tar.TypeReg, Mode: 0o644}}},
+		{name: "opaque whiteout name", headers: []*tar.Header{{Name: "etc/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0o644}}},
+		{name: "absolute symlink", headers: []*tar.Header{{Name: "etc/mtab", Typeflag: tar.TypeSymlink, Linkname: "/proc/self/mounts"}}},
+		{name: "symlink within root", headers: []*tar.Header{{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "../../bin/busybox"}}},
+		{name: "symlink to root", headers: []*tar.Header{{Name: "usr/root", Typeflag: tar.TypeSymlink, Linkname: ".."}}},
+		{name: "symlink escape", headers: []*tar.Header{{Name: "etc/evil", Typeflag: tar.TypeSymlink, Linkname: "../../etc/shadow"}}, wantErr: true},
+		{name: "top-level symlink escape", headers: []*tar.Header{{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "../host"}}, wantErr: true},
+		{
+			name:    "symlink escape after strip",
+			headers: []*tar.Header{{Name: "rootfs/etc/evil", Typeflag: tar.TypeSymlink, Linkname: "../../host"}},
+			strip:   1,
+			wantErr: true,
+		},
+		{
+			name:    "hardlink within root",
+			headers: []*tar.Header{{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755}, {Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+		},
+		{name: "hardlink escape", headers: []*tar.Header{{Name: "etc/shadow", Typeflag: tar.TypeLink, Linkname: "../../etc/shadow"}}, wantErr: true},
+		{name: "absolute hardlink", headers: []*tar.Header{{Name: "etc/shadow", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}}, wantErr: true},
+		{name: "device outside dev", headers: []*tar.Header{{Name: "etc/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}}, wantErr: true},
+		{name: "device under dev", headers: []*tar.Header{{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}}},
+		{
+			name:    "wrapper directory stripped",
+			headers: []*tar.Header{{Name: "rootfs", Typeflag: tar.TypeDir, Mode: 0o755}, {Name: "rootfs/etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644}},
+			strip:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tarPath := writeTar(t, t.TempDir(), tt.headers, nil)
+			opts := DefaultOptions()
+			opts.StripComponents = tt.strip
+
+			ex := New()
+			ex.SuppressLogs()
+			validateErr := ex.Validate(context.Background(), tarPath, opts)
+			_, extractErr := ex.Extract(context.Background(), tarPath, t.TempDir(), opts)
+
+			if (validateErr != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", validateErr, tt.wantErr)
+			}
+			if (extractErr != nil) != tt.wantErr {
+				t.Errorf("Extract() error = %v, wantErr %v", extractErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestValidate_Limits verifies Validate enforces MaxFiles and MaxTotalSize
+// at the same boundaries as Extract.
+func TestValidate_Limits(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "b", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "c", Typeflag: tar.TypeReg, Mode: 0o644},
+	}
+	tarPath := writeTar(t, t.TempDir(), headers, map[string]string{"a": "1234", "b": "5678", "c": "90"})
+
+	for _, tt := range []struct {
+		maxFiles     int
+		maxTotalSize int64
+		wantErr      bool
+	}{
+		{maxFiles: 3, maxTotalSize: 10},
+		{maxFiles: 2, maxTotalSize: 10, wantErr: true},
+		{maxFiles: 3, maxTotalSize: 9, wantErr: true},
+	} {
+		opts := DefaultOptions()
+		opts.MaxFiles = tt.maxFiles
+		opts.MaxTotalSize = tt.maxTotalSize
+		if err := New().Validate(context.Background(), tarPath, opts); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%d files, %d bytes) error = %v, wantErr %v", tt.maxFiles, tt.maxTotalSize, err, tt.wantErr)
+		}
+	}
+
+	if err := New().Validate(context.Background(), filepath.Join(t.TempDir(), "missing.tar"), DefaultOptions()); err == nil {
+		t.Error("Validate(missing file) succeeded, want error")
+	}
+}
+
+// TestIsSecurityViolation verifies hostile entries are told apart from
+// limits and malformed archives.
+func TestIsSecurityViolation(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header *tar.Header
+		want   bool
+	}{
+		{name: "path traversal", header: &tar.Header{Name: "../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644}, want: true},
+		{name: "escaping symlink", header: &tar.Header{Name: "etc/evil", Typeflag: tar.TypeSymlink, Linkname: "../../../etc/shadow"}, want: true},
+		{name: "file count limit", header: &tar.Header{Name: "etc/extra", Typeflag: tar.TypeReg, Mode: 0o644}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := []*tar.Header{{Name: "bin/ok", Typeflag: tar.TypeReg, Mode: 0o644}, tt.header}
+			tarPath := writeTar(t, t.TempDir(), headers, nil)
+			opts := DefaultOptions()
+			opts.MaxFiles = 1
+
+			err := New().Validate(context.Background(), tarPath, opts)
+			if err == nil {
+				t.Fatal("Validate() succeeded, want error")
+			}
+			if got := IsSecurityViolation(err); got != tt.want {
+				t.Errorf("IsSecurityViolation(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+
+	if !IsSecurityViolation(fmt.Errorf("verify: %w", permissionError{fmt.Errorf("world-writable")})) {
+		t.Error("IsSecurityViolation(permissionError) = false, want true")
+	}
+}
+
+// concurrencyArchive returns an archive exercising every ordering constraint
+// of concurrent writes: many small files, a file larger than
+// maxConcurrentFileSize, a path written twice, hardlinks before and after
+// their targets, a symlink, and a directory whose mode is set after its files.
+func concurrencyArchive(t *testing.T) string {
+	headers := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755},
+		{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+		{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o600},
+		{Name: "usr/bin/env", Typeflag: tar.TypeSymlink, Linkname: "../../bin/busybox"},
+		{Name: "var/lib/blob", Typeflag: tar.TypeReg, Mode: 0o644},
+	}
+	contents := map[string]string{
+		"bin/busybox":  "#!busybox\n",
+		"var/lib/blob": strings.Repeat("x", maxConcurrentFileSize+1),
+	}
+	for i := 0; i < 250; i++ {
+		name := fmt.Sprintf("usr/share/doc/%d/file%d", i%7, i)
+		headers = append(headers, &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644})
+		contents[name] = strings.Repeat(strconv.Itoa(i), i)
+	}
+	headers = append(headers, &tar.Header{Name: "usr/share/doc/0/", Typeflag: tar.TypeDir, Mode: 0o750})
+
+	// etc/hostname is written twice; the second entry must win
+	return writeTarWithDuplicates(t, headers, contents, map[int]string{4: "first\n", 5: "second\n"})
+}
+
+// writeTarWithDuplicates is writeTar for archives that repeat a path: bodies
+// are looked up by header index in byIndex before falling back to contents.
+func writeTarWithDuplicates(t *testing.T, headers []*tar.Header, contents map[string]string, byIndex map[int]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dups.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create tar: %v", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for i, h := range headers {
+		body, ok := byIndex[i]
+		if !ok {
+			body = contents[h.Name]
+		}
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("write header %s: %v", h.Name, err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatalf("write %s: %v", h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	return path
+}
+
+// treeSnapshot describes every entry under root: type, permissions, link
+// count, symlink target and a hash of the contents.
+func treeSnapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+	snap := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		desc := fmt.Sprintf("%v nlink=%d", info.Mode(), info.Sys().(*syscall.Stat_t).Nlink)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			desc += " -> " + target
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			desc += fmt.Sprintf(" %x", sha256.Sum256(data))
+		}
+		snap[rel] = desc
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk %s: %v", root, err)
+	}
+	return snap
+}
+
+// TestExtract_WriteConcurrencyEquivalent verifies extracting with a pool of
+// write workers produces the same tree and totals as a sequential extraction.
+func TestExtract_WriteConcurrencyEquivalent(t *testing.T) {
+	tarPath := concurrencyArchive(t)
+
+	extract := func(concurrency int) (*ExtractionResult, map[string]string) {
+		opts := DefaultOptions()
+		opts.WriteConcurrency = concurrency
+		dest := t.TempDir()
+		result, err := New().Extract(context.Background(), tarPath, dest, opts)
+		if err != nil {
+			t.Fatalf("Extract with concurrency %d: %v", concurrency, err)
+		}
+		return result, treeSnapshot(t, dest)
+	}
+
+	wantResult, want := extract(1)
+	if data := want["etc/hostname"]; !strings.Contains(data, fmt.Sprintf("%x", sha256.Sum256([]byte("second\n")))) {
+		t.Fatalf("sequential etc/hostname = %s, want the second entry's contents", data)
+	}
+	for _, concurrency := range []int{2, 8} {
+		result, got := extract(concurrency)
+		if result.FilesExtracted != wantResult.FilesExtracted || result.BytesExtracted != wantResult.BytesExtracted {
+			t.Errorf("concurrency %d extracted %d files, %d bytes; sequential extracted %d, %d",
+				concurrency, result.FilesExtracted, result.BytesExtracted, wantResult.FilesExtracted, wantResult.BytesExtracted)
+		}
+		if len(got) != len(want) {
+			t.Errorf("concurrency %d: %d entries, want %d", concurrency, len(got), len(want))
+		}
+		for path, desc := range want {
+			if got[path] != desc {
+				t.Errorf("concurrency %d: %s = %q, want %q", concurrency, path, got[path], desc)
+			}
+		}
+	}
+}
+
+// TestExtract_WriteConcurrencyBestEffort verifies entries that fail on a
+// write worker are skipped and reported in archive order, as they are when
+// extracting sequentially.
+func TestExtract_WriteConcurrencyBestEffort(t *testing.T) {
+	tarPath := badEntryArchive(t)
+	opts := DefaultOptions()
+	opts.BestEffort = true
+	opts.WriteConcurrency = 4
+
+	result, err := New().Extract(context.Background(), tarPath, t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	var skipped []string
+	for _, entry := range result.SkippedEntries {
+		skipped = append(skipped, entry.Path)
+	}
+	if strings.Join(skipped, ",") != "etc/passwd,bin/sh" {
+		t.Errorf("SkippedEntries = %v, want [etc/passwd bin/sh]", skipped)
+	}
+	if result.FilesExtracted != 4 {
+		t.Errorf("FilesExtracted = %d, want 4", result.FilesExtracted)
+	}
+
+	// Without BestEffort the worker's failure fails the extraction
+	opts.BestEffort = false
+	if _, err := New().Extract(context.Background(), tarPath, t.TempDir(), opts); err == nil || !strings.Contains(err.Error(), "etc/passwd") {
+		t.Fatalf("Extract error = %v, want failure naming etc/passwd", err)
+	}
+}
@@ -0,0 +1,111 @@
+package extraction
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxConcurrentFileSize is the largest regular file handed to a write worker.
+// Workers are given the file's contents, which must be read from the tar
+// stream first, so this bounds the memory held by in-flight writes to
+// WriteConcurrency times this size. Larger files are written as they are read.
+const maxConcurrentFileSize = 4 * 1024 * 1024 // 4MB
+
+// errEntrySkipped is returned by a write that failed and was skipped by a
+// best-effort extraction: the entry is not counted, but extraction goes on.
+var errEntrySkipped = errors.New("entry skipped")
+
+// fileWriter writes regular files on a bounded pool of goroutines while the
+// tar stream is read on the caller's. It tracks the destination of each write
+// in flight so entries that overlap one (the same path, a parent or a child)
+// can wait for it, keeping the archive's ordering where it matters.
+type fileWriter struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	// files and bytes are the extraction totals, shared with the caller
+	files *atomic.Int64
+	bytes *atomic.Int64
+
+	mu           sync.Mutex
+	pending      map[string]int64 // Destination path -> size, for writes in flight
+	pendingBytes int64
+	err          error // First failure, which ends the extraction
+}
+
+func newFileWriter(concurrency int, files, bytes *atomic.Int64) *fileWriter {
+	return &fileWriter{
+		sem:     make(chan struct{}, concurrency),
+		files:   files,
+		bytes:   bytes,
+		pending: make(map[string]int64),
+	}
+}
+
+// Go runs write for the file at path once a worker is free, blocking until
+// then. write returns the bytes written and an error; the file is counted
+// only if the error is nil, and any error other than errEntrySkipped fails
+// the extraction.
+func (w *fileWriter) Go(path string, size int64, write func() (int64, error)) {
+	w.sem <- struct{}{}
+	w.mu.Lock()
+	w.pending[path] = size
+	w.pendingBytes += size
+	w.mu.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		written, err := write()
+
+		// Commit under the lock so Totals never counts a file twice or not at all
+		w.mu.Lock()
+		delete(w.pending, path)
+		w.pendingBytes -= size
+		w.bytes.Add(written)
+		if err == nil {
+			w.files.Add(1)
+		} else if !errors.Is(err, errEntrySkipped) && w.err == nil {
+			w.err = err
+		}
+		w.mu.Unlock()
+		<-w.sem
+	}()
+}
+
+// Wait blocks until every write in flight has finished and returns the first
+// failure.
+func (w *fileWriter) Wait() error {
+	w.wg.Wait()
+	return w.Err()
+}
+
+// Err returns the first failure so far without waiting.
+func (w *fileWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Totals returns the files and bytes extracted, counting writes in flight as
+// done, for checking limits before the next entry.
+func (w *fileWriter) Totals() (files, bytes int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.files.Load() + int64(len(w.pending)), w.bytes.Load() + w.pendingBytes
+}
+
+// Overlaps reports whether a write in flight is to path, to a path under it,
+// or to one of its parents.
+func (w *fileWriter) Overlaps(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for p := range w.pending {
+		if p == path || strings.HasPrefix(p, path+"/") || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
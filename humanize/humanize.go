@@ -0,0 +1,38 @@
+// Package humanize formats byte counts and durations for people to read. The
+// CLI, the TUI and analyze-s3 all use it so sizes look the same everywhere.
+package humanize
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bytes formats n with binary (1024-based) units and one decimal, e.g.
+// 1536 -> "1.5 KB". Values under 1 KB are shown exactly, e.g. "512 B".
+func Bytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Duration formats d at a precision suited to its size: "250ms", "1.5s",
+// "2m5s" or "1h30m".
+func Duration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	if d < time.Minute {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	}
+	if d < time.Hour {
+		return fmt.Sprintf("%dm%ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+}
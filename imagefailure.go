@@ -0,0 +1,36 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ImageErrorStore keeps why an image's last run failed on the image's row,
+// where list-images and the dashboard show it.
+type ImageErrorStore interface {
+	RecordImageError(ctx context.Context, imageID, reason string) error
+	ClearImageError(ctx context.Context, imageID string) error
+}
+
+// RecordImageFailure returns a finalizer that records why a run aborted as
+// "<phase> failed in <state>: <error>" against the image imageID names, and
+// clears an earlier failure once a run completes. Other errors, such as a
+// shutdown, are not failures of the image and leave the row alone.
+func RecordImageFailure[R, W any](phase string, store ImageErrorStore, imageID func(*R) string) Finalizer[R, W] {
+	return func(ctx context.Context, req *Request[R, W], runErr RunErr) {
+		id := imageID(req.Msg)
+		var abortErr *AbortError
+		switch {
+		case runErr.Err == nil:
+			if err := store.ClearImageError(ctx, id); err != nil {
+				req.Log().WithError(err).Warn("failed to clear image error")
+			}
+		case errors.As(runErr.Err, &abortErr):
+			reason := fmt.Sprintf("%s failed in %s: %v", phase, runErr.State, runErr.Err)
+			if err := store.RecordImageError(ctx, id, reason); err != nil {
+				req.Log().WithError(err).Warn("failed to record image error")
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type fakeImageErrorStore map[string]string
+
+func (s fakeImageErrorStore) RecordImageError(ctx context.Context, imageID, reason string) error {
+	s[imageID] = reason
+	return nil
+}
+
+func (s fakeImageErrorStore) ClearImageError(ctx context.Context, imageID string) error {
+	delete(s, imageID)
+	return nil
+}
+
+func TestRecordImageFailure(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	const imageID = "img_1234abcd5678ef00"
+	store := fakeImageErrorStore{}
+	finalize := RecordImageFailure[ImageUnpackRequest, ImageUnpackResponse]("unpack", store,
+		func(r *ImageUnpackRequest) string { return r.ImageID })
+	req := MockRequest(&Request[ImageUnpackRequest, ImageUnpackResponse]{
+		Msg: &ImageUnpackRequest{ImageID: imageID},
+	}, logger, Run{})
+	ctx := context.Background()
+
+	finalize(ctx, req, RunErr{Err: Abort(errors.New("invalid filesystem layout")), State: "verify-layout"})
+	want := "unpack failed in verify-layout: invalid filesystem layout"
+	if got := store[imageID]; got != want {
+		t.Errorf("recorded error = %q, want %q", got, want)
+	}
+
+	// Other errors, such as a shutdown, are not failures of the image
+	finalize(ctx, req, RunErr{Err: context.Canceled, State: "extract-layers"})
+	if got := store[imageID]; got != want {
+		t.Errorf("recorded error changed to %q on a non-abort error", got)
+	}
+
+	finalize(ctx, req, RunErr{})
+	if reason, ok := store[imageID]; ok {
+		t.Errorf("error %q not cleared after a successful run", reason)
+	}
+}
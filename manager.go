@@ -156,6 +156,7 @@ func New(cfg Config) (*Manager, error) {
 			name:   name,
 			size:   size,
 			queue:  make(chan queueItem),
+			resize: make(chan int),
 			queued: make([]func(), 0, size),
 		}
 		man.queues[name] = q
@@ -230,6 +231,33 @@ func (m *Manager) Shutdown(timeout time.Duration) {
 	m.logger.Info("shutdown complete")
 }
 
+// ResizeQueue changes how many FSMs the named queue runs concurrently. Runs
+// already executing are never interrupted: shrinking a queue only holds back
+// queued runs until enough in-flight ones finish.
+func (m *Manager) ResizeQueue(name string, size int) error {
+	if size < 1 {
+		return fmt.Errorf("invalid size %d for queue %s: must be at least 1", size, name)
+	}
+	q, ok := m.queues[name]
+	if !ok {
+		return fmt.Errorf("queue %s not found", name)
+	}
+	select {
+	case q.resize <- size:
+		return nil
+	case <-m.done:
+		return errors.New("manager is shut down")
+	}
+}
+
+// Running returns the number of runs currently executing. Runs still waiting
+// in a queue are not counted.
+func (m *Manager) Running() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.running)
+}
+
 type ActiveKey struct {
 	Action  string
 	Version ulid.ULID
@@ -0,0 +1,73 @@
+package fsm
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestManager_ResizeQueue(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	m, err := New(Config{Logger: logger, DBPath: t.TempDir(), Queues: map[string]int{"work": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Shutdown(time.Second) })
+
+	var running atomic.Int32
+	release := make(chan struct{})
+	q := m.queues["work"]
+	for range 5 {
+		q.Run(context.Background(), logger, make(chan struct{}), func() {
+			running.Add(1)
+			<-release
+			running.Add(-1)
+		})
+	}
+	waitFor(t, "2 running", func() bool { return running.Load() == 2 })
+
+	// After shrinking, a finished function is not replaced until the
+	// queue is under its new size
+	if err := m.ResizeQueue("work", 1); err != nil {
+		t.Fatal(err)
+	}
+	release <- struct{}{}
+	waitFor(t, "1 running", func() bool { return running.Load() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if got := running.Load(); got != 1 {
+		t.Fatalf("running = %d after shrinking to 1, want 1", got)
+	}
+
+	// Growing starts queued functions at once
+	if err := m.ResizeQueue("work", 3); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "3 running", func() bool { return running.Load() == 3 })
+
+	close(release)
+	waitFor(t, "the queue to drain", func() bool { return running.Load() == 0 })
+
+	if err := m.ResizeQueue("work", 0); err == nil {
+		t.Error("ResizeQueue(0) succeeded")
+	}
+	if err := m.ResizeQueue("missing", 1); err == nil {
+		t.Error("ResizeQueue() of an unknown queue succeeded")
+	}
+}
@@ -0,0 +1,19 @@
+package fsm
+
+// RetryPolicy caps how many times each transition of an FSM is retried before
+// the run aborts, keyed by the transition's state name ("download",
+// "extract-layers", ...). A missing or zero entry uses the transition's
+// default; a negative entry disables retries for that transition.
+type RetryPolicy map[string]int
+
+// Limit returns the retry limit for the transition named state, whose default
+// is def.
+func (p RetryPolicy) Limit(state string, def int) uint64 {
+	switch n := p[state]; {
+	case n > 0:
+		return uint64(n)
+	case n < 0:
+		return 0
+	}
+	return uint64(def)
+}
@@ -0,0 +1,25 @@
+package fsm
+
+import "testing"
+
+func TestRetryPolicy_Limit(t *testing.T) {
+	p := RetryPolicy{"download": 7, "validate": -1}
+	tests := []struct {
+		state string
+		want  uint64
+	}{
+		{"download", 7},
+		{"validate", 0}, // negative disables retries
+		{"store-metadata", 5},
+	}
+	for _, tt := range tests {
+		if got := p.Limit(tt.state, 5); got != tt.want {
+			t.Errorf("Limit(%q, 5) = %d, want %d", tt.state, got, tt.want)
+		}
+	}
+
+	var zero RetryPolicy
+	if got := zero.Limit("download", 3); got != 3 {
+		t.Errorf("nil policy Limit() = %d, want the default 3", got)
+	}
+}
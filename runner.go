@@ -85,6 +85,8 @@ type queuedRunner struct {
 
 	queue chan queueItem
 
+	resize chan int
+
 	queued []func()
 }
 
@@ -117,7 +119,29 @@ func (r *queuedRunner) run(quit <-chan struct{}, logger logrus.FieldLogger) {
 	logger = logger.WithFields(logrus.Fields{"queue": r.name, "size": r.size})
 	logger.Info("started")
 
-	done := make(chan struct{}, r.size)
+	// done is not sized to the queue, which can be resized; a function
+	// finishing after quit gives up instead of blocking forever
+	done := make(chan struct{})
+	execute := func(fn func()) {
+		r.inflight++
+		logger.WithFields(r.withFields()).Info("executing")
+		go func() {
+			fn()
+			select {
+			case done <- struct{}{}:
+			case <-quit:
+			}
+		}()
+	}
+	// startQueued runs queued functions while there is room under the
+	// current size
+	startQueued := func() {
+		for r.inflight < r.size && len(r.queued) > 0 {
+			f := r.queued[0]
+			r.queued = r.queued[1:]
+			execute(f)
+		}
+	}
 	for {
 		select {
 		case <-quit:
@@ -126,33 +150,22 @@ func (r *queuedRunner) run(quit <-chan struct{}, logger logrus.FieldLogger) {
 		case <-done:
 			r.inflight--
 			logger.WithFields(r.withFields()).Info("done")
-			switch len(r.queued) {
-			case 0:
-				continue
-			default:
-				f := r.queued[0]
-				r.queued = r.queued[1:]
-				r.inflight++
-				logger.WithFields(r.withFields()).Info("executing")
-				go func() {
-					f()
-					done <- struct{}{}
-				}()
-			}
+			startQueued()
 		case item := <-r.queue:
 			switch {
 			case r.inflight >= r.size:
 				r.queued = append(r.queued, item.fn)
 				logger.WithFields(r.withFields()).Info("queued")
 			default:
-				r.inflight++
-				logger.WithFields(r.withFields()).Info("executing")
-				go func() {
-					item.fn()
-					done <- struct{}{}
-				}()
+				execute(item.fn)
 			}
 			close(item.ack)
+		case size := <-r.resize:
+			// Shrinking lets in-flight functions finish; growing starts queued ones now
+			r.size = size
+			logger = logger.WithField("size", size)
+			logger.WithFields(r.withFields()).Info("resized")
+			startQueued()
 		}
 	}
 }
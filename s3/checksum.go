@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// sha256MetadataKey is the user metadata key (x-amz-meta-sha256) that uploaders
+// may set to publish the hex SHA256 of an object.
+const sha256MetadataKey = "sha256"
+
+// objectSHA256 returns the authoritative hex-encoded SHA256 of an S3 object, or
+// "" if the object does not publish one.
+//
+// The S3 ChecksumSHA256 field (base64) is preferred. Composite checksums from
+// multipart uploads ("<base64>-<parts>") are not a digest of the whole object
+// and are ignored. Otherwise the x-amz-meta-sha256 user metadata is used.
+func objectSHA256(checksumSHA256 *string, metadata map[string]string) string {
+	if checksumSHA256 != nil && !strings.Contains(*checksumSHA256, "-") {
+		if sum, err := base64.StdEncoding.DecodeString(*checksumSHA256); err == nil && len(sum) == 32 {
+			return hex.EncodeToString(sum)
+		}
+	}
+
+	for k, v := range metadata {
+		if !strings.EqualFold(k, sha256MetadataKey) {
+			continue
+		}
+		v = strings.ToLower(strings.TrimSpace(v))
+		if sum, err := hex.DecodeString(v); err == nil && len(sum) == 32 {
+			return v
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,107 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/superfly/fsm/checksum"
+)
+
+func TestObjectSHA256(t *testing.T) {
+	sum := sha256.Sum256([]byte("image contents"))
+	hexSum := hex.EncodeToString(sum[:])
+	b64Sum := base64.StdEncoding.EncodeToString(sum[:])
+	composite := b64Sum + "-3"
+	invalid := "not-base64!"
+
+	tests := []struct {
+		name     string
+		checksum *string
+		metadata map[string]string
+		want     string
+	}{
+		{name: "none", want: ""},
+		{name: "ChecksumSHA256", checksum: &b64Sum, want: hexSum},
+		{name: "metadata", metadata: map[string]string{"sha256": hexSum}, want: hexSum},
+		{name: "metadata uppercase", metadata: map[string]string{"Sha256": strings.ToUpper(hexSum)}, want: hexSum},
+		{name: "ChecksumSHA256 preferred", checksum: &b64Sum, metadata: map[string]string{"sha256": strings.Repeat("0", 64)}, want: hexSum},
+		{name: "composite falls back to metadata", checksum: &composite, metadata: map[string]string{"sha256": hexSum}, want: hexSum},
+		{name: "composite only", checksum: &composite, want: ""},
+		{name: "invalid checksum", checksum: &invalid, want: ""},
+		{name: "invalid metadata", metadata: map[string]string{"sha256": "abc123"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := objectSHA256(tt.checksum, tt.metadata); got != tt.want {
+				t.Errorf("objectSHA256() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestObjectSHA256_FakeS3 downloads from a fake S3 endpoint that returns raw
+// checksum headers, so the SDK's header mapping and objectSHA256 both run, and
+// checks the published checksum against the downloaded content as
+// validateBlob does.
+func TestObjectSHA256_FakeS3(t *testing.T) {
+	content := []byte("tarball bytes")
+	good := sha256.Sum256(content)
+	bad := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name      string
+		header    string
+		value     string
+		wantMatch bool
+	}{
+		{name: "matching x-amz-checksum-sha256", header: "x-amz-checksum-sha256", value: base64.StdEncoding.EncodeToString(good[:]), wantMatch: true},
+		{name: "mismatching x-amz-checksum-sha256", header: "x-amz-checksum-sha256", value: base64.StdEncoding.EncodeToString(bad[:])},
+		{name: "matching x-amz-meta-sha256", header: "x-amz-meta-sha256", value: hex.EncodeToString(good[:]), wantMatch: true},
+		{name: "mismatching x-amz-meta-sha256", header: "x-amz-meta-sha256", value: hex.EncodeToString(bad[:])},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(tt.header, tt.value)
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				if r.Method != http.MethodHead {
+					w.Write(content)
+				}
+			}))
+			defer srv.Close()
+
+			c := newTestClient()
+			c.checksumAlgo = checksum.SHA256
+			c.s3Client = s3.New(s3.Options{
+				Region:       "us-east-1",
+				BaseEndpoint: aws.String(srv.URL),
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+			})
+
+			result, err := c.DownloadImage(context.Background(), "images", "alpine.tar", filepath.Join(t.TempDir(), "alpine.tar"))
+			if err != nil {
+				t.Fatalf("DownloadImage() error = %v", err)
+			}
+			if result.ExpectedChecksum == "" {
+				t.Fatal("DownloadImage() found no checksum in headers")
+			}
+			if match := result.Checksum == result.ExpectedChecksum; match != tt.wantMatch {
+				t.Errorf("checksum match = %v, want %v", match, tt.wantMatch)
+			}
+		})
+	}
+}
@@ -6,10 +6,15 @@
 // # Features
 //
 //   - Streaming downloads (no buffering entire file in memory)
-//   - Automatic SHA256 checksum computation during download
+//   - Checksum computation during download (SHA256 by default, or
+//     Config.ChecksumAlgo)
 //   - Size limit enforcement (10GB max)
 //   - S3 key validation (path traversal prevention)
-//   - Atomic file writes (temp file + rename)
+//   - Atomic file writes (.part file + rename)
+//   - Resumable downloads from an interrupted .part file
+//   - Streaming an image to a consumer while it downloads (StreamImage)
+//   - Downloads from presigned GET URLs for buckets without IAM access
+//   - Bucket region detection via GetBucketLocation (Config.AutoDetectRegion)
 //
 // # Authentication
 //
@@ -49,21 +54,29 @@ package s3
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/sirupsen/logrus"
+
+	"github.com/superfly/fsm/checksum"
 )
 
+// maxDownloadSize is the largest object the client will download (10GB).
+const maxDownloadSize = 10 * 1024 * 1024 * 1024
+
+// ErrObjectTooLarge indicates that an object is larger than maxDownloadSize.
+var ErrObjectTooLarge = errors.New("file too large")
+
 // ProgressFunc is called periodically during download with progress updates
 type ProgressFunc func(downloaded, total int64, speed float64)
 
@@ -72,6 +85,9 @@ type Client struct {
 	s3Client     *s3.Client
 	logger       *logrus.Logger
 	progressFunc ProgressFunc
+	concurrency  int
+	region       string
+	checksumAlgo checksum.Algo
 }
 
 // Config holds S3 client configuration.
@@ -81,21 +97,88 @@ type Config struct {
 
 	// Bucket is the default S3 bucket name
 	Bucket string
+
+	// Concurrency is the number of parallel range requests used by
+	// DownloadImageMultipart (optional, defaults to DefaultConcurrency)
+	Concurrency int
+
+	// AutoDetectRegion looks up Bucket's region with GetBucketLocation when
+	// Region is empty, instead of failing later with timeouts or redirects
+	AutoDetectRegion bool
+
+	// ChecksumAlgo is the algorithm downloads are hashed with (optional,
+	// defaults to checksum.Default)
+	ChecksumAlgo checksum.Algo
+}
+
+// locationRegion is the region GetBucketLocation is sent to when detecting a
+// bucket's region. Any region answers for any bucket.
+const locationRegion = "us-east-1"
+
+// bucketLocator is the subset of *s3.Client used to detect a bucket's region.
+type bucketLocator interface {
+	GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error)
+}
+
+// newBucketLocator builds the client used for region detection. Tests
+// replace it with a fake.
+var newBucketLocator = func(awsCfg aws.Config) bucketLocator {
+	return s3.NewFromConfig(awsCfg)
+}
+
+// detectBucketRegion returns the region bucket lives in.
+func detectBucketRegion(ctx context.Context, api bucketLocator, bucket string) (string, error) {
+	out, err := api.GetBucketLocation(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return "", fmt.Errorf("failed to get location of bucket %s: %w", bucket, err)
+	}
+	return locationConstraintRegion(out.LocationConstraint), nil
+}
+
+// locationConstraintRegion maps a GetBucketLocation constraint to a region.
+// Buckets in us-east-1 report an empty constraint, and some old buckets in
+// eu-west-1 report the legacy "EU".
+func locationConstraintRegion(lc types.BucketLocationConstraint) string {
+	switch lc {
+	case "":
+		return "us-east-1"
+	case types.BucketLocationConstraintEu:
+		return "eu-west-1"
+	default:
+		return string(lc)
+	}
 }
 
 // DefaultConfig returns a default S3 configuration.
 func DefaultConfig() Config {
 	return Config{
-		Region: "us-east-1",
-		Bucket: "flyio-container-images",
+		Region:      "us-east-1",
+		Bucket:      "flyio-container-images",
+		Concurrency: DefaultConcurrency,
 	}
 }
 
 // New creates a new S3 client.
 func New(ctx context.Context, cfg Config) (*Client, error) {
+	logger := logrus.New()
+
+	algo, err := checksum.ParseAlgo(string(cfg.ChecksumAlgo))
+	if err != nil {
+		return nil, err
+	}
+
+	detect := cfg.AutoDetectRegion && cfg.Region == ""
+	if detect && cfg.Bucket == "" {
+		return nil, errors.New("region auto-detection requires a bucket")
+	}
+	region := cfg.Region
+	if detect {
+		region = locationRegion
+	}
+
 	// Load AWS configuration
 	opts := []func(*config.LoadOptions) error{
-		config.WithRegion(cfg.Region),
+		config.WithRegion(region),
 	}
 
 	// If no credentials provided in env, use anonymous
@@ -108,12 +191,37 @@ func New(ctx context.Context, cfg Config) (*Client, error) {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
+	if detect {
+		detected, err := detectBucketRegion(ctx, newBucketLocator(awsCfg), cfg.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		logger.WithFields(logrus.Fields{
+			"bucket": cfg.Bucket,
+			"region": detected,
+		}).Info("detected S3 bucket region")
+		awsCfg.Region = detected
+	}
+
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
 	return &Client{
-		s3Client: s3.NewFromConfig(awsCfg),
-		logger:   logrus.New(),
+		s3Client:     s3.NewFromConfig(awsCfg),
+		logger:       logger,
+		concurrency:  concurrency,
+		region:       awsCfg.Region,
+		checksumAlgo: algo,
 	}, nil
 }
 
+// Region returns the AWS region the client sends requests to.
+func (c *Client) Region() string {
+	return c.region
+}
+
 // SetLogger sets a custom logger for the client.
 func (c *Client) SetLogger(logger *logrus.Logger) {
 	c.logger = logger
@@ -136,18 +244,30 @@ type DownloadResult struct {
 	// LocalPath is the path to the downloaded file
 	LocalPath string
 
-	// Checksum is the SHA256 hash of the downloaded file
-	Checksum string
+	// Checksum is the hex digest of the downloaded file, taken with
+	// ChecksumAlgo
+	Checksum     string
+	ChecksumAlgo checksum.Algo
 
 	// SizeBytes is the size of the downloaded file in bytes
 	SizeBytes int64
+
+	// ExpectedChecksum is the SHA256 published by S3 for the object (from
+	// ChecksumSHA256 or x-amz-meta-sha256), or "" if the object has none
+	ExpectedChecksum string
 }
 
 // DownloadImage downloads an image from S3 to a local file with streaming.
 //
 // The function downloads the S3 object in a streaming fashion (no full buffering),
-// computes SHA256 checksum on-the-fly, and enforces size limits. The download is
-// atomic: it writes to a temp file first, then renames on success.
+// computes its checksum on-the-fly, and enforces size limits. The download is
+// atomic: it writes to destPath+".part" first, then renames on success.
+//
+// If a .part file from an interrupted download exists, only the remaining bytes
+// are fetched with a ranged GetObject, pinned with If-Match to the ETag
+// recorded beside the .part file; a .part file from another version of the
+// object is discarded. The .part file is kept on failure and is locked while
+// in use, so concurrent downloads of the same path fail fast.
 //
 // Parameters:
 //   - ctx: Context for cancellation and timeouts
@@ -278,17 +398,17 @@ func (c *Client) DownloadImage(ctx context.Context, bucket, key, destPath string
 
 	// Get object metadata first to check size
 	headResp, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get object metadata: %w", err)
 	}
 
 	// Enforce size limit (10GB max)
-	const maxSize = 10 * 1024 * 1024 * 1024 // 10GB
-	if headResp.ContentLength != nil && *headResp.ContentLength > maxSize {
-		return nil, fmt.Errorf("file too large: %d bytes (max %d)", *headResp.ContentLength, maxSize)
+	if headResp.ContentLength != nil && *headResp.ContentLength > maxDownloadSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrObjectTooLarge, *headResp.ContentLength, maxDownloadSize)
 	}
 
 	// Log expected content length
@@ -298,86 +418,41 @@ func (c *Client) DownloadImage(ctx context.Context, bucket, key, destPath string
 		logger.WithField("content_length", humanBytes(totalSize)).Info("s3 object metadata fetched")
 	}
 
-	// Create temporary file for download
-	tmpPath := destPath + ".tmp"
-	tmpFile, err := os.Create(tmpPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temporary file: %w", err)
-	}
-	defer func() {
-		tmpFile.Close()
-		// Clean up temp file if we didn't move it
-		if _, err := os.Stat(tmpPath); err == nil {
-			os.Remove(tmpPath)
+	// Download object with streaming, resuming from a previous .part file if
+	// present. A resumed request only succeeds against the version the .part
+	// file came from.
+	get := func(ctx context.Context, offset int64, etag string) (io.ReadCloser, bool, error) {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
 		}
-	}()
-
-	// Download object with streaming
-	getResp, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get object: %w", err)
+		if offset > 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+			input.IfMatch = aws.String(etag)
+		}
+		getResp, err := c.s3Client.GetObject(ctx, input)
+		if err != nil {
+			if offset > 0 && isPreconditionFailed(err) {
+				return nil, false, errObjectChanged
+			}
+			return nil, false, err
+		}
+		return getResp.Body, getResp.ContentRange != nil, nil
 	}
-	defer getResp.Body.Close()
-
-	// Stream to file while computing checksum, with progress logging
-	hash := sha256.New()
-	multiWriter := io.MultiWriter(tmpFile, hash)
 
-	// Wrap body with progress reader (log every 5s)
-	pr := newProgressReader(getResp.Body, logger, c.progressFunc, totalSize, 5*time.Second)
-
-	written, err := io.Copy(multiWriter, pr)
+	result, err := c.downloadToPart(ctx, logger, destPath, totalSize, aws.ToString(headResp.ETag), get)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download file: %w", err)
-	}
-
-	// Final progress log at completion
-	logger.WithFields(logrus.Fields{
-		"downloaded": humanBytes(written),
-		"total":      humanBytes(totalSize),
-	}).Info("s3 download completed")
-
-	// Final progress callback
-	if c.progressFunc != nil {
-		c.progressFunc(written, totalSize, 0)
-	}
-
-	// Sync to disk
-	if err := tmpFile.Sync(); err != nil {
-		return nil, fmt.Errorf("failed to sync file: %w", err)
+		return nil, err
 	}
+	result.ExpectedChecksum = objectSHA256(headResp.ChecksumSHA256, headResp.Metadata)
+	return result, nil
+}
 
-	// Close temp file before moving
-	if err := tmpFile.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close temp file: %w", err)
-	}
-
-	// Ensure destination directory exists
-	destDir := filepath.Dir(destPath)
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create destination directory: %w", err)
-	}
-
-	// Move temp file to final destination
-	if err := os.Rename(tmpPath, destPath); err != nil {
-		return nil, fmt.Errorf("failed to move file to destination: %w", err)
-	}
-
-	checksum := hex.EncodeToString(hash.Sum(nil))
-
-	logger.WithFields(logrus.Fields{
-		"size":     written,
-		"checksum": checksum,
-	}).Info("download completed")
-
-	return &DownloadResult{
-		LocalPath: destPath,
-		Checksum:  checksum,
-		SizeBytes: written,
-	}, nil
+// isPreconditionFailed reports whether err is an HTTP 412 response, as S3
+// returns for a GetObject whose If-Match no longer matches.
+func isPreconditionFailed(err error) bool {
+	var status interface{ HTTPStatusCode() int }
+	return errors.As(err, &status) && status.HTTPStatusCode() == http.StatusPreconditionFailed
 }
 
 // validateS3Key validates an S3 key for security.
@@ -419,8 +494,28 @@ func (c *Client) ListImages(ctx context.Context, bucket, prefix string) ([]strin
 
 	logger.Info("listing S3 objects")
 
-	var keys []string
-	paginator := s3.NewListObjectsV2Paginator(c.s3Client, &s3.ListObjectsV2Input{
+	objs, err := listObjects(ctx, c.s3Client, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		keys = append(keys, *obj.Key)
+	}
+
+	logger.WithField("count", len(keys)).Info("listed S3 objects")
+
+	return keys, nil
+}
+
+// listObjects returns every object in bucket whose key starts with prefix,
+// following continuation tokens. The prefix is sent to S3 and also checked
+// client-side, since some S3-compatible stores ignore it and return the
+// whole bucket.
+func listObjects(ctx context.Context, api s3.ListObjectsV2APIClient, bucket, prefix string) ([]types.Object, error) {
+	var objects []types.Object
+	paginator := s3.NewListObjectsV2Paginator(api, &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
 		Prefix: aws.String(prefix),
 	})
@@ -432,15 +527,13 @@ func (c *Client) ListImages(ctx context.Context, bucket, prefix string) ([]strin
 		}
 
 		for _, obj := range page.Contents {
-			if obj.Key != nil {
-				keys = append(keys, *obj.Key)
+			if obj.Key != nil && strings.HasPrefix(*obj.Key, prefix) {
+				objects = append(objects, obj)
 			}
 		}
 	}
 
-	logger.WithField("count", len(keys)).Info("listed S3 objects")
-
-	return keys, nil
+	return objects, nil
 }
 
 // ObjectExists checks if an object exists in S3.
@@ -494,32 +587,23 @@ func (c *Client) ListImagesDetailed(ctx context.Context, bucket, prefix string)
 
 	logger.Info("listing S3 objects with metadata")
 
-	var objects []S3Object
-	paginator := s3.NewListObjectsV2Paginator(c.s3Client, &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
-	})
+	objs, err := listObjects(ctx, c.s3Client, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list objects: %w", err)
+	objects := make([]S3Object, 0, len(objs))
+	for _, obj := range objs {
+		s3obj := S3Object{
+			Key: *obj.Key,
 		}
-
-		for _, obj := range page.Contents {
-			if obj.Key != nil {
-				s3obj := S3Object{
-					Key: *obj.Key,
-				}
-				if obj.Size != nil {
-					s3obj.Size = *obj.Size
-				}
-				if obj.LastModified != nil {
-					s3obj.LastModified = *obj.LastModified
-				}
-				objects = append(objects, s3obj)
-			}
+		if obj.Size != nil {
+			s3obj.Size = *obj.Size
+		}
+		if obj.LastModified != nil {
+			s3obj.LastModified = *obj.LastModified
 		}
+		objects = append(objects, s3obj)
 	}
 
 	logger.WithField("count", len(objects)).Info("listed S3 objects with metadata")
@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeLocator answers GetBucketLocation with a fixed constraint and records
+// the bucket and region it was asked from.
+type fakeLocator struct {
+	constraint types.BucketLocationConstraint
+	err        error
+
+	bucket string
+	region string
+}
+
+func (f *fakeLocator) GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error) {
+	f.bucket = aws.ToString(params.Bucket)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &s3.GetBucketLocationOutput{LocationConstraint: f.constraint}, nil
+}
+
+// useLocator makes New detect regions with fake for the rest of the test.
+func useLocator(t *testing.T, fake *fakeLocator) {
+	old := newBucketLocator
+	newBucketLocator = func(awsCfg aws.Config) bucketLocator {
+		fake.region = awsCfg.Region
+		return fake
+	}
+	t.Cleanup(func() { newBucketLocator = old })
+}
+
+func TestNew_AutoDetectRegion(t *testing.T) {
+	fake := &fakeLocator{constraint: types.BucketLocationConstraintEuCentral1}
+	useLocator(t, fake)
+
+	c, err := New(context.Background(), Config{Bucket: "images", AutoDetectRegion: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if fake.bucket != "images" || fake.region != locationRegion {
+		t.Errorf("GetBucketLocation(%q) sent to %q, want bucket images via %s", fake.bucket, fake.region, locationRegion)
+	}
+	if c.Region() != "eu-central-1" {
+		t.Errorf("Region() = %q, want eu-central-1", c.Region())
+	}
+	if got := c.s3Client.Options().Region; got != "eu-central-1" {
+		t.Errorf("S3 client region = %q, want eu-central-1", got)
+	}
+}
+
+func TestNew_ExplicitRegionSkipsDetection(t *testing.T) {
+	fake := &fakeLocator{constraint: types.BucketLocationConstraintEuCentral1}
+	useLocator(t, fake)
+
+	c, err := New(context.Background(), Config{Region: "us-west-2", Bucket: "images", AutoDetectRegion: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if fake.bucket != "" {
+		t.Error("GetBucketLocation called although a region was set")
+	}
+	if c.Region() != "us-west-2" || c.s3Client.Options().Region != "us-west-2" {
+		t.Errorf("region = %q, want the configured us-west-2", c.Region())
+	}
+}
+
+func TestNew_AutoDetectRegionErrors(t *testing.T) {
+	useLocator(t, &fakeLocator{err: errors.New("AccessDenied")})
+
+	if _, err := New(context.Background(), Config{Bucket: "images", AutoDetectRegion: true}); err == nil {
+		t.Error("expected error when GetBucketLocation fails")
+	}
+	if _, err := New(context.Background(), Config{AutoDetectRegion: true}); err == nil {
+		t.Error("expected error when no bucket is set")
+	}
+}
+
+func TestLocationConstraintRegion(t *testing.T) {
+	tests := []struct {
+		constraint types.BucketLocationConstraint
+		want       string
+	}{
+		{constraint: "", want: "us-east-1"},
+		{constraint: types.BucketLocationConstraintEu, want: "eu-west-1"},
+		{constraint: types.BucketLocationConstraintApSoutheast2, want: "ap-southeast-2"},
+	}
+	for _, tt := range tests {
+		if got := locationConstraintRegion(tt.constraint); got != tt.want {
+			t.Errorf("locationConstraintRegion(%q) = %q, want %q", tt.constraint, got, tt.want)
+		}
+	}
+}
+
+// fakeLister serves keys from pages, continuing by page index, and records
+// the prefix of each request.
+type fakeLister struct {
+	pages    [][]string
+	prefixes []string
+}
+
+func (f *fakeLister) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.prefixes = append(f.prefixes, aws.ToString(params.Prefix))
+
+	page := 0
+	if params.ContinuationToken != nil {
+		page = int((*params.ContinuationToken)[0] - '0')
+	}
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range f.pages[page] {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(key), Size: aws.Int64(1)})
+	}
+	if page+1 < len(f.pages) {
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(string(rune('0' + page + 1)))
+	}
+	return out, nil
+}
+
+func TestListObjects_HonorsPrefix(t *testing.T) {
+	// The second page includes keys a store ignoring Prefix would return
+	fake := &fakeLister{pages: [][]string{
+		{"images/team-a/alpine.tar", "images/team-a/busybox.tar"},
+		{"images/team-b/nginx.tar", "images/team-a/ubuntu.tar"},
+	}}
+
+	objs, err := listObjects(context.Background(), fake, "bucket", "images/team-a/")
+	if err != nil {
+		t.Fatalf("listObjects() error = %v", err)
+	}
+
+	var got []string
+	for _, obj := range objs {
+		got = append(got, aws.ToString(obj.Key))
+	}
+	want := []string{"images/team-a/alpine.tar", "images/team-a/busybox.tar", "images/team-a/ubuntu.tar"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+	for _, p := range fake.prefixes {
+		if p != "images/team-a/" {
+			t.Errorf("request prefix = %q, want images/team-a/", p)
+		}
+	}
+	if len(fake.prefixes) != 2 {
+		t.Errorf("made %d requests, want 2", len(fake.prefixes))
+	}
+}
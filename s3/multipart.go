@@ -0,0 +1,303 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultConcurrency is the default number of parallel range requests
+	// issued by DownloadImageMultipart.
+	DefaultConcurrency = 8
+
+	// multipartChunkSize is the size of each ranged GetObject request.
+	multipartChunkSize = 16 * 1024 * 1024 // 16MB
+)
+
+// rangeGetFunc fetches the inclusive byte range [start, end] of an object.
+type rangeGetFunc func(ctx context.Context, start, end int64) (io.ReadCloser, error)
+
+// DownloadImageMultipart downloads an S3 object using parallel ranged GetObject
+// requests, writing each range directly into its offset of destPath's .part
+// file, which is locked while in use as in DownloadImage.
+//
+// The number of in-flight requests is set by Config.Concurrency. Every range
+// is requested with If-Match on the ETag read up front, so an object replaced
+// mid-download fails the download instead of mixing two versions. The
+// checksum is computed over the assembled file once all ranges have landed,
+// so the result is identical to DownloadImage.
+//
+// Ranges cannot be resumed individually. On failure the .part file is cut
+// back to the ranges received in order from the start of the object, so
+// DownloadImage can resume from it; any other .part file is discarded.
+func (c *Client) DownloadImageMultipart(ctx context.Context, bucket, key, destPath string) (*DownloadResult, error) {
+	// Validate S3 key
+	if err := validateS3Key(key); err != nil {
+		return nil, fmt.Errorf("invalid S3 key: %w", err)
+	}
+
+	logger := c.logger.WithFields(logrus.Fields{
+		"bucket":      bucket,
+		"key":         key,
+		"dest":        destPath,
+		"concurrency": c.concurrency,
+	})
+
+	logger.Info("starting multipart S3 download")
+
+	// Ranged downloads need the exact size up front
+	headResp, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object metadata: %w", err)
+	}
+	if headResp.ContentLength == nil {
+		return nil, fmt.Errorf("failed to get object metadata: object has no content length")
+	}
+	totalSize := *headResp.ContentLength
+
+	if totalSize > maxDownloadSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrObjectTooLarge, totalSize, maxDownloadSize)
+	}
+
+	logger.WithField("content_length", humanBytes(totalSize)).Info("s3 object metadata fetched")
+
+	// Ensure destination directory exists
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	partPath := PartialPath(destPath)
+	partFile, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partial file: %w", err)
+	}
+	defer partFile.Close()
+
+	if err := lockPartial(partFile); err != nil {
+		return nil, err
+	}
+	// Ranges land out of order, so the .part file is not resumable until it
+	// has been trimmed to an unbroken prefix
+	if err := writePartialETag(destPath, ""); err != nil {
+		return nil, err
+	}
+	if err := partFile.Truncate(0); err != nil {
+		return nil, fmt.Errorf("failed to reset partial file: %w", err)
+	}
+
+	getRange := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		resp, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			IfMatch: headResp.ETag,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+
+	// Report progress every 5s while ranges are in flight
+	var downloaded atomic.Int64
+	started := time.Now()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				read := downloaded.Load()
+				rate := float64(read) / now.Sub(started).Seconds()
+				logger.WithFields(logrus.Fields{
+					"downloaded": humanBytes(read),
+					"total":      humanBytes(totalSize),
+					"avg_rate":   humanBytes(int64(rate)) + "/s",
+				}).Info("s3 download progress")
+				if c.progressFunc != nil {
+					c.progressFunc(read, totalSize, rate)
+				}
+			}
+		}
+	}()
+
+	received, err := downloadRanges(ctx, partFile, totalSize, multipartChunkSize, c.concurrency, getRange, func(n int64) {
+		downloaded.Add(n)
+	})
+	close(done)
+	if err != nil {
+		// Keep only the unbroken prefix, which DownloadImage can resume from
+		if truncErr := partFile.Truncate(received); truncErr != nil {
+			logger.WithError(truncErr).Warn("failed to trim partial file; discarding it")
+			os.Remove(partPath)
+		} else {
+			partFile.Sync()
+			if etagErr := writePartialETag(destPath, aws.ToString(headResp.ETag)); etagErr != nil {
+				logger.WithError(etagErr).Warn("failed to record partial download ETag")
+			}
+		}
+		return nil, fmt.Errorf("failed to download file after %s: %w", humanBytes(received), err)
+	}
+
+	logger.WithField("downloaded", humanBytes(totalSize)).Info("s3 download completed")
+
+	// Final progress callback
+	if c.progressFunc != nil {
+		c.progressFunc(totalSize, totalSize, 0)
+	}
+
+	// Sync to disk
+	if err := partFile.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	// Checksum the assembled file; ranges arrive out of order so it cannot be
+	// computed while streaming.
+	hash, err := c.checksumAlgo.New()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hash, io.NewSectionReader(partFile, 0, totalSize)); err != nil {
+		return nil, fmt.Errorf("failed to compute checksum: %w", err)
+	}
+
+	// Move partial file to final destination while still holding the lock
+	if err := os.Rename(partPath, destPath); err != nil {
+		return nil, fmt.Errorf("failed to move file to destination: %w", err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	logger.WithFields(logrus.Fields{
+		"size":     totalSize,
+		"checksum": checksum,
+	}).Info("download completed")
+
+	return &DownloadResult{
+		LocalPath:        destPath,
+		Checksum:         checksum,
+		ChecksumAlgo:     c.checksumAlgo,
+		SizeBytes:        totalSize,
+		ExpectedChecksum: objectSHA256(headResp.ChecksumSHA256, headResp.Metadata),
+	}, nil
+}
+
+// downloadRanges splits [0, size) into chunkSize ranges and fetches them with
+// up to concurrency workers, writing each at its offset in dst. The first
+// failure cancels the remaining requests. onProgress, if set, is called with
+// the number of bytes written and must be safe for concurrent use.
+//
+// It returns how many bytes from the start of dst were written without a gap:
+// size on success, and on failure the ranges that completed before the first
+// one that did not.
+func downloadRanges(ctx context.Context, dst io.WriterAt, size, chunkSize int64, concurrency int, get rangeGetFunc, onProgress func(int64)) (int64, error) {
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	offsets := make(chan int64)
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		mu       sync.Mutex
+		written  = make([]bool, (size+chunkSize-1)/chunkSize)
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range offsets {
+				end := min(start+chunkSize, size) - 1
+				if err := downloadRange(ctx, dst, start, end, get, onProgress); err != nil {
+					fail(err)
+					return
+				}
+				mu.Lock()
+				written[start/chunkSize] = true
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for start := int64(0); start < size; start += chunkSize {
+		select {
+		case offsets <- start:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(offsets)
+	wg.Wait()
+
+	var received int64
+	for _, ok := range written {
+		if !ok {
+			break
+		}
+		received += chunkSize
+	}
+	received = min(received, size)
+
+	if firstErr != nil {
+		return received, firstErr
+	}
+	return received, ctx.Err()
+}
+
+// downloadRange fetches the inclusive range [start, end] and writes it at
+// offset start, failing if the body is shorter or longer than requested.
+func downloadRange(ctx context.Context, dst io.WriterAt, start, end int64, get rangeGetFunc, onProgress func(int64)) error {
+	body, err := get(ctx, start, end)
+	if err != nil {
+		return fmt.Errorf("range %d-%d: %w", start, end, err)
+	}
+	defer body.Close()
+
+	want := end - start + 1
+	w := io.NewOffsetWriter(dst, start)
+	n, err := io.Copy(w, io.LimitReader(body, want+1))
+	if err != nil {
+		return fmt.Errorf("range %d-%d: %w", start, end, err)
+	}
+	if n != want {
+		return fmt.Errorf("range %d-%d: got %d bytes, want %d", start, end, n, want)
+	}
+	if onProgress != nil {
+		onProgress(n)
+	}
+	return nil
+}
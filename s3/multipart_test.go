@@ -0,0 +1,242 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// newRangeServer serves content with Range support, like S3 GetObject.
+// It tracks the peak number of concurrent requests and fails any range
+// whose start offset is in failAt.
+func newRangeServer(t *testing.T, content []byte, failAt map[int64]bool) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		// Hold the request briefly so concurrent workers overlap
+		time.Sleep(5 * time.Millisecond)
+
+		var start int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		if failAt[start] {
+			http.Error(w, "injected failure", http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &peak
+}
+
+func httpRangeGetter(url string) rangeGetFunc {
+	return func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+}
+
+func TestDownloadRanges(t *testing.T) {
+	content := make([]byte, 1<<20+123) // not a multiple of the chunk size
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	srv, peak := newRangeServer(t, content, nil)
+
+	dst, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := dst.Truncate(int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress atomic.Int64
+	received, err := downloadRanges(context.Background(), dst, int64(len(content)), 64*1024, 4,
+		httpRangeGetter(srv.URL), func(n int64) { progress.Add(n) })
+	if err != nil {
+		t.Fatalf("downloadRanges() error = %v", err)
+	}
+	if received != int64(len(content)) {
+		t.Errorf("downloadRanges() received = %d, want %d", received, len(content))
+	}
+
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("assembled file does not match source content")
+	}
+	if progress.Load() != int64(len(content)) {
+		t.Errorf("progress = %d, want %d", progress.Load(), len(content))
+	}
+	if p := peak.Load(); p > 4 {
+		t.Errorf("peak concurrency = %d, want <= 4", p)
+	}
+}
+
+func TestDownloadRanges_RangeFailure(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 10*1024)
+	srv, _ := newRangeServer(t, content, map[int64]bool{4096: true})
+
+	dst, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	received, err := downloadRanges(context.Background(), dst, int64(len(content)), 1024, 3, httpRangeGetter(srv.URL), nil)
+	if err == nil {
+		t.Fatal("downloadRanges() expected error for failed range")
+	}
+	if !strings.Contains(err.Error(), "range 4096-5119") {
+		t.Errorf("error = %v, want it to name the failed range", err)
+	}
+	// Only whole ranges before the failed one count as received
+	if received > 4096 || received%1024 != 0 {
+		t.Errorf("downloadRanges() received = %d, want whole ranges before 4096", received)
+	}
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(got)) < received || !bytes.Equal(got[:received], content[:received]) {
+		t.Errorf("received prefix of %d bytes does not match the source", received)
+	}
+}
+
+func TestDownloadRanges_ShortBody(t *testing.T) {
+	get := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("short")), nil
+	}
+
+	dst, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	_, err = downloadRanges(context.Background(), dst, 100, 100, 1, get, nil)
+	if err == nil || !strings.Contains(err.Error(), "got 5 bytes, want 100") {
+		t.Errorf("downloadRanges() error = %v, want short body error", err)
+	}
+}
+
+// newMultipartClient returns a client for a fake S3 endpoint serving content
+// with Range and If-Match support under ETag "v1". With replace set, the
+// object is replaced by one with ETag "v2" right after the first HeadObject.
+// The If-Match header of every GET is recorded.
+func newMultipartClient(t *testing.T, content []byte, replace bool) (*Client, *[]string) {
+	t.Helper()
+	var (
+		mu      sync.Mutex
+		etag    = `"v1"`
+		ifMatch []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		w.Header().Set("ETag", etag)
+		if r.Method == http.MethodGet {
+			ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		} else if replace {
+			etag = `"v2"`
+		}
+		mu.Unlock()
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	c := newTestClient()
+	c.concurrency = 2
+	c.s3Client = s3.New(s3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(srv.URL),
+		UsePathStyle:     true,
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+	return c, &ifMatch
+}
+
+// TestDownloadImageMultipart_IfMatch verifies that ranges are requested with
+// the ETag from HeadObject and assembled in the .part file.
+func TestDownloadImageMultipart_IfMatch(t *testing.T) {
+	content := []byte("tarball bytes")
+	c, ifMatch := newMultipartClient(t, content, false)
+	dest := filepath.Join(t.TempDir(), "image.tar")
+
+	result, err := c.DownloadImageMultipart(context.Background(), "images", "alpine.tar", dest)
+	if err != nil {
+		t.Fatalf("DownloadImageMultipart() error = %v", err)
+	}
+	if result.Checksum != sha256Hex(content) {
+		t.Errorf("Checksum = %s, want %s", result.Checksum, sha256Hex(content))
+	}
+	if len(*ifMatch) == 0 {
+		t.Fatal("no ranged GetObject requests were made")
+	}
+	for _, got := range *ifMatch {
+		if got != `"v1"` {
+			t.Errorf("If-Match = %q, want the ETag from HeadObject", got)
+		}
+	}
+	for _, path := range []string{PartialPath(dest), dest + ".tmp"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind (stat err %v)", path, err)
+		}
+	}
+}
+
+// TestDownloadImageMultipart_ObjectReplaced verifies that an object replaced
+// after HeadObject fails the download, and that the .part file is cut back
+// to what DownloadImage can resume from.
+func TestDownloadImageMultipart_ObjectReplaced(t *testing.T) {
+	c, _ := newMultipartClient(t, []byte("tarball bytes"), true)
+	dest := filepath.Join(t.TempDir(), "image.tar")
+
+	if _, err := c.DownloadImageMultipart(context.Background(), "images", "alpine.tar", dest); err == nil {
+		t.Fatal("DownloadImageMultipart() succeeded for a replaced object")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("destination exists after a failed download (stat err %v)", err)
+	}
+	if info, err := os.Stat(PartialPath(dest)); err != nil || info.Size() != 0 {
+		t.Errorf(".part file = %v (err %v), want it kept and empty", info, err)
+	}
+}
@@ -0,0 +1,156 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HTTPStatusError is returned by DownloadImageFromURL when the URL answers
+// with a non-success status. An expired or tampered presigned URL gets 403.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status: %s", e.Status)
+}
+
+// HTTPStatusCode returns the response status code. It matches the method
+// the AWS SDK's response errors expose, so callers can classify both alike.
+func (e *HTTPStatusError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+// DownloadImageFromURL downloads an image from a presigned GET URL to a local
+// file. It is the equivalent of DownloadImage for buckets we have no IAM
+// access to: the same .part file handling, resume, size limit, checksum
+// computation and progress callback apply.
+//
+// The URL's query string carries the signature, so only the scheme, host and
+// path are ever logged.
+func (c *Client) DownloadImageFromURL(ctx context.Context, rawURL, destPath string) (*DownloadResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("invalid presigned URL")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid presigned URL: unsupported scheme %q", u.Scheme)
+	}
+
+	logger := c.logger.WithFields(logrus.Fields{
+		"url":  u.Scheme + "://" + u.Host + u.Path,
+		"dest": destPath,
+	})
+
+	logger.Info("starting presigned URL download")
+
+	// A presigned GET URL cannot be used for HEAD, so the object size comes
+	// from the first GET response.
+	resp, err := getURL(ctx, rawURL, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { resp.Body.Close() }()
+
+	if resp.ContentLength > maxDownloadSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrObjectTooLarge, resp.ContentLength, maxDownloadSize)
+	}
+
+	var totalSize int64
+	if resp.ContentLength > 0 {
+		totalSize = resp.ContentLength
+		logger.WithField("content_length", humanBytes(totalSize)).Info("presigned object metadata fetched")
+	}
+
+	// The Content-Length check above does not cover chunked responses, so
+	// the body is capped as well.
+	get := func(ctx context.Context, offset int64, etag string) (io.ReadCloser, bool, error) {
+		if offset == 0 {
+			return &limitedBody{ReadCloser: resp.Body, remaining: maxDownloadSize}, false, nil
+		}
+		// Resume with a ranged request; the Range and If-Range headers are not
+		// part of the signature, so the same URL can be reused. If the object
+		// has changed, If-Range makes the server send all of it.
+		resp.Body.Close()
+		ranged, err := getURL(ctx, rawURL, offset, etag)
+		if err != nil {
+			return nil, false, err
+		}
+		resp = ranged
+		if resp.StatusCode != http.StatusPartialContent {
+			return &limitedBody{ReadCloser: resp.Body, remaining: maxDownloadSize}, false, nil
+		}
+		return &limitedBody{ReadCloser: resp.Body, remaining: maxDownloadSize - offset}, true, nil
+	}
+
+	result, err := c.downloadToPart(ctx, logger, destPath, totalSize, resp.Header.Get("ETag"), get)
+	if err != nil {
+		return nil, err
+	}
+	result.ExpectedChecksum = objectSHA256(headerValue(resp.Header, "X-Amz-Checksum-Sha256"), map[string]string{
+		sha256MetadataKey: resp.Header.Get("X-Amz-Meta-" + sha256MetadataKey),
+	})
+	return result, nil
+}
+
+// getURL issues a GET for rawURL, starting at offset if it is non-zero. A
+// non-empty etag is sent as If-Range, so the range is only honoured for that
+// version of the object.
+func getURL(ctx context.Context, rawURL string, offset int64, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, errors.New("invalid presigned URL")
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if etag != "" {
+			req.Header.Set("If-Range", etag)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// *url.Error includes the full URL, signature and all.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// headerValue returns a pointer to the header's value, or nil if it is unset.
+func headerValue(h http.Header, key string) *string {
+	if v := h.Get(key); v != "" {
+		return &v
+	}
+	return nil
+}
+
+// limitedBody fails with ErrObjectTooLarge once more than remaining bytes
+// have been read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, fmt.Errorf("%w: more than %d bytes", ErrObjectTooLarge, int64(maxDownloadSize))
+	}
+	return n, err
+}
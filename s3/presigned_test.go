@@ -0,0 +1,132 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadImageFromURL(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefgh"), 4096)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("X-Amz-Signature") != "sig" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-Amz-Meta-Sha256", sha256Hex(content))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	c := newTestClient()
+	var calls, last, lastTotal int64
+	c.SetProgressFunc(func(downloaded, total int64, speed float64) {
+		calls++
+		last, lastTotal = downloaded, total
+	})
+
+	dest := filepath.Join(t.TempDir(), "image.tar")
+	result, err := c.DownloadImageFromURL(context.Background(), srv.URL+"/images/golang/1.tar?X-Amz-Signature=sig", dest)
+	if err != nil {
+		t.Fatalf("DownloadImageFromURL() error = %v", err)
+	}
+
+	if result.Checksum != sha256Hex(content) || result.SizeBytes != int64(len(content)) {
+		t.Errorf("result = %+v, want checksum %s and %d bytes", result, sha256Hex(content), len(content))
+	}
+	if result.ExpectedChecksum != sha256Hex(content) {
+		t.Errorf("ExpectedChecksum = %q, want the x-amz-meta-sha256 header", result.ExpectedChecksum)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Errorf("downloaded file does not match served content")
+	}
+	if calls == 0 || last != int64(len(content)) || lastTotal != int64(len(content)) {
+		t.Errorf("progress: %d calls, last %d/%d, want final %d/%d", calls, last, lastTotal, len(content), len(content))
+	}
+}
+
+func TestDownloadImageFromURL_Resume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	tests := []struct {
+		name       string
+		recorded   string // ETag recorded for the .part file
+		wantRanges string
+	}{
+		{name: "same object", recorded: `"v1"`, wantRanges: ",bytes=4000-"},
+		{name: "replaced object", recorded: `"v0"`, wantRanges: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges, ifRanges []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "", time.Now().Add(-time.Hour), bytes.NewReader(content))
+			}))
+			defer srv.Close()
+
+			dest := filepath.Join(t.TempDir(), "image.tar")
+			writePart(t, dest, content[:4000], tt.recorded)
+
+			result, err := newTestClient().DownloadImageFromURL(context.Background(), srv.URL+"/image.tar", dest)
+			if err != nil {
+				t.Fatalf("DownloadImageFromURL() error = %v", err)
+			}
+			if result.Checksum != sha256Hex(content) {
+				t.Errorf("checksum = %s, want %s", result.Checksum, sha256Hex(content))
+			}
+			if got := strings.Join(ranges, ","); got != tt.wantRanges {
+				t.Errorf("requested ranges = %q, want %q", got, tt.wantRanges)
+			}
+			if len(ifRanges) > 1 && ifRanges[1] != `"v1"` {
+				t.Errorf("resumed request If-Range = %q, want the recorded ETag", ifRanges[1])
+			}
+		})
+	}
+}
+
+func TestDownloadImageFromURL_Errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/expired":
+			w.WriteHeader(http.StatusForbidden)
+		case "/huge":
+			w.Header().Set("Content-Length", "20000000000")
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	c := newTestClient()
+	dir := t.TempDir()
+
+	_, err := c.DownloadImageFromURL(context.Background(), srv.URL+"/expired?X-Amz-Signature=secret", filepath.Join(dir, "a.tar"))
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.HTTPStatusCode() != http.StatusForbidden {
+		t.Errorf("expired URL: error = %v, want a 403 HTTPStatusError", err)
+	}
+
+	_, err = c.DownloadImageFromURL(context.Background(), srv.URL+"/huge", filepath.Join(dir, "b.tar"))
+	if !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("oversized object: error = %v, want ErrObjectTooLarge", err)
+	}
+
+	_, err = c.DownloadImageFromURL(context.Background(), "file:///etc/passwd", filepath.Join(dir, "c.tar"))
+	if err == nil {
+		t.Error("file:// URL accepted")
+	}
+
+	// The signature must never end up in an error message.
+	_, err = c.DownloadImageFromURL(context.Background(), "http://127.0.0.1:1/x?X-Amz-Signature=secret", filepath.Join(dir, "d.tar"))
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("connection error = %v, want an error without the signature", err)
+	}
+}
@@ -0,0 +1,291 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// partialSuffix is appended to the destination path while a download is in
+// progress. The .part file survives interruptions so the next attempt can
+// resume with a ranged request.
+const partialSuffix = ".part"
+
+// etagSuffix is appended to the .part file's path for the file recording the
+// ETag of the object version the .part file holds.
+const etagSuffix = ".etag"
+
+// ErrPartialInUse indicates that another process holds the lock on a .part
+// file and is still writing to it.
+var ErrPartialInUse = errors.New("partial download in use by another process")
+
+// errObjectChanged is returned by a partGetFunc when a resumed request was
+// refused because the object no longer has the ETag the .part file was
+// downloaded from.
+var errObjectChanged = errors.New("object changed since partial download")
+
+// PartialPath returns the path of the in-progress download for destPath.
+func PartialPath(destPath string) string {
+	return destPath + partialSuffix
+}
+
+// partialETagPath returns the path of the file recording the ETag of the
+// object version destPath's .part file holds.
+func partialETagPath(destPath string) string {
+	return PartialPath(destPath) + etagSuffix
+}
+
+// readPartialETag returns the ETag recorded for destPath's .part file, or ""
+// if there is none.
+func readPartialETag(destPath string) string {
+	data, err := os.ReadFile(partialETagPath(destPath))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// writePartialETag records etag as the object version destPath's .part file
+// holds. An empty etag removes the record, so the .part file will not be
+// resumed.
+func writePartialETag(destPath, etag string) error {
+	path := partialETagPath(destPath)
+	if etag == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove partial download ETag: %w", err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(etag), 0644); err != nil {
+		return fmt.Errorf("failed to record partial download ETag: %w", err)
+	}
+	return nil
+}
+
+// PartialDownload describes an interrupted download left on disk.
+type PartialDownload struct {
+	// Exists is true if a .part file is present for the destination
+	Exists bool
+
+	// Size is the number of bytes already received
+	Size int64
+
+	// InUse is true if another process is currently writing to the .part file
+	InUse bool
+}
+
+// CheckPartialDownload reports whether destPath has a .part file that a new
+// download would resume from, and whether a downloader is still active on it.
+func CheckPartialDownload(destPath string) (PartialDownload, error) {
+	f, err := os.OpenFile(PartialPath(destPath), os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return PartialDownload{}, nil
+		}
+		return PartialDownload{}, fmt.Errorf("failed to open partial download: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return PartialDownload{}, fmt.Errorf("failed to stat partial download: %w", err)
+	}
+
+	state := PartialDownload{Exists: true, Size: info.Size()}
+	if err := lockPartial(f); err != nil {
+		if !errors.Is(err, ErrPartialInUse) {
+			return PartialDownload{}, err
+		}
+		state.InUse = true
+	}
+	// Closing f releases the probe lock.
+	return state, nil
+}
+
+// lockPartial takes a non-blocking exclusive flock on f. The lock is released
+// when f is closed, including when the process dies.
+func lockPartial(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return ErrPartialInUse
+		}
+		return fmt.Errorf("failed to lock partial download: %w", err)
+	}
+	return nil
+}
+
+// partGetFunc opens the object body starting at offset. When offset is non-zero
+// the request must only be served from the object version with etag: it
+// either fails with errObjectChanged or is answered with the whole object.
+// ranged reports whether the response honoured the range; if not, the body
+// holds the whole object.
+type partGetFunc func(ctx context.Context, offset int64, etag string) (body io.ReadCloser, ranged bool, err error)
+
+// downloadToPart streams an object into destPath's .part file, resuming from
+// any bytes already present, and renames it to destPath once complete.
+//
+// totalSize is the object size from HeadObject (0 if unknown) and etag its
+// ETag ("" if unknown). The ETag is recorded next to the .part file, and a
+// .part file is only resumed if its recorded ETag matches and it is no larger
+// than the object. The resumed request carries the ETag too, so an object
+// replaced since HeadObject also restarts the download from zero.
+//
+// On failure the .part file is kept so a later attempt can resume.
+func (c *Client) downloadToPart(ctx context.Context, logger logrus.FieldLogger, destPath string, totalSize int64, etag string, get partGetFunc) (*DownloadResult, error) {
+	// Ensure destination directory exists
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	partPath := PartialPath(destPath)
+	partFile, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partial file: %w", err)
+	}
+	defer partFile.Close()
+
+	if err := lockPartial(partFile); err != nil {
+		return nil, err
+	}
+
+	info, err := partFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat partial file: %w", err)
+	}
+
+	offset := info.Size()
+	switch {
+	case offset == 0:
+	case totalSize <= 0 || offset > totalSize:
+		logger.WithField("part_size", offset).Warn("partial download does not match object size, restarting")
+		offset = 0
+	case etag == "" || readPartialETag(destPath) != etag:
+		logger.WithField("part_size", offset).Warn("partial download is not from the current object version, restarting")
+		offset = 0
+	}
+
+	hash, err := c.checksumAlgo.New()
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		// Seed the checksum with the bytes we already have
+		if _, err := io.Copy(hash, io.NewSectionReader(partFile, 0, offset)); err != nil {
+			return nil, fmt.Errorf("failed to read partial file: %w", err)
+		}
+	} else {
+		if err := partFile.Truncate(0); err != nil {
+			return nil, fmt.Errorf("failed to reset partial file: %w", err)
+		}
+		if err := writePartialETag(destPath, etag); err != nil {
+			return nil, err
+		}
+	}
+
+	// restart discards the .part file when the object turns out to have
+	// changed. Until the ETag is known again, the .part file is not resumable.
+	restart := func() error {
+		offset = 0
+		hash.Reset()
+		if err := partFile.Truncate(0); err != nil {
+			return fmt.Errorf("failed to reset partial file: %w", err)
+		}
+		return writePartialETag(destPath, "")
+	}
+
+	if offset < totalSize || totalSize <= 0 {
+		if offset > 0 {
+			logger.WithFields(logrus.Fields{
+				"resume_from": humanBytes(offset),
+				"total":       humanBytes(totalSize),
+			}).Info("resuming partial download")
+		}
+
+		body, ranged, err := get(ctx, offset, etag)
+		if offset > 0 && errors.Is(err, errObjectChanged) {
+			logger.Warn("object changed since partial download, restarting")
+			if err := restart(); err != nil {
+				return nil, err
+			}
+			body, ranged, err = get(ctx, 0, "")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get object: %w", err)
+		}
+		defer body.Close()
+
+		if offset > 0 && !ranged {
+			logger.Warn("range request not honoured, restarting download")
+			if err := restart(); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, err := partFile.Seek(offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek partial file: %w", err)
+		}
+
+		// Stream to file while computing checksum, with progress logging (every 5s)
+		pr := newProgressReader(body, logger, c.progressFunc, totalSize, 5*time.Second)
+		pr.read = offset
+
+		n, err := io.Copy(io.MultiWriter(partFile, hash), pr)
+		offset += n
+		if err != nil {
+			// Keep what we received for the next attempt
+			partFile.Sync()
+			return nil, fmt.Errorf("failed to download file after %s: %w", humanBytes(offset), err)
+		}
+	}
+
+	if totalSize > 0 && offset != totalSize {
+		partFile.Sync()
+		return nil, fmt.Errorf("incomplete download: got %d bytes, want %d", offset, totalSize)
+	}
+
+	// Final progress log at completion
+	logger.WithFields(logrus.Fields{
+		"downloaded": humanBytes(offset),
+		"total":      humanBytes(totalSize),
+	}).Info("s3 download completed")
+
+	// Final progress callback
+	if c.progressFunc != nil {
+		c.progressFunc(offset, totalSize, 0)
+	}
+
+	// Sync to disk
+	if err := partFile.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	// Move partial file to final destination while still holding the lock
+	if err := os.Rename(partPath, destPath); err != nil {
+		return nil, fmt.Errorf("failed to move file to destination: %w", err)
+	}
+	if err := writePartialETag(destPath, ""); err != nil {
+		logger.WithError(err).Warn("failed to clean up partial download ETag")
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	logger.WithFields(logrus.Fields{
+		"size":     offset,
+		"checksum": checksum,
+	}).Info("download completed")
+
+	return &DownloadResult{
+		LocalPath:    destPath,
+		Checksum:     checksum,
+		ChecksumAlgo: c.checksumAlgo,
+		SizeBytes:    offset,
+	}, nil
+}
@@ -0,0 +1,289 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/superfly/fsm/checksum"
+)
+
+func newTestClient() *Client {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return &Client{logger: logger}
+}
+
+// testETag is the ETag fakeObject content is downloaded with.
+const testETag = `"v1"`
+
+func downloadPart(c *Client, dest string, size int64, get partGetFunc) (*DownloadResult, error) {
+	return c.downloadToPart(context.Background(), c.logger, dest, size, testETag, get)
+}
+
+// writePart simulates an interrupted download of the object with etag.
+func writePart(t *testing.T, dest string, data []byte, etag string) {
+	t.Helper()
+	if err := os.WriteFile(PartialPath(dest), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePartialETag(dest, etag); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeObject serves content like a ranged GetObject and records the offsets
+// and If-Match ETags requested.
+type fakeObject struct {
+	content     []byte
+	ignoreRange bool
+	replaced    bool // if set, ranged requests fail as for a replaced object
+	failAfter   int  // if > 0, the body errors after this many bytes
+	offsets     []int64
+	etags       []string
+}
+
+func (o *fakeObject) get(ctx context.Context, offset int64, etag string) (io.ReadCloser, bool, error) {
+	o.offsets = append(o.offsets, offset)
+	o.etags = append(o.etags, etag)
+	if o.replaced && offset > 0 {
+		return nil, false, errObjectChanged
+	}
+	if o.ignoreRange {
+		offset = 0
+	}
+	var r io.Reader = bytes.NewReader(o.content[offset:])
+	if o.failAfter > 0 {
+		r = io.MultiReader(io.LimitReader(r, int64(o.failAfter)), errReader{})
+	}
+	return io.NopCloser(r), offset > 0, nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownloadToPart_Fresh(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "image.tar")
+	obj := &fakeObject{content: bytes.Repeat([]byte("abcdefgh"), 1024)}
+
+	result, err := downloadPart(newTestClient(), dest, int64(len(obj.content)), obj.get)
+	if err != nil {
+		t.Fatalf("downloadToPart() error = %v", err)
+	}
+
+	if result.Checksum != sha256Hex(obj.content) {
+		t.Errorf("checksum = %s, want %s", result.Checksum, sha256Hex(obj.content))
+	}
+	if len(obj.offsets) != 1 || obj.offsets[0] != 0 {
+		t.Errorf("offsets = %v, want [0]", obj.offsets)
+	}
+	if _, err := os.Stat(PartialPath(dest)); !os.IsNotExist(err) {
+		t.Errorf(".part file should be renamed away, stat err = %v", err)
+	}
+}
+
+func TestDownloadToPart_ResumesPartialFile(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "image.tar")
+	obj := &fakeObject{content: bytes.Repeat([]byte("0123456789"), 1000)}
+
+	// Simulate an interrupted previous attempt
+	writePart(t, dest, obj.content[:4000], testETag)
+
+	result, err := downloadPart(newTestClient(), dest, int64(len(obj.content)), obj.get)
+	if err != nil {
+		t.Fatalf("downloadToPart() error = %v", err)
+	}
+
+	if len(obj.offsets) != 1 || obj.offsets[0] != 4000 || obj.etags[0] != testETag {
+		t.Errorf("offsets = %v with ETags %v, want [4000] pinned to %s", obj.offsets, obj.etags, testETag)
+	}
+	if _, err := os.Stat(partialETagPath(dest)); !os.IsNotExist(err) {
+		t.Errorf("ETag record should be removed after the download, stat err = %v", err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, obj.content) {
+		t.Error("resumed file does not match object content")
+	}
+	if result.Checksum != sha256Hex(obj.content) {
+		t.Errorf("checksum = %s, want %s", result.Checksum, sha256Hex(obj.content))
+	}
+	if result.SizeBytes != int64(len(obj.content)) {
+		t.Errorf("size = %d, want %d", result.SizeBytes, len(obj.content))
+	}
+}
+
+func TestDownloadToPart_ChecksumAlgo(t *testing.T) {
+	obj := &fakeObject{content: bytes.Repeat([]byte("0123456789"), 1000)}
+	for _, algo := range checksum.Algos {
+		t.Run(string(algo), func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "image.tar")
+			// A resumed download seeds the hash from the .part file
+			writePart(t, dest, obj.content[:4000], testETag)
+			c := newTestClient()
+			c.checksumAlgo = algo
+
+			result, err := downloadPart(c, dest, int64(len(obj.content)), obj.get)
+			if err != nil {
+				t.Fatalf("downloadToPart() error = %v", err)
+			}
+			want, err := checksum.Reader(algo, bytes.NewReader(obj.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := (checksum.Checksum{Algo: result.ChecksumAlgo, Hex: result.Checksum}); !got.Matches(want) {
+				t.Errorf("checksum = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDownloadToPart_InterruptedThenResumed(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "image.tar")
+	content := bytes.Repeat([]byte("xyz"), 5000)
+	client := newTestClient()
+
+	// First attempt dies mid-stream and leaves the received bytes behind
+	obj := &fakeObject{content: content, failAfter: 6000}
+	if _, err := downloadPart(client, dest, int64(len(content)), obj.get); err == nil {
+		t.Fatal("expected error from interrupted download")
+	}
+	info, err := os.Stat(PartialPath(dest))
+	if err != nil {
+		t.Fatalf(".part file should be kept after failure: %v", err)
+	}
+	if info.Size() != 6000 {
+		t.Errorf(".part size = %d, want 6000", info.Size())
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("destination should not exist after failed download")
+	}
+
+	// Second attempt picks up where the first left off
+	obj = &fakeObject{content: content}
+	result, err := downloadPart(client, dest, int64(len(content)), obj.get)
+	if err != nil {
+		t.Fatalf("resumed downloadToPart() error = %v", err)
+	}
+	if obj.offsets[0] != 6000 {
+		t.Errorf("resume offset = %d, want 6000", obj.offsets[0])
+	}
+	if result.Checksum != sha256Hex(content) {
+		t.Errorf("checksum = %s, want %s", result.Checksum, sha256Hex(content))
+	}
+}
+
+func TestDownloadToPart_RangeIgnored(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "image.tar")
+	obj := &fakeObject{content: bytes.Repeat([]byte("q"), 2048), ignoreRange: true}
+	writePart(t, dest, obj.content[:1000], testETag)
+
+	result, err := downloadPart(newTestClient(), dest, int64(len(obj.content)), obj.get)
+	if err != nil {
+		t.Fatalf("downloadToPart() error = %v", err)
+	}
+	if result.SizeBytes != int64(len(obj.content)) || result.Checksum != sha256Hex(obj.content) {
+		t.Errorf("result = %+v, want full object", result)
+	}
+}
+
+func TestDownloadToPart_StalePartDiscarded(t *testing.T) {
+	for _, etag := range []string{`"v0"`, ""} {
+		t.Run("recorded ETag "+etag, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "image.tar")
+			obj := &fakeObject{content: bytes.Repeat([]byte("n"), 1000)}
+			// The .part file holds another version of the object, or one
+			// of unknown version
+			writePart(t, dest, bytes.Repeat([]byte("o"), 500), etag)
+
+			result, err := downloadPart(newTestClient(), dest, int64(len(obj.content)), obj.get)
+			if err != nil {
+				t.Fatalf("downloadToPart() error = %v", err)
+			}
+			if obj.offsets[0] != 0 {
+				t.Errorf("offset = %d, want 0 for stale .part", obj.offsets[0])
+			}
+			if result.Checksum != sha256Hex(obj.content) {
+				t.Errorf("checksum = %s, want %s", result.Checksum, sha256Hex(obj.content))
+			}
+		})
+	}
+}
+
+// TestDownloadToPart_ObjectReplacedBeforeResume verifies that a resumed
+// request refused because the object changed restarts from zero.
+func TestDownloadToPart_ObjectReplacedBeforeResume(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "image.tar")
+	obj := &fakeObject{content: bytes.Repeat([]byte("n"), 1000), replaced: true}
+	writePart(t, dest, bytes.Repeat([]byte("o"), 500), testETag)
+
+	result, err := downloadPart(newTestClient(), dest, int64(len(obj.content)), obj.get)
+	if err != nil {
+		t.Fatalf("downloadToPart() error = %v", err)
+	}
+	if len(obj.offsets) != 2 || obj.offsets[0] != 500 || obj.offsets[1] != 0 {
+		t.Errorf("offsets = %v, want a refused resume at 500 then a fresh GET", obj.offsets)
+	}
+	if result.Checksum != sha256Hex(obj.content) {
+		t.Errorf("checksum = %s, want %s", result.Checksum, sha256Hex(obj.content))
+	}
+}
+
+func TestCheckPartialDownload(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "image.tar")
+
+	state, err := CheckPartialDownload(dest)
+	if err != nil || state.Exists {
+		t.Fatalf("CheckPartialDownload() = %+v, %v; want no partial", state, err)
+	}
+
+	if err := os.WriteFile(PartialPath(dest), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err = CheckPartialDownload(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Exists || state.InUse || state.Size != 7 {
+		t.Errorf("CheckPartialDownload() = %+v, want idle 7-byte partial", state)
+	}
+
+	// Hold the lock as an active downloader would
+	f, err := os.OpenFile(PartialPath(dest), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := lockPartial(f); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = CheckPartialDownload(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.InUse {
+		t.Error("CheckPartialDownload() should report InUse while locked")
+	}
+
+	obj := &fakeObject{content: []byte("whatever")}
+	if _, err := downloadPart(newTestClient(), dest, 8, obj.get); !errors.Is(err, ErrPartialInUse) {
+		t.Errorf("downloadToPart() error = %v, want ErrPartialInUse", err)
+	}
+}
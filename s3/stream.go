@@ -0,0 +1,175 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/superfly/fsm/checksum"
+)
+
+// ErrChecksumMismatch indicates that a streamed object did not match the
+// SHA256 published for it.
+var ErrChecksumMismatch = errors.New("checksum mismatch with S3 object")
+
+// StreamImage downloads an image from S3 to destPath like DownloadImage, and
+// hands the body to consume as it arrives, so the image can be extracted
+// while it downloads. Every byte consume reads has already been written to
+// the .part file and hashed; whatever consume leaves unread is read before
+// the download completes, so the checksum always covers the whole object.
+//
+// The download is checked against the SHA256 the object publishes (see
+// DownloadResult.ExpectedChecksum) before destPath is created; on a mismatch
+// StreamImage returns an error wrapping ErrChecksumMismatch. An error from
+// consume is returned as is.
+//
+// A stream cannot be resumed, since consume must see the object from its
+// first byte: any .part file is discarded along with its recorded ETag, and
+// the .part file is removed again on failure.
+func (c *Client) StreamImage(ctx context.Context, bucket, key, destPath string, consume func(io.Reader) error) (*DownloadResult, error) {
+	if err := validateS3Key(key); err != nil {
+		return nil, fmt.Errorf("invalid S3 key: %w", err)
+	}
+
+	logger := c.logger.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+		"dest":   destPath,
+	})
+
+	logger.Info("starting S3 stream")
+
+	headResp, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object metadata: %w", err)
+	}
+	if headResp.ContentLength != nil && *headResp.ContentLength > maxDownloadSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrObjectTooLarge, *headResp.ContentLength, maxDownloadSize)
+	}
+	var totalSize int64
+	if headResp.ContentLength != nil {
+		totalSize = *headResp.ContentLength
+	}
+	expected := objectSHA256(headResp.ChecksumSHA256, headResp.Metadata)
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	partPath := PartialPath(destPath)
+	partFile, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partial file: %w", err)
+	}
+	defer partFile.Close()
+	if err := lockPartial(partFile); err != nil {
+		return nil, err
+	}
+
+	if err := writePartialETag(destPath, ""); err != nil {
+		return nil, err
+	}
+	result, err := c.streamToPart(ctx, logger, bucket, key, headResp.ETag, partFile, totalSize, expected, consume)
+	if err != nil {
+		os.Remove(partPath)
+		return nil, err
+	}
+
+	// Move partial file to final destination while still holding the lock
+	if err := os.Rename(partPath, destPath); err != nil {
+		os.Remove(partPath)
+		return nil, fmt.Errorf("failed to move file to destination: %w", err)
+	}
+	result.LocalPath = destPath
+
+	logger.WithFields(logrus.Fields{
+		"size":     result.SizeBytes,
+		"checksum": result.Checksum,
+	}).Info("stream completed")
+
+	return result, nil
+}
+
+// streamToPart writes the object to partFile from its first byte, passing it
+// to consume on the way, and checks it against expected (the object's
+// published SHA256, or "" for none).
+func (c *Client) streamToPart(ctx context.Context, logger logrus.FieldLogger, bucket, key string, etag *string, partFile *os.File, totalSize int64, expected string, consume func(io.Reader) error) (*DownloadResult, error) {
+	if err := partFile.Truncate(0); err != nil {
+		return nil, fmt.Errorf("failed to reset partial file: %w", err)
+	}
+
+	digest, err := c.checksumAlgo.New()
+	if err != nil {
+		return nil, err
+	}
+	hashes := []io.Writer{partFile, digest}
+	// The published checksum is always a SHA256
+	var sha256Hash hash.Hash
+	if expected != "" && c.checksumAlgo.OrDefault() != checksum.SHA256 {
+		sha256Hash, _ = checksum.SHA256.New()
+		hashes = append(hashes, sha256Hash)
+	}
+
+	getResp, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		IfMatch: etag,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer getResp.Body.Close()
+
+	pr := newProgressReader(getResp.Body, logger, c.progressFunc, totalSize, 5*time.Second)
+	body := io.TeeReader(pr, io.MultiWriter(hashes...))
+	if err := consume(body); err != nil {
+		return nil, err
+	}
+	// Read whatever consume left, e.g. padding after the tar's end marker
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return nil, fmt.Errorf("failed to download file after %s: %w", humanBytes(pr.read), err)
+	}
+
+	if totalSize > 0 && pr.read != totalSize {
+		return nil, fmt.Errorf("incomplete download: got %d bytes, want %d", pr.read, totalSize)
+	}
+
+	if c.progressFunc != nil {
+		c.progressFunc(pr.read, totalSize, 0)
+	}
+
+	if err := partFile.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	sum := hex.EncodeToString(digest.Sum(nil))
+	published := sum
+	if sha256Hash != nil {
+		published = hex.EncodeToString(sha256Hash.Sum(nil))
+	}
+	if expected != "" && !strings.EqualFold(published, expected) {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expected, published)
+	}
+
+	return &DownloadResult{
+		Checksum:         sum,
+		ChecksumAlgo:     c.checksumAlgo,
+		SizeBytes:        pr.read,
+		ExpectedChecksum: expected,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// newStreamClient returns a client for a fake S3 endpoint serving content
+// with published as its x-amz-meta-sha256.
+func newStreamClient(t *testing.T, content []byte, published string) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if published != "" {
+			w.Header().Set("x-amz-meta-sha256", published)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method != http.MethodHead {
+			w.Write(content)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c := newTestClient()
+	c.s3Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	return c
+}
+
+func TestStreamImage(t *testing.T) {
+	content := bytes.Repeat([]byte("tarball bytes "), 1000)
+	c := newStreamClient(t, content, sha256Hex(content))
+	dest := filepath.Join(t.TempDir(), "image.tar")
+
+	// Read only part of the body: the rest must still be downloaded and hashed
+	var consumed []byte
+	result, err := c.StreamImage(context.Background(), "images", "alpine.tar", dest, func(r io.Reader) error {
+		var err error
+		consumed, err = io.ReadAll(io.LimitReader(r, 100))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("StreamImage() error = %v", err)
+	}
+	if !bytes.Equal(consumed, content[:100]) {
+		t.Errorf("consume saw %q, want the start of the object", consumed)
+	}
+	if result.Checksum != sha256Hex(content) || result.SizeBytes != int64(len(content)) || result.LocalPath != dest {
+		t.Errorf("StreamImage() = %+v, want the whole object at %s", result, dest)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("destination holds %d bytes (err %v), want the object", len(got), err)
+	}
+}
+
+func TestStreamImage_ChecksumMismatch(t *testing.T) {
+	content := []byte("tarball bytes")
+	other := sha256.Sum256([]byte("something else"))
+	c := newStreamClient(t, content, hex.EncodeToString(other[:]))
+	dest := filepath.Join(t.TempDir(), "image.tar")
+
+	_, err := c.StreamImage(context.Background(), "images", "alpine.tar", dest, func(r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("StreamImage() error = %v, want ErrChecksumMismatch", err)
+	}
+	for _, path := range []string{dest, PartialPath(dest)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s exists after a mismatch (stat err %v)", path, err)
+		}
+	}
+}
+
+func TestStreamImage_ConsumeError(t *testing.T) {
+	c := newStreamClient(t, []byte("tarball bytes"), "")
+	dest := filepath.Join(t.TempDir(), "image.tar")
+
+	errBad := errors.New("bad archive")
+	_, err := c.StreamImage(context.Background(), "images", "alpine.tar", dest, func(io.Reader) error {
+		return errBad
+	})
+	if err != errBad {
+		t.Fatalf("StreamImage() error = %v, want the consume error as is", err)
+	}
+	if _, err := os.Stat(PartialPath(dest)); !os.IsNotExist(err) {
+		t.Errorf(".part file left behind (stat err %v)", err)
+	}
+}
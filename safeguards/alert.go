@@ -0,0 +1,82 @@
+package safeguards
+
+import (
+	"sync"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// DefaultPoolWarnPercent is the default pool usage percentage at which a
+// PoolAlerter fires, below the default refusal threshold of
+// devicemapper.PoolCapacityThreshold.
+const DefaultPoolWarnPercent = 60.0
+
+// DefaultPoolAlertHysteresis is how many percentage points usage must fall
+// below the warn level before a PoolAlerter fires again.
+const DefaultPoolAlertHysteresis = 5.0
+
+// PoolAlertFunc is called when pool usage rises above the warn level.
+type PoolAlertFunc func(info devicemapper.PoolInfo)
+
+// PoolAlertConfig configures a PoolAlerter.
+type PoolAlertConfig struct {
+	// WarnPercent is the usage percentage at which the alert fires (default: 60)
+	WarnPercent float64
+	// HardPercent is the usage percentage at which operations are refused.
+	// Usage at or above it does not fire the alert; the refusal is the signal.
+	HardPercent float64
+	// Hysteresis is how far below WarnPercent usage must drop to re-arm the
+	// alert (default: 5 percentage points)
+	Hysteresis float64
+	// Alert is called once per crossing into the warn band
+	Alert PoolAlertFunc
+}
+
+// PoolAlerter turns pool capacity observations into alerts. It fires once
+// when usage enters the band between WarnPercent and HardPercent and stays
+// quiet until usage drops below WarnPercent-Hysteresis, so a pool hovering
+// at the warn level does not page on every check.
+//
+// Usage is the higher of data and metadata usage, since running out of
+// either stops the pool.
+type PoolAlerter struct {
+	mu      sync.Mutex
+	cfg     PoolAlertConfig
+	alerted bool
+}
+
+// NewPoolAlerter creates a new pool alerter.
+func NewPoolAlerter(cfg PoolAlertConfig) *PoolAlerter {
+	if cfg.WarnPercent <= 0 {
+		cfg.WarnPercent = DefaultPoolWarnPercent
+	}
+	if cfg.HardPercent <= 0 {
+		cfg.HardPercent = devicemapper.PoolCapacityThreshold
+	}
+	if cfg.Hysteresis <= 0 {
+		cfg.Hysteresis = DefaultPoolAlertHysteresis
+	}
+	return &PoolAlerter{cfg: cfg}
+}
+
+// Observe records a pool capacity observation and calls the alert function if
+// usage has just crossed into the warn band. It has the signature expected by
+// devicemapper.Client.SetPoolObserver.
+func (a *PoolAlerter) Observe(info devicemapper.PoolInfo) {
+	usage := max(info.DataUsagePercent(), info.MetaUsagePercent())
+
+	a.mu.Lock()
+	fire := false
+	switch {
+	case usage < a.cfg.WarnPercent-a.cfg.Hysteresis:
+		a.alerted = false
+	case usage >= a.cfg.WarnPercent && usage < a.cfg.HardPercent && !a.alerted:
+		a.alerted = true
+		fire = true
+	}
+	a.mu.Unlock()
+
+	if fire && a.cfg.Alert != nil {
+		a.cfg.Alert(info)
+	}
+}
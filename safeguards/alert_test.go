@@ -0,0 +1,82 @@
+package safeguards
+
+import (
+	"testing"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// poolAt returns a pool with data usage at dataPct and metadata at metaPct.
+func poolAt(dataPct, metaPct int64) devicemapper.PoolInfo {
+	return devicemapper.PoolInfo{
+		Name:            "pool",
+		TotalDataBlocks: 1000,
+		UsedDataBlocks:  dataPct * 10,
+		TotalMetaBlocks: 100,
+		UsedMetaBlocks:  metaPct,
+	}
+}
+
+func TestPoolAlerter_FiresOncePerCrossing(t *testing.T) {
+	var alerts []devicemapper.PoolInfo
+	a := NewPoolAlerter(PoolAlertConfig{
+		WarnPercent: 60,
+		HardPercent: 70,
+		Hysteresis:  5,
+		Alert:       func(info devicemapper.PoolInfo) { alerts = append(alerts, info) },
+	})
+
+	steps := []struct {
+		data       int64
+		wantAlerts int
+	}{
+		{data: 50, wantAlerts: 0},
+		{data: 61, wantAlerts: 1}, // crossed into the warn band
+		{data: 65, wantAlerts: 1}, // still above warn
+		{data: 58, wantAlerts: 1}, // dipped, but within the hysteresis
+		{data: 62, wantAlerts: 1}, // not re-armed yet
+		{data: 54, wantAlerts: 1}, // below warn-hysteresis: re-armed
+		{data: 60, wantAlerts: 2}, // second crossing
+		{data: 75, wantAlerts: 2}, // above the hard threshold: refused, not alerted
+	}
+	for _, s := range steps {
+		a.Observe(poolAt(s.data, 10))
+		if len(alerts) != s.wantAlerts {
+			t.Fatalf("after %d%% usage: %d alerts, want %d", s.data, len(alerts), s.wantAlerts)
+		}
+	}
+
+	first := alerts[0]
+	if first.UsedDataBlocks != 610 || first.TotalDataBlocks != 1000 || first.DataUsagePercent() != 61 {
+		t.Errorf("first alert = %+v (%.1f%%), want 610/1000 blocks at 61%%", first, first.DataUsagePercent())
+	}
+}
+
+func TestPoolAlerter_MetadataUsage(t *testing.T) {
+	var alerts []devicemapper.PoolInfo
+	a := NewPoolAlerter(PoolAlertConfig{
+		WarnPercent: 60,
+		HardPercent: 70,
+		Alert:       func(info devicemapper.PoolInfo) { alerts = append(alerts, info) },
+	})
+
+	a.Observe(poolAt(10, 64))
+	if len(alerts) != 1 {
+		t.Fatalf("%d alerts, want metadata usage alone to fire the alert", len(alerts))
+	}
+	if got := alerts[0].MetaUsagePercent(); got != 64 {
+		t.Errorf("alert metadata usage = %.1f%%, want 64%%", got)
+	}
+}
+
+func TestPoolAlerter_Defaults(t *testing.T) {
+	fired := 0
+	a := NewPoolAlerter(PoolAlertConfig{Alert: func(devicemapper.PoolInfo) { fired++ }})
+
+	a.Observe(poolAt(59, 0))
+	a.Observe(poolAt(60, 0))
+	a.Observe(poolAt(int64(devicemapper.PoolCapacityThreshold), 0))
+	if fired != 1 {
+		t.Errorf("fired %d times, want once at the default 60%% warn level", fired)
+	}
+}
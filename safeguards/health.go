@@ -0,0 +1,153 @@
+package safeguards
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default health thresholds.
+const (
+	DefaultMaxLoad        = 4.0  // 1-minute load average, per CPU when LoadPerCPU is set
+	DefaultMaxIOWait      = 50.0 // Percent
+	DefaultMinMemPercent  = 5.0  // Percent of total memory available
+	DefaultMaxSwapPercent = 80.0 // Percent of swap in use
+	DefaultMaxDmErrors    = 2    // Critical dm errors in the recent kernel log
+	DefaultMaxPressure    = 10.0 // PSI "full avg10" percent for io and memory
+)
+
+// HealthThresholds are the limits SystemHealthChecker.Evaluate applies to
+// pre-flight system readings.
+type HealthThresholds struct {
+	// MaxLoad is the load average above which a warning is logged. High load
+	// alone never refuses an operation.
+	MaxLoad float64
+	// LoadPerCPU scales MaxLoad by the CPU count, so the same value suits a
+	// 2-core VM and a 48-core host.
+	LoadPerCPU bool
+
+	MaxIOWait      float64 // I/O wait percentage above which operations are refused
+	MinMemPercent  float64 // Available memory percentage below which operations are refused
+	MaxSwapPercent float64 // Swap usage percentage above which operations are refused
+	MaxDmErrors    int     // Critical dm errors tolerated in the recent kernel log
+
+	// MaxPressure is the io and memory PSI "full avg10" percentage above
+	// which operations are refused. With PSI readings it replaces the
+	// memory, swap and I/O wait checks.
+	MaxPressure float64
+}
+
+// DefaultHealthThresholds returns the thresholds used when none are set.
+func DefaultHealthThresholds() HealthThresholds {
+	return HealthThresholds{
+		MaxLoad:        DefaultMaxLoad,
+		LoadPerCPU:     true,
+		MaxIOWait:      DefaultMaxIOWait,
+		MinMemPercent:  DefaultMinMemPercent,
+		MaxSwapPercent: DefaultMaxSwapPercent,
+		MaxDmErrors:    DefaultMaxDmErrors,
+		MaxPressure:    DefaultMaxPressure,
+	}
+}
+
+// EffectiveMaxLoad returns MaxLoad scaled for a host with cpus CPUs.
+func (t HealthThresholds) EffectiveMaxLoad(cpus int) float64 {
+	if t.LoadPerCPU && cpus > 0 {
+		return t.MaxLoad * float64(cpus)
+	}
+	return t.MaxLoad
+}
+
+// HealthReadings are system measurements taken before a devicemapper
+// operation. A reading that could not be taken is left at zero, which passes
+// every threshold.
+type HealthReadings struct {
+	DStateProcs    int     // devicemapper-related processes in uninterruptible sleep
+	LoadAvg        float64 // 1-minute load average
+	CPUs           int
+	DmErrors       int     // Critical dm errors in the recent kernel log
+	IOWait         float64 // Percent
+	MemTotalKB     int64
+	MemAvailableKB int64
+	SwapTotalKB    int64
+	SwapFreeKB     int64
+
+	// PSI is set when pressure stall information was read (see
+	// ReadPressure); IOPressure and MemPressure are then judged instead of
+	// the meminfo and I/O wait readings.
+	PSI         bool
+	IOPressure  float64 // io "full avg10" percent
+	MemPressure float64 // memory "full avg10" percent
+}
+
+// SetThresholds replaces the checker's thresholds.
+func (h *SystemHealthChecker) SetThresholds(t HealthThresholds) {
+	h.thresholds = t
+}
+
+// Thresholds returns the checker's thresholds.
+func (h *SystemHealthChecker) Thresholds() HealthThresholds {
+	return h.thresholds
+}
+
+// Evaluate judges readings against the checker's thresholds. Any
+// devicemapper-related D-state process refuses the operation, since that
+// buildup is what precedes a kernel panic. Load and a few dm errors only log
+// warnings. Memory and I/O are judged by PSI when available, else by
+// meminfo and I/O wait.
+func (h *SystemHealthChecker) Evaluate(r HealthReadings) error {
+	t := h.thresholds
+
+	if r.DStateProcs > 0 {
+		return fmt.Errorf("system unstable: %d devicemapper-related D-state processes detected. "+
+			"This indicates kernel-level I/O issues. Reboot recommended before proceeding", r.DStateProcs)
+	}
+
+	if maxLoad := t.EffectiveMaxLoad(r.CPUs); r.LoadAvg > maxLoad {
+		h.logger.WithFields(logrus.Fields{
+			"load_avg": r.LoadAvg,
+			"max_load": maxLoad,
+		}).Warn("high system load detected, operations may be slow")
+	}
+
+	if r.DmErrors > t.MaxDmErrors {
+		return fmt.Errorf("system unstable: %d critical devicemapper errors in recent kernel log. "+
+			"This indicates active dm-thin issues. Wait 30 seconds or reboot before proceeding", r.DmErrors)
+	} else if r.DmErrors > 0 {
+		h.logger.WithField("dm_errors", r.DmErrors).Warn("detected devicemapper messages in dmesg, proceeding with caution")
+	}
+
+	if r.PSI {
+		if r.IOPressure > t.MaxPressure {
+			return fmt.Errorf("system unstable: I/O pressure at %.1f%% (full avg10, maximum %.1f%%) indicates storage stalls. "+
+				"Wait for I/O to settle or reboot", r.IOPressure, t.MaxPressure)
+		}
+		if r.MemPressure > t.MaxPressure {
+			return fmt.Errorf("system unstable: memory pressure at %.1f%% (full avg10, maximum %.1f%%). "+
+				"This can cause devicemapper operations to hang. Free memory or reboot", r.MemPressure, t.MaxPressure)
+		}
+		return nil
+	}
+
+	if r.MemTotalKB > 0 && r.MemAvailableKB > 0 {
+		availPercent := float64(r.MemAvailableKB) / float64(r.MemTotalKB) * 100
+		if availPercent < t.MinMemPercent {
+			return fmt.Errorf("system unstable: high memory pressure detected (%.1f%% memory available, minimum %.1f%%). "+
+				"This can cause devicemapper operations to hang. Free memory or reboot", availPercent, t.MinMemPercent)
+		}
+	}
+	if r.SwapTotalKB > 0 {
+		swapUsedPercent := float64(r.SwapTotalKB-r.SwapFreeKB) / float64(r.SwapTotalKB) * 100
+		if swapUsedPercent > t.MaxSwapPercent {
+			return fmt.Errorf("system unstable: high memory pressure detected (%.1f%% swap used, maximum %.1f%%). "+
+				"This can cause devicemapper operations to hang. Free memory or reboot", swapUsedPercent, t.MaxSwapPercent)
+		}
+	}
+
+	if r.IOWait > t.MaxIOWait {
+		return fmt.Errorf("system unstable: I/O wait at %.1f%% indicates storage bottleneck. "+
+			"Wait for I/O to settle or reboot", r.IOWait)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package safeguards
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// healthyReadings is a quiet 4-CPU host with plenty of memory.
+func healthyReadings() HealthReadings {
+	return HealthReadings{
+		LoadAvg:        1.0,
+		CPUs:           4,
+		IOWait:         5,
+		MemTotalKB:     16_000_000,
+		MemAvailableKB: 8_000_000,
+		SwapTotalKB:    4_000_000,
+		SwapFreeKB:     4_000_000,
+	}
+}
+
+// quietChecker returns a checker with default thresholds that logs nowhere.
+func quietChecker() *SystemHealthChecker {
+	logger, _ := test.NewNullLogger()
+	return NewSystemHealthChecker("pool", logger)
+}
+
+func TestEvaluate_Thresholds(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(r *HealthReadings, th *HealthThresholds)
+		wantErr string // empty: accepted
+	}{
+		{name: "healthy"},
+		{name: "unknown readings pass", mutate: func(r *HealthReadings, th *HealthThresholds) { *r = HealthReadings{} }},
+		{name: "D-state process", mutate: func(r *HealthReadings, th *HealthThresholds) { r.DStateProcs = 1 }, wantErr: "D-state"},
+
+		{name: "iowait at limit", mutate: func(r *HealthReadings, th *HealthThresholds) { r.IOWait = 50 }},
+		{name: "iowait over limit", mutate: func(r *HealthReadings, th *HealthThresholds) { r.IOWait = 50.5 }, wantErr: "I/O wait"},
+		{name: "iowait under raised limit", mutate: func(r *HealthReadings, th *HealthThresholds) { r.IOWait = 70; th.MaxIOWait = 80 }},
+
+		{name: "memory at limit", mutate: func(r *HealthReadings, th *HealthThresholds) { r.MemAvailableKB = r.MemTotalKB / 20 }},
+		{name: "memory under limit", mutate: func(r *HealthReadings, th *HealthThresholds) { r.MemAvailableKB = r.MemTotalKB / 25 }, wantErr: "memory available"},
+		{name: "memory under raised limit", mutate: func(r *HealthReadings, th *HealthThresholds) {
+			r.MemAvailableKB = r.MemTotalKB / 10
+			th.MinMemPercent = 15
+		}, wantErr: "memory available"},
+
+		{name: "swap over limit", mutate: func(r *HealthReadings, th *HealthThresholds) { r.SwapFreeKB = r.SwapTotalKB / 10 }, wantErr: "swap used"},
+
+		{name: "dm errors within tolerance", mutate: func(r *HealthReadings, th *HealthThresholds) { r.DmErrors = 2 }},
+		{name: "dm errors over tolerance", mutate: func(r *HealthReadings, th *HealthThresholds) { r.DmErrors = 3 }, wantErr: "devicemapper errors"},
+
+		// Load only ever warns
+		{name: "high load", mutate: func(r *HealthReadings, th *HealthThresholds) { r.LoadAvg = 100 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, th := healthyReadings(), DefaultHealthThresholds()
+			if tt.mutate != nil {
+				tt.mutate(&r, &th)
+			}
+			h := quietChecker()
+			h.SetThresholds(th)
+
+			err := h.Evaluate(r)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Evaluate() = %v, want accepted", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Evaluate() = %v, want error mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluate_LoadWarningPerCPU(t *testing.T) {
+	tests := []struct {
+		name     string
+		load     float64
+		cpus     int
+		perCPU   bool
+		wantWarn bool
+	}{
+		{name: "48 cores, load 20", load: 20, cpus: 48, perCPU: true, wantWarn: false},
+		{name: "48 cores, load 200", load: 200, cpus: 48, perCPU: true, wantWarn: true},
+		{name: "1 core, load 5", load: 5, cpus: 1, perCPU: true, wantWarn: true},
+		{name: "absolute, 48 cores, load 20", load: 20, cpus: 48, perCPU: false, wantWarn: true},
+		{name: "unknown CPU count", load: 3, cpus: 0, perCPU: true, wantWarn: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			h := NewSystemHealthChecker("pool", logger)
+			th := DefaultHealthThresholds()
+			th.LoadPerCPU = tt.perCPU
+			h.SetThresholds(th)
+
+			r := healthyReadings()
+			r.LoadAvg, r.CPUs = tt.load, tt.cpus
+			if err := h.Evaluate(r); err != nil {
+				t.Fatalf("Evaluate() = %v, want load to warn only", err)
+			}
+
+			warned := false
+			for _, e := range hook.AllEntries() {
+				if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "high system load") {
+					warned = true
+				}
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("load warning = %v, want %v (effective max %.0f)", warned, tt.wantWarn, th.EffectiveMaxLoad(tt.cpus))
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package safeguards
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+// KmsgPath is the kernel log device read when dmesg is not installed.
+const KmsgPath = "/dev/kmsg"
+
+// KernelLogTail returns the last n kernel log messages, from dmesg when it is
+// installed and otherwise read directly from kmsgPath. Unlike a failed
+// "dmesg | grep", an unreadable log is an error, not an empty one.
+func KernelLogTail(ctx context.Context, kmsgPath string, n int) ([]string, error) {
+	var lines []string
+	if devicemapper.Tools().Dmesg {
+		out, err := exec.CommandContext(ctx, "dmesg").Output()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("dmesg timed out: %w", ctx.Err())
+			}
+			return nil, fmt.Errorf("dmesg: %w", err)
+		}
+		lines = strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	} else {
+		var err error
+		if lines, err = ReadKmsg(kmsgPath); err != nil {
+			return nil, err
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// ReadKmsg returns the messages buffered in a /dev/kmsg style log. The device
+// is read without blocking, so it stops at the newest record instead of
+// waiting for more; records overwritten mid-read are skipped.
+//
+// It reads with raw syscalls: an *os.File would register the non-blocking
+// descriptor with the runtime poller and wait for new messages.
+func ReadKmsg(path string) ([]string, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	var data []byte
+	buf := make([]byte, 8192) // /dev/kmsg returns one record per read
+	for {
+		n, err := syscall.Read(fd, buf)
+		switch err {
+		case nil:
+		case syscall.EINTR, syscall.EPIPE:
+			continue
+		case syscall.EAGAIN:
+			return parseKmsg(data), nil
+		default:
+			return nil, &os.PathError{Op: "read", Path: path, Err: err}
+		}
+		if n == 0 {
+			return parseKmsg(data), nil
+		}
+		data = append(data, buf[:n]...)
+	}
+}
+
+// parseKmsg extracts the message text from /dev/kmsg records:
+//
+//	6,1234,5678901,-;device-mapper: thin: 253:0: switching pool to read-only mode
+//	 SUBSYSTEM=block
+//
+// Continuation lines, which start with a space, carry metadata and are dropped.
+func parseKmsg(data []byte) []string {
+	var msgs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || line[0] == ' ' {
+			continue
+		}
+		if _, msg, ok := strings.Cut(line, ";"); ok {
+			line = msg
+		}
+		msgs = append(msgs, line)
+	}
+	return msgs
+}
@@ -0,0 +1,66 @@
+package safeguards
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/superfly/fsm/devicemapper"
+)
+
+const testKmsg = `6,100,1000,-;EXT4-fs (dm-3): mounted filesystem
+ SUBSYSTEM=block
+ DEVICE=b253:3
+3,101,2000,-;device-mapper: thin: 253:0: metadata operation failed
+4,102,3000,-;device-mapper: thin: 253:0: switching pool to read-only mode
+`
+
+func TestReadKmsg(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kmsg")
+	if err := os.WriteFile(path, []byte(testKmsg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadKmsg(path)
+	if err != nil {
+		t.Fatalf("ReadKmsg() error = %v", err)
+	}
+	want := []string{
+		"EXT4-fs (dm-3): mounted filesystem",
+		"device-mapper: thin: 253:0: metadata operation failed",
+		"device-mapper: thin: 253:0: switching pool to read-only mode",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ReadKmsg() = %q, want %q", got, want)
+	}
+
+	if _, err := ReadKmsg(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("ReadKmsg() of a missing log succeeded")
+	}
+}
+
+func TestKernelLogTail_WithoutDmesg(t *testing.T) {
+	prev := devicemapper.Tools()
+	t.Cleanup(func() { devicemapper.SetTools(prev) })
+	devicemapper.SetTools(devicemapper.HostTools{Udevadm: true, Vmstat: true})
+
+	path := filepath.Join(t.TempDir(), "kmsg")
+	if err := os.WriteFile(path, []byte(testKmsg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := KernelLogTail(context.Background(), path, 2)
+	if err != nil {
+		t.Fatalf("KernelLogTail() error = %v", err)
+	}
+	if len(got) != 2 || got[1] != "device-mapper: thin: 253:0: switching pool to read-only mode" {
+		t.Errorf("KernelLogTail() = %q, want the last two messages", got)
+	}
+
+	// An unreadable log is an error, not an empty one
+	if _, err := KernelLogTail(context.Background(), filepath.Join(t.TempDir(), "missing"), 2); err == nil {
+		t.Error("KernelLogTail() of a missing log succeeded")
+	}
+}
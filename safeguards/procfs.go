@@ -0,0 +1,256 @@
+package safeguards
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProcDir is the procfs mount scanned for D-state processes.
+const ProcDir = "/proc"
+
+// pfKthread is the PF_KTHREAD bit of the per-process flags in /proc/<pid>/stat.
+const pfKthread = 0x00200000
+
+// ProcState is a process as read from /proc/<pid>.
+type ProcState struct {
+	PID   int
+	Comm  string // Command name; for kworkers this includes the workqueue, e.g. "kworker/u8:2+dm-thin"
+	State byte   // 'R', 'S', 'D', ...
+	Flags uint64 // Per-process PF_* flags
+	WChan string // Kernel function the task is blocked in ("" or "0" when unknown)
+}
+
+// KernelThread reports whether the process is a kernel thread.
+func (p ProcState) KernelThread() bool {
+	return p.Flags&pfKthread != 0
+}
+
+// DmRelated reports whether the process belongs to the devicemapper I/O
+// stack: dm and dm-thin threads (kdmflush, dmeventd, ...), jbd2 journal
+// threads, kworkers busy on a workqueue ("kworker/...+wq"), or any task
+// blocked in a dm or thin-pool kernel function.
+func (p ProcState) DmRelated() bool {
+	comm := strings.ToLower(p.Comm)
+	switch {
+	case strings.Contains(comm, "dm"), strings.Contains(comm, "thin"), strings.Contains(comm, "jbd2"):
+		return true
+	case strings.HasPrefix(comm, "kworker") && strings.Contains(comm, "+"):
+		return true
+	}
+	wchan := strings.ToLower(p.WChan)
+	return strings.HasPrefix(wchan, "dm_") || strings.Contains(wchan, "thin")
+}
+
+// String describes the process for logs and errors, like "1234 kworker/u8:2+dm-thin (dm_wait_for_completion)".
+func (p ProcState) String() string {
+	if p.WChan == "" || p.WChan == "0" {
+		return fmt.Sprintf("%d %s", p.PID, p.Comm)
+	}
+	return fmt.Sprintf("%d %s (%s)", p.PID, p.Comm, p.WChan)
+}
+
+// DStateProcs returns every process under procDir in uninterruptible sleep
+// ('D'). Only procfs is read, with no subprocesses, so the scan still works
+// on a system whose process table is wedged. Processes that exit during the
+// scan are skipped.
+func DStateProcs(procDir string) ([]ProcState, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var procs []ProcState
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(procDir, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue
+		}
+		p, err := parseProcStat(data)
+		if err != nil || p.State != 'D' {
+			continue
+		}
+		p.PID = pid
+
+		// comm is not truncated at the stat line's closing parenthesis, and
+		// wchan shows where the task is stuck
+		if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+			p.Comm = strings.TrimSpace(string(comm))
+		}
+		if wchan, err := os.ReadFile(filepath.Join(dir, "wchan")); err == nil {
+			p.WChan = strings.TrimSpace(string(wchan))
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+// CountDState returns how many D-state processes under procDir match.
+func CountDState(procDir string, match func(ProcState) bool) (int, error) {
+	procs, err := DStateProcs(procDir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, p := range procs {
+		if match(p) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// parseProcStat parses the command name, state and flags from the contents
+// of /proc/<pid>/stat:
+//
+//	1234 (kworker/u8:2+dm-thin) D 2 0 0 0 -1 69238880 ...
+//
+// The command name may itself contain spaces and parentheses, so it runs to
+// the last closing parenthesis.
+func parseProcStat(data []byte) (ProcState, error) {
+	s := string(data)
+	open := strings.IndexByte(s, '(')
+	end := strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return ProcState{}, fmt.Errorf("malformed stat line %q", s)
+	}
+	// Fields after the name: state ppid pgrp session tty_nr tpgid flags ...
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 7 || len(fields[0]) != 1 {
+		return ProcState{}, fmt.Errorf("malformed stat line %q", s)
+	}
+	flags, err := strconv.ParseUint(fields[6], 10, 64)
+	if err != nil {
+		return ProcState{}, fmt.Errorf("malformed flags in stat line %q: %w", s, err)
+	}
+	return ProcState{
+		Comm:  s[open+1 : end],
+		State: fields[0][0],
+		Flags: flags,
+	}, nil
+}
+
+// userHZ is the clock tick rate of the times in /proc/<pid>/stat. The kernel
+// reports them in USER_HZ, which is 100 on every Linux architecture.
+const userHZ = 100
+
+// ProcStartTime returns when process pid under procDir started, from its
+// start time in /proc/<pid>/stat and the boot time in /proc/stat. It is
+// accurate to about a second. A PID that is reused by a later process gets
+// that process's start time, which is how a stale PID is told apart.
+func ProcStartTime(procDir string, pid int) (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	s := string(data)
+	end := strings.LastIndexByte(s, ')')
+	if end < 0 {
+		return time.Time{}, fmt.Errorf("malformed stat line %q", s)
+	}
+	// starttime is field 22; the fields after the name start at field 3
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("stat line for PID %d has no start time", pid)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed start time in stat line for PID %d: %w", pid, err)
+	}
+
+	boot, err := bootTime(procDir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / userHZ), nil
+}
+
+// bootTime reads the "btime" line of procDir/stat.
+func bootTime(procDir string) (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(procDir, "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			secs, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("malformed btime line %q: %w", line, err)
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no btime line in %s", filepath.Join(procDir, "stat"))
+}
+
+// CPUTimes are the aggregate jiffy counters from the "cpu" line of /proc/stat.
+type CPUTimes struct {
+	IOWait uint64
+	Total  uint64 // user through steal; guest time is already counted in user
+}
+
+// ReadCPUTimes reads the aggregate CPU times from procDir/stat:
+//
+//	cpu  user nice system idle iowait irq softirq steal guest guest_nice
+func ReadCPUTimes(procDir string) (CPUTimes, error) {
+	data, err := os.ReadFile(filepath.Join(procDir, "stat"))
+	if err != nil {
+		return CPUTimes{}, err
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[0] != "cpu" {
+		return CPUTimes{}, fmt.Errorf("malformed cpu line %q", line)
+	}
+
+	var t CPUTimes
+	for i, f := range fields[1:min(len(fields), 9)] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return CPUTimes{}, fmt.Errorf("malformed cpu line %q: %w", line, err)
+		}
+		t.Total += v
+		if i == 4 {
+			t.IOWait = v
+		}
+	}
+	return t, nil
+}
+
+// IOWaitPercent returns the percentage of CPU time spent in I/O wait between
+// two readings, or 0 if no time passed.
+func IOWaitPercent(before, after CPUTimes) float64 {
+	if after.Total <= before.Total || after.IOWait < before.IOWait {
+		return 0
+	}
+	return float64(after.IOWait-before.IOWait) / float64(after.Total-before.Total) * 100
+}
+
+// SampleIOWait measures I/O wait over interval from procDir/stat. It is the
+// fallback for hosts without vmstat, and like "vmstat 1 2" it reports the
+// interval rather than the average since boot.
+func SampleIOWait(ctx context.Context, procDir string, interval time.Duration) (float64, error) {
+	before, err := ReadCPUTimes(procDir)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-time.After(interval):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	after, err := ReadCPUTimes(procDir)
+	if err != nil {
+		return 0, err
+	}
+	return IOWaitPercent(before, after), nil
+}
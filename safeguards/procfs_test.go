@@ -0,0 +1,213 @@
+package safeguards
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProc is a process to lay out in a fake procfs.
+type fakeProc struct {
+	pid   int
+	stat  string
+	comm  string
+	wchan string
+}
+
+// writeProcFS builds a fake /proc in a temp dir.
+func writeProcFS(t *testing.T, procs []fakeProc) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, p := range procs {
+		pdir := filepath.Join(dir, strconv.Itoa(p.pid))
+		if err := os.Mkdir(pdir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{"stat": p.stat, "comm": p.comm + "\n", "wchan": p.wchan}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(pdir, name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Non-process entries are ignored
+	if err := os.WriteFile(filepath.Join(dir, "meminfo"), []byte("MemTotal: 1 kB\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sys"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		name      string
+		stat      string
+		wantComm  string
+		wantState byte
+		wantFlags uint64
+		wantErr   bool
+	}{
+		{
+			name:      "kernel thread",
+			stat:      "412 (kworker/u8:2+dm-thin) D 2 0 0 0 -1 69238880 0 0 0 0 0 0 0 0 20 0 1 0 100 0 0",
+			wantComm:  "kworker/u8:2+dm-thin",
+			wantState: 'D',
+			wantFlags: 69238880,
+		},
+		{
+			name:      "name with spaces and parentheses",
+			stat:      "77 (my (odd) proc) S 1 77 77 0 -1 4194560 0 0 0 0",
+			wantComm:  "my (odd) proc",
+			wantState: 'S',
+			wantFlags: 4194560,
+		},
+		{name: "no name", stat: "77 S 1 77 77 0 -1 4194560", wantErr: true},
+		{name: "truncated", stat: "77 (bash) S 1 77", wantErr: true},
+		{name: "bad flags", stat: "77 (bash) S 1 77 77 0 -1 flags", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseProcStat([]byte(tt.stat))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseProcStat() = %+v, want error", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Comm != tt.wantComm || p.State != tt.wantState || p.Flags != tt.wantFlags {
+				t.Errorf("parseProcStat() = %q %c %d, want %q %c %d",
+					p.Comm, p.State, p.Flags, tt.wantComm, tt.wantState, tt.wantFlags)
+			}
+		})
+	}
+}
+
+func TestProcState_DmRelated(t *testing.T) {
+	tests := []struct {
+		proc ProcState
+		want bool
+	}{
+		{ProcState{Comm: "kdmflush/253:3"}, true},
+		{ProcState{Comm: "dmeventd"}, true},
+		{ProcState{Comm: "jbd2/dm-1-8"}, true},
+		{ProcState{Comm: "kworker/u8:2+dm-thin"}, true},
+		{ProcState{Comm: "kworker/3:1H+kblockd"}, true},
+		{ProcState{Comm: "kworker/3:1"}, false},
+		{ProcState{Comm: "mkfs.ext4", WChan: "dm_wait_for_completion"}, true},
+		{ProcState{Comm: "cp", WChan: "process_prepared_thin"}, true},
+		{ProcState{Comm: "postgres", WChan: "io_schedule"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.proc.DmRelated(); got != tt.want {
+			t.Errorf("%s: DmRelated() = %v, want %v", tt.proc, got, tt.want)
+		}
+	}
+}
+
+func TestDStateProcs(t *testing.T) {
+	dir := writeProcFS(t, []fakeProc{
+		{pid: 1, stat: "1 (systemd) S 0 1 1 0 -1 4194560 0 0 0 0", comm: "systemd", wchan: "ep_poll"},
+		{pid: 412, stat: "412 (kworker/u8:2+dm-thin) D 2 0 0 0 -1 69238880 0 0 0 0", comm: "kworker/u8:2+dm-thin", wchan: "0"},
+		{pid: 513, stat: "513 (jbd2/dm-1-8) D 2 0 0 0 -1 2129984 0 0 0 0", comm: "jbd2/dm-1-8", wchan: "jbd2_journal_commit_transaction"},
+		{pid: 900, stat: "900 (mkfs.ext4) D 1 900 900 0 -1 4194304 0 0 0 0", comm: "mkfs.ext4", wchan: "dm_wait_for_completion"},
+		{pid: 901, stat: "901 (postgres) D 1 901 901 0 -1 4194560 0 0 0 0", comm: "postgres", wchan: "io_schedule"},
+		{pid: 999, stat: "garbage", comm: "vanished"},
+	})
+
+	procs, err := DStateProcs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pids []int
+	for _, p := range procs {
+		pids = append(pids, p.PID)
+	}
+	if len(pids) != 4 || pids[0] != 412 || pids[3] != 901 {
+		t.Fatalf("D-state pids = %v, want [412 513 900 901]", pids)
+	}
+	if procs[2].WChan != "dm_wait_for_completion" {
+		t.Errorf("wchan = %q, want dm_wait_for_completion", procs[2].WChan)
+	}
+
+	dm, err := CountDState(dir, ProcState.DmRelated)
+	if err != nil || dm != 3 {
+		t.Errorf("CountDState(DmRelated) = %d, %v; want 3", dm, err)
+	}
+	user, err := CountDState(dir, func(p ProcState) bool { return !p.KernelThread() })
+	if err != nil || user != 2 {
+		t.Errorf("CountDState(user processes) = %d, %v; want 2", user, err)
+	}
+
+	if _, err := DStateProcs(filepath.Join(dir, "missing")); err == nil {
+		t.Error("DStateProcs(missing dir) succeeded, want error")
+	}
+}
+
+func TestProcStartTime(t *testing.T) {
+	// starttime (field 22) is 2 minutes 30.5 seconds after boot
+	stat := "4242 (flyio-image-m) S" + strings.Repeat(" 0", 18) + " 15050 0 0 0"
+	dir := writeProcFS(t, []fakeProc{
+		{pid: 4242, stat: stat, comm: "flyio-image-m"},
+		{pid: 4243, stat: "4243 (short) S 1 2 3", comm: "short"},
+	})
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte("cpu  1 2 3 4\nbtime 1700000000\nprocesses 99\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ProcStartTime(dir, 4242)
+	if err != nil {
+		t.Fatalf("ProcStartTime() error = %v", err)
+	}
+	if want := time.Unix(1700000150, 500_000_000); !got.Equal(want) {
+		t.Errorf("ProcStartTime() = %v, want %v", got, want)
+	}
+
+	if _, err := ProcStartTime(dir, 4243); err == nil {
+		t.Error("ProcStartTime() of a short stat line succeeded")
+	}
+	if _, err := ProcStartTime(dir, 4244); err == nil {
+		t.Error("ProcStartTime() of a missing PID succeeded")
+	}
+}
+
+func TestReadCPUTimes(t *testing.T) {
+	dir := t.TempDir()
+	stat := "cpu  100 5 50 800 40 3 2 0 7 0\ncpu0 50 2 25 400 20 1 1 0 3 0\nintr 12345\n"
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadCPUTimes(dir)
+	if err != nil {
+		t.Fatalf("ReadCPUTimes() error = %v", err)
+	}
+	// Guest time (7) is already part of user time and is not counted again
+	if want := (CPUTimes{IOWait: 40, Total: 1000}); got != want {
+		t.Errorf("ReadCPUTimes() = %+v, want %+v", got, want)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte("intr 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadCPUTimes(dir); err == nil {
+		t.Error("ReadCPUTimes() without a cpu line succeeded")
+	}
+}
+
+func TestIOWaitPercent(t *testing.T) {
+	before := CPUTimes{IOWait: 40, Total: 1000}
+	if got := IOWaitPercent(before, CPUTimes{IOWait: 65, Total: 1100}); got != 25 {
+		t.Errorf("IOWaitPercent() = %v, want 25", got)
+	}
+	if got := IOWaitPercent(before, before); got != 0 {
+		t.Errorf("IOWaitPercent() with no elapsed time = %v, want 0", got)
+	}
+}
@@ -0,0 +1,122 @@
+package safeguards
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PressureDir is where the kernel exposes pressure stall information (PSI).
+// It exists on Linux 4.20+ built with CONFIG_PSI.
+const PressureDir = "/proc/pressure"
+
+// PSILine is one line of a PSI file: the share of wall time, in percent,
+// that tasks were stalled over the last 10, 60 and 300 seconds, and the
+// total stall time in microseconds.
+type PSILine struct {
+	Avg10  float64
+	Avg60  float64
+	Avg300 float64
+	Total  uint64
+}
+
+// PSI is the pressure stall information for one resource. Some counts time
+// at least one task was stalled; Full counts time all non-idle tasks were
+// stalled at once, which is what precedes a D-state cascade.
+type PSI struct {
+	Some PSILine
+	Full PSILine
+}
+
+// ParsePSI parses a /proc/pressure file:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//
+// The full line is absent from the cpu file on kernels before 5.13 and is
+// left at zero.
+func ParsePSI(r io.Reader) (PSI, error) {
+	var psi PSI
+	var sawSome bool
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var line *PSILine
+		switch fields[0] {
+		case "some":
+			line, sawSome = &psi.Some, true
+		case "full":
+			line = &psi.Full
+		default:
+			return PSI{}, fmt.Errorf("unexpected PSI line %q", scanner.Text())
+		}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return PSI{}, fmt.Errorf("malformed PSI field %q", field)
+			}
+			var err error
+			switch key {
+			case "avg10":
+				line.Avg10, err = strconv.ParseFloat(value, 64)
+			case "avg60":
+				line.Avg60, err = strconv.ParseFloat(value, 64)
+			case "avg300":
+				line.Avg300, err = strconv.ParseFloat(value, 64)
+			case "total":
+				line.Total, err = strconv.ParseUint(value, 10, 64)
+			}
+			if err != nil {
+				return PSI{}, fmt.Errorf("malformed PSI field %q: %w", field, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return PSI{}, err
+	}
+	if !sawSome {
+		return PSI{}, fmt.Errorf("no PSI data")
+	}
+	return psi, nil
+}
+
+// ReadPSI reads the PSI file for resource ("cpu", "io" or "memory") in dir,
+// normally PressureDir.
+func ReadPSI(dir, resource string) (PSI, error) {
+	f, err := os.Open(filepath.Join(dir, resource))
+	if err != nil {
+		return PSI{}, err
+	}
+	defer f.Close()
+
+	psi, err := ParsePSI(f)
+	if err != nil {
+		return PSI{}, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return psi, nil
+}
+
+// ReadPressure fills in the I/O and memory pressure readings from the PSI
+// files in dir and marks the readings as PSI-based. It returns an error
+// wrapping os.ErrNotExist when the kernel has no PSI support.
+func ReadPressure(dir string, r *HealthReadings) error {
+	ioPSI, err := ReadPSI(dir, "io")
+	if err != nil {
+		return err
+	}
+	memPSI, err := ReadPSI(dir, "memory")
+	if err != nil {
+		return err
+	}
+	r.PSI = true
+	r.IOPressure = ioPSI.Full.Avg10
+	r.MemPressure = memPSI.Full.Avg10
+	return nil
+}
@@ -0,0 +1,128 @@
+package safeguards
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	samplePSIIdle = "some avg10=0.00 avg60=0.00 avg300=0.00 total=0\n" +
+		"full avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"
+	samplePSIIO = "some avg10=88.10 avg60=61.40 avg300=22.90 total=812345678\n" +
+		"full avg10=42.75 avg60=30.02 avg300=9.87 total=512345678\n"
+	// cpu on kernels before 5.13 has no full line
+	samplePSICPUOld = "some avg10=0.12 avg60=0.05 avg300=0.01 total=123456\n"
+)
+
+func TestParsePSI(t *testing.T) {
+	psi, err := ParsePSI(strings.NewReader(samplePSIIO))
+	if err != nil {
+		t.Fatalf("ParsePSI() error = %v", err)
+	}
+	want := PSI{
+		Some: PSILine{Avg10: 88.10, Avg60: 61.40, Avg300: 22.90, Total: 812345678},
+		Full: PSILine{Avg10: 42.75, Avg60: 30.02, Avg300: 9.87, Total: 512345678},
+	}
+	if psi != want {
+		t.Errorf("ParsePSI() = %+v, want %+v", psi, want)
+	}
+
+	psi, err = ParsePSI(strings.NewReader(samplePSICPUOld))
+	if err != nil {
+		t.Fatalf("ParsePSI(some only) error = %v", err)
+	}
+	if psi.Some.Avg10 != 0.12 || psi.Full != (PSILine{}) {
+		t.Errorf("ParsePSI(some only) = %+v, want some avg10 0.12 and an empty full line", psi)
+	}
+}
+
+func TestParsePSI_Malformed(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"some avg10=abc avg60=0.00 avg300=0.00 total=0\n",
+		"some avg10\n",
+		"partial avg10=0.00\n",
+	} {
+		if _, err := ParsePSI(strings.NewReader(input)); err == nil {
+			t.Errorf("ParsePSI(%q) succeeded, want error", input)
+		}
+	}
+}
+
+func writePSIDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadPressure(t *testing.T) {
+	dir := writePSIDir(t, map[string]string{"io": samplePSIIO, "memory": samplePSIIdle, "cpu": samplePSICPUOld})
+
+	var r HealthReadings
+	if err := ReadPressure(dir, &r); err != nil {
+		t.Fatalf("ReadPressure() error = %v", err)
+	}
+	if !r.PSI || r.IOPressure != 42.75 || r.MemPressure != 0 {
+		t.Errorf("readings = %+v, want PSI with io 42.75 and memory 0", r)
+	}
+}
+
+func TestReadPressure_Unsupported(t *testing.T) {
+	var r HealthReadings
+	err := ReadPressure(filepath.Join(t.TempDir(), "pressure"), &r)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ReadPressure() error = %v, want os.ErrNotExist", err)
+	}
+	if r.PSI {
+		t.Error("readings marked PSI without pressure files")
+	}
+}
+
+func TestEvaluate_PSI(t *testing.T) {
+	tests := []struct {
+		name    string
+		io, mem float64
+		wantErr string
+	}{
+		{name: "quiet", io: 1.25, mem: 0},
+		{name: "io at limit", io: 10, mem: 0},
+		{name: "io stalls", io: 42.75, mem: 0, wantErr: "I/O pressure"},
+		{name: "memory stalls", io: 0, mem: 12.5, wantErr: "memory pressure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := healthyReadings()
+			r.PSI, r.IOPressure, r.MemPressure = true, tt.io, tt.mem
+			err := quietChecker().Evaluate(r)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Evaluate() = %v, want accepted", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Evaluate() = %v, want error mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluate_PSIReplacesFallbackChecks(t *testing.T) {
+	// Coarse readings that would refuse on their own
+	r := healthyReadings()
+	r.IOWait = 90
+	r.MemAvailableKB = r.MemTotalKB / 100
+
+	if err := quietChecker().Evaluate(r); err == nil {
+		t.Fatal("Evaluate() without PSI accepted 90% I/O wait and 1% free memory")
+	}
+	r.PSI = true
+	if err := quietChecker().Evaluate(r); err != nil {
+		t.Errorf("Evaluate() with quiet PSI = %v, want PSI to override the coarse checks", err)
+	}
+}
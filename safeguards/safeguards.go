@@ -134,8 +134,9 @@ func RecoverableOperation(logger logrus.FieldLogger, opName string, fn func() er
 
 // SystemHealthChecker provides comprehensive system health checks.
 type SystemHealthChecker struct {
-	logger   logrus.FieldLogger
-	poolName string
+	logger     logrus.FieldLogger
+	poolName   string
+	thresholds HealthThresholds
 }
 
 // NewSystemHealthChecker creates a new health checker.
@@ -144,8 +145,9 @@ func NewSystemHealthChecker(poolName string, logger logrus.FieldLogger) *SystemH
 		logger = logrus.StandardLogger()
 	}
 	return &SystemHealthChecker{
-		logger:   logger.WithField("component", "health-checker"),
-		poolName: poolName,
+		logger:     logger.WithField("component", "health-checker"),
+		poolName:   poolName,
+		thresholds: DefaultHealthThresholds(),
 	}
 }
 
@@ -178,22 +180,17 @@ func (h *SystemHealthChecker) CheckAll(ctx context.Context) error {
 }
 
 func (h *SystemHealthChecker) checkDStateProcesses(ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, "bash", "-c", "ps aux | awk '$8 ~ /^D/ {print $0}'")
-	output, err := cmd.Output()
+	procs, err := DStateProcs(ProcDir)
 	if err != nil {
 		return nil // Ignore errors in health check
 	}
 
-	outputStr := strings.TrimSpace(string(output))
-	if outputStr != "" {
-		lines := strings.Split(outputStr, "\n")
-		// Check if any D-state processes are dm-related
-		for _, line := range lines {
-			if strings.Contains(line, "dm-") || strings.Contains(line, "thin") ||
-				strings.Contains(line, "loop") || strings.Contains(line, "kworker") {
-				h.logger.WithField("processes", outputStr).Warn("D-state processes detected")
-				return fmt.Errorf("D-state processes detected - system may be unstable: %s", line)
-			}
+	// Check if any D-state processes are dm-related; loop devices back the
+	// pool and any kworker may be flushing it
+	for _, p := range procs {
+		if p.DmRelated() || strings.HasPrefix(p.Comm, "loop") || strings.HasPrefix(p.Comm, "kworker") {
+			h.logger.WithField("processes", fmt.Sprint(procs)).Warn("D-state processes detected")
+			return fmt.Errorf("D-state processes detected - system may be unstable: %s", p)
 		}
 	}
 	return nil
@@ -221,17 +218,12 @@ func (h *SystemHealthChecker) checkPoolStatus(ctx context.Context) error {
 }
 
 func (h *SystemHealthChecker) checkKernelLogs(ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, "dmesg", "--time-format=reltime")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil // Ignore errors - dmesg may not be available
-	}
-
 	// Check last 50 lines for critical errors only
-	lines := strings.Split(string(output), "\n")
-	start := len(lines) - 50
-	if start < 0 {
-		start = 0
+	lines, err := KernelLogTail(ctx, KmsgPath, 50)
+	if err != nil {
+		// Not fatal, but say so rather than reporting a clean log
+		h.logger.WithError(err).Warn("cannot read kernel log, skipping kernel error check")
+		return nil
 	}
 
 	// Only check for critical errors that indicate imminent system failure
@@ -248,7 +240,7 @@ func (h *SystemHealthChecker) checkKernelLogs(ctx context.Context) error {
 		"device-mapper: thin",
 	}
 
-	for _, line := range lines[start:] {
+	for _, line := range lines {
 		lineLower := strings.ToLower(line)
 
 		// Check for critical errors - these always block
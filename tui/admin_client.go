@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"connectrpc.com/connect"
+	"github.com/oklog/ulid/v2"
 	fsmv1 "github.com/superfly/fsm/gen/fsm/v1"
 	"github.com/superfly/fsm/gen/fsm/v1/fsmv1connect"
 )
@@ -68,6 +69,18 @@ func (c *AdminClient) ListActive(ctx context.Context) ([]*fsmv1.ActiveFSM, error
 	return resp.Msg.GetActive(), nil
 }
 
+// ListRuns returns active FSM runs and, if includeCompleted is set, the runs
+// that have finished since the FSM manager started.
+func (c *AdminClient) ListRuns(ctx context.Context, includeCompleted bool) ([]*fsmv1.ActiveFSM, error) {
+	resp, err := c.client.ListActive(ctx, connect.NewRequest(&fsmv1.ListActiveRequest{
+		IncludeCompleted: includeCompleted,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list FSM runs: %w", err)
+	}
+	return resp.Msg.GetActive(), nil
+}
+
 // GetHistoryEvent retrieves the history event for a specific run version.
 func (c *AdminClient) GetHistoryEvent(ctx context.Context, runVersion string) (*fsmv1.HistoryEvent, error) {
 	resp, err := c.client.GetHistoryEvent(ctx, connect.NewRequest(&fsmv1.GetHistoryEventRequest{
@@ -99,6 +112,9 @@ func ActiveFSMToRun(active *fsmv1.ActiveFSM) FSMRun {
 		state = "running"
 	case fsmv1.RunState_RUN_STATE_COMPLETE:
 		state = "completed"
+		if active.GetError() != "" {
+			state = "failed"
+		}
 	default:
 		state = "unknown"
 	}
@@ -106,12 +122,28 @@ func ActiveFSMToRun(active *fsmv1.ActiveFSM) FSMRun {
 	// Extract image ID from the FSM ID (format: img_<hash>)
 	imageID := active.GetId()
 
-	return FSMRun{
+	run := FSMRun{
 		ID:          active.GetId(),
 		Type:        active.GetAction(),
 		ImageID:     imageID,
 		State:       state,
 		CurrentStep: active.GetCurrentState(),
+		StartedAt:   ulidTime(active.GetVersion()),
+		UpdatedAt:   ulidTime(active.GetTransitionVersion()),
 		Error:       active.GetError(),
 	}
+	if run.UpdatedAt.IsZero() {
+		run.UpdatedAt = run.StartedAt
+	}
+	return run
+}
+
+// ulidTime returns the timestamp encoded in a run or transition version, or
+// the zero time if s is not a ULID.
+func ulidTime(s string) time.Time {
+	id, err := ulid.Parse(s)
+	if err != nil {
+		return time.Time{}
+	}
+	return ulid.Time(id.Time())
 }
@@ -1,8 +1,11 @@
 package tui
 
 import (
+	"math"
 	"sync"
 	"time"
+
+	"github.com/superfly/fsm/humanize"
 )
 
 // ProgressCallback is a function called with progress updates
@@ -18,16 +21,38 @@ const (
 	EventUnpackStart      ProgressEventType = "unpack_start"
 	EventUnpackProgress   ProgressEventType = "unpack_progress"
 	EventUnpackComplete   ProgressEventType = "unpack_complete"
+
+	// Unpack steps that run after extraction, reported by UpdateStep
+	EventVerifyLayoutProgress ProgressEventType = "verify_layout_progress"
+	EventStoreProgress        ProgressEventType = "store_progress"
+
 	EventActivateStart    ProgressEventType = "activate_start"
 	EventActivateProgress ProgressEventType = "activate_progress"
 	EventActivateComplete ProgressEventType = "activate_complete"
 	EventError            ProgressEventType = "error"
 )
 
+// UnpackStep is a step of the unpack phase that runs after extraction.
+type UnpackStep string
+
+const (
+	StepVerifyLayout UnpackStep = "verify-layout" // Directories checked
+	StepStore        UnpackStep = "update-db"     // Record, unmount, deactivate, settle
+)
+
+// Shares of the unpack progress bar: extraction fills it to extractShare,
+// verify-layout to verifyShare and update-db the rest, so the bar keeps
+// moving after the last file is written.
+const (
+	extractShare = 0.90
+	verifyShare  = 0.95
+)
+
 // ProgressEvent represents a progress event
 type ProgressEvent struct {
 	Type      ProgressEventType
 	Phase     OperationPhase
+	Step      UnpackStep // Set on EventVerifyLayoutProgress and EventStoreProgress
 	Timestamp time.Time
 
 	// Progress metrics
@@ -39,7 +64,8 @@ type ProgressEvent struct {
 	Speed    float64 // bytes/second
 	SpeedStr string  // human-readable speed
 
-	// Timing
+	// Timing. ETA is estimated from the smoothed rate (see rateEstimator);
+	// it is zero when the total is unknown or no rate has been measured yet.
 	StartTime time.Time
 	Elapsed   time.Duration
 	ETA       time.Duration
@@ -61,6 +87,54 @@ type ProgressTracker struct {
 	current   int64
 	total     int64
 	startTime time.Time
+	rate      rateEstimator
+}
+
+// rateSmoothing is the time constant of the rate EWMA: a sample's weight
+// decays by a factor of e over this long, so the ETA follows a change in
+// speed within a few seconds without jumping on every chunk.
+const rateSmoothing = 5 * time.Second
+
+// rateEstimator smooths a progress rate with an exponentially weighted
+// moving average over (bytes, time) samples. Samples arrive at irregular
+// intervals, so each one is weighted by how much time it covers.
+type rateEstimator struct {
+	rate      float64 // Smoothed units per second; 0 until the first sample
+	lastCount int64
+	lastTime  time.Time
+}
+
+// reset starts a new series at start with nothing done.
+func (r *rateEstimator) reset(start time.Time) {
+	*r = rateEstimator{lastTime: start}
+}
+
+// observe adds a sample: count units done by now. It returns the smoothed
+// rate. Samples that do not move time forward are ignored.
+func (r *rateEstimator) observe(count int64, now time.Time) float64 {
+	dt := now.Sub(r.lastTime)
+	if dt <= 0 {
+		return r.rate
+	}
+	instant := float64(count-r.lastCount) / dt.Seconds()
+	if r.rate == 0 {
+		r.rate = instant
+	} else {
+		alpha := 1 - math.Exp(-dt.Seconds()/rateSmoothing.Seconds())
+		r.rate += alpha * (instant - r.rate)
+	}
+	r.lastCount = count
+	r.lastTime = now
+	return r.rate
+}
+
+// estimateETA returns how long the remaining total-current units take at
+// rate, rounded to the second, or 0 if the total or rate is unknown.
+func estimateETA(rate float64, current, total int64) time.Duration {
+	if total <= 0 || rate <= 0 || current >= total {
+		return 0
+	}
+	return (time.Duration(float64(total-current) / rate * float64(time.Second))).Round(time.Second)
 }
 
 // NewProgressTracker creates a new progress tracker
@@ -84,6 +158,7 @@ func (p *ProgressTracker) StartPhase(phase OperationPhase, total int64) {
 	p.current = 0
 	p.total = total
 	p.startTime = time.Now()
+	p.rate.reset(p.startTime)
 	p.mu.Unlock()
 
 	p.emit(ProgressEvent{
@@ -97,38 +172,37 @@ func (p *ProgressTracker) StartPhase(phase OperationPhase, total int64) {
 
 // Update updates the current progress
 func (p *ProgressTracker) Update(current int64) {
+	now := time.Now()
 	p.mu.Lock()
 	p.current = current
 	phase := p.phase
 	total := p.total
 	startTime := p.startTime
+	rate := p.rate.observe(current, now)
 	p.mu.Unlock()
 
-	elapsed := time.Since(startTime)
+	elapsed := now.Sub(startTime)
 	var percent float64
 	var speed float64
-	var eta time.Duration
 
 	if total > 0 {
-		percent = float64(current) / float64(total)
+		percent = phasePercent(phase, float64(current)/float64(total))
 	}
 
 	if elapsed.Seconds() > 0 {
 		speed = float64(current) / elapsed.Seconds()
-		if speed > 0 && total > current {
-			eta = time.Duration(float64(total-current)/speed) * time.Second
-		}
 	}
+	eta := estimateETA(rate, current, total)
 
 	p.emit(ProgressEvent{
 		Type:      eventTypeForPhaseProgress(phase),
 		Phase:     phase,
-		Timestamp: time.Now(),
+		Timestamp: now,
 		Current:   current,
 		Total:     total,
 		Percent:   percent,
 		Speed:     speed,
-		SpeedStr:  FormatBytes(int64(speed)) + "/s",
+		SpeedStr:  humanize.Bytes(int64(speed)) + "/s",
 		StartTime: startTime,
 		Elapsed:   elapsed,
 		ETA:       eta,
@@ -138,38 +212,37 @@ func (p *ProgressTracker) Update(current int64) {
 // UpdateWithTotal updates progress with both current and total values.
 // This is useful when the total is not known at phase start (e.g., S3 downloads).
 func (p *ProgressTracker) UpdateWithTotal(current, total int64) {
+	now := time.Now()
 	p.mu.Lock()
 	p.current = current
 	p.total = total // Update the total dynamically
 	phase := p.phase
 	startTime := p.startTime
+	rate := p.rate.observe(current, now)
 	p.mu.Unlock()
 
-	elapsed := time.Since(startTime)
+	elapsed := now.Sub(startTime)
 	var percent float64
 	var speed float64
-	var eta time.Duration
 
 	if total > 0 {
-		percent = float64(current) / float64(total)
+		percent = phasePercent(phase, float64(current)/float64(total))
 	}
 
 	if elapsed.Seconds() > 0 {
 		speed = float64(current) / elapsed.Seconds()
-		if speed > 0 && total > current {
-			eta = time.Duration(float64(total-current)/speed) * time.Second
-		}
 	}
+	eta := estimateETA(rate, current, total)
 
 	p.emit(ProgressEvent{
 		Type:      eventTypeForPhaseProgress(phase),
 		Phase:     phase,
-		Timestamp: time.Now(),
+		Timestamp: now,
 		Current:   current,
 		Total:     total,
 		Percent:   percent,
 		Speed:     speed,
-		SpeedStr:  FormatBytes(int64(speed)) + "/s",
+		SpeedStr:  humanize.Bytes(int64(speed)) + "/s",
 		StartTime: startTime,
 		Elapsed:   elapsed,
 		ETA:       eta,
@@ -188,7 +261,7 @@ func (p *ProgressTracker) UpdateWithMessage(current int64, message string) {
 	elapsed := time.Since(startTime)
 	var percent float64
 	if total > 0 {
-		percent = float64(current) / float64(total)
+		percent = phasePercent(phase, float64(current)/float64(total))
 	}
 
 	p.emit(ProgressEvent{
@@ -204,6 +277,38 @@ func (p *ProgressTracker) UpdateWithMessage(current int64, message string) {
 	})
 }
 
+// UpdateStep reports progress through an unpack step that follows
+// extraction: done of total units, with a status message for display.
+func (p *ProgressTracker) UpdateStep(step UnpackStep, done, total int, message string) {
+	p.mu.RLock()
+	startTime := p.startTime
+	p.mu.RUnlock()
+
+	from, to := verifyShare, 1.0
+	eventType := EventStoreProgress
+	if step == StepVerifyLayout {
+		from, to = extractShare, verifyShare
+		eventType = EventVerifyLayoutProgress
+	}
+	percent := from
+	if total > 0 {
+		percent += (to - from) * float64(min(done, total)) / float64(total)
+	}
+
+	p.emit(ProgressEvent{
+		Type:      eventType,
+		Phase:     PhaseUnpack,
+		Step:      step,
+		Timestamp: time.Now(),
+		Current:   int64(done),
+		Total:     int64(total),
+		Percent:   percent,
+		StartTime: startTime,
+		Elapsed:   time.Since(startTime),
+		Message:   message,
+	})
+}
+
 // CompletePhase marks the current phase as complete
 func (p *ProgressTracker) CompletePhase() {
 	p.mu.RLock()
@@ -255,6 +360,15 @@ func (p *ProgressTracker) emit(event ProgressEvent) {
 	}
 }
 
+// phasePercent scales a phase's own progress fraction to its progress bar.
+// Unpack progress is extraction, which fills the bar up to extractShare.
+func phasePercent(phase OperationPhase, fraction float64) float64 {
+	if phase == PhaseUnpack {
+		return fraction * extractShare
+	}
+	return fraction
+}
+
 func eventTypeForPhaseStart(phase OperationPhase) ProgressEventType {
 	switch phase {
 	case PhaseDownload:
@@ -0,0 +1,136 @@
+package tui
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProgressTracker_UnpackStepsInOrder(t *testing.T) {
+	tracker := NewProgressTracker()
+	var events []ProgressEvent
+	tracker.Subscribe(func(e ProgressEvent) { events = append(events, e) })
+
+	tracker.StartPhase(PhaseUnpack, 0)
+	tracker.UpdateWithTotal(100, 100)
+	tracker.UpdateStep(StepVerifyLayout, 5, 10, "Verifying layout (5/10 checks)")
+	tracker.UpdateStep(StepVerifyLayout, 10, 10, "Verifying layout (10/10 checks)")
+	tracker.UpdateStep(StepStore, 2, 4, "Unmounted, deactivating device")
+	tracker.UpdateStep(StepStore, 4, 4, "Pool settled")
+	tracker.CompletePhase()
+
+	want := []struct {
+		typ     ProgressEventType
+		step    UnpackStep
+		percent float64
+	}{
+		{EventUnpackStart, "", 0},
+		{EventUnpackProgress, "", extractShare},
+		{EventVerifyLayoutProgress, StepVerifyLayout, (extractShare + verifyShare) / 2},
+		{EventVerifyLayoutProgress, StepVerifyLayout, verifyShare},
+		{EventStoreProgress, StepStore, (verifyShare + 1) / 2},
+		{EventStoreProgress, StepStore, 1},
+		{EventUnpackComplete, "", 1},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Type != w.typ || e.Step != w.step || e.Phase != PhaseUnpack {
+			t.Errorf("event %d = %s/%s/%q, want %s/unpack/%q", i, e.Type, e.Phase, e.Step, w.typ, w.step)
+		}
+		if diff := e.Percent - w.percent; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("event %d (%s) percent = %v, want %v", i, e.Type, e.Percent, w.percent)
+		}
+	}
+}
+
+func TestRateEstimator_Smooths(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	var r rateEstimator
+	r.reset(start)
+
+	// A steady 1000 B/s is reported exactly
+	var rate float64
+	for i := 1; i <= 5; i++ {
+		rate = r.observe(int64(i*1000), start.Add(time.Duration(i)*time.Second))
+	}
+	if rate != 1000 {
+		t.Fatalf("steady rate = %v, want 1000", rate)
+	}
+
+	// A sample that does not move time forward is ignored
+	if got := r.observe(9000, start.Add(5*time.Second)); got != 1000 {
+		t.Errorf("rate after a same-time sample = %v, want 1000", got)
+	}
+
+	// After a jump to 3000 B/s one second's sample moves the estimate only
+	// part of the way, weighted by 1-e^(-1s/rateSmoothing)
+	rate = r.observe(8000, start.Add(6*time.Second))
+	want := 1000 + (1-math.Exp(-1/rateSmoothing.Seconds()))*2000
+	if math.Abs(rate-want) > 1e-9 {
+		t.Errorf("rate after speed-up = %v, want %v", rate, want)
+	}
+
+	// and converges on the new speed as samples keep coming
+	count := int64(8000)
+	for i := 7; i <= 60; i++ {
+		count += 3000
+		rate = r.observe(count, start.Add(time.Duration(i)*time.Second))
+	}
+	if math.Abs(rate-3000) > 1 {
+		t.Errorf("rate after a minute at 3000 B/s = %v, want ~3000", rate)
+	}
+
+	// A long gap weighs its sample more than a short one would
+	short, long := r, r
+	rShort := short.observe(count+100, start.Add(61*time.Second))
+	rLong := long.observe(count+6000, start.Add(80*time.Second))
+	if !(rLong < rShort && rShort < 3000) {
+		t.Errorf("rates after a 1s slow sample = %v and a 20s slow sample = %v, want the longer one to pull further down", rShort, rLong)
+	}
+}
+
+func TestEstimateETA(t *testing.T) {
+	tests := []struct {
+		name           string
+		rate           float64
+		current, total int64
+		want           time.Duration
+	}{
+		{"known", 1000, 4000, 10000, 6 * time.Second},
+		{"rounded", 3000, 0, 10000, 3 * time.Second},
+		{"unknown total", 1000, 4000, 0, 0},
+		{"no rate yet", 0, 0, 10000, 0},
+		{"done", 1000, 10000, 10000, 0},
+		{"past total", 1000, 12000, 10000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateETA(tt.rate, tt.current, tt.total); got != tt.want {
+				t.Errorf("estimateETA(%v, %d, %d) = %v, want %v", tt.rate, tt.current, tt.total, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgressTracker_ETAHiddenWithoutTotal(t *testing.T) {
+	tracker := NewProgressTracker()
+	var last ProgressEvent
+	tracker.Subscribe(func(e ProgressEvent) { last = e })
+
+	tracker.StartPhase(PhaseUnpack, 0)
+	time.Sleep(time.Millisecond)
+	tracker.UpdateWithTotal(500, 0)
+	if last.ETA != 0 {
+		t.Errorf("unpack ETA with unknown total = %v, want 0", last.ETA)
+	}
+
+	tracker.StartPhase(PhaseDownload, 0)
+	time.Sleep(time.Millisecond)
+	tracker.UpdateWithTotal(500, 1<<40)
+	if last.ETA <= 0 {
+		t.Errorf("download ETA with a known total = %v, want > 0", last.ETA)
+	}
+}
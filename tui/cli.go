@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/charmbracelet/lipgloss"
+	"github.com/superfly/fsm/humanize"
 )
 
 // CLIProgress provides simple CLI progress display without full TUI
@@ -108,6 +109,10 @@ func (p *CLIProgress) HandleEvent(event ProgressEvent) {
 		state.message = event.Message
 		p.updateProgressLine(event)
 
+	case EventVerifyLayoutProgress, EventStoreProgress:
+		state.message = event.Message
+		fmt.Fprintf(p.w, "\r\033[K  %s", event.Message)
+
 	case EventDownloadComplete, EventUnpackComplete, EventActivateComplete:
 		state.completed = true
 		state.current = event.Total
@@ -124,7 +129,7 @@ func (p *CLIProgress) printPhaseStart(phase OperationPhase, total int64) {
 	phaseName := p.phaseName(phase)
 	var sizeInfo string
 	if total > 0 && phase == PhaseDownload {
-		sizeInfo = fmt.Sprintf(" (%s)", FormatBytes(total))
+		sizeInfo = fmt.Sprintf(" (%s)", humanize.Bytes(total))
 	}
 	line := fmt.Sprintf("%s %s%s...",
 		p.styles.Info.Render(SymbolInProgress),
@@ -157,8 +162,8 @@ func (p *CLIProgress) updateProgressLine(event ProgressEvent) {
 		progressText = fmt.Sprintf("%s %3.0f%% %s/%s",
 			bar,
 			percent*100,
-			FormatBytes(event.Current),
-			FormatBytes(event.Total))
+			humanize.Bytes(event.Current),
+			humanize.Bytes(event.Total))
 		if event.SpeedStr != "" && event.SpeedStr != "0 B/s" {
 			progressText += fmt.Sprintf(" %s", event.SpeedStr)
 		}
@@ -191,7 +196,7 @@ func (p *CLIProgress) printPhaseComplete(phase OperationPhase, elapsed time.Dura
 	line := fmt.Sprintf("%s %s completed (%s)",
 		p.styles.Success.Render(SymbolSuccess),
 		phaseName,
-		FormatDuration(elapsed))
+		humanize.Duration(elapsed))
 	fmt.Fprintln(p.w, line)
 }
 
@@ -254,7 +259,7 @@ func (p *CLIProgress) PrintSummary(result *ProcessResult) {
 		fmt.Fprintf(p.w, "  %-16s %s\n", "Snapshot ID:", result.SnapshotID)
 		fmt.Fprintf(p.w, "  %-16s %s\n", "Snapshot Name:", result.SnapshotName)
 		fmt.Fprintf(p.w, "  %-16s %s\n", "Device Path:", result.DevicePath)
-		fmt.Fprintf(p.w, "  %-16s %s\n", "Total Time:", FormatDuration(result.TotalTime))
+		fmt.Fprintf(p.w, "  %-16s %s\n", "Total Time:", humanize.Duration(result.TotalTime))
 	}
 	fmt.Fprintln(p.w)
 }
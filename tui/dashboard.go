@@ -7,24 +7,31 @@ import (
 	"time"
 
 	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/superfly/fsm/humanize"
 )
 
-// FSMRun represents an active FSM run
+// FSMRun represents an FSM run, live or finished
 type FSMRun struct {
 	ID          string
 	Type        string // download, unpack, activate
 	ImageID     string
-	State       string
+	State       string // pending, running, completed, failed
 	Progress    float64
 	CurrentStep string
 	StartedAt   time.Time
-	UpdatedAt   time.Time
+	UpdatedAt   time.Time // Last transition; when it finished for a finished run
 	Error       string
 }
 
+// Finished reports whether the run has completed or failed.
+func (r FSMRun) Finished() bool {
+	return r.State == "completed" || r.State == "failed"
+}
+
 // SystemStatus represents the current system status
 type SystemStatus struct {
 	PoolName      string
@@ -33,6 +40,7 @@ type SystemStatus struct {
 	PoolMetaUsed  int64
 	PoolMetaTotal int64
 	PoolError     string // Error message if pool status fetch failed
+	PoolState     string // Unhealthy pool state (read-only, needs_check, ...); empty when healthy
 	TotalImages   int
 	UnpackedCount int
 	ActiveSnaps   int
@@ -50,6 +58,22 @@ type LogEntry struct {
 	Fields    map[string]string
 }
 
+// logLevels are the minimum levels the activity log can be filtered to, lowest first.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// logLevelRank returns the index of level in logLevels. Unknown levels rank as info.
+func logLevelRank(level string) int {
+	switch level {
+	case "debug":
+		return 0
+	case "warn", "warning":
+		return 2
+	case "error":
+		return 3
+	}
+	return 1
+}
+
 // DashboardUpdateMsg is sent when dashboard data is updated
 type DashboardUpdateMsg struct {
 	ActiveRuns     []FSMRun
@@ -71,6 +95,7 @@ type ViewMode int
 const (
 	ViewModeDashboard ViewMode = iota // Default monitoring dashboard
 	ViewModeS3Browser                 // S3 image browser for selection/unpack
+	ViewModeSnapshots                 // Active snapshot list with per-snapshot detail
 )
 
 // DashboardModel is the main TUI dashboard model
@@ -91,23 +116,49 @@ type DashboardModel struct {
 
 	// Data
 	activeRuns      []FSMRun
+	showCompleted   bool // Show successfully completed runs; failed runs are always shown
 	registeredFSMs  []string
 	systemStatus    *SystemStatus
 	logs            []LogEntry
 	maxLogs         int
+	minLogLevel     int       // Index into logLevels; lower-level entries are hidden
+	logsClearedAt   time.Time // Entries older than the last clear stay hidden
 	lastRefresh     time.Time
 	connectionError error
 
 	// S3 Browser state
 	s3Browser      *S3BrowserState
 	s3BrowserError error
+	filterInput    textinput.Model
+	filtering      bool // Keystrokes go to filterInput while true
+
+	// Snapshot view state
+	snapshots      *SnapshotListState
+	snapshotsError error
+	snapshotSource snapshotFetcher // nil without a fetcher
 
 	// View mode
 	viewMode ViewMode
 
 	// FSM operation state
-	processingImage string // S3 key of image being processed (if any)
-	processError    error
+	processingImage  string // S3 key of image being processed (if any)
+	processError     error
+	cancelProcessing context.CancelFunc // Cancels the in-flight run; nil when idle
+	cancelling       bool               // Cancel requested, waiting for the run to unwind
+
+	// Batch processing: queued keys are started one at a time, each only after
+	// the previous run (including its pool stabilization) has returned.
+	processQueue []string
+	batchTotal   int // Images in the current batch, 0 when not running a batch
+
+	// Confirmation before processing: Enter sets pendingImage (p sets
+	// pendingBatch) and confirming, and processing only starts on 'y'.
+	// Disabled by noConfirm.
+	noConfirm    bool
+	confirming   bool
+	unquarantine bool // Quarantined images may be processed (--unquarantine)
+	pendingImage string
+	pendingBatch []string
 
 	// Real-time processing progress
 	processingProgress *ProcessingProgressMsg
@@ -125,6 +176,9 @@ type DashboardConfig struct {
 	Title           string
 	RefreshInterval time.Duration
 	Fetcher         *DataFetcher
+	NoConfirm       bool // Process images on Enter without a y/n confirmation
+	ShowCompleted   bool // List completed FSM runs as well as live and failed ones
+	Unquarantine    bool // Allow processing images quarantined after failing security validation
 }
 
 // DefaultDashboardConfig returns default dashboard configuration.
@@ -146,6 +200,11 @@ func NewDashboardModelWithConfig(cfg DashboardConfig) *DashboardModel {
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(ColorPrimary)
 
+	filter := textinput.New()
+	filter.Prompt = "/"
+	filter.Placeholder = "runtime, version or key"
+	filter.CharLimit = 64
+
 	if cfg.RefreshInterval == 0 {
 		cfg.RefreshInterval = time.Second
 	}
@@ -153,10 +212,13 @@ func NewDashboardModelWithConfig(cfg DashboardConfig) *DashboardModel {
 		cfg.Title = "Fly.io Image Manager Dashboard"
 	}
 
-	return &DashboardModel{
+	m := &DashboardModel{
 		title:           cfg.Title,
 		refreshInterval: cfg.RefreshInterval,
 		fetcher:         cfg.Fetcher,
+		noConfirm:       cfg.NoConfirm,
+		unquarantine:    cfg.Unquarantine,
+		showCompleted:   cfg.ShowCompleted,
 		spinner:         s,
 		logView:         viewport.New(80, 10),
 		helpHeight:      2,
@@ -165,14 +227,21 @@ func NewDashboardModelWithConfig(cfg DashboardConfig) *DashboardModel {
 		systemStatus: &SystemStatus{
 			PoolName: "pool",
 		},
-		logs:      []LogEntry{},
-		maxLogs:   100,
-		s3Browser: NewS3BrowserState(),
-		viewMode:  ViewModeDashboard,
-		focused:   "runs",
-		styles:    DefaultStyles(),
-		startTime: time.Now(),
+		logs:        []LogEntry{},
+		maxLogs:     100,
+		s3Browser:   NewS3BrowserState(),
+		snapshots:   NewSnapshotListState(),
+		filterInput: filter,
+		viewMode:    ViewModeDashboard,
+		focused:     "runs",
+		styles:      DefaultStyles(),
+		startTime:   time.Now(),
+	}
+	// Only set when non-nil so a missing fetcher leaves a nil interface
+	if cfg.Fetcher != nil {
+		m.snapshotSource = cfg.Fetcher
 	}
+	return m
 }
 
 // Init initializes the dashboard
@@ -234,6 +303,7 @@ type ProcessingProgressMsg struct {
 	Total       int64                // Total bytes or files
 	Speed       string               // Download speed (e.g., "2.5 MB/s")
 	ElapsedTime string               // Elapsed time string
+	ETA         time.Duration        // Estimated time remaining; 0 hides it (unknown total)
 	progressCh  <-chan ProgressEvent // Channel to continue listening (internal)
 }
 
@@ -256,6 +326,7 @@ func (m *DashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.s3Browser.VisibleRows < 5 {
 				m.s3Browser.VisibleRows = 5
 			}
+			m.snapshots.VisibleRows = m.s3Browser.VisibleRows
 		}
 
 	case DashboardUpdateMsg:
@@ -291,6 +362,9 @@ func (m *DashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			if len(msg.Data.RecentActivity) > 0 {
 				m.logs = msg.Data.RecentActivity
+				if len(m.logs) > m.maxLogs {
+					m.logs = m.logs[len(m.logs)-m.maxLogs:]
+				}
 				m.logView.SetContent(m.renderLogs())
 			}
 		}
@@ -300,15 +374,30 @@ func (m *DashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if msg.Error != nil {
 			m.s3BrowserError = msg.Error
 		} else {
-			m.s3Browser.Images = msg.Images
+			m.s3Browser.SetImages(msg.Images)
 			m.s3BrowserError = nil
 		}
 
+	case SnapshotsMsg:
+		m.snapshots.Loading = false
+		if msg.Error != nil {
+			m.snapshotsError = msg.Error
+		} else {
+			m.snapshots.SetSnapshots(msg.Snapshots)
+			m.snapshotsError = nil
+		}
+
 	case ProcessImageMsg:
 		m.AddLog("info", fmt.Sprintf("ProcessImageMsg received for: %s", msg.S3Key), nil)
+		cancelled := m.cancelling
 		m.processingImage = ""
 		m.processingProgress = nil // Clear progress when complete
-		if msg.Error != nil {
+		m.cancelProcessing = nil
+		m.cancelling = false
+		if msg.Error != nil && cancelled {
+			m.processError = nil
+			m.AddLog("warn", fmt.Sprintf("Cancelled processing of %s: %v", msg.S3Key, msg.Error), nil)
+		} else if msg.Error != nil {
 			m.processError = msg.Error
 			m.AddLog("error", fmt.Sprintf("Failed to process %s: %v", msg.S3Key, msg.Error), nil)
 		} else {
@@ -321,6 +410,9 @@ func (m *DashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				cmds = append(cmds, m.fetchS3Images())
 			}
 		}
+		if cmd := m.nextQueued(msg.Error != nil, cancelled); cmd != nil {
+			cmds = append(cmds, cmd)
+		}
 
 	case ProcessingProgressMsg:
 		// Update real-time progress during processing
@@ -358,6 +450,13 @@ func (m *DashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 func (m *DashboardModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 
+	if m.confirming {
+		return m.handleConfirmKey(msg)
+	}
+	if m.filtering {
+		return m.handleFilterKey(msg)
+	}
+
 	switch msg.String() {
 	case "q", "ctrl+c":
 		m.quitting = true
@@ -375,12 +474,22 @@ func (m *DashboardModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		m.focused = "s3list"
 		m.AddLog("info", "Switched to Images view (viewMode=1)", nil)
 		// Fetch S3 images if not already loaded
-		if len(m.s3Browser.Images) == 0 && !m.s3Browser.Loading && m.fetcher != nil {
+		if len(m.s3Browser.All) == 0 && !m.s3Browser.Loading && m.fetcher != nil {
 			m.s3Browser.Loading = true
 			m.AddLog("info", "Loading S3 images...", nil)
 			cmds = append(cmds, m.fetchS3Images())
 		}
 
+	case "3":
+		// Switch to snapshot view; always re-fetched since snapshots change often
+		m.viewMode = ViewModeSnapshots
+		m.focused = "snapshots"
+		m.AddLog("info", "Switched to Snapshots view (viewMode=2)", nil)
+		if !m.snapshots.Loading && m.snapshotSource != nil {
+			m.snapshots.Loading = true
+			cmds = append(cmds, m.fetchSnapshots())
+		}
+
 	case "tab":
 		if m.viewMode == ViewModeDashboard {
 			switch m.focused {
@@ -396,6 +505,8 @@ func (m *DashboardModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "j", "down":
 		if m.viewMode == ViewModeS3Browser {
 			m.s3Browser.MoveDown()
+		} else if m.viewMode == ViewModeSnapshots {
+			m.snapshots.MoveDown()
 		} else if m.focused == "logs" {
 			m.logView.LineDown(1)
 		}
@@ -403,6 +514,8 @@ func (m *DashboardModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "k", "up":
 		if m.viewMode == ViewModeS3Browser {
 			m.s3Browser.MoveUp()
+		} else if m.viewMode == ViewModeSnapshots {
+			m.snapshots.MoveUp()
 		} else if m.focused == "logs" {
 			m.logView.LineUp(1)
 		}
@@ -411,6 +524,9 @@ func (m *DashboardModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		if m.viewMode == ViewModeS3Browser {
 			m.s3Browser.SelectedIdx = 0
 			m.s3Browser.ScrollOffset = 0
+		} else if m.viewMode == ViewModeSnapshots {
+			m.snapshots.SelectedIdx = 0
+			m.snapshots.ScrollOffset = 0
 		} else if m.focused == "logs" {
 			m.logView.GotoTop()
 		}
@@ -423,6 +539,13 @@ func (m *DashboardModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 					m.s3Browser.ScrollOffset = m.s3Browser.SelectedIdx - m.s3Browser.VisibleRows + 1
 				}
 			}
+		} else if m.viewMode == ViewModeSnapshots {
+			if len(m.snapshots.Snapshots) > 0 {
+				m.snapshots.SelectedIdx = len(m.snapshots.Snapshots) - 1
+				if m.snapshots.SelectedIdx >= m.snapshots.VisibleRows {
+					m.snapshots.ScrollOffset = m.snapshots.SelectedIdx - m.snapshots.VisibleRows + 1
+				}
+			}
 		} else if m.focused == "logs" {
 			m.logView.GotoBottom()
 		}
@@ -434,15 +557,80 @@ func (m *DashboardModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 		if m.viewMode == ViewModeS3Browser && m.processingImage == "" {
 			if img := m.s3Browser.SelectedImage(); img != nil {
-				// Trigger image processing
-				m.processingImage = img.Key
-				m.AddLog("info", fmt.Sprintf("Starting process for %s...", ImageName(img.Key)), nil)
-				cmds = append(cmds, m.processImage(img.Key))
+				if m.refuseQuarantined(img) {
+					// Logged; nothing to confirm
+				} else if m.noConfirm {
+					cmds = append(cmds, m.startProcessing(img.Key))
+				} else {
+					// Processing is a multi-minute devicemapper operation - ask first
+					m.confirming = true
+					m.pendingImage = img.Key
+				}
 			} else {
 				m.AddLog("warn", "Enter pressed but no image selected", nil)
 			}
 		}
 
+	case "/":
+		if m.viewMode == ViewModeS3Browser {
+			m.filtering = true
+			cmds = append(cmds, m.filterInput.Focus())
+		}
+
+	case "esc":
+		if m.viewMode == ViewModeS3Browser && m.s3Browser.Filter != "" {
+			m.clearFilter()
+		}
+
+	case "l":
+		// Cycle the minimum level shown in the activity log
+		if m.viewMode == ViewModeDashboard {
+			m.minLogLevel = (m.minLogLevel + 1) % len(logLevels)
+			m.logView.SetContent(m.renderLogs())
+		}
+
+	case "x":
+		if m.viewMode == ViewModeDashboard {
+			m.clearLogs()
+		}
+
+	case "a":
+		// Toggle completed runs in the runs panel
+		if m.viewMode == ViewModeDashboard {
+			m.showCompleted = !m.showCompleted
+		}
+
+	case " ":
+		if m.viewMode == ViewModeS3Browser {
+			m.s3Browser.ToggleSelected()
+		}
+
+	case "p":
+		// Process every checked image, one at a time
+		if m.viewMode == ViewModeS3Browser {
+			keys := m.s3Browser.SelectedKeys()
+			if len(keys) == 0 {
+				m.AddLog("warn", "No images checked (press space to check images)", nil)
+			} else if keys = m.processableKeys(keys); len(keys) == 0 {
+				// Every checked image is quarantined; each was logged
+			} else if m.noConfirm {
+				cmds = append(cmds, m.enqueueImages(keys))
+			} else {
+				m.confirming = true
+				m.pendingBatch = keys
+			}
+		}
+
+	case "c":
+		// Cancel the in-flight run and drop the rest of the batch. The pipeline
+		// still stabilizes the pool on the way out, so this can take a few
+		// seconds to finish.
+		if m.processingImage != "" && m.cancelProcessing != nil && !m.cancelling {
+			m.cancelling = true
+			m.cancelProcessing()
+			m.AddLog("warn", fmt.Sprintf("Cancelling processing of %s...", ImageName(m.processingImage)), nil)
+		}
+
 	case "r":
 		// Manual refresh
 		cmds = append(cmds, m.fetchData())
@@ -450,11 +638,177 @@ func (m *DashboardModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			m.s3Browser.Loading = true
 			cmds = append(cmds, m.fetchS3Images())
 		}
+		if m.viewMode == ViewModeSnapshots && m.snapshotSource != nil {
+			m.snapshots.Loading = true
+			cmds = append(cmds, m.fetchSnapshots())
+		}
 	}
 
 	return m, tea.Batch(cmds...)
 }
 
+// handleConfirmKey handles the y/n answer to the process confirmation dialog.
+// Any other key leaves the dialog open.
+func (m *DashboardModel) handleConfirmKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "ctrl+c":
+		m.quitting = true
+		return m, tea.Quit
+	case "y", "Y":
+		key, batch := m.pendingImage, m.pendingBatch
+		m.confirming = false
+		m.pendingImage = ""
+		m.pendingBatch = nil
+		if len(batch) > 0 {
+			return m, m.enqueueImages(batch)
+		}
+		if m.processingImage == "" {
+			return m, m.startProcessing(key)
+		}
+	case "n", "N", "esc":
+		if len(m.pendingBatch) > 0 {
+			m.AddLog("info", fmt.Sprintf("Cancelled processing of %d checked images", len(m.pendingBatch)), nil)
+		} else {
+			m.AddLog("info", fmt.Sprintf("Cancelled processing of %s", ImageName(m.pendingImage)), nil)
+		}
+		m.confirming = false
+		m.pendingImage = ""
+		m.pendingBatch = nil
+	}
+	return m, nil
+}
+
+// startProcessing marks s3Key as in progress and returns the command that runs it.
+func (m *DashboardModel) startProcessing(s3Key string) tea.Cmd {
+	m.processingImage = s3Key
+	m.AddLog("info", fmt.Sprintf("Starting process for %s...", ImageName(s3Key)), nil)
+	return m.processImage(s3Key)
+}
+
+// refuseQuarantined reports whether img is quarantined and may not be
+// processed, logging why. --unquarantine allows it.
+func (m *DashboardModel) refuseQuarantined(img *S3Image) bool {
+	if img.Status != ImageStatusQuarantined || m.unquarantine {
+		return false
+	}
+	m.AddLog("warn", fmt.Sprintf("%s is quarantined after failing security validation; restart with --unquarantine to process it", ImageName(img.Key)), nil)
+	return true
+}
+
+// processableKeys returns keys without the quarantined images that may not
+// be processed.
+func (m *DashboardModel) processableKeys(keys []string) []string {
+	var out []string
+	for _, key := range keys {
+		if img := m.s3Browser.Image(key); img != nil && m.refuseQuarantined(img) {
+			continue
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+// enqueueImages queues keys for sequential processing and starts the first one
+// if nothing is running. Keys already running or queued are skipped.
+func (m *DashboardModel) enqueueImages(keys []string) tea.Cmd {
+	m.s3Browser.ClearSelected()
+
+	var added []string
+	for _, key := range keys {
+		if key != m.processingImage && m.queuePosition(key) == 0 {
+			added = append(added, key)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	if m.processingImage != "" {
+		if m.batchTotal == 0 {
+			m.batchTotal = 1 // The run already in progress
+		}
+		m.batchTotal += len(added)
+		m.processQueue = append(m.processQueue, added...)
+		m.AddLog("info", fmt.Sprintf("Queued %d images behind %s", len(added), ImageName(m.processingImage)), nil)
+		return nil
+	}
+
+	m.batchTotal = len(added)
+	m.processQueue = added[1:]
+	m.AddLog("info", fmt.Sprintf("Processing batch of %d images", len(added)), nil)
+	return m.startProcessing(added[0])
+}
+
+// nextQueued starts the next queued image after a run has finished. A failed
+// or cancelled run drops the rest of the queue rather than pushing more
+// devicemapper work onto a pool that may be in trouble.
+func (m *DashboardModel) nextQueued(failed, cancelled bool) tea.Cmd {
+	if len(m.processQueue) > 0 {
+		switch {
+		case cancelled:
+			m.AddLog("warn", fmt.Sprintf("Batch cancelled: %d queued images not processed", len(m.processQueue)), nil)
+			m.processQueue = nil
+		case failed:
+			m.AddLog("warn", fmt.Sprintf("Batch stopped after a failure: %d queued images not processed", len(m.processQueue)), nil)
+			m.processQueue = nil
+		default:
+			next := m.processQueue[0]
+			m.processQueue = m.processQueue[1:]
+			return m.startProcessing(next)
+		}
+	}
+	m.batchTotal = 0
+	return nil
+}
+
+// queuePosition returns the 1-based position of key in the processing queue,
+// or 0 if it is not queued.
+func (m *DashboardModel) queuePosition(key string) int {
+	for i, queued := range m.processQueue {
+		if queued == key {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// handleFilterKey handles keyboard input while the S3 filter input is focused.
+// The list is re-filtered on every keystroke; Enter keeps the filter and returns
+// to navigation, Esc clears it.
+func (m *DashboardModel) handleFilterKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		m.quitting = true
+		return m, tea.Quit
+	case tea.KeyEsc:
+		m.clearFilter()
+		return m, nil
+	case tea.KeyEnter:
+		m.filtering = false
+		m.filterInput.Blur()
+		return m, nil
+	case tea.KeyUp:
+		m.s3Browser.MoveUp()
+		return m, nil
+	case tea.KeyDown:
+		m.s3Browser.MoveDown()
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.filterInput, cmd = m.filterInput.Update(msg)
+	m.s3Browser.FilterImages(m.filterInput.Value())
+	return m, cmd
+}
+
+// clearFilter leaves filter mode and shows every image again.
+func (m *DashboardModel) clearFilter() {
+	m.filtering = false
+	m.filterInput.Blur()
+	m.filterInput.Reset()
+	m.s3Browser.FilterImages("")
+}
+
 // fetchS3Images creates a command to fetch S3 images
 func (m *DashboardModel) fetchS3Images() tea.Cmd {
 	return func() tea.Msg {
@@ -470,6 +824,18 @@ func (m *DashboardModel) fetchS3Images() tea.Cmd {
 	}
 }
 
+// fetchSnapshots creates a command to fetch active snapshots
+func (m *DashboardModel) fetchSnapshots() tea.Cmd {
+	source := m.snapshotSource
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		snapshots, err := source.FetchSnapshots(ctx)
+		return SnapshotsMsg{Snapshots: snapshots, Error: err}
+	}
+}
+
 // processImage creates a command to trigger image processing with real-time progress updates.
 // It returns a batch of commands: one to start processing and one to listen for progress.
 func (m *DashboardModel) processImage(s3Key string) tea.Cmd {
@@ -480,16 +846,21 @@ func (m *DashboardModel) processImage(s3Key string) tea.Cmd {
 	// Create a channel for progress updates
 	progressCh := make(chan ProgressEvent, 100)
 
+	// Cancelled by the 'c' key; the run unwinds through its normal error path
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancelProcessing = cancel
+
 	// Start the processing in a goroutine
 	processCmd := func() tea.Msg {
 		debugLog("processCmd: starting TriggerImageProcessWithProgress")
 
+		defer cancel()
+
 		if m.fetcher == nil {
 			close(progressCh)
 			return ProcessImageMsg{S3Key: s3Key, Error: fmt.Errorf("fetcher not configured")}
 		}
 
-		ctx := context.Background()
 		err := m.fetcher.TriggerImageProcessWithProgress(ctx, s3Key, progressCh)
 
 		debugLog("processCmd: TriggerImageProcessWithProgress completed, err=%v", err)
@@ -540,11 +911,27 @@ func (m *DashboardModel) listenForProgress(s3Key string, progressCh <-chan Progr
 			Current:    event.Current,
 			Total:      event.Total,
 			Speed:      event.SpeedStr,
+			ETA:        event.ETA,
 			progressCh: progressCh, // Include channel to continue listening
 		}
 	}
 }
 
+// formatETA renders an estimated time remaining, e.g. "~2m remaining".
+// Estimates are rough, so past a minute the seconds are dropped.
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("~%ds remaining", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("~%dm remaining", int(d.Round(time.Minute).Minutes()))
+	default:
+		d = d.Round(time.Minute)
+		return fmt.Sprintf("~%dh%dm remaining", int(d.Hours()), int(d.Minutes())%60)
+	}
+}
+
 // progressListenCmd is a message to continue listening for progress
 type progressListenCmd struct {
 	s3Key      string
@@ -574,28 +961,39 @@ func (m *DashboardModel) View() string {
 	}
 
 	// View mode tabs
-	tab1 := "[1] Monitor"
-	tab2 := "[2] Images"
-	if m.viewMode == ViewModeDashboard {
-		tab1 = m.styles.Info.Render("[1] Monitor")
-		tab2 = m.styles.Muted.Render("[2] Images")
-	} else {
-		tab1 = m.styles.Muted.Render("[1] Monitor")
-		tab2 = m.styles.Info.Render("[2] Images")
+	tabs := []struct {
+		mode  ViewMode
+		label string
+	}{
+		{ViewModeDashboard, "[1] Monitor"},
+		{ViewModeS3Browser, "[2] Images"},
+		{ViewModeSnapshots, "[3] Snapshots"},
+	}
+	tabLabels := make([]string, len(tabs))
+	for i, tab := range tabs {
+		if m.viewMode == tab.mode {
+			tabLabels[i] = m.styles.Info.Render(tab.label)
+		} else {
+			tabLabels[i] = m.styles.Muted.Render(tab.label)
+		}
 	}
 
-	title := fmt.Sprintf("%s  %s %s  %s  %s  Uptime: %s",
+	title := fmt.Sprintf("%s  %s %s  %s  Uptime: %s",
 		m.spinner.View(),
 		m.title,
 		connStatus,
-		tab1, tab2,
-		FormatDuration(uptime))
+		strings.Join(tabLabels, "  "),
+		humanize.Duration(uptime))
 	b.WriteString(titleStyle.Render(title) + "\n\n")
 
 	// Render based on view mode
-	switch m.viewMode {
-	case ViewModeS3Browser:
+	switch {
+	case m.confirming:
+		b.WriteString(m.renderConfirmDialog() + "\n")
+	case m.viewMode == ViewModeS3Browser:
 		b.WriteString(m.renderS3BrowserView())
+	case m.viewMode == ViewModeSnapshots:
+		b.WriteString(m.renderSnapshotsView())
 	default:
 		b.WriteString(m.renderDashboardView())
 	}
@@ -607,6 +1005,47 @@ func (m *DashboardModel) View() string {
 	return b.String()
 }
 
+// renderConfirmDialog renders the modal asking to confirm processing pendingImage,
+// centered in the space normally used by the view.
+func (m *DashboardModel) renderConfirmDialog() string {
+	keys := m.styles.HelpKey.Render("y") + " confirm  •  " + m.styles.HelpKey.Render("n") + " cancel"
+
+	var body string
+	if len(m.pendingBatch) > 0 {
+		const maxListed = 5
+		var names []string
+		for i, key := range m.pendingBatch {
+			if i == maxListed {
+				names = append(names, m.styles.Muted.Render(fmt.Sprintf("...and %d more", len(m.pendingBatch)-maxListed)))
+				break
+			}
+			names = append(names, m.styles.Info.Render(ImageDisplayName(key)))
+		}
+		body = fmt.Sprintf("%s\n\n%s\n\n%s",
+			m.styles.Warning.Render(fmt.Sprintf("Process %d images?", len(m.pendingBatch))),
+			strings.Join(names, "\n"),
+			"Each image is downloaded, unpacked and activated,\none at a time.\n"+keys)
+	} else {
+		body = fmt.Sprintf("%s\n\n%s\n%s\n\n%s",
+			m.styles.Warning.Render("Process image?"),
+			m.styles.Info.Render(ImageDisplayName(m.pendingImage)),
+			m.styles.Muted.Render(m.pendingImage),
+			"This downloads, unpacks and activates the image.\n"+keys)
+	}
+
+	dialog := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(ColorWarning).
+		Padding(1, 3).
+		Render(body)
+
+	height := m.height - 4
+	if height < lipgloss.Height(dialog) {
+		return dialog
+	}
+	return lipgloss.Place(m.width, height, lipgloss.Center, lipgloss.Center, dialog)
+}
+
 // renderDashboardView renders the default monitoring dashboard
 func (m *DashboardModel) renderDashboardView() string {
 	var b strings.Builder
@@ -653,6 +1092,142 @@ func (m *DashboardModel) renderS3BrowserView() string {
 	return b.String()
 }
 
+// renderSnapshotsView renders the snapshot view: the active snapshot list,
+// detail for the selected snapshot, and the activity log.
+func (m *DashboardModel) renderSnapshotsView() string {
+	var b strings.Builder
+
+	halfWidth := (m.width - 4) / 2
+
+	listPanel := m.renderSnapshotListPanel(halfWidth)
+	detailPanel := m.renderSnapshotDetailPanel(halfWidth)
+
+	topSection := lipgloss.JoinHorizontal(lipgloss.Top, listPanel, "  ", detailPanel)
+	b.WriteString(topSection + "\n\n")
+
+	logsPanel := m.renderLogsPanel()
+	b.WriteString(logsPanel + "\n")
+
+	return b.String()
+}
+
+// renderSnapshotListPanel renders the active snapshot list panel
+func (m *DashboardModel) renderSnapshotListPanel(width int) string {
+	var content strings.Builder
+
+	contentWidth := width - 4
+	if contentWidth < 20 {
+		contentWidth = 20
+	}
+
+	if m.snapshots.Loading && len(m.snapshots.Snapshots) == 0 {
+		content.WriteString(m.styles.Muted.Render("  Loading snapshots...\n"))
+	} else if m.snapshotsError != nil {
+		content.WriteString(m.styles.Error.Render(fmt.Sprintf("  Error: %v\n", m.snapshotsError)))
+	} else if len(m.snapshots.Snapshots) == 0 {
+		content.WriteString(m.styles.Muted.Render("  No active snapshots. Press 'r' to refresh.\n"))
+	} else {
+		start := m.snapshots.ScrollOffset
+		end := start + m.snapshots.VisibleRows
+		if end > len(m.snapshots.Snapshots) {
+			end = len(m.snapshots.Snapshots)
+		}
+
+		for i := start; i < end; i++ {
+			snap := m.snapshots.Snapshots[i]
+			isSelected := i == m.snapshots.SelectedIdx
+
+			cursor := "  "
+			if isSelected {
+				cursor = "> "
+			}
+
+			allocated := "?"
+			if snap.AllocatedBytes >= 0 {
+				allocated = humanize.Bytes(snap.AllocatedBytes)
+			}
+
+			// Build the line unstyled so truncation and padding count real characters
+			line := fmt.Sprintf("%s%-16s %9s  %s", cursor, snap.SnapshotName, allocated, snapshotImageName(snap))
+			if len(line) > contentWidth {
+				line = line[:contentWidth-3] + "..."
+			}
+			line = fmt.Sprintf("%-*s", contentWidth, line)
+
+			if isSelected {
+				line = m.styles.Info.Render(line)
+			}
+			content.WriteString(line + "\n")
+		}
+
+		if len(m.snapshots.Snapshots) > m.snapshots.VisibleRows {
+			content.WriteString(m.styles.Muted.Render(fmt.Sprintf(
+				"  [%d-%d of %d]", start+1, end, len(m.snapshots.Snapshots))))
+		}
+	}
+
+	return m.styles.ActivePanel.Width(width).Render(
+		m.styles.SectionHead.Render(fmt.Sprintf("Active Snapshots (%d)", len(m.snapshots.Snapshots))) + "\n" +
+			content.String())
+}
+
+// renderSnapshotDetailPanel renders detail for the selected snapshot
+func (m *DashboardModel) renderSnapshotDetailPanel(width int) string {
+	var content strings.Builder
+
+	snap := m.snapshots.SelectedSnapshot()
+	if snap == nil {
+		content.WriteString(m.styles.Muted.Render("  No snapshot selected\n"))
+	} else {
+		cowUsage := "unknown (device not active?)"
+		if snap.AllocatedBytes >= 0 {
+			cowUsage = humanize.Bytes(snap.AllocatedBytes) + " allocated"
+		}
+		created := "unknown"
+		if !snap.CreatedAt.IsZero() {
+			created = fmt.Sprintf("%s (%s ago)",
+				snap.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+				humanize.Duration(time.Since(snap.CreatedAt)))
+		}
+		originImage := snap.S3Key
+		if originImage == "" {
+			originImage = "(image record missing)"
+		}
+
+		rows := []struct {
+			label string
+			value string
+		}{
+			{"Snapshot:", snap.SnapshotName},
+			{"Snapshot ID:", snap.SnapshotID},
+			{"Device:", snap.DevicePath},
+			{"Origin image:", originImage},
+			{"Image ID:", snap.ImageID},
+			{"Origin dev:", snap.OriginDeviceID},
+			{"CoW usage:", cowUsage},
+			{"Created:", created},
+		}
+		for _, row := range rows {
+			content.WriteString(fmt.Sprintf("  %s %s\n",
+				m.styles.Muted.Render(fmt.Sprintf("%-14s", row.label)),
+				row.value))
+		}
+	}
+
+	return m.styles.Panel.Width(width).Render(
+		m.styles.SectionHead.Render("Snapshot Detail") + "\n" +
+			content.String())
+}
+
+// snapshotImageName returns the display name of a snapshot's origin image,
+// falling back to the image ID when the image record is missing.
+func snapshotImageName(snap SnapshotDetail) string {
+	if snap.S3Key != "" {
+		return ImageDisplayName(snap.S3Key)
+	}
+	return snap.ImageID
+}
+
 // renderS3ListPanel renders the S3 image list panel
 func (m *DashboardModel) renderS3ListPanel(width int) string {
 	var content strings.Builder
@@ -664,10 +1239,16 @@ func (m *DashboardModel) renderS3ListPanel(width int) string {
 		contentWidth = 20
 	}
 
+	if m.filtering || m.s3Browser.Filter != "" {
+		content.WriteString("  " + m.filterInput.View() + "\n")
+	}
+
 	if m.s3Browser.Loading {
 		content.WriteString(m.styles.Muted.Render("  Loading images from S3...\n"))
 	} else if m.s3BrowserError != nil {
 		content.WriteString(m.styles.Error.Render(fmt.Sprintf("  Error: %v\n", m.s3BrowserError)))
+	} else if len(m.s3Browser.Images) == 0 && m.s3Browser.Filter != "" {
+		content.WriteString(m.styles.Muted.Render(fmt.Sprintf("  No images match %q. Press Esc to clear.\n", m.s3Browser.Filter)))
 	} else if len(m.s3Browser.Images) == 0 {
 		content.WriteString(m.styles.Muted.Render("  No images found. Press 'r' to refresh.\n"))
 	} else {
@@ -704,6 +1285,9 @@ func (m *DashboardModel) renderS3ListPanel(width int) string {
 			case ImageStatusDownloaded:
 				statusIcon = "o"
 				statusTag = "downloaded"
+			case ImageStatusQuarantined:
+				statusIcon = "!"
+				statusTag = "quarantined"
 			default:
 				statusIcon = "-"
 				statusTag = ""
@@ -715,12 +1299,23 @@ func (m *DashboardModel) renderS3ListPanel(width int) string {
 			// Version: 3 chars
 			version := fmt.Sprintf("v%s", ImageVersion(img.Key))
 
+			// Queued images show their place in the batch instead of their status
+			if pos := m.queuePosition(img.Key); pos > 0 {
+				statusTag = fmt.Sprintf("queued #%d", pos)
+			}
+
+			// Check mark for batch processing: 1 char
+			check := " "
+			if m.s3Browser.IsSelected(img.Key) {
+				check = "x"
+			}
+
 			// Build the plain text line (no ANSI codes)
 			var line string
 			if statusTag != "" {
-				line = fmt.Sprintf("  %s%s %s %s [%s]", cursor, statusIcon, runtime, version, statusTag)
+				line = fmt.Sprintf("  %s%s %s %s %s [%s]", cursor, check, statusIcon, runtime, version, statusTag)
 			} else {
-				line = fmt.Sprintf("  %s%s %s %s", cursor, statusIcon, runtime, version)
+				line = fmt.Sprintf("  %s%s %s %s %s", cursor, check, statusIcon, runtime, version)
 			}
 
 			// Truncate if too long
@@ -743,6 +1338,8 @@ func (m *DashboardModel) renderS3ListPanel(width int) string {
 					line = m.styles.Success.Render(line)
 				case ImageStatusDownloaded, ImageStatusUnpacked:
 					// Keep default color
+				case ImageStatusQuarantined:
+					line = m.styles.Error.Render(line)
 				default:
 					line = m.styles.Muted.Render(line)
 				}
@@ -757,13 +1354,35 @@ func (m *DashboardModel) renderS3ListPanel(width int) string {
 				"  [%d-%d of %d]", start+1, end, len(m.s3Browser.Images))))
 		}
 		// Compact legend
-		content.WriteString(m.styles.Muted.Render("\n  - avail  o down  + unpack  * active"))
+		content.WriteString(m.styles.Muted.Render("\n  - avail  o down  + unpack  * active  x checked"))
+
+		// Detail for the selected image: pool space allocated to its device
+		if img := m.s3Browser.SelectedImage(); img != nil && img.DeviceName != "" {
+			allocated := "unknown"
+			if img.AllocatedBytes >= 0 {
+				allocated = humanize.Bytes(img.AllocatedBytes)
+			}
+			content.WriteString(m.styles.Muted.Render(fmt.Sprintf(
+				"\n  %s: %s allocated (%s)", ImageDisplayName(img.Key), allocated, img.DeviceName)))
+		}
+		// Why the selected image's last run aborted
+		if img := m.s3Browser.SelectedImage(); img != nil && img.LastError != "" {
+			content.WriteString("\n" + m.styles.Error.Render(truncateString("  Last error: "+img.LastError, contentWidth)))
+		}
 	}
 
 	// Processing indicator with real-time progress
 	if m.processingImage != "" {
 		content.WriteString("\n")
-		if m.processingProgress != nil {
+		if m.batchTotal > 0 {
+			content.WriteString(m.styles.Info.Render(fmt.Sprintf("  Batch: image %d of %d (%d queued)",
+				m.batchTotal-len(m.processQueue), m.batchTotal, len(m.processQueue))) + "\n")
+		}
+		if m.cancelling {
+			content.WriteString(m.styles.Warning.Render(
+				fmt.Sprintf("  %s Cancelling: %s", m.spinner.View(), ImageName(m.processingImage))) + "\n")
+			content.WriteString(m.styles.Muted.Render("     Waiting for the pipeline to stop and the pool to settle...") + "\n")
+		} else if m.processingProgress != nil {
 			// Show detailed progress
 			p := m.processingProgress
 			phaseIcon := "⏳"
@@ -794,11 +1413,17 @@ func (m *DashboardModel) renderS3ListPanel(width int) string {
 				content.WriteString(m.styles.Muted.Render(fmt.Sprintf("     %s", p.Status)) + "\n")
 			}
 
-			// Speed and size info for download
+			// Speed and size info for download, and time remaining when
+			// the total is known
 			if p.Phase == "download" && p.Speed != "" {
 				sizeInfo := fmt.Sprintf("     %s / %s @ %s",
-					FormatBytes(p.Current), FormatBytes(p.Total), p.Speed)
+					humanize.Bytes(p.Current), humanize.Bytes(p.Total), p.Speed)
+				if p.ETA > 0 {
+					sizeInfo += ", " + formatETA(p.ETA)
+				}
 				content.WriteString(m.styles.Muted.Render(sizeInfo) + "\n")
+			} else if p.ETA > 0 {
+				content.WriteString(m.styles.Muted.Render("     "+formatETA(p.ETA)) + "\n")
 			}
 		} else {
 			// Fallback: just show processing indicator with spinner
@@ -833,10 +1458,11 @@ func (m *DashboardModel) renderS3ListPanel(width int) string {
 func (m *DashboardModel) renderRunsPanel(width int) string {
 	var content strings.Builder
 
-	if len(m.activeRuns) == 0 {
+	runs := m.visibleRuns()
+	if len(runs) == 0 {
 		content.WriteString(m.styles.Muted.Render("  No active FSM runs\n"))
 	} else {
-		for _, run := range m.activeRuns {
+		for _, run := range runs {
 			icon := m.styles.StatusIcon(run.State)
 			typeLabel := fmt.Sprintf("%-10s", run.Type)
 			imageID := run.ImageID
@@ -844,13 +1470,29 @@ func (m *DashboardModel) renderRunsPanel(width int) string {
 				imageID = imageID[:12] + "..."
 			}
 
+			status := run.State
+			if run.CurrentStep != "" && !run.Finished() {
+				status += " " + run.CurrentStep
+			}
+			if !run.UpdatedAt.IsZero() {
+				status += " " + humanize.Duration(time.Since(run.UpdatedAt).Truncate(time.Second)) + " ago"
+			}
+
 			line := fmt.Sprintf("  %s %s %s %s\n",
 				icon,
 				m.styles.Info.Render(typeLabel),
 				m.styles.Muted.Render(imageID),
-				m.styles.Muted.Render(run.State))
+				m.styles.Muted.Render(status))
 			content.WriteString(line)
 
+			if run.State == "failed" && run.Error != "" {
+				errText := run.Error
+				if max := width - 8; max > 3 && len(errText) > max {
+					errText = errText[:max-3] + "..."
+				}
+				content.WriteString(fmt.Sprintf("    %s\n", m.styles.Error.Render(errText)))
+			}
+
 			// Progress bar if available
 			if run.Progress > 0 && run.Progress < 1 {
 				bar := renderProgressBar(run.Progress, width-6)
@@ -864,11 +1506,30 @@ func (m *DashboardModel) renderRunsPanel(width int) string {
 		panelStyle = m.styles.ActivePanel
 	}
 
+	title := "FSM Runs"
+	if m.showCompleted {
+		title += " (incl. completed)"
+	}
 	return panelStyle.Width(width).Render(
-		m.styles.SectionHead.Render("Active FSM Runs") + "\n" +
+		m.styles.SectionHead.Render(title) + "\n" +
 			content.String())
 }
 
+// visibleRuns returns the runs shown in the runs panel: live and failed runs,
+// plus completed runs when showCompleted is set.
+func (m *DashboardModel) visibleRuns() []FSMRun {
+	if m.showCompleted {
+		return m.activeRuns
+	}
+	runs := make([]FSMRun, 0, len(m.activeRuns))
+	for _, run := range m.activeRuns {
+		if run.State != "completed" {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
 func (m *DashboardModel) renderStatusPanel(width int) string {
 	var content strings.Builder
 
@@ -902,16 +1563,20 @@ func (m *DashboardModel) renderStatusPanel(width int) string {
 		dataUsedPct := float64(status.PoolDataUsed) / float64(status.PoolDataTotal)
 		content.WriteString(fmt.Sprintf("  %s %s / %s (%.1f%%)\n",
 			m.styles.Muted.Render("Pool Data:"),
-			FormatBytes(status.PoolDataUsed),
-			FormatBytes(status.PoolDataTotal),
+			humanize.Bytes(status.PoolDataUsed),
+			humanize.Bytes(status.PoolDataTotal),
 			dataUsedPct*100))
 
 		metaUsedPct := float64(status.PoolMetaUsed) / float64(status.PoolMetaTotal)
 		content.WriteString(fmt.Sprintf("  %s %s / %s (%.1f%%)\n",
 			m.styles.Muted.Render("Pool Meta:"),
-			FormatBytes(status.PoolMetaUsed),
-			FormatBytes(status.PoolMetaTotal),
+			humanize.Bytes(status.PoolMetaUsed),
+			humanize.Bytes(status.PoolMetaTotal),
 			metaUsedPct*100))
+
+		if status.PoolState != "" {
+			content.WriteString(m.styles.Error.Render(fmt.Sprintf("  Pool State: %s\n", status.PoolState)))
+		}
 	} else if status.PoolError != "" {
 		// Show the actual error for debugging
 		errMsg := status.PoolError
@@ -953,10 +1618,17 @@ func (m *DashboardModel) renderLogsPanel() string {
 	}
 
 	content := m.renderLogs()
-	if content == "" {
+	if content == "" && m.minLogLevel > 0 && len(m.logs) > 0 {
+		content = m.styles.Muted.Render(fmt.Sprintf("  No %s+ log entries (l to change level)", logLevels[m.minLogLevel]))
+	} else if content == "" {
 		content = m.styles.Muted.Render("  No log entries yet")
 	}
 
+	title := "Activity Log"
+	if m.minLogLevel > 0 {
+		title += fmt.Sprintf(" (%s+)", logLevels[m.minLogLevel])
+	}
+
 	// Calculate available height for logs
 	logsHeight := 10
 	if m.height > 0 {
@@ -970,14 +1642,19 @@ func (m *DashboardModel) renderLogsPanel() string {
 	m.logView.SetContent(content)
 
 	return panelStyle.Width(m.width - 4).Render(
-		m.styles.SectionHead.Render("Activity Log") + "\n" +
+		m.styles.SectionHead.Render(title) + "\n" +
 			m.logView.View())
 }
 
+// renderLogs renders the log entries at or above minLogLevel that were added
+// since the last clear.
 func (m *DashboardModel) renderLogs() string {
 	var b strings.Builder
 
 	for _, entry := range m.logs {
+		if logLevelRank(entry.Level) < m.minLogLevel || entry.Timestamp.Before(m.logsClearedAt) {
+			continue
+		}
 		timestamp := entry.Timestamp.Format("15:04:05")
 		var levelStyle lipgloss.Style
 		switch entry.Level {
@@ -1016,19 +1693,56 @@ func (m *DashboardModel) renderHelp() string {
 	}{
 		{"1", "monitor"},
 		{"2", "images"},
+		{"3", "snapshots"},
 		{"r", "refresh"},
 		{"q", "quit"},
 	}
 
 	// View-specific keys
-	if m.viewMode == ViewModeS3Browser {
+	if m.confirming {
+		keys = []struct {
+			key  string
+			desc string
+		}{
+			{"y", "process"},
+			{"n/Esc", "cancel"},
+		}
+		commonKeys = nil
+	} else if m.viewMode == ViewModeS3Browser && m.filtering {
+		keys = []struct {
+			key  string
+			desc string
+		}{
+			{"↑/↓", "navigate"},
+			{"Enter", "apply filter"},
+			{"Esc", "clear filter"},
+		}
+		commonKeys = nil
+	} else if m.viewMode == ViewModeS3Browser {
 		keys = []struct {
 			key  string
 			desc string
 		}{
 			{"j/k", "navigate"},
 			{"g/G", "top/bottom"},
+			{"/", "filter"},
+			{"space", "check"},
 			{"Enter", "process image"},
+			{"p", "process checked"},
+		}
+		if m.processingImage != "" && !m.cancelling {
+			keys = append(keys, struct {
+				key  string
+				desc string
+			}{"c", "cancel run"})
+		}
+	} else if m.viewMode == ViewModeSnapshots {
+		keys = []struct {
+			key  string
+			desc string
+		}{
+			{"j/k", "navigate"},
+			{"g/G", "top/bottom"},
 		}
 	} else {
 		keys = []struct {
@@ -1038,6 +1752,9 @@ func (m *DashboardModel) renderHelp() string {
 			{"Tab", "switch panel"},
 			{"j/k", "scroll logs"},
 			{"g/G", "top/bottom"},
+			{"l", "log level"},
+			{"x", "clear logs"},
+			{"a", "toggle completed"},
 		}
 	}
 
@@ -1077,6 +1794,15 @@ func (m *DashboardModel) AddLog(level, message string, fields map[string]string)
 	}
 }
 
+// clearLogs empties the activity log. Activity re-fetched from the database on
+// the next refresh is hidden too, unless it happened after the clear.
+func (m *DashboardModel) clearLogs() {
+	m.logs = m.logs[:0]
+	m.logsClearedAt = time.Now()
+	m.logView.SetContent("")
+	m.logView.GotoTop()
+}
+
 // UpdateRuns updates the active FSM runs
 func (m *DashboardModel) UpdateRuns(runs []FSMRun) {
 	m.activeRuns = runs
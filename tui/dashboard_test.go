@@ -0,0 +1,374 @@
+package tui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func keyRune(r rune) tea.KeyMsg {
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}}
+}
+
+// newBrowserDashboard returns a dashboard in the S3 browser view with
+// images/golang/1.tar selected.
+func newBrowserDashboard(cfg DashboardConfig) *DashboardModel {
+	m := NewDashboardModelWithConfig(cfg)
+	m.viewMode = ViewModeS3Browser
+	m.s3Browser.SetImages([]S3Image{{Key: "images/golang/1.tar"}, {Key: "images/python/1.tar"}})
+	return m
+}
+
+func TestDashboard_ConfirmThenProcess(t *testing.T) {
+	m := newBrowserDashboard(DefaultDashboardConfig())
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if !m.confirming || m.pendingImage != "images/golang/1.tar" {
+		t.Fatalf("after Enter: confirming=%v pending=%q, want confirmation for golang/1", m.confirming, m.pendingImage)
+	}
+	if m.processingImage != "" || cmd != nil {
+		t.Fatal("Enter must not start processing before confirmation")
+	}
+
+	// Navigation keys are swallowed while the dialog is open.
+	m.Update(keyRune('j'))
+	if m.s3Browser.SelectedIdx != 0 || !m.confirming {
+		t.Fatal("keys other than y/n should leave the dialog open and the selection unchanged")
+	}
+
+	_, cmd = m.Update(keyRune('y'))
+	if m.confirming || m.pendingImage != "" {
+		t.Errorf("after y: confirming=%v pending=%q, want dialog closed", m.confirming, m.pendingImage)
+	}
+	if m.processingImage != "images/golang/1.tar" || cmd == nil {
+		t.Fatalf("after y: processing=%q cmd=%v, want golang/1 processing", m.processingImage, cmd)
+	}
+}
+
+func TestDashboard_SelectedImageLastError(t *testing.T) {
+	m := newBrowserDashboard(DefaultDashboardConfig())
+	m.width, m.height = 200, 60
+	m.s3Browser.SetImages([]S3Image{
+		{Key: "images/golang/1.tar", LastError: "unpack failed in verify-layout: invalid filesystem layout: missing /etc"},
+		{Key: "images/python/1.tar"},
+	})
+
+	if view := m.renderS3ListPanel(120); !strings.Contains(view, "Last error: unpack failed in verify-layout") {
+		t.Errorf("selected image's last error not shown:\n%s", view)
+	}
+
+	m.Update(keyRune('j'))
+	if view := m.renderS3ListPanel(120); strings.Contains(view, "Last error") {
+		t.Errorf("last error shown for an image without one:\n%s", view)
+	}
+}
+
+func TestDashboard_ConfirmCancel(t *testing.T) {
+	for _, cancel := range []tea.KeyMsg{keyRune('n'), {Type: tea.KeyEsc}} {
+		m := newBrowserDashboard(DefaultDashboardConfig())
+
+		m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+		_, cmd := m.Update(cancel)
+		if m.confirming || m.pendingImage != "" {
+			t.Errorf("%s: dialog still open", cancel)
+		}
+		if m.processingImage != "" || cmd != nil {
+			t.Errorf("%s: processing started after cancel", cancel)
+		}
+	}
+}
+
+func TestDashboard_NoConfirm(t *testing.T) {
+	cfg := DefaultDashboardConfig()
+	cfg.NoConfirm = true
+	m := newBrowserDashboard(cfg)
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.confirming {
+		t.Fatal("NoConfirm should skip the dialog")
+	}
+	if m.processingImage != "images/golang/1.tar" || cmd == nil {
+		t.Fatalf("processing=%q cmd=%v, want golang/1 processing", m.processingImage, cmd)
+	}
+}
+
+func TestDashboard_QuarantinedImageRefused(t *testing.T) {
+	m := newBrowserDashboard(DefaultDashboardConfig())
+	m.s3Browser.SetImages([]S3Image{
+		{Key: "images/golang/1.tar", Status: ImageStatusQuarantined, LastError: "quarantined: path traversal detected"},
+		{Key: "images/python/1.tar"},
+	})
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.confirming || m.processingImage != "" || cmd != nil {
+		t.Fatalf("Enter on a quarantined image: confirming=%v processing=%q, want refused", m.confirming, m.processingImage)
+	}
+
+	// A batch goes ahead without the quarantined image
+	space := tea.KeyMsg{Type: tea.KeySpace}
+	m.Update(space)
+	m.Update(keyRune('j'))
+	m.Update(space)
+	m.Update(keyRune('p'))
+	if !m.confirming || len(m.pendingBatch) != 1 || m.pendingBatch[0] != "images/python/1.tar" {
+		t.Fatalf("batch = %v, want only python/1", m.pendingBatch)
+	}
+	m.Update(keyRune('n'))
+
+	// --unquarantine allows it
+	cfg := DefaultDashboardConfig()
+	cfg.NoConfirm, cfg.Unquarantine = true, true
+	m = newBrowserDashboard(cfg)
+	m.s3Browser.SetImages([]S3Image{{Key: "images/golang/1.tar", Status: ImageStatusQuarantined}})
+	m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.processingImage != "images/golang/1.tar" {
+		t.Errorf("with Unquarantine processing=%q, want golang/1", m.processingImage)
+	}
+}
+
+// newBatchDashboard returns a browser dashboard with golang/1, python/1 and
+// node/3 checked, in that list order.
+func newBatchDashboard(cfg DashboardConfig) *DashboardModel {
+	m := NewDashboardModelWithConfig(cfg)
+	m.viewMode = ViewModeS3Browser
+	m.s3Browser.SetImages([]S3Image{
+		{Key: "images/golang/1.tar"},
+		{Key: "images/python/1.tar"},
+		{Key: "images/ruby/2.tar"},
+		{Key: "images/node/3.tar"},
+	})
+	space := tea.KeyMsg{Type: tea.KeySpace}
+	m.Update(space)
+	m.Update(keyRune('j'))
+	m.Update(space)
+	m.Update(keyRune('j'))
+	m.Update(keyRune('j'))
+	m.Update(space)
+	return m
+}
+
+func TestDashboard_BatchSequentialDispatch(t *testing.T) {
+	m := newBatchDashboard(DefaultDashboardConfig())
+
+	m.Update(keyRune('p'))
+	if !m.confirming || len(m.pendingBatch) != 3 {
+		t.Fatalf("p should ask to confirm 3 images, confirming=%v batch=%v", m.confirming, m.pendingBatch)
+	}
+	if _, cmd := m.Update(keyRune('y')); cmd == nil {
+		t.Fatal("confirming the batch should start processing")
+	}
+	if len(m.s3Browser.SelectedKeys()) != 0 {
+		t.Error("checks should be cleared once the batch is queued")
+	}
+
+	// Exactly one image runs at a time; the next starts only when it finishes.
+	want := []string{"images/golang/1.tar", "images/python/1.tar", "images/node/3.tar"}
+	for i, key := range want {
+		if m.processingImage != key {
+			t.Fatalf("run %d: processing %q, want %q", i+1, m.processingImage, key)
+		}
+		if got := m.batchTotal - len(m.processQueue); got != i+1 || m.batchTotal != 3 {
+			t.Errorf("run %d: batch position %d of %d", i+1, got, m.batchTotal)
+		}
+		if i+1 < len(want) && m.queuePosition(want[i+1]) != 1 {
+			t.Errorf("run %d: %s should be next in the queue, queue = %v", i+1, want[i+1], m.processQueue)
+		}
+		m.Update(ProcessImageMsg{S3Key: key})
+	}
+
+	if m.processingImage != "" || len(m.processQueue) != 0 || m.batchTotal != 0 {
+		t.Errorf("after the batch: processing=%q queue=%v total=%d", m.processingImage, m.processQueue, m.batchTotal)
+	}
+}
+
+func TestDashboard_BatchStopsOnFailure(t *testing.T) {
+	cfg := DefaultDashboardConfig()
+	cfg.NoConfirm = true
+	m := newBatchDashboard(cfg)
+
+	m.Update(keyRune('p'))
+	if m.processingImage != "images/golang/1.tar" {
+		t.Fatalf("processing = %q, want golang/1 without confirmation", m.processingImage)
+	}
+
+	_, cmd := m.Update(ProcessImageMsg{S3Key: "images/golang/1.tar", Error: errors.New("unpack failed")})
+	if m.processingImage != "" || len(m.processQueue) != 0 || m.batchTotal != 0 {
+		t.Errorf("a failure should drop the queue: processing=%q queue=%v", m.processingImage, m.processQueue)
+	}
+	if cmd != nil {
+		t.Error("no further image should be started after a failure")
+	}
+}
+
+func TestDashboard_BatchQueuesBehindRunningImage(t *testing.T) {
+	cfg := DefaultDashboardConfig()
+	cfg.NoConfirm = true
+	m := newBatchDashboard(cfg)
+	m.processingImage = "images/golang/1.tar" // already running, and also checked
+
+	if _, cmd := m.Update(keyRune('p')); cmd != nil {
+		t.Fatal("queuing behind a running image must not start another run")
+	}
+	if got := strings.Join(m.processQueue, ","); got != "images/python/1.tar,images/node/3.tar" {
+		t.Errorf("queue = %s, want the running image skipped", got)
+	}
+	if m.batchTotal != 3 {
+		t.Errorf("batchTotal = %d, want 3 including the running image", m.batchTotal)
+	}
+}
+
+func TestDashboard_CancelProcessing(t *testing.T) {
+	fetcher := NewDataFetcher(nil, nil, "pool")
+	fetcher.SetImageProcessFuncWithProgress(func(ctx context.Context, s3Key string, progressCh chan<- ProgressEvent) error {
+		progressCh <- ProgressEvent{Type: EventDownloadStart, Phase: PhaseDownload, Message: "Initializing..."}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	cfg := DefaultDashboardConfig()
+	cfg.Fetcher = fetcher
+	cfg.NoConfirm = true
+	m := newBrowserDashboard(cfg)
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if cmd == nil || m.cancelProcessing == nil {
+		t.Fatal("Enter should start processing with a cancel func")
+	}
+	msg := cmd()
+	batch, ok := msg.(tea.BatchMsg)
+	if !ok || len(batch) != 2 {
+		t.Fatalf("processImage should return process and listen commands, got %T", msg)
+	}
+	processCmd, listenCmd := batch[0], batch[1]
+
+	done := make(chan tea.Msg, 1)
+	go func() { done <- processCmd() }()
+
+	if _, ok := listenCmd().(ProcessingProgressMsg); !ok {
+		t.Fatal("expected the initial progress event before cancelling")
+	}
+
+	m.Update(keyRune('c'))
+	if !m.cancelling {
+		t.Fatal("c should put the dashboard into the cancelling state")
+	}
+
+	var result ProcessImageMsg
+	select {
+	case msg := <-done:
+		result = msg.(ProcessImageMsg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("processing did not stop after cancel")
+	}
+	if !errors.Is(result.Error, context.Canceled) {
+		t.Errorf("process error = %v, want context.Canceled", result.Error)
+	}
+	if msg := listenCmd(); msg != nil {
+		t.Errorf("progress channel should be closed, got %T", msg)
+	}
+
+	m.Update(result)
+	if m.processingImage != "" || m.cancelling || m.cancelProcessing != nil {
+		t.Errorf("after completion: processing=%q cancelling=%v", m.processingImage, m.cancelling)
+	}
+	if m.processError != nil {
+		t.Errorf("a cancelled run should not be reported as a failure, got %v", m.processError)
+	}
+}
+
+func TestRenderLogs_LevelFilter(t *testing.T) {
+	m := NewDashboardModelWithConfig(DefaultDashboardConfig())
+	m.AddLog("debug", "[PROGRESS] phase=download", nil)
+	m.AddLog("info", "download started", nil)
+	m.AddLog("warn", "retrying download", nil)
+	m.AddLog("error", "download failed", nil)
+	m.AddLog("", "fetched activity", nil) // unknown levels count as info
+
+	tests := []struct {
+		level string
+		shown []string
+		gone  []string
+	}{
+		// Each 'l' press moves to the next level; the last one wraps to debug.
+		{"info", []string{"download started", "retrying", "failed", "fetched activity"}, []string{"[PROGRESS]"}},
+		{"warn", []string{"retrying", "failed"}, []string{"[PROGRESS]", "download started", "fetched activity"}},
+		{"error", []string{"failed"}, []string{"[PROGRESS]", "download started", "retrying", "fetched activity"}},
+		{"debug", []string{"[PROGRESS]", "download started", "retrying", "failed", "fetched activity"}, nil},
+	}
+	for _, tt := range tests {
+		m.Update(keyRune('l'))
+		if got := logLevels[m.minLogLevel]; got != tt.level {
+			t.Fatalf("level = %s, want %s", got, tt.level)
+		}
+		out := m.renderLogs()
+		for _, want := range tt.shown {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: %q missing from\n%s", tt.level, want, out)
+			}
+		}
+		for _, hidden := range tt.gone {
+			if strings.Contains(out, hidden) {
+				t.Errorf("%s: %q should be filtered out of\n%s", tt.level, hidden, out)
+			}
+		}
+	}
+}
+
+func TestDashboard_ClearLogs(t *testing.T) {
+	m := NewDashboardModelWithConfig(DefaultDashboardConfig())
+	m.AddLog("info", "before clear", nil)
+
+	m.Update(keyRune('x'))
+	if len(m.logs) != 0 || m.renderLogs() != "" {
+		t.Fatalf("logs after clear = %d entries, rendered %q", len(m.logs), m.renderLogs())
+	}
+
+	// Activity re-fetched from the database stays cleared unless it is newer.
+	m.Update(FetchDataMsg{Data: &DashboardUpdateMsg{RecentActivity: []LogEntry{
+		{Timestamp: time.Now().Add(-time.Minute), Level: "info", Message: "old activity"},
+		{Timestamp: time.Now().Add(time.Minute), Level: "info", Message: "new activity"},
+	}}})
+	m.AddLog("info", "after clear", nil)
+
+	out := m.renderLogs()
+	if strings.Contains(out, "old activity") || strings.Contains(out, "before clear") {
+		t.Errorf("entries from before the clear came back:\n%s", out)
+	}
+	if !strings.Contains(out, "new activity") || !strings.Contains(out, "after clear") {
+		t.Errorf("entries from after the clear are missing:\n%s", out)
+	}
+}
+
+func TestAddLog_BoundedByMaxLogs(t *testing.T) {
+	m := NewDashboardModelWithConfig(DefaultDashboardConfig())
+	for i := range m.maxLogs + 20 {
+		m.AddLog("debug", fmt.Sprintf("entry %d", i), nil)
+	}
+	if len(m.logs) != m.maxLogs {
+		t.Fatalf("len(logs) = %d, want %d", len(m.logs), m.maxLogs)
+	}
+	if m.logs[0].Message != "entry 20" {
+		t.Errorf("oldest entry = %q, want entry 20", m.logs[0].Message)
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{45 * time.Second, "~45s remaining"},
+		{59*time.Second + 600*time.Millisecond, "~1m remaining"},
+		{2*time.Minute + 10*time.Second, "~2m remaining"},
+		{time.Hour + 29*time.Minute + 45*time.Second, "~1h30m remaining"},
+	}
+	for _, tt := range tests {
+		if got := formatETA(tt.d); got != tt.want {
+			t.Errorf("formatETA(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
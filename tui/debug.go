@@ -2,6 +2,7 @@ package tui
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sync"
 )
@@ -21,9 +22,27 @@ func IsDebugEnabled() bool {
 	return debugEnabled
 }
 
+// debugOut receives debug messages when set by SetDebugOutput.
+var (
+	debugOut   io.Writer
+	debugOutMu sync.Mutex
+)
+
+// SetDebugOutput sends debug messages to w, enabling them regardless of
+// TUI_DEBUG. A nil w restores the default of stderr when TUI_DEBUG=1.
+func SetDebugOutput(w io.Writer) {
+	debugOutMu.Lock()
+	defer debugOutMu.Unlock()
+	debugOut = w
+}
+
 // debugLog prints a debug message if debugging is enabled (internal use).
 func debugLog(format string, args ...interface{}) {
-	if IsDebugEnabled() {
+	debugOutMu.Lock()
+	defer debugOutMu.Unlock()
+	if debugOut != nil {
+		fmt.Fprintf(debugOut, "[PROGRESS DEBUG] "+format+"\n", args...)
+	} else if IsDebugEnabled() {
 		fmt.Fprintf(os.Stderr, "[PROGRESS DEBUG] "+format+"\n", args...)
 	}
 }
@@ -5,11 +5,14 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/superfly/fsm/database"
+	"github.com/superfly/fsm/devicemapper"
+	fsmv1 "github.com/superfly/fsm/gen/fsm/v1"
 	"github.com/superfly/fsm/s3"
 )
 
@@ -19,14 +22,30 @@ type ImageProcessFunc func(ctx context.Context, s3Key string) error
 // ImageProcessFuncWithProgress is a function that processes an image with progress callback.
 type ImageProcessFuncWithProgress func(ctx context.Context, s3Key string, progressCh chan<- ProgressEvent) error
 
+// runLister lists FSM runs from the admin interface. It is satisfied by
+// *AdminClient.
+type runLister interface {
+	ListRuns(ctx context.Context, includeCompleted bool) ([]*fsmv1.ActiveFSM, error)
+}
+
+// s3Lister lists image objects under a prefix. It is satisfied by *s3.Client.
+type s3Lister interface {
+	ListImagesDetailed(ctx context.Context, bucket, prefix string) ([]s3.S3Object, error)
+}
+
+// maxFinishedRuns caps the completed and failed runs passed to the dashboard.
+// The FSM manager keeps every run finished since it started.
+const maxFinishedRuns = 20
+
 // DataFetcher retrieves dashboard data from various sources.
 type DataFetcher struct {
-	adminClient                  *AdminClient
+	adminClient                  runLister // nil without an admin client
 	db                           *database.DB
 	dbPath                       string // Path to the SQLite database (for diagnostics)
 	poolName                     string
-	dbError                      error // Error from database connection (if any)
-	s3Client                     *s3.Client
+	dbError                      error    // Error from database connection (if any)
+	s3Client                     s3Lister // nil without an S3 client
+	dmClient                     *devicemapper.Client
 	s3Bucket                     string
 	s3Prefix                     string
 	imageProcessFunc             ImageProcessFunc             // Function to trigger image processing (legacy)
@@ -35,31 +54,52 @@ type DataFetcher struct {
 
 // NewDataFetcher creates a new data fetcher.
 func NewDataFetcher(adminClient *AdminClient, db *database.DB, poolName string) *DataFetcher {
-	return &DataFetcher{
-		adminClient: adminClient,
-		db:          db,
-		poolName:    poolName,
-		s3Bucket:    "flyio-container-images",
-		s3Prefix:    "images/",
+	f := &DataFetcher{
+		db:       db,
+		poolName: poolName,
+		s3Bucket: "flyio-container-images",
+		s3Prefix: "images/",
+	}
+	// Only set when non-nil so a missing client leaves a nil interface
+	if adminClient != nil {
+		f.adminClient = adminClient
 	}
+	return f
 }
 
 // NewDataFetcherWithPath creates a new data fetcher with explicit database path for diagnostics.
 func NewDataFetcherWithPath(adminClient *AdminClient, db *database.DB, dbPath, poolName string, dbError error) *DataFetcher {
-	return &DataFetcher{
-		adminClient: adminClient,
-		db:          db,
-		dbPath:      dbPath,
-		poolName:    poolName,
-		dbError:     dbError,
-		s3Bucket:    "flyio-container-images",
-		s3Prefix:    "images/",
-	}
+	f := &DataFetcher{
+		db:       db,
+		dbPath:   dbPath,
+		poolName: poolName,
+		dbError:  dbError,
+		s3Bucket: "flyio-container-images",
+		s3Prefix: "images/",
+	}
+	if adminClient != nil {
+		f.adminClient = adminClient
+	}
+	return f
 }
 
 // SetS3Client sets the S3 client for fetching images.
 func (f *DataFetcher) SetS3Client(client *s3.Client) {
-	f.s3Client = client
+	if client != nil {
+		f.s3Client = client
+	}
+}
+
+// SetS3Prefix limits the S3 browser to keys under prefix. An empty prefix
+// lists the whole bucket.
+func (f *DataFetcher) SetS3Prefix(prefix string) {
+	f.s3Prefix = prefix
+}
+
+// SetDeviceMapperClient sets the devicemapper client used to report per-device
+// pool allocation in the S3 browser.
+func (f *DataFetcher) SetDeviceMapperClient(client *devicemapper.Client) {
+	f.dmClient = client
 }
 
 // SetImageProcessFunc sets the function to trigger image processing.
@@ -94,9 +134,9 @@ func (f *DataFetcher) FetchDashboardData(ctx context.Context) (*DashboardUpdateM
 
 	var adminErr error
 
-	// Fetch active FSM runs
+	// Fetch live and recently finished FSM runs
 	if f.adminClient != nil {
-		runs, err := f.fetchActiveFSMs(ctx)
+		runs, err := f.fetchRuns(ctx)
 		if err != nil {
 			adminErr = err
 		} else {
@@ -120,18 +160,34 @@ func (f *DataFetcher) FetchDashboardData(ctx context.Context) (*DashboardUpdateM
 	return msg, adminErr
 }
 
-// fetchActiveFSMs retrieves active FSM runs from the admin interface.
-func (f *DataFetcher) fetchActiveFSMs(ctx context.Context) ([]FSMRun, error) {
-	active, err := f.adminClient.ListActive(ctx)
+// fetchRuns retrieves FSM runs from the admin interface. Live runs come
+// first, followed by up to maxFinishedRuns completed or failed runs, most
+// recently finished first.
+func (f *DataFetcher) fetchRuns(ctx context.Context) ([]FSMRun, error) {
+	all, err := f.adminClient.ListRuns(ctx, true)
 	if err != nil {
 		return nil, err
 	}
 
-	runs := make([]FSMRun, 0, len(active))
-	for _, a := range active {
-		runs = append(runs, ActiveFSMToRun(a))
+	var live, finished []FSMRun
+	for _, a := range all {
+		run := ActiveFSMToRun(a)
+		if run.Finished() {
+			finished = append(finished, run)
+		} else {
+			live = append(live, run)
+		}
 	}
-	return runs, nil
+	sort.SliceStable(finished, func(i, j int) bool {
+		return finished[i].UpdatedAt.After(finished[j].UpdatedAt)
+	})
+	if len(finished) > maxFinishedRuns {
+		finished = finished[:maxFinishedRuns]
+	}
+
+	runs := make([]FSMRun, 0, len(live)+len(finished))
+	runs = append(runs, live...)
+	return append(runs, finished...), nil
 }
 
 // fetchSystemStatus retrieves system status from database and devicemapper.
@@ -176,6 +232,7 @@ func (f *DataFetcher) fetchSystemStatus(ctx context.Context) (*SystemStatus, err
 		status.PoolDataTotal = poolStatus.DataTotal
 		status.PoolMetaUsed = poolStatus.MetaUsed
 		status.PoolMetaTotal = poolStatus.MetaTotal
+		status.PoolState = poolStatus.State
 	} else if poolErr != nil {
 		status.PoolError = poolErr.Error()
 	}
@@ -189,6 +246,7 @@ type PoolStatus struct {
 	DataTotal int64
 	MetaUsed  int64
 	MetaTotal int64
+	State     string // Comma-separated problems (read-only, needs_check, ...); empty when healthy
 }
 
 // fetchPoolStatus retrieves devicemapper pool status using dmsetup.
@@ -219,6 +277,13 @@ func (f *DataFetcher) fetchPoolStatus(ctx context.Context) (*PoolStatus, error)
 // parsePoolStatus parses dmsetup status output for a thin-pool.
 // Format: 0 <length> thin-pool <transaction_id> <used_metadata>/<total_metadata> <used_data>/<total_data> ...
 func parsePoolStatus(output string) (*PoolStatus, error) {
+	// State flags come from the devicemapper parser so the dashboard agrees
+	// with the checks that gate device creation.
+	info, infoErr := devicemapper.ParsePoolStatusOutput("", output)
+	if infoErr == nil && info.Failed {
+		return nil, fmt.Errorf("pool reported %s", info.MetadataMode)
+	}
+
 	fields := strings.Fields(output)
 	if len(fields) < 7 {
 		return nil, fmt.Errorf("unexpected dmsetup output format")
@@ -259,12 +324,16 @@ func parsePoolStatus(output string) (*PoolStatus, error) {
 
 	// Convert from sectors (512 bytes) to bytes
 	const sectorSize = 512
-	return &PoolStatus{
+	status := &PoolStatus{
 		DataUsed:  dataUsed * sectorSize,
 		DataTotal: dataTotal * sectorSize,
 		MetaUsed:  metaUsed * sectorSize,
 		MetaTotal: metaTotal * sectorSize,
-	}, nil
+	}
+	if infoErr == nil {
+		status.State = strings.Join(info.Problems(), ", ")
+	}
+	return status, nil
 }
 
 // activityEntry is a helper for sorting activity by time.
@@ -371,11 +440,21 @@ func (f *DataFetcher) FetchS3Images(ctx context.Context) ([]S3Image, error) {
 
 	// Build local status map from database
 	localStatus := make(map[string]ImageStatus)
+	localDevice := make(map[string]string)
+	localError := make(map[string]string)
+	quarantined := make(map[string]bool)
 	if f.db != nil {
 		// Check downloaded images
 		if images, err := f.db.ListImages(ctx, ""); err == nil {
 			for _, img := range images {
 				localStatus[img.S3Key] = ImageStatusDownloaded
+				if img.LastError != "" {
+					localError[img.S3Key] = img.LastError
+				}
+				if img.Quarantined() {
+					quarantined[img.S3Key] = true
+					localError[img.S3Key] = "quarantined: " + img.QuarantineReason
+				}
 			}
 		}
 
@@ -385,6 +464,7 @@ func (f *DataFetcher) FetchS3Images(ctx context.Context) ([]S3Image, error) {
 				// Find the S3 key for this image ID
 				if dbImg, err := f.db.GetImageByID(ctx, img.ImageID); err == nil {
 					localStatus[dbImg.S3Key] = ImageStatusUnpacked
+					localDevice[dbImg.S3Key] = img.DeviceName
 				}
 			}
 		}
@@ -395,11 +475,17 @@ func (f *DataFetcher) FetchS3Images(ctx context.Context) ([]S3Image, error) {
 				// Find the S3 key for this image ID
 				if dbImg, err := f.db.GetImageByID(ctx, snap.ImageID); err == nil {
 					localStatus[dbImg.S3Key] = ImageStatusActive
+					localDevice[dbImg.S3Key] = snap.SnapshotName
 				}
 			}
 		}
 	}
 
+	var allocated map[string]int64
+	if len(localDevice) > 0 {
+		allocated = f.fetchAllocatedBytes(ctx)
+	}
+
 	// Convert to S3Image slice
 	images := make([]S3Image, 0, len(objects))
 	for _, obj := range objects {
@@ -418,6 +504,16 @@ func (f *DataFetcher) FetchS3Images(ctx context.Context) ([]S3Image, error) {
 		if status, ok := localStatus[obj.Key]; ok {
 			img.Status = status
 		}
+		// Quarantine overrides every other status
+		if quarantined[obj.Key] {
+			img.Status = ImageStatusQuarantined
+		}
+		img.LastError = localError[obj.Key]
+
+		if device, ok := localDevice[obj.Key]; ok {
+			img.DeviceName = device
+			img.AllocatedBytes = allocatedBytes(allocated, device)
+		}
 
 		images = append(images, img)
 	}
@@ -425,6 +521,75 @@ func (f *DataFetcher) FetchS3Images(ctx context.Context) ([]S3Image, error) {
 	return images, nil
 }
 
+// FetchSnapshots returns the active snapshots with their origin image and the
+// pool space each snapshot device has allocated.
+func (f *DataFetcher) FetchSnapshots(ctx context.Context) ([]SnapshotDetail, error) {
+	if f.db == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	snapshots, err := f.db.ListActiveSnapshots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list active snapshots: %w", err)
+	}
+
+	var allocated map[string]int64
+	if len(snapshots) > 0 {
+		allocated = f.fetchAllocatedBytes(ctx)
+	}
+
+	details := make([]SnapshotDetail, 0, len(snapshots))
+	for _, snap := range snapshots {
+		detail := SnapshotDetail{
+			SnapshotID:     snap.SnapshotID,
+			SnapshotName:   snap.SnapshotName,
+			ImageID:        snap.ImageID,
+			DevicePath:     snap.DevicePath,
+			OriginDeviceID: snap.OriginDeviceID,
+			CreatedAt:      snap.CreatedAt,
+			AllocatedBytes: allocatedBytes(allocated, snap.SnapshotName),
+		}
+		if img, err := f.db.GetImageByID(ctx, snap.ImageID); err == nil && img != nil {
+			detail.S3Key = img.S3Key
+		}
+		details = append(details, detail)
+	}
+
+	return details, nil
+}
+
+// fetchAllocatedBytes returns the pool space mapped by each active thin
+// device, keyed by device name, using one dmsetup call per refresh. It
+// returns nil if no devicemapper client is configured or the status cannot
+// be read.
+func (f *DataFetcher) fetchAllocatedBytes(ctx context.Context) map[string]int64 {
+	if f.dmClient == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	statuses, err := f.dmClient.ListThinDeviceStatus(ctx)
+	if err != nil {
+		return nil
+	}
+	allocated := make(map[string]int64, len(statuses))
+	for name, status := range statuses {
+		allocated[name] = status.MappedBytes()
+	}
+	return allocated
+}
+
+// allocatedBytes looks up a device in the map from fetchAllocatedBytes,
+// returning -1 if the device is unnamed or not active.
+func allocatedBytes(allocated map[string]int64, deviceName string) int64 {
+	if bytes, ok := allocated[deviceName]; ok && deviceName != "" {
+		return bytes
+	}
+	return -1
+}
+
 // TriggerImageProcess triggers the image processing pipeline for an S3 key.
 func (f *DataFetcher) TriggerImageProcess(ctx context.Context, s3Key string) error {
 	if f.imageProcessFunc == nil {
@@ -0,0 +1,221 @@
+package tui
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	fsmv1 "github.com/superfly/fsm/gen/fsm/v1"
+	"github.com/superfly/fsm/s3"
+)
+
+// fakeRunLister returns fixed runs, dropping finished ones unless asked for
+// them like the admin server does.
+type fakeRunLister struct {
+	runs []*fsmv1.ActiveFSM
+	err  error
+}
+
+func (f *fakeRunLister) ListRuns(ctx context.Context, includeCompleted bool) ([]*fsmv1.ActiveFSM, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var runs []*fsmv1.ActiveFSM
+	for _, r := range f.runs {
+		if r.GetRunState() != fsmv1.RunState_RUN_STATE_COMPLETE || includeCompleted {
+			runs = append(runs, r)
+		}
+	}
+	return runs, nil
+}
+
+// versionAt returns a ULID string for a run or transition made at t.
+func versionAt(t time.Time) string {
+	return ulid.MustNew(ulid.Timestamp(t), nil).String()
+}
+
+func fakeRuns(now time.Time) []*fsmv1.ActiveFSM {
+	return []*fsmv1.ActiveFSM{
+		{
+			Id: "img_done", Action: "unpack", RunState: fsmv1.RunState_RUN_STATE_COMPLETE, CurrentState: "complete",
+			Version: versionAt(now.Add(-10 * time.Minute)), TransitionVersion: versionAt(now.Add(-8 * time.Minute)),
+		},
+		{
+			Id: "img_running", Action: "download", RunState: fsmv1.RunState_RUN_STATE_RUNNING, CurrentState: "download",
+			Version: versionAt(now.Add(-time.Minute)),
+		},
+		{
+			Id: "img_broken", Action: "activate", RunState: fsmv1.RunState_RUN_STATE_COMPLETE, CurrentState: "create-snapshot",
+			Version: versionAt(now.Add(-5 * time.Minute)), TransitionVersion: versionAt(now.Add(-4 * time.Minute)),
+			Error: "dmsetup create failed: device busy",
+		},
+		{
+			Id: "img_queued", Action: "unpack", RunState: fsmv1.RunState_RUN_STATE_PENDING,
+			Version: versionAt(now),
+		},
+	}
+}
+
+func TestFetchDashboardData_Runs(t *testing.T) {
+	now := time.Now()
+	f := NewDataFetcher(nil, nil, "pool")
+	f.adminClient = &fakeRunLister{runs: fakeRuns(now)}
+
+	msg, err := f.FetchDashboardData(context.Background())
+	if err != nil {
+		t.Fatalf("FetchDashboardData() error = %v", err)
+	}
+
+	var got []string
+	for _, r := range msg.ActiveRuns {
+		got = append(got, r.ID+"="+r.State)
+	}
+	// Live runs in server order, then finished runs newest first
+	want := "img_running=running,img_queued=pending,img_broken=failed,img_done=completed"
+	if strings.Join(got, ",") != want {
+		t.Errorf("runs = %s, want %s", strings.Join(got, ","), want)
+	}
+
+	broken := msg.ActiveRuns[2]
+	if broken.Error != "dmsetup create failed: device busy" || broken.CurrentStep != "create-snapshot" {
+		t.Errorf("failed run = %+v, want its error and last step", broken)
+	}
+	if d := broken.StartedAt.Sub(now.Add(-5 * time.Minute)); d < -time.Second || d > time.Second {
+		t.Errorf("StartedAt = %v, want the run version's time", broken.StartedAt)
+	}
+	if d := broken.UpdatedAt.Sub(now.Add(-4 * time.Minute)); d < -time.Second || d > time.Second {
+		t.Errorf("UpdatedAt = %v, want the transition version's time", broken.UpdatedAt)
+	}
+	if running := msg.ActiveRuns[0]; !running.UpdatedAt.Equal(running.StartedAt) {
+		t.Errorf("run without a transition: UpdatedAt = %v, want StartedAt %v", running.UpdatedAt, running.StartedAt)
+	}
+}
+
+func TestFetchDashboardData_CapsFinishedRuns(t *testing.T) {
+	now := time.Now()
+	lister := &fakeRunLister{}
+	for i := 0; i < maxFinishedRuns+5; i++ {
+		lister.runs = append(lister.runs, &fsmv1.ActiveFSM{
+			Id:       "img_old",
+			RunState: fsmv1.RunState_RUN_STATE_COMPLETE,
+			Version:  versionAt(now.Add(-time.Duration(i) * time.Minute)),
+		})
+	}
+	f := NewDataFetcher(nil, nil, "pool")
+	f.adminClient = lister
+
+	msg, err := f.FetchDashboardData(context.Background())
+	if err != nil {
+		t.Fatalf("FetchDashboardData() error = %v", err)
+	}
+	if len(msg.ActiveRuns) != maxFinishedRuns {
+		t.Errorf("got %d runs, want the %d most recent", len(msg.ActiveRuns), maxFinishedRuns)
+	}
+}
+
+func TestFetchDashboardData_AdminError(t *testing.T) {
+	f := NewDataFetcher(nil, nil, "pool")
+	f.adminClient = &fakeRunLister{err: errors.New("connection refused")}
+
+	msg, err := f.FetchDashboardData(context.Background())
+	if err == nil {
+		t.Fatal("expected the admin error to be returned for the connection indicator")
+	}
+	if msg == nil || len(msg.ActiveRuns) != 0 {
+		t.Errorf("msg = %+v, want partial data with no runs", msg)
+	}
+}
+
+func TestDashboard_ShowCompletedToggle(t *testing.T) {
+	now := time.Now()
+	f := NewDataFetcher(nil, nil, "pool")
+	f.adminClient = &fakeRunLister{runs: fakeRuns(now)}
+	msg, err := f.FetchDashboardData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewDashboardModel()
+	m.UpdateRuns(msg.ActiveRuns)
+
+	panel := m.renderRunsPanel(80)
+	for _, want := range []string{"img_running", "img_queued", "img_broken", "dmsetup create failed"} {
+		if !strings.Contains(panel, want) {
+			t.Errorf("runs panel missing %q:\n%s", want, panel)
+		}
+	}
+	if strings.Contains(panel, "img_done") {
+		t.Errorf("completed run shown before toggling:\n%s", panel)
+	}
+
+	m.Update(keyRune('a'))
+	if panel := m.renderRunsPanel(80); !strings.Contains(panel, "img_done") {
+		t.Errorf("completed run hidden after toggling:\n%s", panel)
+	}
+
+	m.Update(keyRune('a'))
+	if panel := m.renderRunsPanel(80); strings.Contains(panel, "img_done") {
+		t.Errorf("completed run shown after toggling back:\n%s", panel)
+	}
+}
+
+// fakeS3Lister returns fixed objects and records where it was asked to list.
+type fakeS3Lister struct {
+	objects []s3.S3Object
+
+	bucket string
+	prefix string
+}
+
+func (f *fakeS3Lister) ListImagesDetailed(ctx context.Context, bucket, prefix string) ([]s3.S3Object, error) {
+	f.bucket, f.prefix = bucket, prefix
+	return f.objects, nil
+}
+
+func TestFetchS3Images_PassesPrefix(t *testing.T) {
+	lister := &fakeS3Lister{objects: []s3.S3Object{
+		{Key: "images/team-a/"},
+		{Key: "images/team-a/alpine.tar", Size: 10},
+	}}
+	f := NewDataFetcher(nil, nil, "pool")
+	f.s3Client = lister
+	f.SetS3Prefix("images/team-a/")
+
+	images, err := f.FetchS3Images(context.Background())
+	if err != nil {
+		t.Fatalf("FetchS3Images() error = %v", err)
+	}
+	if lister.bucket != "flyio-container-images" || lister.prefix != "images/team-a/" {
+		t.Errorf("listed %s/%s, want flyio-container-images/images/team-a/", lister.bucket, lister.prefix)
+	}
+	if len(images) != 1 || images[0].Key != "images/team-a/alpine.tar" || images[0].Status != ImageStatusAvailable {
+		t.Errorf("images = %+v, want only images/team-a/alpine.tar available", images)
+	}
+}
+
+func TestFetchS3Images_NoClient(t *testing.T) {
+	f := NewDataFetcher(nil, nil, "pool")
+	f.SetS3Client(nil)
+	if _, err := f.FetchS3Images(context.Background()); err == nil {
+		t.Error("FetchS3Images() without a client succeeded, want error")
+	}
+}
+
+func TestAllocatedBytes(t *testing.T) {
+	allocated := map[string]int64{"snap-1": 4096, "img-2": 0}
+	if got := allocatedBytes(allocated, "snap-1"); got != 4096 {
+		t.Errorf("allocatedBytes(snap-1) = %d, want 4096", got)
+	}
+	if got := allocatedBytes(allocated, "img-2"); got != 0 {
+		t.Errorf("allocatedBytes(img-2) = %d, want 0", got)
+	}
+	if got := allocatedBytes(allocated, "inactive"); got != -1 {
+		t.Errorf("allocatedBytes(inactive) = %d, want -1", got)
+	}
+	if got := allocatedBytes(nil, "snap-1"); got != -1 {
+		t.Errorf("allocatedBytes without a dm client = %d, want -1", got)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/charmbracelet/bubbles/spinner"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/superfly/fsm/humanize"
 )
 
 // OperationPhase represents a phase of the image processing pipeline
@@ -23,12 +24,13 @@ const (
 // ProgressUpdate represents a progress update message
 type ProgressUpdate struct {
 	Phase       OperationPhase
-	Percent     float64 // 0.0 to 1.0
-	Current     int64   // Current progress (bytes for download, files for unpack)
-	Total       int64   // Total (bytes for download, files for unpack)
-	Status      string  // Status message
-	Speed       string  // Speed indicator (e.g., "2.5MB/s")
-	Error       error   // Error if any
+	Percent     float64    // 0.0 to 1.0
+	Current     int64      // Current progress (bytes for download, files for unpack)
+	Total       int64      // Total (bytes for download, files for unpack)
+	Status      string     // Status message
+	Step        UnpackStep // Unpack step after extraction, if any
+	Speed       string     // Speed indicator (e.g., "2.5MB/s")
+	Error       error      // Error if any
 	StartedAt   time.Time
 	CompletedAt time.Time
 }
@@ -91,6 +93,7 @@ type PhaseState struct {
 	Current     int64
 	Total       int64
 	Speed       string
+	Step        UnpackStep
 	Started     bool
 	Completed   bool
 	Error       error
@@ -185,6 +188,7 @@ func (m *ProgressModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		phase.Current = msg.Current
 		phase.Total = msg.Total
 		phase.Speed = msg.Speed
+		phase.Step = msg.Step
 		if msg.Status != "" {
 			phase.Status = msg.Status
 		}
@@ -269,7 +273,7 @@ func (m *ProgressModel) View() string {
 	elapsed := time.Since(m.startTime)
 	b.WriteString(fmt.Sprintf("\n  %s %s\n",
 		m.styles.Muted.Render("Elapsed:"),
-		FormatDuration(elapsed)))
+		humanize.Duration(elapsed)))
 
 	// Final result if complete
 	if m.done && m.result != nil {
@@ -282,7 +286,7 @@ func (m *ProgressModel) View() string {
 			b.WriteString(fmt.Sprintf("    Snapshot ID:   %s\n", m.result.SnapshotID))
 			b.WriteString(fmt.Sprintf("    Snapshot Name: %s\n", m.result.SnapshotName))
 			b.WriteString(fmt.Sprintf("    Device Path:   %s\n", m.result.DevicePath))
-			b.WriteString(fmt.Sprintf("    Total Time:    %s\n", FormatDuration(m.result.TotalTime)))
+			b.WriteString(fmt.Sprintf("    Total Time:    %s\n", humanize.Duration(m.result.TotalTime)))
 		}
 	}
 
@@ -334,13 +338,15 @@ func (m *ProgressModel) renderPhase(phase OperationPhase, name string, spin spin
 		switch phase {
 		case PhaseDownload:
 			if state.Total > 0 {
-				details = fmt.Sprintf(" %s/%s", FormatBytes(state.Current), FormatBytes(state.Total))
+				details = fmt.Sprintf(" %s/%s", humanize.Bytes(state.Current), humanize.Bytes(state.Total))
 				if state.Speed != "" {
 					details += fmt.Sprintf(" %s", state.Speed)
 				}
 			}
 		case PhaseUnpack:
-			if state.Total > 0 {
+			if state.Step != "" {
+				details = fmt.Sprintf(" %s", state.Status)
+			} else if state.Total > 0 {
 				details = fmt.Sprintf(" %d/%d files", state.Current, state.Total)
 			} else if state.Current > 0 {
 				details = fmt.Sprintf(" %d files", state.Current)
@@ -354,7 +360,7 @@ func (m *ProgressModel) renderPhase(phase OperationPhase, name string, spin spin
 	} else if state.Completed {
 		// Show completion time
 		duration := state.CompletedAt.Sub(state.StartedAt)
-		b.WriteString(m.styles.Muted.Render(fmt.Sprintf("(%s)", FormatDuration(duration))))
+		b.WriteString(m.styles.Muted.Render(fmt.Sprintf("(%s)", humanize.Duration(duration))))
 	}
 
 	b.WriteString("\n")
@@ -456,6 +462,15 @@ func CreateTeaCallback(p *tea.Program) ProgressCallback {
 				Total:   event.Total,
 				Status:  event.Message,
 			})
+		case EventVerifyLayoutProgress, EventStoreProgress:
+			p.Send(ProgressUpdate{
+				Phase:   PhaseUnpack,
+				Percent: event.Percent,
+				Current: event.Current,
+				Total:   event.Total,
+				Status:  event.Message,
+				Step:    event.Step,
+			})
 		case EventUnpackComplete:
 			p.Send(PhaseCompleteMsg{
 				Phase:   PhaseUnpack,
@@ -16,17 +16,27 @@ type S3Image struct {
 	Key          string
 	Size         int64
 	LastModified time.Time
-	Status       ImageStatus // Local status (available, downloaded, unpacked, active)
+	Status       ImageStatus // Local status (available, downloaded, unpacked, active, quarantined)
+
+	// DeviceName is the local device backing the image: the active snapshot if
+	// there is one, otherwise the unpacked base device. Empty if not unpacked.
+	DeviceName string
+	// AllocatedBytes is the pool space currently mapped by DeviceName,
+	// or -1 if it could not be determined.
+	AllocatedBytes int64
+	// LastError is why the image's last FSM run aborted, if it did.
+	LastError string
 }
 
 // ImageStatus represents the local status of an S3 image.
 type ImageStatus int
 
 const (
-	ImageStatusAvailable  ImageStatus = iota // Available in S3, not downloaded
-	ImageStatusDownloaded                    // Downloaded locally
-	ImageStatusUnpacked                      // Unpacked to devicemapper
-	ImageStatusActive                        // Has active snapshot
+	ImageStatusAvailable   ImageStatus = iota // Available in S3, not downloaded
+	ImageStatusDownloaded                     // Downloaded locally
+	ImageStatusUnpacked                       // Unpacked to devicemapper
+	ImageStatusActive                         // Has active snapshot
+	ImageStatusQuarantined                    // Failed security validation; not processed again unless allowed
 )
 
 // String returns the string representation of ImageStatus.
@@ -38,6 +48,8 @@ func (s ImageStatus) String() string {
 		return "unpacked"
 	case ImageStatusActive:
 		return "active"
+	case ImageStatusQuarantined:
+		return "quarantined"
 	default:
 		return "available"
 	}
@@ -52,28 +64,42 @@ func (s ImageStatus) StatusIcon() string {
 		return "◉" // Filled circle for unpacked
 	case ImageStatusDownloaded:
 		return "○" // Empty circle for downloaded
+	case ImageStatusQuarantined:
+		return "⊘" // Circled slash for quarantined
 	default:
 		return "◌" // Dotted circle for available
 	}
 }
 
 // S3BrowserState holds the state for the S3 browser component.
+//
+// Images is the list shown and navigated: the subset of All matching Filter.
+// SelectedIdx and ScrollOffset always index into Images.
+//
+// selected is the set of keys checked for batch processing. It is separate
+// from the cursor (SelectedIdx) and survives filtering and refreshes.
 type S3BrowserState struct {
+	All          []S3Image
 	Images       []S3Image
+	Filter       string
 	SelectedIdx  int
 	Loading      bool
 	Error        error
 	LastRefresh  time.Time
 	ScrollOffset int
 	VisibleRows  int
+
+	selected map[string]bool
 }
 
 // NewS3BrowserState creates a new S3 browser state.
 func NewS3BrowserState() *S3BrowserState {
 	return &S3BrowserState{
+		All:         []S3Image{},
 		Images:      []S3Image{},
 		SelectedIdx: 0,
 		VisibleRows: 10,
+		selected:    map[string]bool{},
 	}
 }
 
@@ -107,6 +133,112 @@ func (s *S3BrowserState) MoveDown() {
 	}
 }
 
+// ToggleSelected checks or unchecks the image under the cursor.
+func (s *S3BrowserState) ToggleSelected() {
+	img := s.SelectedImage()
+	if img == nil {
+		return
+	}
+	if s.selected[img.Key] {
+		delete(s.selected, img.Key)
+	} else {
+		s.selected[img.Key] = true
+	}
+}
+
+// IsSelected reports whether key is checked.
+func (s *S3BrowserState) IsSelected(key string) bool {
+	return s.selected[key]
+}
+
+// SelectedKeys returns the checked keys in list order, including checked images
+// hidden by the filter. Keys no longer listed in S3 are left out.
+func (s *S3BrowserState) SelectedKeys() []string {
+	var keys []string
+	for _, img := range s.All {
+		if s.selected[img.Key] {
+			keys = append(keys, img.Key)
+		}
+	}
+	return keys
+}
+
+// Image returns the listed image with key, including one hidden by the
+// filter, or nil if there is none.
+func (s *S3BrowserState) Image(key string) *S3Image {
+	for i := range s.All {
+		if s.All[i].Key == key {
+			return &s.All[i]
+		}
+	}
+	return nil
+}
+
+// ClearSelected unchecks every image.
+func (s *S3BrowserState) ClearSelected() {
+	clear(s.selected)
+}
+
+// SetImages replaces the image list, keeping the current filter and, if it is
+// still listed, the selected image.
+func (s *S3BrowserState) SetImages(images []S3Image) {
+	s.All = images
+	s.applyFilter()
+}
+
+// FilterImages shows only images whose key, runtime or version contains query
+// (case-insensitive). An empty query shows every image.
+func (s *S3BrowserState) FilterImages(query string) {
+	s.Filter = query
+	s.applyFilter()
+}
+
+// applyFilter rebuilds Images from All and keeps the selection on the same
+// image when it survives the filter, otherwise on the first match.
+func (s *S3BrowserState) applyFilter() {
+	var selectedKey string
+	if img := s.SelectedImage(); img != nil {
+		selectedKey = img.Key
+	}
+
+	query := strings.ToLower(strings.TrimSpace(s.Filter))
+	s.Images = make([]S3Image, 0, len(s.All))
+	s.SelectedIdx = 0
+	for _, img := range s.All {
+		if !matchesFilter(img, query) {
+			continue
+		}
+		if img.Key == selectedKey {
+			s.SelectedIdx = len(s.Images)
+		}
+		s.Images = append(s.Images, img)
+	}
+
+	// Keep the selection inside the visible window.
+	if s.ScrollOffset > s.SelectedIdx {
+		s.ScrollOffset = s.SelectedIdx
+	}
+	if s.VisibleRows > 0 && s.SelectedIdx >= s.ScrollOffset+s.VisibleRows {
+		s.ScrollOffset = s.SelectedIdx - s.VisibleRows + 1
+	}
+	if maxOffset := len(s.Images) - s.VisibleRows; s.ScrollOffset > maxOffset {
+		s.ScrollOffset = max(maxOffset, 0)
+	}
+}
+
+// matchesFilter reports whether img matches a lower-cased filter query.
+func matchesFilter(img S3Image, query string) bool {
+	if query == "" {
+		return true
+	}
+	for _, field := range []string{img.Key, ImageRuntime(img.Key), ImageVersion(img.Key)} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
 // FetchS3Images fetches images from S3 and enriches with local status.
 func FetchS3Images(ctx context.Context, s3Client *s3.Client, bucket, prefix string, localImages map[string]ImageStatus) ([]S3Image, error) {
 	objects, err := s3Client.ListImagesDetailed(ctx, bucket, prefix)
@@ -180,4 +312,3 @@ func ImageVersion(key string) string {
 	base := filepath.Base(key)
 	return strings.TrimSuffix(base, ".tar")
 }
-
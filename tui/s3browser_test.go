@@ -0,0 +1,150 @@
+package tui
+
+import (
+	"strings"
+	"testing"
+)
+
+func testS3Images() []S3Image {
+	return []S3Image{
+		{Key: "images/golang/1.tar"},
+		{Key: "images/golang/2.tar"},
+		{Key: "images/python/1.tar"},
+		{Key: "images/python/12.tar"},
+		{Key: "images/node/3.tar"},
+	}
+}
+
+func imageKeys(images []S3Image) string {
+	keys := make([]string, len(images))
+	for i, img := range images {
+		keys[i] = img.Key
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestFilterImages_Matching(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "images/golang/1.tar,images/golang/2.tar,images/python/1.tar,images/python/12.tar,images/node/3.tar"},
+		{"python", "images/python/1.tar,images/python/12.tar"},
+		{"PyThOn", "images/python/1.tar,images/python/12.tar"},
+		{"12", "images/python/12.tar"},
+		{"golang/2", "images/golang/2.tar"},
+		{"  node ", "images/node/3.tar"},
+		{"rust", ""},
+	}
+
+	for _, tt := range tests {
+		s := NewS3BrowserState()
+		s.SetImages(testS3Images())
+		s.FilterImages(tt.query)
+		if got := imageKeys(s.Images); got != tt.want {
+			t.Errorf("FilterImages(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+		if len(s.All) != 5 {
+			t.Errorf("FilterImages(%q) changed All to %d images", tt.query, len(s.All))
+		}
+	}
+}
+
+func TestFilterImages_KeepsSelection(t *testing.T) {
+	s := NewS3BrowserState()
+	s.SetImages(testS3Images())
+	s.MoveDown()
+	s.MoveDown()
+	s.MoveDown() // images/python/12.tar
+
+	s.FilterImages("python")
+	if img := s.SelectedImage(); img == nil || img.Key != "images/python/12.tar" {
+		t.Fatalf("selected = %+v, want images/python/12.tar", img)
+	}
+
+	// The selected image no longer matches: fall back to the first match.
+	s.FilterImages("golang")
+	if s.SelectedIdx != 0 || s.SelectedImage().Key != "images/golang/1.tar" {
+		t.Fatalf("selected = %d (%+v), want first golang image", s.SelectedIdx, s.SelectedImage())
+	}
+
+	s.FilterImages("rust")
+	if s.SelectedImage() != nil || s.SelectedIdx != 0 || s.ScrollOffset != 0 {
+		t.Fatalf("empty result: selected=%d scroll=%d", s.SelectedIdx, s.ScrollOffset)
+	}
+}
+
+func TestFilterImages_ClampsScrollOffset(t *testing.T) {
+	s := NewS3BrowserState()
+	s.VisibleRows = 2
+	s.SetImages(testS3Images())
+	for range 4 {
+		s.MoveDown()
+	}
+	if s.ScrollOffset != 3 {
+		t.Fatalf("ScrollOffset = %d, want 3 before filtering", s.ScrollOffset)
+	}
+
+	s.FilterImages("python")
+	if s.ScrollOffset != 0 || s.SelectedIdx != 0 {
+		t.Fatalf("after filter: selected=%d scroll=%d, want 0/0", s.SelectedIdx, s.ScrollOffset)
+	}
+}
+
+func TestSetImages_ReappliesFilter(t *testing.T) {
+	s := NewS3BrowserState()
+	s.FilterImages("golang")
+	s.SetImages(testS3Images())
+
+	if got := imageKeys(s.Images); got != "images/golang/1.tar,images/golang/2.tar" {
+		t.Fatalf("Images = %s, want only golang after refresh", got)
+	}
+}
+
+func TestSelection_ToggleAndKeys(t *testing.T) {
+	s := NewS3BrowserState()
+	s.SetImages(testS3Images())
+
+	s.ToggleSelected() // golang/1
+	s.MoveDown()
+	s.MoveDown()
+	s.MoveDown()
+	s.ToggleSelected() // python/12
+	s.MoveUp()
+	s.ToggleSelected() // python/1
+
+	// Keys come back in list order, not the order they were checked.
+	if got := strings.Join(s.SelectedKeys(), ","); got != "images/golang/1.tar,images/python/1.tar,images/python/12.tar" {
+		t.Fatalf("SelectedKeys() = %s", got)
+	}
+
+	s.ToggleSelected() // uncheck python/1
+	if s.IsSelected("images/python/1.tar") {
+		t.Error("second toggle should uncheck the image")
+	}
+
+	// Checked images hidden by the filter are still selected.
+	s.FilterImages("python")
+	if got := strings.Join(s.SelectedKeys(), ","); got != "images/golang/1.tar,images/python/12.tar" {
+		t.Errorf("SelectedKeys() with filter = %s", got)
+	}
+
+	// Images that disappear from S3 drop out of the selection.
+	s.SetImages(testS3Images()[1:])
+	if got := strings.Join(s.SelectedKeys(), ","); got != "images/python/12.tar" {
+		t.Errorf("SelectedKeys() after refresh = %s", got)
+	}
+
+	s.ClearSelected()
+	if keys := s.SelectedKeys(); len(keys) != 0 {
+		t.Errorf("SelectedKeys() after clear = %v", keys)
+	}
+}
+
+func TestSelection_EmptyList(t *testing.T) {
+	s := NewS3BrowserState()
+	s.ToggleSelected()
+	if keys := s.SelectedKeys(); len(keys) != 0 {
+		t.Errorf("toggling with no images selected %v", keys)
+	}
+}
@@ -0,0 +1,103 @@
+package tui
+
+import (
+	"context"
+	"time"
+)
+
+// SnapshotDetail describes an active snapshot for the snapshot view.
+type SnapshotDetail struct {
+	SnapshotID     string
+	SnapshotName   string
+	ImageID        string
+	S3Key          string // Origin image's S3 key, empty if the image row is missing
+	DevicePath     string
+	OriginDeviceID string
+	CreatedAt      time.Time
+
+	// AllocatedBytes is the pool space mapped by the snapshot's device (its
+	// CoW data), or -1 if it could not be determined.
+	AllocatedBytes int64
+}
+
+// SnapshotsMsg is sent when active snapshots have been fetched.
+type SnapshotsMsg struct {
+	Snapshots []SnapshotDetail
+	Error     error
+}
+
+// snapshotFetcher fetches the active snapshots shown in the snapshot view.
+// It is satisfied by *DataFetcher.
+type snapshotFetcher interface {
+	FetchSnapshots(ctx context.Context) ([]SnapshotDetail, error)
+}
+
+// SnapshotListState holds the state for the snapshot view.
+type SnapshotListState struct {
+	Snapshots    []SnapshotDetail
+	SelectedIdx  int
+	ScrollOffset int
+	VisibleRows  int
+	Loading      bool
+}
+
+// NewSnapshotListState creates a new snapshot list state.
+func NewSnapshotListState() *SnapshotListState {
+	return &SnapshotListState{
+		Snapshots:   []SnapshotDetail{},
+		VisibleRows: 10,
+	}
+}
+
+// SelectedSnapshot returns the currently selected snapshot, or nil if none.
+func (s *SnapshotListState) SelectedSnapshot() *SnapshotDetail {
+	if len(s.Snapshots) == 0 || s.SelectedIdx < 0 || s.SelectedIdx >= len(s.Snapshots) {
+		return nil
+	}
+	return &s.Snapshots[s.SelectedIdx]
+}
+
+// MoveUp moves selection up.
+func (s *SnapshotListState) MoveUp() {
+	if s.SelectedIdx > 0 {
+		s.SelectedIdx--
+		if s.SelectedIdx < s.ScrollOffset {
+			s.ScrollOffset = s.SelectedIdx
+		}
+	}
+}
+
+// MoveDown moves selection down.
+func (s *SnapshotListState) MoveDown() {
+	if s.SelectedIdx < len(s.Snapshots)-1 {
+		s.SelectedIdx++
+		if s.SelectedIdx >= s.ScrollOffset+s.VisibleRows {
+			s.ScrollOffset = s.SelectedIdx - s.VisibleRows + 1
+		}
+	}
+}
+
+// SetSnapshots replaces the list, keeping the selection on the same snapshot
+// if it is still active.
+func (s *SnapshotListState) SetSnapshots(snapshots []SnapshotDetail) {
+	var selectedID string
+	if snap := s.SelectedSnapshot(); snap != nil {
+		selectedID = snap.SnapshotID
+	}
+
+	s.Snapshots = snapshots
+	s.SelectedIdx = 0
+	for i, snap := range snapshots {
+		if snap.SnapshotID == selectedID {
+			s.SelectedIdx = i
+			break
+		}
+	}
+
+	if s.ScrollOffset > s.SelectedIdx {
+		s.ScrollOffset = s.SelectedIdx
+	}
+	if s.SelectedIdx >= s.ScrollOffset+s.VisibleRows {
+		s.ScrollOffset = s.SelectedIdx - s.VisibleRows + 1
+	}
+}
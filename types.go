@@ -24,6 +24,11 @@ type ImageDownloadRequest struct {
 
 	// Region is the S3 region (optional, defaults to configured region)
 	Region string `json:"region,omitempty"`
+
+	// PresignedURL is a presigned GET URL for the object (optional). When set
+	// the image is downloaded from it instead of Bucket/S3Key; S3Key is still
+	// the image's identity.
+	PresignedURL string `json:"presigned_url,omitempty"`
 }
 
 // ImageDownloadResponse represents the response from the Download FSM.
@@ -35,8 +40,14 @@ type ImageDownloadResponse struct {
 	// LocalPath is the local filesystem path where the image is stored
 	LocalPath string `json:"local_path"`
 
-	// Checksum is the SHA256 hash of the downloaded file
-	Checksum string `json:"checksum"`
+	// Checksum is the hex digest of the downloaded file, taken with
+	// ChecksumAlgo ("sha256", "sha512" or "blake3"; empty means sha256)
+	Checksum     string `json:"checksum"`
+	ChecksumAlgo string `json:"checksum_algo,omitempty"`
+
+	// ExpectedChecksum is the authoritative SHA256 published by S3 for the
+	// object, if any. validateBlob compares the downloaded file against it.
+	ExpectedChecksum string `json:"expected_checksum,omitempty"`
 
 	// SizeBytes is the size of the downloaded file in bytes
 	SizeBytes int64 `json:"size_bytes"`
@@ -67,8 +78,19 @@ type ImageUnpackRequest struct {
 	// PoolName is the devicemapper pool name (optional, defaults to configured pool)
 	PoolName string `json:"pool_name,omitempty"`
 
-	// DeviceSize is the size of the device to create in bytes (optional, defaults to 10GB)
+	// DeviceSize is the size of the device to create in bytes (optional; when unset
+	// the size is estimated from the tarball, else the configured default is used)
 	DeviceSize int64 `json:"device_size,omitempty"`
+
+	// StripComponents strips this many leading path components from archive
+	// entries (optional; overrides the configured default when set, including to 0)
+	StripComponents *int `json:"strip_components,omitempty"`
+
+	// S3Key and Bucket name the image's object (optional). An Unpack FSM set
+	// up to stream (unpack.Dependencies.Stream) extracts it while downloading
+	// it to LocalPath, if nothing has been downloaded there yet.
+	S3Key  string `json:"s3_key,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
 }
 
 // ImageUnpackResponse represents the response from the Unpack FSM.
@@ -92,6 +114,14 @@ type ImageUnpackResponse struct {
 	// FileCount is the number of files extracted
 	FileCount int `json:"file_count"`
 
+	// DeviceSizeBytes is the size of the thin device: the size it was created
+	// with, or the size it was grown to during extraction
+	DeviceSizeBytes int64 `json:"device_size_bytes,omitempty"`
+
+	// Layout is where on the device the root filesystem is: "direct-root"
+	// or "rootfs-subdir" (under rootfs/). Set once the layout is verified.
+	Layout string `json:"layout,omitempty"`
+
 	// Unpacked indicates if the image was unpacked (true) or already existed (false)
 	Unpacked bool `json:"unpacked"`
 
@@ -116,6 +146,10 @@ type ImageActivateRequest struct {
 
 	// PoolName is the devicemapper pool name (optional, defaults to configured pool)
 	PoolName string `json:"pool_name,omitempty"`
+
+	// Layout is the origin's root filesystem layout, as recorded by unpack.
+	// It is passed through to the response for the snapshot's consumers.
+	Layout string `json:"layout,omitempty"`
 }
 
 // ImageActivateResponse represents the response from the Activate FSM.
@@ -141,6 +175,10 @@ type ImageActivateResponse struct {
 
 	// ActivatedAt is the timestamp when activation completed
 	ActivatedAt time.Time `json:"activated_at,omitempty"`
+
+	// Layout is where on the snapshot the root filesystem is: "direct-root"
+	// or "rootfs-subdir" (under rootfs/). Empty if it was not recorded.
+	Layout string `json:"layout,omitempty"`
 }
 
 // Codec implementation for JSON serialization
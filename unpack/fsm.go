@@ -3,20 +3,26 @@ package unpack
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/oklog/ulid/v2"
 	"github.com/sirupsen/logrus"
 	fsm "github.com/superfly/fsm"
 
+	"github.com/superfly/fsm/checksum"
 	"github.com/superfly/fsm/database"
 	"github.com/superfly/fsm/devicemapper"
 	"github.com/superfly/fsm/extraction"
+	"github.com/superfly/fsm/s3"
 )
 
 const (
@@ -38,10 +44,15 @@ type DatabaseManager interface {
 	CheckImageUnpacked(ctx context.Context, imageID string) (*database.UnpackedImage, error)
 	GetUnpackedImageByID(ctx context.Context, imageID string) (*database.UnpackedImage, error)
 	DeleteUnpackedImage(ctx context.Context, imageID string) error
-	StoreUnpackedImage(ctx context.Context, imageID, deviceID, deviceName, devicePath string, sizeBytes int64, fileCount int) error
+	StoreUnpackedImage(ctx context.Context, imageID, deviceID, deviceName, devicePath string, sizeBytes, deviceSizeBytes int64, fileCount int, layout string) error
 	AcquireImageLock(ctx context.Context, imageID, lockedBy string) error
 	ReleaseImageLock(ctx context.Context, imageID string) error
 	IsImageLocked(ctx context.Context, imageID string) (bool, error)
+	RecordImageError(ctx context.Context, imageID, reason string) error
+	ClearImageError(ctx context.Context, imageID string) error
+	QuarantineImage(ctx context.Context, imageID, reason string) error
+	AllocateDeviceID(ctx context.Context, owner string, preferred uint32) (string, error)
+	StoreImageMetadata(ctx context.Context, imageID, s3Key, localPath string, sum checksum.Checksum, sizeBytes int64) error
 }
 
 // DeviceManager defines the interface for devicemapper operations used by the FSM.
@@ -49,7 +60,11 @@ type DatabaseManager interface {
 type DeviceManager interface {
 	DeviceExists(ctx context.Context, deviceName string) (bool, error)
 	CreateThinDevice(ctx context.Context, poolName, deviceID string, sizeBytes int64) (*devicemapper.DeviceInfo, error)
-	MountDevice(ctx context.Context, devicePath, mountPoint string) error
+	CreateThinDeviceWithOpts(ctx context.Context, poolName, deviceID string, sizeBytes int64, opts devicemapper.CreateThinDeviceOpts) (*devicemapper.DeviceInfo, error)
+	ResizeThinDevice(ctx context.Context, poolName, deviceName, deviceID string, newSizeBytes int64) error
+	MaxDeviceSize() int64
+	FilesystemSpace(mountPoint string) (*devicemapper.FilesystemSpace, error)
+	MountDeviceWithOpts(ctx context.Context, devicePath, mountPoint, options string) error
 	IsMounted(mountPoint string) (bool, error)
 	UnmountDevice(ctx context.Context, mountPoint string) error
 	DeactivateDevice(ctx context.Context, deviceName string) error
@@ -57,14 +72,154 @@ type DeviceManager interface {
 	GetDevicePath(deviceName string) string
 }
 
+// ObjectStreamer downloads an image while handing its body to consume; see
+// Dependencies.Stream. *s3.Client implements it.
+type ObjectStreamer interface {
+	StreamImage(ctx context.Context, bucket, key, destPath string, consume func(io.Reader) error) (*s3.DownloadResult, error)
+}
+
 // Dependencies holds external dependencies for the Unpack FSM.
 type Dependencies struct {
 	DB          DatabaseManager
 	DeviceMgr   DeviceManager
 	Extractor   *extraction.Extractor
 	PoolName    string
-	MountRoot   string // Base directory for temporary mounts, e.g. /mnt/flyio
-	DefaultSize int64  // Default device size in bytes if not specified
+	MountRoot   string                  // Base directory for temporary mounts, e.g. /mnt/flyio
+	DefaultSize int64                   // Default device size in bytes if not specified
+	Filesystem  devicemapper.Filesystem // Filesystem for new devices (default: ext4)
+	// MountOptions are passed to mount -o when mounting a device for
+	// extraction. Empty uses devicemapper.DefaultMountOptions.
+	MountOptions string
+	// SizeOverhead sizes devices from the tarball: the total size of its regular
+	// files is scaled by this factor. Zero disables estimation, leaving
+	// DefaultSize for requests without an explicit DeviceSize.
+	SizeOverhead float64
+	// EnableJournal keeps the ext4 journal on new devices. Off by default; when on,
+	// the pool is given longer to settle after each devicemapper operation.
+	EnableJournal bool
+	// BestEffortExtract skips archive entries that fail to extract instead of
+	// aborting the image; security violations still abort. Meant for
+	// pre-warming, where a mostly complete rootfs is better than none.
+	BestEffortExtract bool
+	// StripComponents strips leading path components from archive entries, for
+	// tarballs that wrap the rootfs in a top-level directory (e.g. "rootfs/").
+	// ImageUnpackRequest.StripComponents overrides it per image.
+	StripComponents int
+	// RootfsSubdir extracts images into a rootfs/ subdirectory of the device
+	// instead of its root, for consumers that expect that layout. verifyLayout
+	// then requires the root filesystem there, and the layout is recorded
+	// with the unpacked image.
+	RootfsSubdir bool
+	// MaxFiles and MaxTotalSize cap the number of entries and total bytes
+	// extracted per image. Zero uses the extraction package defaults.
+	MaxFiles     int
+	MaxTotalSize int64
+	// WriteConcurrency is how many regular files are written at once during
+	// extraction. Zero or one writes them one at a time, in archive order.
+	WriteConcurrency int
+	// KeepMounted leaves the device mounted and active after update-db, for
+	// inspecting a bad image. It bypasses the unmount and deactivate that
+	// make snapshotting the origin safe, so the image must not be activated
+	// until the device has been unmounted and deactivated by hand.
+	KeepMounted bool
+	// Stream, if set, extracts requests that name an S3 object (S3Key) while
+	// downloading them to LocalPath, in one pass, instead of reading a
+	// LocalPath downloaded beforehand. The image is recorded as downloaded
+	// once the stream's checksum has been checked. Requests whose LocalPath
+	// already exists are extracted from it as usual.
+	Stream ObjectStreamer
+	// Progress, if set, is told how far verify-layout and update-db have
+	// got, so progress displays keep moving after extraction finishes.
+	Progress StepProgressFunc
+	Timeouts PhaseTimeouts
+	Retries  fsm.RetryPolicy
+}
+
+// Steps reported to a StepProgressFunc.
+const (
+	StepVerifyLayout = "verify-layout"
+	StepUpdateDB     = "update-db"
+)
+
+// StepProgressFunc is called as an unpack step works through its units:
+// directories checked for StepVerifyLayout, and the record, unmount,
+// deactivate and settle stages for StepUpdateDB.
+type StepProgressFunc func(step string, done, total int, message string)
+
+// Default transition timeouts, used for PhaseTimeouts fields left at zero.
+const (
+	DefaultCreateDeviceTimeout = 60 * time.Second
+	DefaultExtractTimeout      = 5 * time.Minute
+	DefaultVerifyTimeout       = 30 * time.Second
+	DefaultUpdateDBTimeout     = 30 * time.Second
+)
+
+// PhaseTimeouts bounds the work done by each Unpack transition. Zero fields
+// use the Default*Timeout constants.
+type PhaseTimeouts struct {
+	CreateDevice time.Duration // Device creation, mkfs and mount
+	Extract      time.Duration // Each extraction attempt (a full device is grown and re-extracted)
+	Verify       time.Duration // Filesystem layout verification
+	UpdateDB     time.Duration // Recording the unpacked image
+}
+
+func (t PhaseTimeouts) createDevice() time.Duration {
+	return orDefault(t.CreateDevice, DefaultCreateDeviceTimeout)
+}
+
+func (t PhaseTimeouts) extract() time.Duration { return orDefault(t.Extract, DefaultExtractTimeout) }
+
+func (t PhaseTimeouts) verify() time.Duration { return orDefault(t.Verify, DefaultVerifyTimeout) }
+
+func (t PhaseTimeouts) updateDB() time.Duration { return orDefault(t.UpdateDB, DefaultUpdateDBTimeout) }
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// States of the Unpack FSM. They also key Dependencies.Retries, whose
+// missing entries use the MaxRetries* constants.
+const (
+	StateCheckUnpacked = "check-unpacked"
+	StateCreateDevice  = "create-device"
+	StateExtractLayers = "extract-layers"
+	StateVerifyLayout  = "verify-layout"
+	StateUpdateDB      = "update-db"
+)
+
+// mountOptions returns the options devices are mounted with for extraction.
+func (d *Dependencies) mountOptions() string {
+	if d.MountOptions != "" {
+		return d.MountOptions
+	}
+	return devicemapper.DefaultMountOptions
+}
+
+// progress reports step progress to d.Progress, if set.
+func (d *Dependencies) progress(step string, done, total int, message string) {
+	if d.Progress != nil {
+		d.Progress(step, done, total, message)
+	}
+}
+
+// journaled reports whether new devices carry a journal that must be flushed
+// before devicemapper operations are safe. XFS always has a log but is not
+// covered by the no-journal tuning below, so only ext4 is considered.
+func (d *Dependencies) journaled() bool {
+	return d.EnableJournal && d.Filesystem != devicemapper.FilesystemXFS
+}
+
+// streams reports whether msg is extracted while it downloads (see Stream):
+// it names an S3 object and nothing has been downloaded to LocalPath yet.
+func (d *Dependencies) streams(msg *ImageUnpackRequest) bool {
+	if d.Stream == nil || msg.S3Key == "" {
+		return false
+	}
+	_, err := os.Stat(msg.LocalPath)
+	return os.IsNotExist(err)
 }
 
 // ImageUnpackRequest and ImageUnpackResponse reuse the shared types from the
@@ -72,23 +227,167 @@ type Dependencies struct {
 type ImageUnpackRequest = fsm.ImageUnpackRequest
 type ImageUnpackResponse = fsm.ImageUnpackResponse
 
-// deviceNameForImage returns the devicemapper device name for an image.
+// DeviceNameForImage returns the devicemapper device name an image's device
+// gets when its preferred device ID (DeviceIDForImage) is free, which is the
+// case unless another image or snapshot already holds it. Transitions use
+// imageDevice for the allocated name.
+func DeviceNameForImage(imageID string) string {
+	return DeviceNameForID(DeviceIDForImage(imageID))
+}
+
+// DeviceNameForID returns the devicemapper device name for a thin device ID.
 //
 // Naming contract
 //   - devicemapper.CreateThinDevice currently creates devices named
 //     "thin-<device_id>" (see devicemapper/dm.go).
 //   - All Unpack FSM transitions that compute mount points or DB paths MUST
-//     use this helper so that:
+//     get the name from imageDevice so that:
 //   - createDevice mounts the same name that extractLayers/verifyLayout
 //     and updateDB later reference, and
 //   - the unpacked_images table stores a device_name that actually exists
 //     in devicemapper.
 //
-// This function is part of the durable idempotency story: given the same
-// imageID we derive the same device ID and hence the same device name,
-// allowing checkUnpacked to correlate database records with real devices.
-func deviceNameForImage(imageID string) string {
-	return fmt.Sprintf("thin-%s", deviceIDForImage(imageID))
+// This is part of the durable idempotency story: the device ID allocated to an
+// imageID is recorded in device_ids, so the same image always gets the same
+// device name, allowing checkUnpacked to correlate database records with real
+// devices.
+func DeviceNameForID(deviceID string) string {
+	return fmt.Sprintf("thin-%s", deviceID)
+}
+
+// imageDevice returns the thin device ID allocated to imageID and the device
+// name derived from it. The first call allocates an ID, preferring
+// DeviceIDForImage; later calls, including from retries and resumed runs,
+// return the same one.
+func imageDevice(ctx context.Context, deps *Dependencies, imageID string) (deviceID, deviceName string, err error) {
+	preferred, _ := strconv.ParseUint(DeviceIDForImage(imageID), 10, 32)
+	deviceID, err = deps.DB.AllocateDeviceID(ctx, database.ImageDeviceOwner(imageID), uint32(preferred))
+	if err != nil {
+		if errors.Is(err, database.ErrDeviceIDsExhausted) {
+			return "", "", fsm.Abort(err)
+		}
+		return "", "", fmt.Errorf("failed to allocate device ID: %w", err)
+	}
+	return deviceID, DeviceNameForID(deviceID), nil
+}
+
+// DefaultSizeOverhead is the suggested Dependencies.SizeOverhead. It leaves
+// room for block rounding of small files, inodes, directories and the
+// filesystem's own metadata.
+const DefaultSizeOverhead = 1.5
+
+// minEstimatedDeviceSize is the smallest device EstimateDeviceSize returns, so
+// tiny images still get room for filesystem metadata.
+const minEstimatedDeviceSize = 256 * 1024 * 1024
+
+// EstimateDeviceSize returns a device size for an image whose regular files
+// total contentBytes: contentBytes scaled by overhead, rounded up to a whole
+// MiB and at least 256MiB.
+func EstimateDeviceSize(contentBytes int64, overhead float64) int64 {
+	const mib = 1024 * 1024
+	size := int64(math.Ceil(float64(contentBytes) * overhead))
+	size = (size + mib - 1) / mib * mib
+	return max(size, minEstimatedDeviceSize)
+}
+
+// stripComponentsForRequest returns the leading path components stripped from
+// a request's archive entries: the request's override, else the configured default.
+func stripComponentsForRequest(deps *Dependencies, msg *ImageUnpackRequest) int {
+	if msg.StripComponents != nil {
+		return *msg.StripComponents
+	}
+	return deps.StripComponents
+}
+
+// deviceSizeForRequest returns the size of the thin device created for a request:
+// the requested DeviceSize, else an estimate from the tarball when
+// Dependencies.SizeOverhead is set, else Dependencies.DefaultSize, else 10GiB.
+// Estimates are capped at the device manager's maximum device size; a tarball
+// that cannot be scanned, or has not been downloaded yet because it will be
+// streamed, falls back to the default.
+func deviceSizeForRequest(ctx context.Context, deps *Dependencies, msg *ImageUnpackRequest, logger logrus.FieldLogger) int64 {
+	if msg.DeviceSize > 0 {
+		return msg.DeviceSize
+	}
+	if deps.SizeOverhead > 0 && !deps.streams(msg) {
+		contentBytes, err := extraction.ScanTotalBytes(ctx, msg.LocalPath, extraction.CompressionAuto)
+		if err == nil {
+			size := EstimateDeviceSize(contentBytes, deps.SizeOverhead)
+			if maxSize := deps.DeviceMgr.MaxDeviceSize(); maxSize > 0 && size > maxSize {
+				size = maxSize
+			}
+			logger.WithFields(map[string]any{
+				"content_bytes": contentBytes,
+				"overhead":      deps.SizeOverhead,
+				"size_bytes":    size,
+			}).Debug("estimated device size from tarball")
+			return size
+		}
+		logger.WithError(err).Warn("failed to scan tarball for device size; using default size")
+	}
+	if deps.DefaultSize > 0 {
+		return deps.DefaultSize
+	}
+	// Default to 10GiB
+	return 10 * 1024 * 1024 * 1024
+}
+
+// isNoSpaceError reports whether an extraction error was caused by the device filling up.
+func isNoSpaceError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || strings.Contains(err.Error(), "no space left on device")
+}
+
+// ErrInsufficientSpace is returned, wrapped in fsm.Abort, when the preflight finds
+// an archive will not fit on its device even at the maximum device size.
+var ErrInsufficientSpace = errors.New("image does not fit on device")
+
+// preflightHeadroom is the fraction of an archive's estimated footprint kept free
+// on top of it, for directories, extended attributes and filesystem metadata.
+const preflightHeadroom = 0.05
+
+// spacePreflight is the outcome of comparing an archive with its device's filesystem.
+type spacePreflight struct {
+	NeedBytes  int64  // Estimated footprint, with headroom
+	NeedInodes uint64 // Entries, with headroom
+	GrowTo     int64  // Device size to grow to before extracting; 0 if the archive already fits
+}
+
+// checkSpace compares an archive with the free space on the filesystem of a
+// sizeBytes device, which can be grown up to maxSize. Each entry is charged a
+// block on top of the file sizes, since small files and directories take at
+// least one. Growing a device grows its inode table with it, so free inodes are
+// scaled by the growth. It returns an error wrapping ErrInsufficientSpace if the
+// archive will not fit at maxSize.
+func checkSpace(stats extraction.ArchiveStats, space *devicemapper.FilesystemSpace, sizeBytes, maxSize int64) (spacePreflight, error) {
+	pf := spacePreflight{
+		NeedBytes:  int64(math.Ceil(float64(stats.TotalBytes+int64(stats.Entries)*space.BlockSize) * (1 + preflightHeadroom))),
+		NeedInodes: uint64(math.Ceil(float64(stats.Entries) * (1 + preflightHeadroom))),
+	}
+
+	freeBytes := space.FreeBytes
+	freeInodes := space.FreeInodes
+	growTo := sizeBytes
+	if pf.NeedBytes > freeBytes {
+		const mib = 1024 * 1024
+		growTo = (sizeBytes + pf.NeedBytes - freeBytes + mib - 1) / mib * mib
+	}
+	if space.TotalInodes > 0 && pf.NeedInodes > freeInodes && sizeBytes > 0 {
+		// Size at which the inode table (growing in proportion) has room.
+		short := float64(pf.NeedInodes - freeInodes)
+		growTo = max(growTo, sizeBytes+int64(math.Ceil(short/float64(space.TotalInodes)*float64(sizeBytes))))
+	}
+	if growTo == sizeBytes {
+		return pf, nil
+	}
+
+	if maxSize > 0 && growTo > maxSize {
+		if pf.NeedBytes-freeBytes > maxSize-sizeBytes {
+			return pf, fmt.Errorf("%w: needs %d bytes, %d free and the device can grow by %d", ErrInsufficientSpace, pf.NeedBytes, freeBytes, maxSize-sizeBytes)
+		}
+		return pf, fmt.Errorf("%w: needs %d inodes, %d free even at the maximum device size", ErrInsufficientSpace, pf.NeedInodes, freeInodes)
+	}
+	pf.GrowTo = growTo
+	return pf, nil
 }
 
 // cleanupDevice performs safe cleanup of a thin device in the correct order:
@@ -107,7 +406,7 @@ func cleanupDevice(ctx context.Context, deps *Dependencies, imageID string) {
 	// This is a deliberate trade-off: we accept resource leakage to prevent kernel panic.
 
 	logger := logrus.WithField("image_id", imageID)
-	deviceName := deviceNameForImage(imageID)
+	deviceName := DeviceNameForImage(imageID)
 
 	logger.WithField("device_name", deviceName).Warn("cleanup: skipping device cleanup to prevent kernel panic (device will be orphaned)")
 
@@ -119,40 +418,79 @@ func cleanupDevice(ctx context.Context, deps *Dependencies, imageID string) {
 	// A separate cleanup process should handle orphaned devices when the system is stable.
 }
 
-// stabilizePool forces the dm-thin pool to commit metadata and waits for kernel to settle.
-// This MUST be called after any devicemapper operation (create device, mkfs, mount, unmount,
-// create snapshot, activate snapshot) to prevent kernel panics from operations happening
-// too close together.
-//
-// The dm-thin subsystem has internal state that needs time to commit. Without this
-// stabilization, rapid sequential operations cause kernel panics.
-//
-// CRITICAL: Do NOT use 'sync' command here - it can block indefinitely if dm-thin
-// devices are in a bad state, causing cascading D-state hangs.
-//
-// PERFORMANCE: With ext4 journaling disabled (-O ^has_journal), we can reduce delays.
-// The primary purpose is now just udev synchronization and metadata commit.
-func stabilizePool(poolName string) {
-	// PERFORMANCE OPTIMIZED: Minimal stabilization for dm-thin pool.
-	// With ext4 journaling disabled and 1ms sleeps proven stable, we only need
-	// a single metadata commit cycle and quick udev check.
+// stabilizePool runs devicemapper.StabilizePool after a devicemapper
+// operation. When journaled is true the journal may still be flushing, so
+// udev is given a real settle timeout and the pool a short grace period
+// afterwards.
+func stabilizePool(ctx context.Context, poolName string, journaled bool) {
+	if !journaled {
+		stabilizeDevicePool(ctx, poolName, 0)
+		return
+	}
+	stabilizeDevicePool(ctx, poolName, journaledSettleTimeout)
+	select {
+	case <-time.After(journaledSettleDelay):
+	case <-ctx.Done():
+	}
+}
+
+// stabilizeDevicePool commits pool metadata and settles udev for
+// stabilizePool. Tests replace it.
+var stabilizeDevicePool = devicemapper.StabilizePool
+
+// extractTarball runs the extraction in extractLayers. Tests replace it.
+var extractTarball = (*extraction.Extractor).Extract
+
+// extractStream runs the extraction in streamTarball. Tests replace it.
+var extractStream = (*extraction.Extractor).ExtractReader
 
-	// Force pool metadata commit using reserve/release metadata snapshot
-	// Skip the initial release - it's redundant and causes "No snapshot found" warnings
-	exec.Command("dmsetup", "message", poolName, "0", "reserve_metadata_snap").Run()
-	exec.Command("dmsetup", "message", poolName, "0", "release_metadata_snap").Run()
+// Settle delays used when new devices carry an ext4 journal. The unmount wait
+// matches the delay used before journaling was disabled.
+const (
+	journaledSettleTimeout = 5 * time.Second
+	journaledSettleDelay   = 500 * time.Millisecond
+	journaledUnmountWait   = 2 * time.Second
+)
+
+// ErrOrphanedDevice matches every *OrphanedDeviceError with errors.Is.
+var ErrOrphanedDevice = errors.New("orphaned device requires manual cleanup")
+
+// OrphanedDeviceError reports an image's thin device that exists in the pool
+// without an unpacked_images record, left behind by an interrupted run or a
+// failed create. The unpack aborts rather than extract into a device holding
+// unknown data, and never deletes it (see cleanupDevice);
+// "flyio-image-manager fix-orphan" removes it so the image can be processed again.
+type OrphanedDeviceError struct {
+	DeviceName string
+	DeviceID   string
+	Err        error // The create error, if the device was left by a failed create
+}
 
-	// Quick udev settle with zero timeout - just process pending events, don't wait
-	exec.Command("udevadm", "settle", "--timeout=0").Run()
+func (e *OrphanedDeviceError) Error() string {
+	msg := fmt.Sprintf("orphaned device %s (id %s) exists without database record", e.DeviceName, e.DeviceID)
+	if e.Err != nil {
+		msg = fmt.Sprintf("orphaned device %s (id %s) left by failed creation (%v)", e.DeviceName, e.DeviceID, e.Err)
+	}
+	return msg + fmt.Sprintf("; run 'flyio-image-manager fix-orphan --device-name %s --force' to remove it", e.DeviceName)
 }
 
-// deviceIDForImage returns a numeric device ID derived from the image ID.
-// Device IDs must fit within devicemapper's 24-bit limitation (max 16777215).
-func deviceIDForImage(imageID string) string {
+func (e *OrphanedDeviceError) Is(target error) bool {
+	return target == ErrOrphanedDevice
+}
+
+func (e *OrphanedDeviceError) Unwrap() error {
+	return e.Err
+}
+
+// DeviceIDForImage returns the preferred device ID for an image, derived from
+// the image ID. Different images can share a preferred ID, so the ID actually
+// used is allocated by imageDevice. Device IDs must fit within devicemapper's
+// 24-bit limitation (max 16777215).
+func DeviceIDForImage(imageID string) string {
 	// Use the lower 16 characters of the hex portion of imageID and interpret
 	// as hex. Apply modulo to ensure it fits in 24 bits.
 	const prefix = "img_"
-	const maxDeviceID = 16777215 // 2^24 - 1
+	const maxDeviceID = database.MaxDeviceID
 	hexPart := imageID
 	if len(imageID) > len(prefix) && imageID[:len(prefix)] == prefix {
 		hexPart = imageID[len(prefix):]
@@ -163,8 +501,11 @@ func deviceIDForImage(imageID string) string {
 	if n, err := strconv.ParseUint(hexPart, 16, 64); err == nil {
 		return fmt.Sprintf("%d", n%maxDeviceID)
 	}
-	// Fallback: ULID time modulo max device ID
-	return fmt.Sprintf("%d", ulid.Make().Time()%maxDeviceID)
+	// Fallback for IDs without a hex part: hash the whole ID, so the
+	// preference is still the same every time.
+	h := fnv.New32a()
+	h.Write([]byte(imageID))
+	return fmt.Sprintf("%d", h.Sum32()%maxDeviceID)
 }
 
 // checkUnpacked verifies if the image has already been unpacked into a valid
@@ -179,8 +520,8 @@ func checkUnpacked(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageU
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for database operations
-		if retryCount > MaxRetriesCheckUnpacked {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for check-unpacked transition", MaxRetriesCheckUnpacked))
+		if limit := deps.Retries.Limit(StateCheckUnpacked, MaxRetriesCheckUnpacked); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for check-unpacked transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -264,13 +605,15 @@ func checkUnpacked(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageU
 		}
 
 		resp := &ImageUnpackResponse{
-			ImageID:    record.ImageID,
-			DeviceID:   record.DeviceID,
-			DeviceName: record.DeviceName,
-			DevicePath: record.DevicePath,
-			SizeBytes:  record.SizeBytes,
-			FileCount:  record.FileCount,
-			Unpacked:   false,
+			ImageID:         record.ImageID,
+			DeviceID:        record.DeviceID,
+			DeviceName:      record.DeviceName,
+			DevicePath:      record.DevicePath,
+			SizeBytes:       record.SizeBytes,
+			FileCount:       record.FileCount,
+			DeviceSizeBytes: record.DeviceSizeBytes,
+			Layout:          record.Layout,
+			Unpacked:        false,
 		}
 
 		// Use the current run's version for Handoff to properly signal FSM completion
@@ -287,8 +630,8 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for devicemapper operations
-		if retryCount > MaxRetriesCreateDevice {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for create-device transition", MaxRetriesCreateDevice))
+		if limit := deps.Retries.Limit(StateCreateDevice, MaxRetriesCreateDevice); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for create-device transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -297,28 +640,24 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 
 		imageID := req.Msg.ImageID
 
-		deviceID := deviceIDForImage(imageID)
-		deviceName := deviceNameForImage(imageID)
-
-		sizeBytes := req.Msg.DeviceSize
-		if sizeBytes <= 0 {
-			if deps.DefaultSize > 0 {
-				sizeBytes = deps.DefaultSize
-			} else {
-				// Default to 10GiB
-				sizeBytes = 10 * 1024 * 1024 * 1024
-			}
+		deviceID, deviceName, err := imageDevice(ctx, deps, imageID)
+		if err != nil {
+			logger.WithError(err).Error("failed to allocate device ID")
+			return nil, err
 		}
 
+		sizeBytes := deviceSizeForRequest(ctx, deps, req.Msg, logger)
+
 		logger.WithFields(map[string]any{
 			"image_id":    imageID,
 			"device_id":   deviceID,
 			"device_name": deviceName,
 			"size_bytes":  sizeBytes,
+			"fs_type":     deps.Filesystem,
 		}).Info("creating thin device for image")
 
 		// Use timeout for device creation and mount operations
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, 60*time.Second)
+		ctxWithTimeout, cancel := context.WithTimeout(ctx, deps.Timeouts.createDevice())
 		defer cancel()
 
 		// Check if device already exists (idempotency)
@@ -351,7 +690,7 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 				if releaseErr := deps.DB.ReleaseImageLock(ctx, imageID); releaseErr != nil {
 					logger.WithError(releaseErr).Error("failed to release image lock before abort")
 				}
-				return nil, fsm.Abort(fmt.Errorf("orphaned device %s exists without database record; manual cleanup required (reboot and delete device)", deviceName))
+				return nil, fsm.Abort(&OrphanedDeviceError{DeviceName: deviceName, DeviceID: deviceID})
 			}
 
 			// Device exists AND has valid DB record - safe to reuse (true idempotency case)
@@ -364,7 +703,10 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 			}
 		} else {
 			// Create new device
-			info, err = deps.DeviceMgr.CreateThinDevice(ctxWithTimeout, deps.PoolName, deviceID, sizeBytes)
+			info, err = deps.DeviceMgr.CreateThinDeviceWithOpts(ctxWithTimeout, deps.PoolName, deviceID, sizeBytes, devicemapper.CreateThinDeviceOpts{
+				Filesystem:    deps.Filesystem,
+				EnableJournal: deps.EnableJournal,
+			})
 			if err != nil {
 				logger.WithError(err).Error("failed to create thin device")
 				// Distinguish pool exhaustion vs other errors.
@@ -375,6 +717,12 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 					}
 					return nil, fsm.Abort(fmt.Errorf("devicemapper pool full: %w", err))
 				}
+				if devicemapper.IsPoolUnhealthyError(err) {
+					if releaseErr := deps.DB.ReleaseImageLock(ctx, imageID); releaseErr != nil {
+						logger.WithError(releaseErr).Error("failed to release image lock before abort")
+					}
+					return nil, fsm.Abort(fmt.Errorf("devicemapper pool unhealthy: %w", err))
+				}
 				// If device was created between our check and now, treat as success
 				if devicemapper.IsDeviceExistsError(err) {
 					logger.WithField("device_name", deviceName).Info("device created concurrently, reusing")
@@ -395,7 +743,7 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 						if releaseErr := deps.DB.ReleaseImageLock(ctx, imageID); releaseErr != nil {
 							logger.WithError(releaseErr).Error("failed to release image lock before abort")
 						}
-						return nil, fsm.Abort(fmt.Errorf("orphaned device %s detected after failed creation; run 'flyio-image-manager gc --force' to clean up", deviceName))
+						return nil, fsm.Abort(&OrphanedDeviceError{DeviceName: deviceName, DeviceID: deviceID, Err: err})
 					}
 					return nil, fmt.Errorf("failed to create thin device: %w", err)
 				}
@@ -405,7 +753,7 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 			// CreateThinDevice does create_thin + dmsetup create + mkfs.ext4 - all rapid
 			// operations that need time to commit to pool metadata.
 			logger.Debug("stabilizing pool after device creation")
-			stabilizePool(deps.PoolName)
+			stabilizePool(ctx, deps.PoolName, deps.journaled())
 		}
 
 		// Mount the device at a stable mountpoint under MountRoot.
@@ -429,7 +777,7 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 		if isMounted {
 			logger.WithField("mount_point", mountPoint).Info("device already mounted, skipping mount")
 		} else {
-			if err := deps.DeviceMgr.MountDevice(ctxWithTimeout, info.DevicePath, mountPoint); err != nil {
+			if err := deps.DeviceMgr.MountDeviceWithOpts(ctxWithTimeout, info.DevicePath, mountPoint, deps.mountOptions()); err != nil {
 				logger.WithError(err).Error("failed to mount device")
 				// Cleanup on failure only if we just created the device.
 				if !exists {
@@ -442,7 +790,7 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 			// CRITICAL: Stabilize pool after mount to ensure kernel has processed the mount.
 			// Mount operations interact with the dm-thin device and need time to settle.
 			logger.Debug("stabilizing pool after mount")
-			stabilizePool(deps.PoolName)
+			stabilizePool(ctx, deps.PoolName, deps.journaled())
 		}
 
 		logger.WithFields(map[string]any{
@@ -451,10 +799,11 @@ func createDevice(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 		}).Info("thin device ready")
 
 		resp := &ImageUnpackResponse{
-			ImageID:    imageID,
-			DeviceID:   info.DeviceID,
-			DeviceName: info.Name,
-			DevicePath: info.DevicePath,
+			ImageID:         imageID,
+			DeviceID:        info.DeviceID,
+			DeviceName:      info.Name,
+			DevicePath:      info.DevicePath,
+			DeviceSizeBytes: sizeBytes,
 		}
 
 		return fsm.NewResponse(resp), nil
@@ -469,8 +818,8 @@ func extractLayers(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageU
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for extraction operations
-		if retryCount > MaxRetriesExtractLayers {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for extract-layers transition", MaxRetriesExtractLayers))
+		if limit := deps.Retries.Limit(StateExtractLayers, MaxRetriesExtractLayers); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for extract-layers transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -480,24 +829,143 @@ func extractLayers(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageU
 		imageID := req.Msg.ImageID
 		localPath := req.Msg.LocalPath
 
-		mountPoint := filepath.Join(deps.MountRoot, deviceNameForImage(imageID))
+		deviceID, deviceName, err := imageDevice(ctx, deps, imageID)
+		if err != nil {
+			logger.WithError(err).Error("failed to allocate device ID")
+			return nil, err
+		}
+		// Start from the size createDevice used rather than scanning the tarball again
+		sizeBytes := req.W.Msg.DeviceSizeBytes
+		if sizeBytes <= 0 {
+			sizeBytes = deviceSizeForRequest(ctx, deps, req.Msg, logger)
+		}
+		maxSize := deps.DeviceMgr.MaxDeviceSize()
+
+		mountPoint := filepath.Join(deps.MountRoot, deviceName)
+		extractDir := mountPoint
+		if deps.RootfsSubdir {
+			extractDir = filepath.Join(mountPoint, extraction.RootfsDir)
+			if err := os.MkdirAll(extractDir, 0o755); err != nil {
+				logger.WithError(err).Error("failed to create rootfs directory")
+				return nil, fmt.Errorf("failed to create rootfs directory: %w", err)
+			}
+		}
+
+		opts := extraction.DefaultOptions()
+		opts.BestEffort = deps.BestEffortExtract
+		opts.StripComponents = stripComponentsForRequest(deps, req.Msg)
+		if deps.MaxFiles > 0 {
+			opts.MaxFiles = deps.MaxFiles
+		}
+		if deps.MaxTotalSize > 0 {
+			opts.MaxTotalSize = deps.MaxTotalSize
+		}
+		opts.WriteConcurrency = deps.WriteConcurrency
+
+		// Refuse an archive that cannot fit before writing a single byte: a
+		// filesystem that fills up (or runs out of inodes) mid-extraction leaves a
+		// half-populated device behind. A streamed image has not arrived yet, so
+		// there is nothing to scan; it relies on growing the device on ENOSPC.
+		stream := deps.streams(req.Msg)
+		var (
+			stats extraction.ArchiveStats
+			space *devicemapper.FilesystemSpace
+			pf    spacePreflight
+		)
+		if !stream {
+			stats, err = extraction.ScanArchive(ctx, localPath, extraction.CompressionAuto)
+			if err != nil {
+				logger.WithError(err).Error("failed to scan tarball for preflight")
+				return nil, fmt.Errorf("failed to scan tarball: %w", err)
+			}
+			space, err = deps.DeviceMgr.FilesystemSpace(mountPoint)
+			if err != nil {
+				logger.WithError(err).Error("failed to read filesystem space for preflight")
+				return nil, err
+			}
+			pf, err = checkSpace(stats, space, sizeBytes, maxSize)
+		}
+		if err != nil {
+			logger.WithError(err).WithFields(map[string]any{
+				"entries":     stats.Entries,
+				"total_bytes": stats.TotalBytes,
+				"free_bytes":  space.FreeBytes,
+				"free_inodes": space.FreeInodes,
+			}).Error("image does not fit on device; refusing to extract")
+			cleanupDevice(ctx, deps, imageID)
+			if releaseErr := deps.DB.ReleaseImageLock(ctx, imageID); releaseErr != nil {
+				logger.WithError(releaseErr).Error("failed to release image lock before abort")
+			}
+			return nil, fsm.Abort(err)
+		}
+		if pf.GrowTo > 0 {
+			logger.WithFields(map[string]any{
+				"device_name": deviceName,
+				"old_size":    sizeBytes,
+				"new_size":    pf.GrowTo,
+				"need_bytes":  pf.NeedBytes,
+				"need_inodes": pf.NeedInodes,
+			}).Info("growing device before extraction to fit the image")
+			if err := deps.DeviceMgr.ResizeThinDevice(ctx, deps.PoolName, deviceName, deviceID, pf.GrowTo); err != nil {
+				logger.WithError(err).Error("failed to grow device before extraction")
+				return nil, fmt.Errorf("failed to grow device before extraction: %w", err)
+			}
+			sizeBytes = pf.GrowTo
+		}
 
 		logger.WithFields(map[string]any{
-			"image_id":    imageID,
-			"local_path":  localPath,
-			"mount_point": mountPoint,
+			"image_id":         imageID,
+			"local_path":       localPath,
+			"mount_point":      mountPoint,
+			"extract_dir":      extractDir,
+			"strip_components": opts.StripComponents,
+			"entries":          stats.Entries,
+			"total_bytes":      stats.TotalBytes,
+			"stream":           stream,
 		}).Info("extracting image layers")
 
-		// Use generous timeout for extraction (large images can take time)
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, 5*time.Minute)
-		defer cancel()
+		var result *extraction.ExtractionResult
+		for {
+			// Use generous timeout for extraction (large images can take time)
+			ctxWithTimeout, cancel := context.WithTimeout(ctx, deps.Timeouts.extract())
+			if stream {
+				// Only the first pass streams; once the image is on disk,
+				// re-extraction after growing the device reads localPath
+				result, err = streamTarball(ctxWithTimeout, deps, req.Msg, extractDir, opts, logger)
+				stream = false
+			} else {
+				result, err = extractTarball(deps.Extractor, ctxWithTimeout, localPath, extractDir, opts)
+			}
+			cancel()
 
-		opts := extraction.DefaultOptions()
-		result, err := deps.Extractor.Extract(ctxWithTimeout, localPath, mountPoint, opts)
+			// The device size is an estimate. When the filesystem fills up, grow the
+			// device in place and re-extract (extraction overwrites existing entries)
+			// rather than throwing away the device and starting over.
+			if err == nil || !isNoSpaceError(err) || sizeBytes >= maxSize {
+				break
+			}
+
+			newSize := min(sizeBytes*2, maxSize)
+			logger.WithFields(map[string]any{
+				"device_name": deviceName,
+				"old_size":    sizeBytes,
+				"new_size":    newSize,
+			}).Warn("device ran out of space during extraction; growing device and retrying")
+
+			if resizeErr := deps.DeviceMgr.ResizeThinDevice(ctx, deps.PoolName, deviceName, deviceID, newSize); resizeErr != nil {
+				logger.WithError(resizeErr).Error("failed to grow device after running out of space")
+				err = fmt.Errorf("%w (device resize failed: %v)", err, resizeErr)
+				break
+			}
+			sizeBytes = newSize
+		}
 		if err != nil {
 			logger.WithError(err).Error("tar extraction failed; cleaning up device")
 			// Cleanup on failure: unmount and delete device.
 			cleanupDevice(ctx, deps, imageID)
+			if extraction.IsSecurityViolation(err) {
+				quarantine(ctx, deps, imageID, fmt.Sprintf("tar extraction failed: %v", err), logger)
+			}
 			// Release lock before aborting
 			if releaseErr := deps.DB.ReleaseImageLock(ctx, imageID); releaseErr != nil {
 				logger.WithError(releaseErr).Error("failed to release image lock before abort")
@@ -506,20 +974,60 @@ func extractLayers(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageU
 		}
 
 		logger.WithFields(map[string]any{
-			"files": result.FilesExtracted,
-			"bytes": result.BytesExtracted,
+			"files":   result.FilesExtracted,
+			"bytes":   result.BytesExtracted,
+			"skipped": len(result.SkippedEntries),
 		}).Info("extraction completed successfully")
+		for _, entry := range result.SkippedEntries {
+			logger.WithError(entry.Err).WithField("path", entry.Path).Warn("entry skipped during best-effort extraction")
+		}
 
+		// The device may have grown above; update-db records the final size
 		resp := &ImageUnpackResponse{
-			ImageID:   imageID,
-			SizeBytes: result.BytesExtracted,
-			FileCount: result.FilesExtracted,
+			ImageID:         imageID,
+			SizeBytes:       result.BytesExtracted,
+			FileCount:       result.FilesExtracted,
+			DeviceSizeBytes: sizeBytes,
 		}
 
 		return fsm.NewResponse(resp), nil
 	}
 }
 
+// streamTarball extracts the object msg names into extractDir while Stream
+// downloads it to msg.LocalPath, and records the image as downloaded once the
+// stream's checksum has been checked. If the device fills up, the rest of the
+// object is still downloaded so the extraction can be repeated from
+// msg.LocalPath after growing the device; the ENOSPC error is returned.
+func streamTarball(ctx context.Context, deps *Dependencies, msg *ImageUnpackRequest, extractDir string, opts extraction.ExtractionOptions, logger logrus.FieldLogger) (*extraction.ExtractionResult, error) {
+	var (
+		result     *extraction.ExtractionResult
+		extractErr error
+	)
+	download, err := deps.Stream.StreamImage(ctx, msg.Bucket, msg.S3Key, msg.LocalPath, func(r io.Reader) error {
+		result, extractErr = extractStream(deps.Extractor, ctx, r, extractDir, opts)
+		if extractErr != nil && isNoSpaceError(extractErr) {
+			return nil
+		}
+		return extractErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sum := checksum.Checksum{Algo: download.ChecksumAlgo, Hex: download.Checksum}
+	if err := deps.DB.StoreImageMetadata(ctx, msg.ImageID, msg.S3Key, download.LocalPath, sum, download.SizeBytes); err != nil {
+		return nil, fmt.Errorf("failed to record streamed download: %w", err)
+	}
+	logger.WithFields(map[string]any{
+		"local_path": download.LocalPath,
+		"checksum":   download.Checksum,
+		"size":       download.SizeBytes,
+	}).Info("image downloaded while extracting")
+
+	return result, extractErr
+}
+
 // verifyLayout performs additional filesystem layout and security checks on the
 // unpacked rootfs. The extraction package already enforces strong safety
 // guarantees (path sanitization, symlink safety, size limits, permission
@@ -535,8 +1043,8 @@ func verifyLayout(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for filesystem verification
-		if retryCount > MaxRetriesVerifyLayout {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for verify-layout transition", MaxRetriesVerifyLayout))
+		if limit := deps.Retries.Limit(StateVerifyLayout, MaxRetriesVerifyLayout); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for verify-layout transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -544,7 +1052,11 @@ func verifyLayout(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 		}
 
 		imageID := req.Msg.ImageID
-		deviceName := deviceNameForImage(imageID)
+		_, deviceName, err := imageDevice(ctx, deps, imageID)
+		if err != nil {
+			logger.WithError(err).Error("failed to allocate device ID")
+			return nil, err
+		}
 		mountPoint := filepath.Join(deps.MountRoot, deviceName)
 
 		logger.WithFields(map[string]any{
@@ -553,7 +1065,7 @@ func verifyLayout(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 		}).Info("verifying filesystem layout")
 
 		// Use timeout for filesystem verification
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, 30*time.Second)
+		ctxWithTimeout, cancel := context.WithTimeout(ctx, deps.Timeouts.verify())
 		defer cancel()
 
 		// Check for timeout before proceeding
@@ -561,14 +1073,22 @@ func verifyLayout(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 			return nil, fmt.Errorf("verification timeout: %w", ctxWithTimeout.Err())
 		}
 
-		cleanupAndAbort := func(msg string, err error) (*fsm.Response[ImageUnpackResponse], error) {
-			if err != nil {
-				logger.WithError(err).Error(msg)
+		cleanupAndAbort := func(v *layoutViolation) (*fsm.Response[ImageUnpackResponse], error) {
+			msg := v.msg
+			if v.err != nil {
+				logger.WithError(v.err).Error(msg)
 			} else {
 				logger.Error(msg)
 			}
 			// Cleanup resources; treat as unrecoverable for this image.
 			cleanupDevice(ctx, deps, imageID)
+			if v.security {
+				reason := "invalid filesystem layout: " + msg
+				if v.err != nil && v.err.Error() != msg {
+					reason += ": " + v.err.Error()
+				}
+				quarantine(ctx, deps, imageID, reason, logger)
+			}
 			// Release lock before aborting
 			if releaseErr := deps.DB.ReleaseImageLock(ctx, imageID); releaseErr != nil {
 				logger.WithError(releaseErr).Error("failed to release image lock before abort")
@@ -576,84 +1096,163 @@ func verifyLayout(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUn
 			return nil, fsm.Abort(fmt.Errorf("invalid filesystem layout: %s", msg))
 		}
 
-		// First, delegate to the extraction layer's layout verification so we share
-		// common logic for both legacy rootfs/ and direct-root OCI layouts.
-		if err := deps.Extractor.VerifyLayout(mountPoint); err != nil {
-			return cleanupAndAbort("extractor layout verification failed", err)
+		// The checks only stat the mount, but a stat on a wedged device can
+		// block indefinitely, so stop waiting for them at the deadline. They do
+		// not touch devicemapper, so leaving them behind is safe; any cleanup
+		// stays on this goroutine.
+		progress := func(checked, total int) {
+			deps.progress(StepVerifyLayout, checked, total, fmt.Sprintf("Verifying layout (%d/%d checks)", checked, total))
+		}
+		type checked struct {
+			layout    string
+			violation *layoutViolation
+		}
+		done := make(chan checked, 1)
+		go func() {
+			layout, v := checkLayout(deps.Extractor, mountPoint, deps.RootfsSubdir, logger, progress)
+			done <- checked{layout, v}
+		}()
+
+		var result checked
+		select {
+		case result = <-done:
+		case <-ctxWithTimeout.Done():
+			logger.Error("filesystem verification timed out")
+			return nil, fmt.Errorf("verification timeout: %w", ctxWithTimeout.Err())
+		}
+		if result.violation != nil {
+			return cleanupAndAbort(result.violation)
 		}
 
-		// Determine the logical root directory for container-specific checks. We
-		// mirror the logic in extraction.VerifyLayout: prefer a rootfs/
-		// subdirectory if present, otherwise treat the mount point as the root.
-		rootDir := mountPoint
-		layout := "direct-root"
+		logger.WithField("layout", result.layout).Info("filesystem layout verified")
 
-		rootfsPath := filepath.Join(mountPoint, "rootfs")
-		if info, err := os.Stat(rootfsPath); err == nil && info.IsDir() {
-			rootDir = rootfsPath
-			layout = "rootfs-subdir"
+		// Pass the extraction results through with the layout for update-db
+		var resp ImageUnpackResponse
+		if req.W.Msg != nil {
+			resp = *req.W.Msg
 		}
+		resp.Layout = result.layout
+		return fsm.NewResponse(&resp), nil
+	}
+}
 
-		logger = logger.WithField("layout", layout)
+// layoutViolation is a reason verifyLayout rejects an unpacked filesystem.
+// A security violation also quarantines the image.
+type layoutViolation struct {
+	msg      string
+	err      error
+	security bool
+}
 
-		// Expected top-level directories under the logical root for a reasonably
-		// complete container image. We check for common directories but only require
-		// that at least ONE exists (to ensure we extracted something meaningful).
-		// Some minimal images may only have etc/ or bin/, which is valid.
-		expectedDirs := []string{"etc", "usr", "var", "bin", "lib", "home"}
-		foundCount := 0
-		for _, dir := range expectedDirs {
-			fullPath := filepath.Join(rootDir, dir)
-			if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
-				foundCount++
-				logger.WithField("dir", dir).Debug("found expected directory")
-			}
-		}
-		if foundCount == 0 {
-			return cleanupAndAbort("no standard directories found (etc, usr, var, bin, lib, home)",
-				fmt.Errorf("extracted filesystem appears empty or invalid"))
+// quarantine marks an image that failed security validation so it is not
+// processed again until released. The abort is returned whether or not this
+// succeeds.
+func quarantine(ctx context.Context, deps *Dependencies, imageID, reason string, logger logrus.FieldLogger) {
+	logger.WithField("reason", reason).Warn("quarantining image")
+	if err := deps.DB.QuarantineImage(ctx, imageID, reason); err != nil {
+		logger.WithError(err).Error("failed to quarantine image")
+	}
+}
+
+// checkLayout runs verifyLayout's filesystem checks on mountPoint and returns
+// the layout found, or the first violation if the layout is not acceptable.
+// With rootfsSubdir the root filesystem must be under rootfs/; otherwise
+// either layout is accepted. progress is called after each check with the
+// number done and the total.
+func checkLayout(extractor *extraction.Extractor, mountPoint string, rootfsSubdir bool, logger logrus.FieldLogger, progress func(checked, total int)) (string, *layoutViolation) {
+	expectedDirs := []string{"etc", "usr", "var", "bin", "lib", "home"}
+	criticalDirs := []string{"etc", "usr", "bin"}
+	total := 1 + len(expectedDirs) + len(criticalDirs)
+	checked := 0
+	step := func() {
+		checked++
+		progress(checked, total)
+	}
+
+	// First, delegate to the extraction layer's layout verification so we share
+	// common logic for both legacy rootfs/ and direct-root OCI layouts.
+	if err := extractor.VerifyLayout(mountPoint); err != nil {
+		return "", &layoutViolation{"extractor layout verification failed", err, extraction.IsSecurityViolation(err)}
+	}
+	step()
+
+	// Determine the logical root directory for container-specific checks. We
+	// mirror the logic in extraction.VerifyLayout: prefer a rootfs/
+	// subdirectory if present, otherwise treat the mount point as the root.
+	// Images extracted into rootfs/ must have it.
+	rootDir := mountPoint
+	layout := extraction.LayoutDirectRoot
+
+	rootfsPath := filepath.Join(mountPoint, extraction.RootfsDir)
+	if info, err := os.Stat(rootfsPath); err == nil && info.IsDir() {
+		rootDir = rootfsPath
+		layout = extraction.LayoutRootfsSubdir
+	} else if rootfsSubdir {
+		return "", &layoutViolation{"rootfs/ directory missing",
+			fmt.Errorf("image was extracted into %s but it is not a directory", rootfsPath), false}
+	}
+
+	logger = logger.WithField("layout", layout)
+
+	// Expected top-level directories under the logical root for a reasonably
+	// complete container image. We check for common directories but only require
+	// that at least ONE exists (to ensure we extracted something meaningful).
+	// Some minimal images may only have etc/ or bin/, which is valid.
+	foundCount := 0
+	for _, dir := range expectedDirs {
+		fullPath := filepath.Join(rootDir, dir)
+		if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+			foundCount++
+			logger.WithField("dir", dir).Debug("found expected directory")
 		}
-		logger.WithField("found_dirs", foundCount).Info("filesystem layout validated")
+		step()
+	}
+	if foundCount == 0 {
+		return "", &layoutViolation{"no standard directories found (etc, usr, var, bin, lib, home)",
+			fmt.Errorf("extracted filesystem appears empty or invalid"), false}
+	}
+	logger.WithField("found_dirs", foundCount).Info("filesystem layout validated")
 
-		// Permission sanity checks on critical paths. The extraction layer already
-		// rejects some dangerous permissions, but we add an extra belt-and-
-		// suspenders check here aligned with SECURITY.md.
-		checkDir := func(path string) error {
-			info, err := os.Stat(path)
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				return fmt.Errorf("expected directory but found file: %s", path)
-			}
-			mode := info.Mode().Perm()
-			// World-writable directories in critical paths are suspicious and we
-			// treat them as security violations (Abort).
-			if mode&0o002 != 0 {
-				return fmt.Errorf("world-writable directory in critical path: %s", path)
-			}
-			return nil
+	// Permission sanity checks on critical paths. The extraction layer already
+	// rejects some dangerous permissions, but we add an extra belt-and-
+	// suspenders check here aligned with SECURITY.md.
+	checkDir := func(path string) *layoutViolation {
+		info, err := os.Stat(path)
+		if err != nil {
+			return &layoutViolation{err.Error(), err, false}
+		}
+		if !info.IsDir() {
+			err := fmt.Errorf("expected directory but found file: %s", path)
+			return &layoutViolation{err.Error(), err, false}
 		}
+		mode := info.Mode().Perm()
+		// World-writable directories in critical paths are suspicious and we
+		// treat them as security violations (Abort and quarantine).
+		if mode&0o002 != 0 {
+			err := fmt.Errorf("world-writable directory in critical path: %s", path)
+			return &layoutViolation{err.Error(), err, true}
+		}
+		return nil
+	}
 
-		// Only check permissions on directories that actually exist
-		criticalDirs := []string{"etc", "usr", "bin"}
-		for _, dir := range criticalDirs {
-			fullPath := filepath.Join(rootDir, dir)
-			if _, err := os.Stat(fullPath); err == nil {
-				if err := checkDir(fullPath); err != nil {
-					return cleanupAndAbort(err.Error(), err)
-				}
+	// Only check permissions on directories that actually exist
+	for _, dir := range criticalDirs {
+		fullPath := filepath.Join(rootDir, dir)
+		if _, err := os.Stat(fullPath); err == nil {
+			if v := checkDir(fullPath); v != nil {
+				return "", v
 			}
 		}
-
-		logger.Info("filesystem layout verified")
-
-		// Pass through current response state. Any layout violations have already
-		// resulted in Abort, so a nil response here is safe.
-		return nil, nil
+		step()
 	}
+
+	return layout, nil
 }
 
+// updateDBStages is the number of StepUpdateDB progress reports: record,
+// unmount, deactivate, settle.
+const updateDBStages = 4
+
 // updateDB records the unpacked image in SQLite and cleans up mounts. The
 // thin device itself is left available for activation.
 func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpackResponse] {
@@ -662,8 +1261,8 @@ func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpack
 		retryCount := fsm.RetryFromContext(ctx)
 
 		// Enforce retry limit for database operations
-		if retryCount > MaxRetriesUpdateDB {
-			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for update-db transition", MaxRetriesUpdateDB))
+		if limit := deps.Retries.Limit(StateUpdateDB, MaxRetriesUpdateDB); retryCount > limit {
+			return nil, fsm.Abort(fmt.Errorf("exceeded maximum retries (%d) for update-db transition", limit))
 		}
 
 		if retryCount > 0 {
@@ -672,13 +1271,18 @@ func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpack
 
 		imageID := req.Msg.ImageID
 
-		deviceID := deviceIDForImage(imageID)
-		deviceName := deviceNameForImage(imageID)
+		deviceID, deviceName, err := imageDevice(ctx, deps, imageID)
+		if err != nil {
+			logger.WithError(err).Error("failed to allocate device ID")
+			return nil, err
+		}
 		devicePath := deps.DeviceMgr.GetDevicePath(deviceName)
 		mountPoint := filepath.Join(deps.MountRoot, deviceName)
 
 		sizeBytes := req.W.Msg.SizeBytes
+		deviceSizeBytes := req.W.Msg.DeviceSizeBytes
 		fileCount := req.W.Msg.FileCount
+		layout := req.W.Msg.Layout
 
 		logger.WithFields(map[string]any{
 			"image_id":    imageID,
@@ -686,20 +1290,23 @@ func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpack
 			"device_name": deviceName,
 			"device_path": devicePath,
 			"size_bytes":  sizeBytes,
+			"device_size": deviceSizeBytes,
 			"file_count":  fileCount,
+			"layout":      layout,
 		}).Info("updating unpacked image metadata in database")
 
 		// Use timeout for database operations
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, 30*time.Second)
+		ctxWithTimeout, cancel := context.WithTimeout(ctx, deps.Timeouts.updateDB())
 		defer cancel()
 
 		// Write to database FIRST before unmounting (unmount can hang)
-		if err := deps.DB.StoreUnpackedImage(ctxWithTimeout, imageID, deviceID, deviceName, devicePath, sizeBytes, fileCount); err != nil {
+		if err := deps.DB.StoreUnpackedImage(ctxWithTimeout, imageID, deviceID, deviceName, devicePath, sizeBytes, deviceSizeBytes, fileCount, layout); err != nil {
 			logger.WithError(err).Error("failed to store unpacked image in database")
 			return nil, fmt.Errorf("database update failed: %w", err)
 		}
 
 		logger.Info("unpacked image metadata stored successfully")
+		deps.progress(StepUpdateDB, 1, updateDBStages, "Stored metadata, unmounting device")
 
 		// Release the image lock now that unpack is complete
 		// This allows other processes to work with this image (e.g., activation)
@@ -710,6 +1317,25 @@ func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpack
 			logger.Info("released image lock")
 		}
 
+		if deps.KeepMounted {
+			logger.WithFields(map[string]any{
+				"device_name": deviceName,
+				"mount_point": mountPoint,
+			}).Warn("KEEP-MOUNTED: leaving device mounted and active; this bypasses the snapshot-safety unmount and deactivate, do NOT activate this image until the device is unmounted and deactivated")
+			deps.progress(StepUpdateDB, updateDBStages, updateDBStages, "Left mounted at "+mountPoint)
+			return fsm.NewResponse(&ImageUnpackResponse{
+				ImageID:         imageID,
+				DeviceID:        deviceID,
+				DeviceName:      deviceName,
+				DevicePath:      devicePath,
+				SizeBytes:       sizeBytes,
+				FileCount:       fileCount,
+				DeviceSizeBytes: deviceSizeBytes,
+				Layout:          layout,
+				Unpacked:        true,
+			}), nil
+		}
+
 		// CRITICAL: Unmount AND DEACTIVATE the device BEFORE activation/snapshot creation.
 		// According to Linux dm-thin documentation:
 		// "If the origin device that you wish to snapshot is active, you must suspend it
@@ -730,6 +1356,7 @@ func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpack
 		} else {
 			logger.Info("device unmounted successfully (lazy)")
 		}
+		deps.progress(StepUpdateDB, 2, updateDBStages, "Unmounted, deactivating device")
 
 		// Step 2: Wait for lazy unmount to fully detach
 		// Lazy unmount returns immediately but kernel needs time to:
@@ -737,7 +1364,11 @@ func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpack
 		// - Detach inodes from the mount namespace
 		// - Update internal data structures
 		// With ext4 journaling disabled, unmount is faster.
-		time.Sleep(1 * time.Millisecond) // Reduced from 2s
+		if deps.journaled() {
+			time.Sleep(journaledUnmountWait)
+		} else {
+			time.Sleep(1 * time.Millisecond) // Reduced from 2s
+		}
 
 		// Step 3: Deactivate the device completely.
 		// This removes it from /dev/mapper, ensuring zero I/O possibility during snapshot.
@@ -750,22 +1381,26 @@ func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpack
 		} else {
 			logger.Info("device deactivated, origin is now completely inactive")
 		}
+		deps.progress(StepUpdateDB, 3, updateDBStages, "Deactivated, waiting for the pool to settle")
 
 		// Step 4: Wait for kernel to fully process the deactivation
 		// Give the kernel time to:
 		// - Flush any remaining dm-thin metadata
 		// - Process pending device mapper events
 		// - Settle udev events
-		stabilizePool(deps.PoolName)
+		stabilizePool(ctx, deps.PoolName, deps.journaled())
+		deps.progress(StepUpdateDB, updateDBStages, updateDBStages, "Pool settled")
 
 		resp := &ImageUnpackResponse{
-			ImageID:    imageID,
-			DeviceID:   deviceID,
-			DeviceName: deviceName,
-			DevicePath: devicePath,
-			SizeBytes:  sizeBytes,
-			FileCount:  fileCount,
-			Unpacked:   true,
+			ImageID:         imageID,
+			DeviceID:        deviceID,
+			DeviceName:      deviceName,
+			DevicePath:      devicePath,
+			SizeBytes:       sizeBytes,
+			FileCount:       fileCount,
+			DeviceSizeBytes: deviceSizeBytes,
+			Layout:          layout,
+			Unpacked:        true,
 		}
 
 		return fsm.NewResponse(resp), nil
@@ -775,11 +1410,12 @@ func updateDB(deps *Dependencies) fsm.Transition[ImageUnpackRequest, ImageUnpack
 // Register registers the Unpack FSM with the manager.
 func Register(ctx context.Context, manager *fsm.Manager, deps *Dependencies) (fsm.Start[ImageUnpackRequest, ImageUnpackResponse], fsm.Resume, error) {
 	return fsm.Register[ImageUnpackRequest, ImageUnpackResponse](manager, "unpack-image").
-		Start("check-unpacked", checkUnpacked(deps)).
-		To("create-device", createDevice(deps)).
-		To("extract-layers", extractLayers(deps)).
-		To("verify-layout", verifyLayout(deps)).
-		To("update-db", updateDB(deps)).
-		End("complete").
+		Start(StateCheckUnpacked, checkUnpacked(deps)).
+		To(StateCreateDevice, createDevice(deps)).
+		To(StateExtractLayers, extractLayers(deps)).
+		To(StateVerifyLayout, verifyLayout(deps)).
+		To(StateUpdateDB, updateDB(deps)).
+		End("complete", fsm.WithFinalizers(fsm.RecordImageFailure[ImageUnpackRequest, ImageUnpackResponse](
+			"unpack", deps.DB, func(r *ImageUnpackRequest) string { return r.ImageID }))).
 		Build(ctx)
 }
@@ -0,0 +1,56 @@
+package unpack
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fsm "github.com/superfly/fsm"
+
+	"github.com/superfly/fsm/extraction"
+)
+
+// TestVerifyLayout_LoweredRetryLimit verifies that a lowered limit aborts a
+// retry the default limit still allows.
+func TestVerifyLayout_LoweredRetryLimit(t *testing.T) {
+	mountRoot := t.TempDir()
+	mountPoint := filepath.Join(mountRoot, DeviceNameForImage("img_1234abcd5678ef00"))
+	for _, d := range []string{"etc", "usr", "var"} {
+		if err := os.MkdirAll(filepath.Join(mountPoint, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deps := &Dependencies{
+		DB:        &fakeDB{},
+		DeviceMgr: &fakeDeviceMgr{},
+		Extractor: extraction.New(),
+		PoolName:  "pool0",
+		MountRoot: mountRoot,
+	}
+	ctx := fsm.MockRetryContext(context.Background(), 2)
+
+	if _, err := verifyLayout(deps)(ctx, slowUnpackRequest()); err != nil {
+		t.Fatalf("verifyLayout() on retry 2 with the default limit error = %v", err)
+	}
+
+	var abortErr *fsm.AbortError
+	deps.Retries = fsm.RetryPolicy{StateVerifyLayout: 1}
+	_, err := verifyLayout(deps)(ctx, slowUnpackRequest())
+	if !errors.As(err, &abortErr) || !strings.Contains(err.Error(), "exceeded maximum retries (1)") {
+		t.Errorf("verifyLayout() on retry 2 with limit 1 error = %v, want a retry-limit abort", err)
+	}
+
+	// Fail fast: the first attempt runs, but there are no retries.
+	deps.Retries = fsm.RetryPolicy{StateVerifyLayout: -1}
+	if _, err := verifyLayout(deps)(context.Background(), slowUnpackRequest()); err != nil {
+		t.Errorf("verifyLayout() first attempt with retries disabled error = %v", err)
+	}
+	_, err = verifyLayout(deps)(fsm.MockRetryContext(context.Background(), 1), slowUnpackRequest())
+	if !errors.As(err, &abortErr) {
+		t.Errorf("verifyLayout() on retry 1 with retries disabled error = %v, want an abort", err)
+	}
+}
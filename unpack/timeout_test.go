@@ -8,11 +8,16 @@ package unpack
 import (
 	"context"
 	"errors"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	fsm "github.com/superfly/fsm"
 	"github.com/superfly/fsm/devicemapper"
+	"github.com/superfly/fsm/extraction"
 )
 
 // MockSlowDeviceManager simulates slow devicemapper operations
@@ -40,7 +45,23 @@ func (m *MockSlowDeviceManager) CreateThinDevice(ctx context.Context, poolName,
 	}
 }
 
-func (m *MockSlowDeviceManager) MountDevice(ctx context.Context, devicePath, mountPoint string) error {
+func (m *MockSlowDeviceManager) CreateThinDeviceWithOpts(ctx context.Context, poolName, deviceID string, sizeBytes int64, opts devicemapper.CreateThinDeviceOpts) (*devicemapper.DeviceInfo, error) {
+	return m.CreateThinDevice(ctx, poolName, deviceID, sizeBytes)
+}
+
+func (m *MockSlowDeviceManager) ResizeThinDevice(ctx context.Context, poolName, deviceName, deviceID string, newSizeBytes int64) error {
+	return nil
+}
+
+func (m *MockSlowDeviceManager) MaxDeviceSize() int64 {
+	return devicemapper.DefaultMaxDeviceSize
+}
+
+func (m *MockSlowDeviceManager) FilesystemSpace(mountPoint string) (*devicemapper.FilesystemSpace, error) {
+	return &devicemapper.FilesystemSpace{BlockSize: 4096, FreeBytes: 1 << 30, FreeInodes: 1 << 16, TotalInodes: 1 << 16}, nil
+}
+
+func (m *MockSlowDeviceManager) MountDeviceWithOpts(ctx context.Context, devicePath, mountPoint, options string) error {
 	select {
 	case <-time.After(m.delay):
 		return nil
@@ -49,6 +70,10 @@ func (m *MockSlowDeviceManager) MountDevice(ctx context.Context, devicePath, mou
 	}
 }
 
+func (m *MockSlowDeviceManager) IsMounted(mountPoint string) (bool, error) {
+	return false, nil
+}
+
 func (m *MockSlowDeviceManager) UnmountDevice(ctx context.Context, mountPoint string) error {
 	return nil
 }
@@ -65,85 +90,98 @@ func (m *MockSlowDeviceManager) GetDevicePath(deviceName string) string {
 	return "/dev/mapper/" + deviceName
 }
 
-// TestCreateDeviceTimeout verifies that createDevice transition respects timeout
+// slowUnpackRequest returns a request for the slow-device tests.
+func slowUnpackRequest() *fsm.Request[ImageUnpackRequest, ImageUnpackResponse] {
+	req := &fsm.Request[ImageUnpackRequest, ImageUnpackResponse]{
+		Msg: &fsm.ImageUnpackRequest{ImageID: "img_1234abcd5678ef00"},
+	}
+	return fsm.MockRequest(req, logrus.New(), fsm.Run{})
+}
+
+// TestCreateDeviceTimeout verifies that createDevice gives up on a slow device
+// creation at Timeouts.CreateDevice.
 func TestCreateDeviceTimeout(t *testing.T) {
-	// Use import alias to avoid undefined reference
-	_ = fsm.ImageUnpackRequest{}
-
-	t.Run("should timeout on slow device creation", func(t *testing.T) {
-		t.Skip("Mock test - demonstrates timeout behavior")
-
-		// This test demonstrates the timeout behavior but is skipped
-		// because it requires full FSM infrastructure
-
-		// In a real scenario with a slow CreateThinDevice (e.g., 90s):
-		// - Without timeout: would hang for 90s
-		// - With 60s timeout: fails at 60s with context.DeadlineExceeded
-
-		slowDeviceMgr := &MockSlowDeviceManager{delay: 90 * time.Second}
-		_ = slowDeviceMgr
-
-		// Expected behavior:
-		// ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-		// defer cancel()
-		//
-		// err := slowDeviceMgr.CreateThinDevice(ctx, "pool", "123", 1024*1024*1024)
-		//
-		// Expected: err == context.DeadlineExceeded
-		// Actual timeout: ~60s (not 90s)
-	})
+	deps := &Dependencies{
+		DB:        &fakeDB{},
+		DeviceMgr: &MockSlowDeviceManager{delay: 10 * time.Second},
+		PoolName:  "pool0",
+		MountRoot: t.TempDir(),
+		Timeouts:  PhaseTimeouts{CreateDevice: 50 * time.Millisecond},
+	}
+
+	start := time.Now()
+	_, err := createDevice(deps)(context.Background(), slowUnpackRequest())
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("createDevice() error = %v, want context.DeadlineExceeded", err)
+	}
+	var abortErr *fsm.AbortError
+	if errors.As(err, &abortErr) {
+		t.Errorf("createDevice() aborted on a timeout, want a retryable error: %v", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("createDevice() took %v, want it bounded by the 50ms timeout", elapsed)
+	}
+}
+
+// TestVerifyLayoutTimeout verifies that verifyLayout fails with a retryable
+// deadline error once Timeouts.Verify has passed, even for a valid layout.
+func TestVerifyLayoutTimeout(t *testing.T) {
+	mountRoot := t.TempDir()
+	mountPoint := filepath.Join(mountRoot, DeviceNameForImage("img_1234abcd5678ef00"))
+	for _, d := range []string{"etc", "usr", "var"} {
+		if err := os.MkdirAll(filepath.Join(mountPoint, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deps := &Dependencies{
+		DB:        &fakeDB{},
+		DeviceMgr: &fakeDeviceMgr{},
+		Extractor: extraction.New(),
+		PoolName:  "pool0",
+		MountRoot: mountRoot,
+		Timeouts:  PhaseTimeouts{Verify: time.Nanosecond},
+	}
+
+	_, err := verifyLayout(deps)(context.Background(), slowUnpackRequest())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("verifyLayout() error = %v, want context.DeadlineExceeded", err)
+	}
+
+	// The same layout passes with the default timeout.
+	deps.Timeouts = PhaseTimeouts{}
+	if _, err := verifyLayout(deps)(context.Background(), slowUnpackRequest()); err != nil {
+		t.Fatalf("verifyLayout() with default timeout error = %v", err)
+	}
 }
 
-// TestTimeoutValues verifies that timeout constants are reasonable
-func TestTimeoutValues(t *testing.T) {
+// TestPhaseTimeoutsDefaults verifies that zero fields fall back to the
+// defaults and that the defaults are reasonable.
+func TestPhaseTimeoutsDefaults(t *testing.T) {
+	var zero PhaseTimeouts
 	tests := []struct {
-		name        string
+		operation   string
 		timeout     time.Duration
 		minExpected time.Duration
 		maxExpected time.Duration
-		operation   string
 	}{
-		{
-			name:        "mount operation should have reasonable timeout",
-			timeout:     30 * time.Second,
-			minExpected: 10 * time.Second,
-			maxExpected: 60 * time.Second,
-			operation:   "mount",
-		},
-		{
-			name:        "device creation should have reasonable timeout",
-			timeout:     60 * time.Second,
-			minExpected: 30 * time.Second,
-			maxExpected: 2 * time.Minute,
-			operation:   "create_device",
-		},
-		{
-			name:        "extraction should have generous timeout",
-			timeout:     5 * time.Minute,
-			minExpected: 2 * time.Minute,
-			maxExpected: 10 * time.Minute,
-			operation:   "extract",
-		},
-		{
-			name:        "cleanup should have reasonable timeout",
-			timeout:     2 * time.Minute,
-			minExpected: 1 * time.Minute,
-			maxExpected: 5 * time.Minute,
-			operation:   "cleanup",
-		},
+		{"create_device", zero.createDevice(), 30 * time.Second, 2 * time.Minute},
+		{"extract", zero.extract(), 2 * time.Minute, 10 * time.Minute},
+		{"verify", zero.verify(), 10 * time.Second, 60 * time.Second},
+		{"update_db", zero.updateDB(), 10 * time.Second, 60 * time.Second},
 	}
 
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if tt.timeout < tt.minExpected {
-				t.Errorf("%s timeout (%v) is too short, minimum expected: %v",
-					tt.operation, tt.timeout, tt.minExpected)
-			}
-			if tt.timeout > tt.maxExpected {
-				t.Errorf("%s timeout (%v) is too long, maximum expected: %v",
-					tt.operation, tt.timeout, tt.maxExpected)
-			}
-		})
+		if tt.timeout < tt.minExpected || tt.timeout > tt.maxExpected {
+			t.Errorf("%s default timeout %v outside [%v, %v]", tt.operation, tt.timeout, tt.minExpected, tt.maxExpected)
+		}
+	}
+
+	custom := PhaseTimeouts{Extract: 20 * time.Minute}
+	if custom.extract() != 20*time.Minute || custom.verify() != DefaultVerifyTimeout {
+		t.Errorf("custom timeouts: extract=%v verify=%v", custom.extract(), custom.verify())
 	}
 }
 
@@ -193,3 +231,32 @@ func TestContextCancellation(t *testing.T) {
 		}
 	})
 }
+
+func TestStabilizePool_CancelledContext(t *testing.T) {
+	var timeouts []time.Duration
+	orig := stabilizeDevicePool
+	stabilizeDevicePool = func(ctx context.Context, poolName string, settleTimeout time.Duration) {
+		timeouts = append(timeouts, settleTimeout)
+	}
+	t.Cleanup(func() { stabilizeDevicePool = orig })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// The journaled grace period ends when the context is cancelled
+	done := make(chan struct{})
+	go func() {
+		stabilizePool(ctx, "pool", true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(journaledSettleDelay / 2):
+		t.Fatal("stabilizePool blocked after its context was cancelled")
+	}
+
+	stabilizePool(ctx, "pool", false)
+	if want := []time.Duration{journaledSettleTimeout, 0}; !slices.Equal(timeouts, want) {
+		t.Errorf("settle timeouts = %v, want %v", timeouts, want)
+	}
+}